@@ -22,6 +22,8 @@ export async function GET(request: NextRequest, { params }: RouteParams) {
     try {
         const sfuResponse = await fetch(`${SFU_URL}/internal/room/${roomId}/status`, {
             method: "GET",
+            // Rooms can be deleted at any time; never serve a stale status
+            cache: "no-store",
         });
 
         if (!sfuResponse.ok) {
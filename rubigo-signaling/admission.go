@@ -0,0 +1,55 @@
+package main
+
+import "net/http"
+
+// Admission control keeps one runaway room from exhausting the host. Rooms
+// are capped by MaxRooms, viewers per room by MaxViewersPerRoom or a lower
+// cap the room was created with, and peer connections overall by
+// MaxPeerConnections. Viewers over their room's cap get 403 room_full;
+// connections over the host's get 429 connection_limit_reached.
+
+// SetMaxViewers caps the room's viewers; zero leaves the server's cap
+func (r *Room) SetMaxViewers(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxViewers = n
+}
+
+// MaxViewers returns the room's own viewer cap, zero if it has none
+func (r *Room) MaxViewers() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.maxViewers
+}
+
+// viewerLimit returns how many viewers room may have: the lower of its own
+// cap and the server's, zero if neither is set
+func (s *Server) viewerLimit(room *Room) int {
+	limit, own := s.cfg.MaxViewersPerRoom, room.MaxViewers()
+	if own > 0 && (limit == 0 || own < limit) {
+		limit = own
+	}
+	return limit
+}
+
+// writeRoomFull writes the 403 for a viewer over its room's cap
+func writeRoomFull(w http.ResponseWriter, viewers, limit int) {
+	writeErrorDetails(w, http.StatusForbidden, errCodeRoomFull, "Room is full",
+		map[string]interface{}{"viewers": viewers, "maxViewers": limit})
+}
+
+// admitPeer reports whether the host has room for another peer connection,
+// writing a 429 if not. The count is taken before the connection is set up,
+// so concurrent requests may overshoot the limit slightly.
+func (s *Server) admitPeer(w http.ResponseWriter) bool {
+	if s.cfg.MaxPeerConnections <= 0 {
+		return true
+	}
+	_, broadcasters, viewers := s.counts()
+	if connections := broadcasters + viewers; connections >= s.cfg.MaxPeerConnections {
+		writeErrorDetails(w, http.StatusTooManyRequests, errCodeConnectionLimit, "Peer connection limit reached",
+			map[string]interface{}{"connections": connections, "maxConnections": s.cfg.MaxPeerConnections})
+		return false
+	}
+	return true
+}
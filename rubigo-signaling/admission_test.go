@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestViewerLimit(t *testing.T) {
+	tests := []struct {
+		server, room, want int
+	}{
+		{0, 0, 0},
+		{5, 0, 5},
+		{0, 3, 3},
+		{5, 2, 2},
+		{5, 10, 5},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.MaxViewersPerRoom = tt.server
+		s := &Server{cfg: cfg}
+		room := &Room{id: "abc", maxViewers: tt.room}
+		if got := s.viewerLimit(room); got != tt.want {
+			t.Errorf("server %d, room %d: limit = %d, want %d", tt.server, tt.room, got, tt.want)
+		}
+	}
+}
+
+func TestAddViewerUpTo(t *testing.T) {
+	track := newLiveTrack(t)
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": track}}
+	for _, id := range []string{"a", "b"} {
+		if err := room.AddViewerUpTo(&viewer{id: id, track: track}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.AddViewerUpTo(&viewer{id: "c", track: track}, 2); !errors.Is(err, errRoomFull) {
+		t.Errorf("third viewer: err = %v, want errRoomFull", err)
+	}
+	if err := room.AddViewerUpTo(&viewer{id: "c", track: track}, 0); err != nil {
+		t.Errorf("unlimited: %v", err)
+	}
+}
+
+func TestSubscribeAdmission(t *testing.T) {
+	offer, _ := json.Marshal(SDPExchange{Type: "offer", SDP: viewerOffer("VP8/90000")})
+	tests := []struct {
+		name     string
+		cfg      func(*Config)
+		room     int
+		wantCode int
+		wantErr  string
+	}{
+		{"room cap", func(*Config) {}, 1, http.StatusForbidden, errCodeRoomFull},
+		{"server cap", func(c *Config) { c.MaxViewersPerRoom = 1 }, 0, http.StatusForbidden, errCodeRoomFull},
+		{"connection cap", func(c *Config) { c.MaxPeerConnections = 2 }, 0, http.StatusTooManyRequests, errCodeConnectionLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			track := newLiveTrack(t)
+			room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": track}, maxViewers: tt.room}
+			store.rooms["abc"] = room
+			// The broadcaster and this viewer make two connections
+			if err := room.AddViewer(&viewer{id: "first", track: track}); err != nil {
+				t.Fatal(err)
+			}
+			cfg := DefaultConfig()
+			tt.cfg(&cfg)
+			h := newServer(t, store, cfg).Handler()
+
+			rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", string(offer))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("subscribe = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			decodeError(t, rec, tt.wantErr)
+		})
+	}
+}
+
+func TestPublishConnectionLimit(t *testing.T) {
+	store := newFakeStore()
+	store.rooms["busy"] = &Room{id: "busy", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	cfg := DefaultConfig()
+	cfg.MaxPeerConnections = 1
+	h := newServer(t, store, cfg).Handler()
+
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: videoOffer(t)})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("publish = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	decodeError(t, rec, errCodeConnectionLimit)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// API keys guard the control plane: with any configured, every /internal
+// route wants one in X-API-Key. Without JWT auth, whose tokens share the
+// header, a bearer token is taken as the key too. Each key has its own rate
+// limit, so one misbehaving client can't starve the others.
+
+// APIKeyConfig configures API keys for /internal routes
+type APIKeyConfig struct {
+	// Keys are accepted as is; with none here or in File the routes are open
+	Keys []string
+	// File holds more keys, one per line; blank lines and lines starting
+	// with # are skipped
+	File string
+	// Requests allowed per second for each key; zero means unlimited
+	Rate  float64
+	Burst int
+}
+
+// apiKeyRing checks keys against the configured ones
+type apiKeyRing struct {
+	// sums are the keys' SHA-256 sums, so comparisons take the same time
+	// whatever the keys' lengths
+	sums    [][sha256.Size]byte
+	limiter *rateLimiter // nil if unlimited
+}
+
+// newAPIKeyRing loads cfg's keys, returning nil if there are none
+func newAPIKeyRing(cfg APIKeyConfig) (*apiKeyRing, error) {
+	keys := cfg.Keys
+	if cfg.File != "" {
+		fileKeys, err := readAPIKeyFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys[:len(keys):len(keys)], fileKeys...)
+	}
+	ring := &apiKeyRing{}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			ring.sums = append(ring.sums, sha256.Sum256([]byte(key)))
+		}
+	}
+	if len(ring.sums) == 0 {
+		return nil, nil
+	}
+	if cfg.Rate > 0 {
+		ring.limiter = newRateLimiter(cfg.Rate, cfg.Burst)
+	}
+	return ring, nil
+}
+
+// readAPIKeyFile reads the keys in path
+func readAPIKeyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// match reports whether key is one of the ring's. Every key is compared, so
+// the time taken doesn't tell which one came close.
+func (ring *apiKeyRing) match(key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	found := 0
+	for i := range ring.sums {
+		found |= subtle.ConstantTimeCompare(sum[:], ring.sums[i][:])
+	}
+	return found == 1
+}
+
+// apiKeyID names key in logs and rate limit buckets without revealing it
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestAPIKey returns the API key r carries, empty if none. The bearer
+// token only stands in for X-API-Key when it isn't a JWT.
+func (s *Server) requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if s.auth == nil {
+		return bearerToken(r)
+	}
+	return ""
+}
+
+// requireAPIKey has next served only to requests carrying a valid API key
+// within its rate limit. Without API keys it returns next as is.
+func (s *Server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	if s.apiKeys == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := s.requestAPIKey(r)
+		if key == "" || !s.apiKeys.match(key) {
+			slog.Warn("Rejected API request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `APIKey header="X-API-Key"`)
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid API key")
+			return
+		}
+		if s.apiKeys.limiter != nil {
+			id := apiKeyID(key)
+			if ok, wait := s.apiKeys.limiter.allow(id); !ok {
+				slog.Warn("API key rate limited", "key", id, "path", r.URL.Path)
+				writeRateLimited(w, wait, "API key rate limit exceeded")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func apiKeyRequest(t *testing.T, h http.Handler, method, path, header, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIKeys.Keys = []string{"key-one", "key-two"}
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	for _, path := range []string{"/internal/rooms", "/internal/room/abc/status", "/internal/ice-servers", "/internal/cascade"} {
+		for _, tc := range []struct{ header, value string }{
+			{"", ""},
+			{"X-API-Key", "wrong"},
+			{"X-API-Key", "key-one-and-more"},
+			{"Authorization", "key-one"},
+		} {
+			rec := apiKeyRequest(t, h, http.MethodGet, path, tc.header, tc.value)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s with %s %q: status = %d, want %d", path, tc.header, tc.value, rec.Code, http.StatusUnauthorized)
+			}
+			decodeError(t, rec, errCodeUnauthorized)
+		}
+	}
+
+	for _, tc := range []struct{ header, value string }{
+		{"X-API-Key", "key-one"},
+		{"X-API-Key", "key-two"},
+		// Without JWT auth the bearer token can carry the key
+		{"Authorization", "Bearer key-two"},
+	} {
+		rec := apiKeyRequest(t, h, http.MethodGet, "/internal/room/abc/status", tc.header, tc.value)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s %q: status = %d, want %d", tc.header, tc.value, rec.Code, http.StatusOK)
+		}
+	}
+
+	// Routes outside /internal stay open
+	if rec := doRequest(t, h, http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("/health status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	// Preflights don't carry the key
+	rec := apiKeyRequest(t, h, http.MethodOptions, "/internal/rooms", "Origin", "https://app.example")
+	if rec.Code != http.StatusOK {
+		t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeysWithJWT(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIKeys.Keys = []string{"key-one"}
+	cfg.JWTSecret = "jwt-secret"
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	// The bearer token is the JWT, so it isn't taken as the key
+	rec := apiKeyRequest(t, h, http.MethodGet, "/internal/room/abc/status", "Authorization", "Bearer key-one")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("bearer key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec = apiKeyRequest(t, h, http.MethodGet, "/internal/room/abc/status", "X-API-Key", "key-one")
+	if rec.Code != http.StatusOK {
+		t.Errorf("X-API-Key: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeysDebugRoutes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIKeys.Keys = []string{"key-one"}
+	cfg.DebugToken = "debug"
+	h := newServer(t, newFakeStore(), cfg).Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/debug/stats", nil)
+	req.Header.Set("Authorization", "Bearer debug")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without key: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("X-API-Key", "key-one")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("with key and token: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIKeys = APIKeyConfig{Keys: []string{"key-one", "key-two"}, Rate: 1, Burst: 2}
+	server := newServer(t, newFakeStore("abc"), cfg)
+	now := time.Unix(1000, 0)
+	server.apiKeys.limiter.now = func() time.Time { return now }
+	h := server.Handler()
+
+	for i := 0; i < 2; i++ {
+		if rec := apiKeyRequest(t, h, http.MethodGet, "/internal/rooms", "X-API-Key", "key-one"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := apiKeyRequest(t, h, http.MethodGet, "/internal/rooms", "X-API-Key", "key-one")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over burst: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	decodeError(t, rec, errCodeRateLimited)
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	// Each key has its own bucket
+	if rec := apiKeyRequest(t, h, http.MethodGet, "/internal/rooms", "X-API-Key", "key-two"); rec.Code != http.StatusOK {
+		t.Errorf("other key: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	now = now.Add(time.Second)
+	if rec := apiKeyRequest(t, h, http.MethodGet, "/internal/rooms", "X-API-Key", "key-one"); rec.Code != http.StatusOK {
+		t.Errorf("after refill: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# deploy keys\nfile-key\n\n  spaced-key  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := newAPIKeyRing(APIKeyConfig{Keys: []string{"flag-key"}, File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"flag-key", "file-key", "spaced-key"} {
+		if !ring.match(key) {
+			t.Errorf("%q not accepted", key)
+		}
+	}
+	for _, key := range []string{"", "# deploy keys", "file"} {
+		if ring.match(key) {
+			t.Errorf("%q accepted", key)
+		}
+	}
+
+	if _, err := newAPIKeyRing(APIKeyConfig{File: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing file accepted")
+	}
+	if ring, err := newAPIKeyRing(APIKeyConfig{Keys: []string{" "}}); ring != nil || err != nil {
+		t.Errorf("blank keys = %v, %v; want no ring", ring, err)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles a token can grant in its room
+const (
+	roleBroadcaster = "broadcaster"
+	roleViewer      = "viewer"
+)
+
+const (
+	// jwtLeeway allows for clock skew between token issuer and server
+	jwtLeeway = 30 * time.Second
+	// jwksRefreshInterval is the least time between JWKS fetches, so
+	// tokens with unknown key IDs can't make us hammer the issuer
+	jwksRefreshInterval = 30 * time.Second
+	// jwksMaxAge is how long fetched keys are used before refetching
+	jwksMaxAge = time.Hour
+)
+
+// tokenClaims are the claims publish and subscribe tokens carry. exp is
+// required so a leaked token doesn't grant access forever.
+type tokenClaims struct {
+	RoomID    string  `json:"roomId"`
+	Role      string  `json:"role"`
+	ExpiresAt float64 `json:"exp"`
+	NotBefore float64 `json:"nbf"`
+}
+
+// tokenVerifier checks JWTs signed with a shared secret (HS256) or with a
+// key published at a JWKS URL (RS256, ES256)
+type tokenVerifier struct {
+	secret []byte
+	jwks   *jwksKeys // nil without a JWKS URL
+}
+
+func newTokenVerifier(secret, jwksURL string) *tokenVerifier {
+	v := &tokenVerifier{}
+	if secret != "" {
+		v.secret = []byte(secret)
+	}
+	if jwksURL != "" {
+		v.jwks = &jwksKeys{url: jwksURL, client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	return v
+}
+
+// verify checks token's signature and validity window and returns its
+// claims
+func (v *tokenVerifier) verify(token string, now time.Time) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := v.checkSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	switch {
+	case claims.ExpiresAt == 0:
+		return nil, errors.New("token has no expiry")
+	case now.After(numericDate(claims.ExpiresAt).Add(jwtLeeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Add(jwtLeeway).Before(numericDate(claims.NotBefore)):
+		return nil, errors.New("token not valid yet")
+	case claims.RoomID == "" || claims.Role == "":
+		return nil, errors.New("token needs roomId and role claims")
+	}
+	return &claims, nil
+}
+
+// checkSignature verifies signature over signed with the key alg and kid
+// name. Algorithms are only accepted for the kind of key configured, so an
+// RSA public key can't be passed off as an HMAC secret.
+func (v *tokenVerifier) checkSignature(alg, kid, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "HS256":
+		if v.secret == nil {
+			return errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS256", "ES256":
+		if v.jwks == nil {
+			return fmt.Errorf("%s tokens are not accepted", alg)
+		}
+		key, err := v.jwks.key(kid)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// ES256 signatures are r and s, 32 bytes each
+			if alg == "ES256" && len(signature) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+				return nil
+			}
+		}
+		return errors.New("invalid signature")
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// decodeSegment decodes a base64url JSON part of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericDate converts a JWT NumericDate, in seconds, to a time
+func numericDate(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// jwksKeys caches the public keys published at a JWKS URL, keyed by kid
+type jwksKeys struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching chan struct{} // closed when the fetch in flight ends; nil if none
+	fetchErr error         // from the last fetch
+}
+
+// key returns the key with kid, refetching the set when the key is unknown
+// or the set is old. Keys already known keep working while the issuer is
+// unreachable, and while a fetch is in flight: only verifications waiting
+// on an unknown kid wait for it, and they share one fetch.
+func (k *jwksKeys) key(kid string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	key, ok := k.keys[kid]
+	age := time.Since(k.fetched)
+	var fetching chan struct{}
+	if (!ok || age > jwksMaxAge) && (k.fetched.IsZero() || age > jwksRefreshInterval) {
+		fetching = k.startFetchLocked()
+	}
+	k.mu.Unlock()
+	if ok || fetching == nil {
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+
+	<-fetching
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if k.fetchErr != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", k.fetchErr)
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// startFetchLocked starts fetching the set unless a fetch is already in
+// flight, returning the channel closed when it ends. The caller must hold
+// k.mu.
+func (k *jwksKeys) startFetchLocked() chan struct{} {
+	if k.fetching != nil {
+		return k.fetching
+	}
+	done := make(chan struct{})
+	k.fetching = done
+	go func() {
+		keys, err := k.fetch()
+		k.mu.Lock()
+		k.fetched, k.fetchErr, k.fetching = time.Now(), err, nil
+		if err == nil {
+			k.keys = keys
+		}
+		k.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// jsonWebKey holds the fields of the RSA and EC keys we understand
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch downloads and parses the key set. Keys of other types are skipped.
+func (k *jwksKeys) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch {
+	case j.Kty == "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(j.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+// bearerToken returns the token from r's Authorization header, or ""
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// requireToken has next served only to requests carrying a valid token for
+// role in the room. Without JWT configuration it returns next as is.
+func (s *Server) requireToken(role string, next func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	if s.auth == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, roomID string) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Missing bearer token")
+			return
+		}
+		claims, err := s.auth.verify(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, fmt.Sprintf("Invalid token: %v", err))
+			return
+		}
+		if claims.RoomID != roomID || claims.Role != role {
+			writeError(w, http.StatusForbidden, errCodeForbidden, fmt.Sprintf("Token grants %s in room %q", claims.Role, claims.RoomID))
+			return
+		}
+		next(w, r, roomID)
+	}
+}
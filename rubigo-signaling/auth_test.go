@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signToken builds a JWT with claims, signed by sign over the encoded
+// header and claims
+func signToken(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// hs256Token returns claims signed with secret
+func hs256Token(t *testing.T, secret string, claims map[string]interface{}) string {
+	return signToken(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims, func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	})
+}
+
+// roomClaims grants role in room until an hour from now
+func roomClaims(room, role string) map[string]interface{} {
+	return map[string]interface{}{"roomId": room, "role": role, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestTokenVerifier(t *testing.T) {
+	v := newTokenVerifier("secret", "")
+	now := time.Now()
+	hour := time.Hour.Seconds()
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid", hs256Token(t, "secret", roomClaims("abc", roleBroadcaster)), ""},
+		{"wrong secret", hs256Token(t, "other", roomClaims("abc", roleBroadcaster)), "invalid signature"},
+		{"expired", hs256Token(t, "secret", map[string]interface{}{"roomId": "abc", "role": roleViewer, "exp": float64(now.Unix()) - hour}), "expired"},
+		{"within leeway", hs256Token(t, "secret", map[string]interface{}{"roomId": "abc", "role": roleViewer, "exp": now.Unix() - 5}), ""},
+		{"not yet valid", hs256Token(t, "secret", map[string]interface{}{"roomId": "abc", "role": roleViewer, "exp": float64(now.Unix()) + 2*hour, "nbf": float64(now.Unix()) + hour}), "not valid yet"},
+		{"no expiry", hs256Token(t, "secret", map[string]interface{}{"roomId": "abc", "role": roleViewer}), "no expiry"},
+		{"no role", hs256Token(t, "secret", map[string]interface{}{"roomId": "abc", "exp": now.Unix() + 60}), "roomId and role"},
+		{"alg none", signToken(t, map[string]interface{}{"alg": "none"}, roomClaims("abc", roleViewer), func([]byte) []byte { return nil }), "unsupported algorithm"},
+		{"RS256 without JWKS", signToken(t, map[string]interface{}{"alg": "RS256"}, roomClaims("abc", roleViewer), func([]byte) []byte { return []byte{1} }), "not accepted"},
+		{"malformed", "not.a-token", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.verify(tt.token, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if claims.RoomID != "abc" {
+					t.Errorf("roomId = %q, want abc", claims.RoomID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"},
+		}})
+	}))
+	defer jwks.Close()
+	v := newTokenVerifier("", jwks.URL)
+
+	rs256 := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, roomClaims("abc", roleViewer), func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	})
+	es256 := signToken(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, roomClaims("abc", roleViewer), func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+	for name, token := range map[string]string{"RS256": rs256, "ES256": es256} {
+		if _, err := v.verify(token, time.Now()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// A key used with the wrong algorithm is rejected
+	mixed := signToken(t, map[string]interface{}{"alg": "ES256", "kid": "rsa"}, roomClaims("abc", roleViewer), func([]byte) []byte { return make([]byte, 64) })
+	if _, err := v.verify(mixed, time.Now()); err == nil {
+		t.Error("ES256 token accepted with an RSA key")
+	}
+	// HS256 without a secret is rejected rather than keyed off the JWKS
+	if _, err := v.verify(hs256Token(t, "", roomClaims("abc", roleViewer)), time.Now()); err == nil {
+		t.Error("HS256 token accepted without a secret")
+	}
+
+	// Unknown key IDs don't refetch more often than the refresh interval
+	unknown := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "gone"}, roomClaims("abc", roleViewer), func([]byte) []byte { return []byte{1} })
+	for i := 0; i < 3; i++ {
+		if _, err := v.verify(unknown, time.Now()); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+			t.Errorf("unknown kid: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKSSlowRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch after the first hangs until released
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		}})
+	}))
+	defer jwks.Close()
+	defer close(release)
+	v := newTokenVerifier("", jwks.URL)
+
+	cached := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, roomClaims("abc", roleViewer), func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	})
+	if _, err := v.verify(cached, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the set so the next verifications refetch it, and have an
+	// unknown kid start the slow fetch
+	v.jwks.mu.Lock()
+	v.jwks.fetched = time.Now().Add(-2 * jwksMaxAge)
+	v.jwks.mu.Unlock()
+	unknown := signToken(t, map[string]interface{}{"alg": "RS256", "kid": "new"}, roomClaims("abc", roleViewer), func([]byte) []byte { return []byte{1} })
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := v.verify(unknown, time.Now())
+		waiting <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for fetches.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("refetch never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The cached key is served meanwhile, without a second fetch
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.verify(cached, time.Now())
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("cached key during refresh: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("verification of a cached key waited on the JWKS fetch")
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+
+	release <- struct{}{}
+	if err := <-waiting; err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("unknown kid after refresh: %v", err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.JWTSecret = "secret"
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	request := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`not json`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		want     int
+		wantCode string
+	}{
+		{"no token", "/internal/room/abc/publish", "", http.StatusUnauthorized, errCodeUnauthorized},
+		{"bad token", "/internal/room/abc/subscribe", "garbage", http.StatusUnauthorized, errCodeUnauthorized},
+		{"viewer publishing", "/internal/room/abc/publish", hs256Token(t, "secret", roomClaims("abc", roleViewer)), http.StatusForbidden, errCodeForbidden},
+		{"other room", "/internal/room/abc/subscribe", hs256Token(t, "secret", roomClaims("def", roleViewer)), http.StatusForbidden, errCodeForbidden},
+		// A valid token gets as far as decoding the body
+		{"broadcaster", "/internal/room/abc/publish", hs256Token(t, "secret", roomClaims("abc", roleBroadcaster)), http.StatusBadRequest, errCodeInvalidJSON},
+		{"viewer", "/internal/room/abc/subscribe", hs256Token(t, "secret", roomClaims("abc", roleViewer)), http.StatusBadRequest, errCodeInvalidJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(tt.path, tt.token)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			decodeError(t, rec, tt.wantCode)
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+
+	// Other endpoints stay open
+	if rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
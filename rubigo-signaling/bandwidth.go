@@ -0,0 +1,173 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Media to viewers carries transport-wide sequence numbers, and the
+// viewers' TWCC feedback drives a send-side (GCC) bandwidth estimate per
+// connection. Viewers without TWCC may send REMB instead. The SFU can't
+// re-encode, so the lowest estimate among the viewers of a non-simulcast
+// broadcast goes upstream as REMB, and the broadcaster's encoder backs off
+// rather than viewers freezing. Simulcast viewers change layer instead.
+
+// Bandwidth estimation tuning
+const (
+	// bweInitialBitrate is where each viewer's estimate starts. GCC only
+	// ramps up by a few percent a second, so starting high keeps a new
+	// viewer from throttling the broadcast until congestion is seen.
+	bweInitialBitrate = 20_000_000
+	// bweMinBroadcastBitrate is the least the broadcaster is asked for,
+	// however congested a viewer is, so one bad link can't make the
+	// broadcast unwatchable for the rest
+	bweMinBroadcastBitrate = 150_000
+	// bandwidthReportInterval is how often the estimate goes upstream
+	bandwidthReportInterval = time.Second
+)
+
+// registerBWE sets up TWCC on outgoing media and a GCC estimator per
+// connection, passed to onEstimator as the connection is created
+func registerBWE(onEstimator func(cc.BandwidthEstimator)) func(m *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	return func(m *webrtc.MediaEngine, registry *interceptor.Registry) error {
+		// The SFU forwards at the broadcaster's pace, so nothing is paced
+		controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(bweInitialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+		})
+		if err != nil {
+			return err
+		}
+		controller.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			onEstimator(estimator)
+		})
+		// The estimator must see packets after the header extension is set
+		registry.Add(controller)
+		return webrtc.ConfigureTWCCHeaderExtensionSender(m, registry)
+	}
+}
+
+// negotiatedTWCC reports whether sender's media carries TWCC sequence
+// numbers, so that its connection's estimate reflects viewer feedback
+func negotiatedTWCC(sender *webrtc.RTPSender) bool {
+	for _, ext := range sender.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			return true
+		}
+	}
+	return false
+}
+
+// bandwidth returns the viewer's estimated downstream bandwidth in bits
+// per second: its TWCC-based estimate if it has one, else its latest
+// REMB, held under the bandwidth its offer asked for. It is zero if the
+// viewer has none of these.
+func (v *viewer) bandwidth() float64 {
+	estimate := float64(v.remb.Load())
+	if v.bwe != nil {
+		estimate = float64(v.bwe.GetTargetBitrate())
+	}
+	if v.maxBitrate > 0 && (estimate == 0 || estimate > v.maxBitrate) {
+		return v.maxBitrate
+	}
+	return estimate
+}
+
+// ViewerBandwidth returns the lowest bandwidth estimate among unpaused
+// non-simulcast viewers and the track they receive, or zero and nil if
+// none has an estimate
+func (r *Room) ViewerBandwidth() (float64, *forwardingTrack) {
+	var (
+		lowest float64
+		track  *forwardingTrack
+	)
+	r.ForEachViewer(func(v *viewer) {
+		if v.simulcast != nil || v.Paused() {
+			return
+		}
+		if estimate := v.bandwidth(); estimate > 0 && (track == nil || estimate < lowest) {
+			lowest, track = estimate, v.track
+		}
+	})
+	return lowest, track
+}
+
+// reportViewerBandwidth sends pc, while it is the room's broadcaster, the
+// lowest of its viewers' bandwidth estimates as REMB, held under the room's
+// bitrate cap. Once no viewer has an estimate, a last report lifts the
+// limit, other than the cap. It exits once pc is replaced or closed.
+func (s *Server) reportViewerBandwidth(room *Room, pc *webrtc.PeerConnection) {
+	ticker := time.NewTicker(bandwidthReportInterval)
+	defer ticker.Stop()
+
+	var limited bool
+	for range ticker.C {
+		if room.BroadcasterPC() != pc || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		estimate, track := room.ViewerBandwidth()
+		limit := room.MaxBitrate()
+		if limit > 0 && (track == nil || estimate > limit) {
+			estimate = limit
+			if track == nil {
+				track = room.GetBroadcasterTrack()
+			}
+		}
+		if track == nil {
+			if !limited {
+				continue
+			}
+			// Any live track will do; browsers apply REMB to the whole
+			// connection
+			estimate, track = bweInitialBitrate, room.GetBroadcasterTrack()
+			if track == nil {
+				continue
+			}
+		}
+		source := track.Source()
+		if source == nil {
+			continue
+		}
+		// A cap below the floor still holds
+		floor := float64(bweMinBroadcastBitrate)
+		if limit > 0 {
+			floor = min(floor, limit)
+		}
+		remb := &rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(max(estimate, floor)),
+			SSRCs:   []uint32{uint32(source.SSRC())},
+		}
+		if err := pc.WriteRTCP([]rtcp.Packet{remb}); err != nil {
+			room.broadcasterLog().Error("Failed to send bandwidth estimate to broadcaster", "err", err)
+			continue
+		}
+		limited = estimate < bweInitialBitrate
+	}
+}
+
+// readViewerRTCP is readRTCP for a non-simulcast viewer's video sender,
+// also keeping the latest REMB the viewer sent
+func (r *Room) readViewerRTCP(v *viewer, sender *webrtc.RTPSender) {
+	onKeyframe := keyframeRequester(r, v.track)
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if wantsKeyframe(pkts) {
+			onKeyframe()
+		}
+		if ssrc, lost := nackedSequences(pkts); len(lost) > 0 {
+			missed, err := v.track.Retransmit(ssrc, lost)
+			r.repairViewer(v, v.track, missed, err)
+		}
+		if estimate := feedbackEstimate(pkts); estimate > 0 {
+			v.remb.Store(uint64(estimate))
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// fakeEstimator reports a fixed bandwidth estimate
+type fakeEstimator struct {
+	cc.BandwidthEstimator
+	bitrate int
+}
+
+func (e fakeEstimator) GetTargetBitrate() int { return e.bitrate }
+
+func TestViewerBandwidth(t *testing.T) {
+	track := newLiveTrack(t)
+	room := &Room{id: "abc", viewers: map[string]*viewer{}}
+	if estimate, got := room.ViewerBandwidth(); got != nil || estimate != 0 {
+		t.Errorf("no viewers: ViewerBandwidth = %v, %v", estimate, got)
+	}
+
+	twcc := &viewer{id: "twcc", track: track, bwe: fakeEstimator{bitrate: 2_000_000}}
+	remb := &viewer{id: "remb", track: track}
+	remb.remb.Store(800_000)
+	silent := &viewer{id: "silent", track: track}
+	paused := &viewer{id: "paused", track: track, paused: true, bwe: fakeEstimator{bitrate: 100_000}}
+	simulcast := &viewer{id: "simulcast", track: track, simulcast: &simulcastTrack{}, bwe: fakeEstimator{bitrate: 100_000}}
+	for _, v := range []*viewer{twcc, remb, silent, paused, simulcast} {
+		room.viewers[v.id] = v
+	}
+
+	// Paused viewers get no media, and simulcast viewers change layer
+	estimate, got := room.ViewerBandwidth()
+	if estimate != 800_000 || got != track {
+		t.Errorf("ViewerBandwidth = %v, %v; want the REMB viewer's 800000", estimate, got)
+	}
+	delete(room.viewers, "remb")
+	if estimate, _ := room.ViewerBandwidth(); estimate != 2_000_000 {
+		t.Errorf("ViewerBandwidth = %v, want the TWCC viewer's 2000000", estimate)
+	}
+}
+
+func TestPeerFactoryBWE(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, _, first, err := factory.connectPeer("abc", "viewer", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	other, _, second, err := factory.connectPeer("abc", "viewer", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if first == nil || second == nil || first == second {
+		t.Fatalf("estimators = %p, %p; want one per connection", first, second)
+	}
+
+	if _, err := pc.AddTrack(newLiveTrack(t)); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(offer.SDP, sdp.TransportCCURI) {
+		t.Error("TWCC header extension not offered")
+	}
+
+	disabled, err := newPeerFactory(PeerConfig{DisableBWE: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disabled.Close()
+	pc, _, estimator, err := disabled.connectPeer("abc", "viewer", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if estimator != nil {
+		t.Error("estimator created with --disable-bwe")
+	}
+}
+
+func TestReportViewerBandwidth(t *testing.T) {
+	sfu, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfu.Close()
+	broadcaster, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broadcaster.Close()
+
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := broadcaster.AddTrack(sending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rembs := make(chan *rtcp.ReceiverEstimatedMaximumBitrate, 10)
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if remb, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+					rembs <- remb
+				}
+			}
+		}
+	}()
+
+	room := &Room{id: "abc", viewers: map[string]*viewer{}}
+	room.SetBroadcaster(sfu, nil, "")
+	attached := make(chan *forwardingTrack, 1)
+	sfu.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		track, _, err := room.AttachBroadcasterSource(sfu, remote)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		attached <- track
+	})
+	negotiate(t, broadcaster, sfu)
+
+	var track *forwardingTrack
+	for seq := uint16(0); track == nil; seq++ {
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		select {
+		case track = <-attached:
+		case <-time.After(10 * time.Millisecond):
+		}
+		if seq > 500 {
+			t.Fatal("broadcaster track never arrived")
+		}
+	}
+
+	// A congested viewer limits the broadcaster, though not below the floor
+	room.viewers["v"] = &viewer{id: "v", track: track, bwe: fakeEstimator{bitrate: 50_000}}
+	go (&Server{}).reportViewerBandwidth(room, sfu)
+	next := func() *rtcp.ReceiverEstimatedMaximumBitrate {
+		t.Helper()
+		select {
+		case remb := <-rembs:
+			return remb
+		case <-time.After(3 * bandwidthReportInterval):
+			t.Fatal("broadcaster got no REMB")
+			return nil
+		}
+	}
+	remb := next()
+	if remb.Bitrate != bweMinBroadcastBitrate {
+		t.Errorf("REMB bitrate = %v, want %v", remb.Bitrate, bweMinBroadcastBitrate)
+	}
+	if want := uint32(track.Source().SSRC()); len(remb.SSRCs) != 1 || remb.SSRCs[0] != want {
+		t.Errorf("REMB SSRCs = %v, want [%d]", remb.SSRCs, want)
+	}
+
+	// Once it leaves, the limit is lifted
+	room.mu.Lock()
+	delete(room.viewers, "v")
+	room.mu.Unlock()
+	for remb = next(); remb.Bitrate < bweInitialBitrate; remb = next() {
+	}
+	select {
+	case remb := <-rembs:
+		t.Errorf("REMB %v sent with no viewer estimates", remb.Bitrate)
+	case <-time.After(2 * bandwidthReportInterval):
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// A room created with maxBitrateKbps holds its screen share under that
+// rate. The REMB the broadcaster gets never asks for more, so a browser's
+// encoder stays under it. Encoders that ignore REMB, such as some WHIP and
+// RTMP publishers, are held there by shedding: once the video has run a
+// second's worth over the cap, frames are dropped until a keyframe arrives
+// with the budget back, and one is asked for. Viewers whose offer has a
+// bandwidth line for video (b=TIAS, or b=AS) are held under it the same
+// way: it bounds their estimate, and so the REMB and their simulcast layer,
+// and simulcast viewers, who have their own track, shed frames over it.
+
+// bitrateShedWindow is how far over its cap a stream may run before frames
+// are shed, in time at the capped rate
+const bitrateShedWindow = time.Second
+
+// SetMaxBitrate caps the room's video in bits per second; zero lifts the cap
+func (r *Room) SetMaxBitrate(bps float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxBitrate = bps
+	for _, track := range r.broadcasterTracks {
+		r.capTrackLocked(track)
+	}
+}
+
+// MaxBitrate returns the room's video cap in bits per second, zero if none
+func (r *Room) MaxBitrate() float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.maxBitrate
+}
+
+// capTrackLocked applies the room's cap to one of the broadcaster's video
+// tracks. The caller must hold r.mu.
+func (r *Room) capTrackLocked(track *forwardingTrack) {
+	track.setBitrateCap(r.maxBitrate, func() {
+		if err := r.RequestKeyframe(track); err != nil {
+			r.broadcasterLog().Debug("Failed to request keyframe after shedding", "err", err)
+		}
+	})
+}
+
+// bitrateShedder holds a video stream under a rate by dropping whole frames
+// while it is over, resuming at a keyframe. It is not safe for concurrent
+// use.
+type bitrateShedder struct {
+	rate   float64 // bits per second
+	tokens float64 // bits that may still be sent; negative within a frame
+	last   time.Time
+
+	shedding  bool
+	recovered bool   // the budget came back while shedding
+	framed    bool   // lastTS is set
+	lastTS    uint32 // timestamp of the last frame sent
+}
+
+func newBitrateShedder(bps float64) *bitrateShedder {
+	return &bitrateShedder{rate: bps, tokens: bps * bitrateShedWindow.Seconds()}
+}
+
+// admit reports whether packet may be sent at now; keyframe is whether it
+// starts one. A frame that has begun is always finished, and shedding
+// starts at the next one. recovered is true once per shedding episode,
+// when a keyframe would be let through.
+func (b *bitrateShedder) admit(packet *rtp.Packet, keyframe bool, now time.Time) (ok, recovered bool) {
+	burst := b.rate * bitrateShedWindow.Seconds()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	newFrame := !b.framed || packet.Timestamp != b.lastTS
+	if b.shedding {
+		// Half the window spare, so the keyframe doesn't start it again
+		if b.tokens < burst/2 {
+			return false, false
+		}
+		if !keyframe {
+			recovered, b.recovered = !b.recovered, true
+			return false, recovered
+		}
+		b.shedding = false
+	} else if newFrame && b.tokens < 0 {
+		b.shedding, b.recovered = true, false
+		return false, false
+	}
+	b.framed, b.lastTS = true, packet.Timestamp
+	b.tokens -= float64(packet.MarshalSize() * 8)
+	return true, false
+}
+
+// setBitrateCap sheds the track's frames over bps, calling onRecovered
+// when a keyframe is wanted to resume; zero lifts the cap. Codecs whose
+// keyframes can't be recognized are only capped by REMB.
+func (f *forwardingTrack) setBitrateCap(bps float64, onRecovered func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shed, f.onShedRecovered = nil, nil
+	if bps > 0 && detectsKeyframes(f.Codec().MimeType) {
+		f.shed, f.onShedRecovered = newBitrateShedder(bps), onRecovered
+	}
+}
+
+// setBitrateCap is forwardingTrack.setBitrateCap for the viewer's track
+func (s *simulcastTrack) setBitrateCap(bps float64, onRecovered func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shed, s.onShedRecovered = nil, nil
+	if bps > 0 && detectsKeyframes(s.Codec().MimeType) {
+		s.shed, s.onShedRecovered = newBitrateShedder(bps), onRecovered
+	}
+}
+
+// offeredBitrate returns the bandwidth an SDP offer asks to receive video
+// within, in bits per second: its first video section's b=TIAS, else b=AS,
+// or zero if it sets neither
+func offeredBitrate(offer string) float64 {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return 0
+	}
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != webrtc.RTPCodecTypeVideo.String() {
+			continue
+		}
+		var as float64
+		for _, bw := range media.Bandwidth {
+			switch {
+			case bw.Experimental:
+			case strings.EqualFold(bw.Type, "TIAS"):
+				return float64(bw.Bandwidth)
+			case strings.EqualFold(bw.Type, "AS"):
+				as = float64(bw.Bandwidth) * 1000
+			}
+		}
+		return as
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// sizedVP8Packet starts a VP8 frame in 8000 bits, header included
+func sizedVP8Packet(ts uint32, keyframe bool) *rtp.Packet {
+	payload := make([]byte, 988)
+	payload[0] = 0x10
+	if !keyframe {
+		payload[1] = 0x01
+	}
+	return &rtp.Packet{Header: rtp.Header{Version: 2, Timestamp: ts}, Payload: payload}
+}
+
+func TestBitrateShedder(t *testing.T) {
+	// A second's budget is ten packets
+	shed := newBitrateShedder(80_000)
+	now := time.Unix(1000, 0)
+	admit := func(ts uint32, keyframe bool) (bool, bool) {
+		return shed.admit(sizedVP8Packet(ts, keyframe), keyframe, now)
+	}
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := admit(uint32(i), false); !ok {
+			t.Fatalf("frame %d within budget was shed", i)
+		}
+	}
+	// A frame that has begun is finished over budget
+	if ok, _ := admit(9, false); !ok {
+		t.Error("rest of a started frame was shed")
+	}
+	if ok, _ := admit(10, false); ok {
+		t.Error("frame over budget was sent")
+	}
+
+	// Until half the budget is back, not even a keyframe goes
+	now = now.Add(500 * time.Millisecond)
+	if ok, recovered := admit(11, true); ok || recovered {
+		t.Errorf("keyframe with the budget short = %v, %v", ok, recovered)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, recovered := admit(12, false); ok || !recovered {
+		t.Errorf("delta frame with the budget back = %v, %v; want shed and recovered", ok, recovered)
+	}
+	if ok, recovered := admit(13, false); ok || recovered {
+		t.Errorf("second delta frame = %v, %v; want shed, recovered once", ok, recovered)
+	}
+	if ok, _ := admit(14, true); !ok {
+		t.Error("keyframe with the budget back was shed")
+	}
+	if ok, _ := admit(15, false); !ok {
+		t.Error("delta frame after the keyframe was shed")
+	}
+}
+
+func TestForwardingTrackBitrateCap(t *testing.T) {
+	track := newLiveTrack(t)
+	viewer := &fakeBinding{id: "v", keep: true}
+	bindViewer(t, track, viewer)
+	recovered := 0
+	track.setBitrateCap(80_000, func() { recovered++ })
+
+	source := track.Source()
+	seq := uint16(100)
+	forward := func(ts uint32, keyframe bool) {
+		t.Helper()
+		packet := sizedVP8Packet(ts, keyframe)
+		packet.SequenceNumber = seq
+		seq++
+		if err := track.Forward(source, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A frame spending the budget is finished, and so is the next one
+	// begun while the budget had a little left; the rest are shed
+	for i := 0; i < 10; i++ {
+		forward(0, false)
+	}
+	for ts := uint32(1); ts < 6; ts++ {
+		forward(ts, false)
+	}
+	if len(viewer.packets) != 11 {
+		t.Fatalf("viewer got %d packets, want 11", len(viewer.packets))
+	}
+
+	// A second later a delta frame asks for a keyframe, which resumes
+	track.mu.Lock()
+	track.shed.last = track.shed.last.Add(-bitrateShedWindow)
+	track.mu.Unlock()
+	forward(6, false)
+	if recovered != 1 {
+		t.Errorf("keyframe requested %d times, want 1", recovered)
+	}
+	forward(7, true)
+	forward(8, false)
+	if len(viewer.packets) != 13 {
+		t.Fatalf("viewer got %d packets, want 13", len(viewer.packets))
+	}
+	// Shed packets leave no gap for the viewer to NACK
+	for i, header := range viewer.packets {
+		if want := uint16(100 + i); header.SequenceNumber != want {
+			t.Errorf("packet %d seq = %d, want %d", i, header.SequenceNumber, want)
+		}
+	}
+	if ts := viewer.packets[11].Timestamp; ts != 7 {
+		t.Errorf("resumed at ts %d, want 7", ts)
+	}
+}
+
+func TestOfferedBitrate(t *testing.T) {
+	const head = "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	audio := "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nb=AS:64\r\n"
+	video := "m=video 9 UDP/TLS/RTP/SAVPF 96\r\n"
+	for _, tc := range []struct {
+		name  string
+		offer string
+		want  float64
+	}{
+		{"none", head + audio + video, 0},
+		{"AS", head + audio + video + "b=AS:500\r\n", 500_000},
+		{"TIAS", head + video + "b=AS:500\r\nb=TIAS:400000\r\n", 400_000},
+		{"invalid", "not sdp", 0},
+	} {
+		if got := offeredBitrate(tc.offer); got != tc.want {
+			t.Errorf("%s: offeredBitrate = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestViewerBandwidthOfferedCap(t *testing.T) {
+	v := &viewer{maxBitrate: 300_000}
+	if got := v.bandwidth(); got != 300_000 {
+		t.Errorf("without an estimate = %v, want the offered cap", got)
+	}
+	v.bwe = fakeEstimator{bitrate: 1_000_000}
+	if got := v.bandwidth(); got != 300_000 {
+		t.Errorf("with a higher estimate = %v, want the offered cap", got)
+	}
+	v.bwe = fakeEstimator{bitrate: 200_000}
+	if got := v.bandwidth(); got != 200_000 {
+		t.Errorf("with a lower estimate = %v, want it", got)
+	}
+}
+
+func TestCreateRoomMaxBitrate(t *testing.T) {
+	store := newFakeStore()
+	h := newServer(t, store, DefaultConfig()).Handler()
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","maxBitrateKbps":-1}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("negative cap status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	decodeError(t, rec, errCodeInvalidRequest)
+
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","maxBitrateKbps":1500}`); rec.Code != http.StatusOK {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := store.Get("abc").MaxBitrate(); got != 1_500_000 {
+		t.Errorf("MaxBitrate = %v, want 1500000", got)
+	}
+	// Re-creating doesn't change it
+	doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","maxBitrateKbps":100}`)
+	body := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+	if body["maxBitrateKbps"] != float64(1500) {
+		t.Errorf("status maxBitrateKbps = %v, want 1500", body["maxBitrateKbps"])
+	}
+}
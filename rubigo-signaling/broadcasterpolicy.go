@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A room's broadcaster policy decides what a publish does while the room
+// already has a broadcaster. Under takeover, the default, the new
+// connection replaces the old one: viewers stay on the room's forwarding
+// tracks and resume on the new connection's media, and the old connection
+// is closed once its replacement's first track has taken over, or the
+// replacement connects without one for takeoverGrace. Under reject, the
+// publish fails with 409 while the broadcaster is connected, and only the
+// holder of its reconnect token may take its place.
+
+// BroadcasterPolicy is what a publish does to a room's current broadcaster
+type BroadcasterPolicy string
+
+const (
+	// BroadcasterTakeover replaces the current broadcaster
+	BroadcasterTakeover BroadcasterPolicy = "takeover"
+	// BroadcasterReject refuses other broadcasters while one is connected
+	BroadcasterReject BroadcasterPolicy = "reject"
+)
+
+// takeoverGrace is how long a replaced broadcaster connection is kept
+// after its replacement connects without sending a track
+const takeoverGrace = 5 * time.Second
+
+// errBroadcasterActive reports a publish refused under BroadcasterReject
+var errBroadcasterActive = errors.New("room already has a broadcaster")
+
+// parseBroadcasterPolicy validates a policy from a request, empty meaning
+// BroadcasterTakeover
+func parseBroadcasterPolicy(s string) (BroadcasterPolicy, error) {
+	switch policy := BroadcasterPolicy(s); policy {
+	case "":
+		return BroadcasterTakeover, nil
+	case BroadcasterTakeover, BroadcasterReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("broadcasterPolicy must be %q or %q", BroadcasterTakeover, BroadcasterReject)
+}
+
+// writeBroadcasterActive responds 409 to a publish refused under
+// BroadcasterReject
+func writeBroadcasterActive(w http.ResponseWriter) {
+	writeErrorDetails(w, http.StatusConflict, errCodeBroadcasterActive, "Room already has a broadcaster",
+		map[string]interface{}{"broadcasterPolicy": BroadcasterReject})
+}
+
+// SetBroadcasterPolicy sets the room's broadcaster policy
+func (r *Room) SetBroadcasterPolicy(policy BroadcasterPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.broadcasterPolicy = policy
+}
+
+// BroadcasterPolicy returns the room's broadcaster policy
+func (r *Room) BroadcasterPolicy() BroadcasterPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.broadcasterPolicy == "" {
+		return BroadcasterTakeover
+	}
+	return r.broadcasterPolicy
+}
+
+// AcceptsBroadcaster reports whether a publish may replace the room's
+// current broadcaster, reconnect being set if it carries a valid
+// reconnect token
+func (r *Room) AcceptsBroadcaster(reconnect bool) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.acceptsBroadcasterLocked(reconnect)
+}
+
+// acceptsBroadcasterLocked is AcceptsBroadcaster. The caller must hold
+// r.mu.
+func (r *Room) acceptsBroadcasterLocked(reconnect bool) bool {
+	if reconnect || r.broadcasterPolicy != BroadcasterReject || r.broadcaster.pc == nil {
+		return true
+	}
+	switch r.broadcaster.pc.ConnectionState() {
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		return true
+	}
+	return false
+}
+
+// TakeBroadcaster is SetBroadcaster under the room's broadcaster policy,
+// checked atomically so of two publishes racing into a reject room only
+// one wins. It returns the connection replaced, to pass to
+// RestoreBroadcaster if the publish fails and to newTakeover if it
+// succeeds, or errBroadcasterActive if the policy refuses.
+func (r *Room) TakeBroadcaster(pc *webrtc.PeerConnection, control *webrtc.DataChannel, peerID string, reconnect bool) (broadcasterConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.acceptsBroadcasterLocked(reconnect) {
+		return broadcasterConn{}, errBroadcasterActive
+	}
+	previous := r.broadcaster
+	r.broadcaster = broadcasterConn{pc: pc, control: control, id: peerID}
+	return previous, nil
+}
+
+// RestoreBroadcaster puts previous back if pc, whose publish failed, is
+// still the broadcaster, so a failed takeover leaves the broadcast as it
+// was
+func (r *Room) RestoreBroadcaster(pc *webrtc.PeerConnection, previous broadcasterConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.broadcaster.pc == pc {
+		r.broadcaster = previous
+	}
+}
+
+// takeover closes the broadcaster connection a publish replaced, once the
+// new one has taken over its media
+type takeover struct {
+	roomID   string
+	previous broadcasterConn
+	once     sync.Once
+}
+
+// newTakeover is the takeover of previous by pc in a room, nil if pc
+// replaced no other connection
+func newTakeover(roomID string, pc *webrtc.PeerConnection, previous broadcasterConn) *takeover {
+	if previous.pc == nil || previous.pc == pc {
+		return nil
+	}
+	return &takeover{roomID: roomID, previous: previous}
+}
+
+// done closes the replaced connection, the first time it is called. It is
+// called when a track from the new connection is attached.
+func (t *takeover) done() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		logger := peerLog(t.roomID, "broadcaster", t.previous.id)
+		logger.Info("Closing replaced broadcaster connection")
+		if err := t.previous.pc.Close(); err != nil {
+			logger.Error("Failed to close replaced broadcaster", "err", err)
+		}
+	})
+}
+
+// observe follows the new connection's state: its failing or closing ends
+// the takeover at once, and its connecting after takeoverGrace, should no
+// track have arrived by then
+func (t *takeover) observe(state webrtc.PeerConnectionState) {
+	if t == nil {
+		return
+	}
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		time.AfterFunc(takeoverGrace, t.done)
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		t.done()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseBroadcasterPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want BroadcasterPolicy
+		ok   bool
+	}{
+		{"", BroadcasterTakeover, true},
+		{"takeover", BroadcasterTakeover, true},
+		{"reject", BroadcasterReject, true},
+		{"Reject", "", false},
+		{"queue", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseBroadcasterPolicy(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseBroadcasterPolicy(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestTakeBroadcaster(t *testing.T) {
+	room := &Room{id: "abc"}
+	if policy := room.BroadcasterPolicy(); policy != BroadcasterTakeover {
+		t.Errorf("default policy = %q, want takeover", policy)
+	}
+	first, second := newTestPC(t), newTestPC(t)
+	if previous, err := room.TakeBroadcaster(first, nil, "first", false); err != nil || previous.pc != nil {
+		t.Fatalf("first TakeBroadcaster = %+v, %v", previous, err)
+	}
+
+	room.SetBroadcasterPolicy(BroadcasterReject)
+	if _, err := room.TakeBroadcaster(second, nil, "second", false); err != errBroadcasterActive {
+		t.Fatalf("TakeBroadcaster over a connected broadcaster = %v, want errBroadcasterActive", err)
+	}
+	if room.BroadcasterPC() != first {
+		t.Fatal("refused TakeBroadcaster replaced the broadcaster")
+	}
+
+	// A reconnecting broadcaster takes its place back, and a failed
+	// publish gives it up again
+	previous, err := room.TakeBroadcaster(second, nil, "second", true)
+	if err != nil || previous.pc != first {
+		t.Fatalf("reconnecting TakeBroadcaster = %+v, %v", previous, err)
+	}
+	room.RestoreBroadcaster(second, previous)
+	if room.BroadcasterPC() != first {
+		t.Fatal("RestoreBroadcaster didn't restore the previous broadcaster")
+	}
+
+	first.Close()
+	if !room.AcceptsBroadcaster(false) {
+		t.Error("closed broadcaster still refuses others")
+	}
+}
+
+func TestBroadcasterPolicyReject(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","broadcasterPolicy":"queue"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("create with a bad policy = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","broadcasterPolicy":"reject"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	if body := decodeBody(t, rec); body["broadcasterPolicy"] != "reject" {
+		t.Errorf("create response policy = %v, want reject", body["broadcasterPolicy"])
+	}
+	// Re-creating doesn't change it
+	doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","broadcasterPolicy":"takeover"}`)
+	if body := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")); body["broadcasterPolicy"] != "reject" {
+		t.Errorf("status policy = %v, want reject", body["broadcasterPolicy"])
+	}
+
+	publish := func(offer SDPExchange) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(offer)
+		return doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	}
+	rec = publish(SDPExchange{Type: "offer", SDP: videoOffer(t)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", rec.Code, rec.Body)
+	}
+	var first SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	room := store.Get("abc")
+	pc := room.BroadcasterPC()
+
+	rec = publish(SDPExchange{Type: "offer", SDP: videoOffer(t)})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("second publish = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	decodeError(t, rec, errCodeBroadcasterActive)
+	if room.BroadcasterPC() != pc {
+		t.Error("refused publish replaced the broadcaster")
+	}
+
+	// The broadcaster itself may come back
+	if rec := publish(SDPExchange{Type: "offer", SDP: videoOffer(t), ReconnectToken: first.ReconnectToken}); rec.Code != http.StatusOK {
+		t.Fatalf("republish with the reconnect token = %d: %s", rec.Code, rec.Body)
+	}
+	if room.BroadcasterPC() == pc {
+		t.Error("reconnect didn't replace the broadcaster")
+	}
+}
+
+func TestBroadcasterPolicyTakeover(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc"}`); rec.Code != http.StatusOK {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	room := store.Get("abc")
+	send := func(sending *webrtc.TrackLocalStaticRTP, until func() bool, what string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for seq := uint16(0); !until(); seq++ {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never happened", what)
+			}
+			sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: []byte{0x10, 0, 0}})
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	first := publishClient(t, h, "/internal/room/abc/publish")
+	send(first, func() bool { return room.GetBroadcasterTrack() != nil }, "first broadcaster track")
+	old, track := room.BroadcasterPC(), room.GetBroadcasterTrack()
+	source := track.Source()
+
+	second := publishClient(t, h, "/internal/room/abc/publish")
+	send(second, func() bool { return old.ConnectionState() == webrtc.PeerConnectionStateClosed }, "closing the replaced broadcaster")
+	if room.BroadcasterPC() == old {
+		t.Error("broadcaster not replaced")
+	}
+	// Viewers stay on the same forwarding track, now fed by the new
+	// connection
+	if room.GetBroadcasterTrack() != track {
+		t.Error("takeover replaced the forwarding track")
+	}
+	if s := track.Source(); s == nil || s == source {
+		t.Errorf("forwarding track source = %p, want the new connection's track", s)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A cascade link relays a room from an upstream SFU node, e.g. one in
+// another region, so that nearby viewers connect to this node instead:
+//
+//	POST   /internal/cascade           {"roomId", "upstreamUrl", ...} links a room
+//	GET    /internal/cascade           lists the links
+//	DELETE /internal/cascade/{roomId}  tears one down
+//
+// This node subscribes to the upstream room over WebRTC like any viewer and
+// its connection stands in as the local room's broadcaster, so local
+// viewers, keyframe requests and recording work as for a direct publish.
+// The upstream's main video and audio are relayed; its extra tracks, which
+// viewers only get by renegotiation, are not.
+
+// cascadeTimeout bounds the subscribe request to the upstream node
+const cascadeTimeout = 30 * time.Second
+
+// cascadeClient makes the subscribe requests to upstream nodes
+var cascadeClient = &http.Client{Timeout: cascadeTimeout}
+
+// cascadeLink is this node's subscription to an upstream room
+type cascadeLink struct {
+	RoomID           string    `json:"roomId"`
+	UpstreamURL      string    `json:"upstreamUrl"`
+	UpstreamRoomID   string    `json:"upstreamRoomId"`
+	UpstreamViewerID string    `json:"upstreamViewerId"`
+	State            string    `json:"state"`
+	CreatedAt        time.Time `json:"createdAt"`
+
+	pc *webrtc.PeerConnection
+}
+
+// cascadeLinks holds the links by local room ID
+type cascadeLinks struct {
+	mu    sync.Mutex
+	links map[string]*cascadeLink
+}
+
+// add registers link unless its room already has one
+func (c *cascadeLinks) add(link *cascadeLink) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.links[link.RoomID]; ok {
+		return false
+	}
+	if c.links == nil {
+		c.links = make(map[string]*cascadeLink)
+	}
+	c.links[link.RoomID] = link
+	return true
+}
+
+// has reports whether roomID has a link
+func (c *cascadeLinks) has(roomID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.links[roomID]
+	return ok
+}
+
+// remove unregisters the link of roomID, if it is on pc or pc is nil
+func (c *cascadeLinks) remove(roomID string, pc *webrtc.PeerConnection) *cascadeLink {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	link := c.links[roomID]
+	if link == nil || (pc != nil && link.pc != pc) {
+		return nil
+	}
+	delete(c.links, roomID)
+	return link
+}
+
+// list returns the links sorted by room ID, with their current state
+func (c *cascadeLinks) list() []cascadeLink {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	links := make([]cascadeLink, 0, len(c.links))
+	for _, link := range c.links {
+		l := *link
+		l.State = link.pc.ConnectionState().String()
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].RoomID < links[j].RoomID })
+	return links
+}
+
+// upstreamError is a subscribe the upstream node refused
+type upstreamError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream answered %d %s: %s", e.status, e.code, e.msg)
+}
+
+// handleCascade handles /internal/cascade and /internal/cascade/{roomId}
+func (s *Server) handleCascade(w http.ResponseWriter, r *http.Request) {
+	roomID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/internal/cascade"), "/")
+	if roomID == "" {
+		if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.handleCascadeCreate(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"links": s.cascades.list()})
+		return
+	}
+
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	link := s.cascades.remove(roomID, nil)
+	if link == nil {
+		writeError(w, http.StatusNotFound, errCodeCascadeNotFound, "No cascade link for this room")
+		return
+	}
+	if room := s.rooms.Get(roomID); room == nil || !room.unpublish(link.pc) {
+		link.pc.Close()
+	}
+	roomLog(roomID).Info("Cascade link torn down", "upstream", link.UpstreamURL)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "unlinked", "roomId": roomID})
+}
+
+// handleCascadeCreate handles POST /internal/cascade
+// Subscribes to upstreamRoomId, by default the same as roomId, on the node
+// at upstreamUrl and relays it into the local room roomId. The password
+// and token are the upstream room's, as a viewer there would send them;
+// upstreamApiKey is the upstream node's API key, if it wants one.
+func (s *Server) handleCascadeCreate(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, errCodeDraining, "Server is draining")
+		return
+	}
+
+	var req struct {
+		RoomID         string `json:"roomId"`
+		UpstreamURL    string `json:"upstreamUrl"`
+		UpstreamRoomID string `json:"upstreamRoomId"`
+		Password       string `json:"password"`
+		Token          string `json:"token"`
+		UpstreamAPIKey string `json:"upstreamApiKey"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if !s.validRoomID(req.RoomID) {
+		writeInvalidRoomID(w, s.cfg.RoomIDPattern)
+		return
+	}
+	if u, err := url.Parse(req.UpstreamURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "upstreamUrl must be an http or https URL")
+		return
+	}
+	if req.UpstreamRoomID == "" {
+		req.UpstreamRoomID = req.RoomID
+	}
+	if !s.routeToOwner(w, r, req.RoomID, true) {
+		return
+	}
+
+	room, _, err := s.rooms.TryCreate(req.RoomID, s.cfg.MaxRooms)
+	if err != nil {
+		writeRoomLimitError(w, err)
+		return
+	}
+	if s.cascades.has(req.RoomID) {
+		writeError(w, http.StatusConflict, errCodeCascadeConflict, "Room already has a cascade link")
+		return
+	}
+	// The link is a broadcaster like any other: the room's policy decides
+	// whether it may replace one already publishing. Checked again when it
+	// takes over the room.
+	if !room.AcceptsBroadcaster(false) {
+		writeBroadcasterActive(w)
+		return
+	}
+	if room.BroadcasterPC() == nil && !s.admitPeer(w) {
+		return
+	}
+
+	peerID := newPeerID()
+	logger := peerLog(req.RoomID, "cascade", peerID)
+	tagPeer(r.Context(), "cascade", peerID)
+	publishSpan := trace.SpanContextFromContext(r.Context())
+	pc, _, _, err := s.peers.connectPeer(req.RoomID, "cascade", peerID, room.ICEServers())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create peer connection: %v", err))
+		return
+	}
+	// Until the link is registered, any failure leaves pc unused
+	linked := false
+	defer func() {
+		if !linked {
+			pc.Close()
+		}
+	}()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add transceiver: %v", err))
+			return
+		}
+	}
+
+	// The link is the room's broadcaster. It has no control channel of its
+	// own: the upstream one would carry this room's messages to that one.
+	previous, err := room.TakeBroadcaster(pc, nil, peerID, false)
+	if err != nil {
+		writeBroadcasterActive(w)
+		return
+	}
+	defer func() {
+		if !linked {
+			room.RestoreBroadcaster(pc, previous)
+		}
+	}()
+	replaced := newTakeover(req.RoomID, pc, previous)
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		logger.Info("Received track from upstream", "codec", remoteTrack.Codec().MimeType)
+		local, _, err := room.AttachBroadcasterSource(pc, remoteTrack)
+		if errors.Is(err, errBroadcasterReplaced) {
+			logger.Info("Ignoring track from replaced cascade link")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create local track", "err", err)
+			return
+		}
+		replaced.done()
+		go s.forwardBroadcasterTrack(room, remoteTrack, local, publishSpan)
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+			go offerTracksToViewers(room)
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create offer: %v", err))
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to set local description: %v", err))
+		return
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return
+	}
+
+	link := &cascadeLink{
+		RoomID:           req.RoomID,
+		UpstreamURL:      req.UpstreamURL,
+		UpstreamRoomID:   req.UpstreamRoomID,
+		UpstreamViewerID: "cascade-" + peerID,
+		CreatedAt:        time.Now().UTC(),
+		pc:               pc,
+	}
+	// Registered before the answer is applied, so no state is missed. A
+	// link that fails to be set up closes without ever being added.
+	connecting := s.startConnectSpan(r.Context())
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		connecting.observe(state)
+		replaced.observe(state)
+		s.notifyConnectionState(req.RoomID, "cascade", state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			logger.Info("Cascade link failed, closing")
+			pc.Close()
+		case webrtc.PeerConnectionStateClosed:
+			// Local viewers wait for the room to be linked or published
+			// again, as when a broadcaster leaves
+			if s.cascades.remove(req.RoomID, pc) != nil {
+				logger.Info("Cascade link closed", "upstream", req.UpstreamURL)
+			}
+			room.unpublish(pc)
+		}
+	})
+
+	answer, err := s.subscribeUpstream(r.Context(), link, SDPExchange{
+		Type:     "offer",
+		SDP:      pc.LocalDescription().SDP,
+		Password: req.Password,
+		ViewerID: link.UpstreamViewerID,
+	}, req.Token, req.UpstreamAPIKey)
+	if err != nil {
+		logger.Warn("Upstream subscribe failed", "upstream", req.UpstreamURL, "err", err)
+		details := map[string]interface{}{"upstreamUrl": req.UpstreamURL}
+		var upErr *upstreamError
+		if errors.As(err, &upErr) {
+			details["upstreamStatus"] = upErr.status
+			details["upstreamCode"] = upErr.code
+		}
+		writeErrorDetails(w, http.StatusBadGateway, errCodeUpstreamFailed, fmt.Sprintf("Upstream subscribe failed: %v", err), details)
+		return
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		writeErrorDetails(w, http.StatusBadGateway, errCodeUpstreamFailed, fmt.Sprintf("Invalid upstream answer: %v", err),
+			map[string]interface{}{"upstreamUrl": req.UpstreamURL})
+		return
+	}
+	if !s.cascades.add(link) {
+		writeError(w, http.StatusConflict, errCodeCascadeConflict, "Room already has a cascade link")
+		return
+	}
+
+	linked = true
+	logger.Info("Cascade link established", "upstream", req.UpstreamURL, "upstreamRoomId", req.UpstreamRoomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":           "linked",
+		"roomId":           link.RoomID,
+		"upstreamUrl":      link.UpstreamURL,
+		"upstreamRoomId":   link.UpstreamRoomID,
+		"upstreamViewerId": answer.ViewerID,
+	})
+}
+
+// subscribeUpstream sends offer to the upstream node's subscribe endpoint
+// for link, continuing the caller's trace, and returns its answer. Cluster
+// redirects on the upstream side are followed.
+func (s *Server) subscribeUpstream(ctx context.Context, link *cascadeLink, offer SDPExchange, token, apiKey string) (SDPExchange, error) {
+	body, err := json.Marshal(offer)
+	if err != nil {
+		return SDPExchange{}, err
+	}
+	endpoint := strings.TrimSuffix(link.UpstreamURL, "/") + "/internal/room/" + url.PathEscape(link.UpstreamRoomID) + "/subscribe"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return SDPExchange{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := cascadeClient.Do(req)
+	if err != nil {
+		return SDPExchange{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error apiError `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return SDPExchange{}, &upstreamError{status: resp.StatusCode, code: failure.Error.Code, msg: failure.Error.Message}
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return SDPExchange{}, fmt.Errorf("invalid upstream answer: %w", err)
+	}
+	return answer, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCascadeValidation(t *testing.T) {
+	h := newTestServer(t, newFakeStore())
+
+	for _, body := range []string{
+		`{"roomId":"abc","upstreamUrl":""}`,
+		`{"roomId":"abc","upstreamUrl":"sfu-eu:37003"}`,
+		`{"roomId":"abc","upstreamUrl":"ftp://sfu-eu"}`,
+	} {
+		if rec := doRequest(t, h, http.MethodPost, "/internal/cascade", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := doRequest(t, h, http.MethodDelete, "/internal/cascade/abc", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown link = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	decodeError(t, rec, errCodeCascadeNotFound)
+	if rec := doRequest(t, h, http.MethodPut, "/internal/cascade", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCascadeUpstreamFailure(t *testing.T) {
+	upstream := httptest.NewServer(newTestServer(t, newFakeStore()))
+	defer upstream.Close()
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"abc","upstreamUrl":"`+upstream.URL+`"}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("cascade from a missing room = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	details := decodeBody(t, rec)["error"].(map[string]interface{})["details"].(map[string]interface{})
+	if details["upstreamStatus"] != float64(http.StatusNotFound) || details["upstreamCode"] != errCodeRoomNotFound {
+		t.Errorf("failure details = %v, want the upstream's 404", details)
+	}
+	if room := store.Get("abc"); room != nil && room.BroadcasterPC() != nil {
+		t.Error("failed link left a broadcaster in the room")
+	}
+
+	// A failed takeover leaves the broadcaster it would have replaced
+	pc := newTestPC(t)
+	store.Get("abc").SetBroadcaster(pc, nil, "")
+	if rec := doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"abc","upstreamUrl":"`+upstream.URL+`"}`); rec.Code != http.StatusBadGateway {
+		t.Fatalf("takeover from a missing room = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if store.Get("abc").BroadcasterPC() != pc {
+		t.Error("failed takeover didn't restore the broadcaster")
+	}
+}
+
+func TestCascadeAdmission(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxPeerConnections = 1
+	store := newFakeStore("full")
+	if err := store.rooms["full"].AddViewer(&viewer{id: "v1", track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	h := newServer(t, store, cfg).Handler()
+
+	// A link is a peer connection like any other
+	rec := doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"abc","upstreamUrl":"http://127.0.0.1:1"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("link over the connection limit = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	decodeError(t, rec, errCodeConnectionLimit)
+
+	// And a broadcaster, held to the room's policy
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"live","broadcasterPolicy":"reject"}`); rec.Code != http.StatusOK {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	pc := newTestPC(t)
+	store.Get("live").SetBroadcaster(pc, nil, "")
+	rec = doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"live","upstreamUrl":"http://127.0.0.1:1"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("link into a reject room = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	decodeError(t, rec, errCodeBroadcasterActive)
+	if store.Get("live").BroadcasterPC() != pc {
+		t.Error("refused link replaced the broadcaster")
+	}
+}
+
+func TestCascade(t *testing.T) {
+	upstreamStore := newFakeStore()
+	upstreamHandler := newTestServer(t, upstreamStore)
+	upstream := httptest.NewServer(upstreamHandler)
+	defer upstream.Close()
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	// Broadcast into the upstream room
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTrack(sending); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP})
+	rec := doRequest(t, upstreamHandler, http.MethodPost, "/internal/room/live/publish", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", rec.Code, rec.Body)
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	upstreamRoom := upstreamStore.Get("live")
+	deadline := time.Now().Add(10 * time.Second)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		}
+	}()
+	for upstreamRoom.GetBroadcasterTrack() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream broadcaster track never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"abc","upstreamUrl":"`+upstream.URL+`","upstreamRoomId":"live"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cascade = %d: %s", rec.Code, rec.Body)
+	}
+	if body := decodeBody(t, rec); body["status"] != "linked" || body["upstreamViewerId"] == "" {
+		t.Errorf("cascade response = %v", body)
+	}
+	room := store.Get("abc")
+	for room.GetBroadcasterTrack() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("relayed track never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A room has one source
+	if rec := doRequest(t, h, http.MethodPost, "/internal/cascade", `{"roomId":"abc","upstreamUrl":"`+upstream.URL+`","upstreamRoomId":"live"}`); rec.Code != http.StatusConflict {
+		t.Errorf("second link = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	var list struct {
+		Links []cascadeLink `json:"links"`
+	}
+	if err := json.NewDecoder(doRequest(t, h, http.MethodGet, "/internal/cascade", "").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Links) != 1 || list.Links[0].RoomID != "abc" || list.Links[0].UpstreamRoomID != "live" {
+		t.Errorf("links = %+v", list.Links)
+	}
+
+	if rec := doRequest(t, h, http.MethodDelete, "/internal/cascade/abc", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d: %s", rec.Code, rec.Body)
+	}
+	if room.BroadcasterPC() != nil {
+		t.Error("room still has the link as its broadcaster")
+	}
+	if rec := doRequest(t, h, http.MethodDelete, "/internal/cascade/abc", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,253 @@
+// Package client is a Go client for the SFU's HTTP API. It creates rooms,
+// reads their status and events, and publishes and subscribes over pion
+// peer connections, doing the offer and answer exchange so callers only
+// deal in tracks.
+//
+//	c := client.New("http://localhost:8080")
+//	if err := c.CreateRoom(ctx, "demo", client.RoomOptions{}); err != nil {
+//		return err
+//	}
+//	pub, err := c.PublishFile(ctx, "demo", client.PublishOptions{Loop: true}, "screen.ivf", "audio.ogg")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Client calls one SFU node's API. Its fields must not change once it is in
+// use.
+type Client struct {
+	// BaseURL is the node's address, e.g. "http://sfu:8080"
+	BaseURL string
+	// APIKey, if set, is sent in X-API-Key on every request
+	APIKey string
+	// Token, if set, is sent as the bearer token, e.g. a JWT for publish
+	// and subscribe
+	Token string
+	// HTTPClient makes the requests; nil means http.DefaultClient
+	HTTPClient *http.Client
+	// WebRTC configures the peer connections; the room's ICE servers are
+	// the SFU's business, these are the local side's
+	WebRTC webrtc.Configuration
+	// API creates the peer connections; nil means pion's defaults
+	API *webrtc.API
+}
+
+// New returns a client for the node at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is an error response from the API
+type Error struct {
+	// StatusCode is the HTTP status
+	StatusCode int
+	// Code is the machine-readable error code, e.g. "room_not_found"
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("sfu: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("sfu: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// HasCode reports whether err is an API error with the given code
+func HasCode(err error, code string) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.Code == code
+}
+
+// CodecPolicy limits the codecs a room's broadcasters may send
+type CodecPolicy struct {
+	Prefer []string `json:"prefer,omitempty"`
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+}
+
+// RoomOptions are the settings a room is created with. They only take
+// effect if the room doesn't exist yet.
+type RoomOptions struct {
+	Password           string             `json:"password,omitempty"`
+	ICEServers         []webrtc.ICEServer `json:"iceServers,omitempty"`
+	IdleTimeoutSeconds int                `json:"idleTimeoutSeconds,omitempty"`
+	CodecPolicy        *CodecPolicy       `json:"codecPolicy,omitempty"`
+	MaxViewers         int                `json:"maxViewers,omitempty"`
+	MaxBitrateKbps     int                `json:"maxBitrateKbps,omitempty"`
+	// BroadcasterPolicy is "takeover", the default, to let a publish
+	// replace the room's broadcaster, or "reject" to refuse it with the
+	// code broadcaster_active while the broadcaster is connected
+	BroadcasterPolicy string `json:"broadcasterPolicy,omitempty"`
+}
+
+// CreateRoom creates the room, succeeding too if it already exists
+func (c *Client) CreateRoom(ctx context.Context, roomID string, opts RoomOptions) error {
+	body := struct {
+		RoomID string `json:"roomId"`
+		RoomOptions
+	}{roomID, opts}
+	return c.do(ctx, http.MethodPost, "/internal/room", body, nil)
+}
+
+// TrackInfo describes a track the room forwards
+type TrackInfo struct {
+	Label    string `json:"label"`
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec,omitempty"`
+	Mid      string `json:"mid,omitempty"`
+	PeerID   string `json:"peerId,omitempty"`
+	StreamID string `json:"streamId,omitempty"`
+}
+
+// QualityStat is the median and worst of a track's viewers' figures
+type QualityStat struct {
+	Median float64 `json:"median"`
+	Worst  float64 `json:"worst"`
+}
+
+// TrackQuality summarizes the receiver reports of a track's viewers
+type TrackQuality struct {
+	Label        string       `json:"label"`
+	PeerID       string       `json:"peerId,omitempty"`
+	Kind         string       `json:"kind"`
+	Viewers      int          `json:"viewers"`
+	FractionLost QualityStat  `json:"fractionLost"`
+	JitterMs     QualityStat  `json:"jitterMs"`
+	RTTMs        *QualityStat `json:"rttMs,omitempty"`
+}
+
+// RoomStatus is a room's state as GET /internal/room/{id}/status reports it
+type RoomStatus struct {
+	Exists         bool           `json:"exists"`
+	HasBroadcaster bool           `json:"hasBroadcaster"`
+	ViewerCount    int            `json:"viewerCount"`
+	Layers         []string       `json:"layers,omitempty"`
+	BytesIngress   int64          `json:"bytesIngress"`
+	BytesEgress    int64          `json:"bytesEgress"`
+	ByteQuota      int64          `json:"byteQuota,omitempty"`
+	MaxBitrateKbps int            `json:"maxBitrateKbps,omitempty"`
+	Codec          string         `json:"codec,omitempty"`
+	Width          int            `json:"width,omitempty"`
+	Height         int            `json:"height,omitempty"`
+	AudioCodec     string         `json:"audioCodec,omitempty"`
+	Tracks         []TrackInfo    `json:"tracks,omitempty"`
+	DataChannels   map[string]int `json:"dataChannels,omitempty"`
+	// BroadcasterPolicy is "takeover" or "reject"
+	BroadcasterPolicy string `json:"broadcasterPolicy,omitempty"`
+	// Quality is updated every few seconds from the viewers' receiver
+	// reports
+	Quality []TrackQuality `json:"quality,omitempty"`
+	// Node is the cluster node hosting the room
+	Node string `json:"node,omitempty"`
+}
+
+// RoomStatus returns the room's status. A room that doesn't exist isn't an
+// error; its status has Exists false.
+func (c *Client) RoomStatus(ctx context.Context, roomID string) (*RoomStatus, error) {
+	var status RoomStatus
+	if err := c.do(ctx, http.MethodGet, roomPath(roomID, "status"), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// roomPath is the path of one of the room's routes
+func roomPath(roomID, route string) string {
+	return "/internal/room/" + url.PathEscape(roomID) + "/" + route
+}
+
+// newRequest builds a request to path carrying the client's credentials,
+// with body encoded as JSON unless nil
+func (c *Client) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// send makes req, returning the response if its status is 200 and the
+// API's error otherwise
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+// do sends body to path and decodes the response into out, if not nil
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("sfu: failed to decode %s response: %w", path, err)
+	}
+	return nil
+}
+
+// decodeError reads the API error in resp, falling back to the bare status
+// if the body isn't one
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Code    string                 `json:"code"`
+			Message string                 `json:"message"`
+			Details map[string]interface{} `json:"details"`
+		} `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil {
+		apiErr.Code = body.Error.Code
+		apiErr.Message = body.Error.Message
+		apiErr.Details = body.Error.Details
+	}
+	return apiErr
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordingServer serves handler, recording each request it gets
+func recordingServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, body map[string]interface{})) (*Client, chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		if r.Body != nil && r.ContentLength != 0 {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+		requests <- r
+		handler(w, r, body)
+	}))
+	t.Cleanup(server.Close)
+	return New(server.URL + "/"), requests
+}
+
+func TestCreateRoom(t *testing.T) {
+	var got map[string]interface{}
+	c, requests := recordingServer(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		got = body
+		w.Write([]byte(`{"status":"created","roomId":"abc"}`))
+	})
+	c.APIKey = "key"
+	c.Token = "jwt"
+
+	if err := c.CreateRoom(context.Background(), "abc", RoomOptions{MaxBitrateKbps: 1500, CodecPolicy: &CodecPolicy{Prefer: []string{"vp9"}}, BroadcasterPolicy: "reject"}); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.Method != http.MethodPost || req.URL.Path != "/internal/room" {
+		t.Errorf("request = %s %s, want POST /internal/room", req.Method, req.URL.Path)
+	}
+	if key, auth := req.Header.Get("X-API-Key"), req.Header.Get("Authorization"); key != "key" || auth != "Bearer jwt" {
+		t.Errorf("credentials = %q, %q", key, auth)
+	}
+	if got["roomId"] != "abc" || got["maxBitrateKbps"] != float64(1500) || got["broadcasterPolicy"] != "reject" {
+		t.Errorf("body = %v", got)
+	}
+	if _, ok := got["password"]; ok {
+		t.Errorf("unset password sent: %v", got)
+	}
+	if policy, _ := got["codecPolicy"].(map[string]interface{}); policy == nil || len(policy["prefer"].([]interface{})) != 1 {
+		t.Errorf("codecPolicy = %v", got["codecPolicy"])
+	}
+}
+
+func TestRoomStatus(t *testing.T) {
+	c, requests := recordingServer(t, func(w http.ResponseWriter, r *http.Request, _ map[string]interface{}) {
+		w.Write([]byte(`{"exists":true,"hasBroadcaster":true,"viewerCount":2,"layers":["low","high"],
+			"bytesIngress":100,"codec":"video/VP8","tracks":[{"label":"screen","kind":"video"}],"dataChannels":{"chat":1},
+			"quality":[{"label":"screen","kind":"video","viewers":2,"fractionLost":{"median":0.01,"worst":0.1},"jitterMs":{"median":2,"worst":5}}]}`))
+	})
+	status, err := c.RoomStatus(context.Background(), "a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; req.URL.EscapedPath() != "/internal/room/a%20b/status" {
+		t.Errorf("path = %s", req.URL.EscapedPath())
+	}
+	if !status.Exists || !status.HasBroadcaster || status.ViewerCount != 2 || len(status.Layers) != 2 ||
+		status.BytesIngress != 100 || status.Codec != "video/VP8" || status.DataChannels["chat"] != 1 {
+		t.Errorf("status = %+v", status)
+	}
+	if len(status.Tracks) != 1 || status.Tracks[0].Label != "screen" {
+		t.Errorf("tracks = %+v", status.Tracks)
+	}
+	if len(status.Quality) != 1 || status.Quality[0].FractionLost.Worst != 0.1 || status.Quality[0].RTTMs != nil {
+		t.Errorf("quality = %+v", status.Quality)
+	}
+}
+
+func TestError(t *testing.T) {
+	c, _ := recordingServer(t, func(w http.ResponseWriter, r *http.Request, _ map[string]interface{}) {
+		if r.URL.Path == "/internal/room/full/status" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"code":"room_limit_reached","message":"Room limit reached","details":{"maxRooms":1}}}`))
+			return
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	})
+
+	_, err := c.RoomStatus(context.Background(), "full")
+	apiErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %v, want an *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "Room limit reached" || apiErr.Details["maxRooms"] != float64(1) {
+		t.Errorf("err = %+v", apiErr)
+	}
+	if !HasCode(err, "room_limit_reached") || HasCode(err, "room_full") {
+		t.Errorf("HasCode wrong for %v", err)
+	}
+
+	// A body that isn't the API's still gives the status
+	_, err = c.RoomStatus(context.Background(), "other")
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" {
+		t.Errorf("err = %v, want a bare 502", err)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Room event types
+const (
+	EventViewerJoined       = "viewer_joined"
+	EventViewerLeft         = "viewer_left"
+	EventViewerKicked       = "viewer_kicked"
+	EventBroadcasterStarted = "broadcaster_started"
+	EventBroadcasterEnded   = "broadcaster_ended"
+	EventQuotaExceeded      = "quota_exceeded"
+	EventRecordingStarted   = "recording_started"
+	EventRecordingStopped   = "recording_stopped"
+	EventQualityDegraded    = "quality_degraded"
+	EventQualityRecovered   = "quality_recovered"
+	EventRoomClosed         = "room_closed"
+)
+
+// Event is a change in a room's state
+type Event struct {
+	Type        string        `json:"type"`
+	RoomID      string        `json:"roomId"`
+	ViewerCount int           `json:"viewerCount"`
+	ViewerID    string        `json:"viewerId,omitempty"`
+	Banned      bool          `json:"banned,omitempty"`
+	Files       []string      `json:"files,omitempty"`   // on recording_stopped
+	Quality     *TrackQuality `json:"quality,omitempty"` // on quality_degraded and quality_recovered
+	Time        time.Time     `json:"time"`
+}
+
+// Events streams the room's events until ctx is done, the room closes or
+// the connection drops, then closes the channel. It returns once the
+// stream is open, so events from then on aren't missed.
+func (c *Client) Events(ctx context.Context, roomID string) (<-chan Event, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, roomPath(roomID, "events"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		readEvents(ctx, resp, events)
+	}()
+	return events, nil
+}
+
+// readEvents sends the server-sent events in resp's body to events. Lines
+// other than data, such as the keep-alive comments, are skipped, and so
+// are events whose data isn't an Event.
+func readEvents(ctx context.Context, resp *http.Response, events chan<- Event) {
+	scanner := bufio.NewScanner(resp.Body)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+
+		var event Event
+		err := json.Unmarshal([]byte(data.String()), &event)
+		data.Reset()
+		if err != nil {
+			continue
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	c, requests := recordingServer(t, func(w http.ResponseWriter, r *http.Request, _ map[string]interface{}) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": connected\n\n: ping\n\n" +
+			"event: viewer_joined\ndata: {\"type\":\"viewer_joined\",\"roomId\":\"abc\",\"viewerCount\":1,\"viewerId\":\"v1\"}\n\n" +
+			"event: broken\ndata: {not json\n\n" +
+			"event: quality_degraded\ndata: {\"type\":\"quality_degraded\",\"roomId\":\"abc\",\"quality\":{\"label\":\"screen\",\"fractionLost\":{\"median\":0.1,\"worst\":0.3}}}\n\n" +
+			"event: room_closed\ndata: {\"type\":\"room_closed\",\"roomId\":\"abc\"}\n\n"))
+	})
+	events, err := c.Events(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; req.URL.Path != "/internal/room/abc/events" || req.Header.Get("Accept") != "text/event-stream" {
+		t.Errorf("request = %s, Accept %q", req.URL.Path, req.Header.Get("Accept"))
+	}
+
+	var got []Event
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, event)
+		case <-timeout:
+			t.Fatal("event stream didn't end")
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("events = %+v, want 3", got)
+	}
+	if got[0].Type != EventViewerJoined || got[0].ViewerID != "v1" || got[0].ViewerCount != 1 {
+		t.Errorf("first event = %+v", got[0])
+	}
+	if got[1].Type != EventQualityDegraded || got[1].Quality == nil || got[1].Quality.FractionLost.Median != 0.1 {
+		t.Errorf("second event = %+v", got[1])
+	}
+	if got[2].Type != EventRoomClosed {
+		t.Errorf("third event = %+v", got[2])
+	}
+}
+
+func TestEventsNotFound(t *testing.T) {
+	c, _ := recordingServer(t, func(w http.ResponseWriter, r *http.Request, _ map[string]interface{}) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":"room_not_found","message":"Room not found"}}`))
+	})
+	if _, err := c.Events(context.Background(), "abc"); !HasCode(err, "room_not_found") {
+		t.Errorf("err = %v, want room_not_found", err)
+	}
+}
+
+func TestEventsCancel(t *testing.T) {
+	c, _ := recordingServer(t, func(w http.ResponseWriter, r *http.Request, _ map[string]interface{}) {
+		w.Write([]byte(": connected\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Events(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("got an event after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled stream wasn't closed")
+	}
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// FilePublisher is a session sending media files
+type FilePublisher struct {
+	*Session
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+// Wait blocks until every file has been sent, or the session is closed,
+// returning the first error reading or sending one
+func (p *FilePublisher) Wait() error {
+	p.wg.Wait()
+	return p.err
+}
+
+// PublishFile sends media files as the room's broadcaster: IVF files of
+// VP8, VP9 or AV1 video, Ogg files of Opus audio, and WebM files of
+// either or both. A file's track is named after it, so camera.ivf is track
+// camera; a WebM file's other tracks are camera-1, camera-2 and so on.
+// They are sent at the pace they were recorded, once unless opts.Loop is
+// set.
+func (c *Client) PublishFile(ctx context.Context, roomID string, opts PublishOptions, paths ...string) (*FilePublisher, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("sfu: no files to publish")
+	}
+	var files []*mediaFile
+	closeFiles := func() {
+		for _, file := range files {
+			file.close()
+		}
+	}
+	var tracks []webrtc.TrackLocal
+	for _, path := range paths {
+		file, err := openMediaFile(path)
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		files = append(files, file)
+		for _, track := range file.tracks {
+			tracks = append(tracks, track)
+		}
+	}
+
+	session, err := c.PublishTrack(ctx, roomID, opts, tracks...)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	pub := &FilePublisher{Session: session}
+	for _, file := range files {
+		pub.wg.Add(1)
+		go func(file *mediaFile) {
+			defer pub.wg.Done()
+			defer file.close()
+			if err := file.send(session.done, opts.Loop); err != nil {
+				pub.errOnce.Do(func() { pub.err = err })
+			}
+		}(file)
+	}
+	return pub, nil
+}
+
+// sample is a frame of one of a media file's tracks, due at its time into
+// the file
+type sample struct {
+	track int
+	data  []byte
+	at    time.Duration
+}
+
+// sampleReader reads a media file's samples in order, returning io.EOF
+// after the last
+type sampleReader func() (sample, error)
+
+// mediaFile is a file being sent on its tracks
+type mediaFile struct {
+	path   string
+	tracks []*webrtc.TrackLocalStaticSample
+
+	file *os.File
+	read sampleReader
+}
+
+// openMediaFile opens the file at path and makes its tracks, telling the
+// codecs from its header
+func openMediaFile(path string) (*mediaFile, error) {
+	f := &mediaFile{path: path}
+	codecs, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for i, codec := range codecs {
+		id := name
+		if i > 0 {
+			id = fmt.Sprintf("%s-%d", name, i)
+		}
+		track, err := webrtc.NewTrackLocalStaticSample(codec, id, "rubigo-client")
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+		f.tracks = append(f.tracks, track)
+	}
+	return f, nil
+}
+
+// open opens the file from its start, returning its tracks' codecs
+func (f *mediaFile) open() ([]webrtc.RTPCodecCapability, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var codecs []webrtc.RTPCodecCapability
+	var read sampleReader
+	switch ext := strings.ToLower(filepath.Ext(f.path)); ext {
+	case ".ivf":
+		codecs, read, err = readIVF(file)
+	case ".ogg", ".opus":
+		codecs, read, err = readOgg(file)
+	case ".webm":
+		codecs, read, err = readWebM(file)
+	default:
+		err = errors.New("unsupported file type " + ext)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("sfu: failed to open %s: %w", f.path, err)
+	}
+	f.file, f.read = file, read
+	return codecs, nil
+}
+
+func (f *mediaFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// send writes the file's samples to their tracks at the pace they are due,
+// from the start again each time it ends if loop is set, until done is
+// closed
+func (f *mediaFile) send(done <-chan struct{}, loop bool) error {
+	start := time.Now()
+	var offset time.Duration // when into the stream the file started over
+	for {
+		// A sample lasts until the next of its track begins, so each is
+		// held until then. The last sample of a track lasts as long as the
+		// one before it.
+		pending := make([]*sample, len(f.tracks))
+		durations := make([]time.Duration, len(f.tracks))
+		write := func(s *sample, duration time.Duration) (bool, error) {
+			timer := time.NewTimer(time.Until(start.Add(offset + s.at)))
+			defer timer.Stop()
+			select {
+			case <-done:
+				return false, nil
+			case <-timer.C:
+			}
+			if err := f.tracks[s.track].WriteSample(media.Sample{Data: s.data, Duration: duration}); err != nil {
+				return false, fmt.Errorf("sfu: failed to send %s: %w", f.path, err)
+			}
+			return true, nil
+		}
+
+		sent := false
+		for {
+			next, err := f.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("sfu: failed to read %s: %w", f.path, err)
+			}
+			if s := pending[next.track]; s != nil {
+				durations[next.track] = next.at - s.at
+				if ok, err := write(s, durations[next.track]); !ok {
+					return err
+				}
+			}
+			pending[next.track] = &next
+			sent = true
+		}
+		if !sent {
+			return fmt.Errorf("sfu: failed to read %s: no media", f.path)
+		}
+
+		// The file ends when the last of its tracks does
+		pending = slices.DeleteFunc(pending, func(s *sample) bool { return s == nil })
+		var end time.Duration
+		for _, s := range pending {
+			end = max(end, s.at+durations[s.track])
+		}
+		slices.SortFunc(pending, func(a, b *sample) int { return cmp.Compare(a.at, b.at) })
+		for _, s := range pending {
+			if ok, err := write(s, durations[s.track]); !ok {
+				return err
+			}
+		}
+		offset += end
+
+		f.close()
+		if !loop {
+			return nil
+		}
+		if _, err := f.open(); err != nil {
+			return err
+		}
+	}
+}
+
+// ivfCodecs are the video codecs IVF files are sent in, by FourCC
+var ivfCodecs = map[string]webrtc.RTPCodecCapability{
+	"VP80": {MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	"VP90": {MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+	"AV01": {MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+}
+
+// readIVF reads an IVF file's frames, due at their timestamps in the
+// file's timebase
+func readIVF(r io.Reader) ([]webrtc.RTPCodecCapability, sampleReader, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	codec, ok := ivfCodecs[header.FourCC]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported IVF codec %q", header.FourCC)
+	}
+	if header.TimebaseDenominator == 0 {
+		return nil, nil, errors.New("IVF timebase is zero")
+	}
+	return []webrtc.RTPCodecCapability{codec}, func() (sample, error) {
+		frame, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			return sample{}, err
+		}
+		at := time.Duration(frameHeader.Timestamp*uint64(header.TimebaseNumerator)) * time.Second
+		return sample{data: frame, at: at / time.Duration(header.TimebaseDenominator)}, nil
+	}, nil
+}
+
+// readOgg reads an Ogg Opus file's pages, each due where the one before
+// it ended. Opus granule positions count at 48kHz whatever the input rate.
+func readOgg(r io.Reader) ([]webrtc.RTPCodecCapability, sampleReader, error) {
+	reader, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	var granule uint64
+	return []webrtc.RTPCodecCapability{codec}, func() (sample, error) {
+		for {
+			page, pageHeader, err := reader.ParseNextPage()
+			if err != nil {
+				return sample{}, err
+			}
+			// The comment header isn't audio
+			if bytes.HasPrefix(page, []byte("OpusTags")) {
+				continue
+			}
+			at := time.Duration(granule) * time.Second / 48000
+			granule = pageHeader.GranulePosition
+			return sample{data: page, at: at}, nil
+		}
+	}, nil
+}
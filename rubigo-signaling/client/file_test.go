@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// writeIVF writes a VP8 IVF file with a millisecond timebase and a frame
+// at each of timestamps
+func writeIVF(t *testing.T, path string, timestamps ...uint64) {
+	t.Helper()
+	var buf bytes.Buffer
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], "VP80")
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(timestamps)))
+	buf.Write(header)
+	for _, ts := range timestamps {
+		frame := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frame, 3)
+		binary.LittleEndian.PutUint64(frame[4:], ts)
+		buf.Write(frame)
+		buf.Write([]byte{0x10, 0x02, 0x00})
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAll reads every sample's time
+func readAll(t *testing.T, read sampleReader) []time.Duration {
+	t.Helper()
+	var times []time.Duration
+	for {
+		s, err := read()
+		if err == io.EOF {
+			return times
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, s.at)
+	}
+}
+
+func TestReadIVF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "camera.ivf")
+	writeIVF(t, path, 0, 40, 80)
+	file, err := openMediaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	if len(file.tracks) != 1 || file.tracks[0].ID() != "camera" || file.tracks[0].Codec().MimeType != webrtc.MimeTypeVP8 {
+		t.Errorf("track = %s %s, want camera VP8", file.tracks[0].ID(), file.tracks[0].Codec().MimeType)
+	}
+	want := []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond}
+	if got := readAll(t, file.read); len(got) != 3 || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("sample times = %v, want %v", got, want)
+	}
+}
+
+func TestReadOgg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audio.ogg")
+	w, err := oggwriter.New(path, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 4; i++ {
+		if err := w.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: i * 960}, Payload: []byte{0xfc, 0xff, 0xfe}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	file, err := openMediaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	if file.tracks[0].Codec().MimeType != webrtc.MimeTypeOpus {
+		t.Errorf("codec = %s, want Opus", file.tracks[0].Codec().MimeType)
+	}
+	// Pages start where the one before ended, 20ms apart after the first,
+	// which the writer ends almost at once
+	got := readAll(t, file.read)
+	if len(got) != 4 || got[0] != 0 || got[2]-got[1] != 20*time.Millisecond || got[3]-got[2] != 20*time.Millisecond {
+		t.Errorf("sample times = %v, want pages 20ms apart", got)
+	}
+}
+
+func TestOpenMediaFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "notes.txt")
+	os.WriteFile(text, []byte("hello"), 0o600)
+	bad := filepath.Join(dir, "bad.ivf")
+	os.WriteFile(bad, []byte("not an ivf file at all, but long enough"), 0o600)
+	for _, path := range []string{text, bad, filepath.Join(dir, "missing.ivf")} {
+		if _, err := openMediaFile(path); err == nil {
+			t.Errorf("%s opened", path)
+		}
+	}
+}
+
+func TestMediaFileSend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screen.ivf")
+	writeIVF(t, path, 0, 20, 40)
+	file, err := openMediaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+
+	// Sent at the pace of the timestamps
+	start := time.Now()
+	if err := file.send(make(chan struct{}), false); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("sent in %v, want at least 40ms", elapsed)
+	}
+
+	// Looping goes on until done
+	if _, err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	time.AfterFunc(150*time.Millisecond, func() { close(done) })
+	start = time.Now()
+	if err := file.send(done, true); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("looped for %v, want until done", elapsed)
+	}
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Answer is the SFU's answer to a publish or subscribe offer
+type Answer struct {
+	SDP  string `json:"sdp"`
+	Type string `json:"type"`
+	// Layer is the simulcast layer a viewer was given
+	Layer string `json:"layer,omitempty"`
+	// ViewerID identifies a viewer for the per-viewer routes
+	ViewerID string `json:"viewerId,omitempty"`
+	// PeerID identifies a co-presenter
+	PeerID string `json:"peerId,omitempty"`
+	// ReconnectToken lets the broadcaster republish, or the viewer
+	// resubscribe into its slot, after a drop
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+	// Tracks labels the media sections of a subscribe answer
+	Tracks []TrackInfo `json:"tracks,omitempty"`
+}
+
+// offer is the body of a publish or subscribe request
+type offer struct {
+	SDP            string            `json:"sdp"`
+	Type           string            `json:"type"`
+	Layer          string            `json:"layer,omitempty"`
+	Password       string            `json:"password,omitempty"`
+	ViewerID       string            `json:"viewerId,omitempty"`
+	ReconnectToken string            `json:"reconnectToken,omitempty"`
+	TrackLabels    map[string]string `json:"trackLabels,omitempty"`
+}
+
+// Session is a peer connection negotiated with the SFU
+type Session struct {
+	PC     *webrtc.PeerConnection
+	Answer Answer
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Done is closed once the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the peer connection
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.PC.Close()
+	})
+	return err
+}
+
+// newPeerConnection creates a peer connection with the client's settings
+func (c *Client) newPeerConnection() (*webrtc.PeerConnection, error) {
+	if c.API != nil {
+		return c.API.NewPeerConnection(c.WebRTC)
+	}
+	return webrtc.NewPeerConnection(c.WebRTC)
+}
+
+// negotiate sends pc's offer, with its candidates gathered, to the room's
+// route and applies the answer. labels, if any, names the offer's tracks
+// by their track IDs; the SFU wants them by mid, known once the offer is
+// set.
+func (c *Client) negotiate(ctx context.Context, pc *webrtc.PeerConnection, path string, body offer, labels map[string]string) (Answer, error) {
+	local, err := pc.CreateOffer(nil)
+	if err != nil {
+		return Answer{}, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(local); err != nil {
+		return Answer{}, err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return Answer{}, ctx.Err()
+	}
+
+	body.Type = "offer"
+	body.SDP = pc.LocalDescription().SDP
+	for _, transceiver := range pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil || sender.Track() == nil {
+			continue
+		}
+		if label, ok := labels[sender.Track().ID()]; ok {
+			if body.TrackLabels == nil {
+				body.TrackLabels = make(map[string]string)
+			}
+			body.TrackLabels[transceiver.Mid()] = label
+		}
+	}
+
+	var answer Answer
+	if err := c.do(ctx, http.MethodPost, path, body, &answer); err != nil {
+		return Answer{}, err
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		return Answer{}, fmt.Errorf("sfu: failed to apply answer: %w", err)
+	}
+	return answer, nil
+}
+
+// PublishOptions configure a broadcaster's offer
+type PublishOptions struct {
+	// Password is the room's, if it has one
+	Password string
+	// ReconnectToken, from an earlier publish answer, republishes without
+	// the password
+	ReconnectToken string
+	// Labels names tracks by track ID, e.g. {"cam": "camera"}; the first
+	// video track is labelled screen unless named here
+	Labels map[string]string
+	// Loop has PublishFile start its files over when they end
+	Loop bool
+}
+
+// PublishTrack publishes tracks to the room as its broadcaster. The caller
+// writes the tracks' media and closes the session when done.
+func (c *Client) PublishTrack(ctx context.Context, roomID string, opts PublishOptions, tracks ...webrtc.TrackLocal) (*Session, error) {
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("sfu: no tracks to publish")
+	}
+	pc, err := c.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	for _, track := range tracks {
+		if _, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		}); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+
+	body := offer{Password: opts.Password, ReconnectToken: opts.ReconnectToken}
+	answer, err := c.negotiate(ctx, pc, roomPath(roomID, "publish"), body, opts.Labels)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &Session{PC: pc, Answer: answer, done: make(chan struct{})}, nil
+}
+
+// SubscribeOptions configure a viewer's offer
+type SubscribeOptions struct {
+	// Password is the room's, if it has one
+	Password string
+	// Layer asks for a simulcast layer: low, mid, high or auto
+	Layer string
+	// ViewerID chooses the viewer's ID; empty lets the SFU pick one
+	ViewerID string
+	// ReconnectToken, from an earlier subscribe answer, takes back the
+	// viewer's slot
+	ReconnectToken string
+	// Wait holds the request until the room has a broadcaster
+	Wait bool
+	// Video and Audio are how many media sections of each kind to offer,
+	// for the room's extra tracks; zero means one
+	Video, Audio int
+}
+
+// Subscription is a viewer's session
+type Subscription struct {
+	*Session
+	tracks chan *webrtc.TrackRemote
+}
+
+// Tracks delivers the tracks the SFU sends as they start. The caller must
+// read them, and their RTP, or the peer connection stalls.
+func (s *Subscription) Tracks() <-chan *webrtc.TrackRemote {
+	return s.tracks
+}
+
+// Subscribe joins the room as a viewer
+func (c *Client) Subscribe(ctx context.Context, roomID string, opts SubscribeOptions) (*Subscription, error) {
+	pc, err := c.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	sections := map[webrtc.RTPCodecType]int{
+		webrtc.RTPCodecTypeVideo: max(opts.Video, 1),
+		webrtc.RTPCodecTypeAudio: max(opts.Audio, 1),
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		for i := 0; i < sections[kind]; i++ {
+			if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				pc.Close()
+				return nil, err
+			}
+		}
+	}
+
+	sub := &Subscription{
+		Session: &Session{PC: pc, done: make(chan struct{})},
+		tracks:  make(chan *webrtc.TrackRemote, sections[webrtc.RTPCodecTypeVideo]+sections[webrtc.RTPCodecTypeAudio]),
+	}
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		select {
+		case sub.tracks <- remote:
+		case <-sub.done:
+		}
+	})
+
+	path := roomPath(roomID, "subscribe")
+	if opts.Wait {
+		path += "?wait=true"
+	}
+	body := offer{Password: opts.Password, Layer: opts.Layer, ViewerID: opts.ViewerID, ReconnectToken: opts.ReconnectToken}
+	answer, err := c.negotiate(ctx, pc, path, body, nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sub.Answer = answer
+	return sub, nil
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// answeringServer answers offers as an SFU would, with reply's fields, and
+// sends each offer it gets, with its URL, on the returned channel
+func answeringServer(t *testing.T, reply Answer) (*Client, chan offerRequest) {
+	t.Helper()
+	offers := make(chan offerRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body offer
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offers <- offerRequest{r.URL.RequestURI(), body}
+
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.Cleanup(func() { pc.Close() })
+		if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: body.SDP}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		gathered := webrtc.GatheringCompletePromise(pc)
+		pc.SetLocalDescription(answer)
+		<-gathered
+
+		reply.Type, reply.SDP = "answer", pc.LocalDescription().SDP
+		json.NewEncoder(w).Encode(reply)
+	}))
+	t.Cleanup(server.Close)
+	return New(server.URL), offers
+}
+
+type offerRequest struct {
+	uri  string
+	body offer
+}
+
+func TestPublishTrack(t *testing.T) {
+	c, offers := answeringServer(t, Answer{ReconnectToken: "token"})
+	screen, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cam, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "cam", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := c.PublishTrack(context.Background(), "abc", PublishOptions{Password: "pw", Labels: map[string]string{"cam": "camera"}}, screen, cam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	got := <-offers
+	if got.uri != "/internal/room/abc/publish" || got.body.Type != "offer" || got.body.Password != "pw" {
+		t.Errorf("offer to %s = %+v", got.uri, got.body)
+	}
+	// Labels are sent by the mid the track got
+	if len(got.body.TrackLabels) != 1 || got.body.TrackLabels["1"] != "camera" {
+		t.Errorf("trackLabels = %v, want the camera's mid", got.body.TrackLabels)
+	}
+	if session.Answer.ReconnectToken != "token" {
+		t.Errorf("answer = %+v", session.Answer)
+	}
+	if state := session.PC.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("signaling state = %s, want stable", state)
+	}
+
+	if _, err := c.PublishTrack(context.Background(), "abc", PublishOptions{}); err == nil {
+		t.Error("publishing nothing succeeded")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c, offers := answeringServer(t, Answer{ViewerID: "v1", Tracks: []TrackInfo{{Label: "screen", Kind: "video", Mid: "0"}}})
+	sub, err := c.Subscribe(context.Background(), "abc", SubscribeOptions{Wait: true, Layer: "low", Video: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := <-offers
+	if got.uri != "/internal/room/abc/subscribe?wait=true" || got.body.Layer != "low" {
+		t.Errorf("offer to %s = %+v", got.uri, got.body)
+	}
+	kinds := map[webrtc.RTPCodecType]int{}
+	for _, transceiver := range sub.PC.GetTransceivers() {
+		if transceiver.Direction() != webrtc.RTPTransceiverDirectionRecvonly {
+			t.Errorf("transceiver %s is %s, want recvonly", transceiver.Mid(), transceiver.Direction())
+		}
+		kinds[transceiver.Kind()]++
+	}
+	if kinds[webrtc.RTPCodecTypeVideo] != 2 || kinds[webrtc.RTPCodecTypeAudio] != 1 {
+		t.Errorf("transceivers = %v, want 2 video and 1 audio", kinds)
+	}
+	if sub.Answer.ViewerID != "v1" || len(sub.Answer.Tracks) != 1 {
+		t.Errorf("answer = %+v", sub.Answer)
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Done():
+	default:
+		t.Error("Done not closed")
+	}
+	if err := sub.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":{"code":"invalid_password","message":"Invalid password"}}`))
+	}))
+	defer server.Close()
+	if _, err := New(server.URL).Subscribe(context.Background(), "abc", SubscribeOptions{Password: "wrong"}); !HasCode(err, "invalid_password") {
+		t.Errorf("err = %v, want invalid_password", err)
+	}
+}
@@ -0,0 +1,277 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WebM files are read as far as sending them needs: the codecs of their
+// tracks, and their blocks in file order. Only unlaced blocks are read,
+// which is how VP8, VP9, AV1 and Opus are muxed; seeking, cues and the
+// rest are skipped over. Segments and clusters may have unknown sizes, as
+// in recordings this SFU and browsers' MediaRecorder make.
+
+// Matroska element IDs, marker bits included
+const (
+	webmEBMLID          = 0x1A45DFA3
+	webmSegmentID       = 0x18538067
+	webmInfoID          = 0x1549A966
+	webmTimecodeScaleID = 0x2AD7B1
+	webmTracksID        = 0x1654AE6B
+	webmTrackEntryID    = 0xAE
+	webmTrackNumberID   = 0xD7
+	webmCodecIDID       = 0x86
+	webmClusterID       = 0x1F43B675
+	webmTimecodeID      = 0xE7
+	webmSimpleBlockID   = 0xA3
+	webmBlockGroupID    = 0xA0
+	webmBlockID         = 0xA1
+)
+
+// webmCodecs are the codecs WebM tracks are sent in, by codec ID
+var webmCodecs = map[string]webrtc.RTPCodecCapability{
+	"V_VP8":  {MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+	"V_VP9":  {MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+	"V_AV1":  {MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+	"A_OPUS": {MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+}
+
+// webmMaxElement bounds the elements read into memory, so a corrupt size
+// doesn't exhaust it
+const webmMaxElement = 16 << 20
+
+// webmReader reads a WebM file's elements in order, descending into the
+// masters that lead to tracks and blocks
+type webmReader struct {
+	r       *bufio.Reader
+	scale   time.Duration // of timecodes
+	cluster uint64        // timecode of the current cluster
+	tracks  map[uint64]int
+}
+
+// readWebM reads a WebM file's tracks, those of a codec it can send, and
+// returns their codecs and a reader of their blocks
+func readWebM(r io.Reader) ([]webrtc.RTPCodecCapability, sampleReader, error) {
+	w := &webmReader{r: bufio.NewReader(r), scale: time.Millisecond, tracks: make(map[uint64]int)}
+	id, size, err := w.header()
+	if err != nil || id != webmEBMLID {
+		return nil, nil, errors.New("not a WebM file")
+	}
+	if err := w.skip(size); err != nil {
+		return nil, nil, err
+	}
+
+	// The tracks are listed before the first cluster
+	var codecs []webrtc.RTPCodecCapability
+	var number uint64
+	for {
+		id, size, err := w.header()
+		if err == io.EOF {
+			return nil, nil, errors.New("no clusters in WebM file")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if id == webmClusterID {
+			break
+		}
+		switch id {
+		case webmSegmentID, webmInfoID, webmTracksID:
+		case webmTrackEntryID:
+			number = 0
+		case webmTimecodeScaleID:
+			scale, err := w.readUint(size)
+			if err != nil {
+				return nil, nil, err
+			}
+			w.scale = time.Duration(scale)
+		case webmTrackNumberID:
+			if number, err = w.readUint(size); err != nil {
+				return nil, nil, err
+			}
+		case webmCodecIDID:
+			// The track number comes first in the entries muxers write
+			data, err := w.readBytes(size)
+			if err != nil {
+				return nil, nil, err
+			}
+			if codec, ok := webmCodecs[string(data)]; ok && number != 0 {
+				w.tracks[number] = len(codecs)
+				codecs = append(codecs, codec)
+			}
+		default:
+			if err := w.skip(size); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(codecs) == 0 {
+		return nil, nil, errors.New("no VP8, VP9, AV1 or Opus track in WebM file")
+	}
+	return codecs, w.next, nil
+}
+
+// next returns the next block of one of the file's tracks
+func (w *webmReader) next() (sample, error) {
+	for {
+		id, size, err := w.header()
+		if err != nil {
+			return sample{}, err
+		}
+		switch id {
+		case webmSegmentID, webmClusterID, webmBlockGroupID:
+		case webmTimecodeID:
+			if w.cluster, err = w.readUint(size); err != nil {
+				return sample{}, err
+			}
+		case webmSimpleBlockID, webmBlockID:
+			data, err := w.readBytes(size)
+			if err != nil {
+				return sample{}, err
+			}
+			s, ok, err := w.block(data)
+			if err != nil {
+				return sample{}, err
+			}
+			if ok {
+				return s, nil
+			}
+		default:
+			if err := w.skip(size); err != nil {
+				return sample{}, err
+			}
+		}
+	}
+}
+
+// block parses a block, reporting false if its track isn't sent
+func (w *webmReader) block(data []byte) (sample, bool, error) {
+	number, n := webmVint(data)
+	if n == 0 || len(data) < n+3 {
+		return sample{}, false, errors.New("invalid WebM block")
+	}
+	track, ok := w.tracks[number]
+	if !ok {
+		return sample{}, false, nil
+	}
+	if data[n+2]&0x06 != 0 {
+		return sample{}, false, errors.New("laced WebM blocks aren't supported")
+	}
+	timecode := int64(w.cluster) + int64(int16(binary.BigEndian.Uint16(data[n:])))
+	return sample{track: track, data: data[n+3:], at: time.Duration(max(timecode, 0)) * w.scale}, true, nil
+}
+
+// webmVint decodes the variable-length integer data starts with, marker
+// removed, returning its value and length, or a zero length if invalid
+func webmVint(data []byte) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	n := 1
+	for data[0]&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if len(data) < n {
+		return 0, 0
+	}
+	v := uint64(data[0] & (0xFF >> n))
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, n
+}
+
+// header reads an element's ID and size. An unknown size, all ones, is
+// returned as -1.
+func (w *webmReader) header() (uint32, int64, error) {
+	id, err := w.vint(4, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := w.vint(8, true)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(id), size, nil
+}
+
+// vint reads a variable-length integer of at most maxLen bytes, with its
+// length marker kept for IDs and removed for sizes
+func (w *webmReader) vint(maxLen int, isSize bool) (int64, error) {
+	first, err := w.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	for n <= maxLen && first&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if n > maxLen {
+		return 0, fmt.Errorf("invalid WebM element header byte %#x", first)
+	}
+	v := uint64(first)
+	unknown := isSize && first == 0xFF>>(n-1)
+	if isSize {
+		v &= 0xFF >> n
+	}
+	for i := 1; i < n; i++ {
+		b, err := w.r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		unknown = unknown && b == 0xFF
+		v = v<<8 | uint64(b)
+	}
+	if unknown {
+		return -1, nil
+	}
+	return int64(v), nil
+}
+
+// readBytes reads an element's data
+func (w *webmReader) readBytes(size int64) ([]byte, error) {
+	if size < 0 || size > webmMaxElement {
+		return nil, fmt.Errorf("invalid WebM element size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(w.r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// readUint reads an unsigned integer element
+func (w *webmReader) readUint(size int64) (uint64, error) {
+	if size > 8 {
+		return 0, fmt.Errorf("invalid WebM integer size %d", size)
+	}
+	data, err := w.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// skip skips an element's data
+func (w *webmReader) skip(size int64) error {
+	if size < 0 {
+		return errors.New("WebM element of unknown size can't be skipped")
+	}
+	if _, err := w.r.Discard(int(size)); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// webmElement encodes an EBML element with a one- or two-byte size
+func webmElement(id uint32, children ...[]byte) []byte {
+	var data []byte
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	if len(data) < 0x7F {
+		out = append(out, 0x80|byte(len(data)))
+	} else {
+		out = append(out, 0x40|byte(len(data)>>8), byte(len(data)))
+	}
+	return append(out, data...)
+}
+
+// webmUnknown starts a master element of unknown size
+func webmUnknown(id uint32) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, id), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+}
+
+func webmBlock(track byte, relative int16, flags byte, frame ...byte) []byte {
+	block := binary.BigEndian.AppendUint16([]byte{0x80 | track}, uint16(relative))
+	return webmElement(webmSimpleBlockID, append(append(block, flags), frame...))
+}
+
+// testWebM is a recording of VP8 and Opus tracks, with a subtitle track
+// that isn't sent, in two clusters of unknown size
+func testWebM(blocks ...[]byte) []byte {
+	var file []byte
+	file = append(file, webmElement(webmEBMLID, webmElement(0x4282, []byte("webm")))...)
+	file = append(file, webmUnknown(webmSegmentID)...)
+	file = append(file, webmElement(0x114D9B74, []byte{0xEC, 0x80})...) // a SeekHead to skip
+	file = append(file, webmElement(webmInfoID, webmElement(webmTimecodeScaleID, []byte{0x0F, 0x42, 0x40}))...)
+	file = append(file, webmElement(webmTracksID,
+		webmElement(webmTrackEntryID, webmElement(webmTrackNumberID, []byte{1}), webmElement(webmCodecIDID, []byte("V_VP8"))),
+		webmElement(webmTrackEntryID, webmElement(webmTrackNumberID, []byte{2}), webmElement(webmCodecIDID, []byte("S_TEXT/UTF8"))),
+		webmElement(webmTrackEntryID, webmElement(webmTrackNumberID, []byte{3}), webmElement(webmCodecIDID, []byte("A_OPUS"))),
+	)...)
+	file = append(file, webmUnknown(webmClusterID)...)
+	file = append(file, webmElement(webmTimecodeID, []byte{0})...)
+	for _, block := range blocks {
+		file = append(file, block...)
+	}
+	return file
+}
+
+func TestReadWebM(t *testing.T) {
+	data := testWebM(
+		webmBlock(1, 0, 0x80, 0x10),
+		webmBlock(3, 0, 0x80, 0xfc),
+		webmBlock(2, 5, 0x80, 'h', 'i'),
+		webmBlock(3, 20, 0x80, 0xfc),
+		webmElement(webmBlockGroupID, webmElement(webmBlockID, []byte{0x81, 0, 33, 0, 0x11})),
+		// A second cluster, a second on
+		webmUnknown(webmClusterID), webmElement(webmTimecodeID, []byte{0x03, 0xE8}),
+		webmBlock(1, -1, 0, 0x12),
+	)
+	codecs, read, err := readWebM(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) != 2 || codecs[0].MimeType != webrtc.MimeTypeVP8 || codecs[1].MimeType != webrtc.MimeTypeOpus {
+		t.Fatalf("codecs = %+v, want VP8 and Opus", codecs)
+	}
+	want := []sample{
+		{0, []byte{0x10}, 0},
+		{1, []byte{0xfc}, 0},
+		{1, []byte{0xfc}, 20 * time.Millisecond},
+		{0, []byte{0x11}, 33 * time.Millisecond},
+		{0, []byte{0x12}, 999 * time.Millisecond},
+	}
+	for i, w := range want {
+		got, err := read()
+		if err != nil {
+			t.Fatalf("sample %d: %v", i, err)
+		}
+		if got.track != w.track || !bytes.Equal(got.data, w.data) || got.at != w.at {
+			t.Errorf("sample %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if _, err := read(); err == nil {
+		t.Error("read past the end")
+	}
+}
+
+func TestReadWebMErrors(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"not webm":  []byte("RIFF....WAVEfmt "),
+		"no tracks": append(webmElement(webmEBMLID), append(webmUnknown(webmSegmentID), webmUnknown(webmClusterID)...)...),
+		"truncated": testWebM()[:20],
+	} {
+		if _, _, err := readWebM(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: read", name)
+		}
+	}
+
+	_, read, err := readWebM(bytes.NewReader(testWebM(webmBlock(1, 0, 0x82, 0, 0x10))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(); err == nil {
+		t.Error("laced block read")
+	}
+}
+
+func TestWebMFileTracks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.webm")
+	if err := os.WriteFile(path, testWebM(webmBlock(1, 0, 0x80, 0x10), webmBlock(3, 0, 0x80, 0xfc)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openMediaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	if len(file.tracks) != 2 || file.tracks[0].ID() != "rec" || file.tracks[1].ID() != "rec-1" {
+		t.Fatalf("tracks = %v, want rec and rec-1", file.tracks)
+	}
+	if err := file.send(make(chan struct{}), false); err != nil {
+		t.Error(err)
+	}
+}
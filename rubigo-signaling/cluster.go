@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// In cluster mode several SFU nodes share one Redis. Each room is owned by
+// the node that created it or took its first publish, recorded as a lease
+// the owner renews while the room exists. Requests for a room owned
+// elsewhere are rejected, or redirected to the owner, since a room's media
+// must all flow through one node. Owners also publish each room's status so
+// any node can answer for it.
+
+// defaultClusterLeaseTTL is how long a room stays assigned to a node that
+// stops renewing it, e.g. because it crashed
+const defaultClusterLeaseTTL = 15 * time.Second
+
+// clusterKeyPrefix namespaces the registry's Redis keys
+const clusterKeyPrefix = "rubigo-sfu:"
+
+// ClusterConfig holds cluster mode settings
+type ClusterConfig struct {
+	// RedisURL, e.g. redis://redis:6379/0, holds room assignments; empty
+	// runs a single node
+	RedisURL string
+	// NodeID names this node in the registry; it must be unique
+	NodeID string
+	// AdvertiseURL is this node's base URL as other nodes redirect to it,
+	// e.g. http://sfu-1:37003; empty means requests are only rejected
+	AdvertiseURL string
+	// Redirect answers requests for another node's rooms with a 307 to it
+	// instead of a 421
+	Redirect bool
+	// LeaseTTL is how long room assignments outlive their last renewal
+	LeaseTTL time.Duration
+}
+
+// claimScript assigns KEYS[1] to ARGV[1] for ARGV[2] ms unless another node
+// holds it, returning the owner. The owner's own claim renews the lease.
+var claimScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return owner
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return ARGV[1]
+`)
+
+// releaseScript deletes KEYS[1], and the status in KEYS[2], if ARGV[1]
+// still holds it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1], KEYS[2])
+end
+return 0
+`)
+
+// redisRegistry records which node owns each room
+type redisRegistry struct {
+	client *redis.Client
+	nodeID string
+	ttl    time.Duration
+}
+
+// newRedisRegistry connects to the Redis at url for node nodeID
+func newRedisRegistry(url, nodeID string, ttl time.Duration) (*redisRegistry, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisRegistry{client: redis.NewClient(opts), nodeID: nodeID, ttl: ttl}, nil
+}
+
+func roomOwnerKey(roomID string) string  { return clusterKeyPrefix + "room:" + roomID }
+func roomStatusKey(roomID string) string { return clusterKeyPrefix + "status:" + roomID }
+func nodeKey(nodeID string) string       { return clusterKeyPrefix + "node:" + nodeID }
+
+// Claim assigns roomID to this node unless another node owns it, returning
+// the owner
+func (g *redisRegistry) Claim(ctx context.Context, roomID string) (string, error) {
+	return claimScript.Run(ctx, g.client, []string{roomOwnerKey(roomID)}, g.nodeID, g.ttl.Milliseconds()).Text()
+}
+
+// Owner returns the node owning roomID, or "" if none does
+func (g *redisRegistry) Owner(ctx context.Context, roomID string) (string, error) {
+	owner, err := g.client.Get(ctx, roomOwnerKey(roomID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, err
+}
+
+// Release gives up this node's claim on roomID and its status
+func (g *redisRegistry) Release(ctx context.Context, roomID string) error {
+	return releaseScript.Run(ctx, g.client, []string{roomOwnerKey(roomID), roomStatusKey(roomID)}, g.nodeID).Err()
+}
+
+// Advertise records url as this node's address for the lease TTL
+func (g *redisRegistry) Advertise(ctx context.Context, url string) error {
+	return g.client.Set(ctx, nodeKey(g.nodeID), url, g.ttl).Err()
+}
+
+// Withdraw removes this node's address
+func (g *redisRegistry) Withdraw(ctx context.Context) error {
+	return g.client.Del(ctx, nodeKey(g.nodeID)).Err()
+}
+
+// NodeURL returns the advertised address of nodeID, or "" if it has none
+func (g *redisRegistry) NodeURL(ctx context.Context, nodeID string) (string, error) {
+	url, err := g.client.Get(ctx, nodeKey(nodeID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return url, err
+}
+
+// PutStatus stores roomID's status as its owner reports it
+func (g *redisRegistry) PutStatus(ctx context.Context, roomID string, status map[string]interface{}) error {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return g.client.Set(ctx, roomStatusKey(roomID), body, g.ttl).Err()
+}
+
+// Status returns roomID's last published status, or nil if there is none
+func (g *redisRegistry) Status(ctx context.Context, roomID string) (map[string]interface{}, error) {
+	body, err := g.client.Get(ctx, roomStatusKey(roomID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var status map[string]interface{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Close disconnects from Redis
+func (g *redisRegistry) Close() error {
+	return g.client.Close()
+}
+
+// clusterNode is this node's part in the cluster: its registry and the
+// rooms it holds leases on
+type clusterNode struct {
+	cfg      ClusterConfig
+	registry *redisRegistry
+	mu       sync.Mutex
+	claimed  map[string]struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// newClusterNode joins the cluster described by cfg
+func newClusterNode(cfg ClusterConfig) (*clusterNode, error) {
+	if cfg.NodeID == "" {
+		return nil, errors.New("node ID required")
+	}
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = defaultClusterLeaseTTL
+	}
+	registry, err := newRedisRegistry(cfg.RedisURL, cfg.NodeID, cfg.LeaseTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	// Fail at startup rather than on the first request
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := registry.client.Ping(ctx).Err(); err != nil {
+		registry.Close()
+		return nil, fmt.Errorf("cannot reach Redis: %w", err)
+	}
+	return &clusterNode{
+		cfg:      cfg,
+		registry: registry,
+		claimed:  make(map[string]struct{}),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// owner returns the node owning roomID, first claiming it for this node if
+// claim is set
+func (c *clusterNode) owner(ctx context.Context, roomID string, claim bool) (string, error) {
+	if !claim {
+		return c.registry.Owner(ctx, roomID)
+	}
+	owner, err := c.registry.Claim(ctx, roomID)
+	if err == nil && owner == c.cfg.NodeID {
+		c.mu.Lock()
+		c.claimed[roomID] = struct{}{}
+		c.mu.Unlock()
+	}
+	return owner, err
+}
+
+// heartbeat syncs the server's rooms to the registry every third of the
+// lease TTL until stopped
+func (c *clusterNode) heartbeat(s *Server) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.cfg.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		s.syncCluster(context.Background())
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncCluster advertises this node, renews the leases of its rooms and
+// publishes their status, and releases rooms that have been deleted
+func (s *Server) syncCluster(ctx context.Context) {
+	c := s.cluster
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.LeaseTTL/3)
+	defer cancel()
+	if c.cfg.AdvertiseURL != "" {
+		if err := c.registry.Advertise(ctx, c.cfg.AdvertiseURL); err != nil {
+			slog.Warn("Failed to advertise node", "node", c.cfg.NodeID, "err", err)
+		}
+	}
+
+	rooms := s.rooms.Rooms()
+	live := make(map[string]struct{}, len(rooms))
+	for _, room := range rooms {
+		live[room.id] = struct{}{}
+		// Rooms from before the lease lapsed are taken back if no other
+		// node has claimed them since
+		owner, err := c.owner(ctx, room.id, true)
+		if err != nil {
+			roomLog(room.id).Warn("Failed to renew room lease", "err", err)
+			continue
+		}
+		if owner != c.cfg.NodeID {
+			roomLog(room.id).Warn("Room is now owned by another node", "owner", owner)
+			continue
+		}
+		if err := c.registry.PutStatus(ctx, room.id, s.roomStatus(room)); err != nil {
+			roomLog(room.id).Warn("Failed to publish room status", "err", err)
+		}
+	}
+
+	c.mu.Lock()
+	var released []string
+	for id := range c.claimed {
+		if _, ok := live[id]; !ok {
+			released = append(released, id)
+			delete(c.claimed, id)
+		}
+	}
+	c.mu.Unlock()
+	for _, id := range released {
+		if err := c.registry.Release(ctx, id); err != nil {
+			roomLog(id).Warn("Failed to release room", "err", err)
+		}
+	}
+}
+
+// close stops the heartbeat and releases every room and the node's
+// address, so that a restarted node's rooms can move at once
+func (c *clusterNode) close() error {
+	close(c.stop)
+	<-c.stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.mu.Lock()
+	for id := range c.claimed {
+		c.registry.Release(ctx, id)
+		delete(c.claimed, id)
+	}
+	c.mu.Unlock()
+	c.registry.Withdraw(ctx)
+	return c.registry.Close()
+}
+
+// routeToOwner checks that roomID belongs to this node, claiming it first
+// if claim is set, and reports whether the request should be handled here.
+// Rooms no node owns are handled here. Requests for another node's room
+// are redirected to it with a 307, which keeps the method and body, if
+// redirects are on and it has advertised an address, and are rejected with
+// a 421 naming the owner otherwise.
+func (s *Server) routeToOwner(w http.ResponseWriter, r *http.Request, roomID string, claim bool) bool {
+	if s.cluster == nil {
+		return true
+	}
+	// A draining node takes no new rooms; its handlers refuse them anyway
+	owner, err := s.cluster.owner(r.Context(), roomID, claim && !s.draining.Load())
+	if err != nil {
+		roomLog(roomID).Error("Room registry unavailable", "err", err)
+		writeError(w, http.StatusServiceUnavailable, errCodeClusterUnavailable, "Room registry unavailable")
+		return false
+	}
+	if owner == "" || owner == s.cluster.cfg.NodeID {
+		return true
+	}
+
+	url, err := s.cluster.registry.NodeURL(r.Context(), owner)
+	if err != nil {
+		roomLog(roomID).Warn("Failed to look up room owner", "owner", owner, "err", err)
+	}
+	if s.cluster.cfg.Redirect && url != "" {
+		http.Redirect(w, r, strings.TrimSuffix(url, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return false
+	}
+	details := map[string]interface{}{"node": owner}
+	if url != "" {
+		details["nodeUrl"] = url
+	}
+	writeErrorDetails(w, http.StatusMisdirectedRequest, errCodeWrongNode, "Room is hosted on another node", details)
+	return false
+}
+
+// remoteRoomStatus returns the status of roomID as published by the other
+// node owning it, or nil if the room isn't known to the cluster
+func (s *Server) remoteRoomStatus(ctx context.Context, roomID string) (map[string]interface{}, error) {
+	if s.cluster == nil {
+		return nil, nil
+	}
+	owner, err := s.cluster.owner(ctx, roomID, false)
+	if err != nil || owner == "" || owner == s.cluster.cfg.NodeID {
+		return nil, err
+	}
+	status, err := s.cluster.registry.Status(ctx, roomID)
+	if status != nil {
+		status["node"] = owner
+	}
+	return status, err
+}
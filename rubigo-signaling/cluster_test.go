@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisRegistry(t *testing.T) {
+	redis := miniredis.RunT(t)
+	ctx := context.Background()
+	a, err := newRedisRegistry("redis://"+redis.Addr(), "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := newRedisRegistry("redis://"+redis.Addr(), "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if owner, err := a.Owner(ctx, "abc"); owner != "" || err != nil {
+		t.Errorf("unclaimed room owner = %q, %v", owner, err)
+	}
+	if owner, err := a.Claim(ctx, "abc"); owner != "a" || err != nil {
+		t.Fatalf("first claim = %q, %v; want a", owner, err)
+	}
+	if owner, _ := b.Claim(ctx, "abc"); owner != "a" {
+		t.Errorf("second node's claim = %q, want a to keep the room", owner)
+	}
+
+	// Only the owner's release counts, and it takes the status with it
+	if err := a.PutStatus(ctx, "abc", map[string]interface{}{"exists": true}); err != nil {
+		t.Fatal(err)
+	}
+	b.Release(ctx, "abc")
+	if owner, _ := b.Owner(ctx, "abc"); owner != "a" {
+		t.Errorf("owner after another node's release = %q, want a", owner)
+	}
+	a.Release(ctx, "abc")
+	if owner, _ := b.Owner(ctx, "abc"); owner != "" {
+		t.Errorf("owner after release = %q", owner)
+	}
+	if status, _ := b.Status(ctx, "abc"); status != nil {
+		t.Errorf("status after release = %v", status)
+	}
+
+	// A node that stops renewing loses its rooms
+	a.Claim(ctx, "abc")
+	redis.FastForward(2 * time.Minute)
+	if owner, _ := b.Claim(ctx, "abc"); owner != "b" {
+		t.Errorf("claim after the lease lapsed = %q, want b", owner)
+	}
+}
+
+// newClusterServer returns a server that is node nodeID in the cluster on
+// redis, advertised at url
+func newClusterServer(t *testing.T, redis *miniredis.Miniredis, nodeID, url string, redirect bool) (*Server, *fakeStore) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Cluster = ClusterConfig{RedisURL: "redis://" + redis.Addr(), NodeID: nodeID, AdvertiseURL: url, Redirect: redirect, LeaseTTL: time.Hour}
+	store := newFakeStore()
+	s := newServer(t, store, cfg)
+	s.syncCluster(context.Background())
+	return s, store
+}
+
+func TestClusterRouting(t *testing.T) {
+	redis := miniredis.RunT(t)
+	a, aStore := newClusterServer(t, redis, "a", "http://sfu-a:37003", false)
+	b, _ := newClusterServer(t, redis, "b", "http://sfu-b:37003", false)
+
+	if rec := doRequest(t, a.Handler(), http.MethodPost, "/internal/room", `{"roomId":"abc"}`); rec.Code != http.StatusOK {
+		t.Fatalf("create on a = %d: %s", rec.Code, rec.Body)
+	}
+	rec := doRequest(t, b.Handler(), http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":""}`)
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("subscribe on b = %d, want %d", rec.Code, http.StatusMisdirectedRequest)
+	}
+	details := decodeBody(t, rec)["error"].(map[string]interface{})["details"].(map[string]interface{})
+	if details["node"] != "a" || details["nodeUrl"] != "http://sfu-a:37003" {
+		t.Errorf("rejection details = %v, want node a and its URL", details)
+	}
+	if rec := doRequest(t, b.Handler(), http.MethodPost, "/internal/room", `{"roomId":"abc"}`); rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("create on b = %d, want %d", rec.Code, http.StatusMisdirectedRequest)
+	}
+
+	// Any node reports status, from what the owner last published
+	a.syncCluster(context.Background())
+	body := decodeBody(t, doRequest(t, b.Handler(), http.MethodGet, "/internal/room/abc/status", ""))
+	if body["exists"] != true || body["node"] != "a" {
+		t.Errorf("status on b = %v, want a's room", body)
+	}
+	if body := decodeBody(t, doRequest(t, a.Handler(), http.MethodGet, "/internal/room/abc/status", "")); body["node"] != "a" {
+		t.Errorf("status on a = %v, want node a", body)
+	}
+
+	// Once a deletes the room, it's free for any node
+	if rec := doRequest(t, a.Handler(), http.MethodDelete, "/internal/room/abc", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete on a = %d", rec.Code)
+	}
+	a.syncCluster(context.Background())
+	if body := decodeBody(t, doRequest(t, b.Handler(), http.MethodGet, "/internal/room/abc/status", "")); body["exists"] != false {
+		t.Errorf("status after delete = %v", body)
+	}
+	if rec := doRequest(t, b.Handler(), http.MethodPost, "/internal/room", `{"roomId":"abc"}`); rec.Code != http.StatusOK {
+		t.Errorf("create on b after delete = %d: %s", rec.Code, rec.Body)
+	}
+	if aStore.Get("abc") != nil {
+		t.Error("room came back on a")
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	redis := miniredis.RunT(t)
+	a, _ := newClusterServer(t, redis, "a", "http://sfu-a:37003/", true)
+	b, _ := newClusterServer(t, redis, "b", "", true)
+
+	doRequest(t, a.Handler(), http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+	for _, path := range []string{"/internal/room/abc/subscribe?wait=true", "/whep/abc"} {
+		rec := doRequest(t, b.Handler(), http.MethodPost, path, `{"type":"offer","sdp":""}`)
+		if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "http://sfu-a:37003"+path {
+			t.Errorf("POST %s on b = %d to %q, want a 307 to a", path, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	// Nodes that haven't advertised an address can only reject
+	doRequest(t, b.Handler(), http.MethodPost, "/internal/room", `{"roomId":"def"}`)
+	if rec := doRequest(t, a.Handler(), http.MethodPost, "/internal/room/def/publish", `{"type":"offer","sdp":""}`); rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("publish to b's room on a = %d, want %d", rec.Code, http.StatusMisdirectedRequest)
+	}
+}
+
+func TestClusterUnavailable(t *testing.T) {
+	redis := miniredis.RunT(t)
+	s, _ := newClusterServer(t, redis, "a", "", false)
+	addr := redis.Addr()
+	redis.Close()
+
+	rec := doRequest(t, s.Handler(), http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("create with Redis down = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	decodeError(t, rec, errCodeClusterUnavailable)
+
+	cfg := DefaultConfig()
+	cfg.Cluster = ClusterConfig{RedisURL: "redis://" + addr, NodeID: "b"}
+	if _, err := NewServer(newFakeStore(), cfg); err == nil {
+		t.Error("NewServer joined a cluster whose Redis is down")
+	}
+}
@@ -0,0 +1,263 @@
+// Command loadtest joins a room as many viewers at once, to size SFU
+// instances. Each viewer is a peer connection receiving the room's media;
+// every interval it prints how many have joined and the percentiles of
+// their join latency, packet loss and bitrate, and a summary at the end.
+//
+//	rubigo-broadcast -room load &
+//	loadtest -room load -viewers 2000 -ramp 2m -duration 10m
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+
+	"rubigo-signaling/client"
+)
+
+// envOr reads an environment variable, def if unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// options are the command's flags
+type options struct {
+	url, apiKey, token string
+	room, password     string
+	layer              string
+	wait               bool
+	viewers            int
+	concurrency        int
+	ramp               time.Duration
+	duration           time.Duration
+	interval           time.Duration
+}
+
+// parseOptions parses the command line
+func parseOptions(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.StringVar(&opts.url, "url", envOr("SFU_URL", "http://localhost:8080"), "SFU address (or SFU_URL)")
+	fs.StringVar(&opts.apiKey, "api-key", os.Getenv("SFU_API_KEY"), "API key for /internal routes (or SFU_API_KEY)")
+	fs.StringVar(&opts.token, "token", os.Getenv("SFU_TOKEN"), "Bearer token, e.g. a JWT allowing subscribe (or SFU_TOKEN)")
+	fs.StringVar(&opts.room, "room", "", "Room to join (required)")
+	fs.StringVar(&opts.password, "password", "", "Room password")
+	fs.StringVar(&opts.layer, "layer", "", "Simulcast layer to ask for: low, mid, high or auto")
+	fs.BoolVar(&opts.wait, "wait", true, "Wait for the room's broadcaster rather than fail")
+	fs.IntVar(&opts.viewers, "viewers", 100, "Viewers to join")
+	fs.IntVar(&opts.concurrency, "concurrency", 50, "Most viewers negotiating at once")
+	fs.DurationVar(&opts.ramp, "ramp", 0, "Spread the viewers' joins evenly over this long; zero joins them as fast as they negotiate")
+	fs.DurationVar(&opts.duration, "duration", 0, "Stop after this long; zero runs until interrupted")
+	fs.DurationVar(&opts.interval, "interval", 5*time.Second, "How often to report")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.room == "" {
+		return opts, errors.New("-room is required")
+	}
+	if opts.viewers < 1 {
+		return opts, errors.New("-viewers must be at least 1")
+	}
+	if opts.concurrency < 1 {
+		return opts, errors.New("-concurrency must be at least 1")
+	}
+	if opts.ramp < 0 || opts.duration < 0 {
+		return opts, errors.New("-ramp and -duration can't be negative")
+	}
+	if opts.interval <= 0 {
+		return opts, errors.New("-interval must be positive")
+	}
+	return opts, nil
+}
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+	if err := run(ctx, opts, os.Stdout); err != nil {
+		slog.Error("Load test failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// udpReadBuffer is the receive buffer asked for the viewers' socket
+const udpReadBuffer = 16 << 20
+
+// newAPI makes the WebRTC API the viewers share. Their connections share
+// one UDP socket too, so thousands of them don't run out of ports, and
+// don't announce mDNS candidates.
+func newAPI() (*webrtc.API, io.Closer, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, nil, err
+	}
+	// Every viewer's media arrives on it, in bursts at keyframes; the
+	// kernel caps this at net.core.rmem_max
+	conn.SetReadBuffer(udpReadBuffer)
+	mux := webrtc.NewICEUDPMux(nil, conn)
+	var settings webrtc.SettingEngine
+	settings.SetICEUDPMux(mux)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	settings.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(settings))
+	return api, mux, nil
+}
+
+// run joins the viewers, reporting on them to out every interval, until
+// ctx is done
+func run(ctx context.Context, opts options, out io.Writer) error {
+	api, mux, err := newAPI()
+	if err != nil {
+		return err
+	}
+	defer mux.Close()
+	c := client.New(opts.url)
+	c.APIKey, c.Token, c.API = opts.apiKey, opts.token, api
+
+	start := time.Now()
+	r := newReporter(start)
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(opts.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				r.summarize(now, false).write(out)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	negotiating := make(chan struct{}, opts.concurrency)
+	subscribe := client.SubscribeOptions{Password: opts.password, Layer: opts.layer, Wait: opts.wait}
+joining:
+	for i := 0; i < opts.viewers; i++ {
+		if opts.ramp > 0 {
+			timer := time.NewTimer(time.Until(start.Add(opts.ramp * time.Duration(i) / time.Duration(opts.viewers))))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				break joining
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			break joining
+		case negotiating <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watch(ctx, c, opts.room, subscribe, r, func() { <-negotiating })
+		}()
+	}
+	<-ctx.Done()
+	wg.Wait()
+	<-reported
+
+	fmt.Fprint(out, "total ")
+	r.summarize(time.Now(), true).write(out)
+	return nil
+}
+
+// watch joins the room as a viewer and reads its media until ctx is done.
+// negotiated is called once the viewer has its answer, or failed to.
+func watch(ctx context.Context, c *client.Client, roomID string, opts client.SubscribeOptions, r *reporter, negotiated func()) {
+	v := &viewerStats{start: time.Now()}
+	sub, err := c.Subscribe(ctx, roomID, opts)
+	negotiated()
+	if err != nil {
+		if ctx.Err() == nil {
+			r.fail()
+			slog.Warn("Viewer failed to subscribe", "err", err)
+		}
+		return
+	}
+	defer sub.Close()
+	sub.PC.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed && ctx.Err() == nil {
+			v.failed.Store(true)
+			sub.Close()
+		}
+	})
+	r.add(v)
+
+	var reading sync.WaitGroup
+	defer reading.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+			return
+		case <-sub.Done():
+			return
+		case track := <-sub.Tracks():
+			reading.Add(1)
+			go func() {
+				defer reading.Done()
+				readTrack(track, v)
+			}()
+		}
+	}
+}
+
+// readTrack counts a track's RTP packets until it ends
+func readTrack(track *webrtc.TrackRemote, v *viewerStats) {
+	var seq sequenceCounter
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := track.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		v.packet(n, time.Now())
+		v.expected.Add(seq.add(binary.BigEndian.Uint16(buf[2:4])))
+	}
+}
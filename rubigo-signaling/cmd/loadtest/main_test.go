@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"-room", "load"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.viewers != 100 || opts.concurrency != 50 || opts.interval != 5*time.Second || !opts.wait {
+		t.Errorf("defaults = %+v", opts)
+	}
+
+	opts, err = parseOptions([]string{"-room", "load", "-viewers", "2000", "-ramp", "2m", "-layer", "low"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.viewers != 2000 || opts.ramp != 2*time.Minute || opts.layer != "low" {
+		t.Errorf("options = %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-room", "x", "-viewers", "0"},
+		{"-room", "x", "-concurrency", "0"},
+		{"-room", "x", "-ramp", "-1s"},
+		{"-room", "x", "-interval", "0"},
+	} {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+// broadcastingServer answers subscribe offers with a VP8 track, sending
+// every packet but each tenth
+func broadcastingServer(t *testing.T) (*httptest.Server, *sync.WaitGroup) {
+	var wg sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var offer struct{ SDP string }
+		json.NewDecoder(r.Body).Decode(&offer)
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "s")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP})
+		if _, err := pc.AddTrack(track); err != nil {
+			t.Error(err)
+			return
+		}
+		answer, _ := pc.CreateAnswer(nil)
+		gathered := webrtc.GatheringCompletePromise(pc)
+		pc.SetLocalDescription(answer)
+		<-gathered
+		json.NewEncoder(w).Encode(map[string]string{"type": "answer", "sdp": pc.LocalDescription().SDP})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pc.Close()
+			ticker := time.NewTicker(5 * time.Millisecond)
+			defer ticker.Stop()
+			for seq := uint16(0); pc.ConnectionState() != webrtc.PeerConnectionStateClosed; seq++ {
+				<-ticker.C
+				if seq%10 == 9 {
+					continue
+				}
+				packet := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 450}, Payload: make([]byte, 100)}
+				if err := track.WriteRTP(packet); err != nil {
+					return
+				}
+				if seq == 400 {
+					return
+				}
+			}
+		}()
+	}))
+	return server, &wg
+}
+
+func TestRun(t *testing.T) {
+	server, sending := broadcastingServer(t)
+	defer server.Close()
+	defer sending.Wait()
+
+	opts, err := parseOptions([]string{"-url", server.URL, "-room", "load", "-viewers", "3", "-interval", "500ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	if err := run(ctx, opts, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("report = %q", out.String())
+	}
+	total := lines[len(lines)-1]
+	if !strings.HasPrefix(total, "total ") || !strings.Contains(total, "connected=3 pending=0 failed=0") {
+		t.Errorf("total = %q", total)
+	}
+	// A tenth of the packets were never sent
+	if !strings.Contains(total, "loss p50=9.") && !strings.Contains(total, "loss p50=10.") {
+		t.Errorf("total = %q, want 10%% loss", total)
+	}
+}
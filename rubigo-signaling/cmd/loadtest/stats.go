@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// viewerStats is what one simulated viewer has seen. Its counters are
+// updated by the viewer's track readers and read by the reporter.
+type viewerStats struct {
+	start time.Time
+	// joined is the time from starting to subscribe to the first RTP
+	// packet, in nanoseconds; zero until then
+	joined atomic.Int64
+	bytes  atomic.Int64
+	// received and expected count RTP packets, from the sequence numbers
+	received atomic.Int64
+	expected atomic.Int64
+	failed   atomic.Bool // the connection failed or was closed by the SFU
+}
+
+// packet counts an RTP packet of size bytes
+func (v *viewerStats) packet(size int, now time.Time) {
+	if v.joined.Load() == 0 {
+		v.joined.CompareAndSwap(0, int64(max(now.Sub(v.start), 1)))
+	}
+	v.bytes.Add(int64(size))
+	v.received.Add(1)
+}
+
+// sequenceCounter counts the packets a track should have had from its
+// sequence numbers, as RFC 3550's extended highest sequence number does.
+// It is not safe for concurrent use; each track has its own.
+type sequenceCounter struct {
+	started bool
+	highest uint32 // extended with the cycles seen
+}
+
+// add accounts for packet seq, returning how many more packets are now
+// expected: one more than the gap since the highest yet, or zero for a
+// late or repeated packet
+func (c *sequenceCounter) add(seq uint16) int64 {
+	if !c.started {
+		c.started, c.highest = true, uint32(seq)
+		return 1
+	}
+	delta := int16(seq - uint16(c.highest))
+	if delta <= 0 {
+		return 0
+	}
+	c.highest += uint32(delta)
+	return int64(delta)
+}
+
+// percentile returns the p-th percentile of sorted by nearest rank, zero
+// if it is empty
+func percentile[T any](sorted []T, p float64) T {
+	var zero T
+	if len(sorted) == 0 {
+		return zero
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// reporter summarizes the viewers' stats each interval
+type reporter struct {
+	mu      sync.Mutex
+	viewers []*viewerStats
+	// failed counts viewers that couldn't subscribe
+	failed int
+	// lastBytes is each viewer's byte count at the last report
+	lastBytes map[*viewerStats]int64
+	last      time.Time
+	start     time.Time
+}
+
+func newReporter(now time.Time) *reporter {
+	return &reporter{lastBytes: make(map[*viewerStats]int64), last: now, start: now}
+}
+
+// add starts reporting on a viewer
+func (r *reporter) add(v *viewerStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.viewers = append(r.viewers, v)
+}
+
+// fail counts a viewer that couldn't subscribe
+func (r *reporter) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed++
+}
+
+// summary is one report's figures
+type summary struct {
+	elapsed   time.Duration
+	connected int // viewers that have had media
+	pending   int // viewers subscribed, still waiting for it
+	failed    int // viewers that couldn't subscribe or lost their connection
+	join      []time.Duration
+	loss      []float64 // percent of packets lost, per viewer
+	kbps      []float64 // bitrate over the interval, per viewer
+}
+
+// summarize takes the figures since the last summary, or if total is set
+// since the start, each viewer's bitrate then being its mean since it
+// joined
+func (r *reporter) summarize(now time.Time, total bool) summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := summary{elapsed: now.Sub(r.start), failed: r.failed}
+	interval := now.Sub(r.last).Seconds()
+	r.last = now
+	for _, v := range r.viewers {
+		if v.failed.Load() {
+			s.failed++
+			continue
+		}
+		joined := v.joined.Load()
+		if joined == 0 {
+			s.pending++
+			continue
+		}
+		s.connected++
+		s.join = append(s.join, time.Duration(joined))
+		if expected := v.expected.Load(); expected > 0 {
+			lost := max(expected-v.received.Load(), 0)
+			s.loss = append(s.loss, 100*float64(lost)/float64(expected))
+		}
+		bytes := v.bytes.Load()
+		if total {
+			if since := now.Sub(v.start.Add(time.Duration(joined))).Seconds(); since > 0 {
+				s.kbps = append(s.kbps, float64(bytes)*8/1000/since)
+			}
+		} else if interval > 0 {
+			s.kbps = append(s.kbps, float64(bytes-r.lastBytes[v])*8/1000/interval)
+		}
+		r.lastBytes[v] = bytes
+	}
+	slices.Sort(s.join)
+	slices.Sort(s.loss)
+	slices.Sort(s.kbps)
+	return s
+}
+
+// write prints the summary on one line: join latency and loss at their
+// median and worst percentiles, bitrate at its median and lowest
+func (s summary) write(w io.Writer) {
+	fmt.Fprintf(w, "%6s connected=%d pending=%d failed=%d", s.elapsed.Round(time.Second), s.connected, s.pending, s.failed)
+	if len(s.join) > 0 {
+		fmt.Fprintf(w, " join p50=%s p90=%s p99=%s",
+			percentile(s.join, 50).Round(time.Millisecond), percentile(s.join, 90).Round(time.Millisecond), percentile(s.join, 99).Round(time.Millisecond))
+	}
+	if len(s.loss) > 0 {
+		fmt.Fprintf(w, " loss p50=%.2f%% p90=%.2f%% p99=%.2f%%", percentile(s.loss, 50), percentile(s.loss, 90), percentile(s.loss, 99))
+	}
+	if len(s.kbps) > 0 {
+		fmt.Fprintf(w, " kbps p50=%.0f p10=%.0f p1=%.0f", percentile(s.kbps, 50), percentile(s.kbps, 10), percentile(s.kbps, 1))
+	}
+	fmt.Fprintln(w)
+}
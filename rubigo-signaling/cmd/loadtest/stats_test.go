@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSequenceCounter(t *testing.T) {
+	var c sequenceCounter
+	var expected int64
+	for _, seq := range []uint16{65533, 65534, 65535, 0, 1} {
+		expected += c.add(seq)
+	}
+	if expected != 5 {
+		t.Errorf("expected %d across the wrap, want 5", expected)
+	}
+	// A gap counts its missing packets; late and repeated ones count none
+	if n := c.add(4); n != 3 {
+		t.Errorf("gap of 3 added %d", n)
+	}
+	if n := c.add(2); n != 0 {
+		t.Errorf("late packet added %d", n)
+	}
+	if n := c.add(4); n != 0 {
+		t.Errorf("repeated packet added %d", n)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tc := range []struct {
+		p    float64
+		want int
+	}{{0, 1}, {1, 1}, {10, 1}, {50, 5}, {90, 9}, {99, 10}, {100, 10}} {
+		if got := percentile(sorted, tc.p); got != tc.want {
+			t.Errorf("p%v = %d, want %d", tc.p, got, tc.want)
+		}
+	}
+	if got := percentile([]int(nil), 50); got != 0 {
+		t.Errorf("p50 of nothing = %d", got)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := newReporter(start)
+	joined := &viewerStats{start: start}
+	joined.packet(1000, start.Add(200*time.Millisecond))
+	joined.packet(1000, start.Add(300*time.Millisecond))
+	joined.expected.Store(4) // half lost
+	lossless := &viewerStats{start: start}
+	lossless.packet(500, start.Add(100*time.Millisecond))
+	lossless.expected.Store(1)
+	dropped := &viewerStats{start: start}
+	dropped.failed.Store(true)
+	r.add(joined)
+	r.add(lossless)
+	r.add(dropped)
+	r.add(&viewerStats{start: start})
+	r.fail()
+
+	s := r.summarize(start.Add(time.Second), false)
+	if s.connected != 2 || s.pending != 1 || s.failed != 2 {
+		t.Errorf("summary = %+v", s)
+	}
+	if len(s.join) != 2 || s.join[0] != 100*time.Millisecond || s.join[1] != 200*time.Millisecond {
+		t.Errorf("join = %v", s.join)
+	}
+	if len(s.loss) != 2 || s.loss[0] != 0 || s.loss[1] != 50 {
+		t.Errorf("loss = %v", s.loss)
+	}
+	if len(s.kbps) != 2 || s.kbps[0] != 4 || s.kbps[1] != 16 {
+		t.Errorf("kbps = %v", s.kbps)
+	}
+
+	// The next interval's bitrate counts only what came since
+	joined.packet(1800, start.Add(1500*time.Millisecond))
+	s = r.summarize(start.Add(2*time.Second), false)
+	if len(s.kbps) != 2 || s.kbps[0] != 0 || s.kbps[1] != 14.4 {
+		t.Errorf("second interval's kbps = %v", s.kbps)
+	}
+	// and the total's is each viewer's mean since it joined
+	s = r.summarize(start.Add(2100*time.Millisecond), true)
+	if len(s.kbps) != 2 || s.kbps[0] != 2 || s.kbps[1] != 16 {
+		t.Errorf("total kbps = %v", s.kbps)
+	}
+
+	var out bytes.Buffer
+	s.write(&out)
+	line := out.String()
+	for _, want := range []string{"connected=2 pending=1 failed=2", "join p50=100ms p90=200ms", "loss p50=0.00% p90=25.00%", "kbps p50=2 p10=2"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("report %q is missing %q", line, want)
+		}
+	}
+}
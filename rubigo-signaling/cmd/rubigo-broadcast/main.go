@@ -0,0 +1,256 @@
+// Command rubigo-broadcast publishes into SFU rooms without a browser: a
+// synthetic VP8 test pattern, or IVF, WebM and Ogg files on a loop. It is
+// for load tests, CI and demos that need a room with something in it.
+//
+//	rubigo-broadcast -room demo
+//	rubigo-broadcast -room load -rooms 50 -audio -duration 10m
+//	rubigo-broadcast -room demo -file talk.webm -url https://sfu.example
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"rubigo-signaling/client"
+)
+
+// opusSilence is a 20ms Opus frame of silence
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+// stringList is a flag.Value that collects repeated flags
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// envOr reads an environment variable, def if unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// options are the command's flags
+type options struct {
+	url, apiKey, token string
+	room, password     string
+	rooms              int
+	create             bool
+	files              stringList
+	loop               bool
+	width, height      int
+	fps                int
+	audio              bool
+	duration           time.Duration
+}
+
+// parseSize parses a WIDTHxHEIGHT size
+func parseSize(s string) (int, int, error) {
+	w, h, ok := strings.Cut(s, "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 || width >= 1<<14 || height >= 1<<14 {
+		return 0, 0, fmt.Errorf("invalid size %q, want WIDTHxHEIGHT", s)
+	}
+	return width, height, nil
+}
+
+// parseOptions parses the command line
+func parseOptions(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("rubigo-broadcast", flag.ContinueOnError)
+	fs.StringVar(&opts.url, "url", envOr("SFU_URL", "http://localhost:8080"), "SFU address (or SFU_URL)")
+	fs.StringVar(&opts.apiKey, "api-key", os.Getenv("SFU_API_KEY"), "API key for /internal routes (or SFU_API_KEY)")
+	fs.StringVar(&opts.token, "token", os.Getenv("SFU_TOKEN"), "Bearer token, e.g. a JWT allowing publish (or SFU_TOKEN)")
+	fs.StringVar(&opts.room, "room", "", "Room to publish into (required)")
+	fs.IntVar(&opts.rooms, "rooms", 1, "Rooms to publish into; more than one are named ROOM-1, ROOM-2 and so on")
+	fs.StringVar(&opts.password, "password", "", "Room password, set on the rooms it creates")
+	fs.BoolVar(&opts.create, "create", true, "Create the rooms first")
+	fs.Var(&opts.files, "file", "IVF, WebM or Ogg file to publish instead of the test pattern (repeatable)")
+	fs.BoolVar(&opts.loop, "loop", true, "Start the files over when they end")
+	size := fs.String("size", "640x360", "Test pattern size")
+	fs.IntVar(&opts.fps, "fps", 15, "Test pattern frame rate")
+	fs.BoolVar(&opts.audio, "audio", false, "Send an Opus track of silence with the test pattern")
+	fs.DurationVar(&opts.duration, "duration", 0, "Stop after this long; zero runs until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.room == "" {
+		return opts, errors.New("-room is required")
+	}
+	if opts.rooms < 1 {
+		return opts, errors.New("-rooms must be at least 1")
+	}
+	if opts.fps < 1 || opts.fps > 60 {
+		return opts, errors.New("-fps must be between 1 and 60")
+	}
+	var err error
+	if opts.width, opts.height, err = parseSize(*size); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// roomIDs are the rooms to publish into
+func (o options) roomIDs() []string {
+	if o.rooms == 1 {
+		return []string{o.room}
+	}
+	ids := make([]string, o.rooms)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s-%d", o.room, i+1)
+	}
+	return ids
+}
+
+func main() {
+	opts, err := parseOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+	if err := run(ctx, opts); err != nil {
+		slog.Error("Broadcast failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run publishes into every room until ctx is done, or the files end if
+// they don't loop
+func run(ctx context.Context, opts options) error {
+	c := client.New(opts.url)
+	c.APIKey, c.Token = opts.apiKey, opts.token
+
+	// The test pattern's tracks are shared by every room's connection
+	var tracks []webrtc.TrackLocal
+	var video, audio *webrtc.TrackLocalStaticSample
+	if len(opts.files) == 0 {
+		var err error
+		if video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "rubigo-broadcast"); err != nil {
+			return err
+		}
+		tracks = append(tracks, video)
+		if opts.audio {
+			if audio, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "rubigo-broadcast"); err != nil {
+				return err
+			}
+			tracks = append(tracks, audio)
+		}
+	}
+
+	var sessions []*client.Session
+	var files []*client.FilePublisher
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+	for _, id := range opts.roomIDs() {
+		logger := slog.With("roomId", id)
+		if opts.create {
+			if err := c.CreateRoom(ctx, id, client.RoomOptions{Password: opts.password}); err != nil {
+				return fmt.Errorf("failed to create room %s: %w", id, err)
+			}
+		}
+		publish := client.PublishOptions{Password: opts.password, Loop: opts.loop}
+		if len(opts.files) > 0 {
+			pub, err := c.PublishFile(ctx, id, publish, opts.files...)
+			if err != nil {
+				return fmt.Errorf("failed to publish into %s: %w", id, err)
+			}
+			sessions, files = append(sessions, pub.Session), append(files, pub)
+		} else {
+			session, err := c.PublishTrack(ctx, id, publish, tracks...)
+			if err != nil {
+				return fmt.Errorf("failed to publish into %s: %w", id, err)
+			}
+			sessions = append(sessions, session)
+		}
+		logger.Info("Publishing")
+	}
+
+	if len(opts.files) > 0 {
+		return waitFiles(ctx, files)
+	}
+	return sendPattern(ctx, testPattern{width: opts.width, height: opts.height}, opts.fps, video, audio)
+}
+
+// waitFiles waits for the files to finish sending, or ctx to be done
+func waitFiles(ctx context.Context, files []*client.FilePublisher) error {
+	errs := make(chan error, len(files))
+	for _, pub := range files {
+		go func(pub *client.FilePublisher) { errs <- pub.Wait() }(pub)
+	}
+	for range files {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendPattern writes the test pattern to video at fps, and silence to
+// audio if not nil, until ctx is done
+func sendPattern(ctx context.Context, pattern testPattern, fps int, video, audio *webrtc.TrackLocalStaticSample) error {
+	frameInterval := time.Second / time.Duration(fps)
+	frames := time.NewTicker(frameInterval)
+	defer frames.Stop()
+	var silence <-chan time.Time
+	if audio != nil {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		silence = ticker.C
+	}
+
+	for n := 0; ; {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-frames.C:
+			if err := video.WriteSample(media.Sample{Data: pattern.frame(n), Duration: frameInterval}); err != nil {
+				return err
+			}
+			n++
+		case <-silence:
+			if err := audio.WriteSample(media.Sample{Data: opusSilence, Duration: 20 * time.Millisecond}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"-room", "demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.width != 640 || opts.height != 360 || opts.fps != 15 || !opts.create || !opts.loop {
+		t.Errorf("defaults = %+v", opts)
+	}
+	if ids := opts.roomIDs(); !slices.Equal(ids, []string{"demo"}) {
+		t.Errorf("roomIDs = %v", ids)
+	}
+
+	opts, err = parseOptions([]string{"-room", "load", "-rooms", "3", "-size", "320x180", "-file", "a.ivf", "-file", "b.ogg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := opts.roomIDs(); !slices.Equal(ids, []string{"load-1", "load-2", "load-3"}) {
+		t.Errorf("roomIDs = %v", ids)
+	}
+	if opts.width != 320 || opts.height != 180 || len(opts.files) != 2 {
+		t.Errorf("options = %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-room", "x", "-rooms", "0"},
+		{"-room", "x", "-size", "640"},
+		{"-room", "x", "-size", "0x360"},
+		{"-room", "x", "-size", "20000x10"},
+		{"-room", "x", "-fps", "0"},
+	} {
+		if _, err := parseOptions(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/internal/room" {
+			w.Write([]byte(`{"status":"created"}`))
+			return
+		}
+		var offer struct{ SDP string }
+		json.NewDecoder(r.Body).Decode(&offer)
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { pc.Close() })
+		pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP})
+		answer, _ := pc.CreateAnswer(nil)
+		gathered := webrtc.GatheringCompletePromise(pc)
+		pc.SetLocalDescription(answer)
+		<-gathered
+		json.NewEncoder(w).Encode(map[string]string{"type": "answer", "sdp": pc.LocalDescription().SDP})
+	}))
+	defer server.Close()
+
+	opts, err := parseOptions([]string{"-url", server.URL, "-room", "load", "-rooms", "2", "-audio"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := run(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"/internal/room", "/internal/room/load-1/publish", "/internal/room", "/internal/room/load-2/publish"}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
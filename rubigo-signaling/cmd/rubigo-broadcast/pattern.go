@@ -0,0 +1,63 @@
+package main
+
+// The test pattern is colour bars over a band a white block sweeps
+// across, one macroblock a frame, with the frame count in binary along the
+// bottom, so a viewer can tell at a glance that video is moving and spot
+// frames dropped or out of order
+
+// Bar colours, limited-range BT.601
+var (
+	patternBars = []vp8Color{
+		{180, 128, 128}, // grey
+		{162, 44, 142},  // yellow
+		{131, 156, 44},  // cyan
+		{112, 72, 58},   // green
+		{84, 184, 198},  // magenta
+		{65, 100, 212},  // red
+		{35, 212, 114},  // blue
+	}
+	patternBlack = vp8Color{16, 128, 128}
+	patternWhite = vp8Color{235, 128, 128}
+	patternDark  = vp8Color{48, 128, 128}
+)
+
+// patternCounterBits is how many bits of the frame count are drawn
+const patternCounterBits = 16
+
+// testPattern draws the pattern at a size
+type testPattern struct {
+	width, height int
+}
+
+// blocks returns frame n's macroblock colours in raster order
+func (p testPattern) blocks(n int) []vp8Color {
+	mbw, mbh := (p.width+15)/16, (p.height+15)/16
+	bars := max(mbh*2/3, 1)
+	blocks := make([]vp8Color, 0, mbw*mbh)
+	for y := 0; y < mbh; y++ {
+		for x := 0; x < mbw; x++ {
+			color := patternBlack
+			switch {
+			case y < bars:
+				color = patternBars[x*len(patternBars)/mbw]
+			case y == mbh-1 && mbh > bars+1:
+				// The count, most significant bit first
+				if x < patternCounterBits {
+					color = patternDark
+					if n>>(patternCounterBits-1-x)&1 != 0 {
+						color = patternWhite
+					}
+				}
+			case x == n%mbw:
+				color = patternWhite
+			}
+			blocks = append(blocks, color)
+		}
+	}
+	return blocks
+}
+
+// frame encodes frame n
+func (p testPattern) frame(n int) []byte {
+	return encodeVP8Keyframe(p.width, p.height, p.blocks(n))
+}
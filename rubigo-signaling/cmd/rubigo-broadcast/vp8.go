@@ -0,0 +1,294 @@
+package main
+
+// A VP8 encoder for the test pattern, which is flat colours in 16x16
+// blocks: every frame is a keyframe whose macroblocks are DC predicted,
+// with only DC coefficients and no loop filter. At quantizer index 0 a
+// block's colour is then reconstructed exactly, so the decoder's picture
+// is the pattern's. RFC 6386 has the bitstream; section numbers below are
+// its.
+
+// vp8Color is a macroblock's colour in limited-range BT.601 Y'CbCr
+type vp8Color struct {
+	y, u, v uint8
+}
+
+// Plane types of the token probabilities, section 13.3
+const (
+	vp8PlaneYAfterY2 = 0
+	vp8PlaneY2       = 1
+	vp8PlaneUV       = 2
+)
+
+// vp8CoeffBands maps a coefficient's position to its band, section 13.3
+var vp8CoeffBands = [16]int{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7}
+
+// vp8ExtraBitProbs are the probabilities of the extra bits of DCT_CAT3 to
+// DCT_CAT6 tokens, section 13.2
+var vp8ExtraBitProbs = [4][]uint8{
+	{173, 148, 140},
+	{176, 155, 140, 135},
+	{180, 157, 141, 134, 130},
+	{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+}
+
+// vp8MaxLevel is the largest coefficient a DCT_CAT6 token holds
+const vp8MaxLevel = 67 + 1<<11 - 1
+
+// vp8BoolEncoder is the boolean entropy encoder of section 7.3
+type vp8BoolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+// write encodes bit, which is false with probability prob/256
+func (e *vp8BoolEncoder) write(prob uint8, bit bool) {
+	split := 1 + ((e.rng - 1) * uint32(prob) >> 8)
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		if e.bitCount--; e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// carry adds one to the bytes written so far
+func (e *vp8BoolEncoder) carry() {
+	i := len(e.out) - 1
+	for ; i >= 0 && e.out[i] == 255; i-- {
+		e.out[i] = 0
+	}
+	e.out[i]++
+}
+
+// literal writes n bits of v, most significant first, at even odds
+func (e *vp8BoolEncoder) literal(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.write(128, v>>uint(i)&1 != 0)
+	}
+}
+
+// bytes flushes the encoder and returns what it wrote
+func (e *vp8BoolEncoder) bytes() []byte {
+	c, v := e.bitCount, e.bottom
+	if v&(1<<(32-uint(c))) != 0 {
+		e.carry()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
+
+// token writes a coefficient of magnitude level above zero at a position
+// whose probabilities are p, then its sign, following the token tree of
+// section 13.2
+func (e *vp8BoolEncoder) token(p *[vp8TokenProbs]uint8, level int, negative bool) {
+	e.write(p[0], true) // not EOB
+	e.write(p[1], true) // not DCT_0
+	switch {
+	case level == 1:
+		e.write(p[2], false)
+	case level <= 4:
+		e.write(p[2], true)
+		e.write(p[3], false)
+		if level == 2 {
+			e.write(p[4], false)
+		} else {
+			e.write(p[4], true)
+			e.write(p[5], level == 4)
+		}
+	case level <= 10:
+		e.write(p[2], true)
+		e.write(p[3], true)
+		e.write(p[6], false)
+		if level <= 6 {
+			e.write(p[7], false)
+			e.write(159, level == 6)
+		} else {
+			e.write(p[7], true)
+			e.write(165, (level-7)&2 != 0)
+			e.write(145, (level-7)&1 != 0)
+		}
+	default:
+		e.write(p[2], true)
+		e.write(p[3], true)
+		e.write(p[6], true)
+		cat := 3
+		for cat > 0 && level < 3+8<<cat {
+			cat--
+		}
+		e.write(p[8], cat>>1 != 0)
+		e.write(p[9+cat>>1], cat&1 != 0)
+		extra, probs := level-(3+8<<cat), vp8ExtraBitProbs[cat]
+		for i, prob := range probs {
+			e.write(prob, extra>>uint(len(probs)-1-i)&1 != 0)
+		}
+	}
+	e.write(128, negative)
+}
+
+// block writes a 4x4 block's tokens: its first coefficient, at position
+// first, then EOB. context is how many of its left and above neighbours
+// have coefficients. It returns whether this one does.
+func (e *vp8BoolEncoder) block(plane, first, context, level int) bool {
+	probs := &vp8DefaultCoeffProbs[plane]
+	p := &probs[vp8CoeffBands[first]][context]
+	if level == 0 {
+		e.write(p[0], false)
+		return false
+	}
+	magnitude := min(max(level, -level), vp8MaxLevel)
+	e.token(p, magnitude, level < 0)
+	next := 2
+	if magnitude == 1 {
+		next = 1
+	}
+	e.write(probs[vp8CoeffBands[first+1]][next][0], false)
+	return true
+}
+
+// vp8DCPredict is the DC prediction of section 12.2 for a flat block whose
+// neighbours are flat too: the mean of the above and left, either if only
+// one is in the frame, or 128 in the top-left corner
+func vp8DCPredict(above, left uint8, hasAbove, hasLeft bool) int {
+	switch {
+	case hasAbove && hasLeft:
+		return (int(above) + int(left) + 1) >> 1
+	case hasAbove:
+		return int(above)
+	case hasLeft:
+		return int(left)
+	}
+	return 128
+}
+
+// encodeVP8Keyframe encodes a width by height keyframe whose macroblocks,
+// in raster order, are the flat colours blocks
+func encodeVP8Keyframe(width, height int, blocks []vp8Color) []byte {
+	mbw, mbh := (width+15)/16, (height+15)/16
+
+	// The frame header, section 9
+	modes := newVP8BoolEncoder()
+	modes.literal(0, 1) // color space
+	modes.literal(0, 1) // clamping required
+	modes.literal(0, 1) // no segmentation
+	modes.literal(0, 1) // normal loop filter
+	modes.literal(0, 6) // loop filter level, off
+	modes.literal(0, 3) // sharpness
+	modes.literal(0, 1) // no loop filter deltas
+	modes.literal(0, 2) // one token partition
+	modes.literal(0, 7) // quantizer index
+	modes.literal(0, 5) // no quantizer deltas
+	modes.literal(0, 1) // refresh_entropy_probs
+	for i := range vp8CoeffUpdateProbs {
+		for j := range vp8CoeffUpdateProbs[i] {
+			for k := range vp8CoeffUpdateProbs[i][j] {
+				for _, prob := range vp8CoeffUpdateProbs[i][j][k] {
+					modes.write(prob, false)
+				}
+			}
+		}
+	}
+	modes.literal(0, 1) // no skipped macroblocks
+
+	tokens := newVP8BoolEncoder()
+	recon := make([]vp8Color, mbw*mbh)
+	// Whether each macroblock's Y2, U and V blocks have coefficients; its
+	// Y blocks never do
+	type nonzero struct{ y2, u, v bool }
+	nz := make([]nonzero, mbw*mbh)
+	count := func(flags ...bool) int {
+		n := 0
+		for _, flag := range flags {
+			if flag {
+				n++
+			}
+		}
+		return n
+	}
+
+	for mby := 0; mby < mbh; mby++ {
+		for mbx := 0; mbx < mbw; mbx++ {
+			i := mby*mbw + mbx
+			var target vp8Color
+			if i < len(blocks) {
+				target = blocks[i]
+			}
+			var above, left vp8Color
+			var aboveNZ, leftNZ nonzero
+			if mby > 0 {
+				above, aboveNZ = recon[i-mbw], nz[i-mbw]
+			}
+			if mbx > 0 {
+				left, leftNZ = recon[i-1], nz[i-1]
+			}
+
+			// Section 11.2: DC_PRED for luma and chroma
+			modes.write(145, true)
+			modes.write(156, false)
+			modes.write(163, false)
+			modes.write(142, false)
+
+			// The luma DC goes in the Y2 block. Its dequantizer is 8, and
+			// the inverse WHT and DCT each divide by 8, so a level of 8
+			// moves every pixel by 1.
+			predY := vp8DCPredict(above.y, left.y, mby > 0, mbx > 0)
+			levelY := 8 * (int(target.y) - predY)
+			nz[i].y2 = tokens.block(vp8PlaneY2, 0, count(aboveNZ.y2, leftNZ.y2), levelY)
+			for b := 0; b < 16; b++ {
+				tokens.block(vp8PlaneYAfterY2, 1, 0, 0)
+			}
+			recon[i].y = uint8(predY + levelY/8)
+
+			// Chroma's dequantizer is 4, and the inverse DCT divides by 8
+			predU := vp8DCPredict(above.u, left.u, mby > 0, mbx > 0)
+			predV := vp8DCPredict(above.v, left.v, mby > 0, mbx > 0)
+			levelU := 2 * (int(target.u) - predU)
+			levelV := 2 * (int(target.v) - predV)
+			for b := 0; b < 4; b++ {
+				ctx := count(b >= 2 && levelU != 0 || b < 2 && aboveNZ.u, b&1 == 1 && levelU != 0 || b&1 == 0 && leftNZ.u)
+				nz[i].u = tokens.block(vp8PlaneUV, 0, ctx, levelU)
+			}
+			for b := 0; b < 4; b++ {
+				ctx := count(b >= 2 && levelV != 0 || b < 2 && aboveNZ.v, b&1 == 1 && levelV != 0 || b&1 == 0 && leftNZ.v)
+				nz[i].v = tokens.block(vp8PlaneUV, 0, ctx, levelV)
+			}
+			recon[i].u = uint8(predU + levelU/2)
+			recon[i].v = uint8(predV + levelV/2)
+		}
+	}
+
+	first, second := modes.bytes(), tokens.bytes()
+	// The frame tag and keyframe start code, section 9.1
+	frame := make([]byte, 10, 10+len(first)+len(second))
+	tag := uint32(len(first))<<5 | 1<<4 // a shown keyframe, version 0
+	frame[0], frame[1], frame[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	frame[6], frame[7] = byte(width), byte(width>>8)
+	frame[8], frame[9] = byte(height), byte(height>>8)
+	frame = append(frame, first...)
+	return append(frame, second...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"golang.org/x/image/vp8"
+)
+
+// decodeVP8 decodes a VP8 keyframe
+func decodeVP8(t *testing.T, frame []byte) *image.YCbCr {
+	t.Helper()
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(frame), len(frame))
+	if _, err := d.DecodeFrameHeader(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// checkVP8Keyframe encodes blocks and checks every decoded pixel is its
+// block's colour
+func checkVP8Keyframe(t *testing.T, width, height int, blocks []vp8Color) {
+	t.Helper()
+	img := decodeVP8(t, encodeVP8Keyframe(width, height, blocks))
+	if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+		t.Fatalf("decoded %v, want %dx%d", b, width, height)
+	}
+	mbw := (width + 15) / 16
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := blocks[(y/16)*mbw+x/16]
+			got := vp8Color{img.Y[img.YOffset(x, y)], img.Cb[img.COffset(x, y)], img.Cr[img.COffset(x, y)]}
+			if got != want {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeVP8Keyframe(t *testing.T) {
+	// A size that isn't whole macroblocks, and colours far apart, which
+	// need the largest tokens
+	colors := []vp8Color{{16, 128, 128}, {235, 16, 240}, {0, 255, 0}, {255, 0, 255}, {81, 90, 240}, {128, 128, 128}, {129, 127, 130}}
+	blocks := make([]vp8Color, 5*3)
+	for i := range blocks {
+		blocks[i] = colors[(i*3)%len(colors)]
+	}
+	checkVP8Keyframe(t, 70, 40, blocks)
+}
+
+func TestEncodeVP8KeyframeSteps(t *testing.T) {
+	// Steps between neighbours that take each size of token
+	for _, step := range []int{1, 2, 3, 4, 5, 8, 9, 17, 33, 67, 100} {
+		var blocks []vp8Color
+		for i := 0; i < 8; i++ {
+			level := uint8(128 + (i%2)*step - (i/4)*step)
+			blocks = append(blocks, vp8Color{level, level, 255 - level})
+		}
+		checkVP8Keyframe(t, 64, 32, blocks)
+	}
+}
+func TestTestPattern(t *testing.T) {
+	p := testPattern{width: 320, height: 192}
+	for _, n := range []int{0, 5, 0xA5} {
+		img := decodeVP8(t, p.frame(n))
+		at := func(mbx, mby int) uint8 { return img.Y[img.YOffset(mbx*16+8, mby*16+8)] }
+
+		if got := at(0, 0); got != patternBars[0].y {
+			t.Errorf("frame %d: first bar luma = %d, want %d", n, got, patternBars[0].y)
+		}
+		if got := at(19, 0); got != patternBars[len(patternBars)-1].y {
+			t.Errorf("frame %d: last bar luma = %d, want %d", n, got, patternBars[len(patternBars)-1].y)
+		}
+		// The sweeping block
+		if got := at(n%20, 9); got != patternWhite.y {
+			t.Errorf("frame %d: block luma = %d, want white", n, got)
+		}
+		if got := at((n+1)%20, 9); got != patternBlack.y {
+			t.Errorf("frame %d: beside the block luma = %d, want black", n, got)
+		}
+		// The count
+		var count int
+		for bit := 0; bit < patternCounterBits; bit++ {
+			count <<= 1
+			if at(bit, 11) == patternWhite.y {
+				count |= 1
+			}
+		}
+		if count != n {
+			t.Errorf("frame %d: count reads %d", n, count)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A codec policy decides what broadcasters may send, so operators can keep
+// screen shares off H264, whose encoders blur text, in favor of VP9 or AV1.
+// The SFU answers publish offers with only the allowed codecs, preferred
+// ones first, and rejects offers with none of them for some kind of media.
+// Viewers are unaffected: they receive whatever the broadcaster sends.
+
+// defaultCodecNames are pion's default codecs, in its registration order,
+// for when --codecs isn't set
+var defaultCodecNames = []string{"opus", "g722", "pcmu", "pcma", "vp8", "h264", "av1", "vp9"}
+
+// CodecPolicy orders and restricts the codecs broadcasters may send, by
+// --codecs names. The zero policy leaves them as negotiated.
+type CodecPolicy struct {
+	// Prefer lists codecs to ask broadcasters for first, e.g. ["av1", "vp9"]
+	Prefer []string `json:"prefer,omitempty"`
+	// Allow, if set, are the only codecs broadcasters may send of the kinds
+	// it names, so ["vp9"] restricts video and leaves audio alone
+	Allow []string `json:"allow,omitempty"`
+	// Deny are codecs broadcasters may not send
+	Deny []string `json:"deny,omitempty"`
+}
+
+// normalize lowercases the policy's names, rejecting unknown ones
+func (p *CodecPolicy) normalize() error {
+	for _, list := range []struct {
+		name  string
+		names *[]string
+	}{{"prefer", &p.Prefer}, {"allow", &p.Allow}, {"deny", &p.Deny}} {
+		names, err := parseCodecs(strings.Join(*list.names, ","))
+		if err != nil {
+			return fmt.Errorf("%s: %w", list.name, err)
+		}
+		*list.names = names
+	}
+	return nil
+}
+
+// empty reports whether p leaves codecs as negotiated
+func (p CodecPolicy) empty() bool {
+	return len(p.Prefer) == 0 && len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// override returns p with each list that room sets replacing p's
+func (p CodecPolicy) override(room CodecPolicy) CodecPolicy {
+	if len(room.Prefer) > 0 {
+		p.Prefer = room.Prefer
+	}
+	if len(room.Allow) > 0 {
+		p.Allow = room.Allow
+	}
+	if len(room.Deny) > 0 {
+		p.Deny = room.Deny
+	}
+	return p
+}
+
+// codecs returns the registered codecs p allows, preferred ones first and
+// the rest in registration order
+func (p CodecPolicy) codecs(registered []string) []string {
+	restricted := make(map[webrtc.RTPCodecType]bool)
+	for _, name := range p.Allow {
+		restricted[supportedCodecs[name].kind] = true
+	}
+	allowed := make(map[string]bool, len(registered))
+	for _, name := range registered {
+		allowed[name] = !restricted[supportedCodecs[name].kind]
+	}
+	for _, name := range p.Allow {
+		if _, ok := allowed[name]; ok {
+			allowed[name] = true
+		}
+	}
+	for _, name := range p.Deny {
+		allowed[name] = false
+	}
+
+	names := make([]string, 0, len(registered))
+	for _, name := range append(append([]string(nil), p.Prefer...), registered...) {
+		if allowed[name] {
+			names = append(names, name)
+			allowed[name] = false // listed
+		}
+	}
+	return names
+}
+
+// receiveCodecs returns the codecs a broadcaster in room may send, in
+// preference order, or nil if no policy applies
+func (s *Server) receiveCodecs(room *Room) []string {
+	policy := s.cfg.CodecPolicy.override(room.CodecPolicy())
+	if policy.empty() {
+		return nil
+	}
+	registered := s.cfg.Peer.Codecs
+	if len(registered) == 0 {
+		registered = defaultCodecNames
+	}
+	return policy.codecs(registered)
+}
+
+// checkOfferCodecs reports whether offer offers one of codecs for each kind
+// of media it has, otherwise it writes a 406 listing what was offered and
+// what is allowed. Nil codecs allow anything.
+func checkOfferCodecs(w http.ResponseWriter, offer string, codecs []string) bool {
+	if codecs == nil {
+		return true
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		offered, err := offeredCodecs(offer, kind)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Invalid offer: %v", err))
+			return false
+		}
+		if len(offered) == 0 {
+			continue
+		}
+		var allowed []string
+		found := false
+		for _, name := range codecs {
+			entry := supportedCodecs[name]
+			if entry.kind != kind {
+				continue
+			}
+			mimeType := entry.params[0].MimeType
+			allowed = append(allowed, mimeType)
+			for _, m := range offered {
+				found = found || strings.EqualFold(m, mimeType)
+			}
+		}
+		if !found {
+			writeErrorDetails(w, http.StatusNotAcceptable, errCodeCodecNotAllowed,
+				fmt.Sprintf("Offer has no allowed %s codec", kind),
+				map[string]interface{}{"offered": offered, "allowed": allowed})
+			return false
+		}
+	}
+	return true
+}
+
+// setReceiveCodecs limits each of pc's transceivers to codecs, in that
+// order of preference. It is called once the remote offer is set, so the
+// offer's media sections all have transceivers, and before answering.
+func setReceiveCodecs(pc *webrtc.PeerConnection, codecs []string) error {
+	for _, t := range pc.GetTransceivers() {
+		var params []webrtc.RTPCodecParameters
+		for _, name := range codecs {
+			if entry := supportedCodecs[name]; entry.kind == t.Kind() {
+				params = append(params, entry.params...)
+			}
+		}
+		// checkOfferCodecs rejected offers needing codecs that aren't there
+		if len(params) == 0 {
+			continue
+		}
+		if err := t.SetCodecPreferences(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCodecPolicyCodecs(t *testing.T) {
+	registered := []string{"opus", "vp8", "h264", "av1", "vp9"}
+	tests := []struct {
+		name   string
+		policy CodecPolicy
+		want   []string
+	}{
+		{"zero policy keeps registration order", CodecPolicy{}, registered},
+		{"preferred first", CodecPolicy{Prefer: []string{"vp9", "av1"}}, []string{"vp9", "av1", "opus", "vp8", "h264"}},
+		{"allow restricts only its kinds", CodecPolicy{Allow: []string{"vp9", "av1"}}, []string{"opus", "av1", "vp9"}},
+		{"deny", CodecPolicy{Deny: []string{"h264"}}, []string{"opus", "vp8", "av1", "vp9"}},
+		{"denied beats preferred", CodecPolicy{Prefer: []string{"h264", "vp9"}, Deny: []string{"h264"}}, []string{"vp9", "opus", "vp8", "av1"}},
+		{"unregistered ignored", CodecPolicy{Prefer: []string{"pcmu"}, Allow: []string{"g722", "vp9"}}, []string{"vp9"}},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.codecs(registered); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: codecs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCodecPolicyOverride(t *testing.T) {
+	global := CodecPolicy{Prefer: []string{"vp9"}, Deny: []string{"h264"}}
+	got := global.override(CodecPolicy{Prefer: []string{"av1"}, Allow: []string{"av1", "vp9"}})
+	want := CodecPolicy{Prefer: []string{"av1"}, Allow: []string{"av1", "vp9"}, Deny: []string{"h264"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("override = %+v, want %+v", got, want)
+	}
+}
+
+func TestCodecPolicyNormalize(t *testing.T) {
+	p := CodecPolicy{Prefer: []string{" AV1", "vp9", "av1"}}
+	if err := p.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Prefer, []string{"av1", "vp9"}) {
+		t.Errorf("Prefer = %v, want [av1 vp9]", p.Prefer)
+	}
+	p = CodecPolicy{Deny: []string{"theora"}}
+	if err := p.normalize(); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+// videoOffer returns a gathered offer sending one video track with the
+// given codecs, or all of pion's defaults if none
+func videoOffer(t *testing.T, codecs ...string) string {
+	t.Helper()
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := client.AddTrack(sending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codecs) > 0 {
+		var params []webrtc.RTPCodecParameters
+		for _, name := range codecs {
+			params = append(params, supportedCodecs[name].params...)
+		}
+		for _, tr := range client.GetTransceivers() {
+			if tr.Sender() == sender {
+				if err := tr.SetCodecPreferences(params); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	return gatheredOffer(t, client, nil)
+}
+
+func TestPublishCodecPolicy(t *testing.T) {
+	store := newFakeStore()
+	cfg := DefaultConfig()
+	cfg.CodecPolicy = CodecPolicy{Prefer: []string{"vp9"}, Deny: []string{"h264"}}
+	h := newServer(t, store, cfg).Handler()
+
+	// The global policy orders and filters the answer
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: videoOffer(t)})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/global/publish", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", rec.Code, rec.Body)
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	answered, err := offeredCodecs(answer.SDP, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answered) == 0 || answered[0] != webrtc.MimeTypeVP9 {
+		t.Errorf("answered video codecs %v, want VP9 first", answered)
+	}
+	for _, m := range answered {
+		if m == webrtc.MimeTypeH264 {
+			t.Errorf("answered denied codec in %v", answered)
+		}
+	}
+
+	// A room allowing only AV1 rejects a VP8 broadcaster
+	rec = doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","codecPolicy":{"allow":["AV1"]}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	body, _ = json.Marshal(SDPExchange{Type: "offer", SDP: videoOffer(t, "vp8")})
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("VP8 publish = %d, want %d", rec.Code, http.StatusNotAcceptable)
+	}
+	decodeError(t, rec, errCodeCodecNotAllowed)
+	if store.Get("abc").BroadcasterPC() != nil {
+		t.Error("rejected broadcaster was attached")
+	}
+
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"bad","codecPolicy":{"deny":["theora"]}}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("create with unknown codec = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// codecEntry is one selectable codec and the payload types it registers.
+// Payload types match pion's defaults so SDP looks the same either way.
+type codecEntry struct {
+	kind   webrtc.RTPCodecType
+	params []webrtc.RTPCodecParameters
+}
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// videoCodec builds a video codec with its RTX retransmission stream
+func videoCodec(mimeType, fmtp string, pt, rtxPT webrtc.PayloadType) []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        pt,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", pt)},
+			PayloadType:        rtxPT,
+		},
+	}
+}
+
+func h264Codecs() []webrtc.RTPCodecParameters {
+	var params []webrtc.RTPCodecParameters
+	for _, c := range []struct {
+		fmtp      string
+		pt, rtxPT webrtc.PayloadType
+	}{
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", 102, 103},
+		{"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", 104, 105},
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", 106, 107},
+		{"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", 108, 109},
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", 127, 125},
+		{"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f", 39, 40},
+		{"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f", 112, 113},
+	} {
+		params = append(params, videoCodec(webrtc.MimeTypeH264, c.fmtp, c.pt, c.rtxPT)...)
+	}
+	return params
+}
+
+// supportedCodecs are the names accepted by --codecs
+var supportedCodecs = map[string]codecEntry{
+	"opus": {webrtc.RTPCodecTypeAudio, []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}}},
+	"g722": {webrtc.RTPCodecTypeAudio, []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+		PayloadType:        rtp.PayloadTypeG722,
+	}}},
+	"pcmu": {webrtc.RTPCodecTypeAudio, []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		PayloadType:        rtp.PayloadTypePCMU,
+	}}},
+	"pcma": {webrtc.RTPCodecTypeAudio, []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+		PayloadType:        rtp.PayloadTypePCMA,
+	}}},
+	"vp8": {webrtc.RTPCodecTypeVideo, videoCodec(webrtc.MimeTypeVP8, "", 96, 97)},
+	"vp9": {webrtc.RTPCodecTypeVideo, append(
+		videoCodec(webrtc.MimeTypeVP9, "profile-id=0", 98, 99),
+		videoCodec(webrtc.MimeTypeVP9, "profile-id=2", 100, 101)...,
+	)},
+	"h264": {webrtc.RTPCodecTypeVideo, h264Codecs()},
+	"av1":  {webrtc.RTPCodecTypeVideo, videoCodec(webrtc.MimeTypeAV1, "", 45, 46)},
+}
+
+// parseCodecs parses a comma-separated codec list such as "vp8,opus".
+// Unknown names are an error; an empty list means pion's defaults.
+func parseCodecs(list string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := supportedCodecs[name]; !ok {
+			return nil, fmt.Errorf("unknown codec %q (supported: %s)", name, strings.Join(supportedCodecNames(), ", "))
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func supportedCodecNames() []string {
+	names := make([]string, 0, len(supportedCodecs))
+	for name := range supportedCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registerCodecs registers the named codecs, or pion's defaults if none
+func registerCodecs(m *webrtc.MediaEngine, names []string) error {
+	if len(names) == 0 {
+		return m.RegisterDefaultCodecs()
+	}
+	for _, name := range names {
+		entry, ok := supportedCodecs[name]
+		if !ok {
+			return fmt.Errorf("unknown codec %q", name)
+		}
+		for _, params := range entry.params {
+			if err := m.RegisterCodec(params, entry.kind); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// offeredCodecs returns the MIME types, such as "video/VP9", that an SDP
+// offer lists for media of kind. RTX, FEC and other non-media payloads are
+// skipped.
+func offeredCodecs(offer string, kind webrtc.RTPCodecType) ([]string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+
+	var mimeTypes []string
+	seen := make(map[string]bool)
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != kind.String() {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// rtpmap:<pt> <name>/<clock rate>[/<channels>]
+			fields := strings.Fields(attr.Value)
+			if len(fields) != 2 {
+				continue
+			}
+			name := strings.SplitN(fields[1], "/", 2)[0]
+			switch strings.ToLower(name) {
+			case "rtx", "red", "ulpfec", "flexfec-03":
+				continue
+			}
+			mimeType := kind.String() + "/" + name
+			if !seen[strings.ToLower(mimeType)] {
+				seen[strings.ToLower(mimeType)] = true
+				mimeTypes = append(mimeTypes, mimeType)
+			}
+		}
+	}
+	return mimeTypes, nil
+}
+
+// offeredSections returns how many media sections of kind an SDP offer has
+func offeredSections(offer string, kind webrtc.RTPCodecType) (int, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media == kind.String() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// offerSupportsCodec reports whether offer can receive mimeType. It also
+// returns what the offer does support, for error messages.
+func offerSupportsCodec(offer, mimeType string) (bool, []string, error) {
+	kind := webrtc.RTPCodecTypeVideo
+	if strings.HasPrefix(strings.ToLower(mimeType), "audio/") {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+	offered, err := offeredCodecs(offer, kind)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, m := range offered {
+		if strings.EqualFold(m, mimeType) {
+			return true, offered, nil
+		}
+	}
+	return false, offered, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseCodecs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"vp8,opus", []string{"vp8", "opus"}, false},
+		{" VP8 , opus,vp8 ", []string{"vp8", "opus"}, false},
+		{"vp8,mp3", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCodecs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCodecs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCodecs(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// viewerOffer builds a minimal recvonly offer listing the given video codecs
+func viewerOffer(rtpmaps ...string) string {
+	offer := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\na=rtpmap:111 opus/48000/2\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF"
+	for i := range rtpmaps {
+		offer += fmt.Sprintf(" %d", 96+i)
+	}
+	offer += "\r\nc=IN IP4 0.0.0.0\r\n"
+	for i, rtpmap := range rtpmaps {
+		offer += fmt.Sprintf("a=rtpmap:%d %s\r\n", 96+i, rtpmap)
+	}
+	return offer
+}
+
+func TestOfferedCodecs(t *testing.T) {
+	offer := viewerOffer("VP9/90000", "rtx/90000", "AV1/90000", "VP9/90000", "ulpfec/90000")
+
+	video, err := offeredCodecs(offer, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"video/VP9", "video/AV1"}; !reflect.DeepEqual(video, want) {
+		t.Errorf("video codecs = %v, want %v", video, want)
+	}
+	audio, _ := offeredCodecs(offer, webrtc.RTPCodecTypeAudio)
+	if want := []string{"audio/opus"}; !reflect.DeepEqual(audio, want) {
+		t.Errorf("audio codecs = %v, want %v", audio, want)
+	}
+
+	for _, tt := range []struct {
+		mimeType string
+		want     bool
+	}{
+		{webrtc.MimeTypeVP9, true},
+		{webrtc.MimeTypeAV1, true},
+		{webrtc.MimeTypeVP8, false},
+		{webrtc.MimeTypeOpus, true},
+	} {
+		if got, _, _ := offerSupportsCodec(offer, tt.mimeType); got != tt.want {
+			t.Errorf("offerSupportsCodec(%s) = %t, want %t", tt.mimeType, got, tt.want)
+		}
+	}
+
+	if _, err := offeredCodecs("garbage", webrtc.RTPCodecTypeVideo); err == nil {
+		t.Error("offeredCodecs accepted an invalid SDP")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are taken from, in order of precedence, the command line, the
+// environment, the config file and the defaults. Every flag can be set in
+// the environment as SFU_ and its name in upper case with underscores, e.g.
+// SFU_MAX_ROOMS for --max-rooms, or under the name in configEnvNames.
+
+// configEnvNames are the environment variables of flags not named by the
+// SFU_ rule, in use before it
+var configEnvNames = map[string]string{
+	"api-key":           "SFU_API_KEYS",
+	"cors-origin":       "SFU_CORS_ORIGINS",
+	"hls-ffmpeg":        "SFU_FFMPEG",
+	"ice-server":        "SFU_ICE_SERVERS",
+	"otlp-endpoint":     "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"upload-access-key": "AWS_ACCESS_KEY_ID",
+	"upload-region":     "AWS_REGION",
+	"upload-secret-key": "AWS_SECRET_ACCESS_KEY",
+}
+
+// configEnv returns the environment variable setting flag name
+func configEnv(name string) string {
+	if env, ok := configEnvNames[name]; ok {
+		return env
+	}
+	return "SFU_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// pinnedFlags returns the flags of fs set on the command line or in the
+// environment, which the config file doesn't change
+func pinnedFlags(fs *flag.FlagSet) map[string]bool {
+	pinned := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { pinned[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && os.Getenv(configEnv(f.Name)) != "" {
+			pinned[f.Name] = true
+		}
+	})
+	return pinned
+}
+
+// applyEnv sets the flags of fs not on the command line from their
+// environment variables
+func applyEnv(fs *flag.FlagSet) error {
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := configEnv(f.Name)
+		value := os.Getenv(env)
+		if err != nil || f.Name == "config" || setOnCommandLine[f.Name] || value == "" {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", env, setErr)
+		}
+	})
+	return err
+}
+
+// readConfigFile parses a YAML or JSON config file
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so one parser handles both
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// applyConfigFile sets flags from a YAML or JSON file whose keys are flag
+// names, e.g. {"port": 37003, "cors-origin": ["https://a", "https://b"]}.
+// Flags already set on the command line or in the environment win over the
+// file. Unknown keys are an error so typos don't silently fall back to
+// defaults.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	pinned := pinnedFlags(fs)
+
+	// Sorted so errors are reported deterministically
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		if pinned[key] {
+			continue
+		}
+		if err := setConfigValue(fs, key, values[key]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// setConfigValue sets flag key from a config file value. Lists set a
+// repeatable flag once per element.
+func setConfigValue(fs *flag.FlagSet, key string, v interface{}) error {
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	for _, item := range items {
+		value, err := configValueString(item)
+		if err != nil {
+			return err
+		}
+		if err := fs.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configValueString formats a scalar config value as flag text
+func configValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]interface{}:
+		// Structured values such as ICE servers are passed on as JSON
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// reloadableConfig is the part of the configuration a SIGHUP rereads from
+// the config file; everything else takes effect on restart
+type reloadableConfig struct {
+	LogLevel    string
+	WebhookURL  string
+	CORSOrigins []string
+}
+
+// configReloader rereads the reloadable settings from a config file
+type configReloader struct {
+	path string
+	fs   *flag.FlagSet
+	// pinned are the flags set on the command line or in the environment,
+	// which the file can't change
+	pinned map[string]bool
+}
+
+// newConfigReloader reloads path for the flags of fs. It must be created
+// once fs is parsed, before the file is applied.
+func newConfigReloader(fs *flag.FlagSet, path string) *configReloader {
+	return &configReloader{path: path, fs: fs, pinned: pinnedFlags(fs)}
+}
+
+// flags returns a FlagSet setting c by flag name
+func (c *reloadableConfig) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "")
+	fs.Var((*stringList)(&c.CORSOrigins), "cors-origin", "")
+	return fs
+}
+
+// load reads the file's reloadable settings. Other keys are left for the
+// next restart.
+func (r *configReloader) load() (reloadableConfig, error) {
+	values, err := readConfigFile(r.path)
+	if err != nil {
+		return reloadableConfig{}, err
+	}
+	var c reloadableConfig
+	fs := c.flags()
+	var loadErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if loadErr != nil {
+			return
+		}
+		// Pinned flags keep their value, the rest come from the file or
+		// else their defaults
+		defined := r.fs.Lookup(f.Name)
+		value, inFile := values[f.Name]
+		switch {
+		case defined != nil && r.pinned[f.Name]:
+			loadErr = fs.Set(f.Name, defined.Value.String())
+		case inFile:
+			loadErr = setConfigValue(fs, f.Name, value)
+		case defined != nil:
+			loadErr = fs.Set(f.Name, defined.DefValue)
+		}
+		if loadErr != nil {
+			loadErr = fmt.Errorf("%s: %s: %w", r.path, f.Name, loadErr)
+		}
+	})
+	return c, loadErr
+}
+
+// Reload puts reloaded settings other than the log level into effect.
+// Nothing changes if one of them can't be.
+func (s *Server) Reload(c reloadableConfig) error {
+	if err := s.cors.checkOrigins(c.CORSOrigins); err != nil {
+		return fmt.Errorf("cors-origin: %w", err)
+	}
+	// The notifier's worker and observers are only set up at startup
+	if s.webhook == nil && c.WebhookURL != "" {
+		return errors.New("webhook-url: a webhook can only be added by restarting")
+	}
+	s.cors.setOrigins(c.CORSOrigins)
+	s.webhook.setURL(c.WebhookURL)
+	return nil
+}
+
+// apply loads the file's reloadable settings and puts them into effect: the
+// log level in level and the rest on server
+func (r *configReloader) apply(server *Server, level *slog.LevelVar) error {
+	c, err := r.load()
+	if err != nil {
+		return err
+	}
+	parsed, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	if err := server.Reload(c); err != nil {
+		return err
+	}
+	level.Set(parsed)
+	slog.Info("Reloaded config", "path", r.path, "logLevel", c.LogLevel, "corsOrigins", c.CORSOrigins, "webhook", c.WebhookURL != "")
+	return nil
+}
+
+// reloadOnHangup has reloader applied on every SIGHUP from now on. A file
+// that fails to load or apply is logged and the current settings kept.
+func reloadOnHangup(reloader *configReloader, server *Server, level *slog.LevelVar) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloader.apply(server, level); err != nil {
+				slog.Error("Failed to reload config, keeping current settings", "path", reloader.path, "err", err)
+			}
+		}
+	}()
+}
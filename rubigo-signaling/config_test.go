@@ -0,0 +1,272 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFlags mirrors a few of main's flags on a fresh FlagSet
+func testFlags() (*flag.FlagSet, *Config, *int) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("port", 37003, "")
+	fs.Var((*stringList)(&cfg.CORS.Origins), "cors-origin", "")
+	fs.DurationVar(&cfg.Peer.ICETimeout, "ice-timeout", cfg.Peer.ICETimeout, "")
+	fs.Float64Var(&cfg.CreateRate, "create-rate", cfg.CreateRate, "")
+	fs.Var(iceServerFlag{&cfg.Peer.ICEServers}, "ice-server", "")
+	fs.String("config", "", "")
+	return fs, &cfg, port
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "port: 8080\ncors-origin:\n  - https://a.example\n  - https://b.example\nice-timeout: 2s\ncreate-rate: 0.5\n",
+		"config.json": `{"port": 8080, "cors-origin": ["https://a.example", "https://b.example"], "ice-timeout": "2s", "create-rate": 0.5}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, cfg, port := testFlags()
+			if err := fs.Parse(nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfigFile(fs, writeConfig(t, name, content)); err != nil {
+				t.Fatal(err)
+			}
+			if *port != 8080 || cfg.Peer.ICETimeout != 2*time.Second || cfg.CreateRate != 0.5 {
+				t.Errorf("port=%d ice-timeout=%v create-rate=%v", *port, cfg.Peer.ICETimeout, cfg.CreateRate)
+			}
+			if want := []string{"https://a.example", "https://b.example"}; !reflect.DeepEqual(cfg.CORS.Origins, want) {
+				t.Errorf("cors-origin = %v, want %v", cfg.CORS.Origins, want)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileFlagsWin(t *testing.T) {
+	fs, cfg, port := testFlags()
+	if err := fs.Parse([]string{"--port", "9000", "--cors-origin", "https://cli.example"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, "config.yaml", "port: 8080\ncors-origin: [https://file.example]\nice-timeout: 2s\n")
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 {
+		t.Errorf("port = %d, want command-line 9000", *port)
+	}
+	if want := []string{"https://cli.example"}; !reflect.DeepEqual(cfg.CORS.Origins, want) {
+		t.Errorf("cors-origin = %v, want %v", cfg.CORS.Origins, want)
+	}
+	// Keys not on the command line still come from the file
+	if cfg.Peer.ICETimeout != 2*time.Second {
+		t.Errorf("ice-timeout = %v, want 2s from file", cfg.Peer.ICETimeout)
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"unknown key", "prot: 8080\n"},
+		{"nested config", "config: other.yaml\n"},
+		{"bad value", "port: eighty\n"},
+		{"nested map", "port: {value: 1}\n"},
+		{"invalid syntax", "port: [\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _, _ := testFlags()
+			fs.Parse(nil)
+			if err := applyConfigFile(fs, writeConfig(t, "config.yaml", tt.content)); err == nil {
+				t.Error("applyConfigFile succeeded, want error")
+			}
+		})
+	}
+
+	fs, _, _ := testFlags()
+	if err := applyConfigFile(fs, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("applyConfigFile succeeded on a missing file")
+	}
+}
+
+func TestApplyConfigFileICEServers(t *testing.T) {
+	fs, cfg, _ := testFlags()
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	content := "ice-server:\n" +
+		"  - urls: [stun:stun.example.com:3478]\n" +
+		"  - urls: [turn:turn.example.com:3478, turns:turn.example.com:5349]\n" +
+		"    username: alice\n" +
+		"    credential: secret\n"
+	if err := applyConfigFile(fs, writeConfig(t, "config.yaml", content)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Peer.ICEServers) != 2 {
+		t.Fatalf("ICE servers = %+v, want 2", cfg.Peer.ICEServers)
+	}
+	turn := cfg.Peer.ICEServers[1]
+	if len(turn.URLs) != 2 || turn.Username != "alice" || turn.Credential != "secret" {
+		t.Errorf("TURN server = %+v", turn)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	for name, want := range map[string]string{
+		"max-rooms":   "SFU_MAX_ROOMS",
+		"port":        "SFU_PORT",
+		"cors-origin": "SFU_CORS_ORIGINS",
+		"ice-server":  "SFU_ICE_SERVERS",
+	} {
+		if got := configEnv(name); got != want {
+			t.Errorf("configEnv(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("SFU_PORT", "8081")
+	t.Setenv("SFU_CORS_ORIGINS", "https://env.example")
+	t.Setenv("SFU_ICE_TIMEOUT", "3s")
+	fs, cfg, port := testFlags()
+	if err := fs.Parse([]string{"--ice-timeout", "4s"}); err != nil {
+		t.Fatal(err)
+	}
+	// The environment wins over the file, and the command line over both
+	path := writeConfig(t, "config.yaml", "port: 8080\ncors-origin: [https://file.example]\ncreate-rate: 0.5\n")
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 8081 {
+		t.Errorf("port = %d, want 8081 from the environment", *port)
+	}
+	if want := []string{"https://env.example"}; !reflect.DeepEqual(cfg.CORS.Origins, want) {
+		t.Errorf("cors-origin = %v, want %v", cfg.CORS.Origins, want)
+	}
+	if cfg.Peer.ICETimeout != 4*time.Second {
+		t.Errorf("ice-timeout = %v, want 4s from the command line", cfg.Peer.ICETimeout)
+	}
+	if cfg.CreateRate != 0.5 {
+		t.Errorf("create-rate = %v, want 0.5 from the file", cfg.CreateRate)
+	}
+
+	t.Setenv("SFU_CREATE_RATE", "fast")
+	fs, _, _ = testFlags()
+	fs.Parse(nil)
+	if err := applyEnv(fs); err == nil {
+		t.Error("applyEnv accepted an invalid value")
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	t.Setenv("SFU_WEBHOOK_URL", "https://env.example/hook")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	logLevel := fs.String("log-level", "info", "")
+	var origins []string
+	fs.Var((*stringList)(&origins), "cors-origin", "")
+	webhookURL := fs.String("webhook-url", "", "")
+	if err := fs.Parse([]string{"--log-level", "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, "config.yaml", "cors-origin: [https://a.example]\n")
+	reloader := newConfigReloader(fs, path)
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line and environment stay; the file's values change
+	os.WriteFile(path, []byte("log-level: debug\nwebhook-url: https://file.example/hook\ncors-origin: [https://b.example, https://c.example]\nport: 1\n"), 0o600)
+	c, err := reloader.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reloadableConfig{LogLevel: *logLevel, WebhookURL: *webhookURL, CORSOrigins: []string{"https://b.example", "https://c.example"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("reloaded %+v, want %+v", c, want)
+	}
+
+	// A key dropped from the file goes back to its default
+	os.WriteFile(path, []byte("{}\n"), 0o600)
+	if c, err = reloader.load(); err != nil || c.CORSOrigins != nil {
+		t.Errorf("reloaded origins %v, %v; want none", c.CORSOrigins, err)
+	}
+
+	os.WriteFile(path, []byte("cors-origin: [[x]]\n"), 0o600)
+	if _, err := reloader.load(); err == nil {
+		t.Error("loaded an invalid value")
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS.Origins = []string{"https://a.example"}
+	server := newServer(t, newFakeStore(), cfg)
+	h := server.Handler()
+	origin := func(origin string) int {
+		req := httptest.NewRequest(http.MethodGet, "/internal/rooms", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if err := server.Reload(reloadableConfig{CORSOrigins: []string{"https://b.example"}}); err != nil {
+		t.Fatal(err)
+	}
+	if origin("https://a.example") != http.StatusForbidden || origin("https://b.example") != http.StatusOK {
+		t.Error("reloaded origins not in effect")
+	}
+	// Started without a webhook, it can't gain one
+	if err := server.Reload(reloadableConfig{WebhookURL: "https://hooks.example"}); err == nil {
+		t.Error("Reload added a webhook")
+	}
+
+	cfg.CORS.AllowCredentials = true
+	server = newServer(t, newFakeStore(), cfg)
+	if err := server.Reload(reloadableConfig{}); err == nil {
+		t.Error("Reload allowed any origin with credentials")
+	}
+}
+
+func TestConfigReloaderApply(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "log-level: loud\n")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("log-level", "info", "")
+	fs.Parse(nil)
+	reloader := newConfigReloader(fs, path)
+	server := newServer(t, newFakeStore(), DefaultConfig())
+	level := new(slog.LevelVar)
+
+	if err := reloader.apply(server, level); err == nil {
+		t.Error("applied an invalid log level")
+	}
+	os.WriteFile(path, []byte("log-level: debug\n"), 0o600)
+	if err := reloader.apply(server, level); err != nil {
+		t.Fatal(err)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Errorf("level = %v, want debug", level.Level())
+	}
+}
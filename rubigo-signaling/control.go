@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Label and SCTP stream ID of the in-room control data channel.
+// The channel is pre-negotiated, so clients open it with
+// createDataChannel("rubigo-control", {negotiated: true, id: 0}).
+// Clients that don't open it are unaffected.
+const (
+	controlChannelLabel        = "rubigo-control"
+	controlChannelID    uint16 = 0
+)
+
+// createControlChannel creates the pre-negotiated control channel on pc
+func createControlChannel(pc *webrtc.PeerConnection) (*webrtc.DataChannel, error) {
+	negotiated := true
+	id := controlChannelID
+	return pc.CreateDataChannel(controlChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+}
+
+// AddControlChannel joins dc to the room's control relay. Messages received
+// on it are sent to every other peer's channel, and it is removed on close.
+func (r *Room) AddControlChannel(dc *webrtc.DataChannel) {
+	r.mu.Lock()
+	if r.controlChannels == nil {
+		r.controlChannels = make(map[*webrtc.DataChannel]struct{})
+	}
+	r.controlChannels[dc] = struct{}{}
+	r.mu.Unlock()
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		r.relayControl(dc, msg)
+	})
+	dc.OnClose(func() {
+		r.mu.Lock()
+		delete(r.controlChannels, dc)
+		r.mu.Unlock()
+	})
+}
+
+// relayControl forwards a control message from one peer to all others
+func (r *Room) relayControl(from *webrtc.DataChannel, msg webrtc.DataChannelMessage) {
+	r.mu.RLock()
+	targets := make([]*webrtc.DataChannel, 0, len(r.controlChannels))
+	for dc := range r.controlChannels {
+		if dc != from {
+			targets = append(targets, dc)
+		}
+	}
+	r.mu.RUnlock()
+	r.relayMessage(targets, msg, controlChannelLabel)
+}
+
+// relayMessage sends msg, received on a channel labelled label, to the open
+// channels in targets. Call it without r.mu held, so a slow peer doesn't
+// block the room.
+func (r *Room) relayMessage(targets []*webrtc.DataChannel, msg webrtc.DataChannelMessage, label string) {
+	for _, dc := range targets {
+		if dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		var err error
+		if msg.IsString {
+			err = dc.SendText(string(msg.Data))
+		} else {
+			err = dc.Send(msg.Data)
+		}
+		if err != nil {
+			roomLog(r.id).Error("Failed to relay data channel message", "label", label, "err", err)
+		}
+	}
+}
+
+// controlMessage is a message the SFU itself sends on a control channel
+type controlMessage struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp,omitempty"`
+	// Tracks labels the media sections of a renegotiate offer
+	Tracks []TrackInfo `json:"tracks,omitempty"`
+	// Layer is the simulcast RID a viewer is being moved to
+	Layer string `json:"layer,omitempty"`
+}
+
+// sendControlMessage sends msg on dc if it is open
+func sendControlMessage(dc *webrtc.DataChannel, msg controlMessage) {
+	sendControlJSON(dc, msg.Type, msg)
+}
+
+// sendControlJSON sends msg, a control message of type msgType, as JSON
+// on dc if it is open
+func sendControlJSON(dc *webrtc.DataChannel, msgType string, msg interface{}) {
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := dc.SendText(string(data)); err != nil {
+		slog.Error("Failed to send control message", "type", msgType, "err", err)
+	}
+}
+
+// Control message telling the broadcaster how many viewers it has
+const controlViewerCount = "viewer_count"
+
+// viewerCountDebounce batches viewer count updates, so a burst of joins
+// sends the broadcaster one message
+const viewerCountDebounce = 250 * time.Millisecond
+
+type viewerCountMessage struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// viewerCountChanged schedules a viewer count update to the broadcaster
+// unless one is already pending
+func (r *Room) viewerCountChanged() {
+	r.countMu.Lock()
+	defer r.countMu.Unlock()
+	if r.countTimer == nil {
+		r.countTimer = time.AfterFunc(viewerCountDebounce, r.sendViewerCount)
+	}
+}
+
+// sendViewerCount sends the current viewer count to the broadcaster
+func (r *Room) sendViewerCount() {
+	r.countMu.Lock()
+	r.countTimer = nil
+	r.countMu.Unlock()
+
+	r.mu.RLock()
+	dc, count := r.broadcaster.control, len(r.viewers)
+	r.mu.RUnlock()
+	sendControlJSON(dc, controlViewerCount, viewerCountMessage{Type: controlViewerCount, Count: count})
+}
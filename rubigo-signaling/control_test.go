@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// connectControl connects a client to a server-side connection's control
+// channel over loopback and returns both ends once they are open
+func connectControl(t *testing.T) (server, client *webrtc.DataChannel) {
+	t.Helper()
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { factory.Close() })
+	pc, server, err := factory.createPeerConnection("abc", "broadcaster", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	clientPC, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientPC.Close() })
+	if client, err = createControlChannel(clientPC); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := make(chan struct{}, 2)
+	server.OnOpen(func() { opened <- struct{}{} })
+	client.OnOpen(func() { opened <- struct{}{} })
+	negotiate(t, clientPC, pc)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-opened:
+		case <-time.After(5 * time.Second):
+			t.Fatal("control channel did not open")
+		}
+	}
+	return server, client
+}
+
+func TestViewerCountDebounced(t *testing.T) {
+	server, client := connectControl(t)
+	counts := make(chan int, 10)
+	client.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m viewerCountMessage
+		if err := json.Unmarshal(msg.Data, &m); err == nil && m.Type == controlViewerCount {
+			counts <- m.Count
+		}
+	})
+
+	room := &Room{id: "abc"}
+	room.SetBroadcaster(nil, server, "")
+	track := newLiveTrack(t)
+	for i := 0; i < 3; i++ {
+		if err := room.AddViewer(&viewer{track: track}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case n := <-counts:
+		if n != 3 {
+			t.Errorf("count = %d, want 3", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no viewer_count message")
+	}
+	select {
+	case n := <-counts:
+		t.Errorf("burst of joins sent a second message (count %d)", n)
+	case <-time.After(2 * viewerCountDebounce):
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Default methods and headers browsers may use cross-origin
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization", "If-Match", "X-API-Key"}
+)
+
+// CORSConfig is the CORS policy for browser callers
+type CORSConfig struct {
+	// Origins allowed; empty accepts any, matching local development
+	Origins []string
+	// Methods and Headers preflights allow; empty means the defaults
+	Methods []string
+	Headers []string
+	// AllowCredentials lets browsers send cookies and HTTP auth, which
+	// requires an origin allowlist
+	AllowCredentials bool
+	// Disabled sends no CORS headers, so browsers can't call the SFU
+	// cross-origin, for deployments reached only by backends
+	Disabled bool
+}
+
+// validate rejects policies that would let any site make credentialed
+// requests
+func (c CORSConfig) validate() error {
+	if c.AllowCredentials && len(c.Origins) == 0 && !c.Disabled {
+		return errors.New("credentials require --cors-origin")
+	}
+	return nil
+}
+
+// corsMiddleware applies the CORS policy for browser callers.
+// With no allowed origins configured any origin is accepted (`*`). Otherwise
+// the request's Origin is echoed back only if it is in the allowlist, and
+// disallowed origins are rejected with 403. Requests without an Origin
+// header (server-to-server) are not affected. Preflights are answered even
+// with CORS disabled, without the headers that would let the browser go on.
+func corsMiddleware(cfg CORSConfig, next http.HandlerFunc) http.HandlerFunc {
+	return newCORSPolicy(cfg).wrap(next)
+}
+
+// corsPolicy is a CORS policy whose allowed origins can be replaced while
+// serving, e.g. on a config reload
+type corsPolicy struct {
+	cfg                        CORSConfig
+	allowMethods, allowHeaders string
+
+	mu      sync.RWMutex
+	allowed map[string]bool
+}
+
+func newCORSPolicy(cfg CORSConfig) *corsPolicy {
+	methods, headers := cfg.Methods, cfg.Headers
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	p := &corsPolicy{cfg: cfg, allowMethods: strings.Join(methods, ", "), allowHeaders: strings.Join(headers, ", ")}
+	p.allowed = originSet(cfg.Origins)
+	return p
+}
+
+func originSet(origins []string) map[string]bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	return allowed
+}
+
+// checkOrigins reports whether origins may replace the allowed ones
+func (p *corsPolicy) checkOrigins(origins []string) error {
+	cfg := p.cfg
+	cfg.Origins = origins
+	return cfg.validate()
+}
+
+// setOrigins replaces the allowed origins; empty accepts any
+func (p *corsPolicy) setOrigins(origins []string) error {
+	if err := p.checkOrigins(origins); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allowed = originSet(origins)
+	return nil
+}
+
+// wrap serves next under the policy
+func (p *corsPolicy) wrap(next http.HandlerFunc) http.HandlerFunc {
+	cfg, allowMethods, allowHeaders := p.cfg, p.allowMethods, p.allowHeaders
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.RLock()
+		allowed := p.allowed
+		p.mu.RUnlock()
+		if cfg.Disabled {
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			next(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+
+		if len(allowed) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin != "" && !allowed[origin] {
+				if r.Method == http.MethodOptions {
+					// Answer the preflight without CORS headers so the browser blocks it
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				writeError(w, http.StatusForbidden, errCodeOriginNotAllowed, "Origin not allowed")
+				return
+			}
+			if origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if cfg.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+		// WHIP and WHEP clients read the session URL, ICE servers and ICE
+		// session tag from these
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Link, ETag")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	allowlist := CORSConfig{Origins: []string{"https://app.example"}}
+	credentialed := CORSConfig{Origins: []string{"https://app.example"}, AllowCredentials: true}
+
+	tests := []struct {
+		name            string
+		cfg             CORSConfig
+		method          string
+		origin          string
+		wantStatus      int
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{"wildcard by default", CORSConfig{}, http.MethodPost, "https://evil.example", http.StatusOK, "*", ""},
+		{"allowed origin echoed", allowlist, http.MethodPost, "https://app.example", http.StatusOK, "https://app.example", ""},
+		{"disallowed origin rejected", allowlist, http.MethodPost, "https://evil.example", http.StatusForbidden, "", ""},
+		{"disallowed preflight gets no headers", allowlist, http.MethodOptions, "https://evil.example", http.StatusOK, "", ""},
+		{"no origin passes through", allowlist, http.MethodPost, "", http.StatusOK, "", ""},
+		{"credentials allowed", credentialed, http.MethodPost, "https://app.example", http.StatusOK, "https://app.example", "true"},
+		{"credentials not offered to disallowed origins", credentialed, http.MethodOptions, "https://evil.example", http.StatusOK, "", ""},
+		{"disabled sends no headers", CORSConfig{Disabled: true}, http.MethodPost, "https://app.example", http.StatusOK, "", ""},
+		{"disabled preflight gets no headers", CORSConfig{Disabled: true}, http.MethodOptions, "https://app.example", http.StatusOK, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/internal/room", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			corsMiddleware(tt.cfg, ok)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+			if tt.cfg.Disabled && rec.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Error("disabled CORS sent Allow-Methods")
+			}
+		})
+	}
+}
+
+func TestCORSMethodsAndHeaders(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	preflight := func(cfg CORSConfig) http.Header {
+		req := httptest.NewRequest(http.MethodOptions, "/whip/abc", nil)
+		req.Header.Set("Origin", "https://app.example")
+		rec := httptest.NewRecorder()
+		corsMiddleware(cfg, ok)(rec, req)
+		return rec.Header()
+	}
+
+	h := preflight(CORSConfig{})
+	if got := h.Get("Access-Control-Allow-Methods"); got != "GET, POST, PATCH, DELETE, OPTIONS" {
+		t.Errorf("default Allow-Methods = %q", got)
+	}
+	if got := h.Get("Access-Control-Allow-Headers"); got != "Content-Type, Authorization, If-Match, X-API-Key" {
+		t.Errorf("default Allow-Headers = %q", got)
+	}
+
+	h = preflight(CORSConfig{Methods: []string{"GET", "POST"}, Headers: []string{"Content-Type", "X-Request-ID"}})
+	if got := h.Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("Allow-Methods = %q, want GET, POST", got)
+	}
+	if got := h.Get("Access-Control-Allow-Headers"); got != "Content-Type, X-Request-ID" {
+		t.Errorf("Allow-Headers = %q, want Content-Type, X-Request-ID", got)
+	}
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	if err := (CORSConfig{AllowCredentials: true}).validate(); err == nil {
+		t.Error("credentials for any origin accepted")
+	}
+	if err := (CORSConfig{AllowCredentials: true, Origins: []string{"https://app.example"}}).validate(); err != nil {
+		t.Errorf("credentials with an allowlist: %v", err)
+	}
+	if err := (CORSConfig{}).validate(); err != nil {
+		t.Errorf("default policy: %v", err)
+	}
+}
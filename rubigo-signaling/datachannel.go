@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/pion/webrtc/v4"
+)
+
+// Besides the control channel, peers may open data channels of their own
+// in-band, e.g. createDataChannel("pointer", {ordered: false,
+// maxRetransmits: 0}) for laser-pointer positions or "chat" for chat. The
+// SFU relays each message to every other peer in the room with an open
+// channel of the same label, so a peer only receives the labels it opens.
+// Each channel keeps the ordering and retransmission settings its peer
+// chose: a reliable chat channel and a lossy pointer channel can sit side
+// by side, and one peer's choice doesn't change another's.
+
+// maxDataChannelLabels caps the labels a room relays, so peers opening
+// channels at will can't grow it without bound
+const maxDataChannelLabels = 16
+
+// AcceptDataChannels has the data channels the peer on pc opens relayed to
+// the room's other peers
+func (r *Room) AcceptDataChannels(pc *webrtc.PeerConnection) {
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		// The control channel is pre-negotiated; one opened in-band would
+		// skip the control relay's rules
+		if dc.Label() == controlChannelLabel || !r.addDataChannel(dc) {
+			roomLog(r.id).Warn("Refusing data channel", "label", dc.Label())
+			dc.Close()
+		}
+	})
+}
+
+// addDataChannel joins dc to the relay for its label, unless the room
+// already relays the most labels it may
+func (r *Room) addDataChannel(dc *webrtc.DataChannel) bool {
+	label := dc.Label()
+	r.mu.Lock()
+	channels := r.dataChannels[label]
+	if channels == nil {
+		if len(r.dataChannels) >= maxDataChannelLabels {
+			r.mu.Unlock()
+			return false
+		}
+		if r.dataChannels == nil {
+			r.dataChannels = make(map[string]map[*webrtc.DataChannel]struct{})
+		}
+		channels = make(map[*webrtc.DataChannel]struct{})
+		r.dataChannels[label] = channels
+	}
+	channels[dc] = struct{}{}
+	r.mu.Unlock()
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		r.mu.RLock()
+		targets := make([]*webrtc.DataChannel, 0, len(r.dataChannels[label]))
+		for target := range r.dataChannels[label] {
+			if target != dc {
+				targets = append(targets, target)
+			}
+		}
+		r.mu.RUnlock()
+		r.relayMessage(targets, msg, label)
+	})
+	dc.OnClose(func() {
+		r.mu.Lock()
+		delete(r.dataChannels[label], dc)
+		if len(r.dataChannels[label]) == 0 {
+			delete(r.dataChannels, label)
+		}
+		r.mu.Unlock()
+	})
+	return true
+}
+
+// DataChannelLabels returns the number of open channels by label
+func (r *Room) DataChannelLabels() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	labels := make(map[string]int, len(r.dataChannels))
+	for label, channels := range r.dataChannels {
+		labels[label] = len(channels)
+	}
+	return labels
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// dataPeer is a client's data channels and the messages each received
+type dataPeer struct {
+	channels map[string]*webrtc.DataChannel
+	received map[string]chan string
+}
+
+// connectDataPeer connects a client whose channels are relayed by room,
+// opening a channel for each label
+func connectDataPeer(t *testing.T, room *Room, factory *peerFactory, labels map[string]*webrtc.DataChannelInit) dataPeer {
+	t.Helper()
+	pc, _, err := factory.createPeerConnection(room.id, "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	room.AcceptDataChannels(pc)
+	client := newTestPC(t)
+	if _, err := createControlChannel(client); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := dataPeer{channels: make(map[string]*webrtc.DataChannel), received: make(map[string]chan string)}
+	opened := make(chan struct{}, len(labels))
+	for label, init := range labels {
+		dc, err := client.CreateDataChannel(label, init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan string, 10)
+		peer.channels[label], peer.received[label] = dc, ch
+		dc.OnOpen(func() { opened <- struct{}{} })
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) { ch <- string(msg.Data) })
+	}
+	negotiate(t, client, pc)
+	for range labels {
+		select {
+		case <-opened:
+		case <-time.After(5 * time.Second):
+			t.Fatal("data channel did not open")
+		}
+	}
+	return peer
+}
+
+// waitForLabels waits until room relays want channels of each label
+func waitForLabels(t *testing.T, room *Room, want map[string]int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := room.DataChannelLabels()
+		ok := len(got) == len(want)
+		for label, n := range want {
+			ok = ok && got[label] == n
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("labels = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDataChannelRelay(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { factory.Close() })
+	room := &Room{id: "abc"}
+
+	unordered, noRetransmits := false, uint16(0)
+	pointer := &webrtc.DataChannelInit{Ordered: &unordered, MaxRetransmits: &noRetransmits}
+	presenter := connectDataPeer(t, room, factory, map[string]*webrtc.DataChannelInit{"chat": nil, "pointer": pointer})
+	alice := connectDataPeer(t, room, factory, map[string]*webrtc.DataChannelInit{"chat": nil, "pointer": pointer})
+	bob := connectDataPeer(t, room, factory, map[string]*webrtc.DataChannelInit{"chat": nil})
+	waitForLabels(t, room, map[string]int{"chat": 3, "pointer": 2})
+
+	send := func(peer dataPeer, label, text string) {
+		t.Helper()
+		if err := peer.channels[label].SendText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(peer dataPeer, label, want string) {
+		t.Helper()
+		select {
+		case got := <-peer.received[label]:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q never arrived", want)
+		}
+	}
+
+	// Chat reaches everyone else, pointer only those with the label
+	send(presenter, "chat", "hello")
+	expect(alice, "chat", "hello")
+	expect(bob, "chat", "hello")
+	send(presenter, "pointer", `{"x":0.5,"y":0.25}`)
+	expect(alice, "pointer", `{"x":0.5,"y":0.25}`)
+	send(alice, "chat", "hi")
+	expect(presenter, "chat", "hi")
+	expect(bob, "chat", "hi")
+
+	select {
+	case got := <-presenter.received["pointer"]:
+		t.Errorf("sender received its own pointer message %q", got)
+	case got := <-bob.received["chat"]:
+		t.Errorf("bob received an extra chat message %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDataChannelLabelLimit(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { factory.Close() })
+	room := &Room{id: "abc"}
+	room.dataChannels = make(map[string]map[*webrtc.DataChannel]struct{})
+	for i := 0; i < maxDataChannelLabels; i++ {
+		room.dataChannels[string(rune('a'+i))] = map[*webrtc.DataChannel]struct{}{}
+	}
+
+	connectDataPeer(t, room, factory, map[string]*webrtc.DataChannelInit{"chat": nil})
+	time.Sleep(100 * time.Millisecond)
+	if n := room.DataChannelLabels()["chat"]; n != 0 {
+		t.Errorf("room relays %d chat channels beyond its label limit", n)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// requireBearer rejects requests whose Authorization header doesn't carry
+// token as a bearer token
+func requireBearer(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleDebugStats handles GET /internal/debug/stats
+// Process-level numbers for capacity planning, e.g. to spot a goroutine
+// leak growing with load
+func (s *Server) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	all := s.rooms.Rooms()
+	var broadcasters, viewers int
+	var bytesIn, bytesOut int64
+	for _, room := range all {
+		if room.BroadcasterPC() != nil {
+			broadcasters++
+		}
+		broadcasters += room.PresenterCount()
+		viewers += room.ViewerCount()
+		in, out := room.Traffic()
+		bytesIn, bytesOut = bytesIn+in, bytesOut+out
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uptimeSeconds":   int(time.Since(s.started).Seconds()),
+		"goroutines":      runtime.NumGoroutine(),
+		"heapAllocBytes":  mem.HeapAlloc,
+		"heapObjects":     mem.HeapObjects,
+		"sysBytes":        mem.Sys,
+		"numGC":           mem.NumGC,
+		"rooms":           len(all),
+		"viewers":         viewers,
+		"peerConnections": broadcasters + viewers,
+		"bytesIngress":    bytesIn,
+		"bytesEgress":     bytesOut,
+	})
+}
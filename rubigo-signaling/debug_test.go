@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugStats(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DebugToken = "secret"
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/internal/debug/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want %d", auth, rec.Code, http.StatusUnauthorized)
+		}
+		decodeError(t, rec, errCodeUnauthorized)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/debug/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := decodeBody(t, rec)
+	if body["rooms"] != float64(1) || body["viewers"] != float64(0) {
+		t.Errorf("unexpected counts: %v", body)
+	}
+	if g, _ := body["goroutines"].(float64); g < 1 {
+		t.Errorf("goroutines = %v", body["goroutines"])
+	}
+	if heap, _ := body["heapAllocBytes"].(float64); heap <= 0 {
+		t.Errorf("heapAllocBytes = %v", body["heapAllocBytes"])
+	}
+}
+
+func TestDebugStatsDisabledWithoutToken(t *testing.T) {
+	rec := doRequest(t, newTestServer(t, newFakeStore()), http.MethodGet, "/internal/debug/stats", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
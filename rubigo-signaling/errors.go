@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Machine-readable error codes. Clients branch on these, so they must not
+// change once released; the messages are for humans and may.
+const (
+	errCodeInvalidJSON        = "invalid_json"
+	errCodeInvalidRequest     = "invalid_request"
+	errCodeBodyTooLarge       = "body_too_large"
+	errCodeMethodNotAllowed   = "method_not_allowed"
+	errCodeUnknownAction      = "unknown_action"
+	errCodeRoomIDRequired     = "room_id_required"
+	errCodeInvalidRoomID      = "invalid_room_id"
+	errCodeRoomNotFound       = "room_not_found"
+	errCodeRoomLimit          = "room_limit_reached"
+	errCodeRoomFull           = "room_full"
+	errCodeConnectionLimit    = "connection_limit_reached"
+	errCodeInvalidPassword    = "invalid_password"
+	errCodeInvalidICEServers  = "invalid_ice_servers"
+	errCodeInvalidSDP         = "invalid_sdp"
+	errCodeUnsupportedMedia   = "unsupported_media_type"
+	errCodeInvalidLayer       = "invalid_layer"
+	errCodeLayerUnavailable   = "layer_unavailable"
+	errCodeCodecUnsupported   = "codec_unsupported"
+	errCodeCodecNotAllowed    = "codec_not_allowed"
+	errCodeNoBroadcaster      = "no_broadcaster"
+	errCodeBroadcasterActive  = "broadcaster_active"
+	errCodeBroadcasterLeft    = "broadcaster_left"
+	errCodeWaitTimeout        = "broadcaster_wait_timeout"
+	errCodeICETimeout         = "ice_timeout"
+	errCodeNegotiateTimeout   = "negotiation_timeout"
+	errCodeQuotaExceeded      = "quota_exceeded"
+	errCodeInvalidViewerID    = "invalid_viewer_id"
+	errCodeViewerNotFound     = "viewer_not_found"
+	errCodeSessionNotFound    = "session_not_found"
+	errCodeViewerBanned       = "viewer_banned"
+	errCodeViewerIDInUse      = "viewer_id_in_use"
+	errCodeReconnectInvalid   = "reconnect_token_invalid"
+	errCodeNoPendingOffer     = "no_pending_offer"
+	errCodeRenegotiating      = "renegotiation_in_progress"
+	errCodePrecondition       = "precondition_failed"
+	errCodeAlreadyRecording   = "already_recording"
+	errCodeNotRecording       = "not_recording"
+	errCodeHLSDisabled        = "hls_disabled"
+	errCodeHLSStarted         = "hls_already_started"
+	errCodeNoHLS              = "hls_not_started"
+	errCodeHLSPartTimeout     = "hls_part_timeout"
+	errCodeDraining           = "draining"
+	errCodeWrongNode          = "wrong_node"
+	errCodeClusterUnavailable = "cluster_unavailable"
+	errCodeCascadeConflict    = "cascade_conflict"
+	errCodeCascadeNotFound    = "cascade_not_found"
+	errCodeUpstreamFailed     = "upstream_failed"
+	errCodePeerNotFound       = "peer_not_found"
+	errCodeRateLimited        = "rate_limited"
+	errCodeOriginNotAllowed   = "origin_not_allowed"
+	errCodeUnauthorized       = "unauthorized"
+	errCodeForbidden          = "forbidden"
+	errCodeInternal           = "internal_error"
+)
+
+// apiError is the body of every error response:
+// {"error":{"code":"room_not_found","message":"Room not found"}}
+type apiError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// writeError writes a JSON error response with a stable code
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with extra machine-readable fields
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{
+		"error": {Code: code, Message: message, Details: details},
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	want := `{"error":{"code":"room_not_found","message":"Room not found"}}` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestWriteErrorDetails(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeErrorDetails(rec, http.StatusServiceUnavailable, errCodeRoomLimit, "Room limit reached",
+		map[string]interface{}{"maxRooms": 2})
+
+	var body map[string]map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	details, _ := body["error"]["details"].(map[string]interface{})
+	if details["maxRooms"] != float64(2) {
+		t.Errorf("details = %v, want maxRooms 2", body["error"]["details"])
+	}
+}
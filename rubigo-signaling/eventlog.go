@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Debug event types besides the room events
+const (
+	debugEventRoomCreated = "room_created"
+	debugEventRoomDeleted = "room_deleted"
+	debugEventError       = "error"
+)
+
+// DebugEvent is an entry in the recent events buffer
+type DebugEvent struct {
+	Type        string    `json:"type"`
+	RoomID      string    `json:"roomId,omitempty"`
+	ViewerCount *int      `json:"viewerCount,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// eventRing keeps the most recent debug events, overwriting the oldest once
+// full. A nil ring discards events.
+type eventRing struct {
+	mu     sync.Mutex
+	events []DebugEvent
+	next   int // where the next event goes
+	full   bool
+}
+
+// newEventRing returns a ring holding size events, or nil if size is not
+// positive
+func newEventRing(size int) *eventRing {
+	if size <= 0 {
+		return nil
+	}
+	return &eventRing{events: make([]DebugEvent, size)}
+}
+
+func (r *eventRing) add(event DebugEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to n of the most recent events, oldest first.
+// n <= 0 returns all of them.
+func (r *eventRing) last(n int) []DebugEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ordered []DebugEvent
+	if r.full {
+		ordered = append(ordered, r.events[r.next:]...)
+	}
+	ordered = append(ordered, r.events[:r.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// addRoomEvent records a room's event
+func (r *eventRing) addRoomEvent(event RoomEvent) {
+	if r == nil {
+		return
+	}
+	count := event.ViewerCount
+	debug := DebugEvent{Type: event.Type, RoomID: event.RoomID, ViewerCount: &count, Time: event.Time}
+	if event.ViewerID != "" {
+		debug.Detail = "viewer " + event.ViewerID
+	}
+	r.add(debug)
+}
+
+// SetEventObserver has fn called with every event of rooms created from
+// now on, and with their creation and deletion as room_created and
+// room_deleted events. It is meant to be called once, before serving;
+// fn runs under the manager's lock, so it must not call back into it.
+func (m *RoomManager) SetEventObserver(fn func(RoomEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observe = fn
+}
+
+// notifyLocked reports a room being created or deleted to the observer.
+// The caller must hold m.mu.
+func (m *RoomManager) notifyLocked(eventType, id string) {
+	if m.observe != nil {
+		m.observe(RoomEvent{Type: eventType, RoomID: id, Time: time.Now().UTC()})
+	}
+}
+
+// statusWriter remembers the status code written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps event streams working through the wrapper
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordErrors adds an error event for every request next fails with a 5xx
+func (s *Server) recordErrors(next http.HandlerFunc) http.HandlerFunc {
+	if s.events == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		if sw.status >= 500 {
+			s.events.add(DebugEvent{
+				Type:   debugEventError,
+				Detail: fmt.Sprintf("%s %s: %d %s", r.Method, r.URL.Path, sw.status, http.StatusText(sw.status)),
+				Time:   time.Now().UTC(),
+			})
+		}
+	}
+}
+
+// handleDebugEvents handles GET /internal/debug/events
+// Dumps the most recent events, oldest first; ?limit=N returns only the
+// last N
+func (s *Server) handleDebugEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	events := s.events.last(limit)
+	if events == nil {
+		events = []DebugEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+	})
+}
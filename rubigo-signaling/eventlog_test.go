@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventRing(t *testing.T) {
+	ring := newEventRing(3)
+	for _, typ := range []string{"a", "b", "c", "d", "e"} {
+		ring.add(DebugEvent{Type: typ})
+	}
+
+	types := func(events []DebugEvent) (s string) {
+		for _, e := range events {
+			s += e.Type
+		}
+		return s
+	}
+	if got := types(ring.last(0)); got != "cde" {
+		t.Errorf("last(0) = %q, want the newest three oldest first", got)
+	}
+	if got := types(ring.last(2)); got != "de" {
+		t.Errorf("last(2) = %q, want de", got)
+	}
+
+	// A disabled buffer drops events
+	var off *eventRing
+	off.add(DebugEvent{Type: "a"})
+	if newEventRing(0) != nil {
+		t.Error("zero-size ring is not nil")
+	}
+}
+
+func TestDebugEvents(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DebugToken = "secret"
+	store := NewRoomManager()
+	s := newServer(t, store, cfg)
+	h := s.Handler()
+
+	room, _ := store.GetOrCreate("abc")
+	if err := room.AddViewer(&viewer{track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/internal/debug/events"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	events, _ := decodeBody(t, get(""))["events"].([]interface{})
+	if len(events) != 2 {
+		t.Fatalf("events = %v, want room_created and viewer_joined", events)
+	}
+	if typ := events[0].(map[string]interface{})["type"]; typ != debugEventRoomCreated {
+		t.Errorf("first event = %v, want %s", typ, debugEventRoomCreated)
+	}
+	events, _ = decodeBody(t, get("?limit=1"))["events"].([]interface{})
+	if len(events) != 1 || events[0].(map[string]interface{})["type"] != EventViewerJoined {
+		t.Errorf("?limit=1 events = %v, want only viewer_joined", events)
+	}
+
+	rec := get("?limit=zero")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	decodeError(t, rec, errCodeInvalidRequest)
+
+	// Server errors on the room API are recorded too
+	failing := s.recordErrors(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "boom")
+	})
+	failing(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/internal/room/abc/publish", nil))
+	last := s.events.last(1)
+	if len(last) != 1 || last[0].Type != debugEventError || last[0].Detail != "POST /internal/room/abc/publish: 500 Internal Server Error" {
+		t.Errorf("last event = %+v, want the failed publish", last)
+	}
+}
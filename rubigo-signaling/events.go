@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Room event types published to subscribers
+const (
+	EventViewerJoined       = "viewer_joined"
+	EventViewerLeft         = "viewer_left"
+	EventViewerKicked       = "viewer_kicked"
+	EventBroadcasterStarted = "broadcaster_started"
+	EventBroadcasterEnded   = "broadcaster_ended"
+	EventQuotaExceeded      = "quota_exceeded"
+	EventRecordingStarted   = "recording_started"
+	EventRecordingStopped   = "recording_stopped"
+	EventQualityDegraded    = "quality_degraded"
+	EventQualityRecovered   = "quality_recovered"
+	EventRoomClosed         = "room_closed"
+)
+
+// Interval between SSE keep-alive comments
+const sseKeepAlive = 15 * time.Second
+
+// RoomEvent is a change in a room's state
+type RoomEvent struct {
+	Type        string        `json:"type"`
+	RoomID      string        `json:"roomId"`
+	ViewerCount int           `json:"viewerCount"`
+	ViewerID    string        `json:"viewerId,omitempty"` // the viewer of viewer_* events
+	Banned      bool          `json:"banned,omitempty"`   // on viewer_kicked, if also banned
+	Files       []string      `json:"files,omitempty"`    // on recording_stopped, the recording's
+	Quality     *TrackQuality `json:"quality,omitempty"`  // on quality_* events, the track's summary
+	Time        time.Time     `json:"time"`
+}
+
+// SubscribeEvents registers for the room's events. The returned cancel func
+// must be called to release the subscription.
+func (r *Room) SubscribeEvents() (<-chan RoomEvent, func()) {
+	ch := make(chan RoomEvent, 16)
+
+	r.eventsMu.Lock()
+	if r.eventSubs == nil {
+		r.eventSubs = make(map[chan RoomEvent]struct{})
+	}
+	r.eventSubs[ch] = struct{}{}
+	r.eventsMu.Unlock()
+
+	cancel := func() {
+		r.eventsMu.Lock()
+		delete(r.eventSubs, ch)
+		r.eventsMu.Unlock()
+	}
+	return ch, cancel
+}
+
+// publishEvent sends an event of eventType to all subscribers
+func (r *Room) publishEvent(eventType string) {
+	r.publishRoomEvent(RoomEvent{Type: eventType})
+}
+
+// publishViewerEvent sends an event of eventType about viewerID
+func (r *Room) publishViewerEvent(eventType, viewerID string) {
+	r.publishRoomEvent(RoomEvent{Type: eventType, ViewerID: viewerID})
+}
+
+// publishRoomEvent fills in the room, viewer count and time of event and
+// sends it to all subscribers.
+// Slow subscribers miss events rather than blocking the room.
+func (r *Room) publishRoomEvent(event RoomEvent) {
+	event.RoomID = r.id
+	event.ViewerCount = r.ViewerCount()
+	event.Time = time.Now().UTC()
+	if r.onEvent != nil {
+		r.onEvent(event)
+	}
+
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	for ch := range r.eventSubs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// handleEventsWithID handles GET /internal/room/{id}/events
+// Streams room events as Server-Sent Events until the client disconnects
+// or the room is closed: viewers joining and leaving, the broadcast
+// starting and ending, recordings starting and stopping, and tracks'
+// quality alerts
+func (s *Server) handleEventsWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Streaming not supported")
+		return
+	}
+
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+			if event.Type == EventRoomClosed {
+				return
+			}
+		}
+	}
+}
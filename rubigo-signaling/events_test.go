@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsStream(t *testing.T) {
+	store := newFakeStore("abc")
+	ts := httptest.NewServer(newTestServer(t, store))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/internal/room/abc/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	// Wait for the subscription before publishing
+	if line := <-lines; !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("first line = %q", line)
+	}
+	if err := store.Get("abc").AddViewer(&viewer{track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("stream closed before event")
+			}
+			if line == "event: "+EventViewerJoined {
+				data := <-lines
+				if !strings.Contains(data, `"viewerCount":1`) {
+					t.Errorf("data = %q", data)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for viewer_joined")
+		}
+	}
+}
+
+func TestEventsRoomNotFound(t *testing.T) {
+	rec := doRequest(t, newTestServer(t, newFakeStore()), http.MethodGet, "/internal/room/abc/events", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestEventsUnsubscribe(t *testing.T) {
+	room := &Room{id: "abc"}
+	_, cancel := room.SubscribeEvents()
+	cancel()
+
+	room.eventsMu.Lock()
+	defer room.eventsMu.Unlock()
+	if len(room.eventSubs) != 0 {
+		t.Errorf("subscribers = %d after cancel, want 0", len(room.eventSubs))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import "encoding/binary"
+
+// Just enough ISO BMFF reading to tell whether an fMP4 fragment from the
+// HLS packager starts on a video keyframe, which is what lets a player
+// start decoding at it.
+
+// Track fragment header (tfhd) and track run (trun) flags
+const (
+	tfhdBaseDataOffset       = 0x000001
+	tfhdSampleDescription    = 0x000002
+	tfhdDefaultDuration      = 0x000008
+	tfhdDefaultSize          = 0x000010
+	tfhdDefaultFlags         = 0x000020
+	trunDataOffset           = 0x000001
+	trunFirstSampleFlags     = 0x000004
+	trunSampleDuration       = 0x000100
+	trunSampleSize           = 0x000200
+	trunSampleFlags          = 0x000400
+	mp4SampleIsNonSyncSample = 0x00010000
+)
+
+// mp4Box is a box's type and the data after its header
+type mp4Box struct {
+	typ  string
+	body []byte
+}
+
+// mp4Boxes splits data into the boxes it holds, stopping at a box that
+// runs past the end
+func mp4Boxes(data []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, mp4Box{typ: string(data[4:8]), body: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// mp4Find returns the bodies of the boxes at path under data, e.g.
+// "moov", "trak" for every track
+func mp4Find(data []byte, path ...string) [][]byte {
+	if len(path) == 0 {
+		return [][]byte{data}
+	}
+	var found [][]byte
+	for _, box := range mp4Boxes(data) {
+		if box.typ == path[0] {
+			found = append(found, mp4Find(box.body, path[1:]...)...)
+		}
+	}
+	return found
+}
+
+// fmp4VideoTrack returns the ID of the video track in an fMP4 init
+// segment, and the sample flags its fragments default to
+func fmp4VideoTrack(init []byte) (id, defaultFlags uint32, ok bool) {
+	for _, trak := range mp4Find(init, "moov", "trak") {
+		hdlr := mp4Find(trak, "mdia", "hdlr")
+		if len(hdlr) == 0 || len(hdlr[0]) < 12 || string(hdlr[0][8:12]) != "vide" {
+			continue
+		}
+		tkhd := mp4Find(trak, "tkhd")
+		if len(tkhd) == 0 || len(tkhd[0]) < 4 {
+			return 0, 0, false
+		}
+		// Creation and modification times come first, 64-bit in version 1
+		offset := 12
+		if tkhd[0][0] == 1 {
+			offset = 20
+		}
+		if len(tkhd[0]) < offset+4 {
+			return 0, 0, false
+		}
+		id = binary.BigEndian.Uint32(tkhd[0][offset:])
+		for _, trex := range mp4Find(init, "moov", "mvex", "trex") {
+			if len(trex) >= 24 && binary.BigEndian.Uint32(trex[4:]) == id {
+				defaultFlags = binary.BigEndian.Uint32(trex[20:])
+			}
+		}
+		return id, defaultFlags, true
+	}
+	return 0, 0, false
+}
+
+// fmp4StartsWithSync reports whether a fragment's first sample of track is
+// a sync sample, defaultFlags being the flags the init segment gives its
+// samples
+func fmp4StartsWithSync(fragment []byte, track, defaultFlags uint32) bool {
+	for _, traf := range mp4Find(fragment, "moof", "traf") {
+		tfhd := mp4Find(traf, "tfhd")
+		if len(tfhd) == 0 || len(tfhd[0]) < 8 || binary.BigEndian.Uint32(tfhd[0][4:]) != track {
+			continue
+		}
+		flags := defaultFlags
+		tfFlags, offset := binary.BigEndian.Uint32(tfhd[0])&0xffffff, 8
+		for _, field := range []struct {
+			flag uint32
+			size int
+		}{{tfhdBaseDataOffset, 8}, {tfhdSampleDescription, 4}, {tfhdDefaultDuration, 4}, {tfhdDefaultSize, 4}} {
+			if tfFlags&field.flag != 0 {
+				offset += field.size
+			}
+		}
+		if tfFlags&tfhdDefaultFlags != 0 {
+			if len(tfhd[0]) < offset+4 {
+				return false
+			}
+			flags = binary.BigEndian.Uint32(tfhd[0][offset:])
+		}
+
+		for _, trun := range mp4Find(traf, "trun") {
+			if len(trun) < 8 || binary.BigEndian.Uint32(trun[4:]) == 0 {
+				continue
+			}
+			runFlags, offset := binary.BigEndian.Uint32(trun)&0xffffff, 8
+			if runFlags&trunDataOffset != 0 {
+				offset += 4
+			}
+			if runFlags&trunFirstSampleFlags != 0 {
+				if len(trun) < offset+4 {
+					return false
+				}
+				return binary.BigEndian.Uint32(trun[offset:])&mp4SampleIsNonSyncSample == 0
+			}
+			if runFlags&trunSampleFlags != 0 {
+				// The first sample's entry: duration and size, then flags
+				if runFlags&trunSampleDuration != 0 {
+					offset += 4
+				}
+				if runFlags&trunSampleSize != 0 {
+					offset += 4
+				}
+				if len(trun) < offset+4 {
+					return false
+				}
+				flags = binary.BigEndian.Uint32(trun[offset:])
+			}
+			return flags&mp4SampleIsNonSyncSample == 0
+		}
+	}
+	return false
+}
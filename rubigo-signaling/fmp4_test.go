@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// mp4TestBox builds a box of typ holding body
+func mp4TestBox(typ string, body ...[]byte) []byte {
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(box, typ...), data...)
+}
+
+// be32 writes each of vs as 32 bits
+func be32(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// mp4SyncFlags are the sample flags of a keyframe
+const mp4SyncFlags = 0x02000000
+
+// testInit is an init segment with audio as track 1 and video as track 2,
+// whose samples default to trexFlags
+func testInit(trexFlags uint32) []byte {
+	trak := func(id uint32, handler string) []byte {
+		return mp4TestBox("trak",
+			mp4TestBox("tkhd", be32(0, 0, 0, id, 0)),
+			mp4TestBox("mdia", mp4TestBox("hdlr", be32(0, 0), []byte(handler))))
+	}
+	return append(mp4TestBox("ftyp", []byte("iso6")), mp4TestBox("moov",
+		trak(1, "soun"), trak(2, "vide"),
+		mp4TestBox("mvex",
+			mp4TestBox("trex", be32(0, 1, 1, 0, 0, 0)),
+			mp4TestBox("trex", be32(0, 2, 1, 0, 0, trexFlags))))...)
+}
+
+// testFragment is a fragment of tracks 1 and 2 whose video starts with a
+// keyframe if sync is set
+func testFragment(sync bool) []byte {
+	flags := uint32(mp4SampleIsNonSyncSample)
+	if sync {
+		flags = mp4SyncFlags
+	}
+	return append(mp4TestBox("moof",
+		mp4TestBox("traf", mp4TestBox("tfhd", be32(0x020000, 1)), mp4TestBox("trun", be32(0, 1))),
+		mp4TestBox("traf", mp4TestBox("tfhd", be32(0x020000, 2)), mp4TestBox("trun", be32(trunDataOffset|trunFirstSampleFlags, 1, 0, flags)))),
+		mp4TestBox("mdat", []byte{1, 2, 3})...)
+}
+
+func TestFMP4VideoTrack(t *testing.T) {
+	if id, flags, ok := fmp4VideoTrack(testInit(mp4SampleIsNonSyncSample)); !ok || id != 2 || flags != mp4SampleIsNonSyncSample {
+		t.Errorf("fmp4VideoTrack = %d, %#x, %v; want 2, %#x", id, flags, ok, mp4SampleIsNonSyncSample)
+	}
+	if _, _, ok := fmp4VideoTrack(mp4TestBox("moov")); ok {
+		t.Error("found a video track in an empty moov")
+	}
+}
+
+func TestFMP4StartsWithSync(t *testing.T) {
+	traf := func(tfhd, trun []byte) []byte {
+		return mp4TestBox("moof", mp4TestBox("traf", mp4TestBox("tfhd", tfhd), mp4TestBox("trun", trun)))
+	}
+	tests := []struct {
+		name     string
+		fragment []byte
+		defaults uint32
+		want     bool
+	}{
+		{"first sample flags", testFragment(true), mp4SampleIsNonSyncSample, true},
+		{"first sample not sync", testFragment(false), 0, false},
+		{"sample flags", traf(be32(0, 2), be32(trunSampleDuration|trunSampleFlags, 2, 3000, mp4SyncFlags, 3000, mp4SampleIsNonSyncSample)), mp4SampleIsNonSyncSample, true},
+		{"tfhd default flags", traf(be32(tfhdBaseDataOffset|tfhdDefaultFlags, 2, 0, 0, mp4SampleIsNonSyncSample), be32(0, 1)), 0, false},
+		{"trex default flags", traf(be32(0, 2), be32(0, 1)), mp4SyncFlags, true},
+		{"other track", traf(be32(0, 1), be32(0, 1)), mp4SyncFlags, false},
+		{"truncated", traf(be32(0, 2), be32(trunFirstSampleFlags, 1)), mp4SyncFlags, false},
+	}
+	for _, tt := range tests {
+		if got := fmp4StartsWithSync(tt.fragment, 2, tt.defaults); got != tt.want {
+			t.Errorf("%s: fmp4StartsWithSync = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// forwardingTrack is the stable track viewers subscribe to.
+// Its upstream source (the broadcaster's remote track) can be swapped when the
+// broadcaster republishes; sequence numbers and timestamps are rewritten so
+// viewers see one continuous stream instead of a new one.
+type forwardingTrack struct {
+	*webrtc.TrackLocalStaticRTP
+
+	mu         sync.Mutex
+	source     *webrtc.TrackRemote
+	generation uint64 // incremented on every SetSource
+	rewriter   rtpRewriter
+
+	// Frame size from the most recent keyframe, zero until one is seen
+	width, height int
+
+	// When a viewer's keyframe request last went to the broadcaster
+	lastKeyframeRequest time.Time
+
+	// One-shot callbacks run after the next forwarded packet
+	onForward []func()
+
+	// Number of viewer senders currently bound, i.e. receiving packets
+	bound atomic.Int32
+
+	// relays are simulcast viewers' tracks, which get every packet once
+	// it has been rewritten here. The slice is replaced, never modified,
+	// so Forward can range over it unlocked.
+	relays []*simulcastTrack
+
+	// Outbound bitrate, for choosing simulcast layers
+	rate    bitrateSampler
+	bitrate float64
+
+	// shed holds the track under the room's bitrate cap; nil if uncapped
+	shed            *bitrateShedder
+	onShedRecovered func()
+
+	// nacks tracks viewers' NACKs passed upstream; nil until the first
+	nacks *nackForwarder
+
+	// history is kept for answering viewers' NACKs, with senders; nil if
+	// the SFU doesn't answer them
+	history *packetHistory
+	senders retransmitters
+}
+
+// rtpRewriter rebases sequence numbers and timestamps so an output stream
+// stays continuous when its input switches. It is not safe for concurrent
+// use.
+type rtpRewriter struct {
+	resync    bool
+	hasOutput bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+
+	// since is the first output sequence number written at seqOffset;
+	// moved is set when the offset changes, until the next write
+	since uint16
+	moved bool
+}
+
+// rewrite moves packet onto the output sequence. After a switch the new
+// input continues one sequence number and one nominal frame, at clockRate,
+// after the last packet written.
+func (w *rtpRewriter) rewrite(packet *rtp.Packet, clockRate uint32) {
+	if w.resync {
+		if w.hasOutput {
+			frame := clockRate / 30
+			w.seqOffset = w.lastSeq + 1 - packet.SequenceNumber
+			w.tsOffset = w.lastTS + frame - packet.Timestamp
+		}
+		w.resync, w.moved = false, true
+	}
+	packet.SequenceNumber += w.seqOffset
+	packet.Timestamp += w.tsOffset
+	if w.moved || !w.hasOutput {
+		w.since, w.moved = packet.SequenceNumber, false
+	}
+	w.lastSeq = packet.SequenceNumber
+	w.lastTS = packet.Timestamp
+	w.hasOutput = true
+}
+
+// skip drops an input packet without leaving a gap in the output sequence.
+// Timestamps aren't moved, since the time did pass.
+func (w *rtpRewriter) skip() {
+	w.seqOffset--
+	w.moved = true
+}
+
+// input returns the input sequence number that output was written from.
+// Only packets written since the offset last moved can be traced back.
+func (w *rtpRewriter) input(output uint16) (uint16, bool) {
+	if !w.hasOutput || w.moved || int16(output-w.since) < 0 || int16(w.lastSeq-output) < 0 {
+		return 0, false
+	}
+	return output - w.seqOffset, true
+}
+
+// newForwardingTrack creates a track for the broadcaster's negotiated codec,
+// so any codec the media engine accepts is passed through unchanged
+func newForwardingTrack(codec webrtc.RTPCodecCapability) (*forwardingTrack, error) {
+	id := "video"
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		id = "audio"
+	}
+	return newLabeledTrack(codec, id)
+}
+
+// newLabeledTrack is newForwardingTrack with a chosen track ID, which
+// viewers see as the track's msid
+func newLabeledTrack(codec webrtc.RTPCodecCapability, id string) (*forwardingTrack, error) {
+	return newStreamTrack(codec, id, hostStreamID)
+}
+
+// newStreamTrack is newLabeledTrack in the msid stream streamID
+func newStreamTrack(codec webrtc.RTPCodecCapability, id, streamID string) (*forwardingTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardingTrack{TrackLocalStaticRTP: track, rate: bitrateSampler{interval: time.Second}}, nil
+}
+
+// Bind attaches a viewer's sender, counting it for Bindings
+func (f *forwardingTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	params, err := f.TrackLocalStaticRTP.Bind(t)
+	if err == nil {
+		f.bound.Add(1)
+		f.senders.bind(t, params)
+	}
+	return params, err
+}
+
+// Unbind detaches a viewer's sender, e.g. when it is paused or closed
+func (f *forwardingTrack) Unbind(t webrtc.TrackLocalContext) error {
+	err := f.TrackLocalStaticRTP.Unbind(t)
+	if err == nil {
+		f.bound.Add(-1)
+		f.senders.unbind(t)
+	}
+	return err
+}
+
+// Bindings returns how many viewer senders each packet is written to,
+// counting those it is relayed to
+func (f *forwardingTrack) Bindings() int {
+	n := int(f.bound.Load())
+	f.mu.Lock()
+	relays := f.relays
+	f.mu.Unlock()
+	for _, relay := range relays {
+		n += int(relay.bound.Load())
+	}
+	return n
+}
+
+// addRelay passes packets on to a simulcast viewer's track
+func (f *forwardingTrack) addRelay(s *simulcastTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, relay := range f.relays {
+		if relay == s {
+			return
+		}
+	}
+	f.relays = append(append([]*simulcastTrack(nil), f.relays...), s)
+}
+
+// removeRelay stops passing packets to s
+func (f *forwardingTrack) removeRelay(s *simulcastTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	relays := make([]*simulcastTrack, 0, len(f.relays))
+	for _, relay := range f.relays {
+		if relay != s {
+			relays = append(relays, relay)
+		}
+	}
+	f.relays = relays
+}
+
+// Bitrate returns the track's recent average bitrate in bits per second,
+// zero until a second of packets has been forwarded
+func (f *forwardingTrack) Bitrate() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bitrate
+}
+
+// SetSource switches the upstream track; the next packet from it is
+// re-based onto the current output sequence
+func (f *forwardingTrack) SetSource(source *webrtc.TrackRemote) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.source = source
+	f.generation++
+	f.rewriter.resync = true
+}
+
+// Generation identifies the current source attachment, so callers can tell
+// whether a source has come and gone since they last looked
+func (f *forwardingTrack) Generation() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.generation
+}
+
+// ClearSource detaches source if it is still the current upstream.
+// Returns false if another source has already replaced it.
+func (f *forwardingTrack) ClearSource(source *webrtc.TrackRemote) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.source != source {
+		return false
+	}
+	f.source = nil
+	return true
+}
+
+// Source returns the current upstream track, or nil if none is attached
+func (f *forwardingTrack) Source() *webrtc.TrackRemote {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.source
+}
+
+// Forward writes a packet from source to viewers.
+// Packets from a source that has been replaced are dropped.
+func (f *forwardingTrack) Forward(source *webrtc.TrackRemote, packet *rtp.Packet) error {
+	f.mu.Lock()
+	if f.source != source {
+		f.mu.Unlock()
+		return nil
+	}
+	if f.shed != nil {
+		if ok, recovered := f.shed.admit(packet, keyframeStart(f.Codec().MimeType, packet.Payload), time.Now()); !ok {
+			f.rewriter.skip()
+			onRecovered := f.onShedRecovered
+			f.mu.Unlock()
+			if recovered {
+				onRecovered()
+			}
+			return nil
+		}
+	}
+	f.rewriter.rewrite(packet, f.Codec().ClockRate)
+	if f.rate.interval > 0 {
+		if _, average, ok := f.rate.add(packet.MarshalSize(), time.Now()); ok {
+			f.bitrate = average
+		}
+	}
+	hooks := f.onForward
+	f.onForward = nil
+	relays := f.relays
+	history := f.history
+	f.mu.Unlock()
+
+	if history != nil {
+		history.add(packet)
+	}
+	err := f.WriteRTP(packet)
+	for _, relay := range relays {
+		err = errors.Join(err, relay.relay(f, packet))
+	}
+	for _, fn := range hooks {
+		fn()
+	}
+	return err
+}
+
+// AfterNextForward runs fn once, after the next packet is written to viewers
+func (f *forwardingTrack) AfterNextForward(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onForward = append(f.onForward, fn)
+}
+
+// ObserveKeyframe records the frame size if packet starts a keyframe
+func (f *forwardingTrack) ObserveKeyframe(packet *rtp.Packet) {
+	width, height, ok := keyframeResolution(f.Codec().MimeType, packet.Payload)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	f.width, f.height = width, height
+	f.mu.Unlock()
+}
+
+// Resolution returns the last keyframe's frame size, or zeros if unknown
+func (f *forwardingTrack) Resolution() (width, height int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.width, f.height
+}
+
+// How often repeated forwarding errors are logged per broadcaster track
+const forwardErrorLogInterval = 10 * time.Second
+
+// forwardBroadcasterTrack copies RTP from the broadcaster's remote track to
+// the room's forwarding track until the remote track ends. Its span is
+// linked to publishSpan, that of the SDP exchange that set up the track.
+func (s *Server) forwardBroadcasterTrack(room *Room, remote *webrtc.TrackRemote, local *forwardingTrack, publishSpan trace.SpanContext) {
+	pooled := s.rtpBuffers.get(s.cfg.RTPBufferSize)
+	defer s.rtpBuffers.put(pooled)
+	buf := *pooled
+	span := s.startForwardSpan(room, remote, publishSpan)
+	var packets, bytes int
+	// Co-presenters' tracks don't keep the broadcast alive and aren't
+	// recorded, and neither are the broadcaster's extra tracks
+	key, published := room.publishedKey(local)
+	copresented := published && key.peerID != ""
+	logger := room.broadcasterLog()
+	if copresented {
+		logger = room.presenterLog(key.peerID)
+	}
+	logger = logger.With("track", remote.Codec().MimeType, "rid", remote.RID())
+	readErrors := logThrottle{logger: logger, interval: forwardErrorLogInterval}
+	writeErrors := logThrottle{logger: logger, interval: forwardErrorLogInterval}
+	recordErrors := logThrottle{logger: logger, interval: forwardErrorLogInterval}
+	var bitrate *bitrateSampler
+	if s.cfg.BitrateLogInterval > 0 {
+		bitrate = &bitrateSampler{interval: s.cfg.BitrateLogInterval}
+	}
+	// Every read is parsed into the same packet; the NACK history and the
+	// recorder keep copies of their own
+	packet := &rtp.Packet{}
+	for {
+		n, _, err := remote.Read(buf)
+		if errors.Is(err, io.ErrShortBuffer) {
+			readErrors.Warn("Dropped RTP packet larger than the read buffer; raise --rtp-buffer-size", "bufferSize", len(buf))
+			continue
+		}
+		if err != nil {
+			logger.Info("Broadcaster track ended", "err", err)
+			endForwardSpan(span, packets, bytes, err)
+			if rec := room.GetRecorder(); rec != nil && !published {
+				rec.CloseTrack(remote.Kind())
+			}
+			if hls := room.GetHLS(); hls != nil && !published {
+				hls.CloseTrack(remote.Kind())
+			}
+			room.DetachBroadcasterSource(remote)
+			return
+		}
+		if packets == 0 {
+			span.AddEvent("first packet")
+		}
+		packets++
+		bytes += n
+		if !copresented {
+			room.touchBroadcaster()
+		}
+		if bitrate != nil {
+			if current, average, ok := bitrate.add(n, time.Now()); ok {
+				logger.Debug("Inbound bitrate", "kbps", math.Round(current/1000), "averageKbps", math.Round(average/1000))
+			}
+		}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		local.ObserveKeyframe(packet)
+		// Tap the stream for recording and HLS before forwarding.
+		// Only the default layer is recorded when simulcasting.
+		if rec, hls := room.GetRecorder(), room.GetHLS(); (rec != nil || hls != nil) && (room.GetBroadcasterTrack() == local || room.AudioTrack() == local) {
+			if rec != nil {
+				if err := rec.WriteRTP(remote.Kind(), remote.Codec(), packet); err != nil {
+					recordErrors.Warn("Recording write failed", "err", err)
+				}
+			}
+			if hls != nil {
+				hls.WriteRTP(remote.Kind(), remote.Codec(), packet)
+			}
+		}
+		if err := local.Forward(remote, packet); isForwardError(err) {
+			writeErrors.Warn("Forwarding to viewers failed", "err", err)
+		}
+		if total := room.addTraffic(n, n*local.Bindings()); s.cfg.RoomByteQuota > 0 && total > s.cfg.RoomByteQuota {
+			s.enforceQuota(room)
+		}
+	}
+}
+
+// bufferPool reuses fixed-size byte buffers. Forwarding reads each packet
+// into its track's buffer and parses it into the same rtp.Packet, and
+// rewrites and writes it to viewers in place, so once a track has a buffer
+// it allocates nothing per packet; the pool
+// saves the buffer allocation as broadcasters come and go. The zero value
+// is ready to use.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// get returns a buffer of size bytes
+func (p *bufferPool) get(size int) *[]byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// put returns buf for reuse; its contents may be handed out again at once
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// bitrateSampler turns a byte count into bits per second once per interval,
+// with an exponential moving average to smooth out keyframe bursts.
+// It is not safe for concurrent use.
+type bitrateSampler struct {
+	interval time.Duration
+	start    time.Time
+	bytes    int
+	average  float64
+}
+
+// add counts n bytes received at now. When an interval has elapsed it
+// returns the bitrate over that interval and the rolling average.
+func (b *bitrateSampler) add(n int, now time.Time) (current, average float64, ok bool) {
+	if b.start.IsZero() {
+		b.start = now
+	}
+	b.bytes += n
+	elapsed := now.Sub(b.start)
+	if elapsed < b.interval {
+		return 0, 0, false
+	}
+
+	current = float64(b.bytes*8) / elapsed.Seconds()
+	if b.average == 0 {
+		b.average = current
+	} else {
+		b.average = 0.7*b.average + 0.3*current
+	}
+	b.start, b.bytes = now, 0
+	return current, b.average, true
+}
+
+// isForwardError reports whether err from Forward is worth logging.
+// io.ErrClosedPipe comes from viewers whose transport isn't up yet or has
+// closed, which resolves itself when they connect or are removed. pion
+// joins per-viewer errors, so a closed viewer also hides errors from
+// others until it is removed.
+func isForwardError(err error) bool {
+	return err != nil && !errors.Is(err, io.ErrClosedPipe)
+}
+
+// logThrottle logs warnings to logger at most once per interval, counting
+// what it suppresses. It is not safe for concurrent use.
+type logThrottle struct {
+	logger     *slog.Logger
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+func (l *logThrottle) Warn(msg string, args ...interface{}) {
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return
+	}
+	if l.suppressed > 0 {
+		args = append(args, "suppressed", l.suppressed)
+	}
+	l.last, l.suppressed = now, 0
+	l.logger.Warn(msg, args...)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// fakeBinding is a viewer binding that records or discards what it is sent
+type fakeBinding struct {
+	id      string
+	err     error
+	packets []rtp.Header
+	keep    bool
+}
+
+func (b *fakeBinding) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}}
+}
+func (b *fakeBinding) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (b *fakeBinding) SSRC() webrtc.SSRC                                      { return 1 }
+func (b *fakeBinding) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (b *fakeBinding) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (b *fakeBinding) WriteStream() webrtc.TrackLocalWriter                   { return b }
+func (b *fakeBinding) ID() string                                             { return b.id }
+func (b *fakeBinding) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+func (b *fakeBinding) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	if b.keep {
+		b.packets = append(b.packets, *header)
+	}
+	return len(payload), b.err
+}
+
+func (b *fakeBinding) Write(p []byte) (int, error) { return len(p), b.err }
+
+// bindViewer attaches a fake viewer to track
+func bindViewer(t testing.TB, track *forwardingTrack, b *fakeBinding) {
+	t.Helper()
+	if _, err := track.Bind(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardingTrackResync(t *testing.T) {
+	track := newLiveTrack(t)
+	viewer := &fakeBinding{id: "v", keep: true}
+	bindViewer(t, track, viewer)
+
+	first := track.Source()
+	for i := uint16(0); i < 3; i++ {
+		if err := track.Forward(first, &rtp.Packet{Header: rtp.Header{SequenceNumber: 100 + i, Timestamp: 1000}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A republished source starts its own sequence; viewers see it continue
+	second := &webrtc.TrackRemote{}
+	track.SetSource(second)
+	if err := track.Forward(first, &rtp.Packet{Header: rtp.Header{SequenceNumber: 103}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := track.Forward(second, &rtp.Packet{Header: rtp.Header{SequenceNumber: 5000, Timestamp: 77}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(viewer.packets) != 4 {
+		t.Fatalf("viewer got %d packets, want 4 (stale source dropped)", len(viewer.packets))
+	}
+	last := viewer.packets[3]
+	if last.SequenceNumber != 103 || last.Timestamp != 1000+90000/30 {
+		t.Errorf("resumed packet seq=%d ts=%d, want seq=103 ts=%d", last.SequenceNumber, last.Timestamp, 1000+90000/30)
+	}
+}
+
+func TestIsForwardError(t *testing.T) {
+	track := newLiveTrack(t)
+	closed := &fakeBinding{id: "closed", err: io.ErrClosedPipe}
+	bindViewer(t, track, closed)
+
+	err := track.Forward(track.Source(), &rtp.Packet{})
+	if err == nil || isForwardError(err) {
+		t.Errorf("closed viewer error %v should not be reported", err)
+	}
+
+	closed.err = errors.New("write failed")
+	if err := track.Forward(track.Source(), &rtp.Packet{}); !isForwardError(err) {
+		t.Errorf("real write error %v should be reported", err)
+	}
+	if isForwardError(nil) {
+		t.Error("nil reported as an error")
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	var buf bytes.Buffer
+	l := logThrottle{logger: slog.New(slog.NewTextHandler(&buf, nil)), interval: time.Hour}
+	l.Warn("first")
+	l.Warn("second")
+	l.Warn("third")
+	if l.suppressed != 2 {
+		t.Errorf("suppressed = %d, want 2", l.suppressed)
+	}
+
+	l.last = time.Now().Add(-2 * time.Hour)
+	l.Warn("after interval")
+	if l.suppressed != 0 {
+		t.Errorf("suppressed after interval = %d, want 0", l.suppressed)
+	}
+	if out := buf.String(); strings.Count(out, "\n") != 2 || !strings.Contains(out, `msg="after interval" suppressed=2`) {
+		t.Errorf("logged %q, want the first line and the one after the interval counting 2 suppressed", out)
+	}
+}
+
+func TestBitrateSampler(t *testing.T) {
+	b := bitrateSampler{interval: time.Second}
+	start := time.Now()
+
+	if _, _, ok := b.add(1000, start); ok {
+		t.Fatal("sample reported before the interval elapsed")
+	}
+	if _, _, ok := b.add(1000, start.Add(500*time.Millisecond)); ok {
+		t.Fatal("sample reported before the interval elapsed")
+	}
+	current, average, ok := b.add(500, start.Add(time.Second))
+	if !ok || current != 20000 || average != 20000 {
+		t.Fatalf("first sample = %v, %v, %t; want 20000, 20000, true", current, average, ok)
+	}
+
+	// The average moves toward a new rate rather than jumping to it
+	current, average, ok = b.add(10000, start.Add(2*time.Second))
+	if !ok || current != 80000 || average <= 20000 || average >= 80000 {
+		t.Errorf("second sample = %v, %v, %t", current, average, ok)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var p bufferPool
+	buf := p.get(1500)
+	if len(*buf) != 1500 {
+		t.Fatalf("len = %d, want 1500", len(*buf))
+	}
+	p.put(buf)
+	// A pooled buffer of another size is never handed out
+	if got := p.get(9000); len(*got) != 9000 {
+		t.Errorf("len = %d, want 9000", len(*got))
+	}
+}
+
+// BenchmarkForward measures the per-packet cost of the broadcaster loop
+// from the read on, as forwardBroadcasterTrack runs it: the packet lands
+// in the pooled read buffer, is parsed into the loop's one packet, checked
+// for a keyframe, kept in the NACK history and fanned out to viewers.
+// allocs/op covers all of it.
+func BenchmarkForward(b *testing.B) {
+	raw, err := (&rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, Timestamp: 1},
+		Payload: make([]byte, 1100),
+	}).Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, viewers := range []int{1, 10, 50, 100} {
+		for _, closed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("viewers=%d/closed=%t", viewers, closed), func(b *testing.B) {
+				track, err := newForwardingTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000})
+				if err != nil {
+					b.Fatal(err)
+				}
+				track.keepHistory(512)
+				source := &webrtc.TrackRemote{}
+				track.SetSource(source)
+				for i := 0; i < viewers; i++ {
+					binding := &fakeBinding{id: fmt.Sprint(i)}
+					if closed {
+						binding.err = io.ErrClosedPipe
+					}
+					bindViewer(b, track, binding)
+				}
+
+				var pool bufferPool
+				pooled := pool.get(1500)
+				defer pool.put(pooled)
+				buf := *pooled
+				packet := &rtp.Packet{}
+				b.SetBytes(int64(len(raw)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// Stands in for remote.Read, with a new sequence
+					// number each time so the history fills
+					n := copy(buf, raw)
+					binary.BigEndian.PutUint16(buf[2:4], uint16(i))
+					if err := packet.Unmarshal(buf[:n]); err != nil {
+						b.Fatal(err)
+					}
+					track.ObserveKeyframe(packet)
+					if err := track.Forward(source, packet); isForwardError(err) {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// BeginShutdown marks the server as shutting down so readiness fails and
+// load balancers stop routing new sessions here
+func (s *Server) BeginShutdown() {
+	s.shuttingDown.Store(true)
+}
+
+// handleDrain handles POST /internal/drain and /internal/undrain.
+// While draining, new rooms and publishes are refused and readiness fails,
+// but existing sessions keep running so they can finish before a deploy.
+func (s *Server) handleDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if s.draining.Swap(draining) != draining {
+			if draining {
+				slog.Info("Draining: refusing new rooms and publishes")
+			} else {
+				slog.Info("Drain cancelled: accepting new rooms and publishes")
+			}
+		}
+
+		rooms, broadcasters, viewers := s.counts()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"draining":     draining,
+			"rooms":        rooms,
+			"broadcasters": broadcasters,
+			"viewers":      viewers,
+		})
+	}
+}
+
+// counts returns the number of rooms and live peer connections
+func (s *Server) counts() (rooms, broadcasters, viewers int) {
+	all := s.rooms.Rooms()
+	for _, room := range all {
+		if room.GetBroadcasterTrack() != nil {
+			broadcasters++
+		}
+		// Co-presenters publish too
+		broadcasters += room.PresenterCount()
+		viewers += room.ViewerCount()
+	}
+	return len(all), broadcasters, viewers
+}
+
+// readyCheckTimeout bounds the cluster registry check in a readiness probe,
+// inside the few seconds Kubernetes gives the whole probe
+const readyCheckTimeout = time.Second
+
+// handleHealth handles GET /healthz and /health
+// Liveness: always ok while the process is serving requests, draining or
+// not, so the probe only restarts a stuck process
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        "healthy",
+		"uptimeSeconds": int(time.Since(s.started).Seconds()),
+	})
+}
+
+// readyCheck is one readiness condition and why it fails, empty if it holds
+type readyCheck struct {
+	name, failure string
+}
+
+// readyChecks evaluates whether the node should get new sessions: it is
+// accepting new rooms, below capacity, can bind media sockets and, in a
+// cluster, can reach the room registry
+func (s *Server) readyChecks(ctx context.Context, rooms, connections int) []readyCheck {
+	var accepting, capacity, udp string
+	switch {
+	case s.shuttingDown.Load():
+		accepting = "shutting down"
+	case s.draining.Load():
+		accepting = "draining"
+	case s.cfg.MaxRooms > 0 && rooms >= s.cfg.MaxRooms:
+		accepting = "room cap reached"
+	case s.cfg.ReadyMaxRooms > 0 && rooms > s.cfg.ReadyMaxRooms:
+		accepting = "room limit exceeded"
+	}
+	switch {
+	case s.cfg.MaxPeerConnections > 0 && connections >= s.cfg.MaxPeerConnections:
+		capacity = "connection cap reached"
+	case s.cfg.ReadyMaxConnections > 0 && connections > s.cfg.ReadyMaxConnections:
+		capacity = "connection limit exceeded"
+	}
+	if err := s.peers.checkUDP(); err != nil {
+		udp = err.Error()
+	}
+	checks := []readyCheck{{"accepting", accepting}, {"capacity", capacity}, {"udp", udp}}
+
+	if s.cluster != nil {
+		ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+		defer cancel()
+		var registry string
+		if err := s.cluster.registry.client.Ping(ctx).Err(); err != nil {
+			registry = "room registry unreachable: " + err.Error()
+		}
+		checks = append(checks, readyCheck{"cluster", registry})
+	}
+	return checks
+}
+
+// handleReady handles GET /readyz and /ready
+// Readiness: 503 once shutdown or draining has begun, at capacity, or when
+// a dependency is down. Each check's result is under checks, and the first
+// failure is the reason.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	rooms, broadcasters, viewers := s.counts()
+
+	status, reason := "ready", ""
+	results := make(map[string]string)
+	for _, check := range s.readyChecks(r.Context(), rooms, broadcasters+viewers) {
+		if check.failure == "" {
+			results[check.name] = "ok"
+			continue
+		}
+		results[check.name] = check.failure
+		if reason == "" {
+			status, reason = "not_ready", check.failure
+		}
+	}
+
+	body := map[string]interface{}{
+		"status":        status,
+		"uptimeSeconds": int(time.Since(s.started).Seconds()),
+		"rooms":         rooms,
+		"broadcasters":  broadcasters,
+		"viewers":       viewers,
+		"checks":        results,
+	}
+	if reason != "" {
+		body["reason"] = reason
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
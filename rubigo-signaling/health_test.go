@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestHealth(t *testing.T) {
+	rec := doRequest(t, newTestServer(t, newFakeStore()), http.MethodGet, "/health", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := decodeBody(t, rec)["status"]; got != "healthy" {
+		t.Errorf("status field = %v, want healthy", got)
+	}
+}
+
+func TestReady(t *testing.T) {
+	t.Run("ready by default", func(t *testing.T) {
+		rec := doRequest(t, newTestServer(t, newFakeStore("a")), http.MethodGet, "/ready", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		body := decodeBody(t, rec)
+		if body["status"] != "ready" || body["rooms"] != float64(1) {
+			t.Errorf("unexpected body: %v", body)
+		}
+	})
+
+	t.Run("not ready during shutdown", func(t *testing.T) {
+		server := newServer(t, newFakeStore(), DefaultConfig())
+		server.BeginShutdown()
+
+		rec := doRequest(t, server.Handler(), http.MethodGet, "/ready", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		// Liveness is unaffected
+		if rec := doRequest(t, server.Handler(), http.MethodGet, "/health", ""); rec.Code != http.StatusOK {
+			t.Errorf("health status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("not ready above room limit", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.ReadyMaxRooms = 1
+		server := newServer(t, newFakeStore("a", "b"), cfg)
+
+		rec := doRequest(t, server.Handler(), http.MethodGet, "/ready", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		if got := decodeBody(t, rec)["reason"]; got != "room limit exceeded" {
+			t.Errorf("reason = %v", got)
+		}
+	})
+
+	t.Run("not ready at the connection cap", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.MaxRooms = 2
+		cfg.MaxPeerConnections = 1
+		store := newFakeStore("a")
+		if err := store.Get("a").AddViewer(&viewer{track: newLiveTrack(t)}); err != nil {
+			t.Fatal(err)
+		}
+		server := newServer(t, store, cfg)
+
+		rec := doRequest(t, server.Handler(), http.MethodGet, "/readyz", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		checks := decodeBody(t, rec)["checks"].(map[string]interface{})
+		if checks["accepting"] != "ok" || checks["capacity"] != "connection cap reached" || checks["udp"] != "ok" {
+			t.Errorf("checks = %v", checks)
+		}
+	})
+
+	t.Run("not ready without a free UDP port", func(t *testing.T) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+		cfg := DefaultConfig()
+		cfg.Peer.UDPPortMin, cfg.Peer.UDPPortMax = port, port
+		server := newServer(t, newFakeStore(), cfg)
+
+		rec := doRequest(t, server.Handler(), http.MethodGet, "/readyz", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		if reason, _ := decodeBody(t, rec)["reason"].(string); !strings.HasPrefix(reason, "no free UDP port") {
+			t.Errorf("reason = %q", reason)
+		}
+	})
+
+	t.Run("not ready without the cluster registry", func(t *testing.T) {
+		redis := miniredis.RunT(t)
+		server, _ := newClusterServer(t, redis, "a", "http://sfu-a:37003", false)
+		if rec := doRequest(t, server.Handler(), http.MethodGet, "/readyz", ""); rec.Code != http.StatusOK {
+			t.Fatalf("status with Redis up = %d: %s", rec.Code, rec.Body)
+		}
+
+		redis.Close()
+		rec := doRequest(t, server.Handler(), http.MethodGet, "/readyz", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		checks := decodeBody(t, rec)["checks"].(map[string]interface{})
+		if cluster, _ := checks["cluster"].(string); !strings.HasPrefix(cluster, "room registry unreachable") {
+			t.Errorf("cluster check = %q", cluster)
+		}
+		// Liveness is unaffected
+		if rec := doRequest(t, server.Handler(), http.MethodGet, "/healthz", ""); rec.Code != http.StatusOK {
+			t.Errorf("healthz status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	h := newTestServer(t, newFakeStore("abc"))
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/drain", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("drain status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if body := decodeBody(t, rec); body["draining"] != true || body["rooms"] != float64(1) {
+		t.Errorf("unexpected drain body: %v", body)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/ready", "")
+	if rec.Code != http.StatusServiceUnavailable || decodeBody(t, rec)["reason"] != "draining" {
+		t.Errorf("ready while draining = %d %s", rec.Code, rec.Body)
+	}
+	for _, path := range []string{"/internal/room", "/internal/room/new/publish"} {
+		if rec := doRequest(t, h, http.MethodPost, path, `{"roomId":"new"}`); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("POST %s while draining = %d, want %d", path, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+	// Existing rooms keep working
+	if rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""); decodeBody(t, rec)["exists"] != true {
+		t.Errorf("status while draining: %s", rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/undrain", "")
+	if body := decodeBody(t, rec); body["draining"] != false {
+		t.Errorf("unexpected undrain body: %v", body)
+	}
+	if rec := doRequest(t, h, http.MethodGet, "/ready", ""); rec.Code != http.StatusOK {
+		t.Errorf("ready after undrain = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"new"}`); rec.Code != http.StatusOK {
+		t.Errorf("create after undrain = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if rec := doRequest(t, h, http.MethodGet, "/internal/drain", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /internal/drain = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// HLS egress serves a room's broadcast to large passive audiences, for whom
+// a WebRTC connection each is more than they need. The broadcaster's media
+// is reassembled as for recording and piped as WebM into an ffmpeg process,
+// which transcodes it to H.264 and AAC and writes fMP4 parts in
+// HLSConfig.Dir/{roomId}. They are served as low-latency HLS at
+// /hls/{roomId}/index.m3u8, with one-second segments (see llhls.go). Rooms
+// turn it on with POST /internal/room/{id}/hls and off with DELETE.
+//
+// Packaging never holds up forwarding: the forwarder queues packets for a
+// goroutine of the egress's own, which feeds ffmpeg and starts and stops
+// its runs, and a packager too slow for the queue loses packets instead.
+
+// HLSConfig configures HLS egress
+type HLSConfig struct {
+	// Dir holds each room's playlist and segments; empty disables HLS
+	Dir string
+	// FFmpeg is the ffmpeg binary that packages the stream
+	FFmpeg string
+}
+
+const (
+	hlsPlaylist = "index.m3u8"
+	// How long ffmpeg gets to finish the playlist once its input ends
+	hlsStopTimeout = 5 * time.Second
+	// How many packets may wait for the packager; more are dropped
+	hlsQueueSize = 512
+)
+
+var (
+	errHLSStarted = errors.New("room already has HLS egress")
+	errNoHLS      = errors.New("room has no HLS egress")
+)
+
+// hlsFileName matches the files served for a room
+var hlsFileName = regexp.MustCompile(`^[A-Za-z0-9_-]+\.(m3u8|m4s|mp4)$`)
+
+// hlsEgress is a room's HLS packaging. Its recorder writes a WebM stream
+// to each ffmpeg run; a run ends, and the next starts on a keyframe, when
+// the broadcaster's video ends and comes back.
+type hlsEgress struct {
+	rec      *Recorder
+	ffmpeg   string
+	playlist *llhlsPlaylist
+
+	queue   chan hlsItem
+	quit    chan struct{} // closed by stop
+	exited  chan struct{} // closed when run returns
+	dropped atomic.Int64  // packets dropped since run last looked
+
+	// Used only by run, which open is called on
+	runs        int // ffmpeg runs so far, naming each run's segments
+	dropLog     logThrottle
+	writeErrors logThrottle
+
+	runMu sync.Mutex
+	cmd   *exec.Cmd     // the latest run
+	done  chan struct{} // closed when the latest run exits; nil before the first
+}
+
+// hlsItem is a packet waiting for the packager, or with no packet the end
+// of a track
+type hlsItem struct {
+	kind   webrtc.RTPCodecType
+	codec  webrtc.RTPCodecParameters
+	packet *rtp.Packet
+}
+
+// newHLSEgress packages rec's stream with ffmpeg, once run is started
+func newHLSEgress(rec *Recorder, ffmpeg string) *hlsEgress {
+	logger := roomLog(rec.roomID)
+	h := &hlsEgress{
+		rec:         rec,
+		ffmpeg:      ffmpeg,
+		playlist:    newLLHLSPlaylist(rec.dir),
+		queue:       make(chan hlsItem, hlsQueueSize),
+		quit:        make(chan struct{}),
+		exited:      make(chan struct{}),
+		dropLog:     logThrottle{logger: logger, interval: forwardErrorLogInterval},
+		writeErrors: logThrottle{logger: logger, interval: forwardErrorLogInterval},
+	}
+	rec.open = h.open
+	return h
+}
+
+// WriteRTP queues a packet read from the broadcaster's track for the
+// packager, dropping it if the queue is full
+func (h *hlsEgress) WriteRTP(kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters, packet *rtp.Packet) {
+	// The caller reuses packet for its next read
+	select {
+	case h.queue <- hlsItem{kind: kind, codec: codec, packet: packet.Clone()}:
+	default:
+		h.dropped.Add(1)
+	}
+}
+
+// CloseTrack queues the end of one media kind's track
+func (h *hlsEgress) CloseTrack(kind webrtc.RTPCodecType) {
+	item := hlsItem{kind: kind}
+	select {
+	case h.queue <- item:
+	default:
+		// Losing the end would leave the packager waiting on the
+		// track, but the forwarder mustn't wait either
+		go func() {
+			select {
+			case h.queue <- item:
+			case <-h.quit:
+			}
+		}()
+	}
+}
+
+// run feeds queued packets to the recorder until stop, then closes it.
+// What is still queued then is dropped rather than start another run.
+func (h *hlsEgress) run() {
+	defer close(h.exited)
+	for {
+		select {
+		case <-h.quit:
+			h.rec.Close()
+			return
+		default:
+		}
+		select {
+		case item := <-h.queue:
+			h.write(item)
+		case <-h.quit:
+		}
+	}
+}
+
+// write hands one queued item to the recorder
+func (h *hlsEgress) write(item hlsItem) {
+	if n := h.dropped.Swap(0); n > 0 {
+		h.dropLog.Warn("HLS packager fell behind; dropped packets", "dropped", n)
+		// The gap breaks the video until its next keyframe
+		if h.rec.requestKeyframe != nil {
+			h.rec.requestKeyframe()
+		}
+	}
+	if item.packet == nil {
+		h.rec.CloseTrack(item.kind)
+		return
+	}
+	if err := h.rec.WriteRTP(item.kind, item.codec, item.packet); err != nil {
+		h.writeErrors.Warn("HLS packaging write failed", "err", err)
+	}
+}
+
+// hlsArgs are ffmpeg's arguments for run, packaging WebM from stdin into
+// parts in dir. Each run appends to the parts playlist after a
+// discontinuity.
+func hlsArgs(dir string, run int) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "webm", "-i", "pipe:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+		// Regular keyframes for segments to start on
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%g)", hlsKeyframeInterval.Seconds()),
+		"-c:a", "aac", "-b:a", "128k",
+		// Parts are cut by time, keyframe or not; a part is only listed
+		// once it is written in full
+		"-f", "hls", "-hls_time", fmt.Sprintf("%g", hlsPartTarget.Seconds()), "-hls_list_size", "40",
+		"-hls_segment_type", "fmp4",
+		"-hls_flags", "delete_segments+append_list+discont_start+split_by_time+temp_file",
+		"-hls_fmp4_init_filename", fmt.Sprintf("init-%d.mp4", run),
+		"-hls_segment_filename", filepath.Join(dir, fmt.Sprintf("part-%d-%%d.m4s", run)),
+		filepath.Join(dir, hlsPartsPlaylist),
+	}
+}
+
+// open starts an ffmpeg run, returning its stdin. Closing that ends the
+// run, which is killed if it hasn't finished within hlsStopTimeout.
+func (h *hlsEgress) open() (io.WriteCloser, error) {
+	// The previous run has its EOF; let it finish the playlist first
+	h.runMu.Lock()
+	previous := h.done
+	h.runMu.Unlock()
+	if previous != nil {
+		select {
+		case <-previous:
+		case <-time.After(hlsStopTimeout):
+		}
+	}
+	h.runs++
+	logger := roomLog(h.rec.roomID).With("run", h.runs)
+	cmd := exec.Command(h.ffmpeg, hlsArgs(h.rec.dir, h.runs)...)
+	cmd.Stderr = logWriter{logger}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	done := make(chan struct{})
+	h.runMu.Lock()
+	h.cmd, h.done = cmd, done
+	h.runMu.Unlock()
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Warn("HLS packager exited", "err", err)
+		}
+		close(done)
+	}()
+	logger.Info("HLS packager started")
+	return &hlsInput{WriteCloser: stdin, cmd: cmd, done: done}, nil
+}
+
+// hlsInput is an ffmpeg run's stdin
+type hlsInput struct {
+	io.WriteCloser
+	cmd  *exec.Cmd
+	done <-chan struct{}
+}
+
+// Close ends the input without waiting for ffmpeg to finish
+func (in *hlsInput) Close() error {
+	err := in.WriteCloser.Close()
+	if errors.Is(err, os.ErrClosed) {
+		// The run has exited, and Wait closed it
+		err = nil
+	}
+	go func() {
+		select {
+		case <-in.done:
+		case <-time.After(hlsStopTimeout):
+			in.cmd.Process.Kill()
+		}
+	}()
+	return err
+}
+
+// stop ends the packaging, waits for ffmpeg and removes the room's files
+func (h *hlsEgress) stop() {
+	close(h.quit)
+	for exited := false; !exited; {
+		select {
+		case <-h.exited:
+			exited = true
+		case <-time.After(hlsStopTimeout):
+			// run is stuck writing to a run that stopped reading;
+			// killing it fails the write
+			h.runMu.Lock()
+			if h.cmd != nil {
+				h.cmd.Process.Kill()
+			}
+			h.runMu.Unlock()
+		}
+	}
+	h.runMu.Lock()
+	done := h.done
+	h.runMu.Unlock()
+	if done != nil {
+		// A run that won't finish is killed after hlsStopTimeout
+		<-done
+	}
+	if err := os.RemoveAll(h.rec.dir); err != nil {
+		roomLog(h.rec.roomID).Error("Failed to remove HLS files", "err", err)
+	}
+}
+
+// logWriter logs each write, such as a line of a child process's stderr
+type logWriter struct {
+	logger *slog.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Warn("HLS packager", "output", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// StartHLS packages the room as HLS into dir with ffmpeg
+func (r *Room) StartHLS(dir, ffmpeg string) (*hlsEgress, error) {
+	r.mu.Lock()
+	if r.hls != nil {
+		r.mu.Unlock()
+		return nil, errHLSStarted
+	}
+	rec, err := NewRecorder(r.id, dir, 0, r.requestRecordingKeyframe)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	h := newHLSEgress(rec, ffmpeg)
+	r.hls = h
+	r.mu.Unlock()
+	go h.run()
+
+	roomLog(r.id).Info("HLS egress started")
+	// Start the first run now rather than at the next periodic keyframe
+	r.requestRecordingKeyframe()
+	return h, nil
+}
+
+// StopHLS ends the room's HLS egress and removes its files
+func (r *Room) StopHLS() error {
+	r.mu.Lock()
+	h := r.hls
+	r.hls = nil
+	r.mu.Unlock()
+
+	if h == nil {
+		return errNoHLS
+	}
+	h.stop()
+	roomLog(r.id).Info("HLS egress stopped")
+	return nil
+}
+
+// GetHLS returns the room's HLS egress, nil if it has none
+func (r *Room) GetHLS() *hlsEgress {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.hls
+}
+
+// hlsPlaylistPath is where players fetch roomID's playlist
+func hlsPlaylistPath(roomID string) string {
+	return "/hls/" + roomID + "/" + hlsPlaylist
+}
+
+// handleHLSWithID handles POST and DELETE /internal/room/{id}/hls
+// POST starts HLS egress and returns the playlist's path, DELETE stops it
+func (s *Server) handleHLSWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	if s.cfg.HLS.Dir == "" {
+		writeError(w, http.StatusNotImplemented, errCodeHLSDisabled, "HLS egress is not enabled")
+		return
+	}
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := room.StopHLS(); err != nil {
+			writeError(w, http.StatusConflict, errCodeNoHLS, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopped", "roomId": roomID})
+		return
+	}
+
+	if _, err := room.StartHLS(filepath.Join(s.cfg.HLS.Dir, roomID), s.cfg.HLS.FFmpeg); err != nil {
+		if errors.Is(err, errHLSStarted) {
+			writeError(w, http.StatusConflict, errCodeHLSStarted, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to start HLS egress: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":   "started",
+		"roomId":   roomID,
+		"playlist": hlsPlaylistPath(roomID),
+	})
+}
+
+// handleHLS handles GET /hls/{roomId}/{file}
+// Serves the playlist and segments of rooms with HLS egress
+func (s *Server) handleHLS(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	if len(parts) != 2 || !s.validRoomID(parts[0]) || !hlsFileName.MatchString(parts[1]) {
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown HLS resource")
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	roomID, name := parts[0], parts[1]
+	var h *hlsEgress
+	if room := s.rooms.Get(roomID); room != nil {
+		h = room.GetHLS()
+	}
+	if h == nil {
+		writeError(w, http.StatusNotFound, errCodeNoHLS, "Room has no HLS egress")
+		return
+	}
+
+	if name == hlsPlaylist {
+		s.serveHLSPlaylist(w, r, h)
+		return
+	}
+	if m := hlsSegmentName.FindStringSubmatch(name); m != nil {
+		msn, _ := strconv.Atoi(m[1])
+		s.serveHLSSegment(w, r, h, msn)
+		return
+	}
+	switch filepath.Ext(name) {
+	case ".m3u8":
+		// Only the playlist built from ffmpeg's is for players
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown HLS resource")
+		return
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	default:
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	http.ServeFile(w, r, filepath.Join(s.cfg.HLS.Dir, roomID, name))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// fakeFFmpeg writes a script standing in for ffmpeg: it writes a playlist
+// where ffmpeg would and copies its input to the returned path
+func fakeFFmpeg(t *testing.T) (ffmpeg, input string) {
+	t.Helper()
+	dir := t.TempDir()
+	ffmpeg, input = filepath.Join(dir, "ffmpeg"), filepath.Join(dir, "input.webm")
+	script := "#!/bin/sh\nfor playlist; do :; done\necho '#EXTM3U' > \"$playlist\"\ncat >> " + input + "\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return ffmpeg, input
+}
+
+// feedHLS sends h a few VP8 frames, starting with a keyframe
+func feedHLS(t *testing.T, h *hlsEgress) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		h.WriteRTP(webrtc.RTPCodecTypeVideo, recordVP8, vp8Packet(uint16(i), uint32(i)*3000, i == 0))
+	}
+}
+
+// waitForFile waits for path to be written
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not written", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHLSEgress(t *testing.T) {
+	ffmpeg, input := fakeFFmpeg(t)
+	dir := filepath.Join(t.TempDir(), "abc")
+	room := &Room{id: "abc"}
+	h, err := room.StartHLS(dir, ffmpeg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.StartHLS(dir, ffmpeg); !errors.Is(err, errHLSStarted) {
+		t.Errorf("second StartHLS = %v, want errHLSStarted", err)
+	}
+
+	feedHLS(t, h)
+	waitForFile(t, filepath.Join(dir, hlsPartsPlaylist))
+	if err := room.StopHLS(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("HLS files left behind: %v", err)
+	}
+	if err := room.StopHLS(); !errors.Is(err, errNoHLS) {
+		t.Errorf("second StopHLS = %v, want errNoHLS", err)
+	}
+
+	// ffmpeg was fed WebM with the broadcaster's video
+	elems := readRecording(t, input)
+	if codecs := ebmlFind(elems, mkvCodecIDID); len(codecs) == 0 || string(codecs[0]) != "V_VP8" {
+		t.Errorf("codecs = %q, want V_VP8 first", codecs)
+	}
+	if blocks := ebmlFind(elems, mkvSimpleBlockID); len(blocks) == 0 {
+		t.Error("no frames reached ffmpeg")
+	}
+}
+
+func TestHLSStuckPackager(t *testing.T) {
+	// An ffmpeg that never reads its input
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\nexec sleep 60\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	room := &Room{id: "abc"}
+	h, err := room.StartHLS(filepath.Join(t.TempDir(), "abc"), ffmpeg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Video until ffmpeg's pipe and then the queue fill up, none of it
+	// waiting on ffmpeg
+	padding := make([]byte, 1200)
+	seq := uint16(0)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.queue) < hlsQueueSize || h.dropped.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue never filled: %d queued, %d dropped", len(h.queue), h.dropped.Load())
+		}
+		start := time.Now()
+		for i := 0; i < hlsQueueSize; i++ {
+			packet := vp8Packet(seq, uint32(seq)*3000, seq == 0)
+			packet.Payload = append(packet.Payload, padding...)
+			h.WriteRTP(webrtc.RTPCodecTypeVideo, recordVP8, packet)
+			seq++
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("writing took %v", elapsed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	h.CloseTrack(webrtc.RTPCodecTypeVideo)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ending the track took %v", elapsed)
+	}
+
+	// Stopping kills the run that won't read
+	if err := room.StopHLS(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHLSEndpoints(t *testing.T) {
+	ffmpeg, _ := fakeFFmpeg(t)
+	store := newFakeStore("abc")
+	cfg := DefaultConfig()
+	cfg.HLS = HLSConfig{Dir: t.TempDir(), FFmpeg: ffmpeg}
+	h := newServer(t, store, cfg).Handler()
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/hls", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/hls", ""); rec.Code != http.StatusConflict {
+		t.Errorf("second start = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	feedHLS(t, store.Get("abc").GetHLS())
+	waitForFile(t, filepath.Join(cfg.HLS.Dir, "abc", hlsPartsPlaylist))
+	rec = doRequest(t, h, http.MethodGet, hlsPlaylistPath("abc"), "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Errorf("playlist = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := doRequest(t, h, http.MethodGet, hlsPlaylistPath("abc")+"?_HLS_part=1", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("playlist with _HLS_part alone = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	for _, path := range []string{"/hls/abc/input.webm", "/hls/nope/index.m3u8", "/hls/abc/" + hlsPartsPlaylist, "/hls/abc/seg-0.m4s"} {
+		if rec := doRequest(t, h, http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+
+	if rec := doRequest(t, h, http.MethodDelete, "/internal/room/abc/hls", ""); rec.Code != http.StatusOK {
+		t.Fatalf("stop = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodGet, hlsPlaylistPath("abc"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("playlist after stop = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, "/internal/room/abc/hls", ""); rec.Code != http.StatusConflict {
+		t.Errorf("second stop = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestHLSDisabled(t *testing.T) {
+	h := newTestServer(t, newFakeStore("abc"))
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/hls", "")
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("start = %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+	decodeError(t, rec, errCodeHLSDisabled)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// iceServerFlag is a repeatable flag.Value taking one ICE server, or an
+// array of them, as JSON in the shape room creation accepts, e.g.
+// {"urls":["turn:turn.example.com:3478"],"username":"u","credential":"p"}
+type iceServerFlag struct {
+	servers *[]webrtc.ICEServer
+}
+
+func (f iceServerFlag) String() string {
+	if f.servers == nil || len(*f.servers) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(*f.servers)
+	return string(data)
+}
+
+func (f iceServerFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
+	var servers []webrtc.ICEServer
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &servers); err != nil {
+			return err
+		}
+	} else {
+		var server webrtc.ICEServer
+		if err := json.Unmarshal([]byte(value), &server); err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	*f.servers = append(*f.servers, servers...)
+	return nil
+}
+
+// validateConfiguredICEServers is validateICEServers for the server's own
+// ICE servers, whose TURN credentials may be generated from a TURN secret
+func validateConfiguredICEServers(servers []webrtc.ICEServer, turnSecret string) error {
+	if turnSecret == "" {
+		return validateICEServers(servers)
+	}
+	withCredentials := turnRESTServers(servers, turnSecret, "check", time.Now())
+	return validateICEServers(withCredentials)
+}
+
+// isTURN reports whether server has a TURN URL
+func isTURN(server webrtc.ICEServer) bool {
+	for _, raw := range server.URLs {
+		if u, err := ice.ParseURL(raw); err == nil && (u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS) {
+			return true
+		}
+	}
+	return false
+}
+
+// turnRESTCredentials returns time-limited TURN credentials as the TURN
+// REST API draft defines them: the username is the expiry as a Unix time
+// and user, the credential its HMAC-SHA1 under the secret the TURN server
+// shares (coturn's static-auth-secret)
+func turnRESTCredentials(secret, user string, expires time.Time) (username, credential string) {
+	username = strconv.FormatInt(expires.Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnRESTServers copies servers, giving TURN servers without credentials
+// ones for user that expire at expires
+func turnRESTServers(servers []webrtc.ICEServer, secret, user string, expires time.Time) []webrtc.ICEServer {
+	out := make([]webrtc.ICEServer, len(servers))
+	copy(out, servers)
+	for i, server := range out {
+		if server.Username == "" && isTURN(server) {
+			out[i].Username, out[i].Credential = turnRESTCredentials(secret, user, expires)
+			out[i].CredentialType = webrtc.ICECredentialTypePassword
+		}
+	}
+	return out
+}
+
+// serversFor returns servers with TURN REST credentials for user filled
+// in, when the factory has a TURN secret
+func (f *peerFactory) serversFor(servers []webrtc.ICEServer, user string) []webrtc.ICEServer {
+	if f.turnSecret == "" {
+		return servers
+	}
+	return turnRESTServers(servers, f.turnSecret, user, time.Now().Add(f.turnTTL))
+}
+
+// handleICEServers handles GET /internal/ice-servers
+// Returns the configured ICE servers with fresh TURN credentials, for
+// clients to connect with; ?user= names them in the TURN username
+func (s *Server) handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		user = "rubigo"
+	}
+
+	body := map[string]interface{}{
+		"iceServers": s.peers.serversFor(s.peers.iceServers, user),
+	}
+	if s.peers.turnSecret != "" {
+		body["ttl"] = int(s.peers.turnTTL.Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestICEServerFlag(t *testing.T) {
+	var servers []webrtc.ICEServer
+	f := iceServerFlag{&servers}
+	if err := f.Set(`{"urls":["stun:stun.example.com"]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set(` [{"urls":["turn:a.example.com"],"username":"u","credential":"p"},{"urls":["turn:b.example.com"]}]`); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 || servers[1].Username != "u" || servers[2].URLs[0] != "turn:b.example.com" {
+		t.Errorf("servers = %+v", servers)
+	}
+	if err := f.Set(`turn:a.example.com`); err == nil {
+		t.Error("bare URL accepted; want JSON")
+	}
+}
+
+func TestTURNRESTCredentials(t *testing.T) {
+	username, credential := turnRESTCredentials("north", "abc", time.Unix(1700000000, 0))
+	if username != "1700000000:abc" || credential != "g5HTmCBrPDhYXFpM/1dHUtfE+c4=" {
+		t.Errorf("credentials = %q, %q", username, credential)
+	}
+
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.com"}},
+		{URLs: []string{"turn:turn.example.com:3478"}},
+		{URLs: []string{"turns:static.example.com"}, Username: "fixed", Credential: "pass"},
+	}
+	filled := turnRESTServers(servers, "north", "abc", time.Unix(1700000000, 0))
+	if filled[0].Username != "" {
+		t.Error("STUN server was given credentials")
+	}
+	if filled[1].Username != "1700000000:abc" || filled[1].Credential != "g5HTmCBrPDhYXFpM/1dHUtfE+c4=" {
+		t.Errorf("TURN server = %+v", filled[1])
+	}
+	if filled[2].Username != "fixed" {
+		t.Error("TURN server's own credentials were replaced")
+	}
+	if servers[1].Username != "" {
+		t.Error("configured servers were modified")
+	}
+
+	// TURN without credentials is only valid with a secret to make them
+	if err := validateConfiguredICEServers(servers[1:2], ""); err == nil {
+		t.Error("TURN server without credentials or secret accepted")
+	}
+	if err := validateConfiguredICEServers(servers[1:2], "north"); err != nil {
+		t.Errorf("TURN server with secret: %v", err)
+	}
+}
+
+func TestHandleICEServers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Peer.ICEServers = []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}}}
+	cfg.Peer.TURNSecret = "north"
+	cfg.Peer.TURNCredentialTTL = time.Hour
+	h := newServer(t, newFakeStore(), cfg).Handler()
+
+	rec := doRequest(t, h, http.MethodGet, "/internal/ice-servers?user=alice", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var body struct {
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
+		TTL        int                `json:"ttl"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.TTL != 3600 || len(body.ICEServers) != 1 {
+		t.Fatalf("body = %+v", body)
+	}
+	expiry, user, _ := strings.Cut(body.ICEServers[0].Username, ":")
+	if unix, err := strconv.ParseInt(expiry, 10, 64); err != nil || user != "alice" || unix <= time.Now().Unix() {
+		t.Errorf("username = %q, want a future expiry and alice", body.ICEServers[0].Username)
+	}
+	if body.ICEServers[0].Credential == nil || body.ICEServers[0].Credential == "" {
+		t.Error("no credential generated")
+	}
+
+	if rec := doRequest(t, h, http.MethodPost, "/internal/ice-servers", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// A client whose network changes mid-session, e.g. a laptop moving from
+// WiFi to Ethernet, restarts ICE on its existing connection rather than
+// publishing or subscribing again. It creates an offer with
+// {iceRestart: true}, sends it with PATCH to /internal/room/{id}/publish
+// (with its peerId if a co-presenter) or /internal/room/{id}/subscribe
+// (with its viewerId), and applies the answer. The connection's tracks,
+// and the room's wiring of them to viewers, are left as they are. The
+// restart has to arrive before the connection fails; a viewer whose
+// connection has failed resubscribes with its reconnect token instead.
+
+// isICERestart reports whether offer has ICE credentials other than the
+// ones pc's remote is using
+func isICERestart(pc *webrtc.PeerConnection, offer string) (bool, error) {
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return false, nil
+	}
+	// Parsed here rather than with SessionDescription.Unmarshal, which
+	// caches the result in the description pion shares
+	var desc, remoteDesc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return false, err
+	}
+	if err := remoteDesc.Unmarshal([]byte(remote.SDP)); err != nil {
+		return false, err
+	}
+	ufrag, _ := iceCredentials(&desc)
+	current, _ := iceCredentials(&remoteDesc)
+	return ufrag != "" && ufrag != current, nil
+}
+
+// restartICE answers an ICE restart offer on pc, which is left open
+// whatever happens, and writes the answer
+func (s *Server) restartICE(w http.ResponseWriter, r *http.Request, pc *webrtc.PeerConnection, offer SDPExchange, logger *slog.Logger) {
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		writeError(w, http.StatusConflict, errCodeRenegotiating, "Connection is renegotiating")
+		return
+	}
+	restart, err := isICERestart(pc, offer.SDP)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Invalid offer: %v", err))
+		return
+	}
+	if !restart {
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, "Offer does not restart ICE")
+		return
+	}
+
+	gatherComplete, err := s.answerOffer(r.Context(), pc, offer.SDP, nil)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return
+	}
+	logger.Info("Restarted ICE")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SDPExchange{
+		Type:     "answer",
+		SDP:      pc.LocalDescription().SDP,
+		ViewerID: offer.ViewerID,
+		PeerID:   offer.PeerID,
+	})
+}
+
+// handlePublishRestart handles PATCH /internal/room/{id}/publish
+// The broadcaster, or the co-presenter with peerId, restarts ICE
+func (s *Server) handlePublishRestart(w http.ResponseWriter, r *http.Request, roomID string) {
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	if !room.CheckPassword(offer.Password) {
+		writeError(w, http.StatusForbidden, errCodeInvalidPassword, "Invalid room password")
+		return
+	}
+	pc, logger := room.BroadcasterPC(), room.broadcasterLog()
+	if offer.PeerID != "" {
+		pc, logger = room.PresenterPC(offer.PeerID), room.presenterLog(offer.PeerID)
+	}
+	if pc == nil {
+		writeError(w, http.StatusConflict, errCodeNoBroadcaster, "No broadcaster in room")
+		return
+	}
+	s.restartICE(w, r, pc, offer, logger)
+}
+
+// handleSubscribeRestart handles PATCH /internal/room/{id}/subscribe
+// The viewer with viewerId restarts ICE
+func (s *Server) handleSubscribeRestart(w http.ResponseWriter, r *http.Request, roomID string) {
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+	if offer.ViewerID == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "viewerId required")
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	v := room.Viewer(offer.ViewerID)
+	if v == nil {
+		writeError(w, http.StatusNotFound, errCodeViewerNotFound, "Viewer not found")
+		return
+	}
+
+	// Hold off SFU offers for new tracks until the restart is answered
+	if !v.claimNegotiation() {
+		writeError(w, http.StatusConflict, errCodeRenegotiating, "Connection is renegotiating")
+		return
+	}
+	defer func() {
+		if v.releaseNegotiation() {
+			go func() {
+				if err := v.offer(); err != nil {
+					room.viewerLog(v.id).Error("Failed to renegotiate with viewer", "err", err)
+				}
+			}()
+		}
+	}()
+	s.restartICE(w, r, v.pc, offer, room.viewerLog(v.id))
+}
+
+// claimNegotiation marks the viewer as negotiating on its own offer, false
+// if an SFU offer is awaiting its answer
+func (v *viewer) claimNegotiation() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.negotiating {
+		return false
+	}
+	v.negotiating = true
+	return true
+}
+
+// releaseNegotiation ends a claimNegotiation, reporting whether an SFU
+// offer was queued meanwhile and should be sent now
+func (v *viewer) releaseNegotiation() (again bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.negotiating = false
+	again, v.renegotiate = v.renegotiate, false
+	return again
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// exchangeSDP sends offer to path with method and applies the answer to
+// client, returning it
+func exchangeSDP(t *testing.T, h http.Handler, client *webrtc.PeerConnection, method, path string, offer SDPExchange) SDPExchange {
+	t.Helper()
+	body, _ := json.Marshal(offer)
+	rec := doRequest(t, h, method, path, string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s %s = %d: %s", method, path, rec.Code, rec.Body)
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	return answer
+}
+
+func TestBroadcasterICERestart(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTrack(sending); err != nil {
+		t.Fatal(err)
+	}
+	offer := SDPExchange{Type: "offer", SDP: gatheredOffer(t, client, nil)}
+	if rec := doRequest(t, h, http.MethodPatch, "/internal/room/abc/publish", `{"type":"offer","sdp":"v=0"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("restart in a missing room = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	exchangeSDP(t, h, client, http.MethodPost, "/internal/room/abc/publish", offer)
+	waitConnected(t, client)
+	room := store.Get("abc")
+	pc := room.BroadcasterPC()
+
+	// The offer already applied is no restart
+	body, _ := json.Marshal(offer)
+	rec := doRequest(t, h, http.MethodPatch, "/internal/room/abc/publish", string(body))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("PATCH without new credentials = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	decodeError(t, rec, errCodeInvalidSDP)
+
+	restart := SDPExchange{Type: "offer", SDP: gatheredOffer(t, client, &webrtc.OfferOptions{ICERestart: true})}
+	exchangeSDP(t, h, client, http.MethodPatch, "/internal/room/abc/publish", restart)
+	waitConnected(t, client)
+	if room.BroadcasterPC() != pc {
+		t.Error("ICE restart replaced the broadcaster connection")
+	}
+	var remote, local sdp.SessionDescription
+	if err := remote.Unmarshal([]byte(client.RemoteDescription().SDP)); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Unmarshal([]byte(pc.LocalDescription().SDP)); err != nil {
+		t.Fatal(err)
+	}
+	ufrag, _ := iceCredentials(&remote)
+	if serving, _ := iceCredentials(&local); ufrag != serving {
+		t.Errorf("client has ufrag %q, SFU serves %q", ufrag, serving)
+	}
+}
+
+func TestViewerICERestart(t *testing.T) {
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	h := newTestServer(t, store)
+
+	client := newTestPC(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createControlChannel(client); err != nil {
+		t.Fatal(err)
+	}
+	answer := exchangeSDP(t, h, client, http.MethodPost, "/internal/room/abc/subscribe", SDPExchange{Type: "offer", SDP: gatheredOffer(t, client, nil)})
+	waitConnected(t, client)
+	v := room.Viewer(answer.ViewerID)
+	if v == nil {
+		t.Fatalf("viewer %q not in room", answer.ViewerID)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		body     string
+		wantCode int
+		wantErr  string
+	}{
+		{"no viewer ID", `{"type":"offer","sdp":"v=0"}`, http.StatusBadRequest, errCodeInvalidRequest},
+		{"unknown viewer", `{"type":"offer","sdp":"v=0","viewerId":"nobody"}`, http.StatusNotFound, errCodeViewerNotFound},
+	} {
+		rec := doRequest(t, h, http.MethodPatch, "/internal/room/abc/subscribe", tt.body)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: PATCH = %d, want %d", tt.name, rec.Code, tt.wantCode)
+			continue
+		}
+		decodeError(t, rec, tt.wantErr)
+	}
+
+	restart := SDPExchange{Type: "offer", SDP: gatheredOffer(t, client, &webrtc.OfferOptions{ICERestart: true}), ViewerID: v.id}
+	body, _ := json.Marshal(restart)
+
+	// Not while an SFU offer awaits the viewer's answer
+	v.claimNegotiation()
+	if rec := doRequest(t, h, http.MethodPatch, "/internal/room/abc/subscribe", string(body)); rec.Code != http.StatusConflict {
+		t.Errorf("PATCH during renegotiation = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	v.releaseNegotiation()
+
+	answer = exchangeSDP(t, h, client, http.MethodPatch, "/internal/room/abc/subscribe", restart)
+	if answer.ViewerID != v.id {
+		t.Errorf("answer viewerId = %q, want %q", answer.ViewerID, v.id)
+	}
+	waitConnected(t, client)
+	if room.Viewer(v.id) != v || room.ViewerCount() != 1 {
+		t.Error("ICE restart replaced the viewer")
+	}
+}
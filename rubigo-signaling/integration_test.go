@@ -0,0 +1,139 @@
+//go:build integration
+
+// End-to-end tests over real HTTP and real pion peer connections, covering
+// the path from the broadcaster's track to a viewer's receiver that the
+// handler tests stub out. They need loopback UDP and wait on real ICE and
+// DTLS, so they only build with the integration tag:
+//
+//	go test -tags integration -run Integration ./...
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"rubigo-signaling/client"
+)
+
+func TestIntegrationPublishSubscribe(t *testing.T) {
+	store := NewRoomManager()
+	server := httptest.NewServer(newServer(t, store, DefaultConfig()).Handler())
+	defer server.Close()
+	ctx := context.Background()
+	sfu := client.New(server.URL)
+	if err := sfu.CreateRoom(ctx, "it", client.RoomOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broadcaster sends synthetic VP8 and Opus streams until the test
+	// ends, as a screen share with tab audio would
+	screen, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcaster, err := sfu.PublishTrack(ctx, "it", client.PublishOptions{}, screen, audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broadcaster.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			// A VP8 payload descriptor starting a keyframe partition
+			screen.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 1800},
+				Payload: []byte{0x10, 0x00, 0x9d, 0x01, 0x2a},
+			})
+			audio.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+				Payload: []byte{0xfc, 0xff, 0xfe},
+			})
+		}
+	}()
+
+	room := store.Get("it")
+	deadline := time.Now().Add(10 * time.Second)
+	for room.GetBroadcasterTrack() == nil || room.AudioTrack() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("broadcaster tracks = %+v, want video and audio", room.Tracks())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The viewer should receive what the broadcaster sends
+	viewer, err := sfu.Subscribe(ctx, "it", client.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	if viewer.Answer.ViewerID == "" {
+		t.Error("subscribe answer has no viewer ID")
+	}
+	received := map[webrtc.RTPCodecType]chan *rtp.Packet{
+		webrtc.RTPCodecTypeVideo: make(chan *rtp.Packet, 1),
+		webrtc.RTPCodecTypeAudio: make(chan *rtp.Packet, 1),
+	}
+	go func() {
+		for {
+			var remote *webrtc.TrackRemote
+			select {
+			case remote = <-viewer.Tracks():
+			case <-viewer.Done():
+				return
+			}
+			go func() {
+				ch := received[remote.Kind()]
+				for {
+					pkt, _, err := remote.ReadRTP()
+					if err != nil {
+						return
+					}
+					select {
+					case ch <- pkt:
+					default:
+					}
+				}
+			}()
+		}
+	}()
+
+	for kind, want := range map[webrtc.RTPCodecType][]byte{
+		webrtc.RTPCodecTypeVideo: {0x10, 0x00, 0x9d, 0x01, 0x2a},
+		webrtc.RTPCodecTypeAudio: {0xfc, 0xff, 0xfe},
+	} {
+		select {
+		case pkt := <-received[kind]:
+			if !bytes.Equal(pkt.Payload, want) {
+				t.Errorf("viewer got %s payload %x, want the broadcaster's", kind, pkt.Payload)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s RTP reached the viewer", kind)
+		}
+	}
+	if n := room.ViewerCount(); n != 1 {
+		t.Errorf("ViewerCount = %d, want 1", n)
+	}
+	if _, out := room.Traffic(); out == 0 {
+		t.Error("no egress accounted for the viewer")
+	}
+}
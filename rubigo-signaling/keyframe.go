@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// A viewer whose decoder hits a corrupt frame asks for a keyframe with a
+// PLI or FIR. The SFU can't produce one itself, so the request is passed
+// upstream as a PLI for the broadcaster track the viewer receives.
+
+// keyframeRequestInterval caps how often viewers' requests for one track
+// reach the broadcaster. A keyframe already on its way serves every viewer
+// that asked for it.
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// wantsKeyframe reports whether pkts include a keyframe request
+func wantsKeyframe(pkts []rtcp.Packet) bool {
+	for _, pkt := range pkts {
+		switch pkt.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+	return false
+}
+
+// claimKeyframeRequest reports whether a keyframe request for the track may
+// go upstream at now, and if so records it
+func (f *forwardingTrack) claimKeyframeRequest(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.lastKeyframeRequest.IsZero() && now.Sub(f.lastKeyframeRequest) < keyframeRequestInterval {
+		return false
+	}
+	f.lastKeyframeRequest = now
+	return true
+}
+
+// RequestKeyframe sends the broadcaster, or the co-presenter publishing
+// track, a PLI for the source of track. Requests closer together than
+// keyframeRequestInterval are dropped. It fails with errNoBroadcaster if
+// the track has no live source.
+func (r *Room) RequestKeyframe(track *forwardingTrack) error {
+	pc := r.publisherPC(track)
+	source := track.Source()
+	if pc == nil || source == nil {
+		return errNoBroadcaster
+	}
+	if !track.claimKeyframeRequest(time.Now()) {
+		return nil
+	}
+	return pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(source.SSRC())}})
+}
+
+// keyframeRequester returns the readRTCP callback for a viewer of track
+func keyframeRequester(room *Room, track *forwardingTrack) func() {
+	return func() {
+		// Without a broadcaster the viewer gets a keyframe when it returns
+		if err := room.RequestKeyframe(track); err != nil && !errors.Is(err, errNoBroadcaster) {
+			roomLog(room.id).Error("Failed to forward keyframe request", "err", err)
+		}
+	}
+}
+
+// requestJoinKeyframe asks the broadcaster for a keyframe of the video v
+// receives. A viewer that has just connected can't decode until one
+// arrives, and the periodic PLIs may be seconds away.
+func (r *Room) requestJoinKeyframe(v *viewer) {
+	track := v.track
+	if v.simulcast != nil {
+		track = v.simulcast.Current()
+	}
+	if err := r.RequestKeyframe(track); err != nil && !errors.Is(err, errNoBroadcaster) {
+		r.viewerLog(v.id).Error("Failed to request keyframe for new viewer", "err", err)
+	}
+}
+
+// publishedKeyframeRequester is keyframeRequester for a published track,
+// or nil for audio, which has no keyframes
+func publishedKeyframeRequester(room *Room, track *forwardingTrack) func() {
+	if track.Kind() != webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+	return keyframeRequester(room, track)
+}
+
+// readRTCP reads RTCP from a viewer until its sender closes. NACKs are
+// answered from the history of track, if set, and the interceptors act on
+// the rest of the feedback as it passes through, so this loop must keep
+// running. onKeyframe, if set, is called whenever the viewer asks for a
+// keyframe.
+func readRTCP(sender *webrtc.RTPSender, track *forwardingTrack, onKeyframe func()) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if onKeyframe != nil && wantsKeyframe(pkts) {
+			onKeyframe()
+		}
+		if ssrc, lost := nackedSequences(pkts); track != nil && len(lost) > 0 {
+			if _, err := track.Retransmit(ssrc, lost); err != nil {
+				slog.Debug("Failed to retransmit", "err", err)
+			}
+		}
+	}
+}
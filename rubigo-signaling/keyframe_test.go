@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWantsKeyframe(t *testing.T) {
+	tests := []struct {
+		name string
+		pkts []rtcp.Packet
+		want bool
+	}{
+		{"pli", []rtcp.Packet{&rtcp.ReceiverReport{}, &rtcp.PictureLossIndication{}}, true},
+		{"fir", []rtcp.Packet{&rtcp.FullIntraRequest{}}, true},
+		{"reports only", []rtcp.Packet{&rtcp.ReceiverReport{}, &rtcp.TransportLayerNack{}}, false},
+	}
+	for _, tt := range tests {
+		if got := wantsKeyframe(tt.pkts); got != tt.want {
+			t.Errorf("%s: wantsKeyframe = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClaimKeyframeRequestThrottles(t *testing.T) {
+	track := newLiveTrack(t)
+	now := time.Now()
+	if !track.claimKeyframeRequest(now) {
+		t.Fatal("first request refused")
+	}
+	if track.claimKeyframeRequest(now.Add(keyframeRequestInterval / 2)) {
+		t.Error("request within the interval went through")
+	}
+	if !track.claimKeyframeRequest(now.Add(keyframeRequestInterval)) {
+		t.Error("request after the interval refused")
+	}
+}
+
+// newKeyframeTestRoom returns a room whose broadcaster, over a real
+// connection, is sending track, and the SSRCs of the PLIs it receives
+func newKeyframeTestRoom(t *testing.T) (*Room, *forwardingTrack, <-chan uint32) {
+	t.Helper()
+	sfu, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sfu.Close() })
+	broadcaster, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broadcaster.Close() })
+
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := broadcaster.AddTrack(sending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plis := make(chan uint32, 10)
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				if pli, ok := pkt.(*rtcp.PictureLossIndication); ok {
+					plis <- pli.MediaSSRC
+				}
+			}
+		}
+	}()
+
+	room := &Room{id: "abc"}
+	room.SetBroadcaster(sfu, nil, "")
+	attached := make(chan *forwardingTrack, 1)
+	sfu.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		track, _, err := room.AttachBroadcasterSource(sfu, remote)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		attached <- track
+	})
+	negotiate(t, broadcaster, sfu)
+
+	var track *forwardingTrack
+	for seq := uint16(0); track == nil; seq++ {
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		select {
+		case track = <-attached:
+		case <-time.After(10 * time.Millisecond):
+		}
+		if seq > 500 {
+			t.Fatal("broadcaster track never arrived")
+		}
+	}
+	return room, track, plis
+}
+
+func TestRoomRequestKeyframeReachesBroadcaster(t *testing.T) {
+	room, track, plis := newKeyframeTestRoom(t)
+	if err := room.RequestKeyframe(track); err != nil {
+		t.Fatal(err)
+	}
+	// Another viewer asking straight after is served by the same keyframe
+	if err := room.RequestKeyframe(track); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ssrc := <-plis:
+		if want := uint32(track.Source().SSRC()); ssrc != want {
+			t.Errorf("PLI for SSRC %d, want %d", ssrc, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcaster got no PLI")
+	}
+	select {
+	case <-plis:
+		t.Error("throttled request still reached the broadcaster")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRequestJoinKeyframe(t *testing.T) {
+	room, track, plis := newKeyframeTestRoom(t)
+	room.requestJoinKeyframe(&viewer{id: "v1", track: track})
+	select {
+	case ssrc := <-plis:
+		if want := uint32(track.Source().SSRC()); ssrc != want {
+			t.Errorf("PLI for SSRC %d, want %d", ssrc, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcaster got no PLI for the new viewer")
+	}
+
+	// Without a broadcaster the viewer waits for it to return
+	room.ClearBroadcaster(room.BroadcasterPC())
+	room.requestJoinKeyframe(&viewer{id: "v2", track: track})
+}
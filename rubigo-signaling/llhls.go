@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Low-latency HLS. ffmpeg cuts the stream into parts of about
+// hlsPartTarget, splitting by time rather than on keyframes, and lists them
+// in its own playlist, hlsPartsPlaylist. The playlist players get,
+// hlsPlaylist, is built from that: parts are grouped into segments that
+// start on keyframes, each served as its parts back to back, and the
+// latest segments also list their parts, which LL-HLS players fetch with
+// blocking playlist reloads as soon as ffmpeg has written them. Players
+// without LL-HLS ignore the parts and play the segments.
+
+const (
+	// hlsPartsPlaylist is ffmpeg's playlist of parts, not served
+	hlsPartsPlaylist = "parts.m3u8"
+	// hlsPartTarget is how long ffmpeg makes each part
+	hlsPartTarget = 200 * time.Millisecond
+	// hlsKeyframeInterval is how often ffmpeg makes a keyframe, and so how
+	// long a segment runs
+	hlsKeyframeInterval = time.Second
+	// hlsMaxSegment ends a segment without a keyframe to start the next on
+	hlsMaxSegment = 2 * hlsKeyframeInterval
+	// hlsTargetDuration is the playlist's target duration, in whole
+	// seconds: hlsMaxSegment rounded
+	hlsTargetDuration = 2
+	// hlsPartWindow is how near the end a segment must be for the playlist
+	// to list its parts
+	hlsPartWindow = 3 * hlsTargetDuration * time.Second
+	// hlsBlockTimeout is how long a blocking reload waits for its part
+	hlsBlockTimeout = 3 * hlsTargetDuration * time.Second
+	// hlsRefreshInterval is how often ffmpeg's playlist is reread
+	hlsRefreshInterval = 50 * time.Millisecond
+)
+
+var (
+	errHLSPartTimeout = errors.New("requested part not available in time")
+	errHLSPartTooFar  = errors.New("requested segment is too far ahead of the playlist")
+)
+
+var (
+	// hlsPartName matches ffmpeg's parts, named for the run they are from
+	hlsPartName = regexp.MustCompile(`^part-(\d+)-\d+\.m4s$`)
+	// hlsSegmentName matches segments, named for their media sequence
+	// number
+	hlsSegmentName = regexp.MustCompile(`^seg-(\d+)\.m4s$`)
+)
+
+// hlsPart is one of ffmpeg's parts
+type hlsPart struct {
+	name        string
+	duration    time.Duration
+	independent bool // starts on a keyframe
+}
+
+// hlsSegment is a run of parts served together
+type hlsSegment struct {
+	msn           int
+	run           int // the ffmpeg run its parts are from
+	discontinuity bool
+	parts         []hlsPart
+	complete      bool // a later part has started the next segment
+}
+
+func (s *hlsSegment) duration() time.Duration {
+	var d time.Duration
+	for _, part := range s.parts {
+		d += part.duration
+	}
+	return d
+}
+
+// llhlsPlaylist builds a room's playlist from ffmpeg's parts in dir
+type llhlsPlaylist struct {
+	dir string
+
+	mu              sync.Mutex
+	refreshed       time.Time
+	segments        []*hlsSegment
+	nextMSN         int
+	lastRun         int
+	lastPart        string
+	discontinuities int           // discontinuities before the first segment
+	partTarget      time.Duration // the longest part so far
+	videoTracks     map[int]fmp4Track
+}
+
+// fmp4Track is an init segment's video track
+type fmp4Track struct {
+	id           uint32
+	defaultFlags uint32
+}
+
+func newLLHLSPlaylist(dir string) *llhlsPlaylist {
+	return &llhlsPlaylist{dir: dir, partTarget: hlsPartTarget, videoTracks: make(map[int]fmp4Track)}
+}
+
+// parsePartsPlaylist lists the parts in ffmpeg's playlist, oldest first
+func parsePartsPlaylist(data []byte) []hlsPart {
+	var parts []hlsPart
+	var duration time.Duration
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			seconds, _ := strconv.ParseFloat(value, 64)
+			duration = time.Duration(seconds * float64(time.Second))
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			parts = append(parts, hlsPart{name: line, duration: duration})
+			duration = 0
+		}
+	}
+	return parts
+}
+
+// refreshLocked picks up the parts ffmpeg has written and forgets those it
+// has deleted, at most once per hlsRefreshInterval. The caller must hold
+// p.mu.
+func (p *llhlsPlaylist) refreshLocked() {
+	if time.Since(p.refreshed) < hlsRefreshInterval {
+		return
+	}
+	p.refreshed = time.Now()
+	data, err := os.ReadFile(filepath.Join(p.dir, hlsPartsPlaylist))
+	if err != nil {
+		// ffmpeg hasn't written a part yet
+		return
+	}
+	listed := parsePartsPlaylist(data)
+
+	present := make(map[string]bool, len(listed))
+	for _, part := range listed {
+		present[part.name] = true
+	}
+	for len(p.segments) > 0 && !p.segments[0].in(present) {
+		if p.segments[0].discontinuity {
+			p.discontinuities++
+		}
+		p.segments = p.segments[1:]
+	}
+
+	// Parts after the last one added are new. Without it, ffmpeg's list
+	// has moved on entirely and all of them are.
+	next := 0
+	for i, part := range listed {
+		if part.name == p.lastPart {
+			next = i + 1
+		}
+	}
+	for _, part := range listed[next:] {
+		m := hlsPartName.FindStringSubmatch(part.name)
+		if m == nil {
+			continue
+		}
+		run, _ := strconv.Atoi(m[1])
+		part.independent = p.independent(run, part.name)
+		p.add(run, part)
+	}
+}
+
+// in reports whether all of s's parts are in present
+func (s *hlsSegment) in(present map[string]bool) bool {
+	for _, part := range s.parts {
+		if !present[part.name] {
+			return false
+		}
+	}
+	return true
+}
+
+// add appends a new part from run, starting a segment on it if it is a
+// keyframe far enough into the current one, the current one has run too
+// long, or it starts a new run
+func (p *llhlsPlaylist) add(run int, part hlsPart) {
+	var current *hlsSegment
+	if n := len(p.segments); n > 0 && p.lastRun == run {
+		current = p.segments[n-1]
+	}
+	if current == nil || current.duration() >= hlsMaxSegment ||
+		(part.independent && current.duration() >= hlsKeyframeInterval/2) {
+		if n := len(p.segments); n > 0 {
+			p.segments[n-1].complete = true
+		}
+		current = &hlsSegment{msn: p.nextMSN, run: run, discontinuity: p.lastPart != "" && p.lastRun != run}
+		p.nextMSN++
+		p.segments = append(p.segments, current)
+	}
+	current.parts = append(current.parts, part)
+	p.lastRun, p.lastPart = run, part.name
+	if part.duration > p.partTarget {
+		// Rounded up, as the playlist gives it to the millisecond
+		p.partTarget = (part.duration + time.Millisecond - 1).Truncate(time.Millisecond)
+	}
+}
+
+// independent reports whether a part of run starts on a video keyframe
+func (p *llhlsPlaylist) independent(run int, name string) bool {
+	track, ok := p.videoTracks[run]
+	if !ok {
+		init, err := os.ReadFile(filepath.Join(p.dir, fmt.Sprintf("init-%d.mp4", run)))
+		if err != nil {
+			return false
+		}
+		if track.id, track.defaultFlags, ok = fmp4VideoTrack(init); !ok {
+			return false
+		}
+		p.videoTracks[run] = track
+	}
+	fragment, err := os.ReadFile(filepath.Join(p.dir, name))
+	return err == nil && fmp4StartsWithSync(fragment, track.id, track.defaultFlags)
+}
+
+// hasLocked reports whether the playlist has segment msn complete or, with
+// part set, that part of it, or anything later. The caller must hold p.mu.
+func (p *llhlsPlaylist) hasLocked(msn, part int) bool {
+	for _, s := range p.segments {
+		switch {
+		case s.msn > msn:
+			// Segment msn is complete, or long gone
+			return true
+		case s.msn == msn && (s.complete || (part >= 0 && part < len(s.parts))):
+			return true
+		}
+	}
+	return false
+}
+
+// renderLocked writes the playlist. The caller must hold p.mu.
+func (p *llhlsPlaylist) renderLocked() []byte {
+	var b bytes.Buffer
+	first := p.nextMSN
+	if len(p.segments) > 0 {
+		first = p.segments[0].msn
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:%d\n", hlsTargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", p.partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*p.partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", first, p.discontinuities)
+
+	// Only the latest segments list their parts
+	parts, tail := len(p.segments), time.Duration(0)
+	for parts > 0 && tail < hlsPartWindow {
+		parts--
+		tail += p.segments[parts].duration()
+	}
+	run := -1
+	for i, s := range p.segments {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if s.run != run {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", s.run)
+			run = s.run
+		}
+		if i >= parts {
+			for _, part := range s.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.duration.Seconds(), part.name)
+				if part.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if s.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg-%d.m4s\n", s.duration().Seconds(), s.msn)
+		}
+	}
+	return b.Bytes()
+}
+
+// Playlist returns the playlist. With msn set it is a blocking reload,
+// waiting until the playlist has segment msn, or with part set that part
+// of it; it fails with errHLSPartTimeout after hlsBlockTimeout, and at
+// once with errHLSPartTooFar for a segment more than two past the last.
+func (p *llhlsPlaylist) Playlist(ctx context.Context, msn, part int) ([]byte, error) {
+	deadline := time.NewTimer(hlsBlockTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(hlsRefreshInterval)
+	defer tick.Stop()
+	for {
+		p.mu.Lock()
+		p.refreshLocked()
+		if msn < 0 || p.hasLocked(msn, part) {
+			playlist := p.renderLocked()
+			p.mu.Unlock()
+			return playlist, nil
+		}
+		// nextMSN is the one after the segment in progress
+		tooFar := msn > p.nextMSN
+		p.mu.Unlock()
+		if tooFar {
+			return nil, errHLSPartTooFar
+		}
+
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			return nil, errHLSPartTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Segment returns segment msn, its parts back to back
+func (p *llhlsPlaylist) Segment(msn int) ([]byte, bool) {
+	p.mu.Lock()
+	var names []string
+	for _, s := range p.segments {
+		if s.msn == msn && s.complete {
+			for _, part := range s.parts {
+				names = append(names, part.name)
+			}
+		}
+	}
+	p.mu.Unlock()
+	if names == nil {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(p.dir, name))
+		if err != nil {
+			// ffmpeg has deleted it since
+			return nil, false
+		}
+		b.Write(data)
+	}
+	return b.Bytes(), true
+}
+
+// parseBlockingReload reads a playlist request's _HLS_msn and _HLS_part,
+// -1 for each when absent
+func parseBlockingReload(query url.Values) (msn, part int, err error) {
+	msn, part = -1, -1
+	if v := query.Get("_HLS_msn"); v != "" {
+		if msn, err = strconv.Atoi(v); err != nil || msn < 0 {
+			return 0, 0, errors.New("_HLS_msn must be a media sequence number")
+		}
+	}
+	if v := query.Get("_HLS_part"); v != "" {
+		if msn < 0 {
+			return 0, 0, errors.New("_HLS_part requires _HLS_msn")
+		}
+		if part, err = strconv.Atoi(v); err != nil || part < 0 {
+			return 0, 0, errors.New("_HLS_part must be a part index")
+		}
+	}
+	return msn, part, nil
+}
+
+// serveHLSPlaylist serves h's playlist, blocking for the requested part on
+// a blocking reload
+func (s *Server) serveHLSPlaylist(w http.ResponseWriter, r *http.Request, h *hlsEgress) {
+	msn, part, err := parseBlockingReload(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	playlist, err := h.playlist.Playlist(r.Context(), msn, part)
+	switch {
+	case errors.Is(err, errHLSPartTooFar):
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	case errors.Is(err, errHLSPartTimeout):
+		writeError(w, http.StatusServiceUnavailable, errCodeHLSPartTimeout, err.Error())
+		return
+	case err != nil:
+		// The player went away
+		return
+	}
+	// Players poll the live playlist
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(playlist)
+}
+
+// serveHLSSegment serves one of h's segments
+func (s *Server) serveHLSSegment(w http.ResponseWriter, r *http.Request, h *hlsEgress, msn int) {
+	data, ok := h.playlist.Segment(msn)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown HLS resource")
+		return
+	}
+	w.Header().Set("Content-Type", "video/iso.segment")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParts stands in for ffmpeg writing parts into a room's HLS dir
+type testParts struct {
+	t     *testing.T
+	dir   string
+	names []string
+}
+
+// add writes a 200ms part of run, starting with a keyframe if sync is
+// set, and lists it
+func (p *testParts) add(run, n int, sync bool) {
+	p.t.Helper()
+	init := filepath.Join(p.dir, fmt.Sprintf("init-%d.mp4", run))
+	if _, err := os.Stat(init); err != nil {
+		if err := os.WriteFile(init, testInit(0), 0o644); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+	name := fmt.Sprintf("part-%d-%d.m4s", run, n)
+	if err := os.WriteFile(filepath.Join(p.dir, name), testFragment(sync), 0o644); err != nil {
+		p.t.Fatal(err)
+	}
+	p.names = append(p.names, name)
+	p.write()
+}
+
+// drop deletes the oldest n parts, as ffmpeg does as they age
+func (p *testParts) drop(n int) {
+	p.t.Helper()
+	for _, name := range p.names[:n] {
+		os.Remove(filepath.Join(p.dir, name))
+	}
+	p.names = p.names[n:]
+	p.write()
+}
+
+func (p *testParts) write() {
+	p.t.Helper()
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:0\n")
+	for _, name := range p.names {
+		fmt.Fprintf(&b, "#EXTINF:0.200000,\n%s\n", name)
+	}
+	if err := os.WriteFile(filepath.Join(p.dir, hlsPartsPlaylist), []byte(b.String()), 0o644); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// render returns the playlist as it is now
+func render(t *testing.T, p *llhlsPlaylist) string {
+	t.Helper()
+	p.mu.Lock()
+	p.refreshed = time.Time{}
+	p.mu.Unlock()
+	playlist, err := p.Playlist(context.Background(), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(playlist)
+}
+
+// wantLines checks playlist has each of lines
+func wantLines(t *testing.T, playlist string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(playlist, line+"\n") {
+			t.Errorf("playlist has no %q:\n%s", line, playlist)
+		}
+	}
+}
+
+func TestLLHLSPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	parts := &testParts{t: t, dir: dir}
+	p := newLLHLSPlaylist(dir)
+	if playlist := render(t, p); !strings.HasPrefix(playlist, "#EXTM3U\n") || strings.Contains(playlist, "#EXT-X-PART:") {
+		t.Errorf("playlist before any parts:\n%s", playlist)
+	}
+
+	// Keyframes a second apart start segments
+	for i := 0; i < 7; i++ {
+		parts.add(1, i, i%5 == 0)
+	}
+	playlist := render(t, p)
+	wantLines(t, playlist,
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-PART-INF:PART-TARGET=0.200",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.600",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		`#EXT-X-MAP:URI="init-1.mp4"`,
+		`#EXT-X-PART:DURATION=0.200,URI="part-1-0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.200,URI="part-1-4.m4s"`,
+		"#EXTINF:1.000,\nseg-0.m4s",
+		`#EXT-X-PART:DURATION=0.200,URI="part-1-5.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.200,URI="part-1-6.m4s"`,
+	)
+	// The segment in progress has no URI yet
+	if strings.Contains(playlist, "seg-1.m4s") {
+		t.Errorf("incomplete segment listed:\n%s", playlist)
+	}
+
+	want := testFragment(true)
+	for i := 1; i < 5; i++ {
+		want = append(want, testFragment(false)...)
+	}
+	if segment, ok := p.Segment(0); !ok || !bytes.Equal(segment, want) {
+		t.Errorf("segment 0 = %d bytes, %v; want its 5 parts", len(segment), ok)
+	}
+	if _, ok := p.Segment(1); ok {
+		t.Error("served the segment in progress")
+	}
+
+	// A new run is a discontinuity with its own init segment, and parts
+	// ffmpeg deletes take their segments with them
+	parts.add(2, 0, true)
+	parts.drop(3)
+	playlist = render(t, p)
+	wantLines(t, playlist,
+		"#EXT-X-MEDIA-SEQUENCE:1",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:0",
+		"#EXTINF:0.400,\nseg-1.m4s",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-2.mp4\"",
+		`#EXT-X-PART:DURATION=0.200,URI="part-2-0.m4s",INDEPENDENT=YES`,
+	)
+	if strings.Contains(playlist, "seg-0.m4s") {
+		t.Errorf("deleted segment listed:\n%s", playlist)
+	}
+}
+
+func TestLLHLSLongSegment(t *testing.T) {
+	dir := t.TempDir()
+	parts := &testParts{t: t, dir: dir}
+	p := newLLHLSPlaylist(dir)
+	// Without keyframes, segments still end
+	for i := 0; i < 12; i++ {
+		parts.add(1, i, i == 0)
+	}
+	wantLines(t, render(t, p), "#EXTINF:2.000,\nseg-0.m4s")
+}
+
+func TestLLHLSBlockingReload(t *testing.T) {
+	dir := t.TempDir()
+	parts := &testParts{t: t, dir: dir}
+	p := newLLHLSPlaylist(dir)
+	parts.add(1, 0, true)
+
+	if _, err := p.Playlist(context.Background(), 5, -1); !errors.Is(err, errHLSPartTooFar) {
+		t.Errorf("reload far ahead = %v, want errHLSPartTooFar", err)
+	}
+
+	// Part 1 of segment 0 isn't written yet
+	result := make(chan string)
+	go func() {
+		playlist, err := p.Playlist(context.Background(), 0, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- string(playlist)
+	}()
+	select {
+	case <-result:
+		t.Fatal("reload returned before its part")
+	case <-time.After(3 * hlsRefreshInterval):
+	}
+	parts.add(1, 1, false)
+	select {
+	case playlist := <-result:
+		wantLines(t, playlist, `#EXT-X-PART:DURATION=0.200,URI="part-1-1.m4s"`)
+	case <-time.After(time.Second):
+		t.Fatal("reload never returned")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Playlist(ctx, 1, -1); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled reload = %v, want context.Canceled", err)
+	}
+}
+
+func TestParseBlockingReload(t *testing.T) {
+	tests := []struct {
+		query     string
+		msn, part int
+		ok        bool
+	}{
+		{"", -1, -1, true},
+		{"_HLS_msn=3", 3, -1, true},
+		{"_HLS_msn=3&_HLS_part=2", 3, 2, true},
+		{"_HLS_part=2", 0, 0, false},
+		{"_HLS_msn=-1", 0, 0, false},
+		{"_HLS_msn=3&_HLS_part=x", 0, 0, false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		msn, part, err := parseBlockingReload(query)
+		if msn != tt.msn || part != tt.part || (err == nil) != tt.ok {
+			t.Errorf("parseBlockingReload(%q) = %d, %d, %v", tt.query, msn, part, err)
+		}
+	}
+}
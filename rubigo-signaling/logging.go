@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v4"
+)
+
+// levelTrace is below slog's debug level, for pion's per-packet tracing
+const levelTrace = slog.LevelDebug - 4
+
+// parseLogLevel parses a --log-level value: trace, debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return levelTrace, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want trace, debug, info, warn or error)", s)
+}
+
+// newLogHandler returns a handler writing format, text or json, to w
+func newLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// fatalf logs an error and exits, like log.Fatalf
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// roomLog returns the logger for events in roomID
+func roomLog(roomID string) *slog.Logger {
+	return slog.With("roomId", roomID)
+}
+
+// peerLog returns the logger for events on one peer's connection, with
+// role broadcaster or viewer
+func peerLog(roomID, role, peerID string) *slog.Logger {
+	return slog.With("roomId", roomID, "role", role, "peerId", peerID)
+}
+
+// logSDP logs the offer and answer pc negotiated, at debug level
+func logSDP(logger *slog.Logger, pc *webrtc.PeerConnection) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if remote := pc.RemoteDescription(); remote != nil {
+		logger.Debug("Remote SDP", "type", remote.Type.String(), "sdp", remote.SDP)
+	}
+	if local := pc.LocalDescription(); local != nil {
+		logger.Debug("Local SDP", "type", local.Type.String(), "sdp", local.SDP)
+	}
+}
+
+// logICE logs pc's local ICE candidates and the candidate pair it selects,
+// at debug level
+func logICE(logger *slog.Logger, pc *webrtc.PeerConnection) {
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			logger.Debug("Local ICE candidate", "candidate", c.String())
+		}
+	})
+	if sctp := pc.SCTP(); sctp != nil {
+		sctp.Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+			logger.Debug("Selected ICE candidate pair", "local", pair.Local.String(), "remote", pair.Remote.String())
+		})
+	}
+}
+
+// pionLoggerFactory hands pion loggers that write to an slog.Logger. Each
+// pion subsystem (ice, dtls, sctp, ...) is tagged with its scope.
+type pionLoggerFactory struct {
+	logger *slog.Logger
+}
+
+func (f pionLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return &pionLogger{logger: f.logger.With("scope", scope)}
+}
+
+// pionLogger maps pion's levels onto slog. pion's info and warn messages
+// are connection diagnostics rather than operational events, so they are
+// logged at debug; only its errors appear at the default level.
+type pionLogger struct {
+	logger *slog.Logger
+}
+
+func (l *pionLogger) log(level slog.Level, msg string) {
+	l.logger.Log(context.Background(), level, msg)
+}
+
+func (l *pionLogger) logf(level slog.Level, format string, args ...interface{}) {
+	// Skip formatting for levels that are filtered out
+	if l.logger.Enabled(context.Background(), level) {
+		l.log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *pionLogger) Trace(msg string)                  { l.log(levelTrace, msg) }
+func (l *pionLogger) Tracef(f string, a ...interface{}) { l.logf(levelTrace, f, a...) }
+func (l *pionLogger) Debug(msg string)                  { l.log(slog.LevelDebug, msg) }
+func (l *pionLogger) Debugf(f string, a ...interface{}) { l.logf(slog.LevelDebug, f, a...) }
+func (l *pionLogger) Info(msg string)                   { l.log(slog.LevelDebug, msg) }
+func (l *pionLogger) Infof(f string, a ...interface{})  { l.logf(slog.LevelDebug, f, a...) }
+func (l *pionLogger) Warn(msg string)                   { l.log(slog.LevelDebug, msg) }
+func (l *pionLogger) Warnf(f string, a ...interface{})  { l.logf(slog.LevelDebug, f, a...) }
+func (l *pionLogger) Error(msg string)                  { l.log(slog.LevelError, msg) }
+func (l *pionLogger) Errorf(f string, a ...interface{}) { l.logf(slog.LevelError, f, a...) }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want slog.Level
+	}{
+		{"trace", levelTrace},
+		{"debug", slog.LevelDebug},
+		{"", slog.LevelInfo},
+		{"INFO", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	for _, tt := range tests {
+		if got, err := parseLogLevel(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseLogLevel(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Error("parseLogLevel accepted an unknown level")
+	}
+}
+
+func TestPionLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	l := pionLoggerFactory{logger: logger.With("roomId", "abc")}.NewLogger("ice")
+
+	l.Infof("connection state %s", "checking")
+	l.Warn("candidate pair failed")
+	if buf.Len() != 0 {
+		t.Errorf("pion info/warn logged at info level: %q", buf.String())
+	}
+
+	l.Errorf("agent closed: %v", "timeout")
+	out := buf.String()
+	for _, want := range []string{"level=ERROR", `msg="agent closed: timeout"`, "roomId=abc", "scope=ice"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log line %q missing %q", out, want)
+		}
+	}
+}
+
+func TestPeerFactoryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: levelTrace}))
+	factory, err := newPeerFactory(PeerConfig{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	if out := buf.String(); !strings.Contains(out, "roomId=abc") || !strings.Contains(out, "role=viewer") {
+		t.Errorf("pion logs not tagged with room and role: %q", out)
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+	logger.Debug("hidden")
+	logger.Info("Viewer joined", "roomId", "abc")
+	if out := buf.String(); !strings.HasPrefix(out, "{") || !strings.Contains(out, `"roomId":"abc"`) || strings.Contains(out, "hidden") {
+		t.Errorf("json handler wrote %q", out)
+	}
+
+	buf.Reset()
+	if handler, err = newLogHandler(&buf, "", slog.LevelInfo); err != nil {
+		t.Fatal(err)
+	}
+	slog.New(handler).Info("Viewer joined", "roomId", "abc")
+	if out := buf.String(); !strings.Contains(out, `msg="Viewer joined" roomId=abc`) {
+		t.Errorf("text handler wrote %q", out)
+	}
+
+	if _, err := newLogHandler(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Error("newLogHandler accepted an unknown format")
+	}
+}
+
+func TestPeerLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	peerLog("abc", "viewer", "v1").Info("ICE connection state changed")
+	if out := buf.String(); !strings.Contains(out, "roomId=abc role=viewer peerId=v1") {
+		t.Errorf("peer log line %q missing its context", out)
+	}
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sfu, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfu.Close()
+	if _, err := client.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, client, sfu)
+
+	buf.Reset()
+	logSDP(peerLog("abc", "viewer", "v1"), sfu)
+	out := buf.String()
+	for _, want := range []string{`msg="Remote SDP" roomId=abc role=viewer peerId=v1 type=offer`, `msg="Local SDP"`, "type=answer"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("SDP log %q missing %q", out, want)
+		}
+	}
+
+	// Nothing is logged above debug
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	buf.Reset()
+	logSDP(peerLog("abc", "viewer", "v1"), sfu)
+	if buf.Len() != 0 {
+		t.Errorf("SDP logged at info level: %q", buf.String())
+	}
+}
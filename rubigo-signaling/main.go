@@ -3,458 +3,495 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
-	"github.com/pion/interceptor"
-	"github.com/pion/interceptor/pkg/intervalpli"
-	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-// Global room manager
-var rooms = NewRoomManager()
+// stringList is a flag.Value that collects repeated or comma-separated
+// flags
+type stringList []string
 
-// CORS middleware for development
-func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
-		next(w, r)
 	}
+	return items
 }
 
-// SDPExchange is the request/response format for SDP exchange
-type SDPExchange struct {
-	SDP  string `json:"sdp"`
-	Type string `json:"type"`
+// envBool reads a boolean environment variable, false if unset or invalid
+func envBool(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
 }
 
-// createPeerConnection creates a new peer connection with standard config
-func createPeerConnection() (*webrtc.PeerConnection, error) {
-	// Configure media engine
-	mediaEngine := &webrtc.MediaEngine{}
-	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
-		return nil, fmt.Errorf("failed to register codecs: %w", err)
+// envOr reads an environment variable, def if unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return def
+}
 
-	// Configure interceptors for RTCP handling
-	interceptorRegistry := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
-		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+// envInt reads an integer environment variable, 0 if unset; an invalid
+// value is fatal
+func envInt(key string) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return 0
 	}
-
-	// Add PLI interceptor for keyframe requests
-	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
+	v, err := strconv.Atoi(s)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create PLI interceptor: %w", err)
+		fatalf("Invalid %s: %v", key, err)
 	}
-	interceptorRegistry.Add(intervalPliFactory)
-
-	// Create API with configured engine
-	api := webrtc.NewAPI(
-		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
-	)
+	return v
+}
 
-	// Create peer connection
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+// validateListenAddr checks that addr is a host:port with a usable port.
+// The host may be empty to listen on all interfaces.
+func validateListenAddr(addr string) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
 	}
-
-	return api.NewPeerConnection(config)
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("port must be a number between 0 and 65535")
+	}
+	return nil
 }
 
-// handleCreateRoom handles POST /internal/room
-func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// validateTLSFlags requires --tls-cert and --tls-key together and checks
+// that they form a usable key pair, so a bad path fails at startup
+func validateTLSFlags(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
 	}
-
-	var req struct {
-		RoomID string `json:"roomId"`
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return err
 	}
+	return nil
+}
 
-	if req.RoomID == "" {
-		http.Error(w, "roomId required", http.StatusBadRequest)
-		return
+// newHTTPServer builds the signaling HTTP server. Header and body read
+// timeouts bound slow clients; there is no write timeout because event
+// streams and waiting subscribes are long-lived. HTTP/2 is served over TLS
+// as usual and as cleartext h2c otherwise, so backends can multiplex many
+// short SDP exchanges over one connection.
+func newHTTPServer(addr string, handler http.Handler, readHeaderTimeout, readTimeout, idleTimeout time.Duration) *http.Server {
+	h2 := &http2.Server{IdleTimeout: idleTimeout}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(handler, h2),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       idleTimeout,
 	}
-
-	room := rooms.GetOrCreate(req.RoomID)
-	_ = room // Room created/retrieved
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "roomId": req.RoomID})
+	// Configure TLS HTTP/2 with the same settings; h2c ignores this
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		fatalf("Failed to configure HTTP/2: %v", err)
+	}
+	return server
 }
 
-// handlePublishWithID handles POST /internal/room/{id}/publish
-// Broadcaster sends SDP offer, receives answer
-func handlePublishWithID(w http.ResponseWriter, r *http.Request, roomID string) {
-
-	var offer SDPExchange
-	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+func main() {
+	cfg := DefaultConfig()
+	port := flag.Int("port", 37003, "HTTP server port (ignored if --listen is set)")
+	listen := flag.String("listen", "", "HTTP listen address as host:port (default :37003)")
+	flag.StringVar(&cfg.RecordDir, "record-dir", cfg.RecordDir, "Directory for room recordings")
+	flag.DurationVar(&cfg.RecordSegment, "record-segment", cfg.RecordSegment, "Start a new recording file after this much video (0 for one file per recording)")
+	recordFormat := flag.String("record-format", string(cfg.RecordFormat), "Recording container: webm, or ivf for IVF video and OGG audio files")
+	flag.StringVar(&cfg.HLS.Dir, "hls-dir", os.Getenv("SFU_HLS_DIR"), "Directory for rooms' HLS playlists and segments; empty disables HLS egress (default $SFU_HLS_DIR)")
+	rtmpAddr := flag.String("rtmp-addr", os.Getenv("SFU_RTMP_ADDR"), "Address, e.g. :1935, to accept RTMP publishes to rtmp://host/live/{roomId} on; empty disables RTMP ingest (default $SFU_RTMP_ADDR)")
+	flag.StringVar(&cfg.HLS.FFmpeg, "hls-ffmpeg", envOr("SFU_FFMPEG", cfg.HLS.FFmpeg), "ffmpeg binary that packages HLS (default $SFU_FFMPEG, else ffmpeg)")
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		cfg.Upload.Region = region
+	}
+	flag.StringVar(&cfg.Upload.Bucket, "upload-bucket", cfg.Upload.Bucket, "S3 bucket finished recording files are uploaded to (unset = no uploads)")
+	flag.StringVar(&cfg.Upload.Endpoint, "upload-endpoint", cfg.Upload.Endpoint, "S3-compatible API URL, e.g. http://minio:9000 (default AWS S3 in --upload-region)")
+	flag.StringVar(&cfg.Upload.Region, "upload-region", cfg.Upload.Region, "Region uploads are signed for (default $AWS_REGION, else us-east-1)")
+	flag.StringVar(&cfg.Upload.Prefix, "upload-prefix", cfg.Upload.Prefix, "Object key prefix for uploads; keys are {prefix}{roomId}/{file}")
+	flag.StringVar(&cfg.Upload.AccessKey, "upload-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "Access key for uploads (default $AWS_ACCESS_KEY_ID)")
+	flag.StringVar(&cfg.Upload.SecretKey, "upload-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key for uploads (default $AWS_SECRET_ACCESS_KEY)")
+	flag.DurationVar(&cfg.Upload.Retention, "upload-retention", cfg.Upload.Retention, "Keep uploaded recordings on disk this long (0 = delete once uploaded, negative = keep)")
+	flag.Var((*stringList)(&cfg.CORS.Origins), "cors-origin", "Allowed CORS origins, comma-separated or repeated (default $SFU_CORS_ORIGINS, else *)")
+	flag.Var((*stringList)(&cfg.CORS.Methods), "cors-methods", "Methods CORS preflights allow, comma-separated (default $SFU_CORS_METHODS, else GET, POST, PATCH, DELETE, OPTIONS)")
+	flag.Var((*stringList)(&cfg.CORS.Headers), "cors-headers", "Request headers CORS preflights allow, comma-separated (default $SFU_CORS_HEADERS, else Content-Type, Authorization, If-Match, X-API-Key)")
+	flag.BoolVar(&cfg.CORS.AllowCredentials, "cors-credentials", envBool("SFU_CORS_CREDENTIALS"), "Allow credentialed CORS requests; requires --cors-origin (default $SFU_CORS_CREDENTIALS)")
+	flag.BoolVar(&cfg.CORS.Disabled, "cors-disabled", envBool("SFU_CORS_DISABLED"), "Send no CORS headers, for internal-only deployments browsers don't call (default $SFU_CORS_DISABLED)")
+	flag.IntVar(&cfg.ReadyMaxRooms, "ready-max-rooms", cfg.ReadyMaxRooms, "Report not ready above this many rooms (0 = no limit)")
+	flag.IntVar(&cfg.ReadyMaxConnections, "ready-max-connections", cfg.ReadyMaxConnections, "Report not ready above this many peer connections (0 = no limit)")
+	flag.StringVar(&cfg.JWTSecret, "jwt-secret", os.Getenv("SFU_JWT_SECRET"), "HS256 secret publish and subscribe tokens are signed with (default $SFU_JWT_SECRET)")
+	flag.StringVar(&cfg.JWKSURL, "jwks-url", os.Getenv("SFU_JWKS_URL"), "JWKS URL of the keys RS256/ES256 publish and subscribe tokens are signed with (default $SFU_JWKS_URL)")
+	flag.Var((*stringList)(&cfg.APIKeys.Keys), "api-key", "API key /internal routes accept in X-API-Key, comma-separated or repeated (default $SFU_API_KEYS, unset = open)")
+	flag.StringVar(&cfg.APIKeys.File, "api-keys-file", os.Getenv("SFU_API_KEYS_FILE"), "File of more API keys, one per line, # for comments (default $SFU_API_KEYS_FILE)")
+	flag.Float64Var(&cfg.APIKeys.Rate, "api-key-rate", cfg.APIKeys.Rate, "Requests allowed per second per API key (0 = unlimited)")
+	flag.IntVar(&cfg.APIKeys.Burst, "api-key-burst", cfg.APIKeys.Burst, "Request burst size per API key")
+	flag.StringVar(&cfg.DebugToken, "debug-token", cfg.DebugToken, "Bearer token for /internal/debug endpoints (unset = not served)")
+	flag.IntVar(&cfg.DebugEventBuffer, "debug-events", cfg.DebugEventBuffer, "Recent events kept for /internal/debug/events (0 = off)")
+	flag.StringVar(&cfg.WebhookURL, "webhook-url", cfg.WebhookURL, "URL to POST room lifecycle and connection state events to")
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", os.Getenv("SFU_WEBHOOK_SECRET"), "Secret webhook requests are signed with, HMAC-SHA256 in X-Webhook-Signature (default $SFU_WEBHOOK_SECRET)")
+	flag.IntVar(&cfg.MaxRooms, "max-rooms", cfg.MaxRooms, "Maximum number of rooms (0 = unlimited)")
+	flag.IntVar(&cfg.MaxViewersPerRoom, "max-viewers", cfg.MaxViewersPerRoom, "Maximum viewers per room; rooms may be created with fewer (0 = unlimited)")
+	flag.IntVar(&cfg.MaxPeerConnections, "max-connections", cfg.MaxPeerConnections, "Maximum peer connections across all rooms (0 = unlimited)")
+	nodeID := os.Getenv("SFU_NODE_ID")
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+	flag.StringVar(&cfg.Cluster.RedisURL, "redis-url", os.Getenv("SFU_REDIS_URL"), "Redis URL for cluster mode, e.g. redis://redis:6379/0; rooms are shared between nodes through it (default $SFU_REDIS_URL, unset = single node)")
+	flag.StringVar(&cfg.Cluster.NodeID, "node-id", nodeID, "This node's unique name in the cluster (default $SFU_NODE_ID, else the hostname)")
+	flag.StringVar(&cfg.Cluster.AdvertiseURL, "advertise-url", os.Getenv("SFU_ADVERTISE_URL"), "Base URL other nodes redirect this node's rooms to, e.g. http://sfu-1:37003 (default $SFU_ADVERTISE_URL)")
+	flag.BoolVar(&cfg.Cluster.Redirect, "cluster-redirect", cfg.Cluster.Redirect, "Redirect requests for another node's rooms there with a 307 instead of rejecting them with a 421")
+	flag.DurationVar(&cfg.Cluster.LeaseTTL, "cluster-lease-ttl", cfg.Cluster.LeaseTTL, "How long a room stays assigned to a node that stops renewing it")
+	flag.DurationVar(&cfg.RoomIdleTimeout, "room-idle-timeout", cfg.RoomIdleTimeout, "Delete rooms with no broadcaster or viewers after this long; rooms may set their own (0 = keep them)")
+	flag.Int64Var(&cfg.RoomByteQuota, "room-byte-quota", cfg.RoomByteQuota, "End a room's session after relaying this many bytes in and out (0 = unlimited)")
+	flag.Float64Var(&cfg.QualityLossAlert, "quality-loss-alert", cfg.QualityLossAlert, "Send quality_degraded room events when a track's median viewer loses more than this fraction of packets, and quality_recovered below half of it (0 = off)")
+	flag.Float64Var(&cfg.CreateRate, "create-rate", cfg.CreateRate, "Room creations allowed per second per caller (0 = unlimited)")
+	flag.IntVar(&cfg.CreateBurst, "create-burst", cfg.CreateBurst, "Room creation burst size per caller")
+	flag.Float64Var(&cfg.SDPRate, "sdp-rate", cfg.SDPRate, "Publish and subscribe requests allowed per second per client IP (0 = unlimited)")
+	flag.IntVar(&cfg.SDPBurst, "sdp-burst", cfg.SDPBurst, "Publish and subscribe burst size per caller")
+	flag.Var(iceServerFlag{&cfg.Peer.ICEServers}, "ice-server", `STUN/TURN server as JSON, e.g. {"urls":["turn:turn.example.com:3478"],"username":"u","credential":"p"}; repeatable (default $SFU_ICE_SERVERS, else Google STUN)`)
+	flag.StringVar(&cfg.Peer.TURNSecret, "turn-secret", os.Getenv("SFU_TURN_SECRET"), "TURN REST API shared secret for time-limited credentials on TURN servers without their own (default $SFU_TURN_SECRET)")
+	flag.DurationVar(&cfg.Peer.TURNCredentialTTL, "turn-ttl", cfg.Peer.TURNCredentialTTL, "Lifetime of generated TURN credentials")
+	flag.DurationVar(&cfg.Peer.ICETimeout, "ice-timeout", cfg.Peer.ICETimeout, "Maximum wait for ICE gathering during SDP exchange")
+	flag.DurationVar(&cfg.Peer.ICEDisconnectedTimeout, "ice-disconnected-timeout", cfg.Peer.ICEDisconnectedTimeout, "Silence before a connection is considered disconnected (0 = pion default of 5s)")
+	flag.DurationVar(&cfg.Peer.ICEFailedTimeout, "ice-failed-timeout", cfg.Peer.ICEFailedTimeout, "Further silence before a disconnected connection fails and viewers are removed (0 = pion default of 25s)")
+	flag.BoolVar(&cfg.Peer.DisableNACK, "disable-nack", cfg.Peer.DisableNACK, "Don't retransmit lost packets to viewers")
+	flag.BoolVar(&cfg.Peer.DisablePLI, "disable-pli", cfg.Peer.DisablePLI, "Don't request keyframes from broadcasters every few seconds; viewers' requests still pass")
+	flag.BoolVar(&cfg.Peer.DisableBWE, "disable-bwe", cfg.Peer.DisableBWE, "Don't estimate viewers' bandwidth or lower broadcasters' bitrate to fit it")
+	flag.DurationVar(&cfg.NegotiationTimeout, "negotiation-timeout", cfg.NegotiationTimeout, "Maximum time to apply an offer and create the answer (0 = no limit)")
+	flag.Var((*stringList)(&cfg.Peer.PublicIPs), "public-ip", "Externally reachable IP to advertise in ICE candidates behind 1:1 NAT, or public/private to map one local IP; comma-separated or repeated (default $SFU_PUBLIC_IP)")
+	publicIPCandidate := flag.String("public-ip-candidate", envOr("SFU_PUBLIC_IP_CANDIDATE", "host"), "How --public-ip is advertised: host replaces private addresses, srflx adds server reflexive candidates beside them (default $SFU_PUBLIC_IP_CANDIDATE, else host)")
+	udpMin := flag.Int("udp-min", envInt("SFU_UDP_MIN"), "Lowest UDP port for media (requires --udp-max; default $SFU_UDP_MIN)")
+	udpMax := flag.Int("udp-max", envInt("SFU_UDP_MAX"), "Highest UDP port for media (requires --udp-min; default $SFU_UDP_MAX)")
+	flag.IntVar(&cfg.Peer.MuxPort, "mux-port", envInt("SFU_MUX_PORT"), "Single UDP port shared by all media, instead of --udp-min/--udp-max (default $SFU_MUX_PORT)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves HTTPS when set with --tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file; serves HTTPS when set with --tls-cert")
+	autocertDomains := flag.String("autocert-domains", os.Getenv("SFU_AUTOCERT_DOMAINS"), "Comma-separated domains to serve HTTPS for with certificates from Let's Encrypt (default $SFU_AUTOCERT_DOMAINS)")
+	var autocertCfg AutocertConfig
+	flag.StringVar(&autocertCfg.CacheDir, "autocert-cache", "autocert-cache", "Directory Let's Encrypt certificates and the account key are kept in")
+	flag.StringVar(&autocertCfg.Email, "autocert-email", "", "Contact address given to Let's Encrypt for expiry notices")
+	flag.StringVar(&autocertCfg.HTTPAddr, "autocert-http-addr", "", "Address, e.g. :80, to answer HTTP-01 challenges on and redirect to HTTPS (default TLS-ALPN-01 on the HTTPS port, which must be 443)")
+	flag.StringVar(&autocertCfg.DirectoryURL, "autocert-directory", "", "ACME directory URL (default Let's Encrypt production)")
+	flag.DurationVar(&cfg.BroadcasterTimeout, "broadcaster-timeout", cfg.BroadcasterTimeout, "End a broadcast after this long without RTP (0 = never)")
+	flag.DurationVar(&cfg.ReconnectGrace, "reconnect-grace", cfg.ReconnectGrace, "How long a dropped viewer may resubscribe with its reconnect token (0 = no tokens)")
+	flag.DurationVar(&cfg.BroadcasterGrace, "broadcaster-grace", cfg.BroadcasterGrace, "How long viewers wait for a broadcaster to republish, e.g. after a tab refresh, and its reconnect token stays valid")
+	flag.DurationVar(&cfg.SubscribeWaitTimeout, "subscribe-wait-timeout", cfg.SubscribeWaitTimeout, "Longest a ?wait=true subscribe waits for the broadcaster (0 = no waiting)")
+	flag.DurationVar(&cfg.BitrateLogInterval, "bitrate-log-interval", cfg.BitrateLogInterval, "Log broadcaster inbound bitrate this often, for debugging (0 = off)")
+	flag.IntVar(&cfg.RTPBufferSize, "rtp-buffer-size", cfg.RTPBufferSize, "Read buffer per broadcaster track; must fit the largest RTP packet")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-sdp-bytes", cfg.MaxBodyBytes, "Maximum request body size for create, publish and subscribe")
+	codecs := flag.String("codecs", "", "Comma-separated codecs to offer, e.g. vp8,opus (default all)")
+	flag.Var((*stringList)(&cfg.CodecPolicy.Prefer), "codec-prefer", "Codecs to ask broadcasters for first, e.g. av1,vp9 (default $SFU_CODEC_PREFER)")
+	flag.Var((*stringList)(&cfg.CodecPolicy.Allow), "codec-allow", "The only codecs broadcasters may send of the kinds listed (default $SFU_CODEC_ALLOW, else all)")
+	flag.Var((*stringList)(&cfg.CodecPolicy.Deny), "codec-deny", "Codecs broadcasters may not send, e.g. h264 (default $SFU_CODEC_DENY)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "Maximum time to read request headers")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Maximum time to read a whole request")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "How long idle keep-alive connections are kept open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Time allowed for in-flight requests on shutdown")
+	logLevel := flag.String("log-level", "info", "Log verbosity: trace, debug, info, warn or error; debug adds SDP, ICE candidates and pion's ICE/DTLS diagnostics")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP URL trace spans are exported to, e.g. http://collector:4318/v1/traces (default $OTEL_EXPORTER_OTLP_ENDPOINT, else no tracing)")
+	roomIDPattern := flag.String("room-id-pattern", defaultRoomIDPattern, "Regular expression room IDs must match; anchor it with ^ and $")
+	configPath := flag.String("config", os.Getenv("SFU_CONFIG"), "YAML or JSON file of flag values; the command line and environment take precedence, and SIGHUP reloads --log-level, --webhook-url and --cors-origin from it (default $SFU_CONFIG)")
+	flag.Parse()
+	var reloader *configReloader
+	if *configPath != "" {
+		reloader = newConfigReloader(flag.CommandLine, *configPath)
+		if err := applyConfigFile(flag.CommandLine, *configPath); err != nil {
+			fatalf("Invalid config file: %v", err)
+		}
+	}
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fatalf("Invalid environment: %v", err)
 	}
 
-	room := rooms.GetOrCreate(roomID)
-
-	// Create peer connection for broadcaster
-	pc, err := createPeerConnection()
+	parsedLevel, err := parseLogLevel(*logLevel)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create peer connection: %v", err), http.StatusInternalServerError)
-		return
+		fatalf("Invalid --log-level: %v", err)
 	}
-
-	// Add transceiver to receive video
-	if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to add transceiver: %v", err), http.StatusInternalServerError)
-		return
+	// A variable, so a reload can change it
+	level := new(slog.LevelVar)
+	level.Set(parsedLevel)
+	handler, err := newLogHandler(os.Stderr, *logFormat, level)
+	if err != nil {
+		fatalf("Invalid --log-format: %v", err)
 	}
+	// Everything logs through slog.Default, pion included
+	slog.SetDefault(slog.New(handler))
+	cfg.Peer.Logger = slog.Default()
 
-	// Handle incoming track from broadcaster
-	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		log.Printf("[Room %s] Received track from broadcaster: %s", roomID, remoteTrack.Codec().MimeType)
-
-		// Create local track for forwarding to viewers
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(
-			remoteTrack.Codec().RTPCodecCapability,
-			"video",
-			"screen-share",
-		)
-		if err != nil {
-			log.Printf("[Room %s] Failed to create local track: %v", roomID, err)
-			return
-		}
-
-		room.SetBroadcasterTrack(localTrack)
-
-		// Forward RTP packets from broadcaster to local track
-		go func() {
-			buf := make([]byte, 1500)
-			for {
-				n, _, err := remoteTrack.Read(buf)
-				if err != nil {
-					log.Printf("[Room %s] Broadcaster track ended: %v", roomID, err)
-					room.SetBroadcasterTrack(nil)
-					return
-				}
-				if _, err := localTrack.Write(buf[:n]); err != nil {
-					// ErrClosedPipe is expected when no viewers
-					continue
-				}
+	tracerProvider, err := newTracerProvider(context.Background(), *otlpEndpoint)
+	if err != nil {
+		fatalf("Invalid --otlp-endpoint: %v", err)
+	}
+	if tracerProvider != nil {
+		cfg.TracerProvider = tracerProvider
+		// Flush the last spans on the way out
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				slog.Error("Failed to flush traces", "err", err)
 			}
 		}()
-	})
-
-	// Set remote description (offer from broadcaster)
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  offer.SDP,
-	}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to set remote description: %v", err), http.StatusBadRequest)
-		return
 	}
 
-	// Create answer
-	answer, err := pc.CreateAnswer(nil)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create answer: %v", err), http.StatusInternalServerError)
-		return
+	if cfg.RoomIDPattern, err = regexp.Compile(*roomIDPattern); err != nil {
+		fatalf("Invalid --room-id-pattern: %v", err)
 	}
-
-	// Gather ICE candidates
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
-	if err := pc.SetLocalDescription(answer); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to set local description: %v", err), http.StatusInternalServerError)
-		return
+	if err := cfg.CORS.validate(); err != nil {
+		fatalf("Invalid CORS policy: %v", err)
 	}
-	<-gatherComplete
-
-	room.SetBroadcasterPC(pc)
-
-	// Return answer with gathered ICE candidates
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(SDPExchange{
-		Type: "answer",
-		SDP:  pc.LocalDescription().SDP,
-	})
-}
-
-// handleSubscribeWithID handles POST /internal/room/{id}/subscribe
-// Viewer sends SDP offer, receives answer with broadcaster's track
-func handleSubscribeWithID(w http.ResponseWriter, r *http.Request, roomID string) {
-
-	var offer SDPExchange
-	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	if err := validateConfiguredICEServers(cfg.Peer.ICEServers, cfg.Peer.TURNSecret); err != nil {
+		fatalf("Invalid ICE servers: %v", err)
 	}
-
-	room := rooms.Get(roomID)
-	if room == nil {
-		http.Error(w, "Room not found", http.StatusNotFound)
-		return
+	if cfg.Peer.TURNSecret != "" && cfg.Peer.TURNCredentialTTL <= 0 {
+		fatalf("Invalid --turn-ttl: %v", cfg.Peer.TURNCredentialTTL)
 	}
-
-	track := room.GetBroadcasterTrack()
-	if track == nil {
-		http.Error(w, "No broadcaster in room", http.StatusNotFound)
-		return
+	if cfg.Peer.Codecs, err = parseCodecs(*codecs); err != nil {
+		fatalf("Invalid --codecs: %v", err)
 	}
-
-	// Create peer connection for viewer
-	pc, err := createPeerConnection()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create peer connection: %v", err), http.StatusInternalServerError)
-		return
+	if err := cfg.CodecPolicy.normalize(); err != nil {
+		fatalf("Invalid codec policy: %v", err)
 	}
-
-	// Add broadcaster's track to viewer connection
-	rtpSender, err := pc.AddTrack(track)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to add track: %v", err), http.StatusInternalServerError)
-		return
+	if err := validatePublicIPs(cfg.Peer.PublicIPs); err != nil {
+		fatalf("Invalid --public-ip: %v", err)
+	}
+	if cfg.Peer.PublicIPCandidateType, err = parsePublicIPCandidateType(*publicIPCandidate); err != nil {
+		fatalf("Invalid --public-ip-candidate: %v", err)
+	}
+	if cfg.RecordFormat, err = parseRecordFormat(*recordFormat); err != nil {
+		fatalf("Invalid --record-format: %v", err)
+	}
+	// The peer connection cap bounds concurrency when set; otherwise the
+	// readiness connection limit is our best estimate of it
+	concurrency := cfg.MaxPeerConnections
+	if concurrency <= 0 {
+		concurrency = cfg.ReadyMaxConnections
+	}
+	if err := validateUDPPortRange(*udpMin, *udpMax, concurrency); err != nil {
+		fatalf("Invalid UDP port range: %v", err)
+	}
+	cfg.Peer.UDPPortMin, cfg.Peer.UDPPortMax = uint16(*udpMin), uint16(*udpMax)
+	if cfg.Peer.MuxPort != 0 && (*udpMin != 0 || *udpMax != 0) {
+		fatalf("--mux-port cannot be combined with --udp-min/--udp-max")
+	}
+	if cfg.Peer.MuxPort < 0 || cfg.Peer.MuxPort > 65535 {
+		fatalf("Invalid --mux-port: %d", cfg.Peer.MuxPort)
 	}
 
-	// Handle RTCP packets from viewer
-	go func() {
-		buf := make([]byte, 1500)
-		for {
-			if _, _, err := rtpSender.Read(buf); err != nil {
-				return
-			}
+	if cfg.HLS.Dir != "" {
+		if _, err := exec.LookPath(cfg.HLS.FFmpeg); err != nil {
+			fatalf("Invalid --hls-ffmpeg: %v", err)
 		}
-	}()
-
-	// Set remote description (offer from viewer)
-	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP:  offer.SDP,
-	}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to set remote description: %v", err), http.StatusBadRequest)
-		return
+	}
+	if cfg.BroadcasterGrace <= 0 {
+		fatalf("Invalid --broadcaster-grace: %v", cfg.BroadcasterGrace)
+	}
+	if cfg.RTPBufferSize <= 0 {
+		fatalf("Invalid --rtp-buffer-size: %d", cfg.RTPBufferSize)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		fatalf("Invalid --max-sdp-bytes: %d", cfg.MaxBodyBytes)
+	}
+	if err := validateTLSFlags(*tlsCert, *tlsKey); err != nil {
+		fatalf("Invalid TLS configuration: %v", err)
 	}
 
-	// Create answer
-	answer, err := pc.CreateAnswer(nil)
+	server, err := NewServer(NewRoomManager(), cfg)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create answer: %v", err), http.StatusInternalServerError)
-		return
+		fatalf("Failed to initialize: %v", err)
 	}
+	defer server.Close()
 
-	// Gather ICE candidates
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
-	if err := pc.SetLocalDescription(answer); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to set local description: %v", err), http.StatusInternalServerError)
-		return
+	addr := *listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", *port)
 	}
-	<-gatherComplete
-
-	room.AddViewer(pc)
-
-	// Return answer
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(SDPExchange{
-		Type: "answer",
-		SDP:  pc.LocalDescription().SDP,
-	})
-}
-
-// handleStatusWithID handles GET /internal/room/{id}/status
-func handleStatusWithID(w http.ResponseWriter, r *http.Request, roomID string) {
-	room := rooms.Get(roomID)
-
-	if room == nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"exists":         false,
-			"hasBroadcaster": false,
-			"viewerCount":    0,
-		})
-		return
+	if err := validateListenAddr(addr); err != nil {
+		fatalf("Invalid listen address %q: %v", addr, err)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"exists":         true,
-		"hasBroadcaster": room.GetBroadcasterTrack() != nil,
-		"viewerCount":    room.ViewerCount(),
-	})
-}
-
-// handleHealth handles GET /health
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
-}
-
-func main() {
-	port := flag.Int("port", 37003, "HTTP server port")
-	flag.Parse()
-
-	// Use a custom mux with manual routing for compatibility
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/health", handleHealth)
-	mux.HandleFunc("/internal/room", corsMiddleware(handleRoomRouter))
-	mux.HandleFunc("/internal/room/", corsMiddleware(handleRoomRouter))
-
-	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Rubigo Screen Share SFU starting on %s", addr)
-	log.Printf("Endpoints:")
-	log.Printf("  POST /internal/room           - Create room")
-	log.Printf("  POST /internal/room/{id}/publish   - Broadcaster SDP exchange")
-	log.Printf("  POST /internal/room/{id}/subscribe - Viewer SDP exchange")
-	log.Printf("  GET  /internal/room/{id}/status    - Room status")
-
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	var rtmpListener net.Listener
+	if *rtmpAddr != "" {
+		if err := validateListenAddr(*rtmpAddr); err != nil {
+			fatalf("Invalid --rtmp-addr %q: %v", *rtmpAddr, err)
+		}
+		if rtmpListener, err = net.Listen("tcp", *rtmpAddr); err != nil {
+			fatalf("Failed to listen for RTMP: %v", err)
+		}
 	}
-}
-
-// handleRoomRouter routes requests under /internal/room/
-func handleRoomRouter(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
 
-	// POST /internal/room - create room
-	if path == "/internal/room" && r.Method == http.MethodPost {
-		handleCreateRoom(w, r)
-		return
+	autocertCfg.Domains = splitList(*autocertDomains)
+	useTLS := *tlsCert != "" || len(autocertCfg.Domains) > 0
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	slog.Info("Rubigo Screen Share SFU starting", "addr", addr, "scheme", scheme)
+	endpoints := [][2]string{
+		{"GET /internal/rooms", "List rooms, ?hasBroadcaster=, ?sort=id|viewers|age, ?order=, ?limit=, ?offset="},
+		{"POST /internal/room", "Create room"},
+		{"DELETE /internal/room/{id}", "Delete room, disconnecting everyone"},
+		{"POST /internal/room/{id}/publish", "Broadcaster SDP exchange (reconnectToken to resume)"},
+		{"PATCH /internal/room/{id}/publish", "Broadcaster ICE restart"},
+		{"POST /internal/room/{id}/present", "Co-presenter SDP exchange (peerId to resume)"},
+		{"POST /internal/room/{id}/subscribe", "Viewer SDP exchange (?wait=true to wait for broadcaster)"},
+		{"PATCH /internal/room/{id}/subscribe", "Viewer ICE restart"},
+		{"POST /internal/room/{id}/resubscribe", "Viewer reconnect with a reconnect token"},
+		{"POST /internal/room/{id}/unpublish", "End the broadcast"},
+		{"POST /internal/room/{id}/hls", "Start HLS egress, returning its playlist"},
+		{"DELETE /internal/room/{id}/hls", "Stop HLS egress"},
+		{"POST /internal/room/{id}/renegotiate", "Broadcaster re-offer on its connection"},
+		{"GET /internal/room/{id}/status", "Room status"},
+		{"GET /internal/room/{id}/stats", "Per-connection WebRTC stats (?peerId= for one peer)"},
+		{"GET /internal/room/{id}/events", "Room events (SSE)"},
+		{"POST /internal/room/{id}/recording/start", "Start recording to WebM"},
+		{"POST /internal/room/{id}/recording/stop", "Stop recording"},
+		{"POST /internal/room/{id}/record", "Start recording (alias)"},
+		{"DELETE /internal/room/{id}/record", "Stop recording (alias)"},
+		{"DELETE /internal/room/{id}/viewer/{viewerId}", "Kick a viewer (?ban=true to ban)"},
+		{"POST /internal/room/{id}/viewer/{viewerId}/pause", "Pause a viewer"},
+		{"POST /internal/room/{id}/viewer/{viewerId}/resume", "Resume a viewer"},
+		{"POST /internal/room/{id}/viewer/{viewerId}/answer", "Viewer answer to a renegotiate offer"},
+		{"POST /internal/room/{id}/viewer/{viewerId}/layer", "Pin a simulcast viewer to a layer, or auto"},
+
+		{"POST /whip/{id}", "WHIP publish (application/sdp)"},
+		{"DELETE /whip/{id}/{sessionId}", "End a WHIP publish"},
+		{"POST /whep/{id}", "WHEP playback (application/sdp)"},
+		{"PATCH /whep/{id}/{sessionId}", "Trickle ICE or ICE restart for a WHEP session"},
+		{"DELETE /whep/{id}/{sessionId}", "End a WHEP playback"},
+
+		{"POST /internal/cascade", "Relay a room from an upstream SFU node"},
+		{"GET /internal/cascade", "List cascade links"},
+		{"DELETE /internal/cascade/{roomId}", "Tear down a cascade link"},
+
+		{"POST /internal/drain", "Stop accepting new rooms and publishes"},
+		{"POST /internal/undrain", "Resume accepting new rooms and publishes"},
+		{"GET /internal/ice-servers", "ICE servers for clients, with fresh TURN credentials"},
+		{"GET /healthz", "Liveness (also /health)"},
+		{"GET /readyz", "Readiness, with dependency checks (also /ready)"},
+		{"GET /metrics", "Prometheus metrics"},
+	}
+	if cfg.HLS.Dir != "" {
+		endpoints = append(endpoints, [2]string{"GET /hls/{id}/index.m3u8", "HLS playlist and segments, while egress runs"})
+	}
+	if rtmpListener != nil {
+		endpoints = append(endpoints, [2]string{"rtmp://" + *rtmpAddr + "/" + rtmpApp + "/{id}", "RTMP publish, H.264 video only (?key= password or token)"})
+	}
+	if cfg.DebugToken != "" {
+		endpoints = append(endpoints, [2]string{"GET /internal/debug/stats", "Process stats (bearer token)"})
+		if cfg.DebugEventBuffer > 0 {
+			endpoints = append(endpoints, [2]string{"GET /internal/debug/events", "Recent events, ?limit=N (bearer token)"})
+		}
+	}
+	for _, e := range endpoints {
+		slog.Info("Endpoint", "route", e[0], "description", e[1])
+	}
+	if cfg.JWTSecret != "" || cfg.JWKSURL != "" {
+		slog.Info("Publish and subscribe require a JWT with roomId and role claims")
+	}
+	if len(cfg.APIKeys.Keys) > 0 || cfg.APIKeys.File != "" {
+		slog.Info("Internal routes require an API key in X-API-Key", "rate", cfg.APIKeys.Rate)
+	}
+	if cfg.Upload.Bucket != "" {
+		slog.Info("Uploading finished recordings", "bucket", cfg.Upload.Bucket)
+	}
+	if tracerProvider != nil {
+		slog.Info("Exporting traces over OTLP")
+	}
+	if cfg.Cluster.RedisURL != "" {
+		slog.Info("Cluster mode: rooms are assigned to nodes in Redis", "node", cfg.Cluster.NodeID, "redirect", cfg.Cluster.Redirect)
 	}
 
-	// Parse /internal/room/{id}/{action}
-	// Expected: /internal/room/abc123/publish
-	parts := strings.Split(strings.TrimPrefix(path, "/internal/room/"), "/")
-	if len(parts) < 1 || parts[0] == "" {
-		http.Error(w, "Room ID required", http.StatusBadRequest)
-		return
+	httpServer := newHTTPServer(addr, server.Handler(), *readHeaderTimeout, *readTimeout, *idleTimeout)
+	var challengeServer *http.Server
+	if useTLS {
+		if challengeServer, err = configureTLS(httpServer, *tlsCert, *tlsKey, autocertCfg); err != nil {
+			fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+	if len(autocertCfg.Domains) > 0 {
+		slog.Info("Serving HTTPS with certificates from ACME", "domains", autocertCfg.Domains, "cache", autocertCfg.CacheDir)
+	}
+	if rtmpListener != nil {
+		go server.ServeRTMP(rtmpListener)
+	}
+	if challengeServer != nil {
+		go func() {
+			if err := challengeServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatalf("ACME challenge server failed: %v", err)
+			}
+		}()
 	}
 
-	roomID := parts[0]
-	action := ""
-	if len(parts) >= 2 {
-		action = parts[1]
+	if reloader != nil {
+		reloadOnHangup(reloader, server, level)
 	}
 
-	// Store roomID in request context or use directly
-	switch action {
-	case "publish":
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	// Fail readiness first, then let in-flight requests finish. Serving
+	// returns as soon as Shutdown starts, so main waits on done for the
+	// drain to complete.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-stop
+		slog.Info("Shutting down")
+		server.BeginShutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Error("Shutdown error", "err", err)
 		}
-		handlePublishWithID(w, r, roomID)
-	case "subscribe":
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+		if challengeServer != nil {
+			challengeServer.Shutdown(ctx)
 		}
-		handleSubscribeWithID(w, r, roomID)
-	case "status":
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+		if rtmpListener != nil {
+			rtmpListener.Close()
 		}
-		handleStatusWithID(w, r, roomID)
-	default:
-		http.Error(w, "Unknown action", http.StatusNotFound)
-	}
-}
-
-// RoomManager manages in-memory room state
-type RoomManager struct {
-	mu    sync.RWMutex
-	rooms map[string]*Room
-}
+	}()
 
-func NewRoomManager() *RoomManager {
-	return &RoomManager{
-		rooms: make(map[string]*Room),
+	if useTLS {
+		// The certificate comes from TLSConfig.GetCertificate
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
 	}
-}
-
-func (m *RoomManager) GetOrCreate(id string) *Room {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if room, ok := m.rooms[id]; ok {
-		return room
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatalf("Server failed: %v", err)
 	}
-
-	room := &Room{id: id}
-	m.rooms[id] = room
-	log.Printf("Created room: %s", id)
-	return room
-}
-
-func (m *RoomManager) Get(id string) *Room {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.rooms[id]
-}
-
-func (m *RoomManager) Delete(id string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.rooms, id)
-	log.Printf("Deleted room: %s", id)
-}
-
-// Room holds in-memory state for a screen share session
-// No persistence - Next.js owns room metadata in SQLite
-type Room struct {
-	id               string
-	mu               sync.RWMutex
-	broadcasterPC    *webrtc.PeerConnection
-	broadcasterTrack *webrtc.TrackLocalStaticRTP
-	viewers          []*webrtc.PeerConnection
-}
-
-func (r *Room) SetBroadcasterPC(pc *webrtc.PeerConnection) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.broadcasterPC = pc
-}
-
-func (r *Room) SetBroadcasterTrack(track *webrtc.TrackLocalStaticRTP) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.broadcasterTrack = track
-}
-
-func (r *Room) GetBroadcasterTrack() *webrtc.TrackLocalStaticRTP {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.broadcasterTrack
-}
-
-func (r *Room) AddViewer(pc *webrtc.PeerConnection) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.viewers = append(r.viewers, pc)
-	log.Printf("[Room %s] Viewer joined (total: %d)", r.id, len(r.viewers))
-}
-
-func (r *Room) ViewerCount() int {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return len(r.viewers)
+	<-done
 }
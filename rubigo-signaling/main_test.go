@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestValidateListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{":37003", false},
+		{"10.0.0.5:37003", false},
+		{"localhost:8080", false},
+		{"[::1]:37003", false},
+		{"37003", true},
+		{"10.0.0.5", true},
+		{"10.0.0.5:http", true},
+		{"10.0.0.5:70000", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := validateListenAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateListenAddr(%q) = %v, wantErr %v", tt.addr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStringList(t *testing.T) {
+	var l stringList
+	for _, value := range []string{"https://a.example, https://b.example", "https://c.example", " , "} {
+		if err := l.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := (stringList{"https://a.example", "https://b.example", "https://c.example"}); !reflect.DeepEqual(l, want) {
+		t.Errorf("list = %q, want %q", l, want)
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	t.Setenv("SFU_TEST_PORT", "50000")
+	t.Setenv("SFU_TEST_FLAG", "true")
+	if got := envInt("SFU_TEST_PORT"); got != 50000 {
+		t.Errorf("envInt = %d, want 50000", got)
+	}
+	if got := envInt("SFU_TEST_UNSET"); got != 0 {
+		t.Errorf("envInt of an unset variable = %d, want 0", got)
+	}
+	if !envBool("SFU_TEST_FLAG") || envBool("SFU_TEST_UNSET") {
+		t.Error("envBool misread the environment")
+	}
+}
+
+func TestValidateTLSFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		cert, key string
+		wantErr   bool
+	}{
+		{"plain HTTP", "", "", false},
+		{"cert only", "cert.pem", "", true},
+		{"key only", "", "key.pem", true},
+		{"missing files", "missing-cert.pem", "missing-key.pem", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTLSFlags(tt.cert, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateTLSFlags(%q, %q) = %v, wantErr %v", tt.cert, tt.key, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	server := newHTTPServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), time.Second, 2*time.Second, 3*time.Second)
+	if server.ReadHeaderTimeout != time.Second || server.ReadTimeout != 2*time.Second || server.IdleTimeout != 3*time.Second {
+		t.Errorf("timeouts = %v/%v/%v", server.ReadHeaderTimeout, server.ReadTimeout, server.IdleTimeout)
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "http://" + listener.Addr().String()
+
+	// Cleartext HTTP/2 with prior knowledge
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	for _, tt := range []struct {
+		client *http.Client
+		want   string
+	}{
+		{h2c, "HTTP/2.0"},
+		{http.DefaultClient, "HTTP/1.1"},
+	} {
+		resp, err := tt.client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, 16)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+		if got := string(body[:n]); got != tt.want {
+			t.Errorf("protocol = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are histogram upper bounds in seconds
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative Prometheus-style histogram of durations
+type histogram struct {
+	name, help string
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, non-cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string) *histogram {
+	return &histogram{name: name, help: help, counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// Observe records one duration
+func (h *histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// writeTo writes the histogram in Prometheus text format
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// serverMetrics are the SFU's exported measurements
+type serverMetrics struct {
+	// From subscribe request to the viewer's connection reaching connected
+	viewerConnect *histogram
+	// From connected to the first RTP packet forwarded to the viewer
+	viewerFirstPacket *histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		viewerConnect: newHistogram("rubigo_viewer_connect_seconds",
+			"Time from subscribe request to viewer connection established."),
+		viewerFirstPacket: newHistogram("rubigo_viewer_first_packet_seconds",
+			"Time from viewer connection established to first forwarded RTP packet."),
+	}
+}
+
+// handleMetrics handles GET /metrics in Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.viewerConnect.writeTo(w)
+	s.metrics.viewerFirstPacket.writeTo(w)
+	s.writeThrottleMetrics(w)
+	s.writeQualityMetrics(w)
+}
+
+// writeThrottleMetrics writes how many requests each configured rate limit
+// has refused
+func (s *Server) writeThrottleMetrics(w io.Writer) {
+	var apiKeyLimiter *rateLimiter
+	if s.apiKeys != nil {
+		apiKeyLimiter = s.apiKeys.limiter
+	}
+	limits := []struct {
+		name    string
+		limiter *rateLimiter
+	}{
+		{"create", s.createLimiter},
+		{"sdp", s.sdpLimiter},
+		{"api_key", apiKeyLimiter},
+	}
+
+	const name = "rubigo_rate_limited_requests_total"
+	fmt.Fprintf(w, "# HELP %s Requests refused with 429 by a rate limit.\n# TYPE %s counter\n", name, name)
+	for _, l := range limits {
+		if l.limiter != nil {
+			fmt.Fprintf(w, "%s{limit=%q} %d\n", name, l.name, l.limiter.throttled.Load())
+		}
+	}
+}
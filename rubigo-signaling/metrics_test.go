@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test.")
+	h.Observe(30 * time.Millisecond)
+	h.Observe(300 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	var b strings.Builder
+	h.writeTo(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.05"} 1`,
+		`test_seconds_bucket{le="0.25"} 1`,
+		`test_seconds_bucket{le="0.5"} 2`,
+		`test_seconds_bucket{le="10"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_count 3",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestObserveViewerJoin(t *testing.T) {
+	server := newServer(t, newFakeStore(), DefaultConfig())
+	track := newLiveTrack(t)
+	v := &viewer{id: "v1", track: track}
+
+	server.observeViewerJoin("abc", v, time.Now().Add(-time.Second))
+	if server.metrics.viewerConnect.count != 1 {
+		t.Errorf("connect observations = %d, want 1", server.metrics.viewerConnect.count)
+	}
+	if server.metrics.viewerFirstPacket.count != 0 {
+		t.Fatal("first packet observed before any packet was forwarded")
+	}
+
+	track.Forward(track.Source(), &rtp.Packet{})
+	track.Forward(track.Source(), &rtp.Packet{})
+	if server.metrics.viewerFirstPacket.count != 1 {
+		t.Errorf("first packet observations = %d, want 1", server.metrics.viewerFirstPacket.count)
+	}
+
+	rec := doRequest(t, server.Handler(), http.MethodGet, "/metrics", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "rubigo_viewer_connect_seconds_count 1") {
+		t.Errorf("metrics = %d %s", rec.Code, rec.Body)
+	}
+}
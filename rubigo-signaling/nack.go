@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// With NACK handling on, the SFU answers viewers' NACKs from its packet
+// history (see rtx.go) and asks the broadcaster for what it lost itself. With it off
+// (--disable-nack) nothing answers them here, so they go upstream instead:
+// each lost packet is traced back to the broadcaster's sequence number and
+// asked for once, however many viewers lost it, and the retransmission is
+// forwarded to everyone like any other packet.
+
+const (
+	// nackRepeatInterval is how long a packet asked for upstream isn't
+	// asked for again, about a round trip for its retransmission
+	nackRepeatInterval = 100 * time.Millisecond
+	// nackForwardRate caps the packets asked for per track and second,
+	// with bursts of nackForwardBurst
+	nackForwardRate  = 500
+	nackForwardBurst = 100
+)
+
+// nackForwarder decides which lost packets of a track to ask for upstream
+type nackForwarder struct {
+	mu      sync.Mutex
+	asked   map[uint16]time.Time // by source sequence number
+	limiter *rateLimiter
+}
+
+func newNACKForwarder() *nackForwarder {
+	return &nackForwarder{asked: make(map[uint16]time.Time), limiter: newRateLimiter(nackForwardRate, nackForwardBurst)}
+}
+
+// claim returns the packets of seqs that may be asked for at now, and
+// records them
+func (n *nackForwarder) claim(seqs []uint16, now time.Time) []uint16 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for seq, at := range n.asked {
+		if now.Sub(at) >= nackRepeatInterval {
+			delete(n.asked, seq)
+		}
+	}
+	var claimed []uint16
+	for _, seq := range seqs {
+		if _, ok := n.asked[seq]; ok {
+			continue
+		}
+		if ok, _ := n.limiter.allow(""); !ok {
+			break
+		}
+		n.asked[seq] = now
+		claimed = append(claimed, seq)
+	}
+	return claimed
+}
+
+// nackedSequences returns the media SSRC of the first NACK in pkts, and the
+// sequence numbers pkts report lost on it
+func nackedSequences(pkts []rtcp.Packet) (webrtc.SSRC, []uint16) {
+	var ssrc uint32
+	var seqs []uint16
+	for _, pkt := range pkts {
+		nack, ok := pkt.(*rtcp.TransportLayerNack)
+		if !ok || (seqs != nil && nack.MediaSSRC != ssrc) {
+			continue
+		}
+		ssrc = nack.MediaSSRC
+		for _, pair := range nack.Nacks {
+			seqs = append(seqs, pair.PacketList()...)
+		}
+	}
+	return webrtc.SSRC(ssrc), seqs
+}
+
+// sourceSequences traces sequence numbers viewers received track on back
+// to the source's, leaving out those that can't be
+func (f *forwardingTrack) sourceSequences(seqs []uint16) []uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var traced []uint16
+	for _, seq := range seqs {
+		if input, ok := f.rewriter.input(seq); ok {
+			traced = append(traced, input)
+		}
+	}
+	return traced
+}
+
+// claimNACKs is nackForwarder.claim for the track's forwarder
+func (f *forwardingTrack) claimNACKs(seqs []uint16, now time.Time) []uint16 {
+	f.mu.Lock()
+	if f.nacks == nil {
+		f.nacks = newNACKForwarder()
+	}
+	nacks := f.nacks
+	f.mu.Unlock()
+	return nacks.claim(seqs, now)
+}
+
+// repairViewer follows up on a viewer's NACK for track once what could be
+// was resent: the rest, missed, goes upstream if the viewer forwards NACKs
+func (r *Room) repairViewer(v *viewer, track *forwardingTrack, missed []uint16, err error) {
+	if err != nil {
+		r.viewerLog(v.id).Debug("Failed to retransmit", "err", err)
+	}
+	if !v.forwardNACKs || len(missed) == 0 {
+		return
+	}
+	if err := r.ForwardNACK(track, missed); err != nil && !errors.Is(err, errNoBroadcaster) {
+		r.viewerLog(v.id).Debug("Failed to forward NACK", "err", err)
+	}
+}
+
+// ForwardNACK asks the publisher of track to resend the packets a viewer
+// reported lost, given as the sequence numbers viewers receive track on.
+// Packets already asked for within nackRepeatInterval, or beyond the rate
+// limit, are left out. It fails with errNoBroadcaster if the track has no
+// live source.
+func (r *Room) ForwardNACK(track *forwardingTrack, lost []uint16) error {
+	pc := r.publisherPC(track)
+	source := track.Source()
+	if pc == nil || source == nil {
+		return errNoBroadcaster
+	}
+	seqs := track.claimNACKs(track.sourceSequences(lost), time.Now())
+	if len(seqs) == 0 {
+		return nil
+	}
+	return pc.WriteRTCP([]rtcp.Packet{&rtcp.TransportLayerNack{
+		MediaSSRC: uint32(source.SSRC()),
+		Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+	}})
+}
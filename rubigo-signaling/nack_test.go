@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestRewriterInput(t *testing.T) {
+	var w rtpRewriter
+	if _, ok := w.input(0); ok {
+		t.Error("traced a packet before any was written")
+	}
+	write := func(seq uint16) uint16 {
+		packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}
+		w.rewrite(packet, 90000)
+		return packet.SequenceNumber
+	}
+	for seq := uint16(65534); seq != 2; seq++ {
+		write(seq)
+	}
+	for _, seq := range []uint16{65534, 65535, 0, 1} {
+		if got, ok := w.input(seq); !ok || got != seq {
+			t.Errorf("input(%d) = %d, %v; want it back", seq, got, ok)
+		}
+	}
+	if _, ok := w.input(2); ok {
+		t.Error("traced a packet not yet written")
+	}
+
+	// After a switch only the new input's packets trace back
+	w.resync = true
+	first := write(500)
+	write(501)
+	if first != 2 {
+		t.Fatalf("switched input continued at %d, want 2", first)
+	}
+	if got, ok := w.input(3); !ok || got != 501 {
+		t.Errorf("input(3) = %d, %v; want 501", got, ok)
+	}
+	if _, ok := w.input(1); ok {
+		t.Error("traced a packet from before the switch")
+	}
+
+	// Nor can anything while a skip is pending, or from before it
+	w.skip()
+	if _, ok := w.input(3); ok {
+		t.Error("traced a packet with a skip pending")
+	}
+	write(503)
+	if got, ok := w.input(4); !ok || got != 503 {
+		t.Errorf("input(4) = %d, %v; want 503", got, ok)
+	}
+	if _, ok := w.input(3); ok {
+		t.Error("traced a packet from before the skip")
+	}
+}
+
+func TestNACKForwarderClaim(t *testing.T) {
+	n := newNACKForwarder()
+	now := time.Unix(1000, 0)
+	n.limiter.now = func() time.Time { return now }
+
+	if got := n.claim([]uint16{1, 2, 3}, now); !slices.Equal(got, []uint16{1, 2, 3}) {
+		t.Errorf("first claim = %v", got)
+	}
+	// Another viewer losing the same packets doesn't ask again
+	if got := n.claim([]uint16{2, 3, 4}, now.Add(10*time.Millisecond)); !slices.Equal(got, []uint16{4}) {
+		t.Errorf("overlapping claim = %v, want [4]", got)
+	}
+	now = now.Add(nackRepeatInterval)
+	if got := n.claim([]uint16{1}, now); !slices.Equal(got, []uint16{1}) {
+		t.Errorf("claim after the repeat interval = %v, want [1]", got)
+	}
+
+	// The burst, refilled by now but for the one just asked, caps how
+	// many go up at once
+	var lost []uint16
+	for seq := uint16(1000); seq < 1000+2*nackForwardBurst; seq++ {
+		lost = append(lost, seq)
+	}
+	if got := n.claim(lost, now); len(got) != nackForwardBurst-1 {
+		t.Errorf("claimed %d over the burst, want %d", len(got), nackForwardBurst-1)
+	}
+}
+
+func TestNackedSequences(t *testing.T) {
+	pkts := []rtcp.Packet{
+		&rtcp.PictureLossIndication{},
+		&rtcp.TransportLayerNack{MediaSSRC: 7, Nacks: []rtcp.NackPair{{PacketID: 10, LostPackets: 0b101}}},
+		&rtcp.TransportLayerNack{MediaSSRC: 8, Nacks: rtcp.NackPairsFromSequenceNumbers([]uint16{20})},
+		&rtcp.TransportLayerNack{MediaSSRC: 7, Nacks: rtcp.NackPairsFromSequenceNumbers([]uint16{40})},
+	}
+	if ssrc, got := nackedSequences(pkts); ssrc != 7 || !slices.Equal(got, []uint16{10, 11, 13, 40}) {
+		t.Errorf("nackedSequences = %d, %v; want 7, [10 11 13 40]", ssrc, got)
+	}
+	if _, got := nackedSequences([]rtcp.Packet{&rtcp.ReceiverReport{}}); got != nil {
+		t.Errorf("without NACKs = %v", got)
+	}
+}
+
+func TestForwardingTrackSourceSequences(t *testing.T) {
+	track := newLiveTrack(t)
+	viewer := &fakeBinding{id: "v", keep: true}
+	bindViewer(t, track, viewer)
+	source := track.Source()
+	for seq := uint16(100); seq < 103; seq++ {
+		if err := track.Forward(source, &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sent []uint16
+	for _, header := range viewer.packets {
+		sent = append(sent, header.SequenceNumber)
+	}
+	if got := track.sourceSequences(append(sent, sent[2]+1)); !slices.Equal(got, []uint16{100, 101, 102}) {
+		t.Errorf("sourceSequences = %v, want [100 101 102]", got)
+	}
+}
+
+func TestForwardNACKWithoutBroadcaster(t *testing.T) {
+	room, _ := NewRoomManager().GetOrCreate("abc")
+	if err := room.ForwardNACK(newLiveTrack(t), []uint16{1}); err != errNoBroadcaster {
+		t.Errorf("ForwardNACK = %v, want errNoBroadcaster", err)
+	}
+}
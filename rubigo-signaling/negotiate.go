@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// errNegotiationTimeout is returned when answering an offer takes longer
+// than Config.NegotiationTimeout
+var errNegotiationTimeout = errors.New("negotiation timed out")
+
+// negotiationError is a failed step of answering an offer
+type negotiationError struct {
+	step    string // what failed, e.g. "set remote description"
+	invalid bool   // the offer itself was rejected
+	err     error
+}
+
+func (e *negotiationError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.step, e.err)
+}
+
+func (e *negotiationError) Unwrap() error {
+	return e.err
+}
+
+// answerOffer applies a remote offer to pc and sets the local answer,
+// returning the promise for ICE gathering to finish. pion's negotiation
+// calls take no context, so they run in their own goroutine: if they
+// outlast Config.NegotiationTimeout or ctx, the handler gives up with
+// errNegotiationTimeout and closing pc unblocks them. receiveCodecs, if
+// set, are the codecs pc may receive, in order of preference.
+func (s *Server) answerOffer(ctx context.Context, pc *webrtc.PeerConnection, sdp string, receiveCodecs []string) (gatherComplete <-chan struct{}, err error) {
+	ctx, span := s.tracer.Start(ctx, "sdp.negotiate")
+	defer func() { endSpan(span, err) }()
+	if s.cfg.NegotiationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.NegotiationTimeout)
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		return nil, errNegotiationTimeout
+	}
+
+	type result struct {
+		gatherComplete <-chan struct{}
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		gatherComplete, err := applyOffer(pc, sdp, receiveCodecs)
+		done <- result{gatherComplete, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.gatherComplete, res.err
+	case <-ctx.Done():
+		return nil, errNegotiationTimeout
+	}
+}
+
+// applyOffer is the body of answerOffer
+func applyOffer(pc *webrtc.PeerConnection, sdp string, receiveCodecs []string) (<-chan struct{}, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  sdp,
+	}); err != nil {
+		return nil, &negotiationError{step: "set remote description", invalid: true, err: err}
+	}
+	if receiveCodecs != nil {
+		if err := setReceiveCodecs(pc, receiveCodecs); err != nil {
+			return nil, &negotiationError{step: "set codec preferences", err: err}
+		}
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, &negotiationError{step: "create answer", err: err}
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, &negotiationError{step: "set local description", err: err}
+	}
+	return gatherComplete, nil
+}
+
+// writeNegotiationError writes the response for an answerOffer failure:
+// 504 on timeout, 400 for an offer that was rejected, 500 otherwise
+func writeNegotiationError(w http.ResponseWriter, err error) {
+	var negErr *negotiationError
+	switch {
+	case errors.Is(err, errNegotiationTimeout):
+		writeError(w, http.StatusGatewayTimeout, errCodeNegotiateTimeout, "SDP negotiation timed out")
+	case errors.As(err, &negErr) && negErr.invalid:
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Failed to %s: %v", negErr.step, negErr.err))
+	case errors.As(err, &negErr):
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to %s: %v", negErr.step, negErr.err))
+	default:
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newOffer returns a video offer from a client connection
+func newOffer(t *testing.T) string {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offer.SDP
+}
+
+func TestAnswerOffer(t *testing.T) {
+	s := newServer(t, newFakeStore(), DefaultConfig())
+	newPC := func() *webrtc.PeerConnection {
+		pc, _, err := s.peers.createPeerConnection("abc", "viewer", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+
+	pc := newPC()
+	gathered, err := s.answerOffer(context.Background(), pc, newOffer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if pc.LocalDescription() == nil || pc.LocalDescription().Type != webrtc.SDPTypeAnswer {
+		t.Error("no local answer after answerOffer")
+	}
+
+	tests := []struct {
+		name     string
+		ctx      func() context.Context
+		sdp      string
+		want     int
+		wantCode string
+	}{
+		{"invalid offer", context.Background, "not sdp", http.StatusBadRequest, errCodeInvalidSDP},
+		{"deadline passed", func() context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}, newOffer(t), http.StatusGatewayTimeout, errCodeNegotiateTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.answerOffer(tt.ctx(), newPC(), tt.sdp, nil)
+			if err == nil {
+				t.Fatal("answerOffer succeeded")
+			}
+			rec := httptest.NewRecorder()
+			writeNegotiationError(rec, err)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			decodeError(t, rec, tt.wantCode)
+		})
+	}
+}
+
+func TestPublishInvalidOfferReleasesRoom(t *testing.T) {
+	store := newFakeStore("abc")
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", `{"type":"offer","sdp":"not sdp"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if pc := store.Get("abc").BroadcasterPC(); pc != nil {
+		t.Errorf("failed publish left its connection on the room (state %s)", pc.ConnectionState())
+	}
+}
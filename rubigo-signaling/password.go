@@ -0,0 +1,38 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashRoomPassword hashes a room password for storage on the Room.
+// Only the bcrypt hash is kept; the plaintext is never stored.
+func hashRoomPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// SetPasswordHash protects the room with a hashed password
+func (r *Room) SetPasswordHash(hash []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.passwordHash = hash
+}
+
+// PasswordProtected reports whether the room requires a password
+func (r *Room) PasswordProtected() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.passwordHash != nil
+}
+
+// CheckPassword reports whether password unlocks the room.
+// Rooms created without a password accept anything.
+func (r *Room) CheckPassword(password string) bool {
+	r.mu.RLock()
+	hash := r.passwordHash
+	r.mu.RUnlock()
+
+	if hash == nil {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
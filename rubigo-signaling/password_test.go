@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRoomPassword(t *testing.T) {
+	room := &Room{id: "abc"}
+	if !room.CheckPassword("") || room.PasswordProtected() {
+		t.Fatal("room without password should accept anything")
+	}
+
+	hash, err := hashRoomPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.SetPasswordHash(hash)
+
+	if !room.PasswordProtected() {
+		t.Error("PasswordProtected = false after SetPasswordHash")
+	}
+	if !room.CheckPassword("secret") {
+		t.Error("correct password rejected")
+	}
+	if room.CheckPassword("wrong") || room.CheckPassword("") {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestPasswordProtectedRoomHandlers(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","password":"secret"}`)
+	if body := decodeBody(t, rec); body["passwordProtected"] != true {
+		t.Fatalf("unexpected create body: %v", body)
+	}
+
+	// Re-creating can't change the password
+	doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","password":"other"}`)
+	if !store.Get("abc").CheckPassword("secret") {
+		t.Error("password changed by second create")
+	}
+
+	for _, action := range []string{"publish", "subscribe"} {
+		rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/"+action, `{"type":"offer","sdp":"","password":"wrong"}`)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s with wrong password: status = %d, want %d", action, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	// The right password gets past the gate to the next check
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":"","password":"secret"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("subscribe with password: status = %d, want %d (no broadcaster)", rec.Code, http.StatusNotFound)
+	}
+}
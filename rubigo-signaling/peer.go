@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// PeerConfig holds settings applied to every peer connection
+type PeerConfig struct {
+	// Codecs to register, from --codecs; empty registers pion's defaults
+	Codecs []string
+	// ICETimeout bounds how long SDP exchange waits for ICE gathering
+	ICETimeout time.Duration
+	// ICEDisconnectedTimeout and ICEFailedTimeout are how long a silent
+	// connection takes to be marked disconnected, then failed and closed;
+	// zero keeps pion's defaults
+	ICEDisconnectedTimeout time.Duration
+	ICEFailedTimeout       time.Duration
+	// UDP port range for media; zero leaves pion's ephemeral default
+	UDPPortMin uint16
+	UDPPortMax uint16
+	// MuxPort, if set, carries all media over one shared UDP port
+	MuxPort int
+	// PublicIPs are advertised for the SFU behind 1:1 NAT, as in Docker or
+	// Kubernetes, each a public IP or a public/private pair. With
+	// PublicIPCandidateType host they replace the private addresses in
+	// host candidates; with srflx they are offered alongside them.
+	PublicIPs             []string
+	PublicIPCandidateType webrtc.ICECandidateType
+	// ICEServers are used by rooms that don't set their own
+	ICEServers []webrtc.ICEServer
+	// TURNSecret, shared with the TURN servers, generates time-limited
+	// credentials for configured TURN servers that have none; they are
+	// valid for TURNCredentialTTL
+	TURNSecret        string
+	TURNCredentialTTL time.Duration
+	// Logger receives pion's internal logs; nil keeps pion's default of
+	// printing errors only
+	Logger *slog.Logger
+	// DisableNACK turns off retransmission of lost packets
+	DisableNACK bool
+	// DisablePLI stops the periodic keyframe requests to broadcasters.
+	// Viewers' own keyframe requests are forwarded regardless.
+	DisablePLI bool
+	// DisableBWE turns off TWCC bandwidth estimation toward viewers, and
+	// with it the bitrate limits passed on to broadcasters
+	DisableBWE bool
+}
+
+// pion's ICE timeouts, kept for whichever of them isn't configured
+const (
+	defaultICEDisconnectedTimeout = 5 * time.Second
+	defaultICEFailedTimeout       = 25 * time.Second
+	defaultICEKeepalive           = 2 * time.Second
+)
+
+// defaultICEServers is the STUN server used when none is configured
+var defaultICEServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+// validateICEServers checks ICE servers supplied by a client: every server
+// needs at least one parseable STUN/TURN URL, and TURN needs credentials
+func validateICEServers(servers []webrtc.ICEServer) error {
+	for i, server := range servers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("iceServers[%d]: urls required", i)
+		}
+		for _, raw := range server.URLs {
+			u, err := ice.ParseURL(raw)
+			if err != nil {
+				return fmt.Errorf("iceServers[%d]: invalid URL %q: %w", i, raw, err)
+			}
+			if (u.Scheme == ice.SchemeTypeTURN || u.Scheme == ice.SchemeTypeTURNS) &&
+				(server.Username == "" || server.Credential == nil || server.Credential == "") {
+				return fmt.Errorf("iceServers[%d]: TURN URL %q requires username and credential", i, raw)
+			}
+		}
+	}
+	return nil
+}
+
+// parsePublicIPCandidateType parses --public-ip-candidate
+func parsePublicIPCandidateType(s string) (webrtc.ICECandidateType, error) {
+	t, err := webrtc.NewICECandidateType(s)
+	if err != nil || (t != webrtc.ICECandidateTypeHost && t != webrtc.ICECandidateTypeSrflx) {
+		return webrtc.ICECandidateTypeUnknown, fmt.Errorf("must be host or srflx, not %q", s)
+	}
+	return t, nil
+}
+
+// validatePublicIPs checks --public-ip values by the rules of pion's 1:1
+// NAT mapping, which would otherwise only fail each connection's ICE
+// gathering: per IP family, either one public IP for every local address
+// or public/private pairs, with each private IP mapped once
+func validatePublicIPs(ips []string) error {
+	sole := make(map[bool]bool)              // by IPv4
+	mapped := make(map[bool]map[string]bool) // private IPs by IPv4
+	for _, entry := range ips {
+		publicStr, privateStr, pair := strings.Cut(entry, "/")
+		public := net.ParseIP(publicStr)
+		if public == nil {
+			return fmt.Errorf("invalid IP %q in %q", publicStr, entry)
+		}
+		v4 := public.To4() != nil
+		if !pair {
+			if sole[v4] || len(mapped[v4]) > 0 {
+				return fmt.Errorf("%q: a public IP for every local address can't be combined with other IPs of its family", entry)
+			}
+			sole[v4] = true
+			continue
+		}
+		private := net.ParseIP(privateStr)
+		if private == nil || (private.To4() != nil) != v4 {
+			return fmt.Errorf("%q: the private IP must be an IP of the public IP's family", entry)
+		}
+		if sole[v4] {
+			return fmt.Errorf("%q: can't be combined with a public IP for every local address", entry)
+		}
+		if mapped[v4] == nil {
+			mapped[v4] = make(map[string]bool)
+		}
+		if mapped[v4][private.String()] {
+			return fmt.Errorf("%q: private IP %s is already mapped", entry, private)
+		}
+		mapped[v4][private.String()] = true
+	}
+	return nil
+}
+
+// validateUDPPortRange checks a --udp-min/--udp-max pair. expectedConns, if
+// known, is the number of concurrent peer connections the range must hold;
+// each connection binds its own port.
+func validateUDPPortRange(min, max, expectedConns int) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if min == 0 || max == 0 {
+		return fmt.Errorf("--udp-min and --udp-max must be set together")
+	}
+	if min < 1 || max > 65535 {
+		return fmt.Errorf("UDP ports must be between 1 and 65535")
+	}
+	if min > max {
+		return fmt.Errorf("--udp-min (%d) is greater than --udp-max (%d)", min, max)
+	}
+	if size := max - min + 1; expectedConns > 0 && size < expectedConns {
+		return fmt.Errorf("UDP port range %d-%d holds %d connections, fewer than the expected %d", min, max, size, expectedConns)
+	}
+	return nil
+}
+
+// peerFactory creates peer connections from one pion API built at startup,
+// so the UDP mux and other engine settings are shared across all rooms
+type peerFactory struct {
+	api        *webrtc.API
+	mux        ice.UDPMux // nil unless a mux port is configured
+	iceServers []webrtc.ICEServer
+	turnSecret string        // for TURN REST credentials; empty if unused
+	turnTTL    time.Duration // how long those credentials last
+
+	// udpMin and udpMax are the ephemeral UDP port range; zero for any port
+	udpMin, udpMax uint16
+
+	// With a logger, each connection gets its own API sharing these, so
+	// pion's logs carry the room and role
+	logger        *slog.Logger
+	mediaEngine   *webrtc.MediaEngine
+	registry      *interceptor.Registry
+	settingEngine webrtc.SettingEngine
+
+	// bweMu serializes connection creation, so the estimator the
+	// congestion controller hands over in bwe, and the RTP stats in
+	// rtpStats, are the new connection's
+	bweMu    sync.Mutex
+	bwe      cc.BandwidthEstimator
+	rtpStats stats.Getter
+
+	// streamStats holds each open connection's RTP stats, by connection
+	streamStats sync.Map
+}
+
+// newPeerFactory builds the shared API from cfg. With a mux port set, every
+// peer connection's media shares that single UDP port.
+func newPeerFactory(cfg PeerConfig) (*peerFactory, error) {
+	// Configure media engine
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerCodecs(mediaEngine, cfg.Codecs); err != nil {
+		return nil, fmt.Errorf("failed to register codecs: %w", err)
+	}
+
+	factory := &peerFactory{iceServers: cfg.ICEServers, logger: cfg.Logger, turnSecret: cfg.TURNSecret, turnTTL: cfg.TURNCredentialTTL}
+
+	// Configure interceptors for RTCP handling
+	interceptorRegistry := &interceptor.Registry{}
+	onEstimator := func(estimator cc.BandwidthEstimator) { factory.bwe = estimator }
+	onStats := func(getter stats.Getter) { factory.rtpStats = getter }
+	if err := registerInterceptors(mediaEngine, interceptorRegistry, optionalInterceptors(cfg, onEstimator, onStats)); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	if len(factory.iceServers) == 0 {
+		factory.iceServers = defaultICEServers
+	}
+	settingEngine := webrtc.SettingEngine{}
+	switch {
+	case cfg.MuxPort != 0:
+		mux, err := ice.NewMultiUDPMuxFromPort(cfg.MuxPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on UDP mux port %d: %w", cfg.MuxPort, err)
+		}
+		settingEngine.SetICEUDPMux(mux)
+		factory.mux = mux
+	case cfg.UDPPortMin != 0 && cfg.UDPPortMax != 0:
+		if err := settingEngine.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax); err != nil {
+			return nil, fmt.Errorf("failed to set UDP port range: %w", err)
+		}
+		factory.udpMin, factory.udpMax = cfg.UDPPortMin, cfg.UDPPortMax
+	}
+
+	if len(cfg.PublicIPs) > 0 {
+		settingEngine.SetNAT1To1IPs(cfg.PublicIPs, cfg.PublicIPCandidateType)
+	}
+
+	if cfg.ICEDisconnectedTimeout > 0 || cfg.ICEFailedTimeout > 0 {
+		disconnected, failed := defaultICEDisconnectedTimeout, defaultICEFailedTimeout
+		if cfg.ICEDisconnectedTimeout > 0 {
+			disconnected = cfg.ICEDisconnectedTimeout
+		}
+		if cfg.ICEFailedTimeout > 0 {
+			failed = cfg.ICEFailedTimeout
+		}
+		settingEngine.SetICETimeouts(disconnected, failed, defaultICEKeepalive)
+	}
+
+	if cfg.Logger != nil {
+		settingEngine.LoggerFactory = pionLoggerFactory{logger: cfg.Logger}
+	}
+
+	// Create API with configured engine
+	factory.mediaEngine, factory.registry, factory.settingEngine = mediaEngine, interceptorRegistry, settingEngine
+	factory.api = webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine),
+	)
+	return factory, nil
+}
+
+// nackHistorySize is how many forwarded packets per video track are kept
+// for retransmission. pion's default of 1024 covers well under a second of
+// high-bitrate screen share, too little for a viewer on a lossy mobile link.
+const nackHistorySize = 4096
+
+// optionalInterceptor is RTCP handling a connection can do without. If
+// setting one up fails, connections come up without that feature.
+type optionalInterceptor struct {
+	name  string
+	setup func(m *webrtc.MediaEngine, registry *interceptor.Registry) error
+}
+
+// optionalInterceptors returns the interceptors cfg leaves enabled, in
+// registration order. onEstimator receives each new connection's bandwidth
+// estimator and onStats its RTP stream stats.
+func optionalInterceptors(cfg PeerConfig, onEstimator func(cc.BandwidthEstimator), onStats func(stats.Getter)) []optionalInterceptor {
+	var set []optionalInterceptor
+	if !cfg.DisableNACK {
+		set = append(set, optionalInterceptor{"NACK", registerNACK})
+	}
+	set = append(set,
+		optionalInterceptor{"RTCP reports", func(_ *webrtc.MediaEngine, registry *interceptor.Registry) error {
+			return webrtc.ConfigureRTCPReports(registry)
+		}},
+		optionalInterceptor{"TWCC", webrtc.ConfigureTWCCSender},
+		optionalInterceptor{"RTP stats", registerRTPStats(onStats)},
+	)
+	if !cfg.DisablePLI {
+		set = append(set, optionalInterceptor{"interval PLI", registerIntervalPLI})
+	}
+	if !cfg.DisableBWE {
+		set = append(set, optionalInterceptor{"bandwidth estimation", registerBWE(onEstimator)})
+	}
+	return set
+}
+
+// registerInterceptors sets up what webrtc.RegisterDefaultInterceptors
+// does, plus periodic keyframe requests. Only what the media engine needs
+// is required; an optional interceptor that fails is logged and skipped.
+func registerInterceptors(m *webrtc.MediaEngine, registry *interceptor.Registry, optional []optionalInterceptor) error {
+	// RID header extensions are needed to receive simulcast
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return err
+	}
+	// Viewers send keyframe requests as PLIs whether or not NACK is on
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+
+	for _, o := range optional {
+		if err := o.setup(m, registry); err != nil {
+			slog.Warn("Continuing without interceptor", "interceptor", o.name, "err", err)
+		}
+	}
+	return nil
+}
+
+// registerNACK has lost packets from publishers asked for again. Viewers'
+// NACKs are answered from the tracks' shared history rather than by pion's
+// responder (see rtx.go), so loss is repaired without waiting for a
+// keyframe.
+func registerNACK(m *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	registry.Add(generator)
+	return nil
+}
+
+// registerIntervalPLI has broadcasters asked for a keyframe every few
+// seconds, bounding how long a viewer that missed one sees no picture
+func registerIntervalPLI(_ *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	pli, err := intervalpli.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	registry.Add(pli)
+	return nil
+}
+
+// createPeerConnection creates a new peer connection for role in roomID,
+// along with its pre-negotiated control data channel. iceServers overrides
+// the factory's servers when non-empty.
+func (f *peerFactory) createPeerConnection(roomID, role string, iceServers []webrtc.ICEServer) (*webrtc.PeerConnection, *webrtc.DataChannel, error) {
+	pc, control, _, err := f.connectPeer(roomID, role, "", iceServers)
+	return pc, control, err
+}
+
+// connectPeer is createPeerConnection for the peer peerID, which tags the
+// connection's logs. It also returns the connection's bandwidth estimator,
+// nil if estimation is disabled.
+func (f *peerFactory) connectPeer(roomID, role, peerID string, iceServers []webrtc.ICEServer) (*webrtc.PeerConnection, *webrtc.DataChannel, cc.BandwidthEstimator, error) {
+	if len(iceServers) == 0 {
+		iceServers = f.iceServers
+	}
+	config := webrtc.Configuration{ICEServers: f.serversFor(iceServers, roomID)}
+
+	api := f.api
+	if f.logger != nil {
+		// pion creates its loggers per connection, so an API per connection
+		// is enough to tag them; the engines themselves are shared
+		settingEngine := f.settingEngine
+		logger := f.logger.With("roomId", roomID, "role", role)
+		if peerID != "" {
+			logger = logger.With("peerId", peerID)
+		}
+		settingEngine.LoggerFactory = pionLoggerFactory{logger: logger}
+		api = webrtc.NewAPI(
+			webrtc.WithMediaEngine(f.mediaEngine),
+			webrtc.WithInterceptorRegistry(f.registry),
+			webrtc.WithSettingEngine(settingEngine),
+		)
+	}
+
+	// The estimator and stats are built, and handed to the factory, by
+	// NewPeerConnection
+	f.bweMu.Lock()
+	f.bwe, f.rtpStats = nil, nil
+	pc, err := api.NewPeerConnection(config)
+	estimator, rtpStats := f.bwe, f.rtpStats
+	f.bweMu.Unlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if rtpStats != nil {
+		f.trackStats(pc, rtpStats)
+	}
+
+	control, err := createControlChannel(pc)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create control channel: %w", err)
+	}
+	if logger := peerLog(roomID, role, peerID); logger.Enabled(context.Background(), slog.LevelDebug) {
+		logICE(logger, pc)
+	}
+
+	return pc, control, estimator, nil
+}
+
+// Close releases the shared UDP mux, if any
+func (f *peerFactory) Close() error {
+	if f.mux != nil {
+		return f.mux.Close()
+	}
+	return nil
+}
+
+// checkUDP reports whether a new connection could bind its media socket:
+// the mux's is bound at startup, otherwise a port must be free in the
+// configured range
+func (f *peerFactory) checkUDP() error {
+	if f.mux != nil {
+		return nil
+	}
+	lo, hi := int(f.udpMin), int(f.udpMax)
+	if lo == 0 || hi == 0 {
+		lo, hi = 0, 0
+	}
+	var err error
+	for port := lo; port <= hi; port++ {
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port}); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	if lo == 0 {
+		return fmt.Errorf("cannot bind a UDP socket: %w", err)
+	}
+	return fmt.Errorf("no free UDP port in %d-%d: %w", lo, hi, err)
+}
+
+// waitForGathering waits for ICE gathering to complete, up to the configured
+// timeout, then logs the negotiated SDP at debug level to logger. On timeout
+// the answer is sent with whatever candidates were gathered; it returns
+// false only if there are none. The wait is a child span of ctx's.
+func (s *Server) waitForGathering(ctx context.Context, pc *webrtc.PeerConnection, gatherComplete <-chan struct{}, logger *slog.Logger) bool {
+	_, span := s.tracer.Start(ctx, "ice.gathering")
+	defer span.End()
+	if s.cfg.Peer.ICETimeout <= 0 {
+		<-gatherComplete
+		logSDP(logger, pc)
+		return true
+	}
+
+	timer := time.NewTimer(s.cfg.Peer.ICETimeout)
+	defer timer.Stop()
+
+	select {
+	case <-gatherComplete:
+		logSDP(logger, pc)
+		return true
+	case <-timer.C:
+	}
+
+	hasCandidates := strings.Contains(pc.LocalDescription().SDP, "a=candidate:")
+	span.SetAttributes(attribute.Bool("ice.timed_out", true), attribute.Bool("ice.candidates_gathered", hasCandidates))
+	if !hasCandidates {
+		span.SetStatus(codes.Error, "ICE gathering timed out")
+	}
+	logger.Warn("ICE gathering timed out; check STUN/TURN reachability",
+		"timeout", s.cfg.Peer.ICETimeout, "candidatesGathered", hasCandidates)
+	if hasCandidates {
+		logSDP(logger, pc)
+	}
+	return hasCandidates
+}
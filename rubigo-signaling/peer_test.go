@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestValidatePublicIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		ips     []string
+		wantErr bool
+	}{
+		{"unset", nil, false},
+		{"one for all", []string{"203.0.113.7"}, false},
+		{"one per family", []string{"203.0.113.7", "2001:db8::7"}, false},
+		{"mapped", []string{"203.0.113.7/10.0.0.7", "203.0.113.8/10.0.0.8"}, false},
+		{"not an IP", []string{"sfu.example.com"}, true},
+		{"two for all", []string{"203.0.113.7", "203.0.113.8"}, true},
+		{"sole and mapped", []string{"203.0.113.7", "203.0.113.8/10.0.0.8"}, true},
+		{"mapped and sole", []string{"203.0.113.8/10.0.0.8", "203.0.113.7"}, true},
+		{"mixed families", []string{"203.0.113.7/fd00::7"}, true},
+		{"private mapped twice", []string{"203.0.113.7/10.0.0.7", "203.0.113.8/10.0.0.7"}, true},
+		{"bad private", []string{"203.0.113.7/"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePublicIPs(tt.ips); (err != nil) != tt.wantErr {
+				t.Errorf("validatePublicIPs(%q) = %v, wantErr %v", tt.ips, err, tt.wantErr)
+			}
+		})
+	}
+
+	for s, want := range map[string]webrtc.ICECandidateType{"host": webrtc.ICECandidateTypeHost, "srflx": webrtc.ICECandidateTypeSrflx} {
+		if got, err := parsePublicIPCandidateType(s); err != nil || got != want {
+			t.Errorf("parsePublicIPCandidateType(%q) = %v, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"relay", "prflx", ""} {
+		if _, err := parsePublicIPCandidateType(s); err == nil {
+			t.Errorf("parsePublicIPCandidateType(%q) accepted", s)
+		}
+	}
+}
+
+func TestPeerFactoryPublicIP(t *testing.T) {
+	for _, candidateType := range []webrtc.ICECandidateType{webrtc.ICECandidateTypeHost, webrtc.ICECandidateTypeSrflx} {
+		t.Run(candidateType.String(), func(t *testing.T) {
+			factory, err := newPeerFactory(PeerConfig{PublicIPs: []string{"203.0.113.7"}, PublicIPCandidateType: candidateType})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer factory.Close()
+			pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			offer := gatheredOffer(t, pc, nil)
+
+			var public, private bool
+			for _, line := range strings.Split(offer, "\r\n") {
+				// foundation component transport priority address port typ type
+				fields := strings.Fields(strings.TrimPrefix(line, "a=candidate:"))
+				if len(fields) < 8 || fields[2] != "udp" {
+					continue
+				}
+				switch ip := net.ParseIP(fields[4]); {
+				case fields[4] == "203.0.113.7" && fields[7] == candidateType.String():
+					public = true
+				case ip != nil && ip.To4() != nil && fields[7] == "host":
+					// The mapping is for IPv4 only, so IPv6 hosts stay
+					private = true
+				}
+			}
+			if !public {
+				t.Errorf("no %s candidate for the public IP in\n%s", candidateType, offer)
+			}
+			// Host mapping hides the private addresses; srflx keeps them
+			if want := candidateType == webrtc.ICECandidateTypeSrflx; private != want {
+				t.Errorf("private host candidates = %v, want %v", private, want)
+			}
+		})
+	}
+}
+
+func TestValidateUDPPortRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		min, max      int
+		expectedConns int
+		wantErr       bool
+	}{
+		{"unset", 0, 0, 0, false},
+		{"valid", 50000, 50100, 0, false},
+		{"single port", 50000, 50000, 0, false},
+		{"only min", 50000, 0, 0, true},
+		{"only max", 0, 50000, 0, true},
+		{"inverted", 50100, 50000, 0, true},
+		{"out of range", 50000, 70000, 0, true},
+		{"too small for concurrency", 50000, 50009, 20, true},
+		{"fits concurrency", 50000, 50019, 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUDPPortRange(tt.min, tt.max, tt.expectedConns)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUDPPortRange(%d, %d, %d) = %v, wantErr %v", tt.min, tt.max, tt.expectedConns, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreatePeerConnectionWithCodecs(t *testing.T) {
+	for _, codecs := range [][]string{nil, {"vp8", "opus"}, {"vp9", "av1", "h264", "pcmu"}} {
+		factory, err := newPeerFactory(PeerConfig{Codecs: codecs})
+		if err != nil {
+			t.Fatalf("newPeerFactory(%v): %v", codecs, err)
+		}
+		pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+		if err != nil {
+			t.Fatalf("createPeerConnection(%v): %v", codecs, err)
+		}
+		pc.Close()
+		factory.Close()
+	}
+}
+
+func TestPeerFactoryUDPMux(t *testing.T) {
+	// Find a free port, then hand it to the mux
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	factory, err := newPeerFactory(PeerConfig{MuxPort: port})
+	if err != nil {
+		t.Fatalf("newPeerFactory: %v", err)
+	}
+	defer factory.Close()
+
+	// Several connections share the one mux
+	for i := 0; i < 3; i++ {
+		pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+		if err != nil {
+			t.Fatalf("createPeerConnection: %v", err)
+		}
+		pc.Close()
+	}
+}
+
+func TestViewerSenderUsesRTX(t *testing.T) {
+	for _, codecs := range [][]string{nil, {"vp8"}} {
+		factory, err := newPeerFactory(PeerConfig{Codecs: codecs})
+		if err != nil {
+			t.Fatalf("newPeerFactory(%v): %v", codecs, err)
+		}
+		pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+		if err != nil {
+			t.Fatalf("createPeerConnection(%v): %v", codecs, err)
+		}
+
+		sender, err := pc.AddTrack(newLiveTrack(t))
+		if err != nil {
+			t.Fatalf("AddTrack(%v): %v", codecs, err)
+		}
+		params := sender.GetParameters()
+		if len(params.Encodings) == 0 || params.Encodings[0].RTX.SSRC == 0 {
+			t.Errorf("codecs %v: sender has no RTX SSRC: %+v", codecs, params.Encodings)
+		}
+		hasRTX := false
+		for _, codec := range params.Codecs {
+			if codec.MimeType == webrtc.MimeTypeRTX {
+				hasRTX = true
+			}
+		}
+		if !hasRTX {
+			t.Errorf("codecs %v: no RTX codec negotiated for viewer sender", codecs)
+		}
+
+		pc.Close()
+		factory.Close()
+	}
+}
+
+func TestValidateICEServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []webrtc.ICEServer
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"stun", []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}, false},
+		{"turn with credentials", []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478?transport=tcp"}, Username: "u", Credential: "p"}}, false},
+		{"no urls", []webrtc.ICEServer{{}}, true},
+		{"bad url", []webrtc.ICEServer{{URLs: []string{"http://example.com"}}}, true},
+		{"turn without credentials", []webrtc.ICEServer{{URLs: []string{"turns:turn.example.com"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateICEServers(tt.servers); (err != nil) != tt.wantErr {
+				t.Errorf("validateICEServers = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreatePeerConnectionICEServers(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+
+	custom := []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}}
+	for _, tt := range []struct {
+		servers []webrtc.ICEServer
+		want    string
+	}{
+		{nil, defaultICEServers[0].URLs[0]},
+		{custom, custom[0].URLs[0]},
+	} {
+		pc, _, err := factory.createPeerConnection("abc", "viewer", tt.servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := pc.GetConfiguration().ICEServers
+		if len(got) != 1 || len(got[0].URLs) != 1 || got[0].URLs[0] != tt.want {
+			t.Errorf("ICEServers = %+v, want %s", got, tt.want)
+		}
+		pc.Close()
+	}
+}
+
+func TestRegisterInterceptorsSkipsFailures(t *testing.T) {
+	ran := false
+	optional := []optionalInterceptor{
+		{"broken", func(*webrtc.MediaEngine, *interceptor.Registry) error { return errors.New("unsupported") }},
+		{"working", func(*webrtc.MediaEngine, *interceptor.Registry) error { ran = true; return nil }},
+	}
+	if err := registerInterceptors(&webrtc.MediaEngine{}, &interceptor.Registry{}, optional); err != nil {
+		t.Fatalf("optional interceptor failure was fatal: %v", err)
+	}
+	if !ran {
+		t.Error("interceptors after a failed one were not registered")
+	}
+}
+
+func TestPeerFactoryDisableInterceptors(t *testing.T) {
+	names := func(set []optionalInterceptor) (s []string) {
+		for _, o := range set {
+			s = append(s, o.name)
+		}
+		return s
+	}
+	if got := names(optionalInterceptors(PeerConfig{DisableNACK: true, DisablePLI: true, DisableBWE: true}, nil, nil)); strings.Join(got, ",") != "RTCP reports,TWCC,RTP stats" {
+		t.Errorf("optional interceptors = %v, want only RTCP reports, TWCC and RTP stats", got)
+	}
+
+	factory, err := newPeerFactory(PeerConfig{DisableNACK: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.AddTrack(newLiveTrack(t)); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(offer.SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=rtcp-fb:") && strings.HasSuffix(line, " nack") {
+			t.Errorf("NACK still offered with --disable-nack: %s", line)
+		}
+	}
+	// Keyframe requests from viewers are still negotiated
+	if !strings.Contains(offer.SDP, " nack pli") {
+		t.Error("PLI feedback missing with NACK disabled")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A co-presenter publishes alongside the room's broadcaster, e.g. a second
+// speaker's camera and microphone. Its tracks are forwarded like the
+// broadcaster's extra tracks, in an msid stream named after its peer ID so
+// viewers can tell presenters apart. The broadcaster alone decides whether
+// the room is live, and its main track is what viewers subscribe to and
+// what is recorded.
+
+// presenter is a co-presenter's connection
+type presenter struct {
+	pc      *webrtc.PeerConnection
+	control *webrtc.DataChannel
+	labels  map[string]string // by mid, as for SetTrackLabels
+}
+
+// SetPresenter makes pc, with its control channel, the connection of the
+// co-presenter peerID, returning the connection it replaces, if any. Tracks
+// from the old connection are ignored from then on.
+func (r *Room) SetPresenter(peerID string, pc *webrtc.PeerConnection, control *webrtc.DataChannel) *webrtc.PeerConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var replaced *webrtc.PeerConnection
+	if old := r.presenters[peerID]; old != nil {
+		replaced = old.pc
+	}
+	if r.presenters == nil {
+		r.presenters = make(map[string]*presenter)
+	}
+	r.presenters[peerID] = &presenter{pc: pc, control: control}
+	return replaced
+}
+
+// PresenterPC returns the connection of the co-presenter peerID, or nil
+func (r *Room) PresenterPC(peerID string) *webrtc.PeerConnection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p := r.presenters[peerID]; p != nil {
+		return p.pc
+	}
+	return nil
+}
+
+// PresenterCount returns the number of co-presenters
+func (r *Room) PresenterCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.presenters)
+}
+
+// RemovePresenter forgets pc if it is still the connection of the
+// co-presenter peerID, ending its tracks as DetachBroadcasterSource ends an
+// extra track. It reports whether pc was removed.
+func (r *Room) RemovePresenter(peerID string, pc *webrtc.PeerConnection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p := r.presenters[peerID]; p == nil || p.pc != pc {
+		return false
+	}
+	delete(r.presenters, peerID)
+	r.clearPresenterLocked(peerID)
+	return true
+}
+
+// clearPresenterLocked detaches the sources of peerID's tracks. The caller
+// must hold r.mu.
+func (r *Room) clearPresenterLocked(peerID string) {
+	for key, track := range r.published {
+		if source := track.Source(); key.peerID == peerID && source != nil {
+			track.ClearSource(source)
+		}
+	}
+}
+
+// closePresenters sends msg to every co-presenter, then closes and removes
+// them all, returning how many there were
+func (r *Room) closePresenters(msg controlMessage) int {
+	r.mu.Lock()
+	closing := make([]*presenter, 0, len(r.presenters))
+	for peerID, p := range r.presenters {
+		closing = append(closing, p)
+		r.clearPresenterLocked(peerID)
+	}
+	r.presenters = nil
+	r.mu.Unlock()
+
+	for _, p := range closing {
+		sendControlMessage(p.control, msg)
+		p.pc.Close()
+	}
+	return len(closing)
+}
+
+// publisherPCLocked returns the connection of the co-presenter peerID, or
+// the broadcaster's for an empty peerID. The caller must hold r.mu.
+func (r *Room) publisherPCLocked(peerID string) *webrtc.PeerConnection {
+	if peerID == "" {
+		return r.broadcaster.pc
+	}
+	if p := r.presenters[peerID]; p != nil {
+		return p.pc
+	}
+	return nil
+}
+
+// publisherPC returns the connection feeding track: its co-presenter's, or
+// else the broadcaster's
+func (r *Room) publisherPC(track *forwardingTrack) *webrtc.PeerConnection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key, published := range r.published {
+		if published == track {
+			return r.publisherPCLocked(key.peerID)
+		}
+	}
+	return r.broadcaster.pc
+}
+
+// SetPresenterLabels is SetTrackLabels for the co-presenter peerID
+func (r *Room) SetPresenterLabels(peerID string, labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.presenters[peerID]
+	if p == nil {
+		return
+	}
+	for mid, label := range labels {
+		if p.labels == nil {
+			p.labels = make(map[string]string)
+		}
+		p.labels[mid] = label
+	}
+}
+
+// presenterLabel returns the label of the co-presenter's track in media
+// section mid. Unlabeled tracks are named after their kind and mid.
+func (r *Room) presenterLabel(peerID, mid string, kind webrtc.RTPCodecType) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p := r.presenters[peerID]; p != nil && p.labels[mid] != "" {
+		return p.labels[mid]
+	}
+	return kind.String() + "-" + mid
+}
+
+// presenterLog returns the logger for the co-presenter peerID
+func (r *Room) presenterLog(peerID string) *slog.Logger {
+	return peerLog(r.id, "presenter", peerID)
+}
+
+// handlePresentWithID handles POST /internal/room/{id}/present
+// A co-presenter sends an SDP offer and receives an answer. It may name
+// itself with peerId, and a co-presenter reconnecting under the same ID
+// replaces its old connection and resumes its tracks.
+func (s *Server) handlePresentWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	if s.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, errCodeDraining, "Server is draining")
+		return
+	}
+
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+	if offer.PeerID == "" {
+		offer.PeerID = newPeerID()
+	} else if !validViewerID(offer.PeerID) || offer.PeerID == hostStreamID {
+		// The ID names the co-presenter's stream, which mustn't look
+		// like the broadcaster's
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "peerId must be 1-64 letters, digits, '-' or '_', other than "+hostStreamID)
+		return
+	}
+	peerID := offer.PeerID
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	if !room.CheckPassword(offer.Password) {
+		writeError(w, http.StatusForbidden, errCodeInvalidPassword, "Invalid room password")
+		return
+	}
+	if s.overQuota(room) {
+		writeErrorDetails(w, http.StatusForbidden, errCodeQuotaExceeded, "Room byte quota exceeded", map[string]interface{}{
+			"byteQuota": s.cfg.RoomByteQuota,
+		})
+		return
+	}
+	codecs := s.receiveCodecs(room)
+	if !checkOfferCodecs(w, offer.SDP, codecs) {
+		return
+	}
+	// A reconnecting co-presenter replaces its connection rather than
+	// adding one
+	if room.PresenterPC(peerID) == nil && !s.admitPeer(w) {
+		return
+	}
+
+	logger := room.presenterLog(peerID)
+	tagPeer(r.Context(), "presenter", peerID)
+	publishSpan := trace.SpanContextFromContext(r.Context())
+	pc, control, _, err := s.peers.connectPeer(roomID, "presenter", peerID, room.ICEServers())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create peer connection: %v", err))
+		return
+	}
+	// Until the answer is sent, any failure leaves pc unused
+	presenting := false
+	defer func() {
+		if !presenting {
+			room.RemovePresenter(peerID, pc)
+			pc.Close()
+		}
+	}()
+
+	// Take over from an earlier connection before any track can arrive,
+	// as publish does for the broadcaster
+	if old := room.SetPresenter(peerID, pc, control); old != nil {
+		logger.Info("Co-presenter reconnected, replacing its connection")
+		old.Close()
+	}
+	room.SetPresenterLabels(peerID, offer.TrackLabels)
+
+	// pion adds a receiving transceiver for each media section offered
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		var mid string
+		if t := transceiverFor(pc, receiver); t != nil {
+			mid = t.Mid()
+		}
+		key := trackKey{peerID: peerID, trackID: room.presenterLabel(peerID, mid, remoteTrack.Kind())}
+		local, reused, err := room.AttachPublishedSource(pc, key, remoteTrack)
+		if errors.Is(err, errBroadcasterReplaced) {
+			logger.Info("Ignoring track from replaced co-presenter connection", "track", key.trackID)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create local track", "track", key.trackID, "err", err)
+			return
+		}
+		if reused {
+			logger.Info("Co-presenter resumed track", "track", key.trackID, "codec", remoteTrack.Codec().MimeType)
+		} else {
+			logger.Info("Co-presenter added track", "track", key.trackID, "codec", remoteTrack.Codec().MimeType)
+		}
+		go s.forwardBroadcasterTrack(room, remoteTrack, local, publishSpan)
+		go offerTracksToViewers(room)
+	})
+
+	gatherComplete, err := s.answerOffer(r.Context(), pc, offer.SDP, codecs)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return
+	}
+
+	presenting = true
+	room.AddControlChannel(control)
+	room.AcceptDataChannels(pc)
+	connecting := s.startConnectSpan(r.Context())
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		connecting.observe(state)
+		s.notifyConnectionState(roomID, "presenter", state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			if err := pc.Close(); err != nil {
+				logger.Error("Failed to close co-presenter", "err", err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			if room.RemovePresenter(peerID, pc) {
+				logger.Info("Co-presenter left")
+			}
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SDPExchange{
+		Type:   "answer",
+		SDP:    pc.LocalDescription().SDP,
+		PeerID: peerID,
+	})
+}
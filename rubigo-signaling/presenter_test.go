@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestPC returns a peer connection closed when the test ends
+func newTestPC(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestRoomPresenters(t *testing.T) {
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	first, second := newTestPC(t), newTestPC(t)
+	if replaced := room.SetPresenter("guest", first, nil); replaced != nil {
+		t.Errorf("first SetPresenter replaced %p", replaced)
+	}
+	room.SetPresenterLabels("guest", map[string]string{"0": "camera"})
+	if label := room.presenterLabel("guest", "0", webrtc.RTPCodecTypeVideo); label != "camera" {
+		t.Errorf("labeled track = %q, want camera", label)
+	}
+	if label := room.presenterLabel("guest", "1", webrtc.RTPCodecTypeAudio); label != "audio-1" {
+		t.Errorf("unlabeled track = %q, want audio-1", label)
+	}
+
+	key := trackKey{peerID: "guest", trackID: "camera"}
+	camera, _, err := room.AttachPublishedSource(first, key, &webrtc.TrackRemote{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if camera.StreamID() != "guest" || camera.ID() != "camera" {
+		t.Errorf("co-presenter track msid = %q %q, want guest camera", camera.StreamID(), camera.ID())
+	}
+	if _, _, err := room.AttachPublishedSource(second, key, &webrtc.TrackRemote{}); !errors.Is(err, errBroadcasterReplaced) {
+		t.Errorf("attach from another connection = %v, want errBroadcasterReplaced", err)
+	}
+	if room.publisherPC(camera) != first {
+		t.Error("keyframe requests for the co-presenter's track don't go to its connection")
+	}
+	tracks := room.Tracks()
+	if len(tracks) != 2 || tracks[1].PeerID != "guest" || tracks[1].StreamID != "guest" || tracks[1].Label != "camera" {
+		t.Errorf("Tracks = %+v, want the screen then guest's camera", tracks)
+	}
+
+	// A reconnect replaces the connection, and only the current one
+	// leaving removes the co-presenter
+	if replaced := room.SetPresenter("guest", second, nil); replaced != first {
+		t.Errorf("SetPresenter replaced %p, want the first connection", replaced)
+	}
+	if room.RemovePresenter("guest", first) {
+		t.Error("the replaced connection removed the co-presenter")
+	}
+	if !room.RemovePresenter("guest", second) || room.PresenterCount() != 0 {
+		t.Error("co-presenter not removed")
+	}
+	if camera.Source() != nil || room.GetBroadcasterTrack() == nil {
+		t.Error("co-presenter leaving didn't end just its tracks")
+	}
+
+	room.SetPresenter("guest", newTestPC(t), nil)
+	if n := room.closePresenters(controlMessage{Type: EventRoomClosed}); n != 1 || room.PresenterCount() != 0 {
+		t.Errorf("closePresenters = %d, want 1 and none left", n)
+	}
+}
+
+func TestSubscribeAnswerIncludesPublishedTracks(t *testing.T) {
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	room.published = map[trackKey]*forwardingTrack{}
+	for _, key := range []trackKey{{trackID: "camera"}, {peerID: "guest", trackID: "camera"}} {
+		track, err := newStreamTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, key.trackID, key.streamID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		track.SetSource(&webrtc.TrackRemote{})
+		room.published[key] = track
+	}
+	h := newTestServer(t, store)
+
+	// Two video sections: the screen and one more, which the broadcaster's
+	// camera gets ahead of the co-presenter's
+	client := newTestPC(t)
+	for i := 0; i < 2; i++ {
+		if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: offer.SDP})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Tracks) != 2 || answer.Tracks[1].Label != "camera" || answer.Tracks[1].PeerID != "" || answer.Tracks[1].Mid == "" {
+		t.Errorf("answer tracks = %+v, want the screen and the broadcaster's camera", answer.Tracks)
+	}
+	if !strings.Contains(answer.SDP, "msid:"+hostStreamID+" camera") {
+		t.Error("answer doesn't send the camera in the broadcaster's stream")
+	}
+}
+
+func TestPresent(t *testing.T) {
+	store := newFakeStore("abc")
+	h := newTestServer(t, store)
+
+	for _, tt := range []struct {
+		name, path, body string
+		want             int
+	}{
+		{"room not found", "/internal/room/missing/present", `{"type":"offer","sdp":""}`, http.StatusNotFound},
+		{"invalid peer ID", "/internal/room/abc/present", `{"type":"offer","sdp":"","peerId":"a/b"}`, http.StatusBadRequest},
+		{"broadcaster's stream", "/internal/room/abc/present", `{"type":"offer","sdp":"","peerId":"screen-share"}`, http.StatusBadRequest},
+	} {
+		if rec := doRequest(t, h, http.MethodPost, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "camera", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTrack(sending); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	mid := client.GetTransceivers()[0].Mid()
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP, PeerID: "guest", TrackLabels: map[string]string{mid: "camera"}})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/present", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("present status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.PeerID != "guest" {
+		t.Errorf("answer peerId = %q, want guest", answer.PeerID)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The track only arrives with its first packets
+	room := store.Get("abc")
+	key := trackKey{peerID: "guest", trackID: "camera"}
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := uint16(0); room.PublishedTracks()[key] == nil; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("published tracks = %v, want guest's camera", room.PublishedTracks())
+		}
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if room.GetBroadcasterTrack() != nil {
+		t.Error("co-presenter's track became the main broadcast")
+	}
+
+	if summary := room.Close(); summary.Presenters != 1 {
+		t.Errorf("teardown = %+v, want one co-presenter", summary)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Every few seconds the viewers' latest receiver reports are summarized
+// per track: the median and worst loss, jitter and round trip time among
+// those reporting on it. Room status carries the summary and /metrics
+// exports it, so monitoring can page on a room whose median viewer is
+// losing packets rather than on one viewer's bad link. Past the server's
+// QualityLossAlert the room's event stream says so too.
+
+// qualityInterval is how often rooms' quality summaries are updated
+const qualityInterval = 5 * time.Second
+
+// qualityStat is the median and worst of the viewers' figures
+type qualityStat struct {
+	Median float64 `json:"median"`
+	Worst  float64 `json:"worst"`
+}
+
+// TrackQuality summarizes how a track's viewers receive it
+type TrackQuality struct {
+	Label  string `json:"label"`
+	PeerID string `json:"peerId,omitempty"`
+	Kind   string `json:"kind"`
+	// Viewers is how many viewers have reported on the track
+	Viewers      int         `json:"viewers"`
+	FractionLost qualityStat `json:"fractionLost"`
+	JitterMs     qualityStat `json:"jitterMs"`
+	// RTTMs is omitted until a viewer's report carries a round trip time,
+	// which takes a sender report from the SFU first
+	RTTMs *qualityStat `json:"rttMs,omitempty"`
+}
+
+// receptionReport is a viewer's latest receiver report on one track
+type receptionReport struct {
+	loss, jitterMs, rttMs float64
+	hasRTT                bool
+}
+
+// summarizeQuality updates every room's quality summary each interval,
+// until done is closed
+func (s *Server) summarizeQuality(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, room := range s.rooms.Rooms() {
+				room.setQuality(s.peers.trackQuality(room), s.cfg.QualityLossAlert)
+			}
+		}
+	}
+}
+
+// setQuality records the room's latest quality summary. Unless threshold
+// is zero it then publishes quality_degraded for each track whose median
+// loss has risen above it, and quality_recovered for each alerted track
+// whose median has fallen below half of it, so a track hovering at the
+// threshold doesn't flap. A track no longer reported on drops its alert
+// quietly; the events of its publisher leaving say why.
+func (r *Room) setQuality(quality []TrackQuality, threshold float64) {
+	var events []RoomEvent
+	r.mu.Lock()
+	r.quality = quality
+	alerts := make(map[trackKey]struct{})
+	for i := range quality {
+		q := &quality[i]
+		key := trackKey{peerID: q.PeerID, trackID: q.Label}
+		_, alerted := r.qualityAlerts[key]
+		switch {
+		case threshold <= 0:
+		case !alerted && q.FractionLost.Median > threshold:
+			alerted = true
+			events = append(events, RoomEvent{Type: EventQualityDegraded, Quality: q})
+		case alerted && q.FractionLost.Median < threshold/2:
+			alerted = false
+			events = append(events, RoomEvent{Type: EventQualityRecovered, Quality: q})
+		}
+		if alerted {
+			alerts[key] = struct{}{}
+		}
+	}
+	r.qualityAlerts = alerts
+	r.mu.Unlock()
+
+	for _, event := range events {
+		r.publishRoomEvent(event)
+	}
+}
+
+// Quality returns the room's latest quality summary, one entry per track
+// viewers have reported on, in the order of Tracks
+func (r *Room) Quality() []TrackQuality {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.quality
+}
+
+// trackQuality summarizes the latest receiver reports of the room's
+// viewers on each of its tracks
+func (f *peerFactory) trackQuality(room *Room) []TrackQuality {
+	reports := make(map[trackKey][]receptionReport)
+	main := trackKey{trackID: room.MainLabel()}
+	room.ForEachViewer(func(v *viewer) {
+		entry, _ := f.streamStats.Load(v.pc)
+		streams, _ := entry.(*streamStats)
+		if streams == nil {
+			return
+		}
+		senders := make(map[trackKey]*webrtc.RTPSender)
+		v.mu.Lock()
+		// A paused viewer's reports are of media it no longer gets
+		if !v.paused {
+			senders[main] = v.sender
+			if v.audioSender != nil {
+				senders[trackKey{trackID: "audio"}] = v.audioSender
+			}
+			for key, extra := range v.extras {
+				senders[key] = extra.sender
+			}
+		}
+		v.mu.Unlock()
+
+		for key, sender := range senders {
+			if report, ok := senderReport(streams, sender); ok {
+				reports[key] = append(reports[key], report)
+			}
+		}
+	})
+
+	var quality []TrackQuality
+	for _, info := range room.Tracks() {
+		key := trackKey{peerID: info.PeerID, trackID: info.Label}
+		if len(reports[key]) == 0 {
+			continue
+		}
+		quality = append(quality, summarizeReports(info, reports[key]))
+	}
+	return quality
+}
+
+// senderReport returns the viewer's latest receiver report on what sender
+// sends it, reporting false if it hasn't sent one
+func senderReport(streams *streamStats, sender *webrtc.RTPSender) (receptionReport, bool) {
+	for _, encoding := range sender.GetParameters().Encodings {
+		s := streams.getter.Get(uint32(encoding.SSRC))
+		if s == nil {
+			continue
+		}
+		remote := s.RemoteInboundRTPStreamStats
+		if remote.PacketsReceived == 0 && remote.PacketsLost == 0 {
+			continue
+		}
+		return receptionReport{
+			loss:     remote.FractionLost,
+			jitterMs: remote.Jitter * 1000,
+			rttMs:    float64(remote.RoundTripTime.Microseconds()) / 1000,
+			hasRTT:   remote.RoundTripTimeMeasurements > 0,
+		}, true
+	}
+	return receptionReport{}, false
+}
+
+// summarizeReports is the quality of the track info describes from its
+// viewers' reports
+func summarizeReports(info TrackInfo, reports []receptionReport) TrackQuality {
+	var loss, jitter, rtt []float64
+	for _, report := range reports {
+		loss = append(loss, report.loss)
+		jitter = append(jitter, report.jitterMs)
+		if report.hasRTT {
+			rtt = append(rtt, report.rttMs)
+		}
+	}
+	q := TrackQuality{
+		Label:        info.Label,
+		PeerID:       info.PeerID,
+		Kind:         info.Kind,
+		Viewers:      len(reports),
+		FractionLost: newQualityStat(loss),
+		JitterMs:     newQualityStat(jitter),
+	}
+	if len(rtt) > 0 {
+		stat := newQualityStat(rtt)
+		q.RTTMs = &stat
+	}
+	return q
+}
+
+// newQualityStat is the median and largest of values, which it sorts
+func newQualityStat(values []float64) qualityStat {
+	if len(values) == 0 {
+		return qualityStat{}
+	}
+	sort.Float64s(values)
+	n := len(values)
+	median := values[n/2]
+	if n%2 == 0 {
+		median = (values[n/2-1] + values[n/2]) / 2
+	}
+	return qualityStat{Median: median, Worst: values[n-1]}
+}
+
+// writeQualityMetrics writes each room's quality summary as gauges, per
+// track and with the median and worst as the stat label
+func (s *Server) writeQualityMetrics(w io.Writer) {
+	type roomQuality struct {
+		id     string
+		tracks []TrackQuality
+	}
+	var rooms []roomQuality
+	for _, room := range s.rooms.Rooms() {
+		if quality := room.Quality(); len(quality) > 0 {
+			rooms = append(rooms, roomQuality{room.id, quality})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].id < rooms[j].id })
+
+	labels := func(room string, q TrackQuality) string {
+		return fmt.Sprintf("room=%q,peer=%q,track=%q,kind=%q", room, q.PeerID, q.Label, q.Kind)
+	}
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	stat := func(name, help string, value func(TrackQuality) *qualityStat, scale float64) {
+		gauge(name, help)
+		for _, room := range rooms {
+			for _, q := range room.tracks {
+				if v := value(q); v != nil {
+					fmt.Fprintf(w, "%s{%s,stat=\"median\"} %s\n", name, labels(room.id, q), strconv.FormatFloat(v.Median*scale, 'g', -1, 64))
+					fmt.Fprintf(w, "%s{%s,stat=\"worst\"} %s\n", name, labels(room.id, q), strconv.FormatFloat(v.Worst*scale, 'g', -1, 64))
+				}
+			}
+		}
+	}
+
+	const reporting = "rubigo_track_reporting_viewers"
+	gauge(reporting, "Viewers whose receiver reports the track's quality summarizes.")
+	for _, room := range rooms {
+		for _, q := range room.tracks {
+			fmt.Fprintf(w, "%s{%s} %d\n", reporting, labels(room.id, q), q.Viewers)
+		}
+	}
+	stat("rubigo_track_fraction_lost", "Fraction of packets lost on the way to the track's viewers, from their receiver reports.",
+		func(q TrackQuality) *qualityStat { return &q.FractionLost }, 1)
+	stat("rubigo_track_jitter_seconds", "Interarrival jitter at the track's viewers, from their receiver reports.",
+		func(q TrackQuality) *qualityStat { return &q.JitterMs }, 0.001)
+	stat("rubigo_track_rtt_seconds", "Round trip time to the track's viewers, from their receiver reports.",
+		func(q TrackQuality) *qualityStat { return q.RTTMs }, 0.001)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestNewQualityStat(t *testing.T) {
+	for _, tt := range []struct {
+		values []float64
+		want   qualityStat
+	}{
+		{nil, qualityStat{}},
+		{[]float64{0.2}, qualityStat{Median: 0.2, Worst: 0.2}},
+		{[]float64{0.5, 0, 0.1}, qualityStat{Median: 0.1, Worst: 0.5}},
+		{[]float64{4, 1, 3, 2}, qualityStat{Median: 2.5, Worst: 4}},
+	} {
+		if got := newQualityStat(tt.values); got != tt.want {
+			t.Errorf("newQualityStat(%v) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeReports(t *testing.T) {
+	info := TrackInfo{Label: "camera", Kind: "video", PeerID: "guest"}
+	q := summarizeReports(info, []receptionReport{
+		{loss: 0.01, jitterMs: 3},
+		{loss: 0.2, jitterMs: 9},
+		{loss: 0.02, jitterMs: 4},
+	})
+	if q.Label != "camera" || q.PeerID != "guest" || q.Kind != "video" || q.Viewers != 3 {
+		t.Errorf("quality = %+v", q)
+	}
+	if q.FractionLost != (qualityStat{Median: 0.02, Worst: 0.2}) || q.JitterMs != (qualityStat{Median: 4, Worst: 9}) {
+		t.Errorf("loss %+v, jitter %+v", q.FractionLost, q.JitterMs)
+	}
+	// Round trips count only from the reports that had one
+	if q.RTTMs != nil {
+		t.Errorf("rtt = %+v without any measured", q.RTTMs)
+	}
+	q = summarizeReports(info, []receptionReport{{rttMs: 40, hasRTT: true}, {}})
+	if q.RTTMs == nil || *q.RTTMs != (qualityStat{Median: 40, Worst: 40}) {
+		t.Errorf("rtt = %+v, want the one measured", q.RTTMs)
+	}
+}
+
+func TestQualityAlerts(t *testing.T) {
+	room := &Room{id: "abc"}
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+	summary := func(loss float64) []TrackQuality {
+		return []TrackQuality{
+			{Label: "screen", Kind: "video", Viewers: 3, FractionLost: qualityStat{Median: loss, Worst: loss}},
+			{Label: "camera", PeerID: "guest", Kind: "video", Viewers: 3},
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if want == "" {
+				t.Errorf("unexpected %s event", event.Type)
+			} else if event.Type != want || event.Quality == nil || event.Quality.Label != "screen" {
+				t.Errorf("event = %+v, want %s for the screen", event, want)
+			}
+		default:
+			if want != "" {
+				t.Errorf("no %s event", want)
+			}
+		}
+	}
+
+	room.setQuality(summary(0.2), 0)
+	expect("")
+	room.setQuality(summary(0.01), 0.05)
+	expect("")
+	room.setQuality(summary(0.08), 0.05)
+	expect(EventQualityDegraded)
+	room.setQuality(summary(0.1), 0.05)
+	expect("")
+	// Recovery waits for the loss to fall well below the threshold
+	room.setQuality(summary(0.04), 0.05)
+	expect("")
+	room.setQuality(summary(0.02), 0.05)
+	expect(EventQualityRecovered)
+
+	// A track no longer reported on loses its alert without an event
+	room.setQuality(summary(0.08), 0.05)
+	expect(EventQualityDegraded)
+	room.setQuality(nil, 0.05)
+	expect("")
+	room.setQuality(summary(0.08), 0.05)
+	expect(EventQualityDegraded)
+}
+
+func TestTrackQuality(t *testing.T) {
+	store := newFakeStore()
+	s := newServer(t, store, DefaultConfig())
+	h := s.Handler()
+	sending := publishClient(t, h, "/internal/room/abc/publish")
+	room := store.Get("abc")
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	defer func() { close(stop); <-sent }()
+	go func() {
+		defer close(sent)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: []byte{0x10, 0, 0}})
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for room.GetBroadcasterTrack() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcaster track never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The viewer's receiver reports come from reading its track
+	client := newTestPC(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	client.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := track.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+	exchangeSDP(t, h, client, http.MethodPost, "/internal/room/abc/subscribe", SDPExchange{Type: "offer", SDP: gatheredOffer(t, client, nil)})
+
+	var quality []TrackQuality
+	for deadline := time.Now().Add(10 * time.Second); len(quality) == 0; quality = s.peers.trackQuality(room) {
+		if time.Now().After(deadline) {
+			t.Fatal("no receiver report from the viewer")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(quality) != 1 || quality[0].Label != "screen" || quality[0].Kind != "video" || quality[0].Viewers != 1 {
+		t.Fatalf("quality = %+v, want the viewer's report on the screen", quality)
+	}
+	if q := quality[0].FractionLost; q.Worst < 0 || q.Worst > 1 {
+		t.Errorf("fractionLost = %+v", q)
+	}
+
+	if body := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")); body["quality"] != nil {
+		t.Errorf("status has quality %v before it was summarized", body["quality"])
+	}
+	room.setQuality(quality, 0)
+	rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")
+	var status struct {
+		Quality []TrackQuality `json:"quality"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Quality) != 1 || status.Quality[0].Label != "screen" {
+		t.Errorf("status quality = %+v", status.Quality)
+	}
+	metrics := doRequest(t, h, http.MethodGet, "/metrics", "").Body.String()
+	for _, want := range []string{
+		`rubigo_track_reporting_viewers{room="abc",peer="",track="screen",kind="video"} 1`,
+		`rubigo_track_fraction_lost{room="abc",peer="",track="screen",kind="video",stat="median"} `,
+		`rubigo_track_jitter_seconds{room="abc",peer="",track="screen",kind="video",stat="worst"} `,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+// Every RTP byte received from a room's broadcaster counts as ingress, and
+// every copy written to a viewer as egress. Sizes are those of packets as
+// received, so egress is approximate: retransmissions aren't counted and
+// header rewriting can change a packet's size slightly.
+
+// addTraffic adds in ingress and out egress bytes and returns the room's
+// new total
+func (r *Room) addTraffic(in, out int) int64 {
+	return r.bytesIn.Add(int64(in)) + r.bytesOut.Add(int64(out))
+}
+
+// Traffic returns the bytes the room has received and sent so far
+func (r *Room) Traffic() (in, out int64) {
+	return r.bytesIn.Load(), r.bytesOut.Load()
+}
+
+// overQuota reports whether room has relayed more than the byte quota
+func (s *Server) overQuota(room *Room) bool {
+	in, out := room.Traffic()
+	return s.cfg.RoomByteQuota > 0 && in+out > s.cfg.RoomByteQuota
+}
+
+// enforceQuota ends the session of a room that went over its byte quota.
+// Only the first call per room acts; later publishes are refused by
+// overQuota.
+func (s *Server) enforceQuota(room *Room) {
+	if !room.quotaHit.CompareAndSwap(false, true) {
+		return
+	}
+	roomLog(room.id).Warn("Byte quota exceeded, disconnecting everyone", "byteQuota", s.cfg.RoomByteQuota)
+	// Called from a broadcaster track's read loop, which closing its
+	// connection ends
+	go room.endOverQuota()
+}
+
+// endOverQuota tells everyone in the room the quota was exceeded, then
+// disconnects the broadcaster, co-presenters and viewers
+func (r *Room) endOverQuota() {
+	r.disconnectAll(EventQuotaExceeded)
+}
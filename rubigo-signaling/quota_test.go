@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestForwardingTrackBindings(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, _, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	track := newLiveTrack(t)
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, client, pc)
+	if n := track.Bindings(); n != 1 {
+		t.Errorf("Bindings = %d after negotiation, want 1", n)
+	}
+	// A paused viewer is not sent packets
+	if err := sender.ReplaceTrack(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := track.Bindings(); n != 0 {
+		t.Errorf("Bindings = %d after pause, want 0", n)
+	}
+}
+
+func TestRoomEndOverQuota(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RoomByteQuota = 1000
+	store := newFakeStore("abc")
+	s := newServer(t, store, cfg)
+	room := store.Get("abc")
+	if err := room.AddViewer(&viewer{id: "v1", track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+
+	room.addTraffic(400, 400)
+	if s.overQuota(room) {
+		t.Fatal("room under its quota reported over")
+	}
+	room.addTraffic(100, 200)
+	if !s.overQuota(room) {
+		t.Fatal("room over its quota not reported")
+	}
+	s.enforceQuota(room)
+	s.enforceQuota(room)
+
+	deadline := time.After(time.Second)
+	for room.ViewerCount() > 0 {
+		select {
+		case <-deadline:
+			t.Fatal("viewers not disconnected after the quota was exceeded")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventQuotaExceeded {
+			t.Errorf("event = %q, want %q", event.Type, EventQuotaExceeded)
+		}
+	default:
+		t.Error("no quota_exceeded event")
+	}
+
+	// The room stays closed to broadcasters
+	h := s.Handler()
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", `{"type":"offer","sdp":""}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("publish over quota: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	decodeError(t, rec, errCodeQuotaExceeded)
+
+	status := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+	if status["bytesIngress"] != float64(500) || status["bytesEgress"] != float64(600) || status["byteQuota"] != float64(1000) {
+		t.Errorf("status traffic = %v in, %v out, quota %v", status["bytesIngress"], status["bytesEgress"], status["byteQuota"])
+	}
+}
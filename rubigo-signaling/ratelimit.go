@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often idle buckets are swept from a rateLimiter
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter is a per-key token bucket limiter
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+
+	throttled atomic.Uint64 // requests refused, for metrics
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate requests per second per key
+// with bursts of up to burst requests
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token for key. When none is available it returns false and
+// how long until one will be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	l.throttled.Add(1)
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled, since they behave like new ones.
+// The caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// middleware rejects requests over the limit with 429 and Retry-After
+func (l *rateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(rateLimitKey(r)); !ok {
+			writeRateLimited(w, wait, "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeRateLimited writes the 429 for a request over a limit, with how
+// long until a retry would be allowed
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, errCodeRateLimited, message)
+}
+
+// limitSDP applies the SDP exchange rate limit to next, which sets up a
+// peer connection, so one client can't open hundreds of them. Without the
+// limit next is served as is.
+func (s *Server) limitSDP(next func(w http.ResponseWriter, r *http.Request, roomID string)) func(w http.ResponseWriter, r *http.Request, roomID string) {
+	return func(w http.ResponseWriter, r *http.Request, roomID string) {
+		if s.sdpLimiter != nil {
+			if ok, wait := s.sdpLimiter.allow(rateLimitKey(r)); !ok {
+				roomLog(roomID).Warn("SDP exchange rate limited", "path", r.URL.Path, "remote", r.RemoteAddr)
+				writeRateLimited(w, wait, "SDP exchange rate limit exceeded")
+				return
+			}
+		}
+		next(w, r, roomID)
+	}
+}
+
+// rateLimitKey identifies the caller by source IP. The limits run before
+// any token is verified, so keying by the bearer would let a client mint
+// a fresh bucket per request with a made-up one.
+func rateLimitKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
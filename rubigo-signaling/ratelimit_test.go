@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("request over burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %v, want (0, 1s]", wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("separate key was limited")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request after refill was limited")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l := newRateLimiter(0.5, 1)
+	h := l.middleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	send := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/internal/room", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	if rec := send(""); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d", rec.Code)
+	}
+	rec := send("")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	// An unverified bearer token doesn't buy a bucket of its own
+	if rec := send("Bearer abc"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("token request status = %d, want 429", rec.Code)
+	}
+}
+
+func TestSDPRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SDPRate = 0.5
+	cfg.SDPBurst = 1
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	send := func(method, path, remote string, bearer ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.RemoteAddr = remote
+		for _, token := range bearer {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The first is refused for its body, but still takes the token
+	if rec := send(http.MethodPost, "/internal/room/abc/subscribe", "192.0.2.1:1000"); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("first subscribe was rate limited")
+	}
+	for _, path := range []string{"/internal/room/abc/subscribe", "/internal/room/abc/publish", "/whep/abc"} {
+		rec := send(http.MethodPost, path, "192.0.2.1:1001")
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("%s status = %d, want %d", path, rec.Code, http.StatusTooManyRequests)
+			continue
+		}
+		decodeError(t, rec, errCodeRateLimited)
+		if got := rec.Header().Get("Retry-After"); got != "2" {
+			t.Errorf("%s Retry-After = %q, want 2", path, got)
+		}
+	}
+	if rec := send(http.MethodPost, "/internal/room/abc/subscribe", "192.0.2.2:1000", "bogus-1"); rec.Code == http.StatusTooManyRequests {
+		t.Error("another IP was rate limited")
+	}
+	// A different made-up bearer doesn't get around the limit
+	if rec := send(http.MethodPost, "/internal/room/abc/subscribe", "192.0.2.2:1001", "bogus-2"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("subscribe with a second bogus bearer = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// Requests that don't set up a connection aren't limited
+	if rec := send(http.MethodGet, "/internal/room/abc/status", "192.0.2.1:1002"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec := send(http.MethodGet, "/metrics", "192.0.2.1:1003")
+	if body := rec.Body.String(); !strings.Contains(body, `rubigo_rate_limited_requests_total{limit="sdp"} 4`) ||
+		strings.Contains(body, `limit="create"`) {
+		t.Errorf("metrics = %s", body)
+	}
+}
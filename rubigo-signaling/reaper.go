@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// roomReapInterval is how often rooms are checked for idleness, and so how
+// late past its timeout an idle room may be deleted
+const roomReapInterval = 10 * time.Second
+
+// EventRoomReaped is published when an idle room is deleted, just before
+// the EventRoomClosed that ends its event streams
+const EventRoomReaped = "room_reaped"
+
+// SetIdleTimeout overrides how long the room may sit empty before it is
+// deleted; zero keeps the server's RoomIdleTimeout
+func (r *Room) SetIdleTimeout(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.idleTimeout = d
+}
+
+// IdleTimeout returns the room's idle timeout, or fallback if it has no
+// override
+func (r *Room) IdleTimeout(fallback time.Duration) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.idleTimeout > 0 {
+		return r.idleTimeout
+	}
+	return fallback
+}
+
+// idleFor returns how long the room has had no broadcaster, co-presenters,
+// viewers or recording as of now, counting from the first call that found
+// it so. It returns zero while the room is in use.
+func (r *Room) idleFor(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inUseLocked() {
+		r.idleSince = time.Time{}
+		return 0
+	}
+	if r.idleSince.IsZero() {
+		r.idleSince = now
+	}
+	return now.Sub(r.idleSince)
+}
+
+// inUseLocked reports whether anyone is connected to the room, or it is
+// being recorded or packaged for HLS. A broadcaster whose connection has
+// failed no longer counts. The caller must hold r.mu.
+func (r *Room) inUseLocked() bool {
+	if len(r.viewers) > 0 || len(r.presenters) > 0 || r.recorder != nil || r.hls != nil {
+		return true
+	}
+	if pc := r.broadcaster.pc; pc != nil {
+		switch pc.ConnectionState() {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// reapIdleRooms deletes idle rooms every interval until done is closed
+func (s *Server) reapIdleRooms(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.reapIdle(now)
+		}
+	}
+}
+
+// reapIdle deletes every room that has been idle longer than its idle
+// timeout as of now, returning their IDs. Rooms with no timeout are kept.
+// Anyone joining in the moment between the check and the delete is
+// disconnected as if the room had been deleted through the API.
+func (s *Server) reapIdle(now time.Time) []string {
+	var reaped []string
+	for _, room := range s.rooms.Rooms() {
+		timeout := room.IdleTimeout(s.cfg.RoomIdleTimeout)
+		idle := room.idleFor(now)
+		if timeout <= 0 || idle <= timeout {
+			continue
+		}
+
+		roomLog(room.id).Info("Reaping idle room", "idleFor", idle.Round(time.Second), "idleTimeout", timeout)
+		room.publishEvent(EventRoomReaped)
+		s.rooms.Delete(room.id)
+		room.Close()
+		reaped = append(reaped, room.id)
+	}
+	return reaped
+}
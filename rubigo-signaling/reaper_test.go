@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReapIdle(t *testing.T) {
+	store := newFakeStore("empty", "override", "watched")
+	store.rooms["override"].SetIdleTimeout(time.Hour)
+	if err := store.rooms["watched"].AddViewer(&viewer{id: "v1", track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.RoomIdleTimeout = time.Minute
+	s := newServer(t, store, cfg)
+	events, cancel := store.rooms["empty"].SubscribeEvents()
+	defer cancel()
+
+	// Idleness counts from when the reaper first finds a room empty
+	start := time.Now()
+	if reaped := s.reapIdle(start); len(reaped) != 0 {
+		t.Fatalf("reaped %v on the first pass", reaped)
+	}
+	if reaped := s.reapIdle(start.Add(2 * time.Minute)); len(reaped) != 1 || reaped[0] != "empty" {
+		t.Fatalf("reaped %v, want [empty]", reaped)
+	}
+	if store.Get("empty") != nil || store.Get("override") == nil || store.Get("watched") == nil {
+		t.Errorf("rooms left = %v", store.rooms)
+	}
+	for _, want := range []string{EventRoomReaped, EventRoomClosed} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Errorf("event = %q, want %q", event.Type, want)
+			}
+		default:
+			t.Errorf("no %s event", want)
+		}
+	}
+
+	// Activity restarts the clock
+	store.rooms["watched"].RemoveViewer("v1")
+	if reaped := s.reapIdle(start.Add(3 * time.Minute)); len(reaped) != 0 {
+		t.Errorf("reaped %v as soon as the last viewer left", reaped)
+	}
+	if reaped := s.reapIdle(start.Add(2 * time.Hour)); len(reaped) != 2 {
+		t.Errorf("reaped %v, want override and watched", reaped)
+	}
+}
+
+func TestReapIdleEgress(t *testing.T) {
+	store := newFakeStore("recorded", "packaged")
+	store.rooms["recorded"].recorder = &Recorder{}
+	store.rooms["packaged"].hls = &hlsEgress{rec: &Recorder{}}
+	cfg := DefaultConfig()
+	cfg.RoomIdleTimeout = time.Minute
+	s := newServer(t, store, cfg)
+
+	start := time.Now()
+	s.reapIdle(start)
+	if reaped := s.reapIdle(start.Add(time.Hour)); len(reaped) != 0 {
+		t.Errorf("reaped %v while recording and packaging", reaped)
+	}
+}
+
+func TestReapIdleDisabled(t *testing.T) {
+	store := newFakeStore("abc")
+	cfg := DefaultConfig()
+	cfg.RoomIdleTimeout = 0
+	s := newServer(t, store, cfg)
+
+	start := time.Now()
+	s.reapIdle(start)
+	if reaped := s.reapIdle(start.Add(24 * time.Hour)); len(reaped) != 0 {
+		t.Errorf("reaped %v with the idle timeout off", reaped)
+	}
+}
+
+func TestCreateRoomIdleTimeout(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","idleTimeoutSeconds":30}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := decodeBody(t, rec)["idleTimeoutSeconds"]; got != float64(30) {
+		t.Errorf("idleTimeoutSeconds = %v, want 30", got)
+	}
+	if got := store.Get("abc").IdleTimeout(time.Minute); got != 30*time.Second {
+		t.Errorf("room idle timeout = %v, want 30s", got)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"def"}`)
+	if got := decodeBody(t, rec)["idleTimeoutSeconds"]; got != DefaultConfig().RoomIdleTimeout.Seconds() {
+		t.Errorf("default idleTimeoutSeconds = %v", got)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"ghi","idleTimeoutSeconds":-1}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("negative idle timeout status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	decodeError(t, rec, errCodeInvalidRequest)
+	if store.Get("ghi") != nil {
+		t.Error("room created despite a negative idle timeout")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// reconnectSlot is what a reconnect token resumes: the viewer's ID and,
+// once its connection has closed, the state it left in
+type reconnectSlot struct {
+	viewerID string
+	paused   bool
+	released time.Time // zero while the viewer is still registered
+}
+
+// expired reports whether the slot's grace window has passed
+func (s *reconnectSlot) expired(grace time.Duration, now time.Time) bool {
+	return !s.released.IsZero() && now.Sub(s.released) > grace
+}
+
+// newReconnectToken returns a random, unguessable reconnect token
+func newReconnectToken() string {
+	return randomHex(16)
+}
+
+// IssueReconnectToken returns a new token for viewerID, replacing any it
+// had. Expired tokens are dropped while the lock is held.
+func (r *Room) IssueReconnectToken(viewerID string, grace time.Duration) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for token, slot := range r.reconnects {
+		if slot.viewerID == viewerID || slot.expired(grace, now) {
+			delete(r.reconnects, token)
+		}
+	}
+	if r.reconnects == nil {
+		r.reconnects = make(map[string]*reconnectSlot)
+	}
+	token := newReconnectToken()
+	r.reconnects[token] = &reconnectSlot{viewerID: viewerID}
+	return token
+}
+
+// Reconnect returns the slot for token, or false if the token is unknown or
+// its grace window has passed. The token stays valid until the resubscribe
+// succeeds and a new one is issued.
+func (r *Room) Reconnect(token string, grace time.Duration) (reconnectSlot, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	slot := r.reconnects[token]
+	if slot == nil || slot.expired(grace, time.Now()) {
+		return reconnectSlot{}, false
+	}
+	return *slot, true
+}
+
+// ReleaseViewer removes v if it is still the viewer registered under its ID,
+// starting the grace window of its reconnect token. A connection replaced by
+// a resubscribe is no longer registered, so closing it leaves its successor
+// alone.
+func (r *Room) ReleaseViewer(v *viewer) {
+	r.mu.Lock()
+	if r.viewers[v.id] != v {
+		r.mu.Unlock()
+		return
+	}
+	for _, slot := range r.reconnects {
+		if slot.viewerID == v.id {
+			slot.paused = v.Paused()
+			slot.released = time.Now()
+		}
+	}
+	r.removeViewerLocked(v.id)
+	r.mu.Unlock()
+
+	r.publishViewerEvent(EventViewerLeft, v.id)
+	r.viewerCountChanged()
+}
+
+// revokeReconnectLocked invalidates viewerID's reconnect token.
+// The caller must hold r.mu.
+func (r *Room) revokeReconnectLocked(viewerID string) {
+	for token, slot := range r.reconnects {
+		if slot.viewerID == viewerID {
+			delete(r.reconnects, token)
+		}
+	}
+}
+
+// IssueBroadcasterToken returns a new reconnect token for the room's
+// broadcaster, replacing any earlier one, and keeps viewers for grace after
+// the broadcaster's tracks end. Republishing with the token while the
+// viewers are kept needs no password.
+func (r *Room) IssueBroadcasterToken(grace time.Duration) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.broadcasterToken = newReconnectToken()
+	r.broadcasterGrace = grace
+	return r.broadcasterToken
+}
+
+// CheckBroadcasterToken reports whether token is the broadcaster's current
+// reconnect token
+func (r *Room) CheckBroadcasterToken(token string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.broadcasterToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.broadcasterToken)) == 1
+}
+
+// handleResubscribeWithID handles POST /internal/room/{id}/resubscribe
+// A viewer whose connection dropped sends its reconnect token with a new
+// offer and gets back the same viewer ID and pause state
+func (s *Server) handleResubscribeWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	start := time.Now()
+
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+	if offer.ReconnectToken == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "reconnectToken required")
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	slot, ok := room.Reconnect(offer.ReconnectToken, s.cfg.ReconnectGrace)
+	if !ok || s.cfg.ReconnectGrace <= 0 {
+		writeError(w, http.StatusGone, errCodeReconnectInvalid, "Reconnect token is invalid or expired")
+		return
+	}
+	if v, answer := s.subscribe(w, r, roomID, offer, &slot, start); v != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
+	}
+}
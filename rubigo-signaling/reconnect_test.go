@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoomReconnectToken(t *testing.T) {
+	room := &Room{id: "abc"}
+	v := &viewer{id: "alice", track: newLiveTrack(t)}
+	if err := room.AddViewer(v); err != nil {
+		t.Fatal(err)
+	}
+	token := room.IssueReconnectToken(v.id, time.Minute)
+
+	slot, ok := room.Reconnect(token, time.Minute)
+	if !ok || slot.viewerID != "alice" {
+		t.Fatalf("Reconnect = %+v, %t; want alice's slot", slot, ok)
+	}
+	if _, ok := room.Reconnect("bogus", time.Minute); ok {
+		t.Error("Reconnect accepted an unknown token")
+	}
+
+	// Dropping the connection starts the grace window
+	room.ReleaseViewer(v)
+	if room.Viewer("alice") != nil {
+		t.Fatal("released viewer still registered")
+	}
+	if _, ok := room.Reconnect(token, time.Minute); !ok {
+		t.Error("token rejected within the grace window")
+	}
+	room.mu.Lock()
+	room.reconnects[token].released = time.Now().Add(-2 * time.Minute)
+	room.mu.Unlock()
+	if _, ok := room.Reconnect(token, time.Minute); ok {
+		t.Error("token accepted after the grace window")
+	}
+
+	// A new token replaces the old one
+	fresh := room.IssueReconnectToken("alice", time.Minute)
+	if _, ok := room.Reconnect(fresh, time.Minute); !ok {
+		t.Error("fresh token rejected")
+	}
+	if n := len(room.reconnects); n != 1 {
+		t.Errorf("%d tokens held, want 1", n)
+	}
+}
+
+func TestRoomReleaseViewerReplaced(t *testing.T) {
+	room := &Room{id: "abc"}
+	track := newLiveTrack(t)
+	old := &viewer{id: "alice", track: track}
+	if err := room.AddViewer(old); err != nil {
+		t.Fatal(err)
+	}
+	room.ReleaseViewer(old)
+	successor := &viewer{id: "alice", track: track}
+	if err := room.AddViewer(successor); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old connection closing late must not remove its successor
+	room.ReleaseViewer(old)
+	if room.Viewer("alice") != successor {
+		t.Error("releasing a replaced viewer removed its successor")
+	}
+}
+
+func TestKickRevokesReconnectToken(t *testing.T) {
+	room := &Room{id: "abc"}
+	if err := room.AddViewer(&viewer{id: "alice", track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	token := room.IssueReconnectToken("alice", time.Minute)
+	if err := room.KickViewer("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := room.Reconnect(token, time.Minute); ok {
+		t.Error("kicked viewer's token still valid")
+	}
+}
+
+func TestResubscribeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		want     int
+		wantCode string
+	}{
+		{"missing token", "/internal/room/abc/resubscribe", `{"type":"offer","sdp":""}`, http.StatusBadRequest, errCodeInvalidRequest},
+		{"room not found", "/internal/room/nope/resubscribe", `{"type":"offer","sdp":"","reconnectToken":"t"}`, http.StatusNotFound, errCodeRoomNotFound},
+		{"unknown token", "/internal/room/abc/resubscribe", `{"type":"offer","sdp":"","reconnectToken":"t"}`, http.StatusGone, errCodeReconnectInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore("abc")), http.MethodPost, tt.path, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			decodeError(t, rec, tt.wantCode)
+		})
+	}
+}
+
+func TestBroadcasterReconnectToken(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","password":"hunter22"}`); rec.Code != http.StatusOK {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	publish := func(offer SDPExchange) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(offer)
+		return doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	}
+	answer := func(rec *httptest.ResponseRecorder) SDPExchange {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("publish = %d: %s", rec.Code, rec.Body)
+		}
+		var answer SDPExchange
+		if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+			t.Fatal(err)
+		}
+		if answer.ReconnectToken == "" {
+			t.Fatal("publish answer has no reconnect token")
+		}
+		return answer
+	}
+
+	first := answer(publish(SDPExchange{Type: "offer", SDP: videoOffer(t), Password: "hunter22"}))
+
+	rec := publish(SDPExchange{Type: "offer", SDP: videoOffer(t), ReconnectToken: "bogus"})
+	if rec.Code != http.StatusGone {
+		t.Fatalf("republish with a bogus token = %d, want %d", rec.Code, http.StatusGone)
+	}
+	decodeError(t, rec, errCodeReconnectInvalid)
+
+	// The token stands in for the password, once
+	second := answer(publish(SDPExchange{Type: "offer", SDP: videoOffer(t), ReconnectToken: first.ReconnectToken}))
+	if second.ReconnectToken == first.ReconnectToken {
+		t.Error("republish kept the old token")
+	}
+	if rec := publish(SDPExchange{Type: "offer", SDP: videoOffer(t), ReconnectToken: first.ReconnectToken}); rec.Code != http.StatusGone {
+		t.Errorf("republish with a replaced token = %d, want %d", rec.Code, http.StatusGone)
+	}
+
+	room := store.Get("abc")
+	room.Unpublish()
+	if room.CheckBroadcasterToken(second.ReconnectToken) {
+		t.Error("token valid after unpublish")
+	}
+}
+
+func TestBroadcasterTokenLapsesWithGrace(t *testing.T) {
+	room := &Room{id: "abc"}
+	track := newLiveTrack(t)
+	room.broadcasterTracks = map[string]*forwardingTrack{"": track}
+	token := room.IssueBroadcasterToken(20 * time.Millisecond)
+
+	// The broadcaster drops out and doesn't come back
+	room.DetachBroadcasterSource(track.Source())
+	if !room.CheckBroadcasterToken(token) {
+		t.Fatal("token rejected within the grace period")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.CheckBroadcasterToken(token) {
+		if time.Now().After(deadline) {
+			t.Fatal("token still valid after the grace period")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// errAlreadyRecording is returned when a room's recording is started twice
+var errAlreadyRecording = errors.New("room is already being recorded")
+
+// errNotRecording is returned when stopping a room that isn't recording
+var errNotRecording = errors.New("room is not being recorded")
+
+// Recording reassembly windows, in packets: how long a frame waits for
+// its missing packets before it is dropped. A screen share keyframe can
+// run to hundreds of packets.
+const (
+	recordVideoMaxLate = 512
+	recordAudioMaxLate = 64
+)
+
+// WebM track numbers of recorded video and audio
+const (
+	recordVideoTrack = 1
+	recordAudioTrack = 2
+)
+
+// Recorder writes a room's incoming broadcaster media to WebM files.
+// Incoming RTP is reassembled into frames, and VP8 or VP9 video goes in a
+// file with Opus audio. Each file starts on a video keyframe; with a
+// segment length set, a new one starts at the first keyframe after that
+// much video. Under RecordIVF it writes IVF and OGG files instead.
+type Recorder struct {
+	roomID  string
+	dir     string
+	segment time.Duration
+	format  RecordFormat
+	// requestKeyframe asks the broadcaster for a keyframe to start a file on
+	requestKeyframe func()
+	start           time.Time
+	// onFile, if set, is called with each file once it is complete
+	onFile func(path string)
+	// open, if set, is used instead of creating files: each file's WebM
+	// goes to the writer it returns, such as a packager's stdin
+	open func() (io.WriteCloser, error)
+
+	mu          sync.Mutex
+	tracks      map[webrtc.RTPCodecType]*recordedTrack
+	file        *webmWriter
+	filePath    string        // the file's path; empty if it came from open
+	fileStart   time.Duration // recording time of the file's first keyframe
+	unsupported map[webrtc.RTPCodecType]bool
+	files       []string
+	// raw holds each kind's open file under RecordIVF
+	raw map[webrtc.RTPCodecType]*rawFile
+}
+
+// recordedTrack is the state of one incoming track being recorded
+type recordedTrack struct {
+	mimeType  string
+	clockRate uint32
+	builder   *samplebuilder.SampleBuilder
+
+	// The first frame's RTP timestamp and its recording time anchor the
+	// rest of the track's frames
+	started  bool
+	base     uint32
+	baseTime time.Duration
+
+	// keyframe is the RTP timestamp of the last keyframe seen
+	keyframe      uint32
+	hasKeyframe   bool
+	width, height int
+}
+
+// newRecordedTrack sets up reassembly for a track of codec
+func newRecordedTrack(codec webrtc.RTPCodecParameters) (*recordedTrack, error) {
+	var depacketizer rtp.Depacketizer
+	maxLate := uint16(recordVideoMaxLate)
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		depacketizer = &codecs.VP8Packet{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		depacketizer = &codecs.OpusPacket{}
+		maxLate = recordAudioMaxLate
+	default:
+		return nil, fmt.Errorf("unsupported codec for recording: %s", codec.MimeType)
+	}
+	return &recordedTrack{
+		mimeType:  codec.MimeType,
+		clockRate: codec.ClockRate,
+		builder:   samplebuilder.New(maxLate, depacketizer, codec.ClockRate),
+	}, nil
+}
+
+// at returns the recording time of the frame with RTP timestamp ts, which
+// arrived now
+func (t *recordedTrack) at(ts uint32, now time.Duration) time.Duration {
+	if !t.started {
+		t.started, t.base, t.baseTime = true, ts, now
+	}
+	return t.baseTime + time.Duration(ts-t.base)*time.Second/time.Duration(t.clockRate)
+}
+
+// NewRecorder creates a recorder for a room, creating dir if needed.
+// segment, if positive, is how long each file runs; requestKeyframe is
+// called when a file is waiting for a keyframe to start on.
+func NewRecorder(roomID, dir string, segment time.Duration, requestKeyframe func()) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	return &Recorder{
+		roomID:          roomID,
+		dir:             dir,
+		segment:         segment,
+		requestKeyframe: requestKeyframe,
+		start:           time.Now(),
+		tracks:          make(map[webrtc.RTPCodecType]*recordedTrack),
+		unsupported:     make(map[webrtc.RTPCodecType]bool),
+		raw:             make(map[webrtc.RTPCodecType]*rawFile),
+	}, nil
+}
+
+// WriteRTP records a packet read from the broadcaster's track
+func (r *Recorder) WriteRTP(kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters, packet *rtp.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.unsupported[kind] {
+		return nil
+	}
+	if r.format == RecordIVF {
+		return r.writeRaw(kind, codec.MimeType, packet)
+	}
+	t := r.tracks[kind]
+	if t == nil {
+		var err error
+		if t, err = newRecordedTrack(codec); err != nil {
+			r.unsupported[kind] = true
+			return err
+		}
+		r.tracks[kind] = t
+	}
+
+	if kind == webrtc.RTPCodecTypeVideo {
+		if width, height, ok := keyframeResolution(t.mimeType, packet.Payload); ok {
+			t.width, t.height = width, height
+		}
+		if keyframeStart(t.mimeType, packet.Payload) {
+			t.keyframe, t.hasKeyframe = packet.Timestamp, true
+		}
+	}
+	// The sample builder holds on to packets, and the caller reuses its
+	// read buffer
+	t.builder.Push(packet.Clone())
+	return r.drain(kind, t)
+}
+
+// drain writes the frames t's sample builder has completed
+func (r *Recorder) drain(kind webrtc.RTPCodecType, t *recordedTrack) error {
+	for sample := t.builder.Pop(); sample != nil; sample = t.builder.Pop() {
+		if err := r.writeSample(kind, t, sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSample writes one frame, starting a new file on a keyframe when
+// none is open or the segment is up
+func (r *Recorder) writeSample(kind webrtc.RTPCodecType, t *recordedTrack, sample *media.Sample) error {
+	at := t.at(sample.PacketTimestamp, time.Since(r.start))
+	keyframe := true
+	track := uint64(recordAudioTrack)
+	if kind == webrtc.RTPCodecTypeVideo {
+		track = recordVideoTrack
+		keyframe = t.hasKeyframe && sample.PacketTimestamp == t.keyframe
+		due := r.file == nil || (r.segment > 0 && at-r.fileStart >= r.segment)
+		switch {
+		case due && keyframe:
+			if err := r.openFile(t, at); err != nil {
+				r.unsupported[kind] = true
+				return err
+			}
+		case due && r.requestKeyframe != nil:
+			r.requestKeyframe()
+		}
+	}
+
+	// Until a keyframe opens the first file there is nothing to write to,
+	// and audio from before it would have a negative timestamp
+	if r.file == nil || at < r.fileStart {
+		return nil
+	}
+	return r.file.writeBlock(track, at-r.fileStart, keyframe, sample.Data)
+}
+
+// openFile closes the current file and starts a new one at recording time
+// at. Audio is always declared, since it may start after the video.
+func (r *Recorder) openFile(video *recordedTrack, at time.Duration) error {
+	r.closeFile()
+
+	var f io.WriteCloser
+	var path string
+	var err error
+	if r.open != nil {
+		f, err = r.open()
+	} else {
+		path = r.filename("webm")
+		f, err = os.Create(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	codecID := "V_VP8"
+	if strings.EqualFold(video.mimeType, webrtc.MimeTypeVP9) {
+		codecID = "V_VP9"
+	}
+	w, err := newWebMWriter(f, []webmTrack{
+		{number: recordVideoTrack, video: true, codecID: codecID, width: video.width, height: video.height},
+		opusTrack(recordAudioTrack),
+	})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write recording header: %w", err)
+	}
+	r.file, r.fileStart, r.filePath = w, at, path
+	if path != "" {
+		r.files = append(r.files, path)
+		roomLog(r.roomID).Info("Recording to file", "file", path)
+	}
+	return nil
+}
+
+// closeFile closes the current file, if any. The caller must hold r.mu.
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		roomLog(r.roomID).Error("Failed to close recording", "err", err)
+	}
+	r.file = nil
+	if r.onFile != nil && r.filePath != "" {
+		r.onFile(r.filePath)
+	}
+}
+
+// CloseTrack flushes one media kind, e.g. when its track ends. Video
+// ending also closes the file; a later track of the same kind is picked
+// up afresh, in a new file for video.
+func (r *Recorder) CloseTrack(kind webrtc.RTPCodecType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t := r.tracks[kind]; t != nil {
+		t.builder.Flush()
+		if err := r.drain(kind, t); err != nil {
+			roomLog(r.roomID).Error("Failed to write recording", "err", err)
+		}
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		r.closeFile()
+	}
+	r.closeRaw(kind)
+	delete(r.tracks, kind)
+	delete(r.unsupported, kind)
+}
+
+// Close closes all open files and returns every file written
+func (r *Recorder) Close() []string {
+	r.CloseTrack(webrtc.RTPCodecTypeAudio)
+	r.CloseTrack(webrtc.RTPCodecTypeVideo)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.files...)
+}
+
+// filename builds the next file's path from the room ID, when recording
+// started and the file's index in the recording
+func (r *Recorder) filename(ext string) string {
+	stamp := r.start.UTC().Format("20060102T150405.000Z")
+	return filepath.Join(r.dir, fmt.Sprintf("%s-%s-%03d.%s", r.roomID, stamp, len(r.files), ext))
+}
+
+// StartRecording starts recording the room in format; onFile, if set, is
+// called with each file once it is complete
+func (r *Room) StartRecording(dir string, format RecordFormat, segment time.Duration, onFile func(path string)) (*Recorder, error) {
+	r.mu.Lock()
+	if r.recorder != nil {
+		r.mu.Unlock()
+		return nil, errAlreadyRecording
+	}
+	rec, err := NewRecorder(r.id, dir, segment, r.requestRecordingKeyframe)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	rec.format, rec.onFile = format, onFile
+	r.recorder = rec
+	r.mu.Unlock()
+
+	roomLog(r.id).Info("Recording started")
+	r.publishEvent(EventRecordingStarted)
+	// Start the first file now rather than at the next periodic keyframe
+	r.requestRecordingKeyframe()
+	return rec, nil
+}
+
+// requestRecordingKeyframe asks the broadcaster for a keyframe of the
+// recorded video
+func (r *Room) requestRecordingKeyframe() {
+	track := r.GetBroadcasterTrack()
+	if track == nil {
+		return
+	}
+	if err := r.RequestKeyframe(track); err != nil && !errors.Is(err, errNoBroadcaster) {
+		roomLog(r.id).Error("Failed to request keyframe for recording", "err", err)
+	}
+}
+
+func (r *Room) StopRecording() ([]string, error) {
+	r.mu.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	r.mu.Unlock()
+
+	if rec == nil {
+		return nil, errNotRecording
+	}
+
+	files := rec.Close()
+	roomLog(r.id).Info("Recording stopped", "files", len(files))
+	r.publishRoomEvent(RoomEvent{Type: EventRecordingStopped, Files: files})
+	return files, nil
+}
+
+func (r *Room) GetRecorder() *Recorder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.recorder
+}
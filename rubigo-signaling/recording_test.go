@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	recordVP8  = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}}
+	recordOpus = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}}
+)
+
+// vp8Packet is a one-packet VP8 frame; keyframes are 640x360
+func vp8Packet(seq uint16, ts uint32, keyframe bool) *rtp.Packet {
+	// Payload descriptor with S set, then the frame
+	payload := []byte{0x10, 0x01, 0x00, 0x00}
+	if keyframe {
+		payload = []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0x68, 0x01}
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: seq, Timestamp: ts},
+		Payload: payload,
+	}
+}
+
+// readRecording parses a recorded file
+func readRecording(t *testing.T, path string) []ebmlElem {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readEBML(t, data)
+}
+
+func TestRecorder(t *testing.T) {
+	requests := 0
+	rec, err := NewRecorder("abc", t.TempDir(), 0, func() { requests++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames before the first keyframe have nowhere to go, so ask for one
+	for i, keyframe := range []bool{false, false, true, false, false} {
+		if err := rec.WriteRTP(webrtc.RTPCodecTypeVideo, recordVP8, vp8Packet(uint16(i), uint32(i)*3000, keyframe)); err != nil {
+			t.Fatal(err)
+		}
+		audio := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i) * 960}, Payload: []byte{0xfc, 0xff}}
+		if err := rec.WriteRTP(webrtc.RTPCodecTypeAudio, recordOpus, audio); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests == 0 {
+		t.Error("no keyframe requested while waiting for one")
+	}
+
+	files := rec.Close()
+	if len(files) != 1 {
+		t.Fatalf("files = %v, want 1", files)
+	}
+	elems := readRecording(t, files[0])
+	if codecs := ebmlFind(elems, mkvCodecIDID); len(codecs) != 2 || string(codecs[0]) != "V_VP8" || string(codecs[1]) != "A_OPUS" {
+		t.Errorf("codecs = %q", codecs)
+	}
+	if height := ebmlFind(elems, mkvPixelHeightID); len(height) != 1 || ebmlUintValue(height[0]) != 360 {
+		t.Errorf("PixelHeight = % x, want 360", height)
+	}
+
+	// The keyframe and the two frames after it; Close flushes the last
+	var video int
+	for i, block := range ebmlFind(elems, mkvSimpleBlockID) {
+		if block[0] != 0x81 {
+			continue
+		}
+		if video == 0 && (i != 0 || block[3] != mkvKeyframeFlag) {
+			t.Errorf("file starts with block % x, want a video keyframe", block[:4])
+		}
+		video++
+	}
+	if video != 3 {
+		t.Errorf("recorded %d video frames, want 3", video)
+	}
+}
+
+func TestRecorderSegments(t *testing.T) {
+	rec, err := NewRecorder("abc", t.TempDir(), 1500*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var finished []string
+	rec.onFile = func(path string) { finished = append(finished, path) }
+	// A frame a second, with a keyframe every third: the segment is up
+	// after the second frame, and the keyframes at 3s and 6s start files
+	for i := 0; i < 8; i++ {
+		if err := rec.WriteRTP(webrtc.RTPCodecTypeVideo, recordVP8, vp8Packet(uint16(i), uint32(i)*90000, i%3 == 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := rec.Close()
+	if len(files) != 3 {
+		t.Fatalf("files = %v, want 3", files)
+	}
+	if !slices.Equal(finished, files) {
+		t.Errorf("finished files = %v, want %v", finished, files)
+	}
+	for i, want := range []int{3, 3, 2} {
+		if got := len(ebmlFind(readRecording(t, files[i]), mkvSimpleBlockID)); got != want {
+			t.Errorf("file %d has %d frames, want %d", i, got, want)
+		}
+	}
+}
+
+func TestRecorderIVF(t *testing.T) {
+	rec, err := NewRecorder("abc", t.TempDir(), time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.format = RecordIVF
+	var finished []string
+	rec.onFile = func(path string) { finished = append(finished, path) }
+	for i := 0; i < 3; i++ {
+		if err := rec.WriteRTP(webrtc.RTPCodecTypeVideo, recordVP8, vp8Packet(uint16(i), uint32(i)*90000, i == 0)); err != nil {
+			t.Fatal(err)
+		}
+		audio := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i) * 960}, Payload: []byte{0xfc, 0xff}}
+		if err := rec.WriteRTP(webrtc.RTPCodecTypeAudio, recordOpus, audio); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One file per track, whatever the segment length
+	files := rec.Close()
+	if len(files) != 2 || filepath.Ext(files[0]) != ".ivf" || filepath.Ext(files[1]) != ".ogg" {
+		t.Fatalf("files = %v, want an IVF and an OGG file", files)
+	}
+	if len(finished) != 2 || !slices.Contains(finished, files[0]) || !slices.Contains(finished, files[1]) {
+		t.Errorf("finished files = %v, want %v", finished, files)
+	}
+	for i, magic := range []string{"DKIF", "OggS"} {
+		data, err := os.ReadFile(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), magic) {
+			t.Errorf("%s starts % x, want %q", files[i], data[:min(len(data), 4)], magic)
+		}
+	}
+}
+
+func TestParseRecordFormat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RecordFormat
+		ok   bool
+	}{
+		{"", RecordWebM, true},
+		{"webm", RecordWebM, true},
+		{"ivf", RecordIVF, true},
+		{"ogg", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseRecordFormat(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseRecordFormat(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+// ebmlUintValue decodes an unsigned integer element's data
+func ebmlUintValue(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func TestRecorderUnsupportedCodec(t *testing.T) {
+	rec, err := NewRecorder("abc", t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// H.264 can't go in WebM; that is reported once
+	h264 := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{0x65}}
+	if err := rec.WriteRTP(webrtc.RTPCodecTypeVideo, h264, packet); err == nil {
+		t.Error("H.264 accepted")
+	}
+	if err := rec.WriteRTP(webrtc.RTPCodecTypeVideo, h264, packet); err != nil {
+		t.Errorf("second H.264 packet: %v", err)
+	}
+	if files := rec.Close(); len(files) != 0 {
+		t.Errorf("files = %v, want none", files)
+	}
+}
+
+func TestRecordingEndpoints(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RecordDir = t.TempDir()
+	store := newFakeStore("abc")
+	h := newServer(t, store, cfg).Handler()
+	events, cancel := store.Get("abc").SubscribeEvents()
+	defer cancel()
+	nextEvent := func() RoomEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		default:
+			t.Fatal("no event published")
+			return RoomEvent{}
+		}
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/recording/start", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start = %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["status"] != "recording" {
+		t.Errorf("start body = %v", body)
+	}
+	if event := nextEvent(); event.Type != EventRecordingStarted {
+		t.Errorf("event = %q, want %q", event.Type, EventRecordingStarted)
+	}
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/recording/start", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("second start = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	decodeError(t, rec, errCodeAlreadyRecording)
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/recording/stop", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stop = %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["status"] != "stopped" {
+		t.Errorf("stop body = %v", body)
+	}
+	if event := nextEvent(); event.Type != EventRecordingStopped {
+		t.Errorf("event = %q, want %q", event.Type, EventRecordingStopped)
+	}
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/recording/stop", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("second stop = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	decodeError(t, rec, errCodeNotRecording)
+
+	if rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/recording/start", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET start = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/recording/pause", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown recording action = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room/missing/recording/start", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown room = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// RecordFormat is the container recordings are written in
+type RecordFormat string
+
+const (
+	// RecordWebM writes video and audio together to WebM files
+	RecordWebM RecordFormat = "webm"
+	// RecordIVF writes video to IVF files and Opus audio to separate OGG
+	// files, each opened on the first packet of its kind. Segments don't
+	// apply: each track is one file.
+	RecordIVF RecordFormat = "ivf"
+)
+
+// parseRecordFormat validates a record format, empty meaning RecordWebM
+func parseRecordFormat(s string) (RecordFormat, error) {
+	switch format := RecordFormat(s); format {
+	case "":
+		return RecordWebM, nil
+	case RecordWebM, RecordIVF:
+		return format, nil
+	}
+	return "", fmt.Errorf("record format must be %q or %q", RecordWebM, RecordIVF)
+}
+
+// rawFile is an IVF or OGG file being recorded
+type rawFile struct {
+	w interface {
+		WriteRTP(*rtp.Packet) error
+		Close() error
+	}
+	path string
+}
+
+// writeRaw records a packet under RecordIVF. The caller must hold r.mu.
+func (r *Recorder) writeRaw(kind webrtc.RTPCodecType, mimeType string, packet *rtp.Packet) error {
+	f := r.raw[kind]
+	if f == nil {
+		var err error
+		if f, err = r.openRaw(kind, mimeType); err != nil {
+			r.unsupported[kind] = true
+			return err
+		}
+		r.raw[kind] = f
+	}
+	return f.w.WriteRTP(packet)
+}
+
+// openRaw opens the file for a track of one media kind
+func (r *Recorder) openRaw(kind webrtc.RTPCodecType, mimeType string) (*rawFile, error) {
+	f := &rawFile{}
+	var err error
+	switch kind {
+	case webrtc.RTPCodecTypeVideo:
+		f.path = r.filename("ivf")
+		f.w, err = ivfwriter.New(f.path, ivfwriter.WithCodec(mimeType))
+	case webrtc.RTPCodecTypeAudio:
+		if !strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+			return nil, fmt.Errorf("unsupported audio codec for recording: %s", mimeType)
+		}
+		f.path = r.filename("ogg")
+		f.w, err = oggwriter.New(f.path, 48000, 2)
+	default:
+		return nil, fmt.Errorf("unsupported track kind for recording: %s", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s recording: %w", kind, err)
+	}
+	r.files = append(r.files, f.path)
+	roomLog(r.roomID).Info("Recording to file", "file", f.path)
+	return f, nil
+}
+
+// closeRaw closes the file of one media kind, if any. The caller must
+// hold r.mu.
+func (r *Recorder) closeRaw(kind webrtc.RTPCodecType) {
+	f := r.raw[kind]
+	if f == nil {
+		return
+	}
+	if err := f.w.Close(); err != nil {
+		roomLog(r.roomID).Error("Failed to close recording", "err", err)
+	}
+	delete(r.raw, kind)
+	if r.onFile != nil {
+		r.onFile(f.path)
+	}
+}
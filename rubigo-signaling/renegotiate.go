@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Control message carrying an SFU offer that adds tracks to a viewer's
+// connection. The viewer answers with POST .../viewer/{viewerId}/answer.
+const controlRenegotiate = "renegotiate"
+
+// errNoPendingOffer is returned for an answer nobody asked for
+var errNoPendingOffer = errors.New("no offer awaiting an answer")
+
+// addAudio attaches audio to the viewer's connection. It returns true if a
+// new sender was added, in which case the viewer must renegotiate; a viewer
+// that already has an audio sender is switched over in place.
+func (v *viewer) addAudio(audio *forwardingTrack) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.audio == audio {
+		return false, nil
+	}
+
+	if v.audioSender != nil {
+		// The broadcaster came back with a different audio track
+		if !v.paused {
+			if err := v.audioSender.ReplaceTrack(audio); err != nil {
+				return false, err
+			}
+		}
+		v.audio = audio
+		return false, nil
+	}
+
+	sender, err := v.pc.AddTrack(audio)
+	if err != nil {
+		return false, err
+	}
+	if v.paused {
+		if err := sender.ReplaceTrack(nil); err != nil {
+			return false, err
+		}
+	}
+	go readRTCP(sender, nil, nil)
+	v.audio, v.audioSender = audio, sender
+	return true, nil
+}
+
+// offer sends the viewer a fresh offer on its control channel. If an
+// earlier offer is still unanswered, this one is sent once it is.
+func (v *viewer) offer() error {
+	v.mu.Lock()
+	if v.negotiating {
+		v.renegotiate = true
+		v.mu.Unlock()
+		return nil
+	}
+	v.negotiating = true
+	v.mu.Unlock()
+
+	offer, err := v.pc.CreateOffer(nil)
+	if err == nil {
+		// ICE is already up, so gathering completes immediately
+		gatherComplete := webrtc.GatheringCompletePromise(v.pc)
+		if err = v.pc.SetLocalDescription(offer); err == nil {
+			<-gatherComplete
+		}
+	}
+	if err != nil {
+		v.mu.Lock()
+		v.negotiating = false
+		v.mu.Unlock()
+		return err
+	}
+
+	sendControlMessage(v.control, controlMessage{
+		Type:   controlRenegotiate,
+		SDP:    v.pc.LocalDescription().SDP,
+		Tracks: v.trackInfos(),
+	})
+	return nil
+}
+
+// applyAnswer completes a renegotiation started by offer. again reports
+// whether another offer was queued meanwhile and should be sent now.
+func (v *viewer) applyAnswer(sdp string) (again bool, err error) {
+	v.mu.Lock()
+	negotiating := v.negotiating
+	v.mu.Unlock()
+	if !negotiating {
+		return false, errNoPendingOffer
+	}
+
+	// On failure the offer stays pending so the viewer can retry
+	if err := v.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	}); err != nil {
+		return false, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.negotiating = false
+	again, v.renegotiate = v.renegotiate, false
+	return again, nil
+}
+
+// offerTracks adds the broadcaster's audio and extra video tracks, and
+// co-presenters' tracks, that a connected viewer is missing, then
+// renegotiates once. Viewers without an open control channel can't receive
+// the offer, so they are left with what their subscribe answer had room for.
+func offerTracks(room *Room, v *viewer) {
+	if v.control == nil || v.control.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	added := false
+	if audio := room.AudioTrack(); audio != nil {
+		ok, err := v.addAudio(audio)
+		if err != nil {
+			room.viewerLog(v.id).Error("Failed to add audio for viewer", "err", err)
+		}
+		added = added || ok
+	}
+	published := room.PublishedTracks()
+	for _, key := range sortedTrackKeys(published) {
+		track := published[key]
+		ok, err := v.addExtra(key, track, publishedKeyframeRequester(room, track))
+		if err != nil {
+			room.viewerLog(v.id).Error("Failed to add track for viewer", "peer", key.peerID, "track", key.trackID, "err", err)
+		}
+		added = added || ok
+	}
+	if !added {
+		return
+	}
+	if err := v.offer(); err != nil {
+		room.viewerLog(v.id).Error("Failed to renegotiate with viewer", "err", err)
+		return
+	}
+	room.viewerLog(v.id).Info("Offered new tracks to viewer")
+}
+
+// offerTracksToViewers runs offerTracks for every viewer already
+// subscribed, typically because audio or a camera was enabled after the
+// screen, or a co-presenter joined
+func offerTracksToViewers(room *Room) {
+	room.ForEachViewer(func(v *viewer) {
+		offerTracks(room, v)
+	})
+}
+
+// handleViewerAnswer handles POST /internal/room/{id}/viewer/{viewerId}/answer
+// The viewer's answer to a renegotiate offer from the control channel
+func (s *Server) handleViewerAnswer(w http.ResponseWriter, r *http.Request, roomID, viewerID string) {
+	var answer SDPExchange
+	if !s.decodeJSON(w, r, &answer) {
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	v := room.Viewer(viewerID)
+	if v == nil {
+		writeError(w, http.StatusNotFound, errCodeViewerNotFound, "Viewer not found")
+		return
+	}
+
+	again, err := v.applyAnswer(answer.SDP)
+	if errors.Is(err, errNoPendingOffer) {
+		writeError(w, http.StatusConflict, errCodeNoPendingOffer, "No offer awaiting an answer")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Failed to set remote description: %v", err))
+		return
+	}
+	if again {
+		go func() {
+			if err := v.offer(); err != nil {
+				room.viewerLog(viewerID).Error("Failed to renegotiate with viewer", "err", err)
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "renegotiated",
+		"roomId":   roomID,
+		"viewerId": viewerID,
+	})
+}
+
+// handleRenegotiateWithID handles POST /internal/room/{id}/renegotiate
+// The broadcaster sends a new offer on its existing connection, e.g. after
+// adding an audio track, and receives an answer. A co-presenter does the
+// same by including its peerId.
+func (s *Server) handleRenegotiateWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	if !room.CheckPassword(offer.Password) {
+		writeError(w, http.StatusForbidden, errCodeInvalidPassword, "Invalid room password")
+		return
+	}
+	pc, logger := room.BroadcasterPC(), room.broadcasterLog()
+	if offer.PeerID != "" {
+		pc, logger = room.PresenterPC(offer.PeerID), room.presenterLog(offer.PeerID)
+	}
+	if pc == nil {
+		writeError(w, http.StatusConflict, errCodeNoBroadcaster, "No broadcaster in room")
+		return
+	}
+	codecs := s.receiveCodecs(room)
+	if !checkOfferCodecs(w, offer.SDP, codecs) {
+		return
+	}
+
+	// New tracks arrive through the OnTrack handler set up by publish or
+	// present
+	if offer.PeerID != "" {
+		room.SetPresenterLabels(offer.PeerID, offer.TrackLabels)
+	} else {
+		room.SetTrackLabels(offer.TrackLabels)
+	}
+	// The connection is live, so it is left open whatever happens
+	gatherComplete, err := s.answerOffer(r.Context(), pc, offer.SDP, codecs)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SDPExchange{
+		Type: "answer",
+		SDP:  pc.LocalDescription().SDP,
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// negotiate completes an offer/answer round from offerer to answerer
+func negotiate(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	t.Helper()
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// answerViewer answers the viewer's pending SFU offer from client
+func answerViewer(t *testing.T, v *viewer, client *webrtc.PeerConnection) (bool, error) {
+	t.Helper()
+	if err := client.SetRemoteDescription(*v.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	return v.applyAnswer(client.LocalDescription().SDP)
+}
+
+func TestViewerAddAudioRenegotiates(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, control, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A video-only subscribe
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	track := newLiveTrack(t)
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, client, pc)
+	v := &viewer{id: "v1", pc: pc, control: control, sender: sender, track: track}
+
+	audio, err := newForwardingTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := v.addAudio(audio)
+	if err != nil || !added {
+		t.Fatalf("addAudio = %t, %v; want new sender", added, err)
+	}
+	if added, _ := v.addAudio(audio); added {
+		t.Error("second addAudio added another sender")
+	}
+
+	if err := v.offer(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pc.LocalDescription().SDP, "m=audio") {
+		t.Fatal("renegotiation offer has no audio section")
+	}
+	// An offer requested mid-negotiation is queued for after the answer
+	if err := v.offer(); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := answerViewer(t, v, client)
+	if err != nil {
+		t.Fatalf("applyAnswer: %v", err)
+	}
+	if !again {
+		t.Error("queued offer not reported after answer")
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("signaling state = %s, want stable", state)
+	}
+	if _, err := v.applyAnswer(client.LocalDescription().SDP); !errors.Is(err, errNoPendingOffer) {
+		t.Errorf("unsolicited answer = %v, want errNoPendingOffer", err)
+	}
+
+	// Pausing stops audio along with video
+	if err := v.setPaused(true); err != nil {
+		t.Fatal(err)
+	}
+	if v.audioSender.Track() != nil {
+		t.Error("paused viewer still has a track on its audio sender")
+	}
+}
+
+func TestRenegotiateRoutes(t *testing.T) {
+	store := newFakeStore("abc")
+	store.rooms["live"] = &Room{id: "live", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	if err := store.rooms["live"].AddViewer(&viewer{id: "v1", track: store.rooms["live"].GetBroadcasterTrack()}); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, store)
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		want     int
+		wantCode string
+	}{
+		{"answer in unknown room", "/internal/room/nope/viewer/v1/answer", `{"type":"answer","sdp":""}`, http.StatusNotFound, errCodeRoomNotFound},
+		{"answer from unknown viewer", "/internal/room/live/viewer/v2/answer", `{"type":"answer","sdp":""}`, http.StatusNotFound, errCodeViewerNotFound},
+		{"unsolicited answer", "/internal/room/live/viewer/v1/answer", `{"type":"answer","sdp":""}`, http.StatusConflict, errCodeNoPendingOffer},
+		{"renegotiate unknown room", "/internal/room/nope/renegotiate", `{"type":"offer","sdp":""}`, http.StatusNotFound, errCodeRoomNotFound},
+		{"renegotiate without broadcaster", "/internal/room/abc/renegotiate", `{"type":"offer","sdp":""}`, http.StatusConflict, errCodeNoBroadcaster},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, h, http.MethodPost, tt.path, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			decodeError(t, rec, tt.wantCode)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeResolution returns the frame size carried by an RTP payload that
+// starts a keyframe. VP8 keyframes carry it in the frame header and VP9
+// keyframes in the scalability structure; other codecs and non-keyframe
+// packets report ok=false.
+func keyframeResolution(mimeType string, payload []byte) (width, height int, ok bool) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return vp8Resolution(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return vp9Resolution(payload)
+	}
+	return 0, 0, false
+}
+
+func vp8Resolution(payload []byte) (int, int, bool) {
+	var pkt codecs.VP8Packet
+	frame, err := pkt.Unmarshal(payload)
+	if err != nil || pkt.S != 1 || pkt.PID != 0 {
+		return 0, 0, false
+	}
+	// 3-byte frame tag (bit 0 clear on keyframes), start code, then
+	// 14-bit little-endian width and height
+	if len(frame) < 10 || frame[0]&0x01 != 0 ||
+		frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width := int(frame[6]) | int(frame[7]&0x3f)<<8
+	height := int(frame[8]) | int(frame[9]&0x3f)<<8
+	return width, height, width > 0 && height > 0
+}
+
+func vp9Resolution(payload []byte) (int, int, bool) {
+	var pkt codecs.VP9Packet
+	if _, err := pkt.Unmarshal(payload); err != nil || !pkt.B || pkt.P || !pkt.V {
+		return 0, 0, false
+	}
+	// Report the largest spatial layer
+	width, height := 0, 0
+	for i := range pkt.Width {
+		if int(pkt.Width[i]) > width && i < len(pkt.Height) {
+			width, height = int(pkt.Width[i]), int(pkt.Height[i])
+		}
+	}
+	return width, height, width > 0 && height > 0
+}
+
+// keyframeStart reports whether an RTP payload is the first packet of a
+// keyframe: for VP9, of a frame that isn't predicted from earlier ones
+func keyframeStart(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		var pkt codecs.VP8Packet
+		frame, err := pkt.Unmarshal(payload)
+		return err == nil && pkt.S == 1 && pkt.PID == 0 && len(frame) > 0 && frame[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		var pkt codecs.VP9Packet
+		_, err := pkt.Unmarshal(payload)
+		return err == nil && pkt.B && !pkt.P && pkt.SID == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264KeyframeStart(payload)
+	}
+	return false
+}
+
+// detectsKeyframes reports whether keyframeStart recognizes mimeType's
+// keyframes
+func detectsKeyframes(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeVP8) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeVP9) ||
+		strings.EqualFold(mimeType, webrtc.MimeTypeH264)
+}
+
+// H.264 NAL unit types (RFC 6184)
+const (
+	h264NALIDR   = 5
+	h264NALSPS   = 7
+	h264NALSTAPA = 24
+	h264NALFUA   = 28
+)
+
+// h264KeyframeStart reports whether an H.264 payload starts an IDR picture
+// or the SPS sent ahead of one
+func h264KeyframeStart(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch nal := payload[0] & 0x1F; nal {
+	case h264NALIDR, h264NALSPS:
+		return true
+	case h264NALSTAPA:
+		// Aggregated NAL units, each behind a 16-bit size
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(rest[0])<<8 | int(rest[1])
+			if size == 0 || len(rest) < 2+size {
+				return false
+			}
+			if t := rest[2] & 0x1F; t == h264NALIDR || t == h264NALSPS {
+				return true
+			}
+			rest = rest[2+size:]
+		}
+	case h264NALFUA:
+		// The first fragment has the start bit set
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == h264NALIDR
+	}
+	return false
+}
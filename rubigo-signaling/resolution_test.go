@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// vp8Keyframe is a VP8 payload descriptor (S=1, PID=0) followed by the
+// start of a 1920x1080 keyframe
+var vp8Keyframe = []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x07, 0x38, 0x04, 0x00}
+
+func TestKeyframeResolution(t *testing.T) {
+	vp8Interframe := append([]byte(nil), vp8Keyframe...)
+	vp8Interframe[1] |= 0x01
+	vp8Continuation := append([]byte(nil), vp8Keyframe...)
+	vp8Continuation[0] = 0x00
+
+	tests := []struct {
+		name          string
+		mimeType      string
+		payload       []byte
+		width, height int
+		ok            bool
+	}{
+		{"VP8 keyframe", webrtc.MimeTypeVP8, vp8Keyframe, 1920, 1080, true},
+		{"VP8 interframe", webrtc.MimeTypeVP8, vp8Interframe, 0, 0, false},
+		{"VP8 continuation", webrtc.MimeTypeVP8, vp8Continuation, 0, 0, false},
+		{"VP8 truncated", webrtc.MimeTypeVP8, vp8Keyframe[:6], 0, 0, false},
+		// B and V set; one spatial layer with resolution, 1280x720
+		{"VP9 scalability structure", webrtc.MimeTypeVP9, []byte{0x0a, 0x10, 0x05, 0x00, 0x02, 0xd0, 0x00}, 1280, 720, true},
+		{"VP9 without SS", webrtc.MimeTypeVP9, []byte{0x08, 0x00}, 0, 0, false},
+		{"H264 unsupported", webrtc.MimeTypeH264, vp8Keyframe, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, ok := keyframeResolution(tt.mimeType, tt.payload)
+			if width != tt.width || height != tt.height || ok != tt.ok {
+				t.Errorf("keyframeResolution = %d, %d, %t; want %d, %d, %t", width, height, ok, tt.width, tt.height, tt.ok)
+			}
+		})
+	}
+}
+
+func TestForwardingTrackObserveKeyframe(t *testing.T) {
+	track := newLiveTrack(t)
+	if width, height := track.Resolution(); width != 0 || height != 0 {
+		t.Fatalf("Resolution before keyframe = %dx%d, want 0x0", width, height)
+	}
+
+	track.ObserveKeyframe(&rtp.Packet{Payload: vp8Keyframe})
+	if width, height := track.Resolution(); width != 1920 || height != 1080 {
+		t.Errorf("Resolution = %dx%d, want 1920x1080", width, height)
+	}
+}
+
+func TestH264KeyframeStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"IDR", []byte{0x65, 0x88}, true},
+		{"non-IDR slice", []byte{0x41, 0x9a}, false},
+		// SPS and PPS aggregated ahead of the IDR
+		{"STAP-A with SPS", []byte{0x18, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"STAP-A without SPS", []byte{0x18, 0x00, 0x02, 0x06, 0x05}, false},
+		{"first IDR fragment", []byte{0x7c, 0x85, 0x88}, true},
+		{"later IDR fragment", []byte{0x7c, 0x05, 0x88}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := keyframeStart(webrtc.MimeTypeH264, tt.payload); got != tt.want {
+			t.Errorf("%s: keyframeStart = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// RoomStore looks up and manages rooms.
+// RoomManager is the in-memory implementation; tests can substitute their own.
+type RoomStore interface {
+	GetOrCreate(id string) (room *Room, created bool)
+	// TryCreate is GetOrCreate with a cap on the number of rooms; a limit
+	// of zero means unlimited. Existing rooms are returned regardless.
+	TryCreate(id string, limit int) (room *Room, created bool, err error)
+	Get(id string) *Room
+	Delete(id string)
+	Rooms() []*Room
+}
+
+// RoomManager manages in-memory room state
+type RoomManager struct {
+	mu      sync.RWMutex
+	rooms   map[string]*Room
+	observe func(RoomEvent) // see SetEventObserver
+	history int             // see SetRetransmitHistory
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms: make(map[string]*Room),
+	}
+}
+
+// RoomLimitError is returned by TryCreate when the room cap is reached
+type RoomLimitError struct {
+	Current int
+	Limit   int
+}
+
+func (e *RoomLimitError) Error() string {
+	return fmt.Sprintf("room limit reached (%d/%d)", e.Current, e.Limit)
+}
+
+// GetOrCreate returns the room with id, creating it if needed.
+// created reports whether the room was newly created.
+func (m *RoomManager) GetOrCreate(id string) (*Room, bool) {
+	room, created, _ := m.TryCreate(id, 0)
+	return room, created
+}
+
+// TryCreate returns the room with id, creating it unless limit rooms
+// already exist, in which case it fails with a *RoomLimitError
+func (m *RoomManager) TryCreate(id string, limit int) (*Room, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if room, ok := m.rooms[id]; ok {
+		return room, false, nil
+	}
+	if limit > 0 && len(m.rooms) >= limit {
+		return nil, false, &RoomLimitError{Current: len(m.rooms), Limit: limit}
+	}
+
+	room := &Room{id: id, onEvent: m.observe, created: time.Now(), history: m.history}
+	m.rooms[id] = room
+	m.notifyLocked(debugEventRoomCreated, id)
+	roomLog(id).Info("Created room")
+	return room, true, nil
+}
+
+func (m *RoomManager) Get(id string) *Room {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.rooms[id]
+}
+
+func (m *RoomManager) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rooms[id]; ok {
+		m.notifyLocked(debugEventRoomDeleted, id)
+	}
+	delete(m.rooms, id)
+	roomLog(id).Info("Deleted room")
+}
+
+// Rooms returns a snapshot of all current rooms
+func (m *RoomManager) Rooms() []*Room {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// How long viewers are kept after their broadcaster's track ends, giving a
+// reconnecting broadcaster time to resume the same track, unless the
+// server configures another grace period
+const broadcasterGracePeriod = 10 * time.Second
+
+// errNoBroadcaster is returned when a viewer's track has no live broadcaster
+var errNoBroadcaster = errors.New("no broadcaster in room")
+
+// errBroadcasterReplaced is returned for a track arriving on a connection
+// that a newer publish has replaced
+var errBroadcasterReplaced = errors.New("broadcaster connection was replaced")
+
+// broadcasterConn is the current publish's connection and control channel.
+// They are swapped together so nothing pairs one publish's connection with
+// another's channel.
+type broadcasterConn struct {
+	pc      *webrtc.PeerConnection
+	control *webrtc.DataChannel // for viewer counts
+	id      string              // tags its log lines
+}
+
+// Room holds in-memory state for a screen share session
+// No persistence - Next.js owns room metadata in SQLite
+//
+// Lock order: mu is taken before a viewer's or forwarding track's own mutex,
+// never after. eventsMu and countMu are leaves. Nothing sends on a data
+// channel or closes a connection while holding mu.
+type Room struct {
+	id                string
+	created           time.Time // when the room manager created it; zero for rooms made otherwise
+	mu                sync.RWMutex
+	broadcaster       broadcasterConn
+	broadcasterPolicy BroadcasterPolicy             // empty means BroadcasterTakeover
+	broadcasterTracks map[string]*forwardingTrack   // video, keyed by simulcast RID
+	audioTrack        *forwardingTrack              // broadcaster audio, nil until it sends some
+	published         map[trackKey]*forwardingTrack // extra video and co-presenters' tracks
+	presenters        map[string]*presenter         // co-presenters by peer ID
+	trackLabels       map[string]string             // broadcaster mid -> label
+	mainLabel         string                        // label of broadcasterTracks
+	viewers           map[string]*viewer            // keyed by viewer ID
+	banned            map[string]struct{}           // viewer IDs refused on subscribe
+	reconnects        map[string]*reconnectSlot     // keyed by reconnect token
+	broadcasterToken  string                        // resumes the broadcast without the password
+	broadcasterGrace  time.Duration                 // how long viewers wait for the broadcaster; zero means broadcasterGracePeriod
+	maxViewers        int                           // lowers the server's viewer cap when set
+	maxBitrate        float64                       // video cap in bits per second; zero if none
+	history           int                           // packets each video track keeps for NACKs; zero for none
+	recorder          *Recorder
+	hls               *hlsEgress
+	controlChannels   map[*webrtc.DataChannel]struct{}
+	dataChannels      map[string]map[*webrtc.DataChannel]struct{} // peers' own channels by label
+	passwordHash      []byte
+	lastPacket        atomic.Int64          // unix nanos of the last broadcaster RTP packet
+	bytesIn           atomic.Int64          // RTP bytes received from the broadcaster
+	bytesOut          atomic.Int64          // RTP bytes sent to viewers
+	quotaHit          atomic.Bool           // the byte quota ended the room's session
+	iceServers        []webrtc.ICEServer    // overrides the server default when set
+	codecPolicy       CodecPolicy           // overrides the server policy's lists it sets
+	idleTimeout       time.Duration         // overrides RoomIdleTimeout when set
+	idleSince         time.Time             // when the reaper found the room empty; zero while in use
+	quality           []TrackQuality        // viewers' reception per track, updated every qualityInterval
+	qualityAlerts     map[trackKey]struct{} // tracks whose quality_degraded awaits quality_recovered
+
+	eventsMu  sync.Mutex
+	eventSubs map[chan RoomEvent]struct{}
+	onEvent   func(RoomEvent) // sees every event; set at creation
+
+	// countMu guards the pending viewer count update
+	countMu    sync.Mutex
+	countTimer *time.Timer
+}
+
+// Created returns when the room was created
+func (r *Room) Created() time.Time {
+	return r.created
+}
+
+// SetICEServers sets the ICE servers for the room's peer connections
+func (r *Room) SetICEServers(servers []webrtc.ICEServer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.iceServers = servers
+}
+
+// ICEServers returns the room's ICE servers, or nil to use the default
+func (r *Room) ICEServers() []webrtc.ICEServer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.iceServers
+}
+
+// SetCodecPolicy sets the room's codec policy
+func (r *Room) SetCodecPolicy(policy CodecPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecPolicy = policy
+}
+
+// CodecPolicy returns the room's codec policy, whose lists override the
+// server's
+func (r *Room) CodecPolicy() CodecPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.codecPolicy
+}
+
+// SetBroadcaster makes pc, with its control channel, the room's broadcaster,
+// known in logs as peerID. Tracks from any earlier connection are ignored
+// from then on.
+func (r *Room) SetBroadcaster(pc *webrtc.PeerConnection, control *webrtc.DataChannel, peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.broadcaster = broadcasterConn{pc: pc, control: control, id: peerID}
+}
+
+// ClearBroadcaster forgets pc if it is still the broadcaster, e.g. when its
+// publish fails after SetBroadcaster
+func (r *Room) ClearBroadcaster(pc *webrtc.PeerConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.broadcaster.pc == pc {
+		r.broadcaster = broadcasterConn{}
+	}
+}
+
+// BroadcasterPC returns the current broadcaster connection, or nil
+func (r *Room) BroadcasterPC() *webrtc.PeerConnection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.broadcaster.pc
+}
+
+// broadcasterLog returns the logger for the current broadcaster
+func (r *Room) broadcasterLog() *slog.Logger {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.broadcasterLogLocked()
+}
+
+func (r *Room) broadcasterLogLocked() *slog.Logger {
+	return peerLog(r.id, "broadcaster", r.broadcaster.id)
+}
+
+// viewerLog returns the logger for the viewer with id
+func (r *Room) viewerLog(id string) *slog.Logger {
+	return peerLog(r.id, "viewer", id)
+}
+
+// touchBroadcaster records that a broadcaster packet just arrived
+func (r *Room) touchBroadcaster() {
+	r.lastPacket.Store(time.Now().UnixNano())
+}
+
+// LastBroadcasterPacket returns when the last broadcaster packet arrived,
+// or the zero time if none has
+func (r *Room) LastBroadcasterPacket() time.Time {
+	nanos := r.lastPacket.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// AttachBroadcasterSource makes remote, received on from, the upstream of
+// the room's forwarding track for its simulcast RID, or of the audio track
+// for audio. The existing track is reused when the codec matches so
+// subscribed viewers resume seamlessly; reused reports whether that
+// happened. It fails with errBroadcasterReplaced unless from is the current
+// broadcaster connection.
+func (r *Room) AttachBroadcasterSource(from *webrtc.PeerConnection, remote *webrtc.TrackRemote) (track *forwardingTrack, reused bool, err error) {
+	if remote.Kind() == webrtc.RTPCodecTypeAudio {
+		return r.attachAudio(from, remote)
+	}
+
+	r.mu.Lock()
+	if r.broadcaster.pc != from {
+		r.mu.Unlock()
+		return nil, false, errBroadcasterReplaced
+	}
+	wasLive := r.hasLiveTrackLocked()
+	track, reused, err = r.attachLocked(remote)
+	var resumed []*viewer
+	if reused {
+		resumed = r.viewersOnLocked(track)
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return nil, false, err
+	}
+	// Viewers kept through a reconnect learn the stream is back
+	for _, v := range resumed {
+		sendControlMessage(v.control, controlMessage{Type: EventBroadcasterStarted})
+	}
+	if !wasLive {
+		r.publishEvent(EventBroadcasterStarted)
+	}
+	return track, reused, nil
+}
+
+// attachAudio is AttachBroadcasterSource for the audio track. Audio doesn't
+// decide whether the broadcast is live, so no events are published.
+func (r *Room) attachAudio(from *webrtc.PeerConnection, remote *webrtc.TrackRemote) (*forwardingTrack, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.broadcaster.pc != from {
+		return nil, false, errBroadcasterReplaced
+	}
+
+	codec := remote.Codec().RTPCodecCapability
+	if r.audioTrack != nil && strings.EqualFold(r.audioTrack.Codec().MimeType, codec.MimeType) {
+		r.audioTrack.SetSource(remote)
+		return r.audioTrack, true, nil
+	}
+	track, err := newForwardingTrack(codec)
+	if err != nil {
+		return nil, false, err
+	}
+	track.SetSource(remote)
+	r.audioTrack = track
+	return track, false, nil
+}
+
+// AudioTrack returns the audio forwarding track while the broadcaster is
+// feeding it, or nil
+func (r *Room) AudioTrack() *forwardingTrack {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.audioTrack == nil || r.audioTrack.Source() == nil {
+		return nil
+	}
+	return r.audioTrack
+}
+
+func (r *Room) attachLocked(remote *webrtc.TrackRemote) (*forwardingTrack, bool, error) {
+	rid := remote.RID()
+	codec := remote.Codec().RTPCodecCapability
+	if existing := r.broadcasterTracks[rid]; existing != nil && strings.EqualFold(existing.Codec().MimeType, codec.MimeType) {
+		existing.SetSource(remote)
+		return existing, true, nil
+	}
+
+	track, err := newForwardingTrack(codec)
+	if err != nil {
+		return nil, false, err
+	}
+	track.SetSource(remote)
+	if r.maxBitrate > 0 {
+		r.capTrackLocked(track)
+	}
+	if r.history > 0 {
+		track.keepHistory(r.history)
+	}
+	if r.broadcasterTracks == nil {
+		r.broadcasterTracks = make(map[string]*forwardingTrack)
+	}
+	r.broadcasterTracks[rid] = track
+	return track, false, nil
+}
+
+// DetachBroadcasterSource clears remote as the upstream if it is still current.
+// The forwarding track is kept so a republish can resume it; viewers on it
+// are told the broadcaster ended and closed if it doesn't return within
+// the grace period.
+func (r *Room) DetachBroadcasterSource(remote *webrtc.TrackRemote) {
+	// Clear under the room lock so AddViewer sees a consistent state
+	r.mu.Lock()
+	if remote.Kind() == webrtc.RTPCodecTypeAudio {
+		// Viewers keep their audio sender, which resumes if the
+		// broadcaster comes back with the same codec
+		if r.audioTrack != nil {
+			r.audioTrack.ClearSource(remote)
+		}
+		r.mu.Unlock()
+		return
+	}
+	track := r.broadcasterTracks[remote.RID()]
+	if track == nil || !track.ClearSource(remote) {
+		// An extra or co-presenter track ends like audio: viewers keep
+		// its sender
+		r.clearPublishedLocked(remote)
+		r.mu.Unlock()
+		return
+	}
+	ended := []endedTrack{r.endedTrackLocked(track)}
+	live := r.hasLiveTrackLocked()
+	r.mu.Unlock()
+
+	r.broadcasterEnded(ended, live)
+}
+
+// Unpublish ends the broadcast immediately rather than waiting for the
+// broadcaster's tracks to error out: every forwarding track loses its
+// source and the broadcaster connection is closed. Viewers are handled as
+// for DetachBroadcasterSource, but the broadcaster's reconnect token is
+// revoked. It returns false if nothing was published.
+func (r *Room) Unpublish() bool {
+	r.mu.Lock()
+	r.broadcasterToken = ""
+	r.mu.Unlock()
+	return r.unpublish(nil)
+}
+
+// unpublish is Unpublish, limited to when only is the broadcaster unless
+// only is nil
+func (r *Room) unpublish(only *webrtc.PeerConnection) bool {
+	r.mu.Lock()
+	if only != nil && r.broadcaster.pc != only {
+		r.mu.Unlock()
+		return false
+	}
+	pc, logger := r.broadcaster.pc, r.broadcasterLogLocked()
+	r.broadcaster = broadcasterConn{}
+	var ended []endedTrack
+	for _, track := range r.broadcasterTracks {
+		if source := track.Source(); source != nil && track.ClearSource(source) {
+			ended = append(ended, r.endedTrackLocked(track))
+		}
+	}
+	if r.audioTrack != nil {
+		if source := r.audioTrack.Source(); source != nil {
+			r.audioTrack.ClearSource(source)
+		}
+	}
+	for key, track := range r.published {
+		if source := track.Source(); key.peerID == "" && source != nil {
+			track.ClearSource(source)
+		}
+	}
+	r.mu.Unlock()
+
+	if pc != nil {
+		if err := pc.Close(); err != nil {
+			logger.Error("Failed to close broadcaster", "err", err)
+		}
+	}
+	if len(ended) > 0 {
+		logger.Info("Broadcaster unpublished")
+		r.broadcasterEnded(ended, false)
+	}
+	return pc != nil || len(ended) > 0
+}
+
+// endedTrack is a forwarding track that just lost its source, with the
+// viewers on it at that moment
+type endedTrack struct {
+	track      *forwardingTrack
+	generation uint64
+	viewers    []*viewer
+}
+
+// endedTrackLocked snapshots track after its source was cleared.
+// The caller must hold r.mu.
+func (r *Room) endedTrackLocked(track *forwardingTrack) endedTrack {
+	return endedTrack{track: track, generation: track.Generation(), viewers: r.viewersOnLocked(track)}
+}
+
+// broadcasterEnded tells the viewers of ended tracks the broadcaster is gone
+// and closes them if it doesn't return within the grace period. live
+// reports whether any other track is still being fed.
+func (r *Room) broadcasterEnded(ended []endedTrack, live bool) {
+	for _, e := range ended {
+		for _, v := range e.viewers {
+			sendControlMessage(v.control, controlMessage{Type: EventBroadcasterEnded})
+		}
+	}
+	if !live {
+		r.publishEvent(EventBroadcasterEnded)
+	}
+
+	r.mu.RLock()
+	grace := r.broadcasterGrace
+	r.mu.RUnlock()
+	if grace <= 0 {
+		grace = broadcasterGracePeriod
+	}
+	for _, e := range ended {
+		e := e
+		time.AfterFunc(grace, func() {
+			r.closeOrphanedViewers(e.track, e.generation)
+		})
+	}
+}
+
+// closeOrphanedViewers closes viewers of track if its broadcaster hasn't
+// come back since generation, when its reconnect token also lapses
+func (r *Room) closeOrphanedViewers(track *forwardingTrack, generation uint64) {
+	r.mu.Lock()
+	if track.Source() != nil || track.Generation() != generation {
+		r.mu.Unlock()
+		return
+	}
+	orphaned := r.viewersOnLocked(track)
+	r.broadcasterToken = ""
+	r.mu.Unlock()
+
+	if len(orphaned) > 0 {
+		roomLog(r.id).Info("Broadcaster did not return, closing viewers", "viewers", len(orphaned))
+	}
+	for _, v := range orphaned {
+		v.pc.Close()
+	}
+}
+
+// viewersOnLocked returns the viewers receiving track.
+// The caller must hold r.mu.
+func (r *Room) viewersOnLocked(track *forwardingTrack) []*viewer {
+	var result []*viewer
+	for _, v := range r.viewers {
+		if v.track == track {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// hasLiveTrackLocked reports whether any forwarding track has a source.
+// The caller must hold r.mu.
+func (r *Room) hasLiveTrackLocked() bool {
+	for _, track := range r.broadcasterTracks {
+		if track.Source() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBroadcasterTrack returns the default forwarding track while a
+// broadcaster is feeding it, or nil if there is no live broadcaster
+func (r *Room) GetBroadcasterTrack() *forwardingTrack {
+	track, _ := r.SelectLayer("")
+	return track
+}
+
+// SelectLayer picks the live forwarding track for a simulcast layer
+// (low, mid or high) and returns it with the RID it was found under.
+// An empty or unavailable layer falls back to the best live track.
+func (r *Room) SelectLayer(layer string) (*forwardingTrack, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	live := func(rid string) bool {
+		track := r.broadcasterTracks[rid]
+		return track != nil && track.Source() != nil
+	}
+
+	for _, rid := range simulcastLayers[layer] {
+		if live(rid) {
+			return r.broadcasterTracks[rid], rid
+		}
+	}
+
+	// Non-simulcast broadcasters publish a single track without a RID
+	if live("") {
+		return r.broadcasterTracks[""], ""
+	}
+	for _, name := range layerPreference {
+		for _, rid := range simulcastLayers[name] {
+			if live(rid) {
+				return r.broadcasterTracks[rid], rid
+			}
+		}
+	}
+	for rid := range r.broadcasterTracks {
+		if live(rid) {
+			return r.broadcasterTracks[rid], rid
+		}
+	}
+	return nil, ""
+}
+
+// WaitForLayer is SelectLayer for a viewer that arrived before the
+// broadcaster: it blocks until a track is live or ctx is done, in which
+// case it returns nil
+func (r *Room) WaitForLayer(ctx context.Context, layer string) (*forwardingTrack, string) {
+	// Subscribe before checking so a broadcaster starting in between
+	// still wakes us
+	events, cancel := r.SubscribeEvents()
+	defer cancel()
+
+	for {
+		if track, rid := r.SelectLayer(layer); track != nil {
+			return track, rid
+		}
+		select {
+		case <-events:
+		case <-ctx.Done():
+			return nil, ""
+		}
+	}
+}
+
+// Layers returns the RIDs of the broadcaster's live simulcast layers
+func (r *Room) Layers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var rids []string
+	for rid, track := range r.broadcasterTracks {
+		if rid != "" && track.Source() != nil {
+			rids = append(rids, rid)
+		}
+	}
+	sort.Strings(rids)
+	return rids
+}
+
+// AddViewer registers a viewer against its track. It fails with
+// errNoBroadcaster if the track lost its broadcaster during negotiation, so
+// the viewer gets a clean error instead of a frozen stream.
+// A viewer without an ID is assigned one; a client-chosen ID fails with
+// errViewerBanned or errViewerExists if it is banned or taken.
+func (r *Room) AddViewer(v *viewer) error {
+	return r.AddViewerUpTo(v, 0)
+}
+
+// AddViewerUpTo is AddViewer failing with errRoomFull if the room already
+// has limit viewers; zero means no limit
+func (r *Room) AddViewerUpTo(v *viewer, limit int) error {
+	r.mu.Lock()
+	if v.track == nil || v.track.Source() == nil {
+		r.mu.Unlock()
+		return errNoBroadcaster
+	}
+	if limit > 0 && len(r.viewers) >= limit {
+		r.mu.Unlock()
+		return errRoomFull
+	}
+	if v.id == "" {
+		v.id = newPeerID()
+	} else if _, banned := r.banned[v.id]; banned {
+		r.mu.Unlock()
+		return errViewerBanned
+	} else if _, taken := r.viewers[v.id]; taken {
+		r.mu.Unlock()
+		return errViewerExists
+	}
+	if r.viewers == nil {
+		r.viewers = make(map[string]*viewer)
+	}
+	r.viewers[v.id] = v
+	r.viewerLog(v.id).Info("Viewer joined", "viewers", len(r.viewers))
+	r.mu.Unlock()
+
+	r.publishViewerEvent(EventViewerJoined, v.id)
+	r.viewerCountChanged()
+	return nil
+}
+
+// RemoveViewer drops the viewer with id; it is a no-op if there is none
+func (r *Room) RemoveViewer(id string) {
+	r.mu.Lock()
+	removed := r.removeViewerLocked(id)
+	r.mu.Unlock()
+
+	if removed {
+		r.publishViewerEvent(EventViewerLeft, id)
+		r.viewerCountChanged()
+	}
+}
+
+// removeViewerLocked drops the viewer with id and reports whether there was
+// one. The caller must hold r.mu and publish EventViewerLeft if so.
+func (r *Room) removeViewerLocked(id string) bool {
+	v, ok := r.viewers[id]
+	if !ok {
+		return false
+	}
+	if v.simulcast != nil {
+		v.simulcast.detach()
+	}
+	delete(r.viewers, id)
+	r.viewerLog(id).Info("Viewer left", "viewers", len(r.viewers))
+	return true
+}
+
+// ForEachViewer calls fn for each viewer in a snapshot taken under the
+// lock. fn runs without the lock held, so it may do network I/O or call
+// back into the room; viewers that join or leave meanwhile may be missed or
+// still visited.
+func (r *Room) ForEachViewer(fn func(v *viewer)) {
+	r.mu.RLock()
+	viewers := make([]*viewer, 0, len(r.viewers))
+	for _, v := range r.viewers {
+		viewers = append(viewers, v)
+	}
+	r.mu.RUnlock()
+
+	for _, v := range viewers {
+		fn(v)
+	}
+}
+
+func (r *Room) ViewerCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.viewers)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newLiveTrack returns a forwarding track with a placeholder source attached
+func newLiveTrack(t *testing.T) *forwardingTrack {
+	t.Helper()
+	track, err := newForwardingTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track.SetSource(&webrtc.TrackRemote{})
+	return track
+}
+
+func TestRoomManagerGetOrCreate(t *testing.T) {
+	m := NewRoomManager()
+
+	if m.Get("abc") != nil {
+		t.Fatal("Get returned a room before it was created")
+	}
+
+	room, created := m.GetOrCreate("abc")
+	if room == nil || !created {
+		t.Fatalf("GetOrCreate = %v, %v; want new room", room, created)
+	}
+	if again, created := m.GetOrCreate("abc"); again != room || created {
+		t.Error("GetOrCreate did not return the existing room")
+	}
+	if got := m.Get("abc"); got != room {
+		t.Error("Get did not return the created room")
+	}
+
+	m.Delete("abc")
+	if m.Get("abc") != nil {
+		t.Error("room still present after Delete")
+	}
+}
+
+func TestRoomManagerTryCreateLimit(t *testing.T) {
+	m := NewRoomManager()
+	if _, _, err := m.TryCreate("abc", 1); err != nil {
+		t.Fatalf("TryCreate under limit: %v", err)
+	}
+
+	_, _, err := m.TryCreate("def", 1)
+	var limitErr *RoomLimitError
+	if !errors.As(err, &limitErr) || limitErr.Current != 1 || limitErr.Limit != 1 {
+		t.Fatalf("TryCreate at limit = %v, want RoomLimitError 1/1", err)
+	}
+	if room, created, err := m.TryCreate("abc", 1); room == nil || created || err != nil {
+		t.Errorf("TryCreate existing at limit = %v, %v, %v", room, created, err)
+	}
+}
+
+func TestRoomWithoutBroadcaster(t *testing.T) {
+	room, _ := NewRoomManager().GetOrCreate("abc")
+
+	if room.GetBroadcasterTrack() != nil {
+		t.Error("new room reports a broadcaster track")
+	}
+	if n := room.ViewerCount(); n != 0 {
+		t.Errorf("ViewerCount = %d, want 0", n)
+	}
+}
+
+func TestRoomAddViewerRequiresLiveTrack(t *testing.T) {
+	room := &Room{id: "abc"}
+
+	if err := room.AddViewer(&viewer{}); !errors.Is(err, errNoBroadcaster) {
+		t.Errorf("AddViewer without track = %v, want errNoBroadcaster", err)
+	}
+
+	track := newLiveTrack(t)
+	if err := room.AddViewer(&viewer{track: track}); err != nil {
+		t.Fatalf("AddViewer with live track: %v", err)
+	}
+
+	track.ClearSource(track.Source())
+	if err := room.AddViewer(&viewer{track: track}); !errors.Is(err, errNoBroadcaster) {
+		t.Errorf("AddViewer after broadcaster left = %v, want errNoBroadcaster", err)
+	}
+	if n := room.ViewerCount(); n != 1 {
+		t.Errorf("ViewerCount = %d, want 1", n)
+	}
+}
+
+func TestRoomDetachBroadcasterSource(t *testing.T) {
+	track := newLiveTrack(t)
+	source := track.Source()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": track}}
+
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+
+	// A stale source must not detach the current one
+	room.DetachBroadcasterSource(&webrtc.TrackRemote{})
+	if room.GetBroadcasterTrack() == nil {
+		t.Fatal("stale source detached the live track")
+	}
+
+	room.DetachBroadcasterSource(source)
+	if room.GetBroadcasterTrack() != nil {
+		t.Error("track still live after detach")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventBroadcasterEnded {
+			t.Errorf("event = %q, want %q", event.Type, EventBroadcasterEnded)
+		}
+	default:
+		t.Error("no broadcaster_ended event")
+	}
+}
+
+func TestRoomUnpublish(t *testing.T) {
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{
+		"h": newLiveTrack(t),
+		"l": newLiveTrack(t),
+	}}
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+
+	if !room.Unpublish() {
+		t.Fatal("Unpublish reported no broadcaster")
+	}
+	if room.GetBroadcasterTrack() != nil || len(room.Layers()) != 0 {
+		t.Error("tracks still live after Unpublish")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventBroadcasterEnded {
+			t.Errorf("event = %q, want %q", event.Type, EventBroadcasterEnded)
+		}
+	default:
+		t.Error("no broadcaster_ended event")
+	}
+
+	if room.Unpublish() {
+		t.Error("second Unpublish reported a broadcaster")
+	}
+}
+
+func TestRoomWaitForLayer(t *testing.T) {
+	room := &Room{id: "abc"}
+
+	got := make(chan *forwardingTrack, 1)
+	go func() {
+		track, _ := room.WaitForLayer(context.Background(), "")
+		got <- track
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	attached, _, err := room.AttachBroadcasterSource(nil, &webrtc.TrackRemote{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case track := <-got:
+		if track != attached {
+			t.Errorf("WaitForLayer = %p, want attached track %p", track, attached)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForLayer did not return after the broadcaster started")
+	}
+}
+
+func TestRoomWaitForLayerTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if track, _ := (&Room{id: "abc"}).WaitForLayer(ctx, ""); track != nil {
+		t.Error("WaitForLayer returned a track for an empty room")
+	}
+}
+
+func TestRoomForEachViewerConcurrent(t *testing.T) {
+	room := &Room{id: "abc"}
+	track := newLiveTrack(t)
+	for i := 0; i < 10; i++ {
+		if err := room.AddViewer(&viewer{track: track}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Joins and leaves race with iteration; run with -race
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			v := &viewer{track: track}
+			if err := room.AddViewer(v); err != nil {
+				t.Error(err)
+				return
+			}
+			room.RemoveViewer(v.id)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			room.ForEachViewer(func(v *viewer) {
+				// The callback may re-enter the room
+				_ = room.Viewer(v.id)
+			})
+		}
+	}()
+	wg.Wait()
+
+	seen := 0
+	room.ForEachViewer(func(*viewer) { seen++ })
+	if seen != 10 {
+		t.Errorf("ForEachViewer visited %d viewers, want 10", seen)
+	}
+}
+
+func TestRoomIgnoresReplacedBroadcaster(t *testing.T) {
+	old, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	current, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+
+	room := &Room{id: "abc"}
+	room.SetBroadcaster(old, nil, "")
+	room.SetBroadcaster(current, nil, "")
+	if _, _, err := room.AttachBroadcasterSource(old, &webrtc.TrackRemote{}); !errors.Is(err, errBroadcasterReplaced) {
+		t.Errorf("attach from replaced connection = %v, want errBroadcasterReplaced", err)
+	}
+	if room.GetBroadcasterTrack() != nil {
+		t.Error("track from replaced connection went live")
+	}
+
+	// A failed publish only clears its own connection
+	room.ClearBroadcaster(old)
+	if room.BroadcasterPC() != current {
+		t.Error("ClearBroadcaster removed a newer broadcaster")
+	}
+	if room.unpublish(old) {
+		t.Error("unpublish of a replaced connection ended the broadcast")
+	}
+}
+
+func TestRoomConcurrentPublishSubscribe(t *testing.T) {
+	room := &Room{id: "abc"}
+
+	// Broadcasters come and go while viewers join, switch layers and leave;
+	// run with -race
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			room.SetBroadcaster(nil, nil, "")
+			remote := &webrtc.TrackRemote{}
+			if _, _, err := room.AttachBroadcasterSource(nil, remote); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 {
+				room.DetachBroadcasterSource(remote)
+			} else {
+				room.Unpublish()
+			}
+		}
+	}()
+	for g := 0; g < 2; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				track, _ := room.SelectLayer("")
+				if track == nil {
+					continue
+				}
+				v := &viewer{track: track}
+				if err := room.AddViewer(v); err != nil {
+					if !errors.Is(err, errNoBroadcaster) {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+				room.ForEachViewer(func(v *viewer) { _ = v.Paused() })
+				_ = room.Layers()
+				room.RemoveViewer(v.id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := room.ViewerCount(); n != 0 {
+		t.Errorf("ViewerCount = %d after everyone left, want 0", n)
+	}
+}
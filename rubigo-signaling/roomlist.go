@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Page sizes for GET /internal/rooms
+const (
+	defaultRoomPageSize = 50
+	maxRoomPageSize     = 500
+)
+
+// roomSorts orders rooms for listing, before ?order=desc reverses them
+var roomSorts = map[string]func(a, b *Room) bool{
+	"id":      func(a, b *Room) bool { return a.id < b.id },
+	"viewers": func(a, b *Room) bool { return a.ViewerCount() > b.ViewerCount() },
+	"age":     func(a, b *Room) bool { return a.Created().Before(b.Created()) },
+}
+
+// handleListRooms handles GET /internal/rooms
+// Lists this node's rooms for dashboards, a page at a time:
+//   - hasBroadcaster=true|false keeps rooms with or without a broadcaster
+//   - sort=id (default), viewers (most first) or age (oldest first), and
+//     order=desc to reverse it
+//   - limit=N rooms from offset=M; nextOffset in the response fetches the
+//     next page
+//
+// Each room's summary has the fields of its status response.
+func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+
+	var filter func(*Room) bool
+	switch v := query.Get("hasBroadcaster"); v {
+	case "":
+	case "true", "false":
+		want := v == "true"
+		filter = func(room *Room) bool { return (room.GetBroadcasterTrack() != nil) == want }
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "hasBroadcaster must be true or false")
+		return
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	less, ok := roomSorts[sortBy]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "sort must be id, viewers or age")
+		return
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		asc := less
+		less = func(a, b *Room) bool { return asc(b, a) }
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "order must be asc or desc")
+		return
+	}
+	limit, offset := defaultRoomPageSize, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRoomPageSize {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "limit must be an integer from 1 to "+strconv.Itoa(maxRoomPageSize))
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = n
+	}
+
+	var rooms []*Room
+	for _, room := range s.rooms.Rooms() {
+		if filter == nil || filter(room) {
+			rooms = append(rooms, room)
+		}
+	}
+	// Ties fall back to room ID so pages don't shuffle between requests
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].id < rooms[j].id })
+	sort.SliceStable(rooms, func(i, j int) bool { return less(rooms[i], rooms[j]) })
+
+	total := len(rooms)
+	page := []map[string]interface{}{}
+	for i := offset; i < total && i < offset+limit; i++ {
+		page = append(page, s.roomSummary(rooms[i]))
+	}
+	body := map[string]interface{}{
+		"rooms":  page,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	}
+	if offset+limit < total {
+		body["nextOffset"] = offset + limit
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// roomSummary is room's entry in the room listing
+func (s *Server) roomSummary(room *Room) map[string]interface{} {
+	summary := s.roomStatus(room)
+	delete(summary, "exists")
+	summary["roomId"] = room.id
+	if created := room.Created(); !created.IsZero() {
+		summary["createdAt"] = created.UTC().Format(time.RFC3339)
+		summary["ageSeconds"] = int(time.Since(created).Seconds())
+	}
+	return summary
+}
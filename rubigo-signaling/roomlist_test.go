@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListRooms(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	// a: live with two viewers, b: empty and oldest, c: live with one
+	for i, tt := range []struct {
+		id      string
+		live    bool
+		viewers int
+	}{{"a", true, 2}, {"b", false, 0}, {"c", true, 1}} {
+		room := &Room{id: tt.id, created: now.Add(time.Duration(i-5) * time.Minute)}
+		if tt.id == "b" {
+			room.created = now.Add(-time.Hour)
+		}
+		if tt.live {
+			track := newLiveTrack(t)
+			room.broadcasterTracks = map[string]*forwardingTrack{"": track}
+			for v := 0; v < tt.viewers; v++ {
+				if err := room.AddViewer(&viewer{id: fmt.Sprint("v", v), track: track}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		store.rooms[tt.id] = room
+	}
+	h := newTestServer(t, store)
+
+	list := func(query string) (ids []string, body map[string]interface{}) {
+		t.Helper()
+		rec := doRequest(t, h, http.MethodGet, "/internal/rooms"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", query, rec.Code, rec.Body)
+		}
+		var page struct {
+			Rooms []map[string]interface{} `json:"rooms"`
+		}
+		raw := rec.Body.Bytes()
+		if err := json.Unmarshal(raw, &page); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(raw, &body)
+		for _, room := range page.Rooms {
+			ids = append(ids, room["roomId"].(string))
+		}
+		return ids, body
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"?sort=viewers", []string{"a", "c", "b"}},
+		{"?sort=age", []string{"b", "a", "c"}},
+		{"?sort=age&order=desc", []string{"c", "a", "b"}},
+		{"?hasBroadcaster=true&sort=viewers&order=desc", []string{"c", "a"}},
+		{"?hasBroadcaster=false", []string{"b"}},
+	}
+	for _, tt := range tests {
+		if ids, _ := list(tt.query); fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("GET %s = %v, want %v", tt.query, ids, tt.want)
+		}
+	}
+
+	ids, body := list("?limit=2")
+	if fmt.Sprint(ids) != "[a b]" || body["total"] != float64(3) || body["nextOffset"] != float64(2) {
+		t.Errorf("first page = %v, %v", ids, body)
+	}
+	ids, body = list("?limit=2&offset=2")
+	if fmt.Sprint(ids) != "[c]" || body["nextOffset"] != nil {
+		t.Errorf("last page = %v, %v", ids, body)
+	}
+	if _, body := list("?offset=9"); len(body["rooms"].([]interface{})) != 0 {
+		t.Errorf("past the end = %v, want no rooms", body["rooms"])
+	}
+
+	_, body = list("?limit=1")
+	summary := body["rooms"].([]interface{})[0].(map[string]interface{})
+	if summary["viewerCount"] != float64(2) || summary["hasBroadcaster"] != true || summary["createdAt"] == nil {
+		t.Errorf("summary = %v", summary)
+	}
+	if _, ok := summary["exists"]; ok {
+		t.Error("summary has exists")
+	}
+}
+
+func TestListRoomsErrors(t *testing.T) {
+	h := newTestServer(t, newFakeStore())
+	for _, query := range []string{"?hasBroadcaster=yes", "?sort=name", "?order=up", "?limit=0", "?limit=501", "?offset=-1"} {
+		rec := doRequest(t, h, http.MethodGet, "/internal/rooms"+query, "")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want %d", query, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		decodeError(t, rec, errCodeInvalidRequest)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/rooms", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+)
+
+// The parts of RTMP an ingest server needs: the handshake, the chunk stream
+// messages are carried in, and the AMF0 values commands are encoded with.
+// Only the simple handshake is spoken; encoders accept it from servers that
+// don't answer with a digest, as Adobe's own did before version 3.
+
+const (
+	rtmpVersion       = 3
+	rtmpHandshakeSize = 1536
+	// Every chunk stream starts out at this chunk size
+	rtmpDefaultChunkSize = 128
+	// rtmpChunkSize is the chunk size this end writes with
+	rtmpChunkSize = 4096
+	// How many bytes each end may send before the other acknowledges them
+	rtmpWindowSize = 2500000
+	// rtmpMaxMessageSize bounds the messages a client may send, so one
+	// can't have a huge message buffered. A keyframe of 4K video fits.
+	rtmpMaxMessageSize = 8 << 20
+	// rtmpMaxChunkStreams bounds the chunk streams a client may open; an
+	// encoder uses a handful
+	rtmpMaxChunkStreams = 64
+	// rtmpMaxAMFDepth bounds how deeply AMF objects may nest
+	rtmpMaxAMFDepth = 16
+)
+
+// RTMP message types
+const (
+	rtmpTypeSetChunkSize     = 1
+	rtmpTypeAbort            = 2
+	rtmpTypeAck              = 3
+	rtmpTypeUserControl      = 4
+	rtmpTypeWindowAckSize    = 5
+	rtmpTypeSetPeerBandwidth = 6
+	rtmpTypeAudio            = 8
+	rtmpTypeVideo            = 9
+	rtmpTypeCommandAMF3      = 17
+	rtmpTypeDataAMF0         = 18
+	rtmpTypeCommandAMF0      = 20
+)
+
+// Chunk stream IDs this end writes on
+const (
+	rtmpControlChunkStream = 2
+	rtmpCommandChunkStream = 3
+)
+
+// rtmpMessage is a message reassembled from, or to be split into, chunks
+type rtmpMessage struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32 // milliseconds
+	payload   []byte
+}
+
+// rtmpServerHandshake does the server side of the handshake on rw: S1 is
+// random bytes after a zero time and version, and S2 echoes C1
+func rtmpServerHandshake(rw io.ReadWriter) error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	s0s1s2[0] = rtmpVersion
+	if _, err := rand.Read(s0s1s2[9 : 1+rtmpHandshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := rw.Write(s0s1s2); err != nil {
+		return err
+	}
+	// C2 echoes S1, which nothing depends on
+	_, err := io.ReadFull(rw, make([]byte, rtmpHandshakeSize))
+	return err
+}
+
+// rtmpChunkStream is a chunk stream's state: the last message header, which
+// later chunks may leave out, and the message being reassembled
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool // the timestamp field overflowed into 4 more bytes
+	payload   []byte
+}
+
+// rtmpReader reads messages from a chunk stream. It is not safe for
+// concurrent use.
+type rtmpReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*rtmpChunkStream
+}
+
+func newRTMPReader(r io.Reader) *rtmpReader {
+	return &rtmpReader{r: bufio.NewReader(r), chunkSize: rtmpDefaultChunkSize, streams: make(map[uint32]*rtmpChunkStream)}
+}
+
+// readMessage reads chunks until a message is complete. Set Chunk Size and
+// Abort messages are acted on here as well as returned.
+func (c *rtmpReader) readMessage() (rtmpMessage, error) {
+	for {
+		msg, ok, err := c.readChunk()
+		if err != nil {
+			return rtmpMessage{}, err
+		}
+		if !ok {
+			continue
+		}
+		switch msg.typeID {
+		case rtmpTypeSetChunkSize:
+			if len(msg.payload) < 4 {
+				return rtmpMessage{}, errors.New("short Set Chunk Size message")
+			}
+			size := binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+			if size == 0 || size > 0xffffff {
+				return rtmpMessage{}, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.chunkSize = size
+		case rtmpTypeAbort:
+			if len(msg.payload) >= 4 {
+				if cs := c.streams[binary.BigEndian.Uint32(msg.payload)]; cs != nil {
+					cs.payload = nil
+				}
+			}
+		}
+		return msg, nil
+	}
+}
+
+// readChunk reads one chunk, returning the message it completes if any
+func (c *rtmpReader) readChunk() (rtmpMessage, bool, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return rtmpMessage{}, false, err
+	}
+	format, csid := b>>6, uint32(b&0x3f)
+	switch csid {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return rtmpMessage{}, false, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return rtmpMessage{}, false, err
+		}
+		csid = 64 + uint32(ext[0]) + uint32(ext[1])<<8
+	}
+	cs := c.streams[csid]
+	if cs == nil {
+		if format != 0 {
+			return rtmpMessage{}, false, fmt.Errorf("chunk stream %d starts without a full header", csid)
+		}
+		if len(c.streams) >= rtmpMaxChunkStreams {
+			return rtmpMessage{}, false, fmt.Errorf("more than %d chunk streams", rtmpMaxChunkStreams)
+		}
+		cs = &rtmpChunkStream{}
+		c.streams[csid] = cs
+	}
+
+	var header [11]byte
+	if _, err := io.ReadFull(c.r, header[:[]int{11, 7, 3, 0}[format]]); err != nil {
+		return rtmpMessage{}, false, err
+	}
+	if format < 3 {
+		// A header starts a new message
+		cs.payload = nil
+		ts := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = ts == 0xffffff
+		if format < 2 {
+			cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			cs.typeID = header[6]
+		}
+		if format == 0 {
+			cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+		}
+		if cs.extended {
+			if ts, err = c.readExtendedTimestamp(); err != nil {
+				return rtmpMessage{}, false, err
+			}
+		}
+		// Type 0 has the timestamp itself, the others its delta from
+		// the previous message's. Type 3 chunks starting a message
+		// repeat the delta.
+		cs.delta = ts
+		if format == 0 {
+			cs.timestamp = ts
+		} else {
+			cs.timestamp += ts
+		}
+	} else {
+		if cs.extended {
+			// Repeated on every chunk of a message with one
+			if _, err := c.readExtendedTimestamp(); err != nil {
+				return rtmpMessage{}, false, err
+			}
+		}
+		if cs.payload == nil {
+			cs.timestamp += cs.delta
+		}
+	}
+
+	if cs.length > rtmpMaxMessageSize {
+		return rtmpMessage{}, false, fmt.Errorf("message of %d bytes is too large", cs.length)
+	}
+	n := cs.length - uint32(len(cs.payload))
+	if n > c.chunkSize {
+		n = c.chunkSize
+	}
+	// Grown as chunks arrive rather than for the length a header claims
+	start := len(cs.payload)
+	cs.payload = slices.Grow(cs.payload, int(n))[:start+int(n)]
+	if _, err := io.ReadFull(c.r, cs.payload[start:]); err != nil {
+		return rtmpMessage{}, false, err
+	}
+	if uint32(len(cs.payload)) < cs.length {
+		return rtmpMessage{}, false, nil
+	}
+	msg := rtmpMessage{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+	cs.payload = nil
+	return msg, true, nil
+}
+
+func (c *rtmpReader) readExtendedTimestamp() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(c.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// rtmpWriter writes messages as chunks, each message starting with a full
+// header. It is not safe for concurrent use.
+type rtmpWriter struct {
+	w         *bufio.Writer
+	chunkSize int
+}
+
+func newRTMPWriter(w io.Writer) *rtmpWriter {
+	return &rtmpWriter{w: bufio.NewWriter(w), chunkSize: rtmpDefaultChunkSize}
+}
+
+// writeMessage writes msg on chunk stream csid, which must be from 2 to 63
+func (c *rtmpWriter) writeMessage(csid uint8, msg rtmpMessage) error {
+	ts := msg.timestamp
+	if ts >= 0xffffff {
+		ts = 0xffffff
+	}
+	header := []byte{
+		csid,
+		byte(ts >> 16), byte(ts >> 8), byte(ts),
+		byte(len(msg.payload) >> 16), byte(len(msg.payload) >> 8), byte(len(msg.payload)),
+		msg.typeID,
+	}
+	header = binary.LittleEndian.AppendUint32(header, msg.streamID)
+	extended := binary.BigEndian.AppendUint32(nil, msg.timestamp)
+	payload := msg.payload
+	for first := true; first || len(payload) > 0; first = false {
+		if first {
+			c.w.Write(header)
+		} else {
+			c.w.WriteByte(0xc0 | csid)
+		}
+		if ts == 0xffffff {
+			c.w.Write(extended)
+		}
+		n := len(payload)
+		if n > c.chunkSize {
+			n = c.chunkSize
+		}
+		c.w.Write(payload[:n])
+		payload = payload[n:]
+	}
+	return c.w.Flush()
+}
+
+// writeControl writes a protocol control message with a 4-byte value,
+// followed by extra bytes if any
+func (c *rtmpWriter) writeControl(typeID uint8, value uint32, extra ...byte) error {
+	payload := append(binary.BigEndian.AppendUint32(nil, value), extra...)
+	return c.writeMessage(rtmpControlChunkStream, rtmpMessage{typeID: typeID, payload: payload})
+}
+
+// setChunkSize tells the peer, then starts writing with, chunks of size
+func (c *rtmpWriter) setChunkSize(size int) error {
+	if err := c.writeControl(rtmpTypeSetChunkSize, uint32(size)); err != nil {
+		return err
+	}
+	c.chunkSize = size
+	return nil
+}
+
+// writeCommand writes an AMF0 command on message stream streamID
+func (c *rtmpWriter) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(rtmpCommandChunkStream, rtmpMessage{typeID: rtmpTypeCommandAMF0, streamID: streamID, payload: amfEncode(values...)})
+}
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// amfEncode encodes values as AMF0. Numbers, booleans, strings, nil and
+// string-keyed maps, as objects with sorted keys, are supported.
+func amfEncode(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		b = amfAppend(b, v)
+	}
+	return b
+}
+
+func amfAppend(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case float64:
+		b = append(b, amfNumber)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case int:
+		return amfAppend(b, float64(v))
+	case bool:
+		if v {
+			return append(b, amfBoolean, 1)
+		}
+		return append(b, amfBoolean, 0)
+	case string:
+		if len(v) > math.MaxUint16 {
+			b = append(b, amfLongString)
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			return append(b, v...)
+		}
+		b = append(b, amfString)
+		return amfAppendKey(b, v)
+	case map[string]interface{}:
+		b = append(b, amfObject)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b = amfAppend(amfAppendKey(b, key), v[key])
+		}
+		return append(b, 0, 0, amfObjectEnd)
+	default:
+		return append(b, amfNull)
+	}
+}
+
+// amfAppendKey appends a string without a type marker, as object keys are
+func amfAppendKey(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// amfDecode decodes the AMF0 values in b. Objects and ECMA arrays become
+// map[string]interface{}, strict arrays []interface{}, dates their
+// milliseconds, and null and undefined nil.
+func amfDecode(b []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(b) > 0 {
+		v, rest, err := amfDecodeValue(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = rest
+	}
+	return values, nil
+}
+
+var errAMFShort = errors.New("truncated AMF value")
+
+func amfDecodeValue(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errAMFShort
+	}
+	if depth > rtmpMaxAMFDepth {
+		return nil, nil, errors.New("AMF values nested too deeply")
+	}
+	marker, b := b[0], b[1:]
+	switch marker {
+	case amfNumber, amfDate:
+		n := 8
+		if marker == amfDate {
+			n = 10 // and a time zone, which is unused
+		}
+		if len(b) < n {
+			return nil, nil, errAMFShort
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[n:], nil
+	case amfBoolean:
+		if len(b) < 1 {
+			return nil, nil, errAMFShort
+		}
+		return b[0] != 0, b[1:], nil
+	case amfString:
+		return amfDecodeKey(b)
+	case amfLongString:
+		if len(b) < 4 {
+			return nil, nil, errAMFShort
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return nil, nil, errAMFShort
+		}
+		return string(b[4 : 4+n]), b[4+n:], nil
+	case amfNull, amfUndefined:
+		return nil, b, nil
+	case amfObject, amfECMAArray:
+		if marker == amfECMAArray {
+			// The count is only a hint; the entries end as an object's do
+			if len(b) < 4 {
+				return nil, nil, errAMFShort
+			}
+			b = b[4:]
+		}
+		obj := make(map[string]interface{})
+		for {
+			if len(b) >= 3 && b[0] == 0 && b[1] == 0 && b[2] == amfObjectEnd {
+				return obj, b[3:], nil
+			}
+			key, rest, err := amfDecodeKey(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, rest, err := amfDecodeValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			obj[key.(string)] = v
+			b = rest
+		}
+	case amfStrictArray:
+		if len(b) < 4 {
+			return nil, nil, errAMFShort
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		var arr []interface{}
+		for i := uint32(0); i < n; i++ {
+			v, rest, err := amfDecodeValue(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+			b = rest
+		}
+		return arr, b, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported AMF0 type 0x%02x", marker)
+}
+
+// amfDecodeKey decodes a string without its type marker
+func amfDecodeKey(b []byte) (interface{}, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errAMFShort
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b)-2 < n {
+		return nil, nil, errAMFShort
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
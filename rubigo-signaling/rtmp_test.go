@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	values := []interface{}{
+		"connect",
+		1.0,
+		map[string]interface{}{"app": "live", "nested": map[string]interface{}{"ok": true}},
+		nil,
+		false,
+	}
+	got, err := amfDecode(amfEncode(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("decoded %#v, want %#v", got, values)
+	}
+}
+
+func TestAMFDecodeFormats(t *testing.T) {
+	// An ECMA array of one number, a strict array of one string, and
+	// undefined
+	b := []byte{amfECMAArray, 0, 0, 0, 1, 0, 1, 'n'}
+	b = append(amfAppend(b, 2.0), 0, 0, amfObjectEnd)
+	b = append(b, amfStrictArray, 0, 0, 0, 1)
+	b = append(amfAppend(b, "x"), amfUndefined)
+	got, err := amfDecode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]interface{}{"n": 2.0}, []interface{}{"x"}, nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, want %#v", got, want)
+	}
+
+	for name, b := range map[string][]byte{
+		"truncated number": {amfNumber, 0, 0},
+		"truncated string": {amfString, 0, 5, 'a'},
+		"unknown type":     {0x11},
+		"too deep":         bytes.Repeat([]byte{amfStrictArray, 0, 0, 0, 1}, rtmpMaxAMFDepth+2),
+	} {
+		if _, err := amfDecode(b); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
+
+func TestRTMPChunks(t *testing.T) {
+	var buf bytes.Buffer
+	w := newRTMPWriter(&buf)
+	big := bytes.Repeat([]byte{0xab}, 3*rtmpDefaultChunkSize+5)
+	messages := []rtmpMessage{
+		{typeID: rtmpTypeVideo, streamID: 1, timestamp: 40, payload: big},
+		{typeID: rtmpTypeAudio, streamID: 1, timestamp: 0x1000000, payload: big[:300]},
+		{typeID: rtmpTypeDataAMF0, streamID: 1, timestamp: 80},
+	}
+	if err := w.writeMessage(4, messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Later messages are split at the new chunk size
+	if err := w.setChunkSize(200); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages[1:] {
+		if err := w.writeMessage(4, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newRTMPReader(&buf)
+	var got []rtmpMessage
+	for buf.Len() > 0 || r.r.Buffered() > 0 {
+		msg, err := r.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.typeID != rtmpTypeSetChunkSize {
+			got = append(got, msg)
+		}
+	}
+	if r.chunkSize != 200 {
+		t.Errorf("chunk size = %d, want 200", r.chunkSize)
+	}
+	if len(got) != len(messages) {
+		t.Fatalf("read %d messages, want %d", len(got), len(messages))
+	}
+	for i, msg := range got {
+		want := messages[i]
+		if msg.typeID != want.typeID || msg.streamID != want.streamID || msg.timestamp != want.timestamp || !bytes.Equal(msg.payload, want.payload) {
+			t.Errorf("message %d = type %d stream %d at %d with %d bytes, want type %d stream %d at %d with %d bytes",
+				i, msg.typeID, msg.streamID, msg.timestamp, len(msg.payload), want.typeID, want.streamID, want.timestamp, len(want.payload))
+		}
+	}
+}
+
+func TestRTMPChunkHeaderCompression(t *testing.T) {
+	// A type 0 chunk, then type 1 and type 3 chunks for messages that
+	// reuse its stream ID, type and delta
+	b := []byte{0x04, 0, 0, 10, 0, 0, 1, rtmpTypeAudio, 1, 0, 0, 0, 'a'}
+	b = append(b, 0x44, 0, 0, 20, 0, 0, 2, rtmpTypeAudio, 'b', 'c')
+	b = append(b, 0xc4, 'd', 'e')
+	r := newRTMPReader(bytes.NewReader(b))
+	want := []struct {
+		timestamp uint32
+		payload   string
+	}{{10, "a"}, {30, "bc"}, {50, "de"}}
+	for i, w := range want {
+		msg, err := r.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.timestamp != w.timestamp || string(msg.payload) != w.payload || msg.streamID != 1 {
+			t.Errorf("message %d at %d on stream %d = %q, want %q at %d on stream 1", i, msg.timestamp, msg.streamID, msg.payload, w.payload, w.timestamp)
+		}
+	}
+
+	// A chunk stream can't start without a full header, nor a message
+	// be larger than the limit
+	if _, err := newRTMPReader(bytes.NewReader([]byte{0x45, 0, 0, 0, 0, 0, 1, 8, 'x'})).readMessage(); err == nil {
+		t.Error("chunk stream started with a type 1 header")
+	}
+	huge := []byte{0x04, 0, 0, 0, 0xff, 0xff, 0xff, rtmpTypeVideo, 1, 0, 0, 0}
+	if _, err := newRTMPReader(bytes.NewReader(huge)).readMessage(); err == nil {
+		t.Error("accepted a 16MB message")
+	}
+}
+
+func TestRTMPServerHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- rtmpServerHandshake(server) }()
+
+	c1 := bytes.Repeat([]byte{7}, rtmpHandshakeSize)
+	client.Write(append([]byte{rtmpVersion}, c1...))
+	s := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(client, s); err != nil {
+		t.Fatal(err)
+	}
+	if s[0] != rtmpVersion || !bytes.Equal(s[1+rtmpHandshakeSize:], c1) {
+		t.Error("S0 or S2 wrong")
+	}
+	client.Write(s[1 : 1+rtmpHandshakeSize])
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	go func() { done <- rtmpServerHandshake(server2) }()
+	client2.Write(append([]byte{6}, c1...))
+	if err := <-done; err == nil {
+		t.Error("accepted RTMP version 6")
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// RTMP ingest lets presenters publish from encoders that speak RTMP rather
+// than WebRTC, such as vMix, OBS and ffmpeg. With --rtmp-addr set they
+// publish to rtmp://host/live/{roomId}, adding ?key= with the room password
+// or, with JWT auth, a broadcaster token, as WHIP takes its bearer token:
+//
+//	ffmpeg -re -i talk.mp4 -c:v libx264 -tune zerolatency -bf 0 -g 60 -an \
+//	    -f flv 'rtmp://sfu:1935/live/abc?key=secret'
+//
+// Each publish becomes the room's broadcaster over a loopback WebRTC
+// connection from this process, so viewers, recording and HLS see it as any
+// other broadcaster. H.264 is repacketized into RTP as it arrives. AAC audio
+// is demuxed but dropped: WebRTC viewers can't decode it, and there is no
+// Opus encoder here. Viewers can't ask an encoder for a keyframe, so they
+// start at its next: encoders should send one every second or two, and no
+// B-frames, which browsers' WebRTC decoders don't expect.
+
+const (
+	// rtmpApp is the application encoders connect to
+	rtmpApp = "live"
+	// rtmpStreamID is the message stream createStream hands out
+	rtmpStreamID             = 1
+	rtmpHandshakeTimeout     = 10 * time.Second
+	rtmpIdleTimeout          = 30 * time.Second // longest an encoder may go silent
+	rtmpLoopbackTimeout      = 10 * time.Second // bounds the publish and connecting the loopback
+	rtmpPayloadMTU           = 1200
+	rtmpAcceptRetryDelay     = 100 * time.Millisecond
+	flvCodecAVC              = 7
+	flvFrameKey              = 1
+	flvAVCSequenceHeader     = 0
+	flvAVCNALU               = 1
+	flvSoundFormatAAC        = 10
+	h264NALPPS               = 8
+	h264NALAccessUnitDivider = 9
+)
+
+// rtmpRefusal is a publish refused with an onStatus code
+type rtmpRefusal struct {
+	code    string
+	message string
+}
+
+func (e *rtmpRefusal) Error() string {
+	return e.message
+}
+
+// ServeRTMP accepts RTMP publishes on ln until it is closed
+func (s *Server) ServeRTMP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. out of file descriptors, which passes
+			slog.Warn("RTMP accept failed", "err", err)
+			time.Sleep(rtmpAcceptRetryDelay)
+			continue
+		}
+		go s.serveRTMP(conn)
+	}
+}
+
+// serveRTMP runs one encoder's connection until it closes
+func (s *Server) serveRTMP(conn net.Conn) {
+	in := &countingReader{r: conn}
+	sess := &rtmpSession{
+		s:      s,
+		conn:   conn,
+		in:     in,
+		r:      newRTMPReader(in),
+		w:      newRTMPWriter(conn),
+		logger: slog.With("rtmpClient", conn.RemoteAddr().String()),
+	}
+	err := sess.run()
+	if sess.ingest != nil {
+		sess.ingest.close()
+	}
+	conn.Close()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		sess.logger.Info("RTMP connection ended", "err", err)
+	}
+}
+
+// countingReader counts the bytes read through it, for acknowledgements
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// rtmpSession is an encoder's connection
+type rtmpSession struct {
+	s      *Server
+	conn   net.Conn
+	in     *countingReader
+	r      *rtmpReader
+	w      *rtmpWriter
+	logger *slog.Logger
+
+	connected bool
+	window    uint32 // bytes between acknowledgements; zero until the encoder sets it
+	acked     uint64 // bytes read when last acknowledged
+	ingest    *rtmpIngest
+}
+
+// run handshakes and then handles messages until the connection fails or
+// a message can't be handled
+func (sess *rtmpSession) run() error {
+	sess.conn.SetDeadline(time.Now().Add(rtmpHandshakeTimeout))
+	if err := rtmpServerHandshake(sess.conn); err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	for {
+		sess.conn.SetDeadline(time.Now().Add(rtmpIdleTimeout))
+		msg, err := sess.r.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := sess.handle(msg); err != nil {
+			return err
+		}
+		if sess.window > 0 && sess.in.n-sess.acked >= uint64(sess.window) {
+			sess.acked = sess.in.n
+			if err := sess.w.writeControl(rtmpTypeAck, uint32(sess.acked)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (sess *rtmpSession) handle(msg rtmpMessage) error {
+	switch msg.typeID {
+	case rtmpTypeWindowAckSize:
+		if len(msg.payload) >= 4 {
+			sess.window = binary.BigEndian.Uint32(msg.payload)
+		}
+	case rtmpTypeCommandAMF3:
+		// Opens with a byte switching to AMF0, which encoders then use
+		if len(msg.payload) > 0 {
+			msg.payload = msg.payload[1:]
+		}
+		fallthrough
+	case rtmpTypeCommandAMF0:
+		return sess.command(msg)
+	case rtmpTypeVideo:
+		if sess.ingest != nil {
+			return sess.ingest.writeVideo(msg)
+		}
+	case rtmpTypeAudio:
+		if sess.ingest != nil {
+			sess.ingest.writeAudio(msg)
+		}
+	}
+	// Metadata, user control messages and bandwidth hints aren't needed
+	return nil
+}
+
+// command handles a command, answering those encoders wait on
+func (sess *rtmpSession) command(msg rtmpMessage) error {
+	values, err := amfDecode(msg.payload)
+	if err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+	arg := func(i int) interface{} {
+		if i < len(values) {
+			return values[i]
+		}
+		return nil
+	}
+	name, _ := arg(0).(string)
+	txID, _ := arg(1).(float64)
+
+	switch name {
+	case "connect":
+		props, _ := arg(2).(map[string]interface{})
+		app, _ := props["app"].(string)
+		return sess.connect(txID, app)
+	case "releaseStream", "FCPublish", "FCUnpublish":
+		return sess.w.writeCommand(0, "_result", txID, nil)
+	case "createStream":
+		return sess.w.writeCommand(0, "_result", txID, nil, rtmpStreamID)
+	case "publish":
+		stream, _ := arg(3).(string)
+		return sess.publish(msg.streamID, stream)
+	case "deleteStream", "closeStream":
+		if sess.ingest != nil {
+			sess.ingest.close()
+			sess.ingest = nil
+		}
+	case "play":
+		sess.status(msg.streamID, "error", "NetStream.Play.Failed", "This server only accepts publishes")
+		return errors.New("playback is not supported")
+	}
+	return nil
+}
+
+// connect accepts a connection to rtmpApp
+func (sess *rtmpSession) connect(txID float64, app string) error {
+	// Some encoders pass the stream's query on the app too
+	app = strings.TrimSuffix(strings.SplitN(app, "?", 2)[0], "/")
+	if app != rtmpApp {
+		sess.w.writeCommand(0, "_error", txID, nil, map[string]interface{}{
+			"level":       "error",
+			"code":        "NetConnection.Connect.Rejected",
+			"description": fmt.Sprintf("Unknown application %q; publish to /%s/{roomId}", app, rtmpApp),
+		})
+		return fmt.Errorf("unknown application %q", app)
+	}
+	if err := sess.w.writeControl(rtmpTypeWindowAckSize, rtmpWindowSize); err != nil {
+		return err
+	}
+	// Limit type 2, dynamic
+	if err := sess.w.writeControl(rtmpTypeSetPeerBandwidth, rtmpWindowSize, 2); err != nil {
+		return err
+	}
+	if err := sess.w.setChunkSize(rtmpChunkSize); err != nil {
+		return err
+	}
+	sess.connected = true
+	return sess.w.writeCommand(0, "_result", txID,
+		map[string]interface{}{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+		map[string]interface{}{
+			"level":          "status",
+			"code":           "NetConnection.Connect.Success",
+			"description":    "Connection succeeded",
+			"objectEncoding": 0,
+		})
+}
+
+// publish starts relaying the stream named {roomId}?key=... into the room
+func (sess *rtmpSession) publish(streamID uint32, stream string) error {
+	if !sess.connected {
+		return errors.New("publish before connect")
+	}
+	if sess.ingest != nil {
+		sess.status(streamID, "error", "NetStream.Publish.BadName", "Already publishing")
+		return errors.New("second publish on one connection")
+	}
+	roomID, query, _ := strings.Cut(stream, "?")
+	values, _ := url.ParseQuery(query)
+	key := values.Get("key")
+	if err := sess.s.authorizeRTMP(roomID, key); err != nil {
+		var refusal *rtmpRefusal
+		if errors.As(err, &refusal) {
+			sess.status(streamID, "error", refusal.code, refusal.message)
+		}
+		return fmt.Errorf("publish to %q refused: %w", roomID, err)
+	}
+
+	peerID := newPeerID()
+	sess.ingest = &rtmpIngest{
+		s:        sess.s,
+		roomID:   roomID,
+		key:      key,
+		peerID:   peerID,
+		logger:   peerLog(roomID, "broadcaster", peerID),
+		streamID: streamID,
+		session:  sess,
+	}
+	sess.ingest.logger.Info("RTMP publish started", "rtmpClient", sess.conn.RemoteAddr().String())
+	return sess.status(streamID, "status", "NetStream.Publish.Start", roomID+" is now published")
+}
+
+// status sends an onStatus event on the message stream streamID
+func (sess *rtmpSession) status(streamID uint32, level, code, description string) error {
+	return sess.w.writeCommand(streamID, "onStatus", 0, nil, map[string]interface{}{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+// authorizeRTMP checks a publish to roomID with the stream key, which stands
+// in for a broadcaster token with JWT auth and for the password otherwise.
+// The publish repeats the password check once the stream starts.
+func (s *Server) authorizeRTMP(roomID, key string) error {
+	if roomID == "" || !s.validRoomID(roomID) {
+		return &rtmpRefusal{"NetStream.Publish.BadName", "Invalid room ID"}
+	}
+	if s.draining.Load() {
+		return &rtmpRefusal{"NetStream.Publish.Denied", "Server is draining"}
+	}
+	if s.auth != nil {
+		claims, err := s.auth.verify(key, time.Now())
+		if err != nil {
+			return &rtmpRefusal{"NetStream.Publish.Denied", fmt.Sprintf("Invalid token: %v", err)}
+		}
+		if claims.RoomID != roomID || claims.Role != roleBroadcaster {
+			return &rtmpRefusal{"NetStream.Publish.Denied", fmt.Sprintf("Token grants %s in room %q", claims.Role, claims.RoomID)}
+		}
+	} else if room := s.rooms.Get(roomID); room != nil && !room.CheckPassword(key) {
+		return &rtmpRefusal{"NetStream.Publish.Denied", "Invalid room password"}
+	}
+	if s.cluster != nil {
+		// Encoders can't follow a redirect to the owner
+		ctx, cancel := context.WithTimeout(context.Background(), rtmpLoopbackTimeout)
+		defer cancel()
+		owner, err := s.cluster.owner(ctx, roomID, true)
+		if err != nil {
+			roomLog(roomID).Error("Room registry unavailable", "err", err)
+			return &rtmpRefusal{"NetStream.Publish.Denied", "Room registry unavailable"}
+		}
+		if owner != "" && owner != s.cluster.cfg.NodeID {
+			return &rtmpRefusal{"NetStream.Publish.Denied", fmt.Sprintf("Room is hosted on node %s", owner)}
+		}
+	}
+	return nil
+}
+
+// rtmpIngest relays an RTMP publish into its room. The loopback is set up
+// by the first AVC sequence header, whose SPS gives the H.264 profile to
+// negotiate.
+type rtmpIngest struct {
+	s        *Server
+	session  *rtmpSession
+	streamID uint32
+	roomID   string
+	key      string
+	peerID   string
+	logger   *slog.Logger
+
+	client    *webrtc.PeerConnection // this process's end of the loopback
+	pc        *webrtc.PeerConnection // the room's end, its broadcaster
+	track     *webrtc.TrackLocalStaticRTP
+	closeOnce sync.Once
+
+	sps, pps    [][]byte
+	nalLength   int
+	payloader   codecs.H264Payloader
+	seq         uint16
+	started     bool // a keyframe has been sent
+	warnedAudio bool
+	writeErrors logThrottle
+}
+
+// writeVideo relays an FLV video tag's payload
+func (in *rtmpIngest) writeVideo(msg rtmpMessage) error {
+	p := msg.payload
+	if len(p) < 5 {
+		return nil
+	}
+	// Enhanced RTMP sets the top bit for codecs other than H.264
+	if p[0]&0x80 != 0 || p[0]&0x0f != flvCodecAVC {
+		in.session.status(in.streamID, "error", "NetStream.Publish.Denied", "Only H.264 video is supported")
+		return errors.New("video is not H.264")
+	}
+	keyframe := p[0]>>4 == flvFrameKey
+	// Composition time offset, a signed 24-bit value
+	cts := int32(uint32(p[2])<<24|uint32(p[3])<<16|uint32(p[4])<<8) >> 8
+	switch p[1] {
+	case flvAVCSequenceHeader:
+		return in.configure(p[5:])
+	case flvAVCNALU:
+		in.writeFrame(p[5:], keyframe, int64(msg.timestamp)+int64(cts))
+	}
+	return nil
+}
+
+// writeAudio notes audio the first time it arrives; it isn't relayed
+func (in *rtmpIngest) writeAudio(msg rtmpMessage) {
+	if in.warnedAudio || len(msg.payload) == 0 {
+		return
+	}
+	in.warnedAudio = true
+	format := msg.payload[0] >> 4
+	in.logger.Warn("Dropping RTMP audio, which WebRTC viewers can't decode", "aac", format == flvSoundFormatAAC, "soundFormat", format)
+}
+
+// configure takes the parameter sets from an AVCDecoderConfigurationRecord,
+// publishing on the first one
+func (in *rtmpIngest) configure(record []byte) error {
+	sps, pps, nalLength, err := parseAVCConfig(record)
+	if err != nil {
+		return fmt.Errorf("invalid AVC sequence header: %w", err)
+	}
+	in.sps, in.pps, in.nalLength = sps, pps, nalLength
+	if in.client != nil {
+		// Sent ahead of each keyframe, so a change of resolution
+		// reaches viewers with the next one
+		return nil
+	}
+	profile, err := h264ProfileLevelID(sps[0])
+	if err != nil {
+		in.session.status(in.streamID, "error", "NetStream.Publish.Denied", err.Error())
+		return err
+	}
+	if err := in.start(profile); err != nil {
+		in.session.status(in.streamID, "error", "NetStream.Failed", err.Error())
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+// start publishes the loopback's H.264 track, with profile-level-id
+// profile, to the room and waits for it to connect
+func (in *rtmpIngest) start(profile string) error {
+	codec := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+	}
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: 102}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	client, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	in.client = client
+	if in.track, err = webrtc.NewTrackLocalStaticRTP(codec, "video", "rtmp"); err != nil {
+		return err
+	}
+	transceiver, err := client.AddTransceiverFromTrack(in.track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		return err
+	}
+	go func() {
+		// Keyframe requests can't be passed on to the encoder
+		for {
+			if _, _, err := transceiver.Sender().ReadRTCP(); err != nil {
+				return
+			}
+		}
+	}()
+	connected := make(chan struct{})
+	var once sync.Once
+	client.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			once.Do(func() { close(connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			// e.g. the room was deleted or another broadcaster took
+			// over; the encoder's connection ends with the loopback
+			in.session.conn.Close()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), rtmpLoopbackTimeout)
+	defer cancel()
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return errors.New("ICE gathering timed out")
+	}
+
+	exchange := SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP}
+	if in.s.auth == nil {
+		exchange.Password = in.key
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/rtmp/"+rtmpApp+"/"+url.PathEscape(in.roomID), nil)
+	if err != nil {
+		return err
+	}
+	resp := &rtmpPublishResponse{header: http.Header{}}
+	pc, answer := in.s.publish(resp, req, in.roomID, in.peerID, exchange)
+	if pc == nil {
+		return resp.err()
+	}
+	in.pc = pc
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		return err
+	}
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return errors.New("loopback connection timed out")
+	}
+	in.writeErrors = logThrottle{logger: in.logger, interval: forwardErrorLogInterval}
+	in.logger.Info("RTMP stream relayed into room", "profileLevelId", profile)
+	return nil
+}
+
+// writeFrame packetizes a frame of length-prefixed NAL units presented at
+// pts milliseconds. Frames before the first keyframe are dropped, as
+// viewers couldn't decode them.
+func (in *rtmpIngest) writeFrame(data []byte, keyframe bool, pts int64) {
+	if in.track == nil || (!in.started && !keyframe) {
+		return
+	}
+	nals, err := splitAVCC(data, in.nalLength)
+	if err != nil {
+		in.writeErrors.Warn("Dropping malformed RTMP video frame", "err", err)
+		return
+	}
+	var annexB []byte
+	inBand := false
+	for _, nal := range nals {
+		switch nal[0] & 0x1f {
+		case h264NALAccessUnitDivider:
+			continue
+		case h264NALSPS, h264NALPPS:
+			inBand = true
+		}
+		annexB = append(append(annexB, 0, 0, 0, 1), nal...)
+	}
+	if keyframe && !inBand {
+		var params []byte
+		for _, ps := range append(append([][]byte(nil), in.sps...), in.pps...) {
+			params = append(append(params, 0, 0, 0, 1), ps...)
+		}
+		annexB = append(params, annexB...)
+	}
+	in.started = true
+
+	ts := uint32(pts) * 90
+	payloads := in.payloader.Payload(rtmpPayloadMTU, annexB)
+	for i, payload := range payloads {
+		in.seq++
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: in.seq,
+				Timestamp:      ts,
+			},
+			Payload: payload,
+		}
+		if err := in.track.WriteRTP(packet); isForwardError(err) {
+			in.writeErrors.Warn("Relaying RTMP video failed", "err", err)
+		}
+	}
+}
+
+// close ends the publish, as an unpublish would, and the loopback
+func (in *rtmpIngest) close() {
+	in.closeOnce.Do(func() {
+		if in.pc != nil {
+			if room := in.s.rooms.Get(in.roomID); room != nil {
+				room.unpublish(in.pc)
+			}
+		}
+		if in.client != nil {
+			in.client.Close()
+		}
+		in.logger.Info("RTMP publish ended")
+	})
+}
+
+// rtmpPublishResponse stands in for the HTTP response a publish writes,
+// keeping the error if it fails
+type rtmpPublishResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *rtmpPublishResponse) Header() http.Header         { return r.header }
+func (r *rtmpPublishResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *rtmpPublishResponse) WriteHeader(status int)      { r.status = status }
+
+// err returns the error the publish wrote
+func (r *rtmpPublishResponse) err() error {
+	var failure struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(r.body.Bytes(), &failure); err != nil || failure.Error.Code == "" {
+		return fmt.Errorf("publish failed with status %d", r.status)
+	}
+	return fmt.Errorf("%s (%s)", failure.Error.Message, failure.Error.Code)
+}
+
+// h264ProfileLevelID returns the profile-level-id, of those the server
+// registers, to negotiate for a stream with sps. The level is always 3.1,
+// as levels needn't match.
+func h264ProfileLevelID(sps []byte) (string, error) {
+	if len(sps) < 4 {
+		return "", errors.New("SPS too short")
+	}
+	switch profile := sps[1]; profile {
+	case 66:
+		return "42e01f", nil // constrained baseline
+	case 77:
+		return "4d001f", nil
+	case 100:
+		return "64001f", nil
+	default:
+		return "", fmt.Errorf("unsupported H.264 profile %d; use baseline, main or high", profile)
+	}
+}
+
+// parseAVCConfig returns the parameter sets and NAL unit length size from
+// an AVCDecoderConfigurationRecord (ISO/IEC 14496-15)
+func parseAVCConfig(b []byte) (sps, pps [][]byte, nalLength int, err error) {
+	if len(b) < 6 {
+		return nil, nil, 0, errors.New("record too short")
+	}
+	nalLength = int(b[4]&3) + 1
+	n, rest := int(b[5]&0x1f), b[6:]
+	for i := 0; i < n; i++ {
+		var ps []byte
+		if ps, rest, err = splitParameterSet(rest); err != nil {
+			return nil, nil, 0, err
+		}
+		sps = append(sps, ps)
+	}
+	if len(rest) < 1 {
+		return nil, nil, 0, errors.New("record too short")
+	}
+	n, rest = int(rest[0]), rest[1:]
+	for i := 0; i < n; i++ {
+		var ps []byte
+		if ps, rest, err = splitParameterSet(rest); err != nil {
+			return nil, nil, 0, err
+		}
+		pps = append(pps, ps)
+	}
+	if len(sps) == 0 {
+		return nil, nil, 0, errors.New("no SPS")
+	}
+	return sps, pps, nalLength, nil
+}
+
+// splitParameterSet splits a parameter set, after its 16-bit length, from b
+func splitParameterSet(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("parameter set truncated")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if n == 0 || len(b)-2 < n {
+		return nil, nil, errors.New("parameter set truncated")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// splitAVCC splits a frame into its NAL units, each after a big-endian
+// length of size bytes
+func splitAVCC(b []byte, size int) ([][]byte, error) {
+	var nals [][]byte
+	for len(b) > 0 {
+		if len(b) < size {
+			return nil, errors.New("NAL unit length truncated")
+		}
+		var n int
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+		if n == 0 || n > len(b) {
+			return nil, fmt.Errorf("NAL unit of %d bytes overruns the frame", n)
+		}
+		nals = append(nals, b[:n])
+		b = b[n:]
+	}
+	return nals, nil
+}
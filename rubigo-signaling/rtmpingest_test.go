@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Parameter sets of a constrained baseline stream
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// avcSequenceHeader is the FLV video tag carrying testSPS and testPPS
+func avcSequenceHeader() []byte {
+	tag := []byte{0x17, flvAVCSequenceHeader, 0, 0, 0, 1, 0x42, 0xc0, 0x1f, 0xff, 0xe1}
+	tag = append(binary.BigEndian.AppendUint16(tag, uint16(len(testSPS))), testSPS...)
+	tag = append(tag, 1)
+	return append(binary.BigEndian.AppendUint16(tag, uint16(len(testPPS))), testPPS...)
+}
+
+// avcFrame is the FLV video tag of one NAL unit, a keyframe's or not
+func avcFrame(nal []byte, keyframe bool) []byte {
+	tag := []byte{0x27, flvAVCNALU, 0, 0, 0}
+	if keyframe {
+		tag[0] = 0x17
+	}
+	return append(binary.BigEndian.AppendUint32(tag, uint32(len(nal))), nal...)
+}
+
+func TestParseAVCConfig(t *testing.T) {
+	sps, pps, nalLength, err := parseAVCConfig(avcSequenceHeader()[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sps, [][]byte{testSPS}) || !reflect.DeepEqual(pps, [][]byte{testPPS}) || nalLength != 4 {
+		t.Errorf("parsed SPS %x, PPS %x, NAL length %d", sps, pps, nalLength)
+	}
+	if _, _, _, err := parseAVCConfig(avcSequenceHeader()[5:12]); err == nil {
+		t.Error("parsed a truncated record")
+	}
+
+	if profile, err := h264ProfileLevelID(testSPS); err != nil || profile != "42e01f" {
+		t.Errorf("profile-level-id = %q, %v; want 42e01f", profile, err)
+	}
+	if _, err := h264ProfileLevelID([]byte{0x67, 244, 0, 0x1f}); err == nil {
+		t.Error("High 4:4:4 accepted")
+	}
+}
+
+func TestSplitAVCC(t *testing.T) {
+	nals, err := splitAVCC([]byte{0, 2, 0x65, 1, 0, 1, 0x41}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nals, [][]byte{{0x65, 1}, {0x41}}) {
+		t.Errorf("split into %x", nals)
+	}
+	if _, err := splitAVCC([]byte{0, 5, 0x65}, 2); err == nil {
+		t.Error("split a NAL unit overrunning the frame")
+	}
+}
+
+// rtmpTestClient is an encoder publishing to a test server
+type rtmpTestClient struct {
+	conn net.Conn
+	r    *rtmpReader
+	w    *rtmpWriter
+}
+
+// dialRTMP starts an RTMP server for s and connects to it
+func dialRTMP(t *testing.T, s *Server) *rtmpTestClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.ServeRTMP(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = rtmpVersion
+	if _, err := conn.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	if _, err := io.ReadFull(conn, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(s0s1s2[1 : 1+rtmpHandshakeSize]); err != nil {
+		t.Fatal(err)
+	}
+	return &rtmpTestClient{conn: conn, r: newRTMPReader(conn), w: newRTMPWriter(conn)}
+}
+
+// expect reads up to the next command, failing unless it is name
+func (c *rtmpTestClient) expect(t *testing.T, name string) []interface{} {
+	t.Helper()
+	for {
+		msg, err := c.r.readMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", name, err)
+		}
+		if msg.typeID != rtmpTypeCommandAMF0 {
+			continue
+		}
+		values, err := amfDecode(msg.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) == 0 || values[0] != name {
+			t.Fatalf("got command %v, want %s", values, name)
+		}
+		return values
+	}
+}
+
+// statusCode returns the code of an onStatus or _error command's info
+func statusCode(values []interface{}) string {
+	info, _ := values[len(values)-1].(map[string]interface{})
+	code, _ := info["code"].(string)
+	return code
+}
+
+// publish connects to app and publishes stream, returning the onStatus the
+// server answers with
+func (c *rtmpTestClient) publish(t *testing.T, app, stream string) []interface{} {
+	t.Helper()
+	c.w.writeCommand(0, "connect", 1, map[string]interface{}{"app": app, "tcUrl": "rtmp://localhost/" + app})
+	if app != rtmpApp {
+		return c.expect(t, "_error")
+	}
+	c.expect(t, "_result")
+	c.w.writeCommand(0, "releaseStream", 2, nil, stream)
+	c.w.writeCommand(0, "FCPublish", 3, nil, stream)
+	c.w.writeCommand(0, "createStream", 4, nil)
+	c.expect(t, "_result") // releaseStream
+	c.expect(t, "_result") // FCPublish
+	if created := c.expect(t, "_result"); !reflect.DeepEqual(created[1:], []interface{}{4.0, nil, float64(rtmpStreamID)}) {
+		t.Fatalf("createStream result %v", created)
+	}
+	c.w.writeCommand(rtmpStreamID, "publish", 5, nil, stream, "live")
+	return c.expect(t, "onStatus")
+}
+
+// sendVideo sends an FLV video tag at timestamp ms
+func (c *rtmpTestClient) sendVideo(t *testing.T, ms uint32, tag []byte) {
+	t.Helper()
+	if err := c.w.writeMessage(6, rtmpMessage{typeID: rtmpTypeVideo, streamID: rtmpStreamID, timestamp: ms, payload: tag}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRTMPIngest(t *testing.T) {
+	store := newFakeStore()
+	s := newServer(t, store, DefaultConfig())
+	c := dialRTMP(t, s)
+	if status := c.publish(t, rtmpApp, "abc?key=ignored"); statusCode(status) != "NetStream.Publish.Start" {
+		t.Fatalf("publish status %v", status)
+	}
+
+	c.sendVideo(t, 0, avcSequenceHeader())
+	// AAC, which is dropped
+	c.w.writeMessage(5, rtmpMessage{typeID: rtmpTypeAudio, streamID: rtmpStreamID, payload: []byte{0xaf, 0x00, 0x12, 0x10}})
+	deadline := time.Now().Add(10 * time.Second)
+	for ms := uint32(0); ; ms += 33 {
+		// A keyframe a second, as encoders should send
+		if ms%990 == 0 {
+			c.sendVideo(t, ms, avcFrame([]byte{0x65, 0x88, 0x84, 0x00, 0x33}, true))
+		} else {
+			c.sendVideo(t, ms, avcFrame([]byte{0x41, 0x9a, 0x02}, false))
+		}
+		room := store.Get("abc")
+		if room != nil && room.GetBroadcasterTrack() != nil && !room.LastBroadcasterPacket().IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("RTMP stream never reached the room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	room := store.Get("abc")
+	if mime := room.GetBroadcasterTrack().Codec().MimeType; mime != "video/H264" {
+		t.Errorf("broadcaster track is %s, want H.264", mime)
+	}
+
+	// Ending the stream ends the broadcast
+	c.w.writeCommand(rtmpStreamID, "deleteStream", 6, nil, float64(rtmpStreamID))
+	deadline = time.Now().Add(5 * time.Second)
+	for room.GetBroadcasterTrack() != nil || room.BroadcasterPC() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcast still live after deleteStream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRTMPIngestRefused(t *testing.T) {
+	store := newFakeStore("locked")
+	hash, err := hashRoomPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Get("locked").SetPasswordHash(hash)
+	s := newServer(t, store, DefaultConfig())
+
+	if status := dialRTMP(t, s).publish(t, "other", "abc"); statusCode(status) != "NetConnection.Connect.Rejected" {
+		t.Errorf("unknown app: %v", status)
+	}
+	if status := dialRTMP(t, s).publish(t, rtmpApp, "locked?key=wrong"); statusCode(status) != "NetStream.Publish.Denied" {
+		t.Errorf("wrong key: %v", status)
+	}
+	if status := dialRTMP(t, s).publish(t, rtmpApp, "locked?key=secret"); statusCode(status) != "NetStream.Publish.Start" {
+		t.Errorf("right key: %v", status)
+	}
+	if status := dialRTMP(t, s).publish(t, rtmpApp, ""); statusCode(status) != "NetStream.Publish.BadName" {
+		t.Errorf("no room: %v", status)
+	}
+}
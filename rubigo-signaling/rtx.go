@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Viewers' NACKs are answered from a history of what each published video
+// track forwarded, kept once per track rather than once per viewer stream
+// as pion's NACK responder would. A lost packet is resent to the viewer
+// that asked, on its RTX stream if it negotiated one and in-band
+// otherwise, so a lossy viewer link is repaired without the broadcaster's
+// uplink carrying it. Simulcast viewers are answered from the history of
+// the layer they are relaying.
+
+// packetHistory holds the last packets written on a track by sequence
+// number, marshaled into buffers each slot reuses, so keeping them costs
+// no allocation per packet. It is safe for concurrent use.
+type packetHistory struct {
+	mu      sync.Mutex
+	packets [][]byte // by sequence number modulo len
+}
+
+// newPacketHistory keeps size packets; size must divide 65536, so slots
+// stay in step when sequence numbers wrap
+func newPacketHistory(size int) *packetHistory {
+	return &packetHistory{packets: make([][]byte, size)}
+}
+
+// add keeps a copy of packet
+func (h *packetHistory) add(packet *rtp.Packet) {
+	size := packet.MarshalSize()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slot := &h.packets[int(packet.SequenceNumber)%len(h.packets)]
+	if cap(*slot) < size {
+		*slot = make([]byte, size)
+	}
+	n, err := packet.MarshalTo((*slot)[:size])
+	if err != nil {
+		*slot = (*slot)[:0]
+		return
+	}
+	*slot = (*slot)[:n]
+}
+
+// get returns a copy of the packet written with seq, or nil once it has
+// been overwritten
+func (h *packetHistory) get(seq uint16) *rtp.Packet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	kept := h.packets[int(seq)%len(h.packets)]
+	if len(kept) < 4 || binary.BigEndian.Uint16(kept[2:4]) != seq {
+		return nil
+	}
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append([]byte(nil), kept...)); err != nil {
+		return nil
+	}
+	return packet
+}
+
+// retransmitter resends packets to one viewer's sender
+type retransmitter struct {
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	// rtxSSRC is zero if the viewer negotiated no RTX stream
+	rtxSSRC        webrtc.SSRC
+	rtxPayloadType webrtc.PayloadType
+	stream         webrtc.TrackLocalWriter
+
+	mu     sync.Mutex // serializes RTX sequence numbers
+	rtxSeq uint16
+}
+
+// newRetransmitter resends on t's streams; codec is what the binding
+// negotiated
+func newRetransmitter(t webrtc.TrackLocalContext, codec webrtc.RTPCodecParameters) *retransmitter {
+	re := &retransmitter{ssrc: t.SSRC(), payloadType: codec.PayloadType, stream: t.WriteStream()}
+	if ssrc := t.SSRCRetransmission(); ssrc != 0 {
+		if pt, ok := rtxPayloadType(codec.PayloadType, t.CodecParameters()); ok {
+			re.rtxSSRC, re.rtxPayloadType = ssrc, pt
+		}
+	}
+	return re
+}
+
+// rtxPayloadType finds the RTX payload type associated with pt
+func rtxPayloadType(pt webrtc.PayloadType, codecs []webrtc.RTPCodecParameters) (webrtc.PayloadType, bool) {
+	apt := "apt=" + strconv.Itoa(int(pt))
+	for _, codec := range codecs {
+		if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+			continue
+		}
+		for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+			if strings.TrimSpace(param) == apt {
+				return codec.PayloadType, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// resend writes packet, as forwarded on the viewer's track, to the viewer
+// again. On RTX the original sequence number leads the payload (RFC 4588).
+func (re *retransmitter) resend(packet *rtp.Packet) error {
+	// Padding isn't kept in the payload
+	packet.Padding, packet.PaddingSize = false, 0
+	if re.rtxSSRC == 0 {
+		packet.SSRC, packet.PayloadType = uint32(re.ssrc), uint8(re.payloadType)
+		_, err := re.stream.WriteRTP(&packet.Header, packet.Payload)
+		return err
+	}
+	payload := make([]byte, 2+len(packet.Payload))
+	binary.BigEndian.PutUint16(payload, packet.SequenceNumber)
+	copy(payload[2:], packet.Payload)
+	packet.SSRC, packet.PayloadType = uint32(re.rtxSSRC), uint8(re.rtxPayloadType)
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	packet.SequenceNumber = re.rtxSeq
+	re.rtxSeq++
+	_, err := re.stream.WriteRTP(&packet.Header, payload)
+	return err
+}
+
+// retransmitters are a track's viewer senders, by their media SSRC
+type retransmitters struct {
+	mu sync.Mutex
+	by map[webrtc.SSRC]*retransmitter
+}
+
+func (rs *retransmitters) bind(t webrtc.TrackLocalContext, codec webrtc.RTPCodecParameters) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.by == nil {
+		rs.by = make(map[webrtc.SSRC]*retransmitter)
+	}
+	rs.by[t.SSRC()] = newRetransmitter(t, codec)
+}
+
+func (rs *retransmitters) unbind(t webrtc.TrackLocalContext) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.by, t.SSRC())
+}
+
+func (rs *retransmitters) get(ssrc webrtc.SSRC) *retransmitter {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.by[ssrc]
+}
+
+// SetRetransmitHistory has the video tracks of rooms created from now on
+// keep their last size packets, answering viewers' NACKs from them; size
+// must divide 65536. It is meant to be called once, before serving.
+func (m *RoomManager) SetRetransmitHistory(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history = size
+}
+
+// keepHistory has the track remember its last size packets for
+// retransmission
+func (f *forwardingTrack) keepHistory(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.history == nil {
+		f.history = newPacketHistory(size)
+	}
+}
+
+// Retransmit resends the packets a viewer reported lost to its sender,
+// the one bound with ssrc. It returns those it doesn't have, all of them
+// if the track keeps no history or the sender isn't bound.
+func (f *forwardingTrack) Retransmit(ssrc webrtc.SSRC, lost []uint16) ([]uint16, error) {
+	f.mu.Lock()
+	history := f.history
+	f.mu.Unlock()
+	re := f.senders.get(ssrc)
+	if history == nil || re == nil {
+		return lost, nil
+	}
+	var missed []uint16
+	var err error
+	for _, seq := range lost {
+		packet := history.get(seq)
+		if packet == nil {
+			missed = append(missed, seq)
+			continue
+		}
+		if err = re.resend(packet); err != nil {
+			break
+		}
+	}
+	return missed, err
+}
+
+// Retransmit is forwardingTrack.Retransmit for a simulcast viewer: the
+// packets come from the history of the layer being relayed, moved onto the
+// viewer's sequence. Those it doesn't have are returned as the layer's
+// sequence numbers, or left out if they can't be traced back to it.
+func (s *simulcastTrack) Retransmit(ssrc webrtc.SSRC, lost []uint16) (*forwardingTrack, []uint16, error) {
+	s.mu.Lock()
+	layer, rewriter := s.current, s.rewriter
+	s.mu.Unlock()
+	var traced []uint16
+	for _, seq := range lost {
+		if input, ok := rewriter.input(seq); ok {
+			traced = append(traced, input)
+		}
+	}
+
+	layer.mu.Lock()
+	history := layer.history
+	layer.mu.Unlock()
+	re := s.senders.get(ssrc)
+	if history == nil || re == nil {
+		return layer, traced, nil
+	}
+	var missed []uint16
+	var err error
+	for _, seq := range traced {
+		packet := history.get(seq)
+		if packet == nil {
+			missed = append(missed, seq)
+			continue
+		}
+		packet.SequenceNumber += rewriter.seqOffset
+		packet.Timestamp += rewriter.tsOffset
+		if err = re.resend(packet); err != nil {
+			break
+		}
+	}
+	return layer, missed, err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtxBinding is a fakeBinding that negotiated RTX, recording payloads too
+type rtxBinding struct {
+	fakeBinding
+	payloads [][]byte
+}
+
+func (b *rtxBinding) CodecParameters() []webrtc.RTPCodecParameters {
+	return append(b.fakeBinding.CodecParameters(), webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=96"},
+		PayloadType:        97,
+	})
+}
+func (b *rtxBinding) SSRCRetransmission() webrtc.SSRC      { return 2 }
+func (b *rtxBinding) WriteStream() webrtc.TrackLocalWriter { return b }
+
+func (b *rtxBinding) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	b.payloads = append(b.payloads, slices.Clone(payload))
+	return b.fakeBinding.WriteRTP(header, payload)
+}
+
+func TestPacketHistory(t *testing.T) {
+	h := newPacketHistory(4)
+	for seq := uint16(65533); seq != 3; seq++ {
+		h.add(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}, Payload: []byte{byte(seq)}})
+	}
+	for _, seq := range []uint16{65535, 0, 1, 2} {
+		if packet := h.get(seq); packet == nil || packet.Payload[0] != byte(seq) {
+			t.Errorf("get(%d) = %v", seq, packet)
+		}
+	}
+	// Overwritten, and not yet written
+	for _, seq := range []uint16{65533, 65534, 3} {
+		if packet := h.get(seq); packet != nil {
+			t.Errorf("get(%d) = %v, want nil", seq, packet)
+		}
+	}
+	// Copies come out, so resending can't change what is kept
+	h.get(0).Payload[0] = 0xff
+	if got := h.get(0).Payload[0]; got != 0 {
+		t.Errorf("kept payload changed to %#x", got)
+	}
+	// And copies go in, since the forwarder reuses its packet and buffer
+	reused := &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: []byte{1}}
+	h.add(reused)
+	reused.Payload[0] = 0xff
+	if got := h.get(1).Payload[0]; got != 1 {
+		t.Errorf("kept payload changed to %#x by its writer", got)
+	}
+}
+
+func TestRTXPayloadType(t *testing.T) {
+	codecs := []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, SDPFmtpLine: "apt=102"}, PayloadType: 103},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+	}
+	if pt, ok := rtxPayloadType(96, codecs); !ok || pt != 97 {
+		t.Errorf("rtxPayloadType(96) = %d, %v; want 97", pt, ok)
+	}
+	if _, ok := rtxPayloadType(98, codecs); ok {
+		t.Error("found RTX for a codec without one")
+	}
+}
+
+// forwardSequence forwards packets with seqs on track, returning the
+// sequence numbers the viewer got them as
+func forwardSequence(t *testing.T, track *forwardingTrack, viewer *fakeBinding, seqs ...uint16) []uint16 {
+	t.Helper()
+	sent := len(viewer.packets)
+	for _, seq := range seqs {
+		packet := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: 1000}, Payload: []byte{0x10, byte(seq)}}
+		if err := track.Forward(track.Source(), packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out []uint16
+	for _, header := range viewer.packets[sent:] {
+		out = append(out, header.SequenceNumber)
+	}
+	return out
+}
+
+func TestForwardingTrackRetransmit(t *testing.T) {
+	track := newLiveTrack(t)
+	viewer := &fakeBinding{id: "v", keep: true}
+	bindViewer(t, track, viewer)
+	sent := forwardSequence(t, track, viewer, 10, 11, 12)
+
+	// Without history every lost packet is missed
+	if missed, err := track.Retransmit(1, sent[:1]); err != nil || !slices.Equal(missed, sent[:1]) {
+		t.Errorf("without history = %v, %v; want all missed", missed, err)
+	}
+
+	track.keepHistory(16)
+	sent = forwardSequence(t, track, viewer, 13, 14, 15)
+	missed, err := track.Retransmit(1, []uint16{sent[0], sent[2], sent[2] + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(missed, []uint16{sent[2] + 1}) {
+		t.Errorf("missed = %v, want [%d]", missed, sent[2]+1)
+	}
+	resent := viewer.packets[len(viewer.packets)-2:]
+	if resent[0].SequenceNumber != sent[0] || resent[1].SequenceNumber != sent[2] {
+		t.Errorf("resent %d, %d; want %d, %d", resent[0].SequenceNumber, resent[1].SequenceNumber, sent[0], sent[2])
+	}
+
+	// Only bound senders are answered
+	if missed, _ := track.Retransmit(5, sent[:1]); !slices.Equal(missed, sent[:1]) {
+		t.Errorf("unknown sender: missed = %v", missed)
+	}
+	if err := track.Unbind(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if missed, _ := track.Retransmit(1, sent[:1]); !slices.Equal(missed, sent[:1]) {
+		t.Errorf("unbound sender: missed = %v", missed)
+	}
+}
+
+func TestForwardingTrackRetransmitRTX(t *testing.T) {
+	track := newLiveTrack(t)
+	track.keepHistory(16)
+	viewer := &rtxBinding{fakeBinding: fakeBinding{id: "v", keep: true}}
+	if _, err := track.Bind(viewer); err != nil {
+		t.Fatal(err)
+	}
+	sent := forwardSequence(t, track, &viewer.fakeBinding, 20, 21)
+
+	for i := 0; i < 2; i++ {
+		if _, err := track.Retransmit(1, sent[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, header := range viewer.packets[2:] {
+		if header.SSRC != 2 || header.PayloadType != 97 || header.SequenceNumber != uint16(i) {
+			t.Errorf("resend %d: SSRC %d, PT %d, seq %d; want the RTX stream's, seq %d", i, header.SSRC, header.PayloadType, header.SequenceNumber, i)
+		}
+		payload := viewer.payloads[2+i]
+		if osn := binary.BigEndian.Uint16(payload); osn != sent[1] || !slices.Equal(payload[2:], []byte{0x10, 21}) {
+			t.Errorf("resend %d: payload %v, want OSN %d and the original", i, payload, sent[1])
+		}
+	}
+}
+
+func TestSimulcastTrackRetransmit(t *testing.T) {
+	layer := newLiveTrack(t)
+	layer.keepHistory(16)
+	s, err := newSimulcastTrack(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := &fakeBinding{id: "v", keep: true}
+	if _, err := s.Bind(viewer); err != nil {
+		t.Fatal(err)
+	}
+	// The viewer's own sequence starts where the layer's does, so move it
+	s.mu.Lock()
+	s.rewriter.seqOffset = 1000
+	s.mu.Unlock()
+	sent := forwardSequence(t, layer, viewer, 30, 31)
+
+	got, missed, err := s.Retransmit(1, []uint16{sent[0], sent[1] + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != layer || missed != nil {
+		t.Errorf("Retransmit = %v, %v; want the layer and nothing missed", got, missed)
+	}
+	if resent := viewer.packets[len(viewer.packets)-1]; resent.SequenceNumber != sent[0] {
+		t.Errorf("resent seq %d, want %d", resent.SequenceNumber, sent[0])
+	}
+
+	// What the layer has lost too is returned in its sequence
+	layer.mu.Lock()
+	layer.history = newPacketHistory(16)
+	layer.mu.Unlock()
+	_, missed, _ = s.Retransmit(1, sent)
+	if want := []uint16{sent[0] - 1000, sent[1] - 1000}; !slices.Equal(missed, want) {
+		t.Errorf("missed = %v, want %v", missed, want)
+	}
+}
@@ -0,0 +1,1275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config holds server settings, populated from flags in main
+type Config struct {
+	RecordDir string
+	HLS       HLSConfig
+	CORS      CORSConfig
+	Peer      PeerConfig
+	// WebhookURL receives room lifecycle and connection state events;
+	// empty disables it
+	WebhookURL string
+	// WebhookSecret, if set, signs webhook requests with HMAC-SHA256
+	WebhookSecret string
+	// MaxRooms caps the number of rooms; zero means unlimited
+	MaxRooms int
+	// MaxViewersPerRoom caps each room's viewers, and rooms can be created
+	// with a lower cap; zero means unlimited
+	MaxViewersPerRoom int
+	// MaxPeerConnections caps broadcasters, co-presenters and viewers
+	// across all rooms; zero means unlimited
+	MaxPeerConnections int
+	// BroadcasterTimeout ends a broadcast that has sent no RTP for this
+	// long even though its connection looks up; zero disables it
+	BroadcasterTimeout time.Duration
+	// SubscribeWaitTimeout bounds how long a ?wait=true subscribe is held
+	// for the broadcaster; zero disables waiting
+	SubscribeWaitTimeout time.Duration
+	// ReconnectGrace is how long a dropped viewer's reconnect token stays
+	// valid; zero disables reconnect tokens
+	ReconnectGrace time.Duration
+	// BroadcasterGrace is how long viewers wait for a broadcaster whose
+	// tracks ended, e.g. on a tab refresh, and its reconnect token stays
+	// valid
+	BroadcasterGrace time.Duration
+	// BitrateLogInterval, if set, logs each broadcaster track's inbound
+	// bitrate this often
+	BitrateLogInterval time.Duration
+	// RTPBufferSize is the read buffer for each broadcaster track; it must
+	// hold the largest RTP packet the broadcaster sends
+	RTPBufferSize int
+	// NegotiationTimeout bounds applying an offer and creating the answer,
+	// before ICE gathering; zero means no limit
+	NegotiationTimeout time.Duration
+	// MaxBodyBytes caps create, publish and subscribe request bodies
+	MaxBodyBytes int64
+	// Room creation rate limit per caller; zero rate disables it
+	CreateRate  float64
+	CreateBurst int
+	// Publish and subscribe rate limit per caller, counting every request
+	// that sets up a peer connection; zero rate disables it
+	SDPRate  float64
+	SDPBurst int
+	// Readiness soft limits; zero disables the check
+	ReadyMaxRooms       int
+	ReadyMaxConnections int
+	// RoomIDPattern is what room IDs must match; nil accepts any
+	RoomIDPattern *regexp.Regexp
+	// DebugToken is the bearer token for /internal/debug endpoints, which
+	// are not served without one
+	DebugToken string
+	// DebugEventBuffer is how many recent events /internal/debug/events
+	// keeps; zero disables the buffer
+	DebugEventBuffer int
+	// RoomByteQuota ends a room's session once it has relayed this many
+	// bytes, ingress and egress together; zero means unlimited
+	RoomByteQuota int64
+	// QualityLossAlert is the fraction of packets a track's median viewer
+	// may lose before the room's events report its quality degraded;
+	// zero disables quality events
+	QualityLossAlert float64
+	// CodecPolicy orders and restricts the codecs broadcasters may send;
+	// rooms can override each of its lists
+	CodecPolicy CodecPolicy
+	// Publish and subscribe require a JWT signed with JWTSecret (HS256) or
+	// a key from JWKSURL (RS256, ES256); with neither set they are open
+	JWTSecret string
+	JWKSURL   string
+	// RecordSegment starts a new recording file at the first keyframe
+	// after this much video; zero writes one file per recording
+	RecordSegment time.Duration
+	// RecordFormat is the container recordings are written in
+	RecordFormat RecordFormat
+	// Upload is where finished recording files go; uploads are off unless
+	// its bucket is set
+	Upload UploadConfig
+	// RoomIdleTimeout deletes a room that has had no broadcaster, viewers
+	// or recording for this long, unless its creator set its own; zero
+	// keeps such rooms
+	RoomIdleTimeout time.Duration
+	// Cluster shares rooms between nodes through Redis; off unless its
+	// Redis URL is set
+	Cluster ClusterConfig
+	// APIKeys guard the /internal routes, which are open without any
+	APIKeys APIKeyConfig
+	// TracerProvider receives the server's spans; nil uses the global
+	// provider, which drops them unless one has been installed
+	TracerProvider trace.TracerProvider
+}
+
+// defaultRoomIDPattern keeps room IDs to one URL path segment of sane length
+const defaultRoomIDPattern = `^[A-Za-z0-9_-]{1,64}$`
+
+// DefaultConfig returns the settings used when no flags are given
+func DefaultConfig() Config {
+	return Config{
+		RecordDir:     "recordings",
+		HLS:           HLSConfig{FFmpeg: "ffmpeg"},
+		RecordSegment: 10 * time.Minute,
+		RecordFormat:  RecordWebM,
+		RoomIDPattern: regexp.MustCompile(defaultRoomIDPattern),
+		CreateBurst:   5,
+		SDPBurst:      10,
+		RTPBufferSize: 1500,
+		MaxBodyBytes:  256 << 10,
+		// Live broadcasters send keyframes at least every few seconds in
+		// response to our interval PLIs, so silence this long means gone
+		BroadcasterTimeout:   30 * time.Second,
+		SubscribeWaitTimeout: 60 * time.Second,
+		ReconnectGrace:       30 * time.Second,
+		BroadcasterGrace:     broadcasterGracePeriod,
+		DebugEventBuffer:     1000,
+		NegotiationTimeout:   10 * time.Second,
+		Cluster:              ClusterConfig{LeaseTTL: defaultClusterLeaseTTL},
+		APIKeys:              APIKeyConfig{Burst: 20},
+		RoomIdleTimeout:      10 * time.Minute,
+		QualityLossAlert:     0.05,
+		Peer: PeerConfig{
+			ICETimeout:        5 * time.Second,
+			TURNCredentialTTL: 24 * time.Hour,
+		},
+		Upload: UploadConfig{
+			Region:    "us-east-1",
+			Retention: 24 * time.Hour,
+		},
+	}
+}
+
+// Server holds the SFU's HTTP handlers and the state they share
+type Server struct {
+	rooms RoomStore
+	cfg   Config
+
+	peers         *peerFactory
+	routes        map[string]roomRoute
+	viewerRoutes  map[string]viewerRoute
+	webhook       *webhookNotifier
+	cors          *corsPolicy
+	metrics       *serverMetrics
+	started       time.Time
+	shuttingDown  atomic.Bool
+	draining      atomic.Bool
+	createLimiter *rateLimiter
+	sdpLimiter    *rateLimiter
+	events        *eventRing // recent events for debugging; nil if off
+	// auth checks publish and subscribe tokens; nil if they are open
+	auth *tokenVerifier
+	// apiKeys are the keys /internal routes accept; nil if they are open
+	apiKeys *apiKeyRing
+	// WHIP broadcasters and WHEP viewers, by session ID
+	whip sdpSessions
+	whep sdpSessions
+	// cascades relay rooms from upstream nodes, by local room ID
+	cascades cascadeLinks
+	// uploader sends finished recordings to storage; nil if off
+	uploader *recordingUploader
+	// stopLoops ends the idle room reaper and the quality summaries
+	stopLoops chan struct{}
+	tracer    trace.Tracer
+	// cluster is this node's membership of a cluster; nil for a single node
+	cluster *clusterNode
+	// rtpBuffers are broadcaster tracks' read buffers, shared across rooms
+	rtpBuffers bufferPool
+}
+
+// NewServer creates a server backed by the given room store
+func NewServer(rooms RoomStore, cfg Config) (*Server, error) {
+	peers, err := newPeerFactory(cfg.Peer)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		rooms:   rooms,
+		cfg:     cfg,
+		peers:   peers,
+		metrics: newServerMetrics(),
+		started: time.Now(),
+		tracer:  tracerFor(cfg),
+	}
+	if cfg.JWTSecret != "" || cfg.JWKSURL != "" {
+		s.auth = newTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	}
+	if s.apiKeys, err = newAPIKeyRing(cfg.APIKeys); err != nil {
+		peers.Close()
+		return nil, err
+	}
+	s.routes = s.roomRoutes()
+	s.viewerRoutes = s.viewerActionRoutes()
+	s.cors = newCORSPolicy(cfg.CORS)
+	if cfg.WebhookURL != "" {
+		s.webhook = newWebhookNotifier(cfg.WebhookURL, cfg.WebhookSecret)
+	}
+	if cfg.Cluster.RedisURL != "" {
+		if s.cluster, err = newClusterNode(cfg.Cluster); err != nil {
+			peers.Close()
+			return nil, fmt.Errorf("invalid cluster config: %w", err)
+		}
+	}
+	if cfg.Upload.Bucket != "" {
+		if s.uploader, err = newRecordingUploader(cfg.Upload, s.webhook); err != nil {
+			peers.Close()
+			if s.cluster != nil {
+				s.cluster.registry.Close()
+			}
+			return nil, fmt.Errorf("invalid upload config: %w", err)
+		}
+	}
+	if cfg.CreateRate > 0 {
+		s.createLimiter = newRateLimiter(cfg.CreateRate, cfg.CreateBurst)
+	}
+	if cfg.SDPRate > 0 {
+		s.sdpLimiter = newRateLimiter(cfg.SDPRate, cfg.SDPBurst)
+	}
+	if cfg.DebugToken != "" {
+		s.events = newEventRing(cfg.DebugEventBuffer)
+	}
+	// Stores that can report room events feed the buffer and the webhook
+	if observable, ok := rooms.(interface{ SetEventObserver(func(RoomEvent)) }); ok && (s.events != nil || s.webhook != nil) {
+		observable.SetEventObserver(s.observeRoomEvent)
+	}
+	if keeper, ok := rooms.(interface{ SetRetransmitHistory(int) }); ok && !cfg.Peer.DisableNACK {
+		keeper.SetRetransmitHistory(nackHistorySize)
+	}
+	// Runs even without a default timeout, for rooms created with their own
+	s.stopLoops = make(chan struct{})
+	go s.reapIdleRooms(roomReapInterval, s.stopLoops)
+	go s.summarizeQuality(qualityInterval, s.stopLoops)
+	if s.cluster != nil {
+		go s.cluster.heartbeat(s)
+	}
+	return s, nil
+}
+
+// Close stops the idle room reaper and quality summaries, leaves the
+// cluster, finishes queued uploads, flushes pending webhooks and releases
+// resources shared by all peer connections
+func (s *Server) Close() error {
+	close(s.stopLoops)
+	if s.cluster != nil {
+		s.cluster.close()
+	}
+	s.uploader.Close()
+	s.webhook.Close()
+	return s.peers.Close()
+}
+
+// Handler returns the server's routes
+func (s *Server) Handler() http.Handler {
+	// Use a custom mux with manual routing for compatibility
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	// The older names of the probes
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	// API keys are checked inside CORS, which answers preflights itself
+	mux.HandleFunc("/internal/drain", s.cors.wrap(s.requireAPIKey(s.handleDrain(true))))
+	mux.HandleFunc("/internal/undrain", s.cors.wrap(s.requireAPIKey(s.handleDrain(false))))
+	mux.HandleFunc("/internal/ice-servers", s.cors.wrap(s.requireAPIKey(s.handleICEServers)))
+	mux.HandleFunc("/internal/rooms", s.cors.wrap(s.requireAPIKey(s.handleListRooms)))
+	mux.HandleFunc("/internal/room", s.cors.wrap(s.requireAPIKey(s.recordErrors(s.handleRoomRouter))))
+	mux.HandleFunc("/internal/room/", s.cors.wrap(s.requireAPIKey(s.recordErrors(s.handleRoomRouter))))
+	mux.HandleFunc("/whip/", s.cors.wrap(s.recordErrors(s.handleWHIP)))
+	mux.HandleFunc("/whep/", s.cors.wrap(s.recordErrors(s.handleWHEP)))
+	if s.cfg.HLS.Dir != "" {
+		mux.HandleFunc("/hls/", s.cors.wrap(s.handleHLS))
+	}
+	mux.HandleFunc("/internal/cascade", s.cors.wrap(s.requireAPIKey(s.recordErrors(s.handleCascade))))
+	mux.HandleFunc("/internal/cascade/", s.cors.wrap(s.requireAPIKey(s.recordErrors(s.handleCascade))))
+	// With API keys these take one in X-API-Key beside the debug token
+	if s.cfg.DebugToken != "" {
+		mux.HandleFunc("/internal/debug/stats", s.requireAPIKey(requireBearer(s.cfg.DebugToken, s.handleDebugStats)))
+	}
+	if s.events != nil {
+		mux.HandleFunc("/internal/debug/events", s.requireAPIKey(requireBearer(s.cfg.DebugToken, s.handleDebugEvents)))
+	}
+
+	return mux
+}
+
+// SDPExchange is the request/response format for SDP exchange
+type SDPExchange struct {
+	SDP  string `json:"sdp"`
+	Type string `json:"type"`
+	// Layer is the simulcast layer (low, mid, high or auto) a viewer asks
+	// for, and the RID it was given in the answer
+	Layer string `json:"layer,omitempty"`
+	// Password is required in offers for password-protected rooms
+	Password string `json:"password,omitempty"`
+	// ViewerID identifies the viewer in a subscribe answer, for the
+	// per-viewer endpoints. A viewer may choose its own in the offer.
+	ViewerID string `json:"viewerId,omitempty"`
+	// PeerID identifies a co-presenter in present offers and answers, and
+	// in renegotiate offers on its connection
+	PeerID string `json:"peerId,omitempty"`
+	// ReconnectToken, from a subscribe answer, lets the viewer resubscribe
+	// into the same slot after a network drop. From a publish answer, it
+	// lets the broadcaster republish without the password, e.g. after a
+	// tab refresh, and viewers keep their connections.
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+	// TrackLabels names a broadcaster's tracks by mid in publish and
+	// renegotiate offers, e.g. {"0": "screen", "1": "camera"}
+	TrackLabels map[string]string `json:"trackLabels,omitempty"`
+	// Tracks labels the media sections of a subscribe answer
+	Tracks []TrackInfo `json:"tracks,omitempty"`
+}
+
+// decodeJSON decodes the request body into v, reading at most
+// MaxBodyBytes. On failure it writes the error response and returns false:
+// 413 with the limit in the error details if it was hit, 400 otherwise.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if s.cfg.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeErrorDetails(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large",
+			map[string]interface{}{"maxBytes": tooLarge.Limit})
+		return false
+	}
+	writeError(w, http.StatusBadRequest, errCodeInvalidJSON, "Invalid JSON")
+	return false
+}
+
+// handleCreateRoom handles POST /internal/room
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, errCodeDraining, "Server is draining")
+		return
+	}
+
+	var req struct {
+		RoomID     string             `json:"roomId"`
+		Password   string             `json:"password"`
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
+		// IdleTimeoutSeconds overrides RoomIdleTimeout for this room
+		IdleTimeoutSeconds int `json:"idleTimeoutSeconds"`
+		// CodecPolicy overrides the server's codec policy lists it sets
+		CodecPolicy CodecPolicy `json:"codecPolicy"`
+		// MaxViewers caps the room's viewers below MaxViewersPerRoom
+		MaxViewers int `json:"maxViewers"`
+		// MaxBitrateKbps caps the broadcaster's video
+		MaxBitrateKbps int `json:"maxBitrateKbps"`
+		// BroadcasterPolicy is "takeover", the default, or "reject"
+		BroadcasterPolicy string `json:"broadcasterPolicy"`
+	}
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.RoomID == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "roomId required")
+		return
+	}
+	if !s.validRoomID(req.RoomID) {
+		writeInvalidRoomID(w, s.cfg.RoomIDPattern)
+		return
+	}
+
+	if err := validateICEServers(req.ICEServers); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidICEServers, err.Error())
+		return
+	}
+	if req.IdleTimeoutSeconds < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "idleTimeoutSeconds must not be negative")
+		return
+	}
+	if req.MaxViewers < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "maxViewers must not be negative")
+		return
+	}
+	if req.MaxBitrateKbps < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "maxBitrateKbps must not be negative")
+		return
+	}
+	if err := req.CodecPolicy.normalize(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid codecPolicy: %v", err))
+		return
+	}
+	broadcasterPolicy, err := parseBroadcasterPolicy(req.BroadcasterPolicy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Hash before creating so a bad password doesn't leave an open room
+	var passwordHash []byte
+	if req.Password != "" {
+		var err error
+		if passwordHash, err = hashRoomPassword(req.Password); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid password: %v", err))
+			return
+		}
+	}
+
+	if !s.routeToOwner(w, r, req.RoomID, true) {
+		return
+	}
+	room, created, err := s.rooms.TryCreate(req.RoomID, s.cfg.MaxRooms)
+	if err != nil {
+		writeRoomLimitError(w, err)
+		return
+	}
+	// Only the creator sets the password, ICE servers, idle timeout, codec
+	// policy, viewer cap, bitrate cap and broadcaster policy; they can't be
+	// changed by re-creating
+	if created && passwordHash != nil {
+		room.SetPasswordHash(passwordHash)
+	}
+	if created && len(req.ICEServers) > 0 {
+		room.SetICEServers(req.ICEServers)
+	}
+	if created && req.IdleTimeoutSeconds > 0 {
+		room.SetIdleTimeout(time.Duration(req.IdleTimeoutSeconds) * time.Second)
+	}
+	if created && !req.CodecPolicy.empty() {
+		room.SetCodecPolicy(req.CodecPolicy)
+	}
+	if created && req.MaxViewers > 0 {
+		room.SetMaxViewers(req.MaxViewers)
+	}
+	if created && req.MaxBitrateKbps > 0 {
+		room.SetMaxBitrate(float64(req.MaxBitrateKbps) * 1000)
+	}
+	if created {
+		room.SetBroadcasterPolicy(broadcasterPolicy)
+	}
+
+	status := "existed"
+	if created {
+		status = "created"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":             status,
+		"roomId":             req.RoomID,
+		"hasBroadcaster":     room.GetBroadcasterTrack() != nil,
+		"viewerCount":        room.ViewerCount(),
+		"passwordProtected":  room.PasswordProtected(),
+		"idleTimeoutSeconds": int(room.IdleTimeout(s.cfg.RoomIdleTimeout).Seconds()),
+		"broadcasterPolicy":  room.BroadcasterPolicy(),
+	})
+}
+
+// writeRoomLimitError responds 503 to a TryCreate failure, reporting how
+// many rooms exist against the limit
+func writeRoomLimitError(w http.ResponseWriter, err error) {
+	var limitErr *RoomLimitError
+	if !errors.As(err, &limitErr) {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	writeErrorDetails(w, http.StatusServiceUnavailable, errCodeRoomLimit, "Room limit reached",
+		map[string]interface{}{"rooms": limitErr.Current, "maxRooms": limitErr.Limit})
+}
+
+// handlePublishWithID handles POST /internal/room/{id}/publish
+// Broadcaster sends SDP offer, receives answer. PATCH restarts ICE.
+func (s *Server) handlePublishWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method == http.MethodPatch {
+		s.handlePublishRestart(w, r, roomID)
+		return
+	}
+	if s.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, errCodeDraining, "Server is draining")
+		return
+	}
+
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+
+	if pc, answer := s.publish(w, r, roomID, newPeerID(), offer); pc != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
+	}
+}
+
+// publish makes the connection answering offer the broadcaster of roomID,
+// known in logs as peerID, returning it with its answer set once ICE
+// gathering is done, and the answer to send. On failure it writes the
+// error response and returns nil.
+func (s *Server) publish(w http.ResponseWriter, r *http.Request, roomID, peerID string, offer SDPExchange) (*webrtc.PeerConnection, SDPExchange) {
+	room, _, err := s.rooms.TryCreate(roomID, s.cfg.MaxRooms)
+	if err != nil {
+		writeRoomLimitError(w, err)
+		return nil, SDPExchange{}
+	}
+	// A reconnect token stands in for the password
+	reconnect := offer.ReconnectToken != ""
+	if reconnect {
+		if !room.CheckBroadcasterToken(offer.ReconnectToken) {
+			writeError(w, http.StatusGone, errCodeReconnectInvalid, "Reconnect token is invalid or expired")
+			return nil, SDPExchange{}
+		}
+	} else if !room.CheckPassword(offer.Password) {
+		writeError(w, http.StatusForbidden, errCodeInvalidPassword, "Invalid room password")
+		return nil, SDPExchange{}
+	}
+	// Checked again when taking over the room, should another publish win
+	// the race to it
+	if !room.AcceptsBroadcaster(reconnect) {
+		writeBroadcasterActive(w)
+		return nil, SDPExchange{}
+	}
+	if s.overQuota(room) {
+		writeErrorDetails(w, http.StatusForbidden, errCodeQuotaExceeded, "Room byte quota exceeded", map[string]interface{}{
+			"byteQuota": s.cfg.RoomByteQuota,
+		})
+		return nil, SDPExchange{}
+	}
+	codecs := s.receiveCodecs(room)
+	if !checkOfferCodecs(w, offer.SDP, codecs) {
+		return nil, SDPExchange{}
+	}
+	// A republish replaces the broadcaster's connection rather than adding one
+	if room.BroadcasterPC() == nil && !s.admitPeer(w) {
+		return nil, SDPExchange{}
+	}
+
+	// Create peer connection for broadcaster
+	logger := peerLog(roomID, "broadcaster", peerID)
+	tagPeer(r.Context(), "broadcaster", peerID)
+	publishSpan := trace.SpanContextFromContext(r.Context())
+	pc, control, _, err := s.peers.connectPeer(roomID, "broadcaster", peerID, room.ICEServers())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create peer connection: %v", err))
+		return nil, SDPExchange{}
+	}
+	// Until the answer is sent, any failure leaves pc unused
+	published := false
+	defer func() {
+		if !published {
+			pc.Close()
+		}
+	}()
+
+	// Add transceiver to receive video. Simulcast offers arrive as one
+	// track per RID on this transceiver; further video sections of the
+	// offer get transceivers of their own and carry extra tracks.
+	mainVideo, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add transceiver: %v", err))
+		return nil, SDPExchange{}
+	}
+	// And one for tab or system audio shared with the screen. Offers
+	// without audio simply leave it unused.
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add audio transceiver: %v", err))
+		return nil, SDPExchange{}
+	}
+
+	// Take over the room before any track can arrive, so a track is only
+	// ever attached from the connection the room points at. Tracks still
+	// arriving on a previous publish are ignored from here on, and if this
+	// one fails the previous connection stays the broadcaster.
+	previous, err := room.TakeBroadcaster(pc, control, peerID, reconnect)
+	if err != nil {
+		writeBroadcasterActive(w)
+		return nil, SDPExchange{}
+	}
+	defer func() {
+		if !published {
+			room.RestoreBroadcaster(pc, previous)
+		}
+	}()
+	replaced := newTakeover(roomID, pc, previous)
+
+	// Handle incoming track from broadcaster
+	pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if rid := remoteTrack.RID(); rid != "" {
+			logger.Info("Received simulcast track from broadcaster", "codec", remoteTrack.Codec().MimeType, "rid", rid)
+		} else {
+			logger.Info("Received track from broadcaster", "codec", remoteTrack.Codec().MimeType)
+		}
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			if t := transceiverFor(pc, receiver); t != nil && t != mainVideo {
+				s.attachExtraTrack(room, pc, t.Mid(), remoteTrack, publishSpan)
+				return
+			}
+			room.labelTrack(mainVideo.Mid(), true)
+		}
+
+		// Attach to the room's stable forwarding track so viewers from a
+		// previous publish keep receiving media after a reconnect
+		localTrack, reused, err := room.AttachBroadcasterSource(pc, remoteTrack)
+		if errors.Is(err, errBroadcasterReplaced) {
+			logger.Info("Ignoring track from replaced broadcaster connection")
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create local track", "err", err)
+			return
+		}
+		if reused {
+			logger.Info("Broadcaster reconnected, resuming existing track")
+		}
+		// Viewers now get this connection's media, so the one it replaced
+		// can go
+		replaced.done()
+
+		// Forward RTP packets from broadcaster to local track
+		go s.forwardBroadcasterTrack(room, remoteTrack, localTrack, publishSpan)
+
+		// Audio enabled after video reaches viewers already watching
+		if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+			go offerTracksToViewers(room)
+		}
+	})
+
+	// Apply the broadcaster's offer and gather ICE candidates
+	room.SetTrackLabels(offer.TrackLabels)
+	gatherComplete, err := s.answerOffer(r.Context(), pc, offer.SDP, codecs)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return nil, SDPExchange{}
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return nil, SDPExchange{}
+	}
+
+	published = true
+	room.AddControlChannel(control)
+	room.AcceptDataChannels(pc)
+	// Start the host's viewer badge from the current count
+	control.OnOpen(room.sendViewerCount)
+	if s.cfg.BroadcasterTimeout > 0 {
+		go s.watchBroadcaster(room, pc)
+	}
+	if !s.cfg.Peer.DisableBWE || room.MaxBitrate() > 0 {
+		go s.reportViewerBandwidth(room, pc)
+	}
+	connecting := s.startConnectSpan(r.Context())
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		connecting.observe(state)
+		replaced.observe(state)
+		s.notifyConnectionState(roomID, "broadcaster", state)
+	})
+	return pc, SDPExchange{
+		Type:           "answer",
+		SDP:            pc.LocalDescription().SDP,
+		ReconnectToken: room.IssueBroadcasterToken(s.cfg.BroadcasterGrace),
+	}
+}
+
+// handleSubscribeWithID handles POST /internal/room/{id}/subscribe
+// Viewer sends SDP offer, receives answer with broadcaster's track. PATCH
+// restarts ICE.
+func (s *Server) handleSubscribeWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method == http.MethodPatch {
+		s.handleSubscribeRestart(w, r, roomID)
+		return
+	}
+	start := time.Now()
+
+	var offer SDPExchange
+	if !s.decodeJSON(w, r, &offer) {
+		return
+	}
+	if v, answer := s.subscribe(w, r, roomID, offer, nil, start); v != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer)
+	}
+}
+
+// subscribe negotiates a viewer connection for offer, returning the viewer
+// and its answer. resume, if set, is the reconnect slot being resumed: the
+// password was checked when its token was issued, and the viewer it
+// replaces is closed once the new one is ready. On failure the error
+// response has been written and the viewer is nil.
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request, roomID string, offer SDPExchange, resume *reconnectSlot, start time.Time) (*viewer, SDPExchange) {
+	if !validLayer(offer.Layer) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidLayer, "layer must be low, mid, high or auto")
+		return nil, SDPExchange{}
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return nil, SDPExchange{}
+	}
+
+	if resume == nil && !room.CheckPassword(offer.Password) {
+		writeError(w, http.StatusForbidden, errCodeInvalidPassword, "Invalid room password")
+		return nil, SDPExchange{}
+	}
+
+	// Viewers may bring their own stable ID so a ban survives reconnects
+	if resume != nil {
+		offer.ViewerID = resume.viewerID
+		if room.ViewerBanned(offer.ViewerID) {
+			writeError(w, http.StatusForbidden, errCodeViewerBanned, "Viewer is banned from this room")
+			return nil, SDPExchange{}
+		}
+	} else if offer.ViewerID != "" {
+		if !validViewerID(offer.ViewerID) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidViewerID, "viewerId must be 1-64 letters, digits, '-' or '_'")
+			return nil, SDPExchange{}
+		}
+		if room.ViewerBanned(offer.ViewerID) {
+			writeError(w, http.StatusForbidden, errCodeViewerBanned, "Viewer is banned from this room")
+			return nil, SDPExchange{}
+		}
+		if room.Viewer(offer.ViewerID) != nil {
+			writeError(w, http.StatusConflict, errCodeViewerIDInUse, "Viewer ID already in use")
+			return nil, SDPExchange{}
+		}
+	}
+
+	// Pick the requested simulcast layer, or the best available one.
+	// With ?wait=true a viewer that arrives early is held until the
+	// broadcaster starts.
+	track, rid := room.SelectLayer(offer.Layer)
+	if track == nil && r.URL.Query().Get("wait") == "true" && s.cfg.SubscribeWaitTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.cfg.SubscribeWaitTimeout)
+		track, rid = room.WaitForLayer(ctx, offer.Layer)
+		cancel()
+		if track == nil {
+			writeError(w, http.StatusGatewayTimeout, errCodeWaitTimeout, "Timed out waiting for broadcaster")
+			return nil, SDPExchange{}
+		}
+		// Join latency is measured from when there was something to join
+		start = time.Now()
+	}
+	if track == nil {
+		writeError(w, http.StatusNotFound, errCodeNoBroadcaster, "No broadcaster in room")
+		return nil, SDPExchange{}
+	}
+
+	// Media is passed through as the broadcaster sent it, so a viewer that
+	// can't decode that codec would only ever see a black screen
+	codec := track.Codec().MimeType
+	supported, offered, err := offerSupportsCodec(offer.SDP, codec)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Invalid offer: %v", err))
+		return nil, SDPExchange{}
+	}
+	if !supported {
+		writeError(w, http.StatusNotAcceptable, errCodeCodecUnsupported, fmt.Sprintf("Viewer cannot decode broadcaster codec %s (offered: %s)", codec, strings.Join(offered, ", ")))
+		return nil, SDPExchange{}
+	}
+
+	// Turn viewers away before negotiating if the room or host is full. A
+	// resumed viewer may still hold its old slot, which it gives up below.
+	limit := s.viewerLimit(room)
+	if resume == nil || room.Viewer(resume.viewerID) == nil {
+		if n := room.ViewerCount(); limit > 0 && n >= limit {
+			writeRoomFull(w, n, limit)
+			return nil, SDPExchange{}
+		}
+		if !s.admitPeer(w) {
+			return nil, SDPExchange{}
+		}
+	}
+
+	// Create peer connection for viewer
+	// The ID is settled now so that the connection's logs carry it
+	if offer.ViewerID == "" {
+		offer.ViewerID = newPeerID()
+	}
+	logger := peerLog(roomID, "viewer", offer.ViewerID)
+	tagPeer(r.Context(), "viewer", offer.ViewerID)
+	pc, control, bwe, err := s.peers.connectPeer(roomID, "viewer", offer.ViewerID, room.ICEServers())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create peer connection: %v", err))
+		return nil, SDPExchange{}
+	}
+	// With simulcast the viewer gets its own track, so it can move
+	// between layers independently of other viewers
+	var simulcast *simulcastTrack
+	if rid != "" {
+		if simulcast, err = newSimulcastTrack(track); err != nil {
+			pc.Close()
+			writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to create track: %v", err))
+			return nil, SDPExchange{}
+		}
+	}
+	// Until the viewer is registered, any failure leaves pc unused
+	registered := false
+	defer func() {
+		if !registered {
+			pc.Close()
+			if simulcast != nil {
+				simulcast.detach()
+			}
+		}
+	}()
+
+	// Add broadcaster's track to viewer connection
+	// The sender gets an RTX stream when the viewer supports it, which
+	// retransmissions from the track's history go out on
+	var videoTrack webrtc.TrackLocal = track
+	if simulcast != nil {
+		videoTrack = simulcast
+	}
+	rtpSender, err := pc.AddTrack(videoTrack)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add track: %v", err))
+		return nil, SDPExchange{}
+	}
+
+	// Audio goes in the answer if the offer has room for it; otherwise it
+	// is offered once the control channel opens
+	audio := room.AudioTrack()
+	var audioSender *webrtc.RTPSender
+	if audio != nil {
+		if ok, _, _ := offerSupportsCodec(offer.SDP, audio.Codec().MimeType); ok {
+			if audioSender, err = pc.AddTrack(audio); err != nil {
+				writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add track: %v", err))
+				return nil, SDPExchange{}
+			}
+			go readRTCP(audioSender, nil, nil)
+		} else {
+			audio = nil
+		}
+	}
+
+	// So do the extra and co-presenter tracks, while the offer has media
+	// sections to spare
+	extras, err := addPublishedSenders(pc, room, offer.SDP, audioSender != nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to add track: %v", err))
+		return nil, SDPExchange{}
+	}
+
+	// Apply the viewer's offer and gather ICE candidates
+	gatherComplete, err := s.answerOffer(r.Context(), pc, offer.SDP, nil)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return nil, SDPExchange{}
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return nil, SDPExchange{}
+	}
+
+	v := &viewer{id: offer.ViewerID, pc: pc, control: control, sender: rtpSender, track: track, label: room.MainLabel(), audio: audio, audioSender: audioSender, extras: extras}
+	if bwe != nil && negotiatedTWCC(rtpSender) {
+		v.bwe = bwe
+	}
+	v.maxBitrate = offeredBitrate(offer.SDP)
+	v.forwardNACKs = s.cfg.Peer.DisableNACK
+	if simulcast == nil {
+		go room.readViewerRTCP(v, rtpSender)
+	} else {
+		// Viewers that ask for no particular layer get the best one, and
+		// move down if their connection can't keep up
+		v.simulcast = simulcast
+		v.autoLayer = offer.Layer == "" || offer.Layer == layerAuto
+		simulcast.setBitrateCap(v.maxBitrate, func() {
+			if err := room.RequestKeyframe(simulcast.Current()); err != nil && !errors.Is(err, errNoBroadcaster) {
+				logger.Debug("Failed to request keyframe after shedding", "err", err)
+			}
+		})
+		go room.readSimulcastRTCP(v, rtpSender)
+	}
+	if resume != nil {
+		// Take over from the old connection if it hasn't noticed the drop
+		paused := resume.paused
+		if old := room.Viewer(v.id); old != nil {
+			paused = old.Paused()
+			room.ReleaseViewer(old)
+			old.pc.Close()
+		}
+		if err := v.setPaused(paused); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to update viewer: %v", err))
+			return nil, SDPExchange{}
+		}
+	}
+
+	// Register against the track atomically; the broadcaster may have left
+	// while we were negotiating
+	if err := room.AddViewerUpTo(v, limit); err != nil {
+		switch {
+		case errors.Is(err, errRoomFull):
+			writeRoomFull(w, room.ViewerCount(), limit)
+		case errors.Is(err, errViewerBanned):
+			writeError(w, http.StatusForbidden, errCodeViewerBanned, "Viewer is banned from this room")
+		case errors.Is(err, errViewerExists):
+			writeError(w, http.StatusConflict, errCodeViewerIDInUse, "Viewer ID already in use")
+		default:
+			writeError(w, http.StatusConflict, errCodeBroadcasterLeft, "Broadcaster left during subscribe")
+		}
+		return nil, SDPExchange{}
+	}
+	registered = true
+	room.AddControlChannel(control)
+	room.AcceptDataChannels(pc)
+	control.OnOpen(func() {
+		// Audio may have started during negotiation, or the offer had no
+		// audio section. Extra tracks always arrive this way.
+		offerTracks(room, v)
+	})
+	var connectedOnce sync.Once
+	connecting := s.startConnectSpan(r.Context())
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		connecting.observe(state)
+		s.notifyConnectionState(roomID, "viewer", state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			// Media can only reach the viewer from here on, so this is
+			// when its first keyframe is worth asking for
+			connectedOnce.Do(func() {
+				room.requestJoinKeyframe(v)
+				s.observeViewerJoin(roomID, v, start)
+			})
+		case webrtc.PeerConnectionStateFailed:
+			// ICE or DTLS gave up on the viewer, which pion won't
+			// recover from; closing releases it below
+			logger.Info("Viewer connection failed, closing")
+			if err := pc.Close(); err != nil {
+				logger.Error("Failed to close viewer", "err", err)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			room.ReleaseViewer(v)
+		}
+	})
+
+	var token string
+	if s.cfg.ReconnectGrace > 0 {
+		token = room.IssueReconnectToken(v.id, s.cfg.ReconnectGrace)
+	}
+
+	return v, SDPExchange{
+		Type:           "answer",
+		SDP:            pc.LocalDescription().SDP,
+		Layer:          rid,
+		ViewerID:       v.id,
+		ReconnectToken: token,
+		Tracks:         v.trackInfos(),
+	}
+}
+
+// handleUnpublishWithID handles POST /internal/room/{id}/unpublish
+// Ends the broadcast at once when the host stops sharing
+func (s *Server) handleUnpublishWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	if !room.Unpublish() {
+		writeError(w, http.StatusConflict, errCodeNoBroadcaster, "No broadcaster in room")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "unpublished",
+		"roomId":         roomID,
+		"hasBroadcaster": false,
+	})
+}
+
+// observeViewerJoin records how long a viewer took to connect after
+// subscribing, then how long until media first reached it
+func (s *Server) observeViewerJoin(roomID string, v *viewer, subscribed time.Time) {
+	connected := time.Now()
+	setup := connected.Sub(subscribed)
+	s.metrics.viewerConnect.Observe(setup)
+	logger := peerLog(roomID, "viewer", v.id)
+	logger.Info("Viewer connected", "setup", setup.Round(time.Millisecond))
+
+	v.track.AfterNextForward(func() {
+		firstPacket := time.Since(connected)
+		s.metrics.viewerFirstPacket.Observe(firstPacket)
+		logger.Info("Viewer received first packet", "afterConnect", firstPacket.Round(time.Millisecond))
+	})
+}
+
+// handleStatusWithID handles GET /internal/room/{id}/status
+func (s *Server) handleStatusWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+
+	if room == nil {
+		// In a cluster the room may be on another node
+		remote, err := s.remoteRoomStatus(r.Context(), roomID)
+		if err != nil {
+			roomLog(roomID).Warn("Failed to read room status from the cluster", "err", err)
+		}
+		if remote != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(remote)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"exists":         false,
+			"hasBroadcaster": false,
+			"viewerCount":    0,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.roomStatus(room))
+}
+
+// roomStatus is the status response body for room, also what it publishes
+// to the cluster
+func (s *Server) roomStatus(room *Room) map[string]interface{} {
+	track := room.GetBroadcasterTrack()
+	in, out := room.Traffic()
+	body := map[string]interface{}{
+		"exists":         true,
+		"hasBroadcaster": track != nil,
+		"viewerCount":    room.ViewerCount(),
+		"layers":         room.Layers(),
+		"bytesIngress":   in,
+		"bytesEgress":    out,
+	}
+	if s.cfg.RoomByteQuota > 0 {
+		body["byteQuota"] = s.cfg.RoomByteQuota
+	}
+	if limit := room.MaxBitrate(); limit > 0 {
+		body["maxBitrateKbps"] = int(limit / 1000)
+	}
+	body["broadcasterPolicy"] = room.BroadcasterPolicy()
+	// Resolution is only known once the first keyframe has been parsed
+	if track != nil {
+		body["codec"] = track.Codec().MimeType
+		if width, height := track.Resolution(); width > 0 {
+			body["width"] = width
+			body["height"] = height
+		}
+	}
+	if audio := room.AudioTrack(); audio != nil {
+		body["audioCodec"] = audio.Codec().MimeType
+	}
+	if tracks := room.Tracks(); len(tracks) > 0 {
+		body["tracks"] = tracks
+	}
+	if labels := room.DataChannelLabels(); len(labels) > 0 {
+		body["dataChannels"] = labels
+	}
+	if quality := room.Quality(); len(quality) > 0 {
+		body["quality"] = quality
+	}
+	if s.cluster != nil {
+		body["node"] = s.cluster.cfg.NodeID
+	}
+	return body
+}
+
+// handleRecordWithID handles POST and DELETE /internal/room/{id}/record
+// POST starts recording the broadcaster's media, DELETE stops it
+func (s *Server) handleRecordWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	if r.Method == http.MethodDelete {
+		s.handleRecordingStopWithID(w, r, roomID)
+		return
+	}
+	s.handleRecordingStartWithID(w, r, roomID)
+}
+
+// handleRecordingStopWithID handles POST /internal/room/{id}/recording/stop
+// Returns the recording's files
+func (s *Server) handleRecordingStopWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	files, err := room.StopRecording()
+	if err != nil {
+		writeError(w, http.StatusConflict, errCodeNotRecording, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "stopped",
+		"roomId": roomID,
+		"files":  files,
+	})
+}
+
+// handleRecordingStartWithID handles POST /internal/room/{id}/recording/start
+// Records the broadcaster's media under the record directory, in the
+// configured record format
+func (s *Server) handleRecordingStartWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	onFile := func(path string) { s.uploader.Enqueue(roomID, path) }
+	if _, err := room.StartRecording(s.cfg.RecordDir, s.cfg.RecordFormat, s.cfg.RecordSegment, onFile); err != nil {
+		if errors.Is(err, errAlreadyRecording) {
+			writeError(w, http.StatusConflict, errCodeAlreadyRecording, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to start recording: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "recording", "roomId": roomID})
+}
+
+// roomRoute is an action under /internal/room/{id}/ and the methods it accepts
+type roomRoute struct {
+	methods []string
+	handler func(w http.ResponseWriter, r *http.Request, roomID string)
+}
+
+// roomRoutes maps each action to its route
+func (s *Server) roomRoutes() map[string]roomRoute {
+	return map[string]roomRoute{
+		"":            {[]string{http.MethodDelete}, s.handleDeleteRoomWithID},
+		"publish":     {[]string{http.MethodPost, http.MethodPatch}, s.limitSDP(s.traced("publish", s.requireToken(roleBroadcaster, s.handlePublishWithID)))},
+		"present":     {[]string{http.MethodPost}, s.limitSDP(s.traced("present", s.requireToken(roleBroadcaster, s.handlePresentWithID)))},
+		"subscribe":   {[]string{http.MethodPost, http.MethodPatch}, s.limitSDP(s.traced("subscribe", s.requireToken(roleViewer, s.handleSubscribeWithID)))},
+		"status":      {[]string{http.MethodGet}, s.handleStatusWithID},
+		"stats":       {[]string{http.MethodGet}, s.handleStatsWithID},
+		"events":      {[]string{http.MethodGet}, s.handleEventsWithID},
+		"record":      {[]string{http.MethodPost, http.MethodDelete}, s.handleRecordWithID},
+		"hls":         {[]string{http.MethodPost, http.MethodDelete}, s.handleHLSWithID},
+		"unpublish":   {[]string{http.MethodPost}, s.handleUnpublishWithID},
+		"renegotiate": {[]string{http.MethodPost}, s.limitSDP(s.traced("renegotiate", s.requireToken(roleBroadcaster, s.handleRenegotiateWithID)))},
+		"resubscribe": {[]string{http.MethodPost}, s.limitSDP(s.traced("resubscribe", s.requireToken(roleViewer, s.handleResubscribeWithID)))},
+
+		// Recording control; record is the older form of these
+		"recording/start": {[]string{http.MethodPost}, s.handleRecordingStartWithID},
+		"recording/stop":  {[]string{http.MethodPost}, s.handleRecordingStopWithID},
+	}
+}
+
+// allowMethod reports whether r's method is one of methods, otherwise it
+// writes a 405 with an Allow header. HEAD is accepted wherever GET is, and
+// OPTIONS is always listed since corsMiddleware answers preflights.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	allowed := make([]string, 0, len(methods)+2)
+	for _, m := range methods {
+		if r.Method == m || (r.Method == http.MethodHead && m == http.MethodGet) {
+			return true
+		}
+		allowed = append(allowed, m)
+		if m == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	allowed = append(allowed, http.MethodOptions)
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+	return false
+}
+
+// validRoomID reports whether id matches the configured room ID pattern
+func (s *Server) validRoomID(id string) bool {
+	return s.cfg.RoomIDPattern == nil || s.cfg.RoomIDPattern.MatchString(id)
+}
+
+func writeInvalidRoomID(w http.ResponseWriter, pattern *regexp.Regexp) {
+	writeErrorDetails(w, http.StatusBadRequest, errCodeInvalidRoomID, "Invalid room ID",
+		map[string]interface{}{"pattern": pattern.String()})
+}
+
+// handleRoomRouter routes requests under /internal/room/
+func (s *Server) handleRoomRouter(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	// POST /internal/room - create room
+	if path == "/internal/room" {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if s.createLimiter != nil {
+			s.createLimiter.middleware(s.handleCreateRoom)(w, r)
+			return
+		}
+		s.handleCreateRoom(w, r)
+		return
+	}
+
+	// Parse /internal/room/{id}/{action}
+	// Expected: /internal/room/abc123/publish
+	parts := strings.Split(strings.TrimPrefix(path, "/internal/room/"), "/")
+	if len(parts) < 1 || parts[0] == "" {
+		writeError(w, http.StatusBadRequest, errCodeRoomIDRequired, "Room ID required")
+		return
+	}
+
+	roomID := parts[0]
+	if !s.validRoomID(roomID) {
+		writeInvalidRoomID(w, s.cfg.RoomIDPattern)
+		return
+	}
+	action := ""
+	if len(parts) >= 2 {
+		action = parts[1]
+	}
+	// Some actions have a sub-action, as in recording/start
+	if len(parts) == 3 {
+		if _, ok := s.routes[action+"/"+parts[2]]; ok {
+			action += "/" + parts[2]
+		}
+	}
+
+	// /internal/room/{id}/viewer/{viewerId}[/{action}]
+	if action == "viewer" {
+		if len(parts) < 3 || len(parts) > 4 || parts[2] == "" {
+			writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown action")
+			return
+		}
+		viewerAction := ""
+		if len(parts) == 4 {
+			viewerAction = parts[3]
+		}
+		route, ok := s.viewerRoutes[viewerAction]
+		if !ok {
+			writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown action")
+			return
+		}
+		if !allowMethod(w, r, route.methods...) || !s.routeToOwner(w, r, roomID, false) {
+			return
+		}
+		route.handler(w, r, roomID, parts[2])
+		return
+	}
+
+	route, ok := s.routes[action]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown action")
+		return
+	}
+	if !allowMethod(w, r, route.methods...) {
+		return
+	}
+	// Any node can report status. Publishing takes an unowned room for
+	// this node; everything else goes wherever the room already is.
+	if action != "status" && !s.routeToOwner(w, r, roomID, (action == "publish" && r.Method == http.MethodPost) || action == "present") {
+		return
+	}
+	route.handler(w, r, roomID)
+}
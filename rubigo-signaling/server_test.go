@@ -0,0 +1,651 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// fakeStore is an in-memory RoomStore that records calls
+type fakeStore struct {
+	mu      sync.Mutex
+	rooms   map[string]*Room
+	created []string
+	deleted []string
+}
+
+func newFakeStore(ids ...string) *fakeStore {
+	f := &fakeStore{rooms: make(map[string]*Room)}
+	for _, id := range ids {
+		f.rooms[id] = &Room{id: id}
+	}
+	return f
+}
+
+func (f *fakeStore) GetOrCreate(id string) (*Room, bool) {
+	room, created, _ := f.TryCreate(id, 0)
+	return room, created
+}
+
+func (f *fakeStore) TryCreate(id string, limit int) (*Room, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if room, ok := f.rooms[id]; ok {
+		return room, false, nil
+	}
+	if limit > 0 && len(f.rooms) >= limit {
+		return nil, false, &RoomLimitError{Current: len(f.rooms), Limit: limit}
+	}
+	room := &Room{id: id}
+	f.rooms[id] = room
+	f.created = append(f.created, id)
+	return room, true, nil
+}
+
+func (f *fakeStore) Get(id string) *Room {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rooms[id]
+}
+
+func (f *fakeStore) Delete(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rooms, id)
+	f.deleted = append(f.deleted, id)
+}
+
+func (f *fakeStore) Rooms() []*Room {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rooms := make([]*Room, 0, len(f.rooms))
+	for _, room := range f.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// newServer creates a Server for a test and closes it on cleanup
+func newServer(t *testing.T, store RoomStore, cfg Config) *Server {
+	t.Helper()
+	server, err := NewServer(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func newTestServer(t *testing.T, store RoomStore) http.Handler {
+	return newServer(t, store, DefaultConfig()).Handler()
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+// decodeError decodes a JSON error envelope and checks its code
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder, wantCode string) apiError {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON error response %q: %v", rec.Body.String(), err)
+	}
+	if body.Error.Code != wantCode {
+		t.Errorf("error code = %q, want %q (message %q)", body.Error.Code, wantCode, body.Error.Message)
+	}
+	return body.Error
+}
+
+func TestCreateRoom(t *testing.T) {
+	store := newFakeStore()
+	rec := doRequest(t, newTestServer(t, store), http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body := decodeBody(t, rec)
+	if body["status"] != "created" || body["roomId"] != "abc" {
+		t.Errorf("unexpected body: %v", body)
+	}
+	if len(store.created) != 1 || store.created[0] != "abc" {
+		t.Errorf("created = %v, want [abc]", store.created)
+	}
+}
+
+func TestCreateRoomExisting(t *testing.T) {
+	store := newFakeStore("abc")
+	rec := doRequest(t, newTestServer(t, store), http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+
+	body := decodeBody(t, rec)
+	if body["status"] != "existed" || body["hasBroadcaster"] != false || body["viewerCount"] != float64(0) {
+		t.Errorf("unexpected body: %v", body)
+	}
+	if len(store.created) != 0 {
+		t.Errorf("created = %v, want none", store.created)
+	}
+}
+
+func TestCreateRoomErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"bad JSON", http.MethodPost, `{`, http.StatusBadRequest},
+		{"missing roomId", http.MethodPost, `{}`, http.StatusBadRequest},
+		{"negative maxViewers", http.MethodPost, `{"roomId":"abc","maxViewers":-1}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			rec := doRequest(t, newTestServer(t, store), tt.method, "/internal/room", tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if len(store.created) != 0 {
+				t.Errorf("created = %v, want none", store.created)
+			}
+		})
+	}
+}
+
+func TestCreateRoomICEServers(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","iceServers":[{"urls":["turn:turn.example.com"],"username":"u","credential":"p"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	servers := store.Get("abc").ICEServers()
+	if len(servers) != 1 || servers[0].Username != "u" || servers[0].URLs[0] != "turn:turn.example.com" {
+		t.Errorf("room ICE servers = %+v", servers)
+	}
+
+	// Re-creating doesn't replace them
+	doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc","iceServers":[{"urls":["stun:other.example.com"]}]}`)
+	if servers := store.Get("abc").ICEServers(); servers[0].URLs[0] != "turn:turn.example.com" {
+		t.Errorf("ICE servers changed by re-create: %+v", servers)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"def","iceServers":[{"urls":["turn:turn.example.com"]}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid ICE servers status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if store.Get("def") != nil {
+		t.Error("room created despite invalid ICE servers")
+	}
+}
+
+func TestCreateRoomLimit(t *testing.T) {
+	store := newFakeStore("abc")
+	cfg := DefaultConfig()
+	cfg.MaxRooms = 1
+	h := newServer(t, store, cfg).Handler()
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"def"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if apiErr := decodeError(t, rec, errCodeRoomLimit); apiErr.Details["rooms"] != float64(1) || apiErr.Details["maxRooms"] != float64(1) {
+		t.Errorf("unexpected details: %v", apiErr.Details)
+	}
+	if len(store.created) != 0 {
+		t.Errorf("created = %v, want none", store.created)
+	}
+
+	// Existing rooms are still reachable at the limit
+	rec = doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("existing room status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/def/publish", `{"type":"offer","sdp":""}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("publish status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxBodyBytes = 64
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+	huge := `{"type":"offer","sdp":"` + strings.Repeat("a", 1000) + `"}`
+
+	for _, path := range []string{"/internal/room", "/internal/room/abc/publish", "/internal/room/abc/subscribe"} {
+		t.Run(path, func(t *testing.T) {
+			rec := doRequest(t, h, http.MethodPost, path, huge)
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+			}
+			if apiErr := decodeError(t, rec, errCodeBodyTooLarge); apiErr.Details["maxBytes"] != float64(64) {
+				t.Errorf("unexpected details: %v", apiErr.Details)
+			}
+		})
+	}
+
+	// Bodies under the limit are unaffected
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"def"}`); rec.Code != http.StatusOK {
+		t.Errorf("small body status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"bad JSON", http.MethodPost, `not json`, http.StatusBadRequest},
+		{"invalid SDP", http.MethodPost, `{"type":"offer","sdp":"garbage"}`, http.StatusBadRequest},
+		{"wrong method", http.MethodGet, ``, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore()), tt.method, "/internal/room/abc/publish", tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishWithAudio(t *testing.T) {
+	store := newFakeStore("abc")
+	h := newTestServer(t, store)
+
+	broadcaster, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broadcaster.Close()
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range []webrtc.TrackLocal{video, audio} {
+		if _, err := broadcaster.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offer, err := broadcaster.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(broadcaster)
+	if err := broadcaster.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: broadcaster.LocalDescription().SDP})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer.SDP, "m=audio") {
+		t.Fatal("answer has no audio section")
+	}
+	if err := broadcaster.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	room := store.Get("abc")
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := uint16(0); room.GetBroadcasterTrack() == nil || room.AudioTrack() == nil; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("tracks = %+v, want video and audio", room.Tracks())
+		}
+		video.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		audio.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0xfc}})
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+	if status["audioCodec"] != webrtc.MimeTypeOpus {
+		t.Errorf("status audioCodec = %v, want %s", status["audioCodec"], webrtc.MimeTypeOpus)
+	}
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		rooms    []string
+		body     string
+		want     int
+		wantCode string
+	}{
+		{"bad JSON", []string{"abc"}, `{`, http.StatusBadRequest, errCodeInvalidJSON},
+		{"room not found", nil, `{"type":"offer","sdp":""}`, http.StatusNotFound, errCodeRoomNotFound},
+		{"no broadcaster", []string{"abc"}, `{"type":"offer","sdp":""}`, http.StatusNotFound, errCodeNoBroadcaster},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore(tt.rooms...)), http.MethodPost, "/internal/room/abc/subscribe", tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			decodeError(t, rec, tt.wantCode)
+		})
+	}
+}
+
+func TestUnpublish(t *testing.T) {
+	store := newFakeStore("idle")
+	store.rooms["abc"] = &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/unpublish", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if body := decodeBody(t, rec); body["status"] != "unpublished" || body["hasBroadcaster"] != false {
+		t.Errorf("unexpected body: %v", body)
+	}
+	// Status reflects it immediately
+	if body := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")); body["hasBroadcaster"] != false {
+		t.Errorf("status after unpublish: %v", body)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/internal/room/abc/unpublish", http.StatusConflict},
+		{"/internal/room/idle/unpublish", http.StatusConflict},
+		{"/internal/room/missing/unpublish", http.StatusNotFound},
+	} {
+		if rec := doRequest(t, h, http.MethodPost, tt.path, ""); rec.Code != tt.want {
+			t.Errorf("POST %s = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSubscribeWaitTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SubscribeWaitTimeout = 10 * time.Millisecond
+	h := newServer(t, newFakeStore("abc"), cfg).Handler()
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe?wait=true", `{"type":"offer","sdp":""}`)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	// Without wait the viewer is turned away at once
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":""}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status without wait = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestSubscribeCodecMismatch(t *testing.T) {
+	store := newFakeStore()
+	store.rooms["abc"] = &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	h := newTestServer(t, store)
+
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: viewerOffer("VP9/90000", "AV1/90000")})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", string(body))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotAcceptable)
+	}
+	if msg := rec.Body.String(); !strings.Contains(msg, "video/VP8") || !strings.Contains(msg, "video/VP9") {
+		t.Errorf("error %q should name the broadcaster and offered codecs", msg)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":"garbage"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid SDP status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestViewerRemovedWhenConnectionFails(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Peer.ICEDisconnectedTimeout = 200 * time.Millisecond
+	cfg.Peer.ICEFailedTimeout = 200 * time.Millisecond
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	h := newServer(t, store, cfg).Handler()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	client.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("subscribe status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer never connected")
+	}
+	v := room.Viewer(answer.ViewerID)
+	if v == nil {
+		t.Fatal("viewer not registered")
+	}
+
+	// The viewer vanishes without saying goodbye, as when its network
+	// drops; the server only notices by ICE going silent
+	if err := client.SCTP().Transport().ICETransport().Stop(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.ViewerCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("viewer still registered after its connection failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if state := v.pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("viewer connection state = %s, want closed", state)
+	}
+	if status := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")); status["viewerCount"] != float64(0) {
+		t.Errorf("status viewerCount = %v, want 0", status["viewerCount"])
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Run("missing room", func(t *testing.T) {
+		rec := doRequest(t, newTestServer(t, newFakeStore()), http.MethodGet, "/internal/room/abc/status", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		body := decodeBody(t, rec)
+		if body["exists"] != false || body["hasBroadcaster"] != false || body["viewerCount"] != float64(0) {
+			t.Errorf("unexpected body: %v", body)
+		}
+	})
+
+	t.Run("existing room", func(t *testing.T) {
+		rec := doRequest(t, newTestServer(t, newFakeStore("abc")), http.MethodGet, "/internal/room/abc/status", "")
+		body := decodeBody(t, rec)
+		if body["exists"] != true || body["hasBroadcaster"] != false {
+			t.Errorf("unexpected body: %v", body)
+		}
+	})
+
+	t.Run("broadcaster media", func(t *testing.T) {
+		track := newLiveTrack(t)
+		store := newFakeStore()
+		store.rooms["abc"] = &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": track}}
+		h := newTestServer(t, store)
+
+		body := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+		if body["codec"] != webrtc.MimeTypeVP8 {
+			t.Errorf("codec = %v, want %s", body["codec"], webrtc.MimeTypeVP8)
+		}
+		if _, ok := body["width"]; ok {
+			t.Errorf("width reported before first keyframe: %v", body)
+		}
+
+		track.ObserveKeyframe(&rtp.Packet{Payload: vp8Keyframe})
+		body = decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+		if body["width"] != float64(1920) || body["height"] != float64(1080) {
+			t.Errorf("unexpected body: %v", body)
+		}
+	})
+
+	t.Run("does not create room", func(t *testing.T) {
+		store := newFakeStore()
+		doRequest(t, newTestServer(t, store), http.MethodGet, "/internal/room/abc/status", "")
+		if len(store.created) != 0 {
+			t.Errorf("created = %v, want none", store.created)
+		}
+	})
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"missing room ID", http.MethodPost, "/internal/room/", http.StatusBadRequest},
+		{"unknown action", http.MethodPost, "/internal/room/abc/bogus", http.StatusNotFound},
+		{"preflight", http.MethodOptions, "/internal/room/abc/publish", http.StatusOK},
+		{"preflight on status", http.MethodOptions, "/internal/room/abc/status", http.StatusOK},
+		{"HEAD status", http.MethodHead, "/internal/room/abc/status", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore()), tt.method, tt.path, "")
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		wantAllow string
+	}{
+		{http.MethodGet, "/internal/room", "POST, OPTIONS"},
+		{http.MethodGet, "/internal/room/abc/publish", "POST, PATCH, OPTIONS"},
+		{http.MethodPut, "/internal/room/abc/subscribe", "POST, PATCH, OPTIONS"},
+		{http.MethodPost, "/internal/room/abc/status", "GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/internal/room/abc/record", "POST, DELETE, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore()), tt.method, tt.path, "")
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			decodeError(t, rec, errCodeMethodNotAllowed)
+		})
+	}
+}
+
+func TestRoomIDValidation(t *testing.T) {
+	long := strings.Repeat("a", 65)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"create with slash", http.MethodPost, "/internal/room", `{"roomId":"a/b"}`},
+		{"create too long", http.MethodPost, "/internal/room", `{"roomId":"` + long + `"}`},
+		{"create with space", http.MethodPost, "/internal/room", `{"roomId":"a b"}`},
+		{"route too long", http.MethodGet, "/internal/room/" + long + "/status", ""},
+		{"route with dot", http.MethodPost, "/internal/room/a.b/publish", `{"type":"offer","sdp":""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			rec := doRequest(t, newTestServer(t, store), tt.method, tt.path, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			decodeError(t, rec, errCodeInvalidRoomID)
+			if len(store.created) != 0 {
+				t.Errorf("created = %v, want none", store.created)
+			}
+		})
+	}
+
+	// The pattern is configurable
+	cfg := DefaultConfig()
+	cfg.RoomIDPattern = regexp.MustCompile(`^room-[0-9]+$`)
+	h := newServer(t, newFakeStore(), cfg).Handler()
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"room-42"}`); rec.Code != http.StatusOK {
+		t.Errorf("custom pattern match: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("custom pattern mismatch: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// simulcastLayers maps the layer names viewers request to the RIDs
+// broadcasters commonly use for them. Browsers' own examples use
+// q/h/f (quarter, half, full resolution).
+var simulcastLayers = map[string][]string{
+	"low":  {"low", "q", "l"},
+	"mid":  {"mid", "h", "m"},
+	"high": {"high", "f"},
+}
+
+// layerPreference is the order layers are picked in when a viewer doesn't
+// ask for one, or asks for one the broadcaster isn't sending
+var layerPreference = []string{"high", "mid", "low"}
+
+// layerAuto asks for the layer to follow the viewer's bandwidth, which is
+// also what a viewer that names no layer gets
+const layerAuto = "auto"
+
+// validLayer reports whether layer is empty, auto or a known layer name
+func validLayer(layer string) bool {
+	if layer == "" || layer == layerAuto {
+		return true
+	}
+	_, ok := simulcastLayers[layer]
+	return ok
+}
+
+// Layer selection errors
+var (
+	errNotSimulcast     = errors.New("broadcaster is not simulcasting")
+	errLayerUnavailable = errors.New("broadcaster is not sending that layer")
+)
+
+// Control message telling a viewer which layer it is being moved to
+const controlLayer = "layer"
+
+// Automatic layer selection. Receiver reports arrive about once a second.
+const (
+	// layerLossDown is the fraction of packets lost above which a viewer
+	// moves down a layer
+	layerLossDown = 0.10
+	// layerLossUp is the loss a viewer must stay under to move up
+	layerLossUp = 0.02
+	// layerSwitchHold is how long after a switch before another, while
+	// reports still describe the previous layer
+	layerSwitchHold = 3 * time.Second
+	// layerProbeDelay is how long a viewer without a bandwidth estimate
+	// must go without loss before trying the layer above
+	layerProbeDelay = 10 * time.Second
+	// layerUpHeadroom is how far a bandwidth estimate must exceed the
+	// bitrate of the layer above before moving up to it
+	layerUpHeadroom = 1.2
+)
+
+// With simulcast, each viewer gets its own video track, relaying whichever
+// of the room's layer tracks suits it. The room's tracks keep one output
+// sequence per layer; the viewer's track rewrites them again so moving
+// between layers looks like one continuous stream to the viewer.
+
+// simulcastTrack is a simulcast viewer's own video track. It relays one
+// layer at a time; a switch takes effect at the new layer's next keyframe
+// so the viewer's decoder never starts mid-stream.
+type simulcastTrack struct {
+	*webrtc.TrackLocalStaticRTP
+
+	mu       sync.Mutex
+	current  *forwardingTrack
+	pending  *forwardingTrack // switching to, from its next keyframe
+	rewriter rtpRewriter
+
+	// Number of viewer senders bound, for forwardingTrack.Bindings
+	bound   atomic.Int32
+	senders retransmitters
+
+	// shed holds the viewer under its offered bandwidth; nil if it set none
+	shed            *bitrateShedder
+	onShedRecovered func()
+}
+
+// newSimulcastTrack creates a viewer's track, relaying layer
+func newSimulcastTrack(layer *forwardingTrack) (*simulcastTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(layer.Codec(), "video", "screen-share")
+	if err != nil {
+		return nil, err
+	}
+	s := &simulcastTrack{TrackLocalStaticRTP: track, current: layer}
+	layer.addRelay(s)
+	return s, nil
+}
+
+// Bind attaches the viewer's sender, counting it
+func (s *simulcastTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	params, err := s.TrackLocalStaticRTP.Bind(t)
+	if err == nil {
+		s.bound.Add(1)
+		s.senders.bind(t, params)
+	}
+	return params, err
+}
+
+// Unbind detaches the viewer's sender
+func (s *simulcastTrack) Unbind(t webrtc.TrackLocalContext) error {
+	err := s.TrackLocalStaticRTP.Unbind(t)
+	if err == nil {
+		s.bound.Add(-1)
+		s.senders.unbind(t)
+	}
+	return err
+}
+
+// Current returns the layer being relayed
+func (s *simulcastTrack) Current() *forwardingTrack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// switchTo moves to layer at its next keyframe, or at once for a codec
+// whose keyframes can't be recognized
+func (s *simulcastTrack) switchTo(layer *forwardingTrack) {
+	s.mu.Lock()
+	var dropped []*forwardingTrack
+	switch {
+	case layer == s.current:
+		if s.pending != nil {
+			dropped = append(dropped, s.pending)
+		}
+		s.pending = nil
+	case !detectsKeyframes(layer.Codec().MimeType):
+		dropped = append(dropped, s.current)
+		if s.pending != nil && s.pending != layer {
+			dropped = append(dropped, s.pending)
+		}
+		s.current, s.pending = layer, nil
+		s.rewriter.resync = true
+	default:
+		if s.pending != nil && s.pending != layer {
+			dropped = append(dropped, s.pending)
+		}
+		s.pending = layer
+	}
+	s.mu.Unlock()
+
+	layer.addRelay(s)
+	for _, track := range dropped {
+		track.removeRelay(s)
+	}
+}
+
+// relay writes a packet forwarded on layer to the viewer if layer is the
+// one being relayed, completing a pending switch on its keyframe
+func (s *simulcastTrack) relay(layer *forwardingTrack, packet *rtp.Packet) error {
+	s.mu.Lock()
+	var dropped *forwardingTrack
+	if layer == s.pending && keyframeStart(layer.Codec().MimeType, packet.Payload) {
+		dropped, s.current, s.pending = s.current, layer, nil
+		s.rewriter.resync = true
+	}
+	if layer != s.current {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.shed != nil {
+		if ok, recovered := s.shed.admit(packet, keyframeStart(layer.Codec().MimeType, packet.Payload), time.Now()); !ok {
+			s.rewriter.skip()
+			onRecovered := s.onShedRecovered
+			s.mu.Unlock()
+			if dropped != nil {
+				dropped.removeRelay(s)
+			}
+			if recovered {
+				onRecovered()
+			}
+			return nil
+		}
+	}
+	// The layer's other viewers share packet
+	out := *packet
+	s.rewriter.rewrite(&out, s.Codec().ClockRate)
+	s.mu.Unlock()
+
+	if dropped != nil {
+		dropped.removeRelay(s)
+	}
+	return s.WriteRTP(&out)
+}
+
+// detach stops relaying, once the viewer has gone
+func (s *simulcastTrack) detach() {
+	s.mu.Lock()
+	current, pending := s.current, s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	current.removeRelay(s)
+	if pending != nil {
+		pending.removeRelay(s)
+	}
+}
+
+// layerAdapter decides when an auto-layer viewer changes layer, from the
+// packet loss in its receiver reports and any bandwidth estimate from its
+// TWCC feedback or REMB. It is not safe for concurrent use.
+type layerAdapter struct {
+	lastSwitch time.Time
+	cleanSince time.Time // when loss was last above layerLossUp
+	estimate   float64   // in bits per second, zero if none
+}
+
+// step returns -1 to move down a layer, +1 to move up or 0 to stay, given
+// the loss reported at now and the bitrates of the viewer's layer and the
+// one above it
+func (a *layerAdapter) step(now time.Time, loss, current, above float64) int {
+	if a.cleanSince.IsZero() || loss > layerLossUp {
+		a.cleanSince = now
+	}
+	if now.Sub(a.lastSwitch) < layerSwitchHold {
+		return 0
+	}
+	if loss >= layerLossDown || (a.estimate > 0 && a.estimate < current) {
+		return -1
+	}
+	if loss > layerLossUp {
+		return 0
+	}
+	if a.estimate > 0 {
+		if above > 0 && a.estimate >= above*layerUpHeadroom {
+			return 1
+		}
+		return 0
+	}
+	if now.Sub(a.cleanSince) >= layerProbeDelay {
+		return 1
+	}
+	return 0
+}
+
+// switched records that the viewer changed layer at now
+func (a *layerAdapter) switched(now time.Time) {
+	a.lastSwitch, a.cleanSince = now, now
+}
+
+// feedbackLoss returns the worst loss fraction in pkts' receiver reports,
+// and whether there were any
+func feedbackLoss(pkts []rtcp.Packet) (float64, bool) {
+	loss, found := 0.0, false
+	for _, pkt := range pkts {
+		rr, ok := pkt.(*rtcp.ReceiverReport)
+		if !ok {
+			continue
+		}
+		for _, report := range rr.Reports {
+			found = true
+			loss = max(loss, float64(report.FractionLost)/256)
+		}
+	}
+	return loss, found
+}
+
+// feedbackEstimate returns the bitrate of the last REMB in pkts, or zero
+func feedbackEstimate(pkts []rtcp.Packet) float64 {
+	estimate := 0.0
+	for _, pkt := range pkts {
+		if remb, ok := pkt.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+			estimate = float64(remb.Bitrate)
+		}
+	}
+	return estimate
+}
+
+// layerRef is one of the broadcaster's live simulcast layers
+type layerRef struct {
+	rid   string
+	track *forwardingTrack
+}
+
+// liveLayersLocked returns the live layers of the known names, lowest
+// first. The caller must hold r.mu.
+func (r *Room) liveLayersLocked() []layerRef {
+	var layers []layerRef
+	for i := len(layerPreference) - 1; i >= 0; i-- {
+		for _, rid := range simulcastLayers[layerPreference[i]] {
+			if track := r.broadcasterTracks[rid]; track != nil && track.Source() != nil {
+				layers = append(layers, layerRef{rid: rid, track: track})
+				break
+			}
+		}
+	}
+	return layers
+}
+
+// layerRIDLocked returns the RID track is the room's layer for.
+// The caller must hold r.mu.
+func (r *Room) layerRIDLocked(track *forwardingTrack) string {
+	for rid, t := range r.broadcasterTracks {
+		if t == track {
+			return rid
+		}
+	}
+	return ""
+}
+
+// moveViewer switches a simulcast viewer to layer and asks the
+// broadcaster for a keyframe of it, so the switch happens promptly
+func (r *Room) moveViewer(v *viewer, layer layerRef) {
+	r.mu.Lock()
+	v.mu.Lock()
+	moved := v.track != layer.track
+	v.track = layer.track
+	v.adapter.switched(time.Now())
+	v.simulcast.switchTo(layer.track)
+	v.mu.Unlock()
+	r.mu.Unlock()
+	if !moved {
+		return
+	}
+
+	logger := r.viewerLog(v.id)
+	logger.Info("Viewer switching layer", "layer", layer.rid)
+	if err := r.RequestKeyframe(layer.track); err != nil && !errors.Is(err, errNoBroadcaster) {
+		logger.Error("Failed to request keyframe for layer switch", "err", err)
+	}
+	sendControlMessage(v.control, controlMessage{Type: controlLayer, Layer: layer.rid})
+}
+
+// SetViewerLayer pins the viewer with id to a layer (low, mid or high), or
+// with auto lets the layer follow its bandwidth again. It returns the RID
+// the viewer is on or moving to.
+func (r *Room) SetViewerLayer(id, layer string) (string, error) {
+	v := r.Viewer(id)
+	if v == nil {
+		return "", errViewerNotFound
+	}
+	if v.simulcast == nil {
+		return "", errNotSimulcast
+	}
+
+	auto := layer == "" || layer == layerAuto
+	r.mu.RLock()
+	target := layerRef{rid: r.layerRIDLocked(v.track), track: v.track}
+	found := auto
+	for _, ref := range r.liveLayersLocked() {
+		for _, rid := range simulcastLayers[layer] {
+			if ref.rid == rid {
+				target, found = ref, true
+			}
+		}
+	}
+	r.mu.RUnlock()
+	if !found {
+		return "", errLayerUnavailable
+	}
+
+	v.mu.Lock()
+	v.autoLayer = auto
+	v.mu.Unlock()
+	if !auto {
+		r.moveViewer(v, target)
+	}
+	return target.rid, nil
+}
+
+// adaptLayer moves an auto-layer viewer up or down a layer on the RTCP
+// feedback it sent at now
+func (r *Room) adaptLayer(v *viewer, pkts []rtcp.Packet, now time.Time) {
+	if estimate := feedbackEstimate(pkts); estimate > 0 {
+		v.remb.Store(uint64(estimate))
+	}
+	loss, reported := feedbackLoss(pkts)
+	v.mu.Lock()
+	v.adapter.estimate = v.bandwidth()
+	auto := v.autoLayer
+	v.mu.Unlock()
+	if !reported || !auto {
+		return
+	}
+
+	r.mu.RLock()
+	layers := r.liveLayersLocked()
+	current := v.track
+	r.mu.RUnlock()
+	at := -1
+	for i, layer := range layers {
+		if layer.track == current {
+			at = i
+		}
+	}
+	if at < 0 {
+		return
+	}
+	currentRate, aboveRate := layers[at].track.Bitrate(), 0.0
+	if at+1 < len(layers) {
+		aboveRate = layers[at+1].track.Bitrate()
+	}
+
+	v.mu.Lock()
+	step := v.adapter.step(now, loss, currentRate, aboveRate)
+	v.mu.Unlock()
+	if to := at + step; step != 0 && to >= 0 && to < len(layers) {
+		r.moveViewer(v, layers[to])
+	}
+}
+
+// readSimulcastRTCP is readRTCP for a simulcast viewer's video sender:
+// keyframe requests go to the layer being relayed, and the rest of the
+// feedback drives automatic layer selection
+func (r *Room) readSimulcastRTCP(v *viewer, sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if wantsKeyframe(pkts) {
+			if err := r.RequestKeyframe(v.simulcast.Current()); err != nil && !errors.Is(err, errNoBroadcaster) {
+				r.viewerLog(v.id).Error("Failed to forward keyframe request", "err", err)
+			}
+		}
+		if ssrc, lost := nackedSequences(pkts); len(lost) > 0 {
+			layer, missed, err := v.simulcast.Retransmit(ssrc, lost)
+			r.repairViewer(v, layer, missed, err)
+		}
+		r.adaptLayer(v, pkts, time.Now())
+	}
+}
+
+// handleViewerLayer handles POST /internal/room/{id}/viewer/{viewerId}/layer
+// with {"layer": "low"|"mid"|"high"|"auto"}; a named layer turns off
+// automatic selection until auto is set again
+func (s *Server) handleViewerLayer(w http.ResponseWriter, r *http.Request, roomID, viewerID string) {
+	var body struct {
+		Layer string `json:"layer"`
+	}
+	if !s.decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Layer == "" || !validLayer(body.Layer) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidLayer, "layer must be low, mid, high or auto")
+		return
+	}
+
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	rid, err := room.SetViewerLayer(viewerID, body.Layer)
+	switch {
+	case errors.Is(err, errViewerNotFound):
+		writeError(w, http.StatusNotFound, errCodeViewerNotFound, "Viewer not found")
+		return
+	case errors.Is(err, errNotSimulcast), errors.Is(err, errLayerUnavailable):
+		writeError(w, http.StatusConflict, errCodeLayerUnavailable, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to switch layer: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomId":   roomID,
+		"viewerId": viewerID,
+		"layer":    rid,
+		"auto":     body.Layer == layerAuto,
+	})
+}
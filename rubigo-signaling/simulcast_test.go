@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestSimulcastTrackSwitch(t *testing.T) {
+	low, high := newLiveTrack(t), newLiveTrack(t)
+	track, err := newSimulcastTrack(high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := &fakeBinding{id: "v", keep: true}
+	if _, err := track.Bind(viewer); err != nil {
+		t.Fatal(err)
+	}
+	forward := func(layer *forwardingTrack, packet *rtp.Packet) {
+		t.Helper()
+		if err := layer.Forward(layer.Source(), packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forward(high, vp8Packet(100, 9000, false))
+	forward(low, vp8Packet(7, 500, false))
+	if len(viewer.packets) != 1 || high.Bindings() != 1 || low.Bindings() != 0 {
+		t.Fatalf("before switching: %d packets, bindings high=%d low=%d", len(viewer.packets), high.Bindings(), low.Bindings())
+	}
+
+	// The high layer is relayed until the low one sends a keyframe
+	track.switchTo(low)
+	forward(low, vp8Packet(8, 3500, false))
+	forward(high, vp8Packet(101, 12000, false))
+	forward(low, vp8Packet(9, 6500, true))
+	forward(high, vp8Packet(102, 15000, true))
+	forward(low, vp8Packet(10, 9500, false))
+
+	if len(viewer.packets) != 4 {
+		t.Fatalf("viewer got %d packets, want 4", len(viewer.packets))
+	}
+	for i, want := range []struct {
+		seq uint16
+		ts  uint32
+	}{{100, 9000}, {101, 12000}, {102, 12000 + 90000/30}, {103, 15000 + 90000/30}} {
+		if got := viewer.packets[i]; got.SequenceNumber != want.seq || got.Timestamp != want.ts {
+			t.Errorf("packet %d seq=%d ts=%d, want seq=%d ts=%d", i, got.SequenceNumber, got.Timestamp, want.seq, want.ts)
+		}
+	}
+	if track.Current() != low || high.Bindings() != 0 || low.Bindings() != 1 {
+		t.Errorf("after switching: bindings high=%d low=%d", high.Bindings(), low.Bindings())
+	}
+
+	track.detach()
+	if low.Bindings() != 0 {
+		t.Errorf("detached track still relayed: %d bindings", low.Bindings())
+	}
+}
+
+func TestLayerAdapter(t *testing.T) {
+	start := time.Now()
+	var a layerAdapter
+	a.switched(start)
+
+	// Nothing moves while reports may still describe the previous layer
+	if got := a.step(start.Add(time.Second), 0.5, 0, 0); got != 0 {
+		t.Errorf("step during hold = %d, want 0", got)
+	}
+	at := start.Add(layerSwitchHold)
+	if got := a.step(at, 0.2, 0, 0); got != -1 {
+		t.Errorf("step with heavy loss = %d, want -1", got)
+	}
+	a.switched(at)
+
+	// Without an estimate, the layer above is tried after a clean spell
+	at = at.Add(layerSwitchHold)
+	if got := a.step(at, 0.05, 0, 0); got != 0 {
+		t.Errorf("step with some loss = %d, want 0", got)
+	}
+	if got := a.step(at.Add(layerProbeDelay/2), 0, 0, 0); got != 0 {
+		t.Errorf("step soon after loss = %d, want 0", got)
+	}
+	if got := a.step(at.Add(layerProbeDelay), 0, 0, 0); got != 1 {
+		t.Errorf("step after a clean spell = %d, want 1", got)
+	}
+
+	// With one, it decides both ways against the layers' bitrates
+	a.estimate = 900e3
+	at = at.Add(layerProbeDelay)
+	if got := a.step(at, 0, 1e6, 2e6); got != -1 {
+		t.Errorf("step with estimate below the layer = %d, want -1", got)
+	}
+	if got := a.step(at, 0, 300e3, 800e3); got != 0 {
+		t.Errorf("step without headroom = %d, want 0", got)
+	}
+	if got := a.step(at, 0, 300e3, 700e3); got != 1 {
+		t.Errorf("step with headroom = %d, want 1", got)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	pkts := []rtcp.Packet{
+		&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{FractionLost: 64}, {FractionLost: 128}}},
+		&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: 1.5e6},
+		&rtcp.PictureLossIndication{},
+	}
+	if loss, ok := feedbackLoss(pkts); !ok || loss != 0.5 {
+		t.Errorf("feedbackLoss = %v, %v; want 0.5, true", loss, ok)
+	}
+	if _, ok := feedbackLoss(pkts[1:]); ok {
+		t.Error("loss reported without receiver reports")
+	}
+	if got := feedbackEstimate(pkts); got != 1.5e6 {
+		t.Errorf("feedbackEstimate = %v, want 1.5e6", got)
+	}
+}
+
+func TestSimulcastSubscribeAndLayerEndpoint(t *testing.T) {
+	low, high := newLiveTrack(t), newLiveTrack(t)
+	store := newFakeStore("plain")
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"q": low, "f": high}}
+	store.rooms["abc"] = room
+	store.rooms["plain"].broadcasterTracks = map[string]*forwardingTrack{"": newLiveTrack(t)}
+	h := newTestServer(t, store)
+
+	subscribe := func(roomID string) string {
+		t.Helper()
+		body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: newOffer(t)})
+		rec := doRequest(t, h, http.MethodPost, "/internal/room/"+roomID+"/subscribe", string(body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("subscribe = %d: %s", rec.Code, rec.Body.String())
+		}
+		var answer SDPExchange
+		if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+			t.Fatal(err)
+		}
+		return answer.ViewerID
+	}
+
+	// A viewer asking for no layer starts on the best one, on automatic
+	id := subscribe("abc")
+	v := room.Viewer(id)
+	if v == nil || v.simulcast == nil || v.track != high || !v.autoLayer {
+		t.Fatalf("viewer = %+v, want an automatic simulcast viewer on the high layer", v)
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/viewer/"+id+"/layer", `{"layer":"low"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("layer = %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := decodeBody(t, rec); body["layer"] != "q" || body["auto"] != false {
+		t.Errorf("layer body = %v", body)
+	}
+	if v.track != low || v.autoLayer {
+		t.Error("viewer not pinned to the low layer")
+	}
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/viewer/"+id+"/layer", `{"layer":"auto"}`)
+	if body := decodeBody(t, rec); rec.Code != http.StatusOK || body["layer"] != "q" || body["auto"] != true {
+		t.Errorf("auto = %d: %v", rec.Code, body)
+	}
+	if !v.autoLayer {
+		t.Error("viewer not back on automatic")
+	}
+
+	plain := subscribe("plain")
+	tests := []struct {
+		name, path, body string
+		want             int
+		wantCode         string
+	}{
+		{"unknown layer", "/internal/room/abc/viewer/" + id + "/layer", `{"layer":"ultra"}`, http.StatusBadRequest, errCodeInvalidLayer},
+		{"layer not sent", "/internal/room/abc/viewer/" + id + "/layer", `{"layer":"mid"}`, http.StatusConflict, errCodeLayerUnavailable},
+		{"not simulcasting", "/internal/room/plain/viewer/" + plain + "/layer", `{"layer":"low"}`, http.StatusConflict, errCodeLayerUnavailable},
+		{"unknown viewer", "/internal/room/abc/viewer/nobody/layer", `{"layer":"low"}`, http.StatusNotFound, errCodeViewerNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, h, http.MethodPost, tt.path, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			decodeError(t, rec, tt.wantCode)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// GET /internal/room/{id}/stats reports each of a room's connections as
+// seen from the SFU: media bytes and packets each way, the loss, jitter and
+// round trip time from RTP and the peer's RTCP reports, the bitrate since
+// the previous read, and the ICE candidate pair in use. Numbers for what
+// the SFU sends come from the peer's receiver reports, so they lag by a
+// report interval.
+
+// registerRTPStats records the RTP streams of each connection, passing its
+// stats to onStats as the connection is created
+func registerRTPStats(onStats func(stats.Getter)) func(m *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	return func(_ *webrtc.MediaEngine, registry *interceptor.Registry) error {
+		recorder, err := stats.NewInterceptor()
+		if err != nil {
+			return err
+		}
+		recorder.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+			onStats(getter)
+		})
+		registry.Add(recorder)
+		return nil
+	}
+}
+
+// streamStats is a connection's RTP stats and the totals at its last read,
+// for the bitrate since then
+type streamStats struct {
+	getter stats.Getter
+
+	mu             sync.Mutex
+	readAt         time.Time
+	sent, received uint64
+}
+
+// trackStats keeps getter as pc's RTP stats, forgetting those of closed
+// connections
+func (f *peerFactory) trackStats(pc *webrtc.PeerConnection, getter stats.Getter) {
+	f.streamStats.Range(func(key, _ interface{}) bool {
+		if key.(*webrtc.PeerConnection).ConnectionState() == webrtc.PeerConnectionStateClosed {
+			f.streamStats.Delete(key)
+		}
+		return true
+	})
+	f.streamStats.Store(pc, &streamStats{getter: getter})
+}
+
+// peerStats is one connection's entry in a stats response
+type peerStats struct {
+	Role   string `json:"role"`
+	PeerID string `json:"peerId,omitempty"`
+	State  string `json:"state"`
+
+	BytesSent       uint64 `json:"bytesSent"`
+	BytesReceived   uint64 `json:"bytesReceived"`
+	PacketsSent     uint64 `json:"packetsSent"`
+	PacketsReceived uint64 `json:"packetsReceived"`
+	// PacketsLost counts packets lost on the way to the SFU and, as the
+	// peer reports it, on the way from it
+	PacketsLost int64 `json:"packetsLost"`
+	// FractionLost is the worst loss in the peer's latest receiver reports
+	FractionLost float64 `json:"fractionLost"`
+	// JitterMs is the worst interarrival jitter either way
+	JitterMs float64 `json:"jitterMs"`
+	// RTTMs is the round trip time from RTCP, or from ICE until the peer
+	// has sent a receiver report
+	RTTMs float64 `json:"rttMs"`
+	// Bitrates are in bits per second since the connection's previous
+	// read, and omitted on the first
+	SendBitrate    *float64 `json:"sendBitrate,omitempty"`
+	ReceiveBitrate *float64 `json:"receiveBitrate,omitempty"`
+
+	CandidatePair *candidatePairStats `json:"candidatePair,omitempty"`
+}
+
+// candidatePairStats is the ICE candidate pair a connection is using
+type candidatePairStats struct {
+	Local         candidateStats `json:"local"`
+	Remote        candidateStats `json:"remote"`
+	RTTMs         float64        `json:"rttMs"`
+	BytesSent     uint64         `json:"bytesSent"`
+	BytesReceived uint64         `json:"bytesReceived"`
+}
+
+// candidateStats is one end of a candidate pair
+type candidateStats struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int32  `json:"port"`
+}
+
+// connectionStats gathers the stats of pc, the connection of peerID in
+// role
+func (f *peerFactory) connectionStats(role, peerID string, pc *webrtc.PeerConnection) peerStats {
+	out := peerStats{Role: role, PeerID: peerID, State: pc.ConnectionState().String()}
+	if pair := selectedPairStats(pc.GetStats()); pair != nil {
+		out.CandidatePair = pair
+		out.RTTMs = pair.RTTMs
+	}
+
+	entry, _ := f.streamStats.Load(pc)
+	streams, _ := entry.(*streamStats)
+	if streams == nil {
+		return out
+	}
+	var rtcpRTT time.Duration
+	for _, transceiver := range pc.GetTransceivers() {
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			for _, encoding := range sender.GetParameters().Encodings {
+				s := streams.getter.Get(uint32(encoding.SSRC))
+				if s == nil {
+					continue
+				}
+				out.BytesSent += s.OutboundRTPStreamStats.BytesSent
+				out.PacketsSent += s.OutboundRTPStreamStats.PacketsSent
+				out.PacketsLost += s.RemoteInboundRTPStreamStats.PacketsLost
+				out.FractionLost = max(out.FractionLost, s.RemoteInboundRTPStreamStats.FractionLost)
+				out.JitterMs = max(out.JitterMs, s.RemoteInboundRTPStreamStats.Jitter*1000)
+				rtcpRTT = max(rtcpRTT, s.RemoteInboundRTPStreamStats.RoundTripTime)
+			}
+		}
+		if receiver := transceiver.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				s := streams.getter.Get(uint32(track.SSRC()))
+				if s == nil {
+					continue
+				}
+				out.BytesReceived += s.InboundRTPStreamStats.BytesReceived
+				out.PacketsReceived += s.InboundRTPStreamStats.PacketsReceived
+				out.PacketsLost += s.InboundRTPStreamStats.PacketsLost
+				// Inbound jitter is in RTP timestamp units
+				if clockRate := track.Codec().ClockRate; clockRate > 0 {
+					out.JitterMs = max(out.JitterMs, s.InboundRTPStreamStats.Jitter/float64(clockRate)*1000)
+				}
+			}
+		}
+	}
+	if rtcpRTT > 0 {
+		out.RTTMs = float64(rtcpRTT.Microseconds()) / 1000
+	}
+
+	streams.mu.Lock()
+	now := time.Now()
+	if !streams.readAt.IsZero() {
+		if elapsed := now.Sub(streams.readAt).Seconds(); elapsed > 0 {
+			send := float64(out.BytesSent-min(out.BytesSent, streams.sent)) * 8 / elapsed
+			receive := float64(out.BytesReceived-min(out.BytesReceived, streams.received)) * 8 / elapsed
+			out.SendBitrate, out.ReceiveBitrate = &send, &receive
+		}
+	}
+	streams.readAt, streams.sent, streams.received = now, out.BytesSent, out.BytesReceived
+	streams.mu.Unlock()
+	return out
+}
+
+// selectedPairStats returns the nominated candidate pair in report, or the
+// first that succeeded, or nil if ICE hasn't found one
+func selectedPairStats(report webrtc.StatsReport) *candidatePairStats {
+	var selected *webrtc.ICECandidatePairStats
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		if selected == nil || (pair.Nominated && !selected.Nominated) {
+			selected = &pair
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	candidate := func(id string) candidateStats {
+		c, _ := report[id].(webrtc.ICECandidateStats)
+		return candidateStats{Type: c.CandidateType.String(), Protocol: c.Protocol, Address: c.IP, Port: c.Port}
+	}
+	return &candidatePairStats{
+		Local:         candidate(selected.LocalCandidateID),
+		Remote:        candidate(selected.RemoteCandidateID),
+		RTTMs:         selected.CurrentRoundTripTime * 1000,
+		BytesSent:     selected.BytesSent,
+		BytesReceived: selected.BytesReceived,
+	}
+}
+
+// roomPeer is one of a room's connections
+type roomPeer struct {
+	role, id string
+	pc       *webrtc.PeerConnection
+}
+
+// Peers returns a snapshot of the room's connections: its broadcaster,
+// co-presenters and viewers
+func (r *Room) Peers() []roomPeer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var peers []roomPeer
+	if r.broadcaster.pc != nil {
+		peers = append(peers, roomPeer{"broadcaster", r.broadcaster.id, r.broadcaster.pc})
+	}
+	for id, p := range r.presenters {
+		peers = append(peers, roomPeer{"presenter", id, p.pc})
+	}
+	for id, v := range r.viewers {
+		peers = append(peers, roomPeer{"viewer", id, v.pc})
+	}
+	return peers
+}
+
+// handleStatsWithID handles GET /internal/room/{id}/stats
+// ?peerId= limits the response to that peer's connection.
+func (s *Server) handleStatsWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	only := r.URL.Query().Get("peerId")
+
+	peers := make([]peerStats, 0)
+	for _, p := range room.Peers() {
+		if only == "" || p.id == only {
+			peers = append(peers, s.peers.connectionStats(p.role, p.id, p.pc))
+		}
+	}
+	if only != "" && len(peers) == 0 {
+		writeError(w, http.StatusNotFound, errCodePeerNotFound, "No such peer in this room")
+		return
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Role != peers[j].Role {
+			return peerRoleOrder[peers[i].Role] < peerRoleOrder[peers[j].Role]
+		}
+		return peers[i].PeerID < peers[j].PeerID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomId":      roomID,
+		"timestamp":   time.Now().UTC(),
+		"connections": peers,
+	})
+}
+
+// peerRoleOrder lists stats with the broadcaster first, then presenters
+var peerRoleOrder = map[string]int{"broadcaster": 0, "presenter": 1, "viewer": 2}
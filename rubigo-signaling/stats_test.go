@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// publishClient publishes a VP8 track from a new client connection to the
+// publish endpoint at path, returning the track to write to
+func publishClient(t *testing.T, h http.Handler, path string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTrack(sending); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP})
+	rec := doRequest(t, h, http.MethodPost, path, string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish = %d: %s", rec.Code, rec.Body)
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	return sending
+}
+
+func TestRoomStats(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+	if rec := doRequest(t, h, http.MethodGet, "/internal/room/missing/stats", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("stats of a missing room = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	sending := publishClient(t, h, "/internal/room/abc/publish")
+	room := store.Get("abc")
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := uint16(0); seq < 50 || room.GetBroadcasterTrack() == nil; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcaster track never arrived")
+		}
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: []byte{0x10, 0, 0}})
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	read := func(query string) []peerStats {
+		t.Helper()
+		rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/stats"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("stats = %d: %s", rec.Code, rec.Body)
+		}
+		var body struct {
+			Connections []peerStats `json:"connections"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Connections
+	}
+	conns := read("")
+	if len(conns) != 1 || conns[0].Role != "broadcaster" || conns[0].PeerID == "" {
+		t.Fatalf("connections = %+v, want the broadcaster", conns)
+	}
+	broadcaster := conns[0]
+	if broadcaster.PacketsReceived == 0 || broadcaster.BytesReceived == 0 {
+		t.Errorf("broadcaster received %d packets, %d bytes", broadcaster.PacketsReceived, broadcaster.BytesReceived)
+	}
+	if pair := broadcaster.CandidatePair; pair == nil || pair.Local.Address == "" || pair.Remote.Port == 0 {
+		t.Errorf("candidate pair = %+v", broadcaster.CandidatePair)
+	}
+	if broadcaster.ReceiveBitrate != nil {
+		t.Error("first read reported a bitrate")
+	}
+
+	// Later reads have a bitrate, and can pick out a peer
+	for seq := uint16(50); seq < 60; seq++ {
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000}, Payload: []byte{0x10, 0, 0}})
+	}
+	time.Sleep(50 * time.Millisecond)
+	conns = read("?peerId=" + broadcaster.PeerID)
+	if len(conns) != 1 || conns[0].ReceiveBitrate == nil || *conns[0].ReceiveBitrate <= 0 {
+		t.Errorf("second read = %+v, want a receive bitrate", conns)
+	}
+	rec := doRequest(t, h, http.MethodGet, "/internal/room/abc/stats?peerId=nobody", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stats of an unknown peer = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	decodeError(t, rec, errCodePeerNotFound)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// RoomTeardown summarizes what closing a room shut down
+type RoomTeardown struct {
+	Broadcaster bool     `json:"broadcaster"`
+	Presenters  int      `json:"presenters,omitempty"`
+	Viewers     int      `json:"viewers"`
+	Recording   []string `json:"recordingFiles,omitempty"`
+}
+
+// disconnectAll publishes eventType, sends it to the broadcaster,
+// co-presenters and every viewer over their control channels, then closes
+// all their connections. It reports whether there was a broadcaster and how
+// many co-presenters and viewers were closed.
+func (r *Room) disconnectAll(eventType string) (broadcaster bool, presenters, viewers int) {
+	r.publishEvent(eventType)
+	msg := controlMessage{Type: eventType}
+
+	r.mu.RLock()
+	control := r.broadcaster.control
+	r.mu.RUnlock()
+	sendControlMessage(control, msg)
+
+	var closing []*viewer
+	r.ForEachViewer(func(v *viewer) {
+		sendControlMessage(v.control, msg)
+		closing = append(closing, v)
+	})
+
+	broadcaster = r.Unpublish()
+	presenters = r.closePresenters(msg)
+	for _, v := range closing {
+		r.ReleaseViewer(v)
+		if v.pc != nil {
+			v.pc.Close()
+		}
+	}
+	return broadcaster, presenters, len(closing)
+}
+
+// Close ends everything in the room: the broadcaster, co-presenters,
+// viewers, any recording and HLS egress. The room should already be out
+// of its store, so nobody can join while it is torn down.
+func (r *Room) Close() RoomTeardown {
+	var summary RoomTeardown
+	summary.Broadcaster, summary.Presenters, summary.Viewers = r.disconnectAll(EventRoomClosed)
+	if files, err := r.StopRecording(); err == nil {
+		summary.Recording = files
+	}
+	r.StopHLS()
+	roomLog(r.id).Info("Room closed", "broadcaster", summary.Broadcaster, "presenters", summary.Presenters, "viewers", summary.Viewers)
+	return summary
+}
+
+// handleDeleteRoomWithID handles DELETE /internal/room/{id}
+// Removes the room, then disconnects everyone in it
+func (s *Server) handleDeleteRoomWithID(w http.ResponseWriter, r *http.Request, roomID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+	// Status reports the room gone from here on
+	s.rooms.Delete(roomID)
+	summary := room.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "deleted",
+		"roomId":   roomID,
+		"teardown": summary,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDeleteRoom(t *testing.T) {
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	if err := room.AddViewer(&viewer{id: "v1", track: room.GetBroadcasterTrack()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := room.StartRecording(t.TempDir(), RecordWebM, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodDelete, "/internal/room/abc", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	body := decodeBody(t, rec)
+	teardown, _ := body["teardown"].(map[string]interface{})
+	if body["status"] != "deleted" || teardown["broadcaster"] != true || teardown["viewers"] != float64(1) {
+		t.Errorf("unexpected body: %v", body)
+	}
+	if len(store.deleted) != 1 || store.deleted[0] != "abc" {
+		t.Errorf("deleted = %v, want [abc]", store.deleted)
+	}
+	if room.ViewerCount() != 0 || room.GetBroadcasterTrack() != nil || room.GetRecorder() != nil {
+		t.Error("room still has a viewer, broadcaster or recording after delete")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventRoomClosed {
+			t.Errorf("event = %q, want %q", event.Type, EventRoomClosed)
+		}
+	default:
+		t.Error("no room_closed event")
+	}
+
+	// Status reflects it immediately
+	if status := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", "")); status["exists"] != false {
+		t.Errorf("status after delete: %v", status)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, "/internal/room/abc", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doRequest(t, h, http.MethodGet, "/internal/room/abc", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET room = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The SFU serves HTTPS from --tls-cert/--tls-key, picking up renewed files
+// without a restart, or from certificates it obtains itself from Let's
+// Encrypt for --autocert-domains. Autocert answers TLS-ALPN-01 challenges
+// on the HTTPS listener, which must then be reachable on port 443, and
+// HTTP-01 challenges on --autocert-http-addr if set.
+
+// certCheckInterval is how often the certificate files are checked for a
+// renewal, at most
+const certCheckInterval = 30 * time.Second
+
+// certReloader serves a certificate and key pair from files, reloading
+// them when either changes
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // of the newer file at the last load
+	checked time.Time
+}
+
+// newCertReloader loads the key pair in certFile and keyFile
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert, c.modTime, c.checked = &cert, modTime, time.Now()
+	return c, nil
+}
+
+// filesModTime returns the later modification time of the two files
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, checking for new
+// files at most every certCheckInterval
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		c.reloadLocked()
+	}
+	return c.cert, nil
+}
+
+// reloadLocked loads the files if they changed since the last load. A pair
+// that fails to load, e.g. because the key has yet to be written next to a
+// renewed certificate, keeps the current one and is retried at the next
+// check. The caller must hold c.mu.
+func (c *certReloader) reloadLocked() {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		slog.Warn("Failed to check TLS certificate files, keeping current certificate", "err", err)
+		return
+	}
+	if !modTime.After(c.modTime) {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		slog.Warn("Failed to reload TLS certificate, keeping current certificate", "err", err)
+		return
+	}
+	c.cert, c.modTime = &cert, modTime
+	slog.Info("Reloaded TLS certificate", "cert", c.certFile)
+}
+
+// AutocertConfig holds settings for certificates from Let's Encrypt
+type AutocertConfig struct {
+	// Domains certificates are requested for; empty disables autocert
+	Domains []string
+	// CacheDir keeps the account key and certificates across restarts
+	CacheDir string
+	// Email is given to Let's Encrypt for expiry notices; optional
+	Email string
+	// HTTPAddr, e.g. :80, serves HTTP-01 challenges and redirects other
+	// requests to HTTPS; empty relies on TLS-ALPN-01
+	HTTPAddr string
+	// DirectoryURL is the ACME directory; empty means Let's Encrypt
+	DirectoryURL string
+}
+
+// newAutocertManager returns a manager obtaining and renewing certificates
+// for cfg's domains only
+func newAutocertManager(cfg AutocertConfig) (*autocert.Manager, error) {
+	if cfg.CacheDir == "" {
+		return nil, errors.New("a cache directory is required, or every restart requests new certificates")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m, nil
+}
+
+// configureTLS sets up server to serve HTTPS with the certificate files,
+// or with autocert if cfg has domains. It returns the HTTP-01 challenge
+// server to run alongside, if any.
+func configureTLS(server *http.Server, certFile, keyFile string, cfg AutocertConfig) (*http.Server, error) {
+	if len(cfg.Domains) > 0 && certFile != "" {
+		return nil, errors.New("--autocert-domains and --tls-cert are mutually exclusive")
+	}
+	// newHTTPServer has set up HTTP/2, so NextProtos already lists h2
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	if len(cfg.Domains) == 0 {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig.GetCertificate = reloader.GetCertificate
+		return nil, nil
+	}
+
+	m, err := newAutocertManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig.GetCertificate = m.GetCertificate
+	server.TLSConfig.NextProtos = append(server.TLSConfig.NextProtos, acme.ALPNProto)
+	if cfg.HTTPAddr == "" {
+		return nil, nil
+	}
+	if err := validateListenAddr(cfg.HTTPAddr); err != nil {
+		return nil, fmt.Errorf("invalid --autocert-http-addr %q: %w", cfg.HTTPAddr, err)
+	}
+	return &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: server.ReadHeaderTimeout,
+	}, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// writeTestCert writes a self-signed certificate for commonName and its
+// key to dir, returning their paths
+func writeTestCert(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// servedName returns the common name of the certificate c serves
+func servedName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, c); got != "first" {
+		t.Fatalf("serving %q, want first", got)
+	}
+
+	// A renewal is picked up at the next check
+	writeTestCert(t, dir, "renewed")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if got := servedName(t, c); got != "first" {
+		t.Errorf("serving %q before the check was due", got)
+	}
+	c.checked = time.Time{}
+	if got := servedName(t, c); got != "renewed" {
+		t.Errorf("serving %q after renewal, want renewed", got)
+	}
+
+	// A half-written renewal keeps the working pair
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	c.checked = time.Time{}
+	if got := servedName(t, c); got != "renewed" {
+		t.Errorf("serving %q after a bad reload, want renewed", got)
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("missing certificate accepted")
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "127.0.0.1")
+	server := newHTTPServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), time.Second, time.Second, time.Second)
+	challenge, err := configureTLS(server, certFile, keyFile, AutocertConfig{})
+	if err != nil || challenge != nil {
+		t.Fatalf("configureTLS = %v, %v", challenge, err)
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2 over TLS", resp.Proto)
+	}
+}
+
+func TestConfigureAutocert(t *testing.T) {
+	cfg := AutocertConfig{Domains: splitList(" sfu.example.com, ,sfu2.example.com"), CacheDir: t.TempDir(), HTTPAddr: ":80"}
+	if !slices.Equal(cfg.Domains, []string{"sfu.example.com", "sfu2.example.com"}) {
+		t.Errorf("domains = %q", cfg.Domains)
+	}
+	server := newHTTPServer(":443", http.NotFoundHandler(), time.Second, time.Second, time.Second)
+	challenge, err := configureTLS(server, "", "", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge == nil || challenge.Addr != ":80" {
+		t.Errorf("challenge server = %v, want one on :80", challenge)
+	}
+	if protos := server.TLSConfig.NextProtos; !slices.Contains(protos, "h2") || !slices.Contains(protos, acme.ALPNProto) {
+		t.Errorf("NextProtos = %v, want h2 and TLS-ALPN-01", protos)
+	}
+	// Only the configured domains get certificates
+	if _, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("certificate requested for a domain not configured")
+	}
+
+	for name, bad := range map[string]AutocertConfig{
+		"no cache": {Domains: []string{"sfu.example.com"}},
+		"bad addr": {Domains: []string{"sfu.example.com"}, CacheDir: t.TempDir(), HTTPAddr: "80"},
+	} {
+		if _, err := configureTLS(newHTTPServer(":443", http.NotFoundHandler(), time.Second, time.Second, time.Second), "", "", bad); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := configureTLS(server, "cert.pem", "key.pem", cfg); err == nil {
+		t.Error("autocert and certificate files accepted together")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans follow a join through the SFU: each SDP exchange continues the
+// caller's trace from its traceparent header, with child spans for applying
+// the offer, ICE gathering and the connection coming up. A forwarded track
+// can outlive its publish by hours, so its span starts a trace of its own
+// linked to the publish it came from.
+
+// tracerName names the instrumentation in exported spans
+const tracerName = "rubigo-signaling"
+
+// tracePropagator reads W3C trace context and baggage from request headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider returns a provider exporting spans over OTLP/HTTP to
+// endpoint, a traces URL such as http://collector:4318/v1/traces. An empty
+// endpoint falls back to the standard OTEL_EXPORTER_OTLP_* variables, and
+// with those unset too tracing is off and the provider is nil. Sampling
+// follows OTEL_TRACES_SAMPLER, recording every trace by default.
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not an http or https URL", endpoint)
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracerName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// traced wraps a room route in a server span named name, continuing the
+// trace in the request's headers. Responses of 500 and up mark the span
+// failed.
+func (s *Server) traced(name string, next func(w http.ResponseWriter, r *http.Request, roomID string)) func(w http.ResponseWriter, r *http.Request, roomID string) {
+	return func(w http.ResponseWriter, r *http.Request, roomID string) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("room.id", roomID),
+			))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(ctx), roomID)
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}
+}
+
+// tagPeer adds the peer an SDP exchange is for to the request's span
+func tagPeer(ctx context.Context, role, peerID string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("peer.role", role), attribute.String("peer.id", peerID))
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// connectSpan times a peer connection from its answer until it connects
+// or gives up
+type connectSpan struct {
+	span trace.Span
+	once sync.Once
+}
+
+// startConnectSpan starts the span for pc under the SDP exchange in ctx
+func (s *Server) startConnectSpan(ctx context.Context) *connectSpan {
+	_, span := s.tracer.Start(ctx, "webrtc.connect")
+	return &connectSpan{span: span}
+}
+
+// observe ends the span at the first state that settles the connection.
+// Call it from the connection's state change handler.
+func (c *connectSpan) observe(state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		c.once.Do(func() { c.span.End() })
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		c.once.Do(func() {
+			c.span.SetStatus(codes.Error, "connection "+state.String())
+			c.span.End()
+		})
+	}
+}
+
+// startForwardSpan starts the span covering forwarding one broadcaster
+// track, linked to the span of the publish whose connection carries it
+func (s *Server) startForwardSpan(room *Room, remote *webrtc.TrackRemote, publish trace.SpanContext) trace.Span {
+	_, span := s.tracer.Start(context.Background(), "rtp.forward",
+		trace.WithLinks(trace.Link{SpanContext: publish}),
+		trace.WithAttributes(
+			attribute.String("room.id", room.id),
+			attribute.String("track.kind", remote.Kind().String()),
+			attribute.String("track.codec", remote.Codec().MimeType),
+			attribute.String("track.rid", remote.RID()),
+		))
+	return span
+}
+
+// endForwardSpan ends a forwarding span with the traffic it carried. A
+// track ending with EOF is the broadcaster leaving, not a failure.
+func endForwardSpan(span trace.Span, packets, bytes int, err error) {
+	span.SetAttributes(attribute.Int("rtp.packets", packets), attribute.Int("rtp.bytes", bytes))
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	endSpan(span, err)
+}
+
+// tracerFor returns the tracer spans from cfg go to, the global one unless
+// cfg sets a provider
+func tracerFor(cfg Config) trace.Tracer {
+	if cfg.TracerProvider != nil {
+		return cfg.TracerProvider.Tracer(tracerName)
+	}
+	return otel.Tracer(tracerName)
+}
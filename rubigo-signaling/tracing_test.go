@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tp, err := newTracerProvider(context.Background(), ""); tp != nil || err != nil {
+		t.Errorf("no endpoint = %v, %v; want tracing off", tp, err)
+	}
+	for _, endpoint := range []string{"collector:4318", "grpc://collector:4317", "http://"} {
+		if _, err := newTracerProvider(context.Background(), endpoint); err == nil {
+			t.Errorf("endpoint %q accepted", endpoint)
+		}
+	}
+
+	tp, err := newTracerProvider(context.Background(), "http://127.0.0.1:4318/v1/traces")
+	if err != nil || tp == nil {
+		t.Fatalf("valid endpoint = %v, %v", tp, err)
+	}
+	tp.Shutdown(context.Background())
+
+	// The standard variables turn tracing on without the flag
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:4318")
+	tp, err = newTracerProvider(context.Background(), "")
+	if err != nil || tp == nil {
+		t.Fatalf("endpoint from environment = %v, %v", tp, err)
+	}
+	tp.Shutdown(context.Background())
+}
+
+// findSpan returns the ended span called name, or nil
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+// spanAttr returns the value of span's attribute key
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestPublishTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	cfg := DefaultConfig()
+	cfg.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	store := newFakeStore()
+	h := newServer(t, store, cfg).Handler()
+
+	client := newTestPC(t)
+	sending, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "screen", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTrack(sending); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	// The Next.js app's trace carries on into the SFU
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: client.LocalDescription().SDP})
+	req := httptest.NewRequest(http.MethodPost, "/internal/room/abc/publish", strings.NewReader(string(body)))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	publish := findSpan(recorder.Ended(), "publish")
+	if publish == nil {
+		t.Fatal("no publish span")
+	}
+	if got := publish.SpanContext().TraceID().String(); got != traceID || !publish.Parent().IsRemote() {
+		t.Errorf("publish span trace = %s, want the caller's %s", got, traceID)
+	}
+	if spanAttr(publish, "room.id").AsString() != "abc" || spanAttr(publish, "peer.role").AsString() != "broadcaster" {
+		t.Errorf("publish span attributes = %v", publish.Attributes())
+	}
+	for _, name := range []string{"sdp.negotiate", "ice.gathering"} {
+		child := findSpan(recorder.Ended(), name)
+		if child == nil || child.Parent().SpanID() != publish.SpanContext().SpanID() {
+			t.Errorf("%s span missing or not under publish", name)
+		}
+	}
+
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+	room := store.Get("abc")
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := uint16(0); room.GetBroadcasterTrack() == nil; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatal("broadcaster track never arrived")
+		}
+		sending.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Forwarding ends with the broadcast, in a trace of its own linked to
+	// the publish
+	room.Close()
+	var forward sdktrace.ReadOnlySpan
+	for forward == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no rtp.forward span after the broadcast ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+		forward = findSpan(recorder.Ended(), "rtp.forward")
+	}
+	if links := forward.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != publish.SpanContext().SpanID() {
+		t.Errorf("rtp.forward links = %v, want the publish span", forward.Links())
+	}
+	if forward.Status().Code == codes.Error || spanAttr(forward, "rtp.packets").AsInt64() == 0 {
+		t.Errorf("rtp.forward status = %v, packets = %d", forward.Status(), spanAttr(forward, "rtp.packets").AsInt64())
+	}
+}
+
+func TestTracedStatus(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	cfg := DefaultConfig()
+	cfg.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := newServer(t, newFakeStore(), cfg)
+
+	handler := s.traced("test", func(w http.ResponseWriter, r *http.Request, roomID string) {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "boom")
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/internal/room/abc/test", nil), "abc")
+	if span := findSpan(recorder.Ended(), "test"); span == nil || span.Status().Code != codes.Error || spanAttr(span, "http.response.status_code").AsInt64() != 500 {
+		t.Errorf("span for a 500 = %v", span)
+	}
+
+	// Client errors are the caller's, not the SFU's
+	rec := doRequest(t, s.Handler(), http.MethodPost, "/internal/room/missing/subscribe", `{"type":"offer","sdp":""}`)
+	span := findSpan(recorder.Ended(), "subscribe")
+	if rec.Code != http.StatusNotFound || span == nil || span.Status().Code == codes.Error {
+		t.Errorf("span for a %d = %v", rec.Code, span)
+	}
+}
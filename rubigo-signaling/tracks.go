@@ -0,0 +1,356 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A broadcaster may send more than one video track, e.g. a camera overlay
+// next to its screen. The video transceiver publish sets up carries the
+// main track and its simulcast layers; any further video track is an extra
+// track, forwarded as is. Co-presenters' tracks, video and audio, are
+// forwarded the same way. Viewers get them in their subscribe answer if
+// the offer has media sections to spare, and by renegotiation otherwise.
+
+// defaultMainLabel labels the main video track unless the broadcaster
+// names it
+const defaultMainLabel = "screen"
+
+// hostStreamID is the msid stream of the broadcaster's tracks. Each
+// co-presenter's tracks are in a stream named after its peer ID.
+const hostStreamID = "screen-share"
+
+// trackKey identifies a published track by who publishes it and its label.
+// peerID is a co-presenter's ID, or empty for the room's broadcaster, whose
+// tracks outlive any one of its connections.
+type trackKey struct {
+	peerID  string
+	trackID string
+}
+
+// streamID is the msid stream viewers see the track in
+func (k trackKey) streamID() string {
+	if k.peerID == "" {
+		return hostStreamID
+	}
+	return k.peerID
+}
+
+// TrackInfo describes a forwarded track in room status, subscribe answers
+// and renegotiate offers, so clients can tell the screen from the camera
+// and one presenter from another
+type TrackInfo struct {
+	Label string `json:"label"`
+	Kind  string `json:"kind"`
+	Codec string `json:"codec,omitempty"`
+	// Mid is the track's media section in the viewer's session
+	Mid string `json:"mid,omitempty"`
+	// PeerID is the co-presenter publishing the track, empty for the
+	// broadcaster; StreamID is the msid stream it arrives in
+	PeerID   string `json:"peerId,omitempty"`
+	StreamID string `json:"streamId,omitempty"`
+}
+
+// extraSender is a viewer's sender for one published track
+type extraSender struct {
+	track  *forwardingTrack
+	sender *webrtc.RTPSender
+}
+
+// SetTrackLabels records the broadcaster's labels for its media sections,
+// keyed by mid. Labels from a renegotiate offer are added to those from
+// publish.
+func (r *Room) SetTrackLabels(labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for mid, label := range labels {
+		if r.trackLabels == nil {
+			r.trackLabels = make(map[string]string)
+		}
+		r.trackLabels[mid] = label
+	}
+}
+
+// labelTrack returns the label for the broadcaster's track in media section
+// mid. Unlabeled extra tracks are named after their mid. For the main track
+// the label is also what status reports.
+func (r *Room) labelTrack(mid string, main bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	label := r.trackLabels[mid]
+	if label == "" {
+		if main {
+			label = defaultMainLabel
+		} else {
+			label = "video-" + mid
+		}
+	}
+	if main {
+		r.mainLabel = label
+	}
+	return label
+}
+
+// MainLabel returns the label of the main video track
+func (r *Room) MainLabel() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mainLabel == "" {
+		return defaultMainLabel
+	}
+	return r.mainLabel
+}
+
+// AttachPublishedSource is AttachBroadcasterSource for an extra track of
+// the broadcaster or a co-presenter's track, published under key. Like
+// audio, these tracks don't decide whether the broadcast is live, so no
+// events are published. It fails with errBroadcasterReplaced unless from is
+// the publisher's current connection.
+func (r *Room) AttachPublishedSource(from *webrtc.PeerConnection, key trackKey, remote *webrtc.TrackRemote) (*forwardingTrack, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.publisherPCLocked(key.peerID) != from {
+		return nil, false, errBroadcasterReplaced
+	}
+
+	codec := remote.Codec().RTPCodecCapability
+	if existing := r.published[key]; existing != nil && strings.EqualFold(existing.Codec().MimeType, codec.MimeType) {
+		existing.SetSource(remote)
+		return existing, true, nil
+	}
+	track, err := newStreamTrack(codec, key.trackID, key.streamID())
+	if err != nil {
+		return nil, false, err
+	}
+	track.SetSource(remote)
+	if r.history > 0 && track.Kind() == webrtc.RTPCodecTypeVideo {
+		track.keepHistory(r.history)
+	}
+	if r.published == nil {
+		r.published = make(map[trackKey]*forwardingTrack)
+	}
+	r.published[key] = track
+	return track, false, nil
+}
+
+// clearPublishedLocked detaches remote from the published track it feeds,
+// if any. The caller must hold r.mu.
+func (r *Room) clearPublishedLocked(remote *webrtc.TrackRemote) {
+	for _, track := range r.published {
+		if track.ClearSource(remote) {
+			return
+		}
+	}
+}
+
+// PublishedTracks returns the extra and co-presenter tracks being fed
+func (r *Room) PublishedTracks() map[trackKey]*forwardingTrack {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	live := make(map[trackKey]*forwardingTrack)
+	for key, track := range r.published {
+		if track.Source() != nil {
+			live[key] = track
+		}
+	}
+	return live
+}
+
+// publishedKey returns the key of track if it is an extra or co-presenter
+// track
+func (r *Room) publishedKey(track *forwardingTrack) (trackKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key, published := range r.published {
+		if published == track {
+			return key, true
+		}
+	}
+	return trackKey{}, false
+}
+
+// sortedTrackKeys orders tracks by publisher, the broadcaster first, then
+// by label
+func sortedTrackKeys(tracks map[trackKey]*forwardingTrack) []trackKey {
+	keys := make([]trackKey, 0, len(tracks))
+	for key := range tracks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].peerID != keys[j].peerID {
+			return keys[i].peerID < keys[j].peerID
+		}
+		return keys[i].trackID < keys[j].trackID
+	})
+	return keys
+}
+
+// publishedInfo describes track, published under key
+func publishedInfo(key trackKey, track *forwardingTrack) TrackInfo {
+	return TrackInfo{
+		Label:    key.trackID,
+		Kind:     track.Kind().String(),
+		Codec:    track.Codec().MimeType,
+		PeerID:   key.peerID,
+		StreamID: key.streamID(),
+	}
+}
+
+// Tracks lists the live tracks: the main video, then audio, then extra
+// tracks by label, then co-presenters' tracks by peer ID and label
+func (r *Room) Tracks() []TrackInfo {
+	var tracks []TrackInfo
+	if track := r.GetBroadcasterTrack(); track != nil {
+		tracks = append(tracks, TrackInfo{Label: r.MainLabel(), Kind: "video", Codec: track.Codec().MimeType, StreamID: hostStreamID})
+	}
+	if audio := r.AudioTrack(); audio != nil {
+		tracks = append(tracks, TrackInfo{Label: "audio", Kind: "audio", Codec: audio.Codec().MimeType, StreamID: hostStreamID})
+	}
+	published := r.PublishedTracks()
+	for _, key := range sortedTrackKeys(published) {
+		tracks = append(tracks, publishedInfo(key, published[key]))
+	}
+	return tracks
+}
+
+// addExtra is addAudio for the published track with key. onKeyframe is
+// called when the viewer asks for a keyframe on it.
+func (v *viewer) addExtra(key trackKey, track *forwardingTrack, onKeyframe func()) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	existing, ok := v.extras[key]
+	if ok && existing.track == track {
+		return false, nil
+	}
+
+	if ok {
+		// The publisher came back with a different track under key
+		if !v.paused {
+			if err := existing.sender.ReplaceTrack(track); err != nil {
+				return false, err
+			}
+		}
+		v.extras[key] = extraSender{track: track, sender: existing.sender}
+		return false, nil
+	}
+
+	sender, err := v.pc.AddTrack(track)
+	if err != nil {
+		return false, err
+	}
+	if v.paused {
+		if err := sender.ReplaceTrack(nil); err != nil {
+			return false, err
+		}
+	}
+	go readRTCP(sender, track, onKeyframe)
+	if v.extras == nil {
+		v.extras = make(map[trackKey]extraSender)
+	}
+	v.extras[key] = extraSender{track: track, sender: sender}
+	return true, nil
+}
+
+// addPublishedSenders adds senders to a subscribing viewer's pc for the
+// room's extra and co-presenter tracks, as many as offer has unused media
+// sections for; the main video, and audio if hasAudio, take the first of
+// each kind. The rest are left for offerTracks.
+func addPublishedSenders(pc *webrtc.PeerConnection, room *Room, offer string, hasAudio bool) (map[trackKey]extraSender, error) {
+	free := make(map[webrtc.RTPCodecType]int)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		n, err := offeredSections(offer, kind)
+		if err != nil {
+			return nil, err
+		}
+		free[kind] = n
+	}
+	free[webrtc.RTPCodecTypeVideo]--
+	if hasAudio {
+		free[webrtc.RTPCodecTypeAudio]--
+	}
+
+	published := room.PublishedTracks()
+	extras := make(map[trackKey]extraSender)
+	for _, key := range sortedTrackKeys(published) {
+		track := published[key]
+		if free[track.Kind()] <= 0 {
+			continue
+		}
+		if ok, _, _ := offerSupportsCodec(offer, track.Codec().MimeType); !ok {
+			continue
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			return nil, err
+		}
+		go readRTCP(sender, track, publishedKeyframeRequester(room, track))
+		extras[key] = extraSender{track: track, sender: sender}
+		free[track.Kind()]--
+	}
+	return extras, nil
+}
+
+// trackInfos labels the viewer's senders with their media sections in the
+// current local description
+func (v *viewer) trackInfos() []TrackInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	tracks := []TrackInfo{{Label: v.label, Kind: "video", Codec: v.track.Codec().MimeType, Mid: senderMid(v.pc, v.sender), StreamID: hostStreamID}}
+	if v.audioSender != nil {
+		tracks = append(tracks, TrackInfo{Label: "audio", Kind: "audio", Codec: v.audio.Codec().MimeType, Mid: senderMid(v.pc, v.audioSender), StreamID: hostStreamID})
+	}
+	published := make(map[trackKey]*forwardingTrack, len(v.extras))
+	for key, extra := range v.extras {
+		published[key] = extra.track
+	}
+	for _, key := range sortedTrackKeys(published) {
+		info := publishedInfo(key, published[key])
+		info.Mid = senderMid(v.pc, v.extras[key].sender)
+		tracks = append(tracks, info)
+	}
+	return tracks
+}
+
+// senderMid returns the mid of sender's transceiver, or "" before it is
+// negotiated
+func senderMid(pc *webrtc.PeerConnection, sender *webrtc.RTPSender) string {
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() == sender {
+			return t.Mid()
+		}
+	}
+	return ""
+}
+
+// transceiverFor returns the transceiver of receiver on pc, or nil
+func transceiverFor(pc *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) *webrtc.RTPTransceiver {
+	for _, t := range pc.GetTransceivers() {
+		if t.Receiver() == receiver {
+			return t
+		}
+	}
+	return nil
+}
+
+// attachExtraTrack forwards an extra video track from the broadcaster on pc,
+// published in publishSpan, and offers it to the viewers already watching
+func (s *Server) attachExtraTrack(room *Room, pc *webrtc.PeerConnection, mid string, remote *webrtc.TrackRemote, publishSpan trace.SpanContext) {
+	label := room.labelTrack(mid, false)
+	local, reused, err := room.AttachPublishedSource(pc, trackKey{trackID: label}, remote)
+	if err != nil {
+		room.broadcasterLog().Error("Failed to attach extra track", "track", label, "err", err)
+		return
+	}
+	if reused {
+		room.broadcasterLog().Info("Broadcaster resumed extra track", "track", label)
+	} else {
+		room.broadcasterLog().Info("Broadcaster added extra track", "track", label)
+	}
+
+	go s.forwardBroadcasterTrack(room, remote, local, publishSpan)
+	go offerTracksToViewers(room)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRoomExtraTracks(t *testing.T) {
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	room.SetTrackLabels(map[string]string{"1": "camera"})
+	if label := room.labelTrack("0", true); label != defaultMainLabel {
+		t.Errorf("unlabeled main track = %q, want %q", label, defaultMainLabel)
+	}
+	if label := room.labelTrack("1", false); label != "camera" {
+		t.Errorf("labeled extra track = %q, want camera", label)
+	}
+	if label := room.labelTrack("2", false); label != "video-2" {
+		t.Errorf("unlabeled extra track = %q, want video-2", label)
+	}
+
+	remote := &webrtc.TrackRemote{}
+	camera, _, err := room.AttachPublishedSource(nil, trackKey{trackID: "camera"}, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if camera.ID() != "camera" || camera.StreamID() != hostStreamID {
+		t.Errorf("extra track msid = %q %q, want the broadcaster's stream and its label", camera.StreamID(), camera.ID())
+	}
+	tracks := room.Tracks()
+	if len(tracks) != 2 || tracks[0].Label != "screen" || tracks[1].Label != "camera" {
+		t.Errorf("Tracks = %+v, want screen then camera", tracks)
+	}
+
+	// The camera going away leaves the broadcast live
+	room.DetachBroadcasterSource(remote)
+	if room.GetBroadcasterTrack() == nil {
+		t.Error("detaching the extra track ended the main track")
+	}
+	if len(room.PublishedTracks()) != 0 {
+		t.Error("extra track still live after detach")
+	}
+	if again, reused, err := room.AttachPublishedSource(nil, trackKey{trackID: "camera"}, &webrtc.TrackRemote{}); err != nil || !reused || again != camera {
+		t.Errorf("reattach = %p, %t, %v; want the existing track reused", again, reused, err)
+	}
+}
+
+func TestViewerAddExtraRenegotiates(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, control, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	track := newLiveTrack(t)
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiate(t, client, pc)
+	v := &viewer{id: "v1", pc: pc, control: control, sender: sender, track: track, label: "screen"}
+
+	camera, err := newLabeledTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "camera")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := trackKey{trackID: "camera"}
+	if added, err := v.addExtra(key, camera, nil); err != nil || !added {
+		t.Fatalf("addExtra = %t, %v; want new sender", added, err)
+	}
+	if added, _ := v.addExtra(key, camera, nil); added {
+		t.Error("second addExtra added another sender")
+	}
+	if err := v.offer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := answerViewer(t, v, client); err != nil {
+		t.Fatalf("applyAnswer: %v", err)
+	}
+
+	tracks := v.trackInfos()
+	if len(tracks) != 2 || tracks[0].Label != "screen" || tracks[1].Label != "camera" {
+		t.Fatalf("trackInfos = %+v, want screen then camera", tracks)
+	}
+	if tracks[0].Mid == "" || tracks[1].Mid == "" || tracks[0].Mid == tracks[1].Mid {
+		t.Errorf("trackInfos mids = %q, %q; want two distinct media sections", tracks[0].Mid, tracks[1].Mid)
+	}
+
+	if err := v.setPaused(true); err != nil {
+		t.Fatal(err)
+	}
+	if v.extras[key].sender.Track() != nil {
+		t.Error("paused viewer still has a track on its extra sender")
+	}
+}
+
+func TestPublishScreenAndCamera(t *testing.T) {
+	store := newFakeStore("abc")
+	h := newTestServer(t, store)
+
+	broadcaster, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broadcaster.Close()
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	names := []string{"screen", "camera"}
+	var sending []*webrtc.TrackLocalStaticRTP
+	for _, name := range names {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, name, "broadcast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := broadcaster.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+		sending = append(sending, track)
+	}
+
+	offer, err := broadcaster.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(broadcaster)
+	if err := broadcaster.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	labels := make(map[string]string)
+	for i, tr := range broadcaster.GetTransceivers() {
+		labels[tr.Mid()] = names[i]
+	}
+	body, _ := json.Marshal(SDPExchange{Type: "offer", SDP: broadcaster.LocalDescription().SDP, TrackLabels: labels})
+	rec := doRequest(t, h, http.MethodPost, "/internal/room/abc/publish", string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var answer SDPExchange
+	if err := json.NewDecoder(rec.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := broadcaster.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.SDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tracks only arrive with their first packets
+	room := store.Get("abc")
+	deadline := time.Now().Add(5 * time.Second)
+	for seq := uint16(0); len(room.Tracks()) < 2; seq++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("Tracks = %+v, want screen and camera", room.Tracks())
+		}
+		for _, track := range sending {
+			track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq}, Payload: []byte{0x10, 0, 0}})
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := decodeBody(t, doRequest(t, h, http.MethodGet, "/internal/room/abc/status", ""))
+	tracks, _ := status["tracks"].([]interface{})
+	if len(tracks) != 2 {
+		t.Fatalf("status tracks = %v, want 2", status["tracks"])
+	}
+	for i, want := range names {
+		if label := tracks[i].(map[string]interface{})["label"]; label != want {
+			t.Errorf("status track %d label = %v, want %s", i, label, want)
+		}
+	}
+}
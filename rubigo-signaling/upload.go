@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording upload tuning
+const (
+	uploadQueueSize   = 64
+	uploadMaxAttempts = 3
+	uploadRetryDelay  = 2 * time.Second
+	uploadTimeout     = 30 * time.Minute
+)
+
+// UploadConfig is the S3-compatible storage finished recording files are
+// uploaded to. Uploads are off unless Bucket is set.
+type UploadConfig struct {
+	// Endpoint is the S3 API's base URL, e.g. http://minio:9000; empty
+	// means AWS S3 in Region. Buckets are addressed path-style.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix starts every object key; keys are {prefix}{roomId}/{file}
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Retention is how long uploaded files stay on disk: zero deletes
+	// them once uploaded and a negative value keeps them
+	Retention time.Duration
+}
+
+// endpoint returns the S3 API base URL
+func (c UploadConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return strings.TrimSuffix(c.Endpoint, "/")
+	}
+	return "https://s3." + c.Region + ".amazonaws.com"
+}
+
+func (c UploadConfig) validate() error {
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return errors.New("access key and secret key are required")
+	}
+	if c.Region == "" {
+		return errors.New("region is required")
+	}
+	u, err := url.Parse(c.endpoint())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+	return nil
+}
+
+// uploadJob is a finished recording file
+type uploadJob struct {
+	roomID string
+	path   string
+}
+
+// recordingUploader uploads finished recording files from a background
+// worker, one at a time, and reports each upload to the webhook
+type recordingUploader struct {
+	cfg        UploadConfig
+	client     *http.Client
+	webhook    *webhookNotifier
+	retryDelay time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan uploadJob
+	done   sync.WaitGroup
+}
+
+func newRecordingUploader(cfg UploadConfig, webhook *webhookNotifier) (*recordingUploader, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	u := &recordingUploader{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: uploadTimeout},
+		webhook:    webhook,
+		retryDelay: uploadRetryDelay,
+		queue:      make(chan uploadJob, uploadQueueSize),
+	}
+	u.done.Add(1)
+	go u.run()
+	return u, nil
+}
+
+// Enqueue queues a finished file for upload. It is a no-op on a nil
+// uploader; if the queue is full the file is left on disk.
+func (u *recordingUploader) Enqueue(roomID, path string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		roomLog(roomID).Warn("Uploader stopped, leaving recording on disk", "file", path)
+		return
+	}
+	select {
+	case u.queue <- uploadJob{roomID: roomID, path: path}:
+	default:
+		roomLog(roomID).Warn("Upload queue full, leaving recording on disk", "file", path)
+	}
+}
+
+// Close stops accepting files and waits for queued ones to be uploaded
+func (u *recordingUploader) Close() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	if !u.closed {
+		u.closed = true
+		close(u.queue)
+	}
+	u.mu.Unlock()
+	u.done.Wait()
+}
+
+func (u *recordingUploader) run() {
+	defer u.done.Done()
+	for job := range u.queue {
+		u.process(job)
+	}
+}
+
+// process uploads one file, reports the outcome and applies the retention
+// policy. Files that fail to upload are kept.
+func (u *recordingUploader) process(job uploadJob) {
+	objectURL, err := u.upload(job)
+	if err != nil {
+		roomLog(job.roomID).Error("Recording upload failed", "file", job.path, "err", err)
+		u.webhook.Notify(WebhookEvent{Type: "recording_upload_failed", RoomID: job.roomID, File: filepath.Base(job.path), Error: err.Error()})
+		return
+	}
+	roomLog(job.roomID).Info("Uploaded recording", "file", job.path, "url", objectURL)
+	u.webhook.Notify(WebhookEvent{Type: "recording_uploaded", RoomID: job.roomID, File: filepath.Base(job.path), URL: objectURL})
+
+	switch {
+	case u.cfg.Retention == 0:
+		removeRecording(job)
+	case u.cfg.Retention > 0:
+		time.AfterFunc(u.cfg.Retention, func() { removeRecording(job) })
+	}
+}
+
+func removeRecording(job uploadJob) {
+	if err := os.Remove(job.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		roomLog(job.roomID).Error("Failed to remove uploaded recording", "file", job.path, "err", err)
+	}
+}
+
+// objectURL returns the URL of the object a file of roomID is stored as
+func (u *recordingUploader) objectURL(roomID, file string) string {
+	key := path.Join(u.cfg.Prefix, roomID, filepath.Base(file))
+	return u.cfg.endpoint() + "/" + s3EscapePath(u.cfg.Bucket+"/"+key)
+}
+
+// upload PUTs the file, retrying with backoff up to uploadMaxAttempts, and
+// returns the object's URL
+func (u *recordingUploader) upload(job uploadJob) (string, error) {
+	f, err := os.Open(job.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	objectURL := u.objectURL(job.roomID, job.path)
+	delay := u.retryDelay
+	for attempt := 1; attempt <= uploadMaxAttempts; attempt++ {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if err = u.put(objectURL, f, size, payloadHash); err == nil {
+			return objectURL, nil
+		}
+		if attempt < uploadMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return "", fmt.Errorf("%w (after %d attempts)", err, uploadMaxAttempts)
+}
+
+func (u *recordingUploader) put(objectURL string, body io.Reader, size int64, payloadHash string) error {
+	// The client closes request bodies, and the file is reused on retry
+	req, err := http.NewRequest(http.MethodPut, objectURL, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "video/webm")
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signS3Request(req, u.cfg.AccessKey, u.cfg.SecretKey, u.cfg.Region, payloadHash, time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// signS3Request signs req with AWS Signature Version 4 for S3, covering
+// the host and any content type, range and x-amz-* headers already set.
+// Requests have no query string.
+func signS3Request(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes p as S3 canonical URIs are, keeping only
+// unreserved characters and slashes
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+)
+
+// Viewer registration errors
+var (
+	errViewerNotFound = errors.New("viewer not found")
+	errViewerExists   = errors.New("viewer ID already in use")
+	errViewerBanned   = errors.New("viewer is banned from this room")
+	errRoomFull       = errors.New("room is full")
+)
+
+// Control message sent to a viewer removed by the host
+const controlKicked = "kicked"
+
+// validViewerID reports whether id is usable as a client-chosen viewer ID.
+// IDs appear in URL paths, so they are limited to URL-safe characters.
+func validViewerID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// viewer is a subscriber's connection and the track it receives
+type viewer struct {
+	id      string
+	pc      *webrtc.PeerConnection
+	control *webrtc.DataChannel
+	sender  *webrtc.RTPSender
+	track   *forwardingTrack
+	label   string // of track, for the client
+	// simulcast is the viewer's own video track when the broadcaster
+	// simulcasts, relaying the layer in track, which then changes under
+	// both the room's lock and mu; nil otherwise
+	simulcast *simulcastTrack
+	// bwe estimates the viewer's bandwidth from its TWCC feedback; nil if
+	// it didn't negotiate TWCC, in which case remb holds its latest REMB
+	bwe  cc.BandwidthEstimator
+	remb atomic.Uint64
+	// maxBitrate is the video bandwidth the viewer's offer asked for, in
+	// bits per second; zero if it set none
+	maxBitrate float64
+	// forwardNACKs passes the viewer's NACKs to the broadcaster, when the
+	// SFU doesn't answer them itself
+	forwardNACKs bool
+
+	// mu serializes pause/resume and renegotiation so the senders' tracks
+	// match paused
+	mu          sync.Mutex
+	paused      bool
+	audio       *forwardingTrack // nil until audio is added
+	audioSender *webrtc.RTPSender
+	negotiating bool // an SFU offer awaits the viewer's answer
+	renegotiate bool // another offer is due once it is answered
+	autoLayer   bool // the simulcast layer follows the viewer's bandwidth
+	adapter     layerAdapter
+
+	// extras are the broadcaster's further video tracks and co-presenters'
+	// tracks
+	extras map[trackKey]extraSender
+}
+
+// randomHex returns n random bytes from crypto/rand, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newPeerID returns a random identifier for a broadcaster or viewer
+func newPeerID() string {
+	return randomHex(8)
+}
+
+// setPaused stops or restarts RTP to the viewer. Pausing detaches the
+// forwarding track from the viewer's sender; the connection stays up, so
+// resuming only rebinds the track.
+func (v *viewer) setPaused(paused bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.paused == paused {
+		return nil
+	}
+
+	var track, audio webrtc.TrackLocal
+	if !paused {
+		track = v.videoTrack()
+		if v.audio != nil {
+			audio = v.audio
+		}
+	}
+	if err := v.sender.ReplaceTrack(track); err != nil {
+		return err
+	}
+	if v.audioSender != nil {
+		if err := v.audioSender.ReplaceTrack(audio); err != nil {
+			return err
+		}
+	}
+	for _, extra := range v.extras {
+		var track webrtc.TrackLocal
+		if !paused {
+			track = extra.track
+		}
+		if err := extra.sender.ReplaceTrack(track); err != nil {
+			return err
+		}
+	}
+	v.paused = paused
+	return nil
+}
+
+// videoTrack is what the viewer's video sender sends: its own simulcast
+// track, or else the room's track
+func (v *viewer) videoTrack() webrtc.TrackLocal {
+	if v.simulcast != nil {
+		return v.simulcast
+	}
+	return v.track
+}
+
+// Paused reports whether forwarding to the viewer is paused
+func (v *viewer) Paused() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.paused
+}
+
+// Viewer returns the viewer with id, or nil if there is none
+func (r *Room) Viewer(id string) *viewer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.viewers[id]
+}
+
+// SetViewerPaused pauses or resumes forwarding to the viewer with id
+func (r *Room) SetViewerPaused(id string, paused bool) error {
+	v := r.Viewer(id)
+	if v == nil {
+		return errViewerNotFound
+	}
+	if err := v.setPaused(paused); err != nil {
+		return err
+	}
+	state := "resumed"
+	if paused {
+		state = "paused"
+	}
+	r.viewerLog(id).Info("Viewer " + state)
+	return nil
+}
+
+// KickViewer closes the viewer with id and removes it from the room. With
+// ban set, the ID is also refused by later subscribes to this room. The
+// viewer_left event is followed by viewer_kicked, so moderators' views can
+// tell a kick from the viewer leaving.
+func (r *Room) KickViewer(id string, ban bool) error {
+	r.mu.Lock()
+	v := r.viewers[id]
+	if v != nil && ban {
+		if r.banned == nil {
+			r.banned = make(map[string]struct{})
+		}
+		r.banned[id] = struct{}{}
+	}
+	if v != nil {
+		r.revokeReconnectLocked(id)
+	}
+	r.mu.Unlock()
+	if v == nil {
+		return errViewerNotFound
+	}
+
+	r.viewerLog(id).Info("Viewer kicked", "banned", ban)
+	sendControlMessage(v.control, controlMessage{Type: controlKicked})
+	r.RemoveViewer(id)
+	if v.pc != nil {
+		v.pc.Close()
+	}
+	r.publishRoomEvent(RoomEvent{Type: EventViewerKicked, ViewerID: id, Banned: ban})
+	return nil
+}
+
+// ViewerBanned reports whether id has been banned from the room
+func (r *Room) ViewerBanned(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, banned := r.banned[id]
+	return banned
+}
+
+// viewerRoute is an action under /internal/room/{id}/viewer/{viewerId}/
+type viewerRoute struct {
+	methods []string
+	handler func(w http.ResponseWriter, r *http.Request, roomID, viewerID string)
+}
+
+// viewerActionRoutes maps each per-viewer action to its route. The empty
+// action is the viewer itself.
+func (s *Server) viewerActionRoutes() map[string]viewerRoute {
+	return map[string]viewerRoute{
+		"":       {[]string{http.MethodDelete}, s.handleViewerKick},
+		"pause":  {[]string{http.MethodPost}, s.handleViewerPause},
+		"resume": {[]string{http.MethodPost}, s.handleViewerResume},
+		"answer": {[]string{http.MethodPost}, s.handleViewerAnswer},
+		"layer":  {[]string{http.MethodPost}, s.handleViewerLayer},
+	}
+}
+
+// handleViewerKick handles DELETE /internal/room/{id}/viewer/{viewerId}
+// ?ban=true also bans the viewer ID from rejoining the room
+func (s *Server) handleViewerKick(w http.ResponseWriter, r *http.Request, roomID, viewerID string) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+
+	ban := r.URL.Query().Get("ban") == "true"
+	if err := room.KickViewer(viewerID, ban); err != nil {
+		writeError(w, http.StatusNotFound, errCodeViewerNotFound, "Viewer not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "removed",
+		"roomId":   roomID,
+		"viewerId": viewerID,
+		"banned":   ban,
+	})
+}
+
+// handleViewerPause handles POST /internal/room/{id}/viewer/{viewerId}/pause
+func (s *Server) handleViewerPause(w http.ResponseWriter, r *http.Request, roomID, viewerID string) {
+	s.setViewerPaused(w, roomID, viewerID, true)
+}
+
+// handleViewerResume handles POST /internal/room/{id}/viewer/{viewerId}/resume
+func (s *Server) handleViewerResume(w http.ResponseWriter, r *http.Request, roomID, viewerID string) {
+	s.setViewerPaused(w, roomID, viewerID, false)
+}
+
+func (s *Server) setViewerPaused(w http.ResponseWriter, roomID, viewerID string, paused bool) {
+	room := s.rooms.Get(roomID)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errCodeRoomNotFound, "Room not found")
+		return
+	}
+
+	if err := room.SetViewerPaused(viewerID, paused); err != nil {
+		if errors.Is(err, errViewerNotFound) {
+			writeError(w, http.StatusNotFound, errCodeViewerNotFound, "Viewer not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to update viewer: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roomId":   roomID,
+		"viewerId": viewerID,
+		"paused":   paused,
+	})
+}
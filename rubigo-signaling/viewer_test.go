@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRoomSetViewerPaused(t *testing.T) {
+	factory, err := newPeerFactory(PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer factory.Close()
+	pc, control, err := factory.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	track := newLiveTrack(t)
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &Room{id: "abc"}
+	v := &viewer{pc: pc, control: control, sender: sender, track: track}
+	if err := room.AddViewer(v); err != nil {
+		t.Fatal(err)
+	}
+	if v.id == "" || room.Viewer(v.id) != v {
+		t.Fatalf("viewer not registered under its ID %q", v.id)
+	}
+
+	if err := room.SetViewerPaused(v.id, true); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	if !v.Paused() || sender.Track() != nil {
+		t.Error("paused viewer still has a track on its sender")
+	}
+
+	if err := room.SetViewerPaused(v.id, false); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if v.Paused() || sender.Track() != track {
+		t.Error("resumed viewer's sender is not back on the forwarding track")
+	}
+
+	if err := room.SetViewerPaused("missing", true); !errors.Is(err, errViewerNotFound) {
+		t.Errorf("pause unknown viewer = %v, want errViewerNotFound", err)
+	}
+}
+
+func TestRoomRemoveViewer(t *testing.T) {
+	room := &Room{id: "abc"}
+	v := &viewer{track: newLiveTrack(t)}
+	if err := room.AddViewer(v); err != nil {
+		t.Fatal(err)
+	}
+
+	room.RemoveViewer("missing")
+	if n := room.ViewerCount(); n != 1 {
+		t.Fatalf("ViewerCount after removing unknown ID = %d, want 1", n)
+	}
+	room.RemoveViewer(v.id)
+	if n := room.ViewerCount(); n != 0 {
+		t.Errorf("ViewerCount = %d, want 0", n)
+	}
+}
+
+func TestViewerRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"unknown room", http.MethodPost, "/internal/room/nope/viewer/v1/pause", http.StatusNotFound},
+		{"unknown viewer", http.MethodPost, "/internal/room/abc/viewer/v1/pause", http.StatusNotFound},
+		{"unknown viewer resume", http.MethodPost, "/internal/room/abc/viewer/v1/resume", http.StatusNotFound},
+		{"unknown viewer action", http.MethodPost, "/internal/room/abc/viewer/v1/bogus", http.StatusNotFound},
+		{"POST to viewer", http.MethodPost, "/internal/room/abc/viewer/v1", http.StatusMethodNotAllowed},
+		{"kick unknown viewer", http.MethodDelete, "/internal/room/abc/viewer/v1", http.StatusNotFound},
+		{"kick in unknown room", http.MethodDelete, "/internal/room/nope/viewer/v1", http.StatusNotFound},
+		{"missing viewer", http.MethodDelete, "/internal/room/abc/viewer", http.StatusNotFound},
+		{"wrong method", http.MethodGet, "/internal/room/abc/viewer/v1/pause", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, newTestServer(t, newFakeStore("abc")), tt.method, tt.path, "")
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoomKickViewer(t *testing.T) {
+	room := &Room{id: "abc"}
+	track := newLiveTrack(t)
+	for _, id := range []string{"alice", "bob"} {
+		if err := room.AddViewer(&viewer{id: id, track: track}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.AddViewer(&viewer{id: "alice", track: track}); !errors.Is(err, errViewerExists) {
+		t.Errorf("duplicate AddViewer = %v, want errViewerExists", err)
+	}
+
+	if err := room.KickViewer("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if room.Viewer("alice") != nil || room.ViewerCount() != 1 {
+		t.Error("kicked viewer still in room")
+	}
+	// A kick without ban lets the viewer back in
+	if err := room.AddViewer(&viewer{id: "alice", track: track}); err != nil {
+		t.Errorf("rejoin after kick = %v", err)
+	}
+
+	if err := room.KickViewer("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if !room.ViewerBanned("bob") {
+		t.Error("banned viewer not recorded")
+	}
+	if err := room.AddViewer(&viewer{id: "bob", track: track}); !errors.Is(err, errViewerBanned) {
+		t.Errorf("rejoin after ban = %v, want errViewerBanned", err)
+	}
+
+	if err := room.KickViewer("carol", true); !errors.Is(err, errViewerNotFound) {
+		t.Errorf("kick unknown = %v, want errViewerNotFound", err)
+	}
+	if room.ViewerBanned("carol") {
+		t.Error("unknown viewer banned")
+	}
+}
+
+func TestKickViewerEvents(t *testing.T) {
+	room := &Room{id: "abc"}
+	track := newLiveTrack(t)
+	if err := room.AddViewer(&viewer{id: "alice", track: track}); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := room.SubscribeEvents()
+	defer cancel()
+
+	if err := room.KickViewer("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	left, kicked := <-events, <-events
+	if left.Type != EventViewerLeft || left.ViewerID != "alice" {
+		t.Errorf("first event = %+v, want alice's viewer_left", left)
+	}
+	if kicked.Type != EventViewerKicked || kicked.ViewerID != "alice" || !kicked.Banned || kicked.ViewerCount != 0 {
+		t.Errorf("second event = %+v, want alice's viewer_kicked with the ban", kicked)
+	}
+}
+
+func TestKickViewerEndpoint(t *testing.T) {
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	if err := room.AddViewer(&viewer{id: "bob", track: room.GetBroadcasterTrack()}); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, store)
+
+	rec := doRequest(t, h, http.MethodDelete, "/internal/room/abc/viewer/bob?ban=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if body := decodeBody(t, rec); body["banned"] != true || body["viewerId"] != "bob" {
+		t.Errorf("unexpected body: %v", body)
+	}
+
+	// The banned ID is refused before any negotiation
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":"","viewerId":"bob"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("banned subscribe = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = doRequest(t, h, http.MethodPost, "/internal/room/abc/subscribe", `{"type":"offer","sdp":"","viewerId":"bad/id"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid viewerId subscribe = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// watchBroadcaster unpublishes the room if pc stays the broadcaster but
+// stops sending RTP for BroadcasterTimeout, as happens when a laptop sleeps
+// without closing the connection. It exits once pc is replaced or closed.
+func (s *Server) watchBroadcaster(room *Room, pc *webrtc.PeerConnection) {
+	timeout := s.cfg.BroadcasterTimeout
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	started := time.Now()
+	for range ticker.C {
+		if room.BroadcasterPC() != pc || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		if s.broadcasterIdle(room, started, time.Now()) {
+			room.broadcasterLog().Info("No RTP from broadcaster, ending broadcast", "timeout", timeout)
+			room.unpublish(pc)
+			return
+		}
+	}
+}
+
+// broadcasterIdle reports whether the room's broadcaster has gone
+// BroadcasterTimeout without a packet, counting from started if it has
+// never sent one
+func (s *Server) broadcasterIdle(room *Room, started, now time.Time) bool {
+	last := room.LastBroadcasterPacket()
+	if last.Before(started) {
+		last = started
+	}
+	return now.Sub(last) > s.cfg.BroadcasterTimeout
+}
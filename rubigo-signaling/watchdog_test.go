@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcasterIdle(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BroadcasterTimeout = 10 * time.Second
+	server := newServer(t, newFakeStore(), cfg)
+	room := &Room{id: "abc"}
+	started := time.Now()
+
+	if server.broadcasterIdle(room, started, started.Add(5*time.Second)) {
+		t.Error("idle before timeout with no packets")
+	}
+	if !server.broadcasterIdle(room, started, started.Add(11*time.Second)) {
+		t.Error("not idle after timeout with no packets")
+	}
+
+	room.touchBroadcaster()
+	last := room.LastBroadcasterPacket()
+	if last.IsZero() {
+		t.Fatal("touchBroadcaster did not record a packet")
+	}
+	if server.broadcasterIdle(room, started, last.Add(9*time.Second)) {
+		t.Error("idle within timeout of the last packet")
+	}
+	if !server.broadcasterIdle(room, started, last.Add(11*time.Second)) {
+		t.Error("not idle after timeout since the last packet")
+	}
+}
+
+func TestWatchBroadcasterUnpublishes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BroadcasterTimeout = 40 * time.Millisecond
+	server := newServer(t, newFakeStore(), cfg)
+
+	pc, _, err := server.peers.createPeerConnection("abc", "viewer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	room.SetBroadcaster(pc, nil, "")
+
+	done := make(chan struct{})
+	go func() {
+		server.watchBroadcaster(room, pc)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+
+	if room.GetBroadcasterTrack() != nil || room.BroadcasterPC() != nil {
+		t.Error("broadcast still live after watchdog fired")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Webhook delivery tuning
+const (
+	webhookQueueSize   = 256
+	webhookMaxAttempts = 3
+	webhookRetryDelay  = 500 * time.Millisecond
+	webhookTimeout     = 5 * time.Second
+)
+
+// Webhook request headers. With a secret configured, the signature is
+// "sha256=" and the hex HMAC-SHA256 of the timestamp, a '.' and the body, so
+// receivers can reject forged and replayed requests. The ID is the same
+// across retries of an event.
+const (
+	webhookIDHeader        = "X-Webhook-ID"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookEvent is the JSON body POSTed to the webhook URL
+type WebhookEvent struct {
+	Type   string    `json:"type"`
+	RoomID string    `json:"roomId"`
+	Role   string    `json:"role,omitempty"`
+	State  string    `json:"state,omitempty"`
+	Time   time.Time `json:"time"`
+	// Room events report the viewer count after the change, and the
+	// viewer of viewer_* events
+	ViewerCount *int   `json:"viewerCount,omitempty"`
+	ViewerID    string `json:"viewerId,omitempty"`
+	// Recording uploads report the file, and its URL or why it failed
+	File  string `json:"file,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// webhookNotifier delivers events to a webhook from a background worker so
+// a slow endpoint never blocks media or signaling
+type webhookNotifier struct {
+	mu         sync.Mutex
+	url        string // empty drops events
+	secret     []byte // signs requests; nil sends them unsigned
+	client     *http.Client
+	queue      chan WebhookEvent
+	retryDelay time.Duration
+	done       sync.WaitGroup
+}
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	n := &webhookNotifier{
+		url:        url,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan WebhookEvent, webhookQueueSize),
+		retryDelay: webhookRetryDelay,
+	}
+	if secret != "" {
+		n.secret = []byte(secret)
+	}
+	n.done.Add(1)
+	go n.run()
+	return n
+}
+
+// Notify queues an event for delivery. It is a no-op on a nil notifier and
+// drops the event if the queue is full.
+func (n *webhookNotifier) Notify(event WebhookEvent) {
+	if n == nil || n.target() == "" {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case n.queue <- event:
+	default:
+		roomLog(event.RoomID).Warn("Webhook queue full, dropping event", "event", event.Type)
+	}
+}
+
+// target returns the URL events are delivered to
+func (n *webhookNotifier) target() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.url
+}
+
+// setURL delivers events to url from now on, including those queued; empty
+// drops them. It is a no-op on a nil notifier.
+func (n *webhookNotifier) setURL(url string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.url = url
+}
+
+// notifyRoomEvent forwards a room's lifecycle event, from the room
+// manager's observer, e.g. broadcaster_started or room_deleted
+func (n *webhookNotifier) notifyRoomEvent(event RoomEvent) {
+	if n == nil {
+		return
+	}
+	count := event.ViewerCount
+	n.Notify(WebhookEvent{Type: event.Type, RoomID: event.RoomID, Time: event.Time, ViewerCount: &count, ViewerID: event.ViewerID})
+}
+
+// Close stops accepting events and waits for queued ones to be delivered
+func (n *webhookNotifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	n.done.Wait()
+}
+
+func (n *webhookNotifier) run() {
+	defer n.done.Done()
+	for event := range n.queue {
+		n.deliver(event)
+	}
+}
+
+// deliver POSTs one event, retrying with backoff up to webhookMaxAttempts
+func (n *webhookNotifier) deliver(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil || n.target() == "" {
+		return
+	}
+
+	id := newPeerID()
+	delay := n.retryDelay
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		err = n.post(id, body)
+		if err == nil {
+			return
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	roomLog(event.RoomID).Error("Webhook delivery failed", "event", event.Type, "attempts", webhookMaxAttempts, "err", err)
+}
+
+func (n *webhookNotifier) post(id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.target(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, id)
+	if n.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, webhookSignature(n.secret, timestamp, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the signature header value for body sent at
+// timestamp
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyConnectionState reports the connection transitions the control
+// plane cares about: connected, disconnected and failed
+func (s *Server) notifyConnectionState(roomID, role string, state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected,
+		webrtc.PeerConnectionStateDisconnected,
+		webrtc.PeerConnectionStateFailed:
+		s.webhook.Notify(WebhookEvent{
+			Type:   "connection_state",
+			RoomID: roomID,
+			Role:   role,
+			State:  state.String(),
+		})
+	}
+}
+
+// observeRoomEvent passes the events of the store's rooms to the debug
+// buffer and the webhook
+func (s *Server) observeRoomEvent(event RoomEvent) {
+	s.events.addRoomEvent(event)
+	s.webhook.notifyRoomEvent(event)
+}
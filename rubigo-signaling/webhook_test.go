@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var got WebhookEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < webhookMaxAttempts {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer hook.Close()
+
+	n := newWebhookNotifier(hook.URL, "")
+	n.retryDelay = time.Millisecond
+	n.Notify(WebhookEvent{Type: "connection_state", RoomID: "abc", Role: "viewer", State: "connected"})
+	n.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != webhookMaxAttempts {
+		t.Errorf("attempts = %d, want %d", attempts, webhookMaxAttempts)
+	}
+	if got.RoomID != "abc" || got.Role != "viewer" || got.State != "connected" || got.Time.IsZero() {
+		t.Errorf("unexpected event: %+v", got)
+	}
+}
+
+func TestWebhookNotifierGivesUp(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hook.Close()
+
+	n := newWebhookNotifier(hook.URL, "")
+	n.retryDelay = time.Millisecond
+	n.Notify(WebhookEvent{Type: "connection_state", RoomID: "abc"})
+	n.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != webhookMaxAttempts {
+		t.Errorf("attempts = %d, want %d", attempts, webhookMaxAttempts)
+	}
+}
+
+func TestNotifyConnectionStateFilters(t *testing.T) {
+	var mu sync.Mutex
+	var states []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		states = append(states, event.State)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	cfg := DefaultConfig()
+	cfg.WebhookURL = hook.URL
+	server, err := NewServer(newFakeStore(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []webrtc.PeerConnectionState{
+		webrtc.PeerConnectionStateConnecting,
+		webrtc.PeerConnectionStateConnected,
+		webrtc.PeerConnectionStateDisconnected,
+		webrtc.PeerConnectionStateFailed,
+		webrtc.PeerConnectionStateClosed,
+	} {
+		server.notifyConnectionState("abc", "broadcaster", state)
+	}
+	server.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"connected", "disconnected", "failed"}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("states = %v, want %v", states, want)
+			break
+		}
+	}
+}
+
+func TestNilWebhookNotifier(t *testing.T) {
+	var n *webhookNotifier
+	n.Notify(WebhookEvent{Type: "connection_state"})
+	n.Close()
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	var verified int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, r.Header.Get(webhookIDHeader))
+		if r.Header.Get(webhookSignatureHeader) == webhookSignature([]byte("s3cret"), timestamp, body) {
+			verified++
+		}
+		if len(ids) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer hook.Close()
+
+	n := newWebhookNotifier(hook.URL, "s3cret")
+	n.retryDelay = time.Millisecond
+	n.Notify(WebhookEvent{Type: EventBroadcasterStarted, RoomID: "abc"})
+	n.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("delivery IDs = %v, want one ID across the retry", ids)
+	}
+	if verified != 2 {
+		t.Errorf("%d of %d requests verified", verified, len(ids))
+	}
+
+	// A receiver's recomputed signature matches only the same secret
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000.{}"))
+	if got := webhookSignature([]byte("s3cret"), "1700000000", []byte("{}")); got != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature = %s", got)
+	}
+}
+
+func TestRoomLifecycleWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []WebhookEvent
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	cfg := DefaultConfig()
+	cfg.WebhookURL = hook.URL
+	store := NewRoomManager()
+	server, err := NewServer(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := server.Handler()
+	doRequest(t, h, http.MethodPost, "/internal/room", `{"roomId":"abc"}`)
+	room := store.Get("abc")
+	if err := room.AddViewer(&viewer{id: "alice", track: newLiveTrack(t)}); err != nil {
+		t.Fatal(err)
+	}
+	room.RemoveViewer("alice")
+	doRequest(t, h, http.MethodDelete, "/internal/room/abc", "")
+	server.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.RoomID != "abc" || event.Time.IsZero() {
+			t.Errorf("event = %+v", event)
+		}
+	}
+	want := []string{debugEventRoomCreated, EventViewerJoined, EventViewerLeft, debugEventRoomDeleted, EventRoomClosed}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", types, want)
+	}
+	if joined := events[1]; joined.ViewerID != "alice" || joined.ViewerCount == nil || *joined.ViewerCount != 1 {
+		t.Errorf("viewer_joined = %+v, want alice and a count of 1", joined)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// A minimal WebM muxer for recordings. The segment and its clusters are
+// written with unknown sizes, as browsers' MediaRecorder does, so nothing
+// is ever rewritten and a file cut short still plays up to its last block.
+
+// Matroska element IDs, marker bits included
+const (
+	ebmlHeaderID         = 0x1A45DFA3
+	ebmlVersionID        = 0x4286
+	ebmlReadVersionID    = 0x42F7
+	ebmlMaxIDLengthID    = 0x42F2
+	ebmlMaxSizeLengthID  = 0x42F3
+	ebmlDocTypeID        = 0x4282
+	ebmlDocTypeVersionID = 0x4287
+	ebmlDocTypeReadID    = 0x4285
+
+	mkvSegmentID        = 0x18538067
+	mkvInfoID           = 0x1549A966
+	mkvTimestampScaleID = 0x2AD7B1
+	mkvMuxingAppID      = 0x4D80
+	mkvWritingAppID     = 0x5741
+	mkvTracksID         = 0x1654AE6B
+	mkvTrackEntryID     = 0xAE
+	mkvTrackNumberID    = 0xD7
+	mkvTrackUIDID       = 0x73C5
+	mkvTrackTypeID      = 0x83
+	mkvCodecIDID        = 0x86
+	mkvCodecPrivateID   = 0x63A2
+	mkvCodecDelayID     = 0x56AA
+	mkvSeekPreRollID    = 0x56BB
+	mkvVideoID          = 0xE0
+	mkvPixelWidthID     = 0xB0
+	mkvPixelHeightID    = 0xBA
+	mkvAudioID          = 0xE1
+	mkvSamplingFreqID   = 0xB5
+	mkvChannelsID       = 0x9F
+	mkvClusterID        = 0x1F43B675
+	mkvClusterTimeID    = 0xE7
+	mkvSimpleBlockID    = 0xA3
+)
+
+const (
+	mkvTrackTypeVideo = 1
+	mkvTrackTypeAudio = 2
+	// mkvKeyframeFlag marks a SimpleBlock as a keyframe
+	mkvKeyframeFlag = 0x80
+)
+
+// ebmlUnknownSize is the size of an element that runs until its parent's
+// next child, or the end of the file
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// webmTrack describes one track of a WebM file
+type webmTrack struct {
+	number       uint64
+	video        bool
+	codecID      string // V_VP8, V_VP9 or A_OPUS
+	codecPrivate []byte
+	// For video tracks
+	width, height int
+	// For audio tracks
+	sampleRate float64
+	channels   int
+	codecDelay time.Duration
+	preRoll    time.Duration
+}
+
+// opusTrack is the Opus audio track WebRTC negotiates: 48kHz stereo
+func opusTrack(number uint64) webmTrack {
+	// OpusHead (RFC 7845): version 1, two channels, 3840 samples of
+	// pre-skip at 48kHz, no gain, channel mapping family 0
+	head := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0, 0, 0x80, 0xBB, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(head[10:], 3840)
+	return webmTrack{
+		number:       number,
+		codecID:      "A_OPUS",
+		codecPrivate: head,
+		sampleRate:   48000,
+		channels:     2,
+		codecDelay:   80 * time.Millisecond,
+		preRoll:      80 * time.Millisecond,
+	}
+}
+
+// webmWriter writes blocks to a WebM file. It is not safe for concurrent
+// use.
+type webmWriter struct {
+	w       io.WriteCloser
+	video   map[uint64]bool
+	started bool // a cluster has been written
+	// cluster is the timestamp blocks in the current cluster are relative to
+	cluster time.Duration
+}
+
+// newWebMWriter writes the WebM header for tracks to w
+func newWebMWriter(w io.WriteCloser, tracks []webmTrack) (*webmWriter, error) {
+	header := ebmlMaster(ebmlHeaderID,
+		ebmlUint(ebmlVersionID, 1),
+		ebmlUint(ebmlReadVersionID, 1),
+		ebmlUint(ebmlMaxIDLengthID, 4),
+		ebmlUint(ebmlMaxSizeLengthID, 8),
+		ebmlString(ebmlDocTypeID, "webm"),
+		ebmlUint(ebmlDocTypeVersionID, 4),
+		ebmlUint(ebmlDocTypeReadID, 2),
+	)
+	header = append(header, ebmlID(mkvSegmentID)...)
+	header = append(header, ebmlUnknownSize...)
+	header = append(header, ebmlMaster(mkvInfoID,
+		ebmlUint(mkvTimestampScaleID, uint64(time.Millisecond)),
+		ebmlString(mkvMuxingAppID, "rubigo-signaling"),
+		ebmlString(mkvWritingAppID, "rubigo-signaling"),
+	)...)
+
+	writer := &webmWriter{w: w, video: make(map[uint64]bool)}
+	var entries [][]byte
+	for _, t := range tracks {
+		entry := [][]byte{
+			ebmlUint(mkvTrackNumberID, t.number),
+			ebmlUint(mkvTrackUIDID, t.number),
+			ebmlString(mkvCodecIDID, t.codecID),
+		}
+		if len(t.codecPrivate) > 0 {
+			entry = append(entry, ebmlElement(mkvCodecPrivateID, t.codecPrivate))
+		}
+		if t.video {
+			writer.video[t.number] = true
+			entry = append(entry,
+				ebmlUint(mkvTrackTypeID, mkvTrackTypeVideo),
+				ebmlMaster(mkvVideoID,
+					ebmlUint(mkvPixelWidthID, uint64(t.width)),
+					ebmlUint(mkvPixelHeightID, uint64(t.height)),
+				))
+		} else {
+			entry = append(entry,
+				ebmlUint(mkvTrackTypeID, mkvTrackTypeAudio),
+				ebmlUint(mkvCodecDelayID, uint64(t.codecDelay)),
+				ebmlUint(mkvSeekPreRollID, uint64(t.preRoll)),
+				ebmlMaster(mkvAudioID,
+					ebmlFloat(mkvSamplingFreqID, t.sampleRate),
+					ebmlUint(mkvChannelsID, uint64(t.channels)),
+				))
+		}
+		entries = append(entries, ebmlMaster(mkvTrackEntryID, entry...))
+	}
+	header = append(header, ebmlMaster(mkvTracksID, entries...)...)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// writeBlock writes a frame of track at timestamp, from the start of the
+// file. Video keyframes start a new cluster so players can seek to them.
+func (w *webmWriter) writeBlock(track uint64, timestamp time.Duration, keyframe bool, frame []byte) error {
+	timestamp = timestamp.Truncate(time.Millisecond)
+	relative := (timestamp - w.cluster) / time.Millisecond
+	if !w.started || (keyframe && w.video[track]) || relative < 0 || relative > math.MaxInt16 {
+		cluster := append(ebmlID(mkvClusterID), ebmlUnknownSize...)
+		cluster = append(cluster, ebmlUint(mkvClusterTimeID, uint64(timestamp/time.Millisecond))...)
+		if _, err := w.w.Write(cluster); err != nil {
+			return err
+		}
+		w.started, w.cluster, relative = true, timestamp, 0
+	}
+
+	// Track number, timestamp relative to the cluster, flags
+	block := make([]byte, 0, len(frame)+4)
+	block = append(block, ebmlSize(track)...)
+	block = binary.BigEndian.AppendUint16(block, uint16(int16(relative)))
+	if keyframe {
+		block = append(block, mkvKeyframeFlag)
+	} else {
+		block = append(block, 0)
+	}
+	block = append(block, frame...)
+	_, err := w.w.Write(ebmlElement(mkvSimpleBlockID, block))
+	return err
+}
+
+// Close closes the underlying file
+func (w *webmWriter) Close() error {
+	return w.w.Close()
+}
+
+// ebmlID encodes an element ID, which carries its own length marker
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize encodes n as a variable-length integer in as few bytes as it
+// fits, avoiding the all-ones value that means an unknown size
+func ebmlSize(n uint64) []byte {
+	length := 1
+	for length < 8 && n >= 1<<(7*uint(length))-1 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] |= 0x80 >> uint(length-1)
+	return b
+}
+
+func ebmlElement(id uint32, data []byte) []byte {
+	out := append(ebmlID(id), ebmlSize(uint64(len(data)))...)
+	return append(out, data...)
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+	var data []byte
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	data := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		data = append([]byte{byte(v)}, data...)
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
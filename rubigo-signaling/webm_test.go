@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+	"testing"
+	"time"
+)
+
+// ebmlElem is an element of a parsed WebM file; masters have no data
+type ebmlElem struct {
+	id   uint32
+	data []byte
+}
+
+// readEBML flattens a WebM file into its elements in file order, with each
+// master element followed by its children
+func readEBML(t *testing.T, data []byte) []ebmlElem {
+	t.Helper()
+	masters := map[uint32]bool{
+		ebmlHeaderID: true, mkvSegmentID: true, mkvInfoID: true, mkvTracksID: true,
+		mkvTrackEntryID: true, mkvVideoID: true, mkvAudioID: true, mkvClusterID: true,
+	}
+	var elems []ebmlElem
+	for len(data) > 0 {
+		idLen := bits.LeadingZeros8(data[0]) + 1
+		sizeLen := 0
+		if len(data) > idLen {
+			sizeLen = bits.LeadingZeros8(data[idLen]) + 1
+		}
+		if idLen > 4 || sizeLen == 0 || sizeLen > 8 || len(data) < idLen+sizeLen {
+			t.Fatalf("malformed element at % x", data[:min(len(data), 8)])
+		}
+		var id uint32
+		for _, b := range data[:idLen] {
+			id = id<<8 | uint32(b)
+		}
+		size := uint64(data[idLen] & (0xFF >> uint(sizeLen)))
+		for _, b := range data[idLen+1 : idLen+sizeLen] {
+			size = size<<8 | uint64(b)
+		}
+		data = data[idLen+sizeLen:]
+
+		if masters[id] {
+			elems = append(elems, ebmlElem{id: id})
+			continue
+		}
+		if size > uint64(len(data)) {
+			t.Fatalf("element %x overruns the file", id)
+		}
+		elems = append(elems, ebmlElem{id: id, data: data[:size]})
+		data = data[size:]
+	}
+	return elems
+}
+
+// ebmlFind returns the data of every element with id
+func ebmlFind(elems []ebmlElem, id uint32) [][]byte {
+	var found [][]byte
+	for _, e := range elems {
+		if e.id == id {
+			found = append(found, e.data)
+		}
+	}
+	return found
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestEBMLSize(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		// 127 in one byte would be all ones, the unknown size
+		{127, []byte{0x40, 0x7F}},
+		{300, []byte{0x41, 0x2C}},
+		{1 << 20, []byte{0x30, 0x00, 0x00}},
+		{1 << 21, []byte{0x10, 0x20, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := ebmlSize(tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("ebmlSize(%d) = % x, want % x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestWebMWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newWebMWriter(nopWriteCloser{&buf}, []webmTrack{
+		{number: 1, video: true, codecID: "V_VP8", width: 1280, height: 720},
+		opusTrack(2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := []struct {
+		track    uint64
+		at       time.Duration
+		keyframe bool
+	}{
+		{1, 0, true},
+		{2, 10 * time.Millisecond, true},
+		{1, 33 * time.Millisecond, false},
+		{1, time.Second, true},
+		// Too far from the cluster start for a 16-bit offset
+		{2, 40 * time.Second, true},
+	}
+	for _, b := range blocks {
+		if err := w.writeBlock(b.track, b.at, b.keyframe, []byte{0xAA}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	elems := readEBML(t, buf.Bytes())
+	if docType := ebmlFind(elems, ebmlDocTypeID); len(docType) != 1 || string(docType[0]) != "webm" {
+		t.Errorf("DocType = %q, want webm", docType)
+	}
+	codecs := ebmlFind(elems, mkvCodecIDID)
+	if len(codecs) != 2 || string(codecs[0]) != "V_VP8" || string(codecs[1]) != "A_OPUS" {
+		t.Errorf("codecs = %q", codecs)
+	}
+	if width := ebmlFind(elems, mkvPixelWidthID); len(width) != 1 || !bytes.Equal(width[0], []byte{0x05, 0x00}) {
+		t.Errorf("PixelWidth = % x, want 05 00", width)
+	}
+	if head := ebmlFind(elems, mkvCodecPrivateID); len(head) != 1 || !bytes.HasPrefix(head[0], []byte("OpusHead")) || len(head[0]) != 19 {
+		t.Errorf("Opus CodecPrivate = % x", head)
+	}
+
+	// Clusters start at the first block, the second keyframe and the
+	// block too late for the second cluster
+	clusterTimes := ebmlFind(elems, mkvClusterTimeID)
+	wantTimes := [][]byte{{0}, {0x03, 0xE8}, {0x9C, 0x40}}
+	if len(clusterTimes) != len(wantTimes) {
+		t.Fatalf("cluster timestamps = % x, want % x", clusterTimes, wantTimes)
+	}
+	for i := range wantTimes {
+		if !bytes.Equal(clusterTimes[i], wantTimes[i]) {
+			t.Errorf("cluster %d timestamp = % x, want % x", i, clusterTimes[i], wantTimes[i])
+		}
+	}
+
+	simple := ebmlFind(elems, mkvSimpleBlockID)
+	wantBlocks := [][]byte{
+		{0x81, 0, 0, 0x80, 0xAA},
+		{0x82, 0, 10, 0x80, 0xAA},
+		{0x81, 0, 33, 0, 0xAA},
+		{0x81, 0, 0, 0x80, 0xAA},
+		{0x82, 0, 0, 0x80, 0xAA},
+	}
+	if len(simple) != len(wantBlocks) {
+		t.Fatalf("got %d blocks, want %d", len(simple), len(wantBlocks))
+	}
+	for i := range wantBlocks {
+		if !bytes.Equal(simple[i], wantBlocks[i]) {
+			t.Errorf("block %d = % x, want % x", i, simple[i], wantBlocks[i])
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEP is WHIP's counterpart for playback, so standard players and web
+// components can watch a room with a plain SDP offer:
+//
+//	POST   /whep/{roomId}              offer in, 201 with the answer and a Location
+//	PATCH  /whep/{roomId}/{sessionId}  trickle candidates or an ICE restart
+//	DELETE /whep/{roomId}/{sessionId}  ends the playback session
+//
+// PATCH bodies are SDP fragments (RFC 8840). A fragment with the viewer's
+// current ICE credentials only adds candidates; new credentials restart
+// ICE, and the response carries ours.
+
+const iceFragmentContentType = "application/trickle-ice-sdpfrag"
+
+// iceFragment is the ICE part of an SDP fragment
+type iceFragment struct {
+	ufrag, pwd string
+	candidates []webrtc.ICECandidateInit
+}
+
+// parseICEFragment reads the credentials and candidates from an SDP
+// fragment
+func parseICEFragment(body string) (iceFragment, error) {
+	var frag iceFragment
+	mid, index := "", -1
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidateMid := mid
+				candidate.SDPMid = &candidateMid
+			}
+			if index >= 0 {
+				candidateIndex := uint16(index)
+				candidate.SDPMLineIndex = &candidateIndex
+			}
+			frag.candidates = append(frag.candidates, candidate)
+		}
+	}
+	if (frag.ufrag == "") != (frag.pwd == "") {
+		return iceFragment{}, errors.New("ice-ufrag and ice-pwd must be given together")
+	}
+	return frag, nil
+}
+
+// iceCredentials returns the ICE ufrag and password of desc, from the
+// session or its first media section
+func iceCredentials(desc *sdp.SessionDescription) (ufrag, pwd string) {
+	ufrag, _ = desc.Attribute("ice-ufrag")
+	pwd, _ = desc.Attribute("ice-pwd")
+	if ufrag == "" && len(desc.MediaDescriptions) > 0 {
+		ufrag, _ = desc.MediaDescriptions[0].Attribute("ice-ufrag")
+		pwd, _ = desc.MediaDescriptions[0].Attribute("ice-pwd")
+	}
+	return ufrag, pwd
+}
+
+// formatICEFragment returns the SDP fragment carrying the ICE credentials
+// and candidates of description. Media is bundled, so the first media
+// section has all of them.
+func formatICEFragment(description string) (string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(description)); err != nil {
+		return "", err
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return "", errors.New("no media sections")
+	}
+	ufrag, pwd := iceCredentials(&desc)
+	media := desc.MediaDescriptions[0]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", ufrag, pwd)
+	fmt.Fprintf(&b, "m=%s\r\n", media.MediaName.String())
+	if mid, ok := media.Attribute("mid"); ok {
+		fmt.Fprintf(&b, "a=mid:%s\r\n", mid)
+	}
+	for _, attr := range media.Attributes {
+		if attr.Key == "candidate" {
+			fmt.Fprintf(&b, "a=candidate:%s\r\n", attr.Value)
+		}
+	}
+	b.WriteString("a=end-of-candidates\r\n")
+	return b.String(), nil
+}
+
+// withICEFragment returns description with its ICE credentials replaced by
+// frag's and its candidates dropped, for replaying an offer as an ICE
+// restart
+func withICEFragment(description string, frag iceFragment) (string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(description)); err != nil {
+		return "", err
+	}
+	replace := func(attrs []sdp.Attribute) []sdp.Attribute {
+		out := make([]sdp.Attribute, 0, len(attrs))
+		for _, attr := range attrs {
+			switch attr.Key {
+			case "ice-ufrag":
+				attr.Value = frag.ufrag
+			case "ice-pwd":
+				attr.Value = frag.pwd
+			case "candidate", "end-of-candidates":
+				continue
+			}
+			out = append(out, attr)
+		}
+		return out
+	}
+	desc.Attributes = replace(desc.Attributes)
+	for _, media := range desc.MediaDescriptions {
+		media.Attributes = replace(media.Attributes)
+	}
+	out, err := desc.Marshal()
+	return string(out), err
+}
+
+// iceETag is the entity tag of a WHEP session: it changes with each ICE
+// restart, so a PATCH meant for an earlier ICE session can be refused
+func iceETag(pc *webrtc.PeerConnection) string {
+	local := pc.LocalDescription()
+	if local == nil {
+		return ""
+	}
+	desc, err := local.Unmarshal()
+	if err != nil {
+		return ""
+	}
+	ufrag, _ := iceCredentials(desc)
+	return `"` + ufrag + `"`
+}
+
+// handleWHEP routes /whep/{roomId} and /whep/{roomId}/{sessionId}
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whep/"), "/")
+	roomID := parts[0]
+	if roomID == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown WHEP resource")
+		return
+	}
+	if !s.validRoomID(roomID) {
+		writeInvalidRoomID(w, s.cfg.RoomIDPattern)
+		return
+	}
+
+	if len(parts) == 1 {
+		if !allowMethod(w, r, http.MethodPost) || !s.routeToOwner(w, r, roomID, false) {
+			return
+		}
+		s.limitSDP(s.traced("whep.subscribe", s.requireToken(roleViewer, s.handleWHEPSubscribe)))(w, r, roomID)
+		return
+	}
+	if !allowMethod(w, r, http.MethodPatch, http.MethodDelete) || !s.routeToOwner(w, r, roomID, false) {
+		return
+	}
+	if r.Method == http.MethodPatch {
+		s.handleWHEPPatch(w, r, roomID, parts[1])
+		return
+	}
+	s.handleWHEPDelete(w, r, roomID, parts[1])
+}
+
+// handleWHEPSubscribe handles POST /whep/{roomId}
+// ?layer= picks a simulcast layer and ?wait=true waits for the
+// broadcaster, as for subscribe. Without JWT auth, the bearer token is
+// the room password.
+func (s *Server) handleWHEPSubscribe(w http.ResponseWriter, r *http.Request, roomID string) {
+	start := time.Now()
+
+	body, ok := s.readSDP(w, r, sdpContentType)
+	if !ok {
+		return
+	}
+	offer := SDPExchange{Type: "offer", SDP: body, Layer: r.URL.Query().Get("layer")}
+	if s.auth == nil {
+		offer.Password = bearerToken(r)
+	}
+
+	v, answer := s.subscribe(w, r, roomID, offer, nil, start)
+	if v == nil {
+		return
+	}
+	id := s.whep.add(roomID, v.id, v.pc)
+
+	for _, link := range iceServerLinks(v.pc.GetConfiguration().ICEServers) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Location", "/whep/"+roomID+"/"+id)
+	w.Header().Set("ETag", iceETag(v.pc))
+	w.Header().Set("Content-Type", sdpContentType)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// handleWHEPPatch handles PATCH /whep/{roomId}/{sessionId}
+// Adds the viewer's trickled candidates, or restarts ICE when the
+// fragment has new credentials
+func (s *Server) handleWHEPPatch(w http.ResponseWriter, r *http.Request, roomID, sessionID string) {
+	session, ok := s.whep.get(roomID, sessionID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeSessionNotFound, "WHEP session not found")
+		return
+	}
+	body, ok := s.readSDP(w, r, iceFragmentContentType)
+	if !ok {
+		return
+	}
+	frag, err := parseICEFragment(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Invalid SDP fragment: %v", err))
+		return
+	}
+	pc, logger := session.pc, peerLog(roomID, "viewer", session.peerID)
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != iceETag(pc) {
+		writeError(w, http.StatusPreconditionFailed, errCodePrecondition, "ICE session has changed")
+		return
+	}
+
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		writeError(w, http.StatusConflict, errCodeRenegotiating, "Session is not negotiated")
+		return
+	}
+	remoteDesc, err := remote.Unmarshal()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to parse remote description: %v", err))
+		return
+	}
+	if ufrag, _ := iceCredentials(remoteDesc); frag.ufrag == "" || frag.ufrag == ufrag {
+		for _, candidate := range frag.candidates {
+			if err := pc.AddICECandidate(candidate); err != nil {
+				writeError(w, http.StatusBadRequest, errCodeInvalidSDP, fmt.Sprintf("Invalid candidate: %v", err))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// An ICE restart replays the viewer's offer with its new credentials
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		writeError(w, http.StatusConflict, errCodeRenegotiating, "Session is renegotiating")
+		return
+	}
+	restart, err := withICEFragment(remote.SDP, frag)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to build restart offer: %v", err))
+		return
+	}
+	gatherComplete, err := s.answerOffer(r.Context(), pc, restart, nil)
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	for _, candidate := range frag.candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			logger.Warn("Ignoring WHEP candidate", "err", err)
+		}
+	}
+	if !s.waitForGathering(r.Context(), pc, gatherComplete, logger) {
+		writeError(w, http.StatusGatewayTimeout, errCodeICETimeout, "ICE gathering timed out")
+		return
+	}
+	answer, err := formatICEFragment(pc.LocalDescription().SDP)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to build answer: %v", err))
+		return
+	}
+	logger.Info("WHEP session restarted ICE")
+
+	w.Header().Set("ETag", iceETag(pc))
+	w.Header().Set("Content-Type", iceFragmentContentType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, answer)
+}
+
+// handleWHEPDelete handles DELETE /whep/{roomId}/{sessionId}
+// Closing the connection releases the viewer
+func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request, roomID, sessionID string) {
+	session, ok := s.whep.remove(roomID, sessionID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeSessionNotFound, "WHEP session not found")
+		return
+	}
+	session.pc.Close()
+	peerLog(roomID, "viewer", session.peerID).Info("WHEP session ended")
+	w.WriteHeader(http.StatusOK)
+}
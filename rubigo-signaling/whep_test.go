@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// doFragmentRequest sends a PATCH with an SDP fragment body
+func doFragmentRequest(h http.Handler, path, body, ifMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", iceFragmentContentType)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// gatheredOffer sets and returns pc's offer once its candidates are in
+func gatheredOffer(t *testing.T, pc *webrtc.PeerConnection, options *webrtc.OfferOptions) string {
+	t.Helper()
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+// waitConnected waits for pc to reach the connected state
+func waitConnected(t *testing.T, pc *webrtc.PeerConnection) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection state = %s, want connected", pc.ConnectionState())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWHEPSession(t *testing.T) {
+	store := newFakeStore()
+	room := &Room{id: "abc", broadcasterTracks: map[string]*forwardingTrack{"": newLiveTrack(t)}}
+	store.rooms["abc"] = room
+	h := newTestServer(t, store)
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doSDPRequest(h, http.MethodPost, "/whep/abc", gatheredOffer(t, client, nil), "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != sdpContentType {
+		t.Errorf("Content-Type = %q, want %s", ct, sdpContentType)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whep/abc/") {
+		t.Fatalf("Location = %q", location)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Error("no ETag")
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: rec.Body.String()}); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, client)
+	if n := room.ViewerCount(); n != 1 {
+		t.Fatalf("ViewerCount = %d, want 1", n)
+	}
+
+	// Trickled candidates for the current ICE session are just added
+	current, err := formatICEFragment(client.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doFragmentRequest(h, location, current, etag); rec.Code != http.StatusNoContent {
+		t.Errorf("trickle PATCH = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+	if rec := doFragmentRequest(h, location, current, `"stale"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match = %d, want %d", rec.Code, http.StatusPreconditionFailed)
+	}
+	if rec := doSDPRequest(h, http.MethodPatch, location, current, ""); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH with application/sdp = %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+
+	// New credentials restart ICE, and the answer fragment has ours
+	restart, err := formatICEFragment(gatheredOffer(t, client, &webrtc.OfferOptions{ICERestart: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = doFragmentRequest(h, location, restart, "*")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restart PATCH = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != iceFragmentContentType {
+		t.Errorf("Content-Type = %q, want %s", ct, iceFragmentContentType)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Error("ETag unchanged by ICE restart")
+	}
+	frag, err := parseICEFragment(rec.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frag.candidates) == 0 {
+		t.Error("restart answer has no candidates")
+	}
+	answer, err := withICEFragment(client.RemoteDescription().SDP, frag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range frag.candidates {
+		if err := client.AddICECandidate(candidate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitConnected(t, client)
+
+	if rec := doSDPRequest(h, http.MethodDelete, location, "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d, want %d", rec.Code, http.StatusOK)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for room.ViewerCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("viewer still registered after DELETE")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if rec := doSDPRequest(h, http.MethodDelete, location, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doFragmentRequest(h, location, restart, "*"); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH after DELETE = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestWHEPErrors(t *testing.T) {
+	h := newTestServer(t, newFakeStore("empty"))
+
+	if rec := doSDPRequest(h, http.MethodPost, "/whep/missing", newOffer(t), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown room = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	rec := doSDPRequest(h, http.MethodPost, "/whep/empty", newOffer(t), "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("no broadcaster = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	decodeError(t, rec, errCodeNoBroadcaster)
+	if rec := doSDPRequest(h, http.MethodGet, "/whep/empty", "", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if rec := doSDPRequest(h, http.MethodPost, "/whep/empty/a/b", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("nested path = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestParseICEFragment(t *testing.T) {
+	frag, err := parseICEFragment("a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=audio 9 RTP/AVP 0\r\na=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\na=end-of-candidates\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag.ufrag != "EsAw" || frag.pwd != "P2uYro0UCOQ4zxjKXaWCBui1" {
+		t.Errorf("credentials = %q/%q", frag.ufrag, frag.pwd)
+	}
+	if len(frag.candidates) != 1 {
+		t.Fatalf("candidates = %v, want 1", frag.candidates)
+	}
+	c := frag.candidates[0]
+	if !strings.HasPrefix(c.Candidate, "candidate:1387637174 ") || c.SDPMid == nil || *c.SDPMid != "0" || c.SDPMLineIndex == nil || *c.SDPMLineIndex != 0 {
+		t.Errorf("candidate = %+v", c)
+	}
+
+	if _, err := parseICEFragment("a=ice-ufrag:EsAw\r\n"); err == nil {
+		t.Error("ufrag without a password accepted")
+	}
+}
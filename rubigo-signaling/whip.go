@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHIP (RFC 9725) lets OBS, GStreamer's whipsink and hardware encoders
+// publish with a plain SDP offer instead of our JSON envelope:
+//
+//	POST   /whip/{roomId}              offer in, 201 with the answer and a Location
+//	DELETE /whip/{roomId}/{sessionId}  ends the broadcast
+//
+// Candidates are gathered before answering, so there is no trickle ICE;
+// PATCH on a session is answered 405 as the RFC asks.
+
+const sdpContentType = "application/sdp"
+
+// sdpSession is a connection negotiated over WHIP or WHEP
+type sdpSession struct {
+	roomID string
+	peerID string
+	pc     *webrtc.PeerConnection
+}
+
+// sdpSessions maps WHIP or WHEP session IDs to their connections
+type sdpSessions struct {
+	mu       sync.Mutex
+	sessions map[string]sdpSession
+}
+
+// add registers pc, the connection of peerID, under a new session ID,
+// dropping sessions whose connections have since closed
+func (w *sdpSessions) add(roomID, peerID string, pc *webrtc.PeerConnection) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for id, session := range w.sessions {
+		if session.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			delete(w.sessions, id)
+		}
+	}
+	if w.sessions == nil {
+		w.sessions = make(map[string]sdpSession)
+	}
+	id := newSessionID()
+	w.sessions[id] = sdpSession{roomID: roomID, peerID: peerID, pc: pc}
+	return id
+}
+
+// remove unregisters and returns the session id in roomID
+func (w *sdpSessions) remove(roomID, id string) (sdpSession, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	session, ok := w.sessions[id]
+	if !ok || session.roomID != roomID {
+		return sdpSession{}, false
+	}
+	delete(w.sessions, id)
+	return session, true
+}
+
+// get returns the session id in roomID
+func (w *sdpSessions) get(roomID, id string) (sdpSession, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	session, ok := w.sessions[id]
+	if !ok || session.roomID != roomID {
+		return sdpSession{}, false
+	}
+	return session, true
+}
+
+// newSessionID returns a random, unguessable session ID. Knowing it
+// is enough to end the session.
+func newSessionID() string {
+	return randomHex(16)
+}
+
+// readSDP reads a request body of contentType, application/sdp or an SDP
+// fragment, writing the error response if it isn't one
+func (s *Server) readSDP(w http.ResponseWriter, r *http.Request, contentType string) (string, bool) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != contentType {
+		writeError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia, "Content-Type must be "+contentType)
+		return "", false
+	}
+	if s.cfg.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErrorDetails(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large",
+				map[string]interface{}{"maxBytes": tooLarge.Limit})
+			return "", false
+		}
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Failed to read body: %v", err))
+		return "", false
+	}
+	return string(body), true
+}
+
+// iceServerLinks returns Link header values advertising servers to the
+// client, as RFC 9725 section 4.6 describes
+func iceServerLinks(servers []webrtc.ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if credential, ok := server.Credential.(string); ok && server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`, server.Username, credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// handleWHIP routes /whip/{roomId} and /whip/{roomId}/{sessionId}
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+	roomID := parts[0]
+	if roomID == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, errCodeUnknownAction, "Unknown WHIP resource")
+		return
+	}
+	if !s.validRoomID(roomID) {
+		writeInvalidRoomID(w, s.cfg.RoomIDPattern)
+		return
+	}
+
+	if len(parts) == 1 {
+		if !allowMethod(w, r, http.MethodPost) || !s.routeToOwner(w, r, roomID, true) {
+			return
+		}
+		s.limitSDP(s.traced("whip.publish", s.requireToken(roleBroadcaster, s.handleWHIPPublish)))(w, r, roomID)
+		return
+	}
+	// Neither trickle ICE nor ICE restarts are supported
+	if !allowMethod(w, r, http.MethodDelete) || !s.routeToOwner(w, r, roomID, false) {
+		return
+	}
+	s.handleWHIPDelete(w, r, roomID, parts[1])
+}
+
+// handleWHIPPublish handles POST /whip/{roomId}
+// Without JWT auth, the bearer token is the room password
+func (s *Server) handleWHIPPublish(w http.ResponseWriter, r *http.Request, roomID string) {
+	if s.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, errCodeDraining, "Server is draining")
+		return
+	}
+	sdp, ok := s.readSDP(w, r, sdpContentType)
+	if !ok {
+		return
+	}
+	offer := SDPExchange{Type: "offer", SDP: sdp}
+	if s.auth == nil {
+		offer.Password = bearerToken(r)
+	}
+
+	peerID := newPeerID()
+	pc, _ := s.publish(w, r, roomID, peerID, offer)
+	if pc == nil {
+		return
+	}
+	id := s.whip.add(roomID, peerID, pc)
+
+	for _, link := range iceServerLinks(pc.GetConfiguration().ICEServers) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Location", "/whip/"+roomID+"/"+id)
+	w.Header().Set("Content-Type", sdpContentType)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP)
+}
+
+// handleWHIPDelete handles DELETE /whip/{roomId}/{sessionId}
+// Ends the broadcast if the session is still the room's broadcaster
+func (s *Server) handleWHIPDelete(w http.ResponseWriter, r *http.Request, roomID, sessionID string) {
+	session, ok := s.whip.remove(roomID, sessionID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeSessionNotFound, "WHIP session not found")
+		return
+	}
+	if room := s.rooms.Get(roomID); room != nil && room.unpublish(session.pc) {
+		peerLog(roomID, "broadcaster", session.peerID).Info("WHIP session ended")
+	} else {
+		// Replaced by a later publish; only this connection goes
+		session.pc.Close()
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// doSDPRequest sends body as application/sdp, with token as the bearer
+// token if set
+func doSDPRequest(h http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", sdpContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWHIPPublish(t *testing.T) {
+	store := newFakeStore()
+	h := newTestServer(t, store)
+
+	rec := doSDPRequest(h, http.MethodPost, "/whip/abc", newOffer(t), "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != sdpContentType {
+		t.Errorf("Content-Type = %q, want %s", ct, sdpContentType)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "v=0") {
+		t.Errorf("body is not an SDP answer: %q", rec.Body.String())
+	}
+	links := rec.Header().Values("Link")
+	if len(links) == 0 || !strings.Contains(links[0], `rel="ice-server"`) {
+		t.Errorf("Link = %v, want the ICE servers", links)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whip/abc/") {
+		t.Fatalf("Location = %q", location)
+	}
+	room := store.Get("abc")
+	if room == nil || room.BroadcasterPC() == nil {
+		t.Fatal("WHIP publish did not make a broadcaster")
+	}
+
+	// Trickle ICE and ICE restarts are not supported
+	if rec := doSDPRequest(h, http.MethodPatch, location, "", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if rec := doSDPRequest(h, http.MethodDelete, "/whip/other/"+strings.TrimPrefix(location, "/whip/abc/"), "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE in another room = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := doSDPRequest(h, http.MethodDelete, location, "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if room.BroadcasterPC() != nil {
+		t.Error("broadcaster still set after DELETE")
+	}
+	if rec := doSDPRequest(h, http.MethodDelete, location, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestWHIPErrors(t *testing.T) {
+	store := newFakeStore("locked")
+	hash, err := hashRoomPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Get("locked").SetPasswordHash(hash)
+	h := newTestServer(t, store)
+
+	// JSON is for the internal publish endpoint
+	req := httptest.NewRequest(http.MethodPost, "/whip/abc", strings.NewReader(`{"type":"offer"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("JSON offer = %d, want %d", rec.Code, http.StatusUnsupportedMediaType)
+	}
+	decodeError(t, rec, errCodeUnsupportedMedia)
+
+	if rec := doSDPRequest(h, http.MethodPost, "/whip/abc", "garbage", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid SDP = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := doSDPRequest(h, http.MethodGet, "/whip/abc", "", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// The bearer token carries the room password
+	if rec := doSDPRequest(h, http.MethodPost, "/whip/locked", newOffer(t), "wrong"); rec.Code != http.StatusForbidden {
+		t.Errorf("wrong password = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = doSDPRequest(h, http.MethodPost, "/whip/locked", newOffer(t), "secret")
+	if rec.Code != http.StatusCreated {
+		t.Errorf("right password = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if pc := store.Get("locked").BroadcasterPC(); pc != nil {
+		pc.Close()
+	}
+}
+
+func TestICEServerLinks(t *testing.T) {
+	links := iceServerLinks([]webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.com"}},
+		{URLs: []string{"turn:turn.example.com?transport=tcp"}, Username: "u", Credential: "p"},
+	})
+	want := []string{
+		`<stun:stun.example.com>; rel="ice-server"`,
+		`<turn:turn.example.com?transport=tcp>; rel="ice-server"; username="u"; credential="p"; credential-type="password"`,
+	}
+	if strings.Join(links, "\n") != strings.Join(want, "\n") {
+		t.Errorf("links = %q, want %q", links, want)
+	}
+}